@@ -0,0 +1,99 @@
+// Command deploy-agent runs on an app host and keeps its compose project on
+// the current release (see package agent for its configuration):
+//
+//	deploy-agent                   poll and deploy
+//	deploy-agent once              poll once
+//	deploy-agent rollback [tag]    deploy tag (default: the previous release) and pin to it
+//	deploy-agent resume            unpin and follow the current release again
+//	deploy-agent retry [step]      run the last rollout again from its failed step,
+//	                               or from step (render, pull, restart or verify)
+//	deploy-agent status            print what is deployed
+//	deploy-agent journal           print the steps of the last rollout
+//
+// With AGENT_BOOTSTRAP_TOKEN and AGENT_CA_HASH (from "todoctl agent token
+// <AGENT_NAME>") it first enrolls for a client certificate and talks mTLS
+// from then on. With AGENT_MANIFEST_REPOSITORY it reads releases from the
+// registry the releaser publishes them to, checking their signatures
+// against AGENT_MANIFEST_KEYS, and only reports to the releaser.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/velann21/todo-releaser/internal/agent"
+)
+
+const usage = "usage: deploy-agent [once | rollback [tag] | resume | retry [step] | status | journal]\n"
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lmsgprefix)
+	log.SetPrefix("deploy-agent: ")
+
+	conf, err := agent.ConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	a, err := agent.New(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := a.Enroll(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	cmd := ""
+	if len(os.Args) > 1 {
+		cmd = os.Args[1]
+	}
+	switch cmd {
+	case "":
+		err = a.Run(ctx)
+	case "once":
+		err = a.Poll(ctx)
+	case "rollback":
+		tag := ""
+		if len(os.Args) > 2 {
+			tag = os.Args[2]
+		}
+		err = a.Rollback(ctx, tag)
+	case "resume":
+		err = a.Resume()
+	case "retry":
+		step := ""
+		if len(os.Args) > 2 {
+			step = os.Args[2]
+		}
+		err = a.Retry(ctx, step)
+	case "status":
+		var st agent.State
+		if st, err = a.Status(); err == nil {
+			err = printJSON(st)
+		}
+	case "journal":
+		var j agent.Journal
+		if j, err = a.Journal(); err == nil {
+			err = printJSON(j)
+		}
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,39 @@
+// Command infra previews, deploys and destroys the app and controlplane
+// stacks through the Pulumi Automation API.
+//
+//	infra [flags] preview|up|refresh|destroy|expire app|controlplane|all
+//
+// Examples:
+//
+//	infra -manifest release_manifest.json up app
+//	infra -pr 42 -manifest release_manifest.json up app
+//	infra expire app
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/velann21/todo-releaser/internal/infra"
+)
+
+func main() {
+	var opts infra.Options
+	opts.RegisterFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: infra [flags] %s\n", infra.Usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := infra.Run(context.Background(), opts, flag.Arg(0), flag.Arg(1)); err != nil {
+		log.Fatal(err)
+	}
+}
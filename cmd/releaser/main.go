@@ -1,334 +1,240 @@
+// Command releaser keeps release_manifest.json at the latest image tags and
+// tags calver releases.
+//
+//	releaser                 poll and release
+//	releaser build [-push]   build this repository's images and release them
+//	releaser hotfix -service s -tag t [-branch]
+//	                         release one service at tag t as a patch release
+//	releaser dry-run [-out dir]
+//	                         render the release that would be made, without making it
+//	releaser action          reconcile once as a GitHub Actions step (see action.yml)
+//	releaser lambda          serve AWS Lambda invocations, one reconcile each
+//	releaser sandbox [-dir d] [-serve]
+//	                         release against a local fake registry and repository
+//	releaser deps [-dry-run] open pull requests for updates of this repository's
+//	                         Go modules and Dockerfile base images
+//	releaser github-token    print a token for this repository: the GitHub App's
+//	                         installation token, or GITHUB_TOKEN
+//	releaser skew [-json]    compare the containers agents run with the manifest;
+//	                         exits 1 when a host is out of date or modified
+//	releaser slo [-since d] [-json]
+//	                         report the time from upstream tags' publication to
+//	                         their release; exits 1 when a release missed its target
+//	releaser replay [-since d] [-every d] [-json]
+//	                         replay the update decisions of the last d over the
+//	                         recorded registry history, with this checkout's policy
+//	releaser import -host h | -compose f [-out f] [-pin] [-force]
+//	                         write a first manifest from the services running on
+//	                         Docker host h, or of compose file f
+//	releaser export -release v [-out f]
+//	                         write release v, with its images, as a bundle for
+//	                         a disconnected site
+//	releaser import -bundle f -registry r [-out f]
+//	                         load bundle f's images into registry r and apply
+//	                         its release
+//	releaser admin backup [-out f]
+//	                         write a backup of the state to f, - for stdout
+//	releaser admin restore f replace the state with the backup f, - for stdin;
+//	                         stop the daemon first
+//
+// SIGINT or SIGTERM stops the command, abandoning a release not yet pushed
+// so the repository is left as it was; a second one exits at once.
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
-	"net/http"
+	"log"
 	"os"
-	"os/exec"
-	"sort"
-	"strconv"
-	"strings"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/Masterminds/semver/v3"
-)
-
-const (
-	ManifestFile    = "release_manifest.json"
-	PollingInterval = 30 * time.Second
-)
-
-type Service struct {
-	Name    string `json:"name"`
-	Image   string `json:"image"`
-	Version string `json:"version"`
-}
-
-type Manifest struct {
-	ReleaseVersion string    `json:"release_version"`
-	Services       []Service `json:"services"`
-}
-
-type DockerHubTags struct {
-	Results []struct {
-		Name string `json:"name"`
-	} `json:"results"`
-}
-
-type IncrementType int
-
-const (
-	IncrementPatch IncrementType = iota
-	IncrementMinor
-	IncrementMajor
+	"github.com/velann21/todo-releaser/internal/releaser"
 )
 
 func main() {
-	fmt.Println("Starting Releaser in Reconciler Mode...")
-
-	for {
-		err := reconcile()
-		if err != nil {
-			fmt.Printf("Error during reconciliation: %v\n", err)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if len(os.Args) > 1 && os.Args[1] == "build" {
+		fs := flag.NewFlagSet("build", flag.ExitOnError)
+		var opts releaser.BuildOptions
+		opts.RegisterFlags(fs)
+		fs.Parse(os.Args[2:])
+		if err := releaser.Build(ctx, opts); err != nil {
+			log.Fatal(err)
 		}
-		fmt.Printf("Sleeping for %v...\n", PollingInterval)
-		time.Sleep(PollingInterval)
-	}
-}
-
-func reconcile() error {
-	// 1. Load Manifest
-	manifest, err := loadManifest(ManifestFile)
-	if err != nil {
-		return fmt.Errorf("error loading manifest: %w", err)
+		return
 	}
-
-	updated := false
-	maxIncrement := IncrementPatch
-
-	for i, service := range manifest.Services {
-		fmt.Printf("Checking service: %s (current: %s)\n", service.Name, service.Version)
-		latestTag, err := getLatestTagFromDockerHub(service.Image)
-		if err != nil {
-			fmt.Printf("Error checking Docker Hub for %s: %v\n", service.Name, err)
-			continue
-		}
-
-		if latestTag != service.Version && latestTag != "" {
-			fmt.Printf("Found update for %s: %s -> %s\n", service.Name, service.Version, latestTag)
-
-			incType := determineIncrementType(service.Version, latestTag)
-			if incType > maxIncrement {
-				maxIncrement = incType
-			}
-
-			manifest.Services[i].Version = latestTag
-			updated = true
-		} else {
-			fmt.Printf("No update for %s\n", service.Name)
+	if len(os.Args) > 1 && os.Args[1] == "hotfix" {
+		fs := flag.NewFlagSet("hotfix", flag.ExitOnError)
+		var opts releaser.HotfixOptions
+		opts.RegisterFlags(fs)
+		fs.Parse(os.Args[2:])
+		if _, err := releaser.Hotfix(ctx, opts); err != nil {
+			log.Fatal(err)
 		}
+		return
 	}
-
-	if !updated {
-		fmt.Println("No updates found.")
-		return nil
-	}
-
-	// 2. Update Manifest File
-	err = saveManifest(ManifestFile, manifest)
-	if err != nil {
-		return fmt.Errorf("error saving manifest: %w", err)
-	}
-
-	// 3. Git Operations
-	// Commit
-	err = runGitCommand("add", ManifestFile)
-	if err != nil {
-		return err
-	}
-
-	msg := "chore: update services to latest versions"
-	err = runGitCommand("commit", "-m", msg)
-	if err != nil {
-		return err
-	}
-
-	// Tag
-	newVersion, err := generateNewVersion(maxIncrement)
-	if err != nil {
-		return fmt.Errorf("error generating new version: %w", err)
-	}
-	fmt.Printf("Creating new tag: %s\n", newVersion)
-
-	// Update manifest with new version
-	manifest.ReleaseVersion = newVersion
-	err = saveManifest(ManifestFile, manifest)
-	if err != nil {
-		return fmt.Errorf("error saving manifest with new version: %w", err)
-	}
-
-	// Commit again with the version update
-	err = runGitCommand("add", ManifestFile)
-	if err != nil {
-		return err
-	}
-
-	msg = fmt.Sprintf("chore: release %s", newVersion)
-	err = runGitCommand("commit", "-m", msg)
-	if err != nil {
-		return err
-	}
-
-	err = runGitCommand("tag", newVersion)
-	if err != nil {
-		return err
-	}
-
-	fmt.Println("Release created locally. Run 'git push --tags origin master' to publish.")
-	return nil
-}
-
-func loadManifest(path string) (*Manifest, error) {
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-	var m Manifest
-	err = json.Unmarshal(data, &m)
-	return &m, err
-}
-
-func saveManifest(path string, m *Manifest) error {
-	data, err := json.MarshalIndent(m, "", "  ")
-	if err != nil {
-		return err
-	}
-	return ioutil.WriteFile(path, data, 0644)
-}
-
-func getLatestTagFromDockerHub(image string) (string, error) {
-	parts := strings.Split(image, "/")
-	if len(parts) == 1 {
-		parts = []string{"library", parts[0]}
-	}
-
-	// Fetch more tags to ensure we find a semantic one
-	url := fmt.Sprintf("https://hub.docker.com/v2/repositories/%s/%s/tags?page_size=20", parts[0], parts[1])
-	resp, err := http.Get(url)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("docker hub api returned %d", resp.StatusCode)
+	if len(os.Args) > 1 && os.Args[1] == "dry-run" {
+		fs := flag.NewFlagSet("dry-run", flag.ExitOnError)
+		out := fs.String("out", releaser.DefaultDryRunDir, "directory to write the rendered release to")
+		fs.Parse(os.Args[2:])
+		if _, err := releaser.DryRun(ctx, *out); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
-
-	var tags DockerHubTags
-	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
-		return "", err
+	if len(os.Args) > 1 && os.Args[1] == "action" {
+		os.Exit(releaser.RunAction())
 	}
-
-	if len(tags.Results) == 0 {
-		return "", nil
+	if len(os.Args) > 1 && os.Args[1] == "sandbox" {
+		fs := flag.NewFlagSet("sandbox", flag.ExitOnError)
+		var opts releaser.SandboxOptions
+		opts.RegisterFlags(fs)
+		fs.Parse(os.Args[2:])
+		if _, err := releaser.Sandbox(ctx, opts); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
-
-	var semverTags []*semver.Version
-	for _, tag := range tags.Results {
-		// Attempt to parse as semantic version
-		// We handle 'v' prefix if present, though semver lib handles it too usually
-		v, err := semver.NewVersion(tag.Name)
-		if err == nil {
-			semverTags = append(semverTags, v)
+	if len(os.Args) > 1 && os.Args[1] == "deps" {
+		fs := flag.NewFlagSet("deps", flag.ExitOnError)
+		var opts releaser.DepsOptions
+		opts.RegisterFlags(fs)
+		fs.Parse(os.Args[2:])
+		if _, err := releaser.UpdateDeps(opts); err != nil {
+			log.Fatal(err)
 		}
+		return
 	}
-
-	if len(semverTags) == 0 {
-		return "", nil
+	if len(os.Args) > 1 && os.Args[1] == "github-token" {
+		if err := releaser.GitHubToken(); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
-
-	// Sort to find the latest
-	sort.Sort(semver.Collection(semverTags))
-
-	// Return the latest version
-	return semverTags[len(semverTags)-1].Original(), nil
-}
-
-func runGitCommand(args ...string) error {
-	cmd := exec.Command("git", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	fmt.Printf("Running: git %s\n", strings.Join(args, " "))
-	return cmd.Run()
-}
-
-func parseVersion(v string) (major, minor, patch int, err error) {
-	v = strings.TrimPrefix(v, "v")
-	parts := strings.Split(v, ".")
-	if len(parts) < 3 {
-		return 0, 0, 0, fmt.Errorf("invalid version format: %s", v)
+	if len(os.Args) > 1 && os.Args[1] == "skew" {
+		fs := flag.NewFlagSet("skew", flag.ExitOnError)
+		var opts releaser.SkewOptions
+		opts.RegisterFlags(fs)
+		fs.Parse(os.Args[2:])
+		skewed, err := releaser.PrintSkew(ctx, opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if skewed > 0 {
+			os.Exit(1)
+		}
+		return
 	}
-
-	major, err = strconv.Atoi(parts[0])
-	if err != nil {
+	if len(os.Args) > 1 && os.Args[1] == "slo" {
+		fs := flag.NewFlagSet("slo", flag.ExitOnError)
+		var opts releaser.SLOOptions
+		opts.RegisterFlags(fs)
+		fs.Parse(os.Args[2:])
+		missed, err := releaser.PrintSLO(opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if missed > 0 {
+			os.Exit(1)
+		}
 		return
 	}
-
-	minor, err = strconv.Atoi(parts[1])
-	if err != nil {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		fs := flag.NewFlagSet("replay", flag.ExitOnError)
+		var opts releaser.ReplayOptions
+		opts.RegisterFlags(fs)
+		fs.Parse(os.Args[2:])
+		if err := releaser.PrintReplay(ctx, opts); err != nil {
+			log.Fatal(err)
+		}
 		return
 	}
-
-	patch, err = strconv.Atoi(parts[2])
-	if err != nil {
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		fs := flag.NewFlagSet("import", flag.ExitOnError)
+		var opts releaser.ImportOptions
+		opts.RegisterFlags(fs)
+		fs.Parse(os.Args[2:])
+		if _, err := releaser.Import(ctx, opts); err != nil {
+			log.Fatal(err)
+		}
 		return
 	}
-
-	return
-}
-
-func determineIncrementType(oldVer, newVer string) IncrementType {
-	oMaj, oMin, _, err1 := parseVersion(oldVer)
-	nMaj, nMin, _, err2 := parseVersion(newVer)
-
-	if err1 != nil || err2 != nil {
-		// Fallback to patch if parsing fails (e.g. "latest")
-		return IncrementPatch
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		fs := flag.NewFlagSet("export", flag.ExitOnError)
+		var opts releaser.ExportOptions
+		opts.RegisterFlags(fs)
+		fs.Parse(os.Args[2:])
+		if err := releaser.Export(ctx, opts); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
-
-	if nMaj > oMaj {
-		return IncrementMajor
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		if err := admin(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
-	if nMin > oMin {
-		return IncrementMinor
+	if len(os.Args) > 1 && os.Args[1] == "lambda" {
+		if err := releaser.RunLambda(); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
-	return IncrementPatch
+	releaser.Run(ctx)
 }
 
-func generateNewVersion(incType IncrementType) (string, error) {
-	year, week := time.Now().ISOWeek()
-	prefix := fmt.Sprintf("v%d%02d", year, week) // e.g. v202452
-
-	// Get existing tags
-	cmd := exec.Command("git", "tag")
-	out, err := cmd.Output()
-	if err != nil {
-		return "", err
-	}
-
-	tags := strings.Split(string(out), "\n")
-
-	type version struct {
-		minor, patch int
-	}
-	var versions []version
-
-	for _, tag := range tags {
-		if strings.HasPrefix(tag, prefix) {
-			// Parse vYYYYWW.Minor.Patch
-			parts := strings.Split(tag, ".")
-			if len(parts) >= 3 {
-				minorStr := parts[1]
-				patchStr := parts[2]
-
-				m, err1 := strconv.Atoi(minorStr)
-				p, err2 := strconv.Atoi(patchStr)
-
-				if err1 == nil && err2 == nil {
-					versions = append(versions, version{m, p})
-				}
-			}
+// admin runs the state administration subcommands.
+func admin(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: releaser admin backup [-out f] | restore f")
+	}
+	switch args[0] {
+	case "backup":
+		fs := flag.NewFlagSet("admin backup", flag.ExitOnError)
+		out := fs.String("out", "releaser-state-"+time.Now().UTC().Format("20060102T150405Z")+".tar.gz", "file to write the backup to, - for stdout")
+		fs.Parse(args[1:])
+		if *out == "-" {
+			return releaser.Backup(os.Stdout)
 		}
-	}
-
-	// Sort versions to find the latest
-	sort.Slice(versions, func(i, j int) bool {
-		if versions[i].minor != versions[j].minor {
-			return versions[i].minor < versions[j].minor
+		f, err := os.OpenFile(*out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
 		}
-		return versions[i].patch < versions[j].patch
-	})
-
-	currentMinor := 0
-	currentPatch := -1 // So that if no tags exist, we start at 0
-
-	if len(versions) > 0 {
-		last := versions[len(versions)-1]
-		currentMinor = last.minor
-		currentPatch = last.patch
-	}
-
-	newMinor := currentMinor
-	newPatch := currentPatch
-
-	if incType == IncrementMinor || incType == IncrementMajor {
-		newMinor++
-		newPatch = 0
-	} else {
-		newPatch++
+		if err := releaser.Backup(f); err != nil {
+			f.Close()
+			os.Remove(*out)
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Backed up the state to %s\n", *out)
+		return nil
+	case "restore":
+		if len(args) != 2 {
+			return errors.New("usage: releaser admin restore f")
+		}
+		if args[1] == "-" {
+			return releaser.Restore(os.Stdin)
+		}
+		f, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return releaser.Restore(f)
+	default:
+		return fmt.Errorf("unknown admin command %q, expected backup or restore", args[0])
 	}
-
-	return fmt.Sprintf("%s.%d.%d", prefix, newMinor, newPatch), nil
 }
@@ -0,0 +1,350 @@
+// Command todoctl is a single entrypoint for releasing, deploying and
+// operating the todo stacks:
+//
+//	todoctl release [-once]              run the releaser (one reconcile with -once)
+//	todoctl build [-push]                build this repository's images and release them
+//	todoctl freeze [-reason r] [-for 24h] on|off|status
+//	todoctl deploy [infra flags] [-stacks a,b -parallel n -max-failures n]
+//	                                     roll the release manifest out to the app stack(s)
+//	todoctl infra [flags] <action> <target>
+//	todoctl encrypt [-r age1...] <value>|-   encrypt a value for the manifest or config
+//	todoctl manifest sign [-key-file f]  sign the release manifest for RELEASER_MANIFEST_VERIFY=signature
+//	todoctl render [-out dir] nomad|quadlet  write the release manifest as a Nomad job or podman quadlets
+//	todoctl auth token                   print an API access token
+//	todoctl db tunnel [-port 5432]       forward a local port to the app database
+//
+// Every subcommand reads a .env file from the working directory when present,
+// so credentials (Docker, GitHub, Auth0, AWS) are configured in one place.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"github.com/velann21/todo-releaser/internal/auth"
+	"github.com/velann21/todo-releaser/internal/infra"
+	"github.com/velann21/todo-releaser/internal/manifest"
+	"github.com/velann21/todo-releaser/internal/releaser"
+	"github.com/velann21/todo-releaser/internal/render"
+	"github.com/velann21/todo-releaser/internal/secrets"
+)
+
+const usage = `usage: todoctl <command> [arguments]
+
+commands:
+  release [-once | -dry-run [-out dir]]
+  build [-push]
+  hotfix -service s -tag t [-branch]
+  freeze [-reason r] [-for 24h] on|off|status
+  deploy [infra flags] [-stacks a,b -parallel n -max-failures n]
+  infra [flags] ` + infra.Usage + `
+  encrypt [-r age1...] <value>|-
+  manifest sign [-key-file f]
+  render [-manifest f] [-out dir] nomad|quadlet
+  auth token
+  agent token [-ttl 1h] <agent name>
+  db tunnel [-port 5432]
+`
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lmsgprefix)
+	log.SetPrefix("todoctl: ")
+	if err := godotenv.Load(); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to read .env: %v", err)
+	}
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	cmd, args := os.Args[1], os.Args[2:]
+	var err error
+	switch cmd {
+	case "release":
+		err = runRelease(ctx, args)
+	case "build":
+		err = runBuild(ctx, args)
+	case "hotfix":
+		err = runHotfix(ctx, args)
+	case "freeze":
+		err = runFreeze(args)
+	case "deploy":
+		err = runDeploy(ctx, args)
+	case "infra":
+		err = runInfra(ctx, args)
+	case "encrypt":
+		err = runEncrypt(args)
+	case "manifest":
+		err = runManifest(args)
+	case "render":
+		err = runRender(args)
+	case "auth":
+		err = runAuth(ctx, args)
+	case "agent":
+		err = runAgent(args)
+	case "db":
+		err = runDB(ctx, args)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runRelease(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("release", flag.ExitOnError)
+	once := fs.Bool("once", false, "reconcile once and exit instead of polling")
+	dryRun := fs.Bool("dry-run", false, "render the release that would be made into -out instead of making it")
+	out := fs.String("out", releaser.DefaultDryRunDir, "with -dry-run, directory to write the rendered release to")
+	fs.Parse(args)
+
+	if *dryRun {
+		result, err := releaser.DryRun(ctx, *out)
+		if err == nil && result == nil {
+			log.Print("Nothing to release")
+		}
+		return err
+	}
+
+	if !*once {
+		releaser.Run(ctx)
+		return nil
+	}
+	result, err := releaser.Reconcile(ctx)
+	if err == nil && result == nil {
+		log.Print("Nothing to release")
+	}
+	return err
+}
+
+func runBuild(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	var opts releaser.BuildOptions
+	opts.RegisterFlags(fs)
+	fs.Parse(args)
+
+	return releaser.Build(ctx, opts)
+}
+
+func runHotfix(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("hotfix", flag.ExitOnError)
+	var opts releaser.HotfixOptions
+	opts.RegisterFlags(fs)
+	fs.Parse(args)
+
+	_, err := releaser.Hotfix(ctx, opts)
+	return err
+}
+
+func runFreeze(args []string) error {
+	fs := flag.NewFlagSet("freeze", flag.ExitOnError)
+	addr := fs.String("addr", envOr("RELEASER_URL", "http://localhost:9090"), "releaser base URL (default $RELEASER_URL)")
+	reason := fs.String("reason", "", "why releases are frozen (required for on)")
+	duration := fs.Duration("for", 0, "lift the freeze automatically after this long")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: todoctl freeze [-reason r] [-for 24h] on|off|status")
+	}
+
+	client := releaser.FreezeClient{Addr: *addr, Token: os.Getenv("RELEASER_API_TOKEN")}
+	var out string
+	var err error
+	switch fs.Arg(0) {
+	case "on":
+		out, err = client.Freeze(*reason, os.Getenv("USER"), *duration)
+	case "off":
+		out, err = client.Lift()
+	case "status":
+		out, err = client.Status()
+	default:
+		return fmt.Errorf("unknown freeze command %q, expected on, off or status", fs.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Print(out)
+	return nil
+}
+
+func runAgent(args []string) error {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	addr := fs.String("addr", envOr("RELEASER_URL", "http://localhost:9090"), "releaser base URL (default $RELEASER_URL)")
+	ttl := fs.Duration("ttl", releaser.DefaultEnrollTokenTTL, "how long the bootstrap token can be used")
+	fs.Parse(args)
+	if fs.NArg() != 2 || fs.Arg(0) != "token" {
+		return fmt.Errorf("usage: todoctl agent token [-ttl 1h] <agent name>")
+	}
+
+	out, err := releaser.NewEnrollToken(*addr, os.Getenv("RELEASER_API_TOKEN"), fs.Arg(1), *ttl)
+	if err != nil {
+		return err
+	}
+	fmt.Print(out)
+	return nil
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func runDeploy(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("deploy", flag.ExitOnError)
+	var opts infra.Options
+	opts.RegisterFlags(fs)
+	fs.Lookup("manifest").DefValue = manifest.File
+	opts.Manifest = manifest.File
+	stacks := fs.String("stacks", "", "comma-separated app stacks to roll out to instead of -stack")
+	parallel := fs.Int("parallel", 1, "with -stacks, how many stacks to deploy at once")
+	maxFailures := fs.Int("max-failures", 0, "with -stacks, failed stacks tolerated before the rollout is aborted")
+	fs.Parse(args)
+
+	if *stacks == "" {
+		return infra.Run(ctx, opts, "up", infra.ManifestProject)
+	}
+	return infra.Rollout(ctx, opts, infra.RolloutOptions{
+		Stacks:      strings.Split(*stacks, ","),
+		Parallel:    *parallel,
+		MaxFailures: *maxFailures,
+	})
+}
+
+func runInfra(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("infra", flag.ExitOnError)
+	var opts infra.Options
+	opts.RegisterFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: todoctl infra [flags] %s\n", infra.Usage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	return infra.Run(ctx, opts, fs.Arg(0), fs.Arg(1))
+}
+
+func runEncrypt(args []string) error {
+	fs := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	var recipients []string
+	fs.Func("r", "age recipient (repeatable; default $SOPS_AGE_RECIPIENTS)", func(s string) error {
+		recipients = append(recipients, s)
+		return nil
+	})
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: todoctl encrypt [-r age1...] <value>|-")
+	}
+	if len(recipients) == 0 && os.Getenv("SOPS_AGE_RECIPIENTS") != "" {
+		recipients = strings.Split(os.Getenv("SOPS_AGE_RECIPIENTS"), ",")
+	}
+
+	value := fs.Arg(0)
+	if value == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		value = strings.TrimSuffix(string(data), "\n")
+	}
+	enc, err := secrets.Encrypt(value, recipients...)
+	if err != nil {
+		return err
+	}
+	fmt.Println(enc)
+	return nil
+}
+
+func runManifest(args []string) error {
+	if len(args) == 0 || args[0] != "sign" {
+		return fmt.Errorf("usage: todoctl manifest sign [-key-file f]")
+	}
+	fs := flag.NewFlagSet("manifest sign", flag.ExitOnError)
+	keyFile := fs.String("key-file", "", "file holding your base64 ed25519 signing key (default $TODOCTL_SIGNING_KEY)")
+	fs.Parse(args[1:])
+
+	key := os.Getenv("TODOCTL_SIGNING_KEY")
+	if *keyFile != "" {
+		data, err := os.ReadFile(*keyFile)
+		if err != nil {
+			return err
+		}
+		key = string(data)
+	}
+	if key == "" {
+		return fmt.Errorf("no signing key: pass -key-file or set TODOCTL_SIGNING_KEY")
+	}
+	return releaser.SignManifest(key)
+}
+
+func runRender(args []string) error {
+	fs := flag.NewFlagSet("render", flag.ExitOnError)
+	path := fs.String("manifest", manifest.File, "release manifest to render")
+	out := fs.String("out", ".", "directory to write the files to")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: todoctl render [-manifest f] [-out dir] %s", strings.Join(render.Names(), "|"))
+	}
+
+	// The outputs carry no secrets, so the manifest is read without
+	// decrypting them.
+	data, err := os.ReadFile(*path)
+	if err != nil {
+		return err
+	}
+	var m manifest.Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("error parsing %s: %w", *path, err)
+	}
+	files, err := render.Write(*out, fs.Arg(0), &m)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		fmt.Println(f)
+	}
+	return nil
+}
+
+func runAuth(ctx context.Context, args []string) error {
+	if len(args) != 1 || args[0] != "token" {
+		return fmt.Errorf("usage: todoctl auth token")
+	}
+	token, err := auth.ClientCredentialsToken(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting a token: %w", err)
+	}
+	fmt.Println(token.AccessToken)
+	return nil
+}
+
+func runDB(ctx context.Context, args []string) error {
+	if len(args) < 1 || args[0] != "tunnel" {
+		return fmt.Errorf("usage: todoctl db tunnel [-port 5432]")
+	}
+	fs := flag.NewFlagSet("db tunnel", flag.ExitOnError)
+	var opts infra.Options
+	opts.RegisterFlags(fs)
+	port := fs.Int("port", 5432, "local port to forward")
+	fs.Parse(args[1:])
+
+	return infra.DBTunnel(ctx, opts, *port)
+}
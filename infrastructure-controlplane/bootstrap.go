@@ -0,0 +1,128 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws"
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/iam"
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/ssm"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+)
+
+//go:embed ssm/bootstrap.yaml
+var bootstrapDocument string
+
+const (
+	bootstrapAnsible = "ansible"
+	bootstrapSSM     = "ssm"
+)
+
+// bootstrapConfig selects how the instance is provisioned once it is up.
+type bootstrapConfig struct {
+	// Mode is "ansible" (ansible-playbook run locally over SSH) or "ssm"
+	// (an SSM document applied by State Manager; no SSH access needed).
+	Mode string
+	// TimeoutSeconds bounds how long the update waits for the SSM
+	// association to succeed.
+	TimeoutSeconds int
+}
+
+func loadBootstrapConfig(conf *config.Config) (bootstrapConfig, error) {
+	b := bootstrapConfig{
+		Mode:           conf.Get("bootstrapMode"),
+		TimeoutSeconds: conf.GetInt("bootstrapTimeoutSeconds"),
+	}
+	if b.Mode == "" {
+		b.Mode = bootstrapAnsible
+	}
+	if b.Mode != bootstrapAnsible && b.Mode != bootstrapSSM {
+		return b, fmt.Errorf("unknown bootstrapMode %q, expected %q or %q", b.Mode, bootstrapAnsible, bootstrapSSM)
+	}
+	if b.TimeoutSeconds == 0 {
+		b.TimeoutSeconds = 1800
+	}
+	return b, nil
+}
+
+// ssmBootstrapArgs are the values the bootstrap document is run with.
+type ssmBootstrapArgs struct {
+	DockerUsername   string
+	DockerPassword   pulumi.StringOutput
+	Github           *githubCredentials
+	ReleaserUnits    map[string]string
+	DataVolumeDevice string
+}
+
+// newSSMBootstrap provisions the instances matching targets with the embedded SSM document instead of
+// Ansible. Secrets are stored as SecureString parameters (or, for GitHub, in
+// Secrets Manager) that the instance reads itself, so they never pass through
+// the command or its output. The
+// association waits for the first run to succeed and re-runs whenever the
+// document or its parameters change, and instances that match targets later
+// (e.g. auto scaling replacements) are bootstrapped when they register.
+func newSSMBootstrap(ctx *pulumi.Context, name string, b bootstrapConfig, role *iam.Role, targets ssm.AssociationTargetArray, args ssmBootstrapArgs, deps []pulumi.Resource) (*ssm.Association, error) {
+	region, err := aws.GetRegion(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	paramPrefix := "/" + name + "/" + ctx.Stack()
+	dockerPassword, err := ssm.NewParameter(ctx, name+"-docker-password", &ssm.ParameterArgs{
+		Name:  pulumi.String(paramPrefix + "/docker-password"),
+		Type:  pulumi.String("SecureString"),
+		Value: args.DockerPassword,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the bootstrap parameter is readable; SecureStrings use the
+	// default aws/ssm key, which the key policy already lets the account use.
+	paramPolicy, err := iam.NewRolePolicy(ctx, name+"-bootstrap-params", &iam.RolePolicyArgs{
+		Role: role.ID(),
+		Policy: pulumi.Sprintf(`{
+			"Version": "2012-10-17",
+			"Statement": [{
+				"Effect": "Allow",
+				"Action": ["ssm:GetParameter"],
+				"Resource": "%s"
+			}]
+		}`, dockerPassword.Arn),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	document, err := ssm.NewDocument(ctx, name+"-bootstrap", &ssm.DocumentArgs{
+		DocumentType:   pulumi.String("Command"),
+		DocumentFormat: pulumi.String("YAML"),
+		Content:        pulumi.String(bootstrapDocument),
+		Tags: pulumi.StringMap{
+			"Name": pulumi.String(name + "-bootstrap"),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	deps = append(deps, paramPolicy)
+	return ssm.NewAssociation(ctx, name+"-bootstrap", &ssm.AssociationArgs{
+		Name:            document.Name,
+		DocumentVersion: document.LatestVersion,
+		Targets:         targets,
+		Parameters: pulumi.StringMap{
+			"region":                  pulumi.String(region.Region),
+			"dockerUsername":          pulumi.String(args.DockerUsername),
+			"dockerPasswordParameter": dockerPassword.Name,
+			"githubCredentialType":    pulumi.String(args.Github.Type),
+			"githubSecretId":          args.Github.SecretArn,
+			"releaserService":         pulumi.String(args.ReleaserUnits["todo-releaser.service"]),
+			"releaserHealthService":   pulumi.String(args.ReleaserUnits["todo-releaser-health.service"]),
+			"releaserHealthTimer":     pulumi.String(args.ReleaserUnits["todo-releaser-health.timer"]),
+			"dataVolumeDevice":        pulumi.String(args.DataVolumeDevice),
+		},
+		WaitForSuccessTimeoutSeconds: pulumi.Int(b.TimeoutSeconds),
+	}, pulumi.DependsOn(deps))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/iam"
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/secretsmanager"
+	"github.com/pulumi/pulumi-tls/sdk/v5/go/tls"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+	"github.com/velann21/todo-releaser/infrastructure/instance"
+)
+
+const (
+	githubCredentialToken     = "token"
+	githubCredentialDeployKey = "deployKey"
+)
+
+// githubConfig selects the credentials the releaser uses to reach GitHub.
+type githubConfig struct {
+	// Type is "token" (a fine-grained token) or "deployKey" (a generated
+	// SSH key added to the repository as a deploy key).
+	Type string
+	// SecretArn points at an existing secret holding the credential, e.g.
+	// one rotated outside this stack. When empty the stack creates it.
+	SecretArn string
+	// RotationLambdaArn rotates a token secret every RotationDays.
+	RotationLambdaArn string
+	RotationDays      int
+	// DeployKeyRotation is part of the deploy key's resource name; changing
+	// it generates a new key.
+	DeployKeyRotation string
+}
+
+func loadGithubConfig(conf *config.Config) (githubConfig, error) {
+	g := githubConfig{
+		Type:              conf.Get("githubCredentialType"),
+		SecretArn:         conf.Get("githubSecretArn"),
+		RotationLambdaArn: conf.Get("githubTokenRotationLambdaArn"),
+		RotationDays:      conf.GetInt("githubTokenRotationDays"),
+		DeployKeyRotation: conf.Get("githubDeployKeyRotation"),
+	}
+	if g.Type == "" {
+		g.Type = githubCredentialToken
+	}
+	if g.Type != githubCredentialToken && g.Type != githubCredentialDeployKey {
+		return g, fmt.Errorf("unknown githubCredentialType %q, expected %q or %q", g.Type, githubCredentialToken, githubCredentialDeployKey)
+	}
+	if g.RotationDays == 0 {
+		g.RotationDays = 30
+	}
+	return g, nil
+}
+
+// githubCredentials is the GitHub credential kept in Secrets Manager. The
+// instance fetches it at runtime, so rotating the secret needs no redeploy.
+type githubCredentials struct {
+	Type      string
+	SecretArn pulumi.StringInput
+	// DeployKey is set when the stack generated a deploy key; its public half
+	// has to be added to the repository with write access.
+	DeployKey *tls.PrivateKey
+}
+
+// newGithubCredentials stores the GitHub credential in Secrets Manager (unless
+// an existing secret is configured) and lets role read it. For the token type
+// the value comes from the githubCredentialToken config secret.
+func newGithubCredentials(ctx *pulumi.Context, name string, g githubConfig, conf *config.Config, role *iam.Role) (*githubCredentials, error) {
+	creds := &githubCredentials{
+		Type:      g.Type,
+		SecretArn: pulumi.String(g.SecretArn),
+	}
+
+	if g.SecretArn == "" {
+		var value pulumi.StringOutput
+		if g.Type == githubCredentialDeployKey {
+			keyName := name + "-deploy-key"
+			if g.DeployKeyRotation != "" {
+				keyName += "-" + g.DeployKeyRotation
+			}
+			key, err := tls.NewPrivateKey(ctx, keyName, &tls.PrivateKeyArgs{
+				Algorithm: pulumi.String("ED25519"),
+			})
+			if err != nil {
+				return nil, err
+			}
+			creds.DeployKey = key
+			value = key.PrivateKeyOpenssh
+		} else {
+			value = conf.RequireSecret("githubToken")
+		}
+
+		secret, err := secretsmanager.NewSecret(ctx, name, &secretsmanager.SecretArgs{
+			Description: pulumi.Sprintf("GitHub %s for the releaser", g.Type),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// Once a rotation function owns the token, later updates must not
+		// put the value from config back.
+		var versionOpts []pulumi.ResourceOption
+		if g.Type == githubCredentialToken && g.RotationLambdaArn != "" {
+			versionOpts = append(versionOpts, pulumi.IgnoreChanges([]string{"secretString"}))
+		}
+		_, err = secretsmanager.NewSecretVersion(ctx, name, &secretsmanager.SecretVersionArgs{
+			SecretId:     secret.ID(),
+			SecretString: value,
+		}, versionOpts...)
+		if err != nil {
+			return nil, err
+		}
+
+		if g.Type == githubCredentialToken && g.RotationLambdaArn != "" {
+			_, err = secretsmanager.NewSecretRotation(ctx, name, &secretsmanager.SecretRotationArgs{
+				SecretId:          secret.ID(),
+				RotationLambdaArn: pulumi.String(g.RotationLambdaArn),
+				RotationRules: &secretsmanager.SecretRotationRotationRulesArgs{
+					AutomaticallyAfterDays: pulumi.Int(g.RotationDays),
+				},
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		creds.SecretArn = secret.Arn
+	}
+
+	_, err := instance.AllowSecretsRead(ctx, name+"-read", role, creds.SecretArn)
+	if err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
@@ -1,11 +1,13 @@
-module github.com/velann21/todo-releaser/infrastructure
+module github.com/velann21/todo-releaser/infrastructure-controlplane
 
 go 1.23.11
 
 require (
 	github.com/pulumi/pulumi-aws/sdk/v7 v7.0.0
 	github.com/pulumi/pulumi-command/sdk v1.1.3
+	github.com/pulumi/pulumi-tls/sdk/v5 v5.2.0
 	github.com/pulumi/pulumi/sdk/v3 v3.197.0
+	github.com/velann21/todo-releaser/infrastructure v0.0.0
 )
 
 require (
@@ -70,7 +72,6 @@ require (
 	github.com/spf13/cast v1.4.1 // indirect
 	github.com/spf13/cobra v1.8.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
-	github.com/stretchr/objx v0.5.0 // indirect
 	github.com/texttheater/golang-levenshtein v1.0.1 // indirect
 	github.com/uber/jaeger-client-go v2.30.0+incompatible // indirect
 	github.com/uber/jaeger-lib v2.4.1+incompatible // indirect
@@ -93,3 +94,5 @@ require (
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 	lukechampine.com/frand v1.4.2 // indirect
 )
+
+replace github.com/velann21/todo-releaser/infrastructure => ../infrastructure
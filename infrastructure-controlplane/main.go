@@ -1,59 +1,59 @@
 package main
 
 import (
-	"os"
-	"os/exec"
-	"path/filepath"
+	"strings"
 
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws"
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/autoscaling"
 	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/ec2"
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/secretsmanager"
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/ssm"
 	"github.com/pulumi/pulumi-command/sdk/go/command/local"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+	"github.com/velann21/todo-releaser/infrastructure/instance"
 )
 
-func ensureSSHKey(keyPath string) error {
-	if _, err := os.Stat(keyPath); os.IsNotExist(err) {
-		// Generate SSH key
-		cmd := exec.Command("ssh-keygen", "-t", "rsa", "-b", "4096", "-f", keyPath, "-N", "")
-		if err := cmd.Run(); err != nil {
-			return err
-		}
-		// Ensure correct permissions
-		if err := os.Chmod(keyPath, 0400); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
 func main() {
 	pulumi.Run(func(ctx *pulumi.Context) error {
-		// 0. Ensure SSH Key Exists
-		homeDir, err := os.UserHomeDir()
+		// Config
+		conf := config.New(ctx, "")
+		region, err := aws.GetRegion(ctx, nil)
 		if err != nil {
 			return err
 		}
-		privateKeyPath := filepath.Join(homeDir, ".ssh", "todo-controlplane-key.pem")
-		publicKeyPath := privateKeyPath + ".pub"
-
-		if err := ensureSSHKey(privateKeyPath); err != nil {
+		bootstrap, err := loadBootstrapConfig(conf)
+		if err != nil {
 			return err
 		}
 
-		publicKeyContent, err := os.ReadFile(publicKeyPath)
-		if err != nil {
-			return err
+		// 0. SSH key pair (imported from config or generated). Not needed when
+		// the instance is bootstrapped through SSM.
+		var sshKey *instance.SSHKey
+		if bootstrap.Mode == bootstrapAnsible {
+			sshKey, err = instance.NewSSHKey(ctx, "todo-controlplane", conf)
+			if err != nil {
+				return err
+			}
 		}
 
-		// Create AWS Key Pair
-		keyPair, err := ec2.NewKeyPair(ctx, "todo-controlplane-key-pair", &ec2.KeyPairArgs{
-			PublicKey: pulumi.String(string(publicKeyContent)),
-			Tags: pulumi.StringMap{
-				"Name": pulumi.String("todo-controlplane-key-pair"),
-			},
-		})
-		if err != nil {
-			return err
+		// Keep the generated private key in Secrets Manager too, so operators
+		// can fetch it without access to the stack state
+		var sshKeySecret *secretsmanager.Secret
+		if sshKey != nil && sshKey.Generated != nil {
+			sshKeySecret, err = secretsmanager.NewSecret(ctx, "todo-controlplane-ssh-key", &secretsmanager.SecretArgs{
+				Description: pulumi.String("SSH private key for the controlplane instance"),
+			})
+			if err != nil {
+				return err
+			}
+			_, err = secretsmanager.NewSecretVersion(ctx, "todo-controlplane-ssh-key", &secretsmanager.SecretVersionArgs{
+				SecretId:     sshKeySecret.ID(),
+				SecretString: sshKey.Generated.PrivateKeyOpenssh,
+			})
+			if err != nil {
+				return err
+			}
 		}
 
 		// 1. Create a VPC
@@ -80,6 +80,22 @@ func main() {
 			return err
 		}
 
+		// VPC peering with the app stack. The peering connection itself is
+		// owned by the app stack; once it exists we add the return route here.
+		var app *pulumi.StackReference
+		var appPeeringId interface{}
+		if appStack := conf.Get("appStack"); appStack != "" {
+			app, err = pulumi.NewStackReference(ctx, appStack, nil)
+			if err != nil {
+				return err
+			}
+			details, err := app.GetOutputDetails("peeringConnectionId")
+			if err != nil {
+				return err
+			}
+			appPeeringId = details.Value
+		}
+
 		// 2. Subnets
 		// Public Subnet
 		publicSubnet, err := ec2.NewSubnet(ctx, "todo-controlplane-public-subnet", &ec2.SubnetArgs{
@@ -96,14 +112,21 @@ func main() {
 		}
 
 		// Route Table for Public Subnet
-		publicRt, err := ec2.NewRouteTable(ctx, "todo-controlplane-public-rt", &ec2.RouteTableArgs{
-			VpcId: vpc.ID(),
-			Routes: ec2.RouteTableRouteArray{
-				&ec2.RouteTableRouteArgs{
-					CidrBlock: pulumi.String("0.0.0.0/0"),
-					GatewayId: igw.ID(),
-				},
+		publicRoutes := ec2.RouteTableRouteArray{
+			&ec2.RouteTableRouteArgs{
+				CidrBlock: pulumi.String("0.0.0.0/0"),
+				GatewayId: igw.ID(),
 			},
+		}
+		if peeringId, ok := appPeeringId.(string); ok && peeringId != "" {
+			publicRoutes = append(publicRoutes, &ec2.RouteTableRouteArgs{
+				CidrBlock:              app.GetStringOutput(pulumi.String("vpcCidr")),
+				VpcPeeringConnectionId: pulumi.String(peeringId),
+			})
+		}
+		publicRt, err := ec2.NewRouteTable(ctx, "todo-controlplane-public-rt", &ec2.RouteTableArgs{
+			VpcId:  vpc.ID(),
+			Routes: publicRoutes,
 			Tags: pulumi.StringMap{
 				"Name": pulumi.String("todo-controlplane-public-rt"),
 			},
@@ -122,18 +145,29 @@ func main() {
 		}
 
 		// 3. Security Groups
+		releaser := loadReleaserConfig(conf)
+		ingress := ec2.SecurityGroupIngressArray{
+			&ec2.SecurityGroupIngressArgs{
+				Protocol:    pulumi.String("tcp"),
+				FromPort:    pulumi.Int(releaser.Port),
+				ToPort:      pulumi.Int(releaser.Port),
+				CidrBlocks:  pulumi.StringArray{vpc.CidrBlock},
+				Description: pulumi.String("Releaser health and metrics"),
+			},
+		}
+		if bootstrap.Mode == bootstrapAnsible {
+			ingress = append(ingress, &ec2.SecurityGroupIngressArgs{
+				Protocol:    pulumi.String("tcp"),
+				FromPort:    pulumi.Int(22),
+				ToPort:      pulumi.Int(22),
+				CidrBlocks:  pulumi.StringArray{pulumi.String("0.0.0.0/0")}, // Restrict in production
+				Description: pulumi.String("SSH"),
+			})
+		}
 		sg, err := ec2.NewSecurityGroup(ctx, "todo-controlplane-sg", &ec2.SecurityGroupArgs{
 			VpcId:       vpc.ID(),
 			Description: pulumi.String("Allow SSH"),
-			Ingress: ec2.SecurityGroupIngressArray{
-				&ec2.SecurityGroupIngressArgs{
-					Protocol:    pulumi.String("tcp"),
-					FromPort:    pulumi.Int(22),
-					ToPort:      pulumi.Int(22),
-					CidrBlocks:  pulumi.StringArray{pulumi.String("0.0.0.0/0")}, // Restrict in production
-					Description: pulumi.String("SSH"),
-				},
-			},
+			Ingress:     ingress,
 			Egress: ec2.SecurityGroupEgressArray{
 				&ec2.SecurityGroupEgressArgs{
 					Protocol:   pulumi.String("-1"),
@@ -148,6 +182,54 @@ func main() {
 		}
 
 		// 4. EC2 Instance
+		storage := instance.LoadStorage(conf)
+		recovery := loadRecoveryConfig(conf)
+		if err := recovery.validate(bootstrap, storage); err != nil {
+			return err
+		}
+		schedule := loadScheduleConfig(conf)
+
+		// Logging: the CloudWatch agent installed from user data ships container
+		// and system logs plus host metrics
+		logRetentionDays := conf.GetInt("logRetentionDays")
+		if logRetentionDays == 0 {
+			logRetentionDays = 14
+		}
+		logGroups, err := instance.NewLogGroups(ctx, "todo-controlplane-logs", "todo-controlplane/"+ctx.Stack(), logRetentionDays)
+		if err != nil {
+			return err
+		}
+		// Instance role: the releaser uses it instead of static AWS keys.
+		// Logs and metrics for the CloudWatch agent, ECR pulls, and SSM
+		// (Run Command, Session Manager and parameters); Secrets Manager
+		// access is granted per secret below.
+		instanceRole, instanceProfile, err := instance.NewRole(ctx, "todo-controlplane-server-role",
+			"arn:aws:iam::aws:policy/CloudWatchAgentServerPolicy",
+			"arn:aws:iam::aws:policy/AmazonEC2ContainerRegistryReadOnly",
+			"arn:aws:iam::aws:policy/AmazonSSMManagedInstanceCore",
+		)
+		if err != nil {
+			return err
+		}
+		if secretArns := conf.Get("releaserSecretArns"); secretArns != "" {
+			var arns []pulumi.StringInput
+			for _, arn := range strings.Split(secretArns, ",") {
+				arns = append(arns, pulumi.String(strings.TrimSpace(arn)))
+			}
+			_, err = instance.AllowSecretsRead(ctx, "todo-controlplane-releaser-secrets", instanceRole, arns...)
+			if err != nil {
+				return err
+			}
+		}
+		serverUserData, err := instance.RenderUserData(instance.UserData{
+			ContainerLogGroup: logGroups.ContainersName,
+			SystemLogGroup:    logGroups.SystemName,
+			MetricsNamespace:  "todo/controlplane",
+		})
+		if err != nil {
+			return err
+		}
+
 		ami, err := ec2.LookupAmi(ctx, &ec2.LookupAmiArgs{
 			MostRecent: pulumi.BoolRef(true),
 			Owners:     []string{"amazon"},
@@ -162,60 +244,194 @@ func main() {
 			return err
 		}
 
-		server, err := ec2.NewInstance(ctx, "todo-controlplane-server", &ec2.InstanceArgs{
-			InstanceType:        pulumi.String("t3.micro"),
-			VpcSecurityGroupIds: pulumi.StringArray{sg.ID()},
-			Ami:                 pulumi.String(ami.Id),
-			SubnetId:            publicSubnet.ID(),
-			KeyName:             keyPair.KeyName,
-			Tags: pulumi.StringMap{
-				"Name": pulumi.String("todo-controlplane-server"),
-			},
-		})
+		// Either a standalone instance with an auto-recovery alarm, or a
+		// size-1 auto scaling group whose replacements bootstrap themselves
+		var server *ec2.Instance
+		var group *autoscaling.Group
+		var provisionDeps []pulumi.Resource
+		var bootstrapTargets ssm.AssociationTargetArray
+		var scheduled scheduleTarget
+		dataDevice := ""
+		if recovery.AutoScalingGroup {
+			group, err = newInstanceGroup(ctx, "todo-controlplane-server", instanceGroupArgs{
+				Ami:             ami.Id,
+				InstanceType:    "t3.micro",
+				SubnetId:        publicSubnet.ID(),
+				SecurityGroupId: sg.ID(),
+				InstanceProfile: instanceProfile.Name,
+				UserData:        serverUserData,
+				Storage:         storage,
+				IgnoreCapacity:  schedule.Enabled(),
+			}, pulumi.DependsOn([]pulumi.Resource{logGroups.Containers, logGroups.System}))
+			if err != nil {
+				return err
+			}
+			provisionDeps = []pulumi.Resource{group}
+			bootstrapTargets = ssm.AssociationTargetArray{
+				&ssm.AssociationTargetArgs{
+					Key:    pulumi.String("tag:Name"),
+					Values: pulumi.StringArray{pulumi.String("todo-controlplane-server")},
+				},
+			}
+			scheduled = groupScheduleTarget(group)
+		} else {
+			var keyName pulumi.StringPtrInput
+			if sshKey != nil {
+				keyName = sshKey.KeyPair.KeyName
+			}
+			server, err = ec2.NewInstance(ctx, "todo-controlplane-server", &ec2.InstanceArgs{
+				MetadataOptions:     instance.MetadataOptions(),
+				InstanceType:        pulumi.String("t3.micro"),
+				VpcSecurityGroupIds: pulumi.StringArray{sg.ID()},
+				Ami:                 pulumi.String(ami.Id),
+				SubnetId:            publicSubnet.ID(),
+				KeyName:             keyName,
+				RootBlockDevice:     storage.RootBlockDevice(),
+				IamInstanceProfile:  instanceProfile.Name,
+				UserData:            pulumi.String(serverUserData),
+				Tags: pulumi.StringMap{
+					"Name": pulumi.String("todo-controlplane-server"),
+				},
+			}, pulumi.DependsOn([]pulumi.Resource{logGroups.Containers, logGroups.System}))
+			if err != nil {
+				return err
+			}
+
+			_, err = newRecoveryAlarm(ctx, "todo-controlplane-recovery", region.Region, server)
+			if err != nil {
+				return err
+			}
+
+			// Optional data volume for Docker images
+			dataVolume, err := instance.NewDataVolume(ctx, "todo-controlplane-data-volume", storage, server)
+			if err != nil {
+				return err
+			}
+			provisionDeps = []pulumi.Resource{server}
+			if dataVolume != nil {
+				provisionDeps = append(provisionDeps, dataVolume)
+				dataDevice = instance.DataVolumeDevice
+			}
+			bootstrapTargets = ssm.AssociationTargetArray{
+				&ssm.AssociationTargetArgs{
+					Key:    pulumi.String("InstanceIds"),
+					Values: pulumi.StringArray{server.ID()},
+				},
+			}
+			scheduled = instanceScheduleTarget(server)
+		}
+
+		dockerUsername := conf.Require("dockerUsername")
+		dockerPassword := conf.RequireSecret("dockerPassword")
+
+		// GitHub credentials live in Secrets Manager and are fetched by the
+		// instance at runtime
+		githubConf, err := loadGithubConfig(conf)
+		if err != nil {
+			return err
+		}
+		github, err := newGithubCredentials(ctx, "todo-controlplane-github", githubConf, conf, instanceRole)
 		if err != nil {
 			return err
 		}
 
-		// Config
-		conf := config.New(ctx, "")
+		// Working-hours schedule; the releaser alarm tolerates the gaps
+		releaser.StoppedOnSchedule = schedule.Enabled()
 
-		dockerUsername := conf.Require("dockerUsername")
-		dockerPassword := conf.RequireSecret("dockerPassword")
-		githubToken := conf.RequireSecret("githubToken")
-
-		releaserImage := conf.Get("releaserImage")
-		if releaserImage == "" {
-			releaserImage = "singaravelan21/todo-releaser"
-		}
-		releaserVersion := conf.Get("releaserVersion")
-		if releaserVersion == "" {
-			releaserVersion = "latest"
-		}
-
-		// 5. Run Ansible Playbook
-		_, err = local.NewCommand(ctx, "run-ansible", &local.CommandArgs{
-			Create: pulumi.Sprintf("sleep 60; ANSIBLE_HOST_KEY_CHECKING=False ansible-playbook -vvv -u ec2-user --private-key %s -i '%s,' -e 'docker_username=%s' -e 'docker_password=%s' -e 'github_token=%s' -e 'releaser_image=%s' -e 'releaser_version=%s' ansible/playbook.yml",
-				privateKeyPath,
-				server.PublicIp,
-				dockerUsername,
-				dockerPassword,
-				githubToken,
-				pulumi.String(releaserImage),
-				pulumi.String(releaserVersion),
-			),
-			Triggers: pulumi.Array{
-				server.PublicIp,
-				dockerPassword,
-				githubToken,
-			},
-		}, pulumi.DependsOn([]pulumi.Resource{server}))
+		// The releaser runs as a systemd unit whose environment file lives in
+		// SSM; both bootstrap modes install the same units
+		releaserService, err := newReleaserService(ctx, "todo-controlplane-releaser", releaser, instanceRole, "todo/controlplane")
+		if err != nil {
+			return err
+		}
+
+		// 5. Provision the instance
+		if bootstrap.Mode == bootstrapSSM {
+			association, err := newSSMBootstrap(ctx, "todo-controlplane", bootstrap, instanceRole, bootstrapTargets, ssmBootstrapArgs{
+				DockerUsername:   dockerUsername,
+				DockerPassword:   dockerPassword,
+				Github:           github,
+				ReleaserUnits:    releaserService.Units,
+				DataVolumeDevice: dataDevice,
+			}, provisionDeps)
+			if err != nil {
+				return err
+			}
+			ctx.Export("bootstrapAssociationId", association.AssociationId)
+		} else {
+			// Run the Ansible playbook over SSH once cloud-init reports the
+			// instance ready
+			ready, err := instance.WaitForCloudInit(ctx, "todo-controlplane-wait-cloud-init", server, sshKey, instance.LoadReadiness(conf), provisionDeps)
+			if err != nil {
+				return err
+			}
+			provisionDeps = append(provisionDeps, ready)
+
+			// Secrets are passed through the environment (read by the playbook with
+			// lookup('env')) so they never appear in the command line, process
+			// listings or Pulumi logs.
+			keySetup, ansibleEnv := sshKey.AnsibleKeySetup()
+			ansibleEnv["DOCKER_PASSWORD"] = dockerPassword
+			ansibleEnv["RELEASER_SERVICE"] = pulumi.String(releaserService.Units["todo-releaser.service"])
+			ansibleEnv["RELEASER_HEALTH_SERVICE"] = pulumi.String(releaserService.Units["todo-releaser-health.service"])
+			ansibleEnv["RELEASER_HEALTH_TIMER"] = pulumi.String(releaserService.Units["todo-releaser-health.timer"])
+
+			_, err = local.NewCommand(ctx, "run-ansible", &local.CommandArgs{
+				Create: pulumi.Sprintf("%sANSIBLE_HOST_KEY_CHECKING=False ansible-playbook -vvv -u ec2-user --private-key \"$SSH_KEY_FILE\" -i '%s,' -e 'aws_region=%s' -e 'docker_username=%s' -e 'github_credential_type=%s' -e 'github_secret_id=%s' -e 'data_volume_device=%s' ansible/playbook.yml",
+					keySetup,
+					server.PublicIp,
+					pulumi.String(region.Region),
+					dockerUsername,
+					pulumi.String(github.Type),
+					github.SecretArn,
+					pulumi.String(dataDevice),
+				),
+				Environment: ansibleEnv,
+				Triggers: pulumi.Array{
+					server.PublicIp,
+					releaserService.EnvParameter.Version,
+					pulumi.ToStringMap(releaserService.Units),
+					dockerPassword,
+					github.SecretArn,
+				},
+			}, pulumi.DependsOn(provisionDeps), pulumi.AdditionalSecretOutputs([]string{"stdout", "stderr"}))
+			if err != nil {
+				return err
+			}
+		}
+
+		// 6. Stop the instance outside working hours
+		err = newInstanceSchedule(ctx, "todo-controlplane-schedule", schedule, scheduled)
 		if err != nil {
 			return err
 		}
 
 		// Outputs
-		ctx.Export("publicIp", server.PublicIp)
-		ctx.Export("publicHostName", server.PublicDns)
+		if server != nil {
+			ctx.Export("instanceId", server.ID())
+			ctx.Export("publicIp", server.PublicIp)
+			ctx.Export("publicHostName", server.PublicDns)
+		} else {
+			ctx.Export("autoScalingGroupName", group.Name)
+		}
+		ctx.Export("containerLogGroup", logGroups.Containers.Name)
+		ctx.Export("systemLogGroup", logGroups.System.Name)
+		ctx.Export("releaserEnvParameter", releaserService.EnvParameter.Name)
+		ctx.Export("releaserPort", pulumi.Int(releaser.Port))
+		ctx.Export("releaserAlarmArn", releaserService.Alarm.Arn)
+		ctx.Export("githubSecretArn", github.SecretArn)
+		if github.DeployKey != nil {
+			ctx.Export("githubDeployKey", github.DeployKey.PublicKeyOpenssh)
+		}
+		if sshKey != nil && sshKey.Generated != nil {
+			ctx.Export("sshPrivateKey", pulumi.ToSecret(sshKey.Generated.PrivateKeyOpenssh))
+			ctx.Export("sshKeySecretArn", sshKeySecret.Arn)
+		}
+		ctx.Export("vpcId", vpc.ID())
+		ctx.Export("vpcCidr", vpc.CidrBlock)
+		if app != nil {
+			ctx.Export("appPrivateIp", app.GetStringOutput(pulumi.String("privateIp")))
+		}
 
 		return nil
 	})
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/autoscaling"
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/cloudwatch"
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/ec2"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+	"github.com/velann21/todo-releaser/infrastructure/instance"
+)
+
+// recoveryConfig selects how a failed instance is brought back.
+type recoveryConfig struct {
+	// AutoScalingGroup runs the instance in a size-1 auto scaling group that
+	// replaces it when it fails health checks. The replacement is
+	// bootstrapped by the SSM association, so it needs bootstrapMode "ssm"
+	// and cannot use a data volume. Otherwise the standalone instance gets an
+	// EC2 auto-recovery alarm.
+	AutoScalingGroup bool
+}
+
+func loadRecoveryConfig(conf *config.Config) recoveryConfig {
+	return recoveryConfig{
+		AutoScalingGroup: conf.GetBool("autoScalingGroup"),
+	}
+}
+
+// validate checks that the other settings allow unattended replacement.
+func (r recoveryConfig) validate(b bootstrapConfig, s instance.Storage) error {
+	if !r.AutoScalingGroup {
+		return nil
+	}
+	if b.Mode != bootstrapSSM {
+		return errors.New("autoScalingGroup requires bootstrapMode ssm")
+	}
+	if s.DataVolumeSize > 0 {
+		return errors.New("autoScalingGroup cannot be combined with dataVolumeSize")
+	}
+	return nil
+}
+
+// newRecoveryAlarm recovers server onto new hardware when the system status
+// check fails, keeping its ID, IPs and volumes.
+func newRecoveryAlarm(ctx *pulumi.Context, name, region string, server *ec2.Instance) (*cloudwatch.MetricAlarm, error) {
+	return cloudwatch.NewMetricAlarm(ctx, name, &cloudwatch.MetricAlarmArgs{
+		AlarmDescription:   pulumi.String("Recovers the instance when the system status check fails"),
+		Namespace:          pulumi.String("AWS/EC2"),
+		MetricName:         pulumi.String("StatusCheckFailed_System"),
+		Dimensions:         pulumi.StringMap{"InstanceId": server.ID()},
+		Statistic:          pulumi.String("Maximum"),
+		Period:             pulumi.Int(60),
+		EvaluationPeriods:  pulumi.Int(2),
+		Threshold:          pulumi.Float64(1),
+		ComparisonOperator: pulumi.String("GreaterThanOrEqualToThreshold"),
+		AlarmActions: pulumi.Array{
+			pulumi.String("arn:aws:automate:" + region + ":ec2:recover"),
+		},
+	})
+}
+
+// instanceGroupArgs describes the instances the group launches.
+type instanceGroupArgs struct {
+	Ami             string
+	InstanceType    string
+	SubnetId        pulumi.StringInput
+	SecurityGroupId pulumi.StringInput
+	InstanceProfile pulumi.StringInput
+	UserData        string
+	Storage         instance.Storage
+	// IgnoreCapacity leaves the group's size to the start/stop schedule.
+	IgnoreCapacity bool
+}
+
+// newInstanceGroup runs a single instance named name in an auto scaling group.
+// Instances are tagged with Name=name so the SSM association picks them up.
+func newInstanceGroup(ctx *pulumi.Context, name string, args instanceGroupArgs, opts ...pulumi.ResourceOption) (*autoscaling.Group, error) {
+	template, err := ec2.NewLaunchTemplate(ctx, name, &ec2.LaunchTemplateArgs{
+		ImageId:      pulumi.String(args.Ami),
+		InstanceType: pulumi.String(args.InstanceType),
+		IamInstanceProfile: &ec2.LaunchTemplateIamInstanceProfileArgs{
+			Name: args.InstanceProfile,
+		},
+		NetworkInterfaces: ec2.LaunchTemplateNetworkInterfaceArray{
+			&ec2.LaunchTemplateNetworkInterfaceArgs{
+				AssociatePublicIpAddress: pulumi.String("true"),
+				SecurityGroups:           pulumi.StringArray{args.SecurityGroupId},
+			},
+		},
+		BlockDeviceMappings: ec2.LaunchTemplateBlockDeviceMappingArray{
+			args.Storage.LaunchTemplateRootDevice(),
+		},
+		MetadataOptions: &ec2.LaunchTemplateMetadataOptionsArgs{
+			HttpEndpoint:            pulumi.String("enabled"),
+			HttpTokens:              pulumi.String("required"),
+			HttpPutResponseHopLimit: pulumi.Int(2),
+		},
+		UserData: pulumi.String(base64.StdEncoding.EncodeToString([]byte(args.UserData))),
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if args.IgnoreCapacity {
+		opts = append(opts, pulumi.IgnoreChanges([]string{"minSize", "desiredCapacity"}))
+	}
+	return autoscaling.NewGroup(ctx, name, &autoscaling.GroupArgs{
+		MinSize:                pulumi.Int(1),
+		MaxSize:                pulumi.Int(1),
+		DesiredCapacity:        pulumi.Int(1),
+		VpcZoneIdentifiers:     pulumi.StringArray{args.SubnetId},
+		HealthCheckType:        pulumi.String("EC2"),
+		HealthCheckGracePeriod: pulumi.Int(300),
+		LaunchTemplate: &autoscaling.GroupLaunchTemplateArgs{
+			Id:      template.ID(),
+			Version: template.LatestVersion.ApplyT(func(v int) string { return strconv.Itoa(v) }).(pulumi.StringOutput),
+		},
+		// Roll onto a new launch template version one instance at a time;
+		// with a single instance that means a short outage.
+		InstanceRefresh: &autoscaling.GroupInstanceRefreshArgs{
+			Strategy: pulumi.String("Rolling"),
+			Preferences: &autoscaling.GroupInstanceRefreshPreferencesArgs{
+				MinHealthyPercentage: pulumi.Int(0),
+			},
+		},
+		Tags: autoscaling.GroupTagArray{
+			&autoscaling.GroupTagArgs{
+				Key:               pulumi.String("Name"),
+				Value:             pulumi.String(name),
+				PropagateAtLaunch: pulumi.Bool(true),
+			},
+		},
+	}, opts...)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"text/template"
+
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws"
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/cloudwatch"
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/iam"
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/ssm"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+)
+
+//go:embed systemd
+var systemdUnits embed.FS
+
+// releaserHealthMetric is published every minute by the health timer: 1 when
+// /healthz answers, 0 otherwise.
+const releaserHealthMetric = "ReleaserHealthy"
+
+// releaserConfig holds the settings for the releaser daemon.
+type releaserConfig struct {
+	Image   string
+	Version string
+	// Port serves /healthz and /metrics on the instance.
+	Port int
+	// Env holds extra KEY=VALUE lines for the daemon's environment file.
+	Env pulumi.StringOutput
+	// AlarmActions are notified when the daemon is reported down.
+	AlarmActions []string
+	// StoppedOnSchedule is set when the instance is stopped outside working
+	// hours; missing health data is expected then.
+	StoppedOnSchedule bool
+}
+
+func loadReleaserConfig(conf *config.Config) releaserConfig {
+	r := releaserConfig{
+		Image:   conf.Get("releaserImage"),
+		Version: conf.Get("releaserVersion"),
+		Port:    conf.GetInt("releaserPort"),
+		Env:     conf.GetSecret("releaserEnv"),
+	}
+	if r.Image == "" {
+		r.Image = "singaravelan21/todo-releaser"
+	}
+	if r.Version == "" {
+		r.Version = "latest"
+	}
+	if r.Port == 0 {
+		r.Port = 9090
+	}
+	if topic := conf.Get("releaserAlarmTopicArn"); topic != "" {
+		r.AlarmActions = []string{topic}
+	}
+	return r
+}
+
+// releaserService is the releaser daemon run by systemd on the instance.
+type releaserService struct {
+	// Units maps unit file names to their rendered contents.
+	Units        map[string]string
+	EnvParameter *ssm.Parameter
+	Alarm        *cloudwatch.MetricAlarm
+}
+
+// newReleaserService stores the daemon's environment file in SSM, lets the
+// instance role read it, renders the systemd units and creates an alarm that
+// fires when the health timer stops reporting the daemon healthy.
+func newReleaserService(ctx *pulumi.Context, name string, r releaserConfig, role *iam.Role, namespace string) (*releaserService, error) {
+	region, err := aws.GetRegion(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	envParameterName := "/" + name + "/" + ctx.Stack() + "/env"
+	envParameter, err := ssm.NewParameter(ctx, name+"-env", &ssm.ParameterArgs{
+		Name:  pulumi.String(envParameterName),
+		Type:  pulumi.String("SecureString"),
+		Value: pulumi.Sprintf("RELEASER_HTTP_ADDR=:%d\nAWS_REGION=%s\n%s", r.Port, region.Region, r.Env),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = iam.NewRolePolicy(ctx, name+"-env", &iam.RolePolicyArgs{
+		Role: role.ID(),
+		Policy: pulumi.Sprintf(`{
+			"Version": "2012-10-17",
+			"Statement": [{
+				"Effect": "Allow",
+				"Action": ["ssm:GetParameter"],
+				"Resource": "%s"
+			}]
+		}`, envParameter.Arn),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The rollback watchdog reads the app load balancer's 5xx count.
+	_, err = iam.NewRolePolicy(ctx, name+"-watchdog", &iam.RolePolicyArgs{
+		Role: role.ID(),
+		Policy: pulumi.String(`{
+			"Version": "2012-10-17",
+			"Statement": [{
+				"Effect": "Allow",
+				"Action": ["cloudwatch:GetMetricStatistics"],
+				"Resource": "*"
+			}]
+		}`),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	svc := &releaserService{
+		Units:        map[string]string{},
+		EnvParameter: envParameter,
+	}
+	values := struct {
+		Region, EnvParameter, Image, Namespace, MetricName, Stack string
+		Port                                                      int
+	}{
+		Region:       region.Region,
+		EnvParameter: envParameterName,
+		Image:        r.Image + ":" + r.Version,
+		Namespace:    namespace,
+		MetricName:   releaserHealthMetric,
+		Stack:        ctx.Stack(),
+		Port:         r.Port,
+	}
+	for _, unit := range []string{"todo-releaser.service", "todo-releaser-health.service", "todo-releaser-health.timer"} {
+		tmpl, err := template.ParseFS(systemdUnits, "systemd/"+unit)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, values); err != nil {
+			return nil, err
+		}
+		svc.Units[unit] = buf.String()
+	}
+
+	var alarmActions pulumi.Array
+	for _, action := range r.AlarmActions {
+		alarmActions = append(alarmActions, pulumi.String(action))
+	}
+	// No data normally means the instance or the timer is gone too
+	treatMissingData := "breaching"
+	if r.StoppedOnSchedule {
+		treatMissingData = "notBreaching"
+	}
+	svc.Alarm, err = cloudwatch.NewMetricAlarm(ctx, name+"-down", &cloudwatch.MetricAlarmArgs{
+		AlarmDescription:   pulumi.String("The releaser daemon has not reported healthy for 3 minutes"),
+		Namespace:          pulumi.String(namespace),
+		MetricName:         pulumi.String(releaserHealthMetric),
+		Dimensions:         pulumi.StringMap{"Stack": pulumi.String(ctx.Stack())},
+		Statistic:          pulumi.String("Minimum"),
+		Period:             pulumi.Int(60),
+		EvaluationPeriods:  pulumi.Int(3),
+		Threshold:          pulumi.Float64(1),
+		ComparisonOperator: pulumi.String("LessThanThreshold"),
+		TreatMissingData:   pulumi.String(treatMissingData),
+		AlarmActions:       alarmActions,
+		OkActions:          alarmActions,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return svc, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/autoscaling"
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/ec2"
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/iam"
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/scheduler"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+)
+
+// scheduleConfig holds the working-hours schedule for the instance. Both
+// expressions are EventBridge Scheduler expressions, e.g.
+// "cron(0 19 ? * MON-FRI *)".
+type scheduleConfig struct {
+	Start    string
+	Stop     string
+	Timezone string
+}
+
+func loadScheduleConfig(conf *config.Config) scheduleConfig {
+	s := scheduleConfig{
+		Start:    conf.Get("scheduleStart"),
+		Stop:     conf.Get("scheduleStop"),
+		Timezone: conf.Get("scheduleTimezone"),
+	}
+	if s.Timezone == "" {
+		s.Timezone = "UTC"
+	}
+	return s
+}
+
+// Enabled reports whether the instance is stopped on a schedule.
+func (s scheduleConfig) Enabled() bool {
+	return s.Start != "" || s.Stop != ""
+}
+
+// scheduleTarget is the API the start and stop schedules call, through
+// EventBridge Scheduler universal targets.
+type scheduleTarget struct {
+	// Resource and Actions scope the scheduler role's permissions.
+	Resource pulumi.StringInput
+	Actions  string
+	// StartApi/StopApi are "<service>:<operation>" universal target names,
+	// called with StartInput/StopInput.
+	StartApi, StopApi     string
+	StartInput, StopInput pulumi.StringInput
+}
+
+// instanceScheduleTarget starts and stops server.
+func instanceScheduleTarget(server *ec2.Instance) scheduleTarget {
+	input := pulumi.Sprintf(`{"InstanceIds": ["%s"]}`, server.ID())
+	return scheduleTarget{
+		Resource:   server.Arn,
+		Actions:    `["ec2:StartInstances", "ec2:StopInstances"]`,
+		StartApi:   "ec2:startInstances",
+		StopApi:    "ec2:stopInstances",
+		StartInput: input,
+		StopInput:  input,
+	}
+}
+
+// groupScheduleTarget scales group between one instance and none.
+func groupScheduleTarget(group *autoscaling.Group) scheduleTarget {
+	return scheduleTarget{
+		Resource:   group.Arn,
+		Actions:    `["autoscaling:UpdateAutoScalingGroup"]`,
+		StartApi:   "autoscaling:updateAutoScalingGroup",
+		StopApi:    "autoscaling:updateAutoScalingGroup",
+		StartInput: pulumi.Sprintf(`{"AutoScalingGroupName": "%s", "MinSize": 1, "DesiredCapacity": 1}`, group.Name),
+		StopInput:  pulumi.Sprintf(`{"AutoScalingGroupName": "%s", "MinSize": 0, "DesiredCapacity": 0}`, group.Name),
+	}
+}
+
+// newInstanceSchedule starts and stops the controlplane instance with
+// EventBridge Scheduler. It does nothing when no schedule is configured.
+func newInstanceSchedule(ctx *pulumi.Context, name string, s scheduleConfig, target scheduleTarget) error {
+	if !s.Enabled() {
+		return nil
+	}
+
+	role, err := iam.NewRole(ctx, name+"-role", &iam.RoleArgs{
+		AssumeRolePolicy: pulumi.String(`{
+			"Version": "2012-10-17",
+			"Statement": [{
+				"Effect": "Allow",
+				"Principal": {"Service": "scheduler.amazonaws.com"},
+				"Action": "sts:AssumeRole"
+			}]
+		}`),
+	})
+	if err != nil {
+		return err
+	}
+
+	policy, err := iam.NewRolePolicy(ctx, name+"-policy", &iam.RolePolicyArgs{
+		Role: role.ID(),
+		Policy: pulumi.Sprintf(`{
+			"Version": "2012-10-17",
+			"Statement": [{
+				"Effect": "Allow",
+				"Action": %s,
+				"Resource": "%s"
+			}]
+		}`, target.Actions, target.Resource),
+	})
+	if err != nil {
+		return err
+	}
+
+	actions := []struct {
+		name, expression, api string
+		input                 pulumi.StringInput
+	}{
+		{"start", s.Start, target.StartApi, target.StartInput},
+		{"stop", s.Stop, target.StopApi, target.StopInput},
+	}
+	for _, action := range actions {
+		if action.expression == "" {
+			continue
+		}
+		_, err = scheduler.NewSchedule(ctx, name+"-"+action.name, &scheduler.ScheduleArgs{
+			Description:                pulumi.String("Scheduled " + action.name + " of the controlplane instance"),
+			ScheduleExpression:         pulumi.String(action.expression),
+			ScheduleExpressionTimezone: pulumi.String(s.Timezone),
+			FlexibleTimeWindow: &scheduler.ScheduleFlexibleTimeWindowArgs{
+				Mode: pulumi.String("OFF"),
+			},
+			Target: &scheduler.ScheduleTargetArgs{
+				Arn:     pulumi.String("arn:aws:scheduler:::aws-sdk:" + action.api),
+				RoleArn: role.Arn,
+				Input:   action.input,
+			},
+		}, pulumi.DependsOn([]pulumi.Resource{policy}))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
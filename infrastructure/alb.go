@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws"
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/ec2"
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/lb"
+	"github.com/pulumi/pulumi-command/sdk/go/command/local"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+)
+
+const (
+	frontendPort = 3000
+	backendPort  = 8000
+)
+
+// appLoadBalancer fronts the app instance so it can be replaced blue/green.
+// Pulumi creates a replacement instance before deleting the old one; the
+// replacement is registered here and has to pass the ALB health checks before
+// the update continues and the old instance is retired.
+type appLoadBalancer struct {
+	LoadBalancer  *lb.LoadBalancer
+	SecurityGroup *ec2.SecurityGroup
+	Frontend      *lb.TargetGroup
+	Backend       *lb.TargetGroup
+}
+
+// secondAvailabilityZone is the zone of the ALB's second subnet: the
+// albAvailabilityZone config if set, else the first available zone of the
+// region other than first.
+func secondAvailabilityZone(ctx *pulumi.Context, conf *config.Config, first string) (string, error) {
+	if zone := conf.Get("albAvailabilityZone"); zone != "" {
+		return zone, nil
+	}
+	zones, err := aws.GetAvailabilityZones(ctx, &aws.GetAvailabilityZonesArgs{
+		State: pulumi.StringRef("available"),
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, zone := range zones.Names {
+		if zone != first {
+			return zone, nil
+		}
+	}
+	return "", fmt.Errorf("no availability zone other than %s is available for the load balancer", first)
+}
+
+func newAppLoadBalancer(ctx *pulumi.Context, vpc *ec2.Vpc, subnets pulumi.StringArray, backendHealthPath string) (*appLoadBalancer, error) {
+	sg, err := ec2.NewSecurityGroup(ctx, "todo-alb-sg", &ec2.SecurityGroupArgs{
+		VpcId:       vpc.ID(),
+		Description: pulumi.String("Allow HTTP to the load balancer"),
+		Ingress: ec2.SecurityGroupIngressArray{
+			&ec2.SecurityGroupIngressArgs{
+				Protocol:    pulumi.String("tcp"),
+				FromPort:    pulumi.Int(80),
+				ToPort:      pulumi.Int(80),
+				CidrBlocks:  pulumi.StringArray{pulumi.String("0.0.0.0/0")},
+				Description: pulumi.String("HTTP"),
+			},
+		},
+		Egress: ec2.SecurityGroupEgressArray{
+			&ec2.SecurityGroupEgressArgs{
+				Protocol:   pulumi.String("-1"),
+				FromPort:   pulumi.Int(0),
+				ToPort:     pulumi.Int(0),
+				CidrBlocks: pulumi.StringArray{vpc.CidrBlock},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	alb, err := lb.NewLoadBalancer(ctx, "todo-alb", &lb.LoadBalancerArgs{
+		LoadBalancerType: pulumi.String("application"),
+		SecurityGroups:   pulumi.StringArray{sg.ID()},
+		Subnets:          subnets,
+		Tags: pulumi.StringMap{
+			"Name": pulumi.String("todo-alb"),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	frontend, err := lb.NewTargetGroup(ctx, "todo-frontend-tg", &lb.TargetGroupArgs{
+		VpcId:               vpc.ID(),
+		Port:                pulumi.Int(frontendPort),
+		Protocol:            pulumi.String("HTTP"),
+		TargetType:          pulumi.String("instance"),
+		DeregistrationDelay: pulumi.Int(30),
+		HealthCheck: &lb.TargetGroupHealthCheckArgs{
+			Path:               pulumi.String("/"),
+			Matcher:            pulumi.String("200-399"),
+			Interval:           pulumi.Int(15),
+			HealthyThreshold:   pulumi.Int(2),
+			UnhealthyThreshold: pulumi.Int(3),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	backend, err := lb.NewTargetGroup(ctx, "todo-backend-tg", &lb.TargetGroupArgs{
+		VpcId:               vpc.ID(),
+		Port:                pulumi.Int(backendPort),
+		Protocol:            pulumi.String("HTTP"),
+		TargetType:          pulumi.String("instance"),
+		DeregistrationDelay: pulumi.Int(30),
+		HealthCheck: &lb.TargetGroupHealthCheckArgs{
+			Path:               pulumi.String(backendHealthPath),
+			Matcher:            pulumi.String("200-399"),
+			Interval:           pulumi.Int(15),
+			HealthyThreshold:   pulumi.Int(2),
+			UnhealthyThreshold: pulumi.Int(3),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := lb.NewListener(ctx, "todo-alb-http", &lb.ListenerArgs{
+		LoadBalancerArn: alb.Arn,
+		Port:            pulumi.Int(80),
+		Protocol:        pulumi.String("HTTP"),
+		DefaultActions: lb.ListenerDefaultActionArray{
+			&lb.ListenerDefaultActionArgs{
+				Type:           pulumi.String("forward"),
+				TargetGroupArn: frontend.Arn,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = lb.NewListenerRule(ctx, "todo-alb-api", &lb.ListenerRuleArgs{
+		ListenerArn: listener.Arn,
+		Priority:    pulumi.Int(10),
+		Actions: lb.ListenerRuleActionArray{
+			&lb.ListenerRuleActionArgs{
+				Type:           pulumi.String("forward"),
+				TargetGroupArn: backend.Arn,
+			},
+		},
+		Conditions: lb.ListenerRuleConditionArray{
+			&lb.ListenerRuleConditionArgs{
+				PathPattern: &lb.ListenerRuleConditionPathPatternArgs{
+					Values: pulumi.StringArray{pulumi.String("/api/*")},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &appLoadBalancer{
+		LoadBalancer:  alb,
+		SecurityGroup: sg,
+		Frontend:      frontend,
+		Backend:       backend,
+	}, nil
+}
+
+// registerInstance attaches server to both target groups and blocks until the
+// ALB reports it in service. deps are the resources that have to finish
+// (typically the provisioning step) before health checks can pass. The wait
+// runs the aws CLI where Pulumi runs, against the stack's region rather than
+// the CLI's default.
+func (a *appLoadBalancer) registerInstance(ctx *pulumi.Context, server *ec2.Instance, deps []pulumi.Resource) (*local.Command, error) {
+	region, err := aws.GetRegion(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	frontendAttachment, err := lb.NewTargetGroupAttachment(ctx, "todo-frontend-tg-attachment", &lb.TargetGroupAttachmentArgs{
+		TargetGroupArn: a.Frontend.Arn,
+		TargetId:       server.ID(),
+		Port:           pulumi.Int(frontendPort),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	backendAttachment, err := lb.NewTargetGroupAttachment(ctx, "todo-backend-tg-attachment", &lb.TargetGroupAttachmentArgs{
+		TargetGroupArn: a.Backend.Arn,
+		TargetId:       server.ID(),
+		Port:           pulumi.Int(backendPort),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	deps = append(deps, frontendAttachment, backendAttachment)
+	return local.NewCommand(ctx, "wait-healthy", &local.CommandArgs{
+		Create: pulumi.Sprintf("aws elbv2 wait target-in-service --region %s --target-group-arn %s --targets Id=%s,Port=%d && aws elbv2 wait target-in-service --region %s --target-group-arn %s --targets Id=%s,Port=%d",
+			region.Region, a.Frontend.Arn, server.ID(), frontendPort,
+			region.Region, a.Backend.Arn, server.ID(), backendPort,
+		),
+		Triggers: pulumi.Array{
+			server.ID(),
+		},
+	}, pulumi.DependsOn(deps))
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	_ "embed"
+
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/cloudwatch"
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/iam"
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/kms"
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/lambda"
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/rds"
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/s3"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+)
+
+//go:embed lambda/snapshot_export.py
+var snapshotExportSource string
+
+// snapshotConfig holds the disaster-recovery settings for the database.
+type snapshotConfig struct {
+	Enabled       bool
+	Schedule      string
+	RetentionDays int
+	CopyRegion    string
+}
+
+func loadSnapshotConfig(conf *config.Config) snapshotConfig {
+	s := snapshotConfig{
+		Enabled:       conf.GetBool("snapshotExportEnabled"),
+		Schedule:      conf.Get("snapshotExportSchedule"),
+		RetentionDays: conf.GetInt("snapshotRetentionDays"),
+		CopyRegion:    conf.Get("snapshotCopyRegion"),
+	}
+	if s.Schedule == "" {
+		s.Schedule = "cron(0 3 * * ? *)"
+	}
+	if s.RetentionDays == 0 {
+		s.RetentionDays = 30
+	}
+	return s
+}
+
+// newSnapshotExport schedules a daily export of the cluster's latest automated
+// snapshot to S3 and, when a copy region is configured, a cross-region copy.
+// It returns the export bucket, or nil when exports are disabled.
+func newSnapshotExport(ctx *pulumi.Context, s snapshotConfig, cluster *rds.Cluster) (*s3.Bucket, error) {
+	if !s.Enabled {
+		return nil, nil
+	}
+
+	bucket, err := s3.NewBucket(ctx, "todo-db-snapshot-exports", &s3.BucketArgs{
+		Tags: pulumi.StringMap{
+			"Name": pulumi.String("todo-db-snapshot-exports"),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s3.NewBucketPublicAccessBlock(ctx, "todo-db-snapshot-exports-pab", &s3.BucketPublicAccessBlockArgs{
+		Bucket:                bucket.ID(),
+		BlockPublicAcls:       pulumi.Bool(true),
+		BlockPublicPolicy:     pulumi.Bool(true),
+		IgnorePublicAcls:      pulumi.Bool(true),
+		RestrictPublicBuckets: pulumi.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s3.NewBucketLifecycleConfiguration(ctx, "todo-db-snapshot-exports-lifecycle", &s3.BucketLifecycleConfigurationArgs{
+		Bucket: bucket.ID(),
+		Rules: s3.BucketLifecycleConfigurationRuleArray{
+			&s3.BucketLifecycleConfigurationRuleArgs{
+				Id:     pulumi.String("expire-exports"),
+				Status: pulumi.String("Enabled"),
+				Filter: &s3.BucketLifecycleConfigurationRuleFilterArgs{},
+				Expiration: &s3.BucketLifecycleConfigurationRuleExpirationArgs{
+					Days: pulumi.Int(s.RetentionDays),
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Snapshot exports must be encrypted with a customer managed key
+	exportKey, err := kms.NewKey(ctx, "todo-db-snapshot-export-key", &kms.KeyArgs{
+		Description:       pulumi.String("Encrypts RDS snapshot exports"),
+		EnableKeyRotation: pulumi.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	exportRole, err := iam.NewRole(ctx, "todo-db-snapshot-export-role", &iam.RoleArgs{
+		AssumeRolePolicy: pulumi.String(`{
+			"Version": "2012-10-17",
+			"Statement": [{
+				"Effect": "Allow",
+				"Principal": {"Service": "export.rds.amazonaws.com"},
+				"Action": "sts:AssumeRole"
+			}]
+		}`),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = iam.NewRolePolicy(ctx, "todo-db-snapshot-export-policy", &iam.RolePolicyArgs{
+		Role: exportRole.ID(),
+		Policy: pulumi.Sprintf(`{
+			"Version": "2012-10-17",
+			"Statement": [{
+				"Effect": "Allow",
+				"Action": ["s3:PutObject*", "s3:GetObject*", "s3:ListBucket", "s3:DeleteObject*", "s3:GetBucketLocation"],
+				"Resource": ["%s", "%s/*"]
+			}]
+		}`, bucket.Arn, bucket.Arn),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	functionRole, err := iam.NewRole(ctx, "todo-db-snapshot-export-fn-role", &iam.RoleArgs{
+		AssumeRolePolicy: pulumi.String(`{
+			"Version": "2012-10-17",
+			"Statement": [{
+				"Effect": "Allow",
+				"Principal": {"Service": "lambda.amazonaws.com"},
+				"Action": "sts:AssumeRole"
+			}]
+		}`),
+		ManagedPolicyArns: pulumi.StringArray{
+			pulumi.String("arn:aws:iam::aws:policy/service-role/AWSLambdaBasicExecutionRole"),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = iam.NewRolePolicy(ctx, "todo-db-snapshot-export-fn-policy", &iam.RolePolicyArgs{
+		Role: functionRole.ID(),
+		Policy: pulumi.Sprintf(`{
+			"Version": "2012-10-17",
+			"Statement": [
+				{
+					"Effect": "Allow",
+					"Action": [
+						"rds:DescribeDBClusterSnapshots",
+						"rds:StartExportTask",
+						"rds:CopyDBClusterSnapshot",
+						"rds:DeleteDBClusterSnapshot",
+						"rds:AddTagsToResource"
+					],
+					"Resource": "*"
+				},
+				{
+					"Effect": "Allow",
+					"Action": "iam:PassRole",
+					"Resource": "%s"
+				},
+				{
+					"Effect": "Allow",
+					"Action": ["kms:DescribeKey", "kms:CreateGrant", "kms:Encrypt", "kms:Decrypt", "kms:GenerateDataKey*", "kms:ReEncrypt*", "kms:RetireGrant"],
+					"Resource": "%s"
+				}
+			]
+		}`, exportRole.Arn, exportKey.Arn),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	function, err := lambda.NewFunction(ctx, "todo-db-snapshot-export", &lambda.FunctionArgs{
+		Runtime: pulumi.String("python3.12"),
+		Handler: pulumi.String("index.handler"),
+		Role:    functionRole.Arn,
+		Timeout: pulumi.Int(60),
+		Code: pulumi.NewAssetArchive(map[string]interface{}{
+			"index.py": pulumi.NewStringAsset(snapshotExportSource),
+		}),
+		Environment: &lambda.FunctionEnvironmentArgs{
+			Variables: pulumi.StringMap{
+				"CLUSTER_ID":        cluster.ClusterIdentifier,
+				"EXPORT_BUCKET":     bucket.Bucket,
+				"EXPORT_ROLE_ARN":   exportRole.Arn,
+				"EXPORT_KMS_KEY_ID": exportKey.Arn,
+				"COPY_REGION":       pulumi.String(s.CopyRegion),
+				"RETENTION_DAYS":    pulumi.Sprintf("%d", s.RetentionDays),
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rule, err := cloudwatch.NewEventRule(ctx, "todo-db-snapshot-export-schedule", &cloudwatch.EventRuleArgs{
+		Description:        pulumi.String("Exports the latest database snapshot for disaster recovery"),
+		ScheduleExpression: pulumi.String(s.Schedule),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = lambda.NewPermission(ctx, "todo-db-snapshot-export-invoke", &lambda.PermissionArgs{
+		Action:    pulumi.String("lambda:InvokeFunction"),
+		Function:  function.Name,
+		Principal: pulumi.String("events.amazonaws.com"),
+		SourceArn: rule.Arn,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = cloudwatch.NewEventTarget(ctx, "todo-db-snapshot-export-target", &cloudwatch.EventTargetArgs{
+		Rule: rule.Name,
+		Arn:  function.Arn,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return bucket, nil
+}
@@ -0,0 +1,71 @@
+package instance
+
+import (
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/ec2"
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/iam"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// NewRole creates an EC2 role with the given managed policies and an
+// instance profile for it. Callers attach additional inline policies to the
+// returned role.
+func NewRole(ctx *pulumi.Context, name string, policyArns ...string) (*iam.Role, *iam.InstanceProfile, error) {
+	role, err := iam.NewRole(ctx, name, &iam.RoleArgs{
+		AssumeRolePolicy: pulumi.String(`{
+			"Version": "2012-10-17",
+			"Statement": [{
+				"Effect": "Allow",
+				"Principal": {"Service": "ec2.amazonaws.com"},
+				"Action": "sts:AssumeRole"
+			}]
+		}`),
+		ManagedPolicyArns: pulumi.ToStringArray(policyArns),
+		Tags: pulumi.StringMap{
+			"Name": pulumi.String(name),
+		},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	profile, err := iam.NewInstanceProfile(ctx, name, &iam.InstanceProfileArgs{
+		Role: role.Name,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return role, profile, nil
+}
+
+// MetadataOptions requires IMDSv2 and allows one extra hop, so containers on
+// the Docker bridge network can still get role credentials.
+func MetadataOptions() *ec2.InstanceMetadataOptionsArgs {
+	return &ec2.InstanceMetadataOptionsArgs{
+		HttpEndpoint:            pulumi.String("enabled"),
+		HttpTokens:              pulumi.String("required"),
+		HttpPutResponseHopLimit: pulumi.Int(2),
+	}
+}
+
+// AllowSecretsRead lets role read the given Secrets Manager secrets and
+// nothing else.
+func AllowSecretsRead(ctx *pulumi.Context, name string, role *iam.Role, secretArns ...pulumi.StringInput) (*iam.RolePolicy, error) {
+	resources := make(pulumi.Array, len(secretArns))
+	for i, arn := range secretArns {
+		resources[i] = arn
+	}
+	policy := pulumi.JSONMarshal(pulumi.Map{
+		"Version": pulumi.String("2012-10-17"),
+		"Statement": pulumi.Array{
+			pulumi.Map{
+				"Effect":   pulumi.String("Allow"),
+				"Action":   pulumi.StringArray{pulumi.String("secretsmanager:GetSecretValue"), pulumi.String("secretsmanager:DescribeSecret")},
+				"Resource": resources,
+			},
+		},
+	})
+	return iam.NewRolePolicy(ctx, name, &iam.RolePolicyArgs{
+		Role:   role.ID(),
+		Policy: policy,
+	})
+}
@@ -0,0 +1,4 @@
+// Package instance holds the EC2 instance plumbing shared by the app and
+// controlplane stacks: SSH keys, storage, the instance role, log shipping
+// and waiting for first boot to finish.
+package instance
@@ -0,0 +1,96 @@
+package instance
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/ec2"
+	"github.com/pulumi/pulumi-tls/sdk/v5/go/tls"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+)
+
+// SSHKey is the key pair the instance is launched with, plus how Ansible gets
+// hold of the matching private key.
+type SSHKey struct {
+	KeyPair *ec2.KeyPair
+	// Generated is the generated private key, kept in the stack state as a
+	// secret. It is nil when the public key was imported from config.
+	Generated *tls.PrivateKey
+	// privateKeyPath is the operator-provided private key for imported keys.
+	privateKeyPath string
+}
+
+// NewSSHKey creates the AWS key pair for name. When sshPublicKey is configured
+// that key is imported and Ansible uses the private key at sshPrivateKeyPath
+// (default ~/.ssh/<name>-key.pem).
+// Otherwise an ed25519 key is generated; it never touches the disk except for
+// the duration of the Ansible run.
+func NewSSHKey(ctx *pulumi.Context, name string, conf *config.Config) (*SSHKey, error) {
+	key := &SSHKey{
+		privateKeyPath: conf.Get("sshPrivateKeyPath"),
+	}
+	if key.privateKeyPath == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		key.privateKeyPath = filepath.Join(homeDir, ".ssh", name+"-key.pem")
+	}
+
+	publicKey := pulumi.String(conf.Get("sshPublicKey")).ToStringOutput()
+	if conf.Get("sshPublicKey") == "" {
+		generated, err := tls.NewPrivateKey(ctx, name+"-ssh-key", &tls.PrivateKeyArgs{
+			Algorithm: pulumi.String("ED25519"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		publicKey = generated.PublicKeyOpenssh
+		key.Generated = generated
+	}
+
+	var err error
+	key.KeyPair, err = ec2.NewKeyPair(ctx, name+"-key-pair", &ec2.KeyPairArgs{
+		PublicKey: publicKey,
+		Tags: pulumi.StringMap{
+			"Name": pulumi.String(name + "-key-pair"),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// AnsibleKeySetup returns a shell prefix that points $SSH_KEY_FILE at the
+// private key, and the environment it needs. A generated key is passed in
+// through the environment and written to a private temp file that is removed
+// when the command exits, so it never shows up in the command line or logs.
+func (k *SSHKey) AnsibleKeySetup() (string, pulumi.StringMap) {
+	if k.Generated == nil {
+		return "SSH_KEY_FILE=" + shellQuote(k.privateKeyPath) + "; ", pulumi.StringMap{}
+	}
+	setup := `umask 077; SSH_KEY_FILE=$(mktemp); trap 'rm -f "$SSH_KEY_FILE"' EXIT; printf '%s\n' "$SSH_PRIVATE_KEY" > "$SSH_KEY_FILE"; `
+	return setup, pulumi.StringMap{
+		"SSH_PRIVATE_KEY": pulumi.ToSecret(k.Generated.PrivateKeyOpenssh).(pulumi.StringOutput),
+	}
+}
+
+// shellQuote single-quotes s for use in a POSIX shell command.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// PrivateKeyPEM returns the private key contents for direct SSH connections.
+func (k *SSHKey) PrivateKeyPEM() (pulumi.StringInput, error) {
+	if k.Generated != nil {
+		return k.Generated.PrivateKeyOpenssh, nil
+	}
+	pem, err := os.ReadFile(k.privateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	return pulumi.ToSecret(pulumi.String(pem)).(pulumi.StringOutput), nil
+}
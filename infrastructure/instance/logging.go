@@ -0,0 +1,69 @@
+package instance
+
+import (
+	"bytes"
+	_ "embed"
+	"text/template"
+
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/cloudwatch"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+//go:embed userdata.sh
+var userDataTemplate string
+
+// UserData holds the values the instance bootstrap script is rendered with.
+type UserData struct {
+	ContainerLogGroup string
+	SystemLogGroup    string
+	MetricsNamespace  string
+}
+
+// RenderUserData renders the bootstrap script with d.
+func RenderUserData(d UserData) (string, error) {
+	tmpl, err := template.New("userdata").Parse(userDataTemplate)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, d); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// LogGroups are the CloudWatch log groups the agent ships to.
+type LogGroups struct {
+	Containers     *cloudwatch.LogGroup
+	System         *cloudwatch.LogGroup
+	ContainersName string
+	SystemName     string
+}
+
+// NewLogGroups creates /<prefix>/containers and /<prefix>/system log groups
+// with the given retention.
+func NewLogGroups(ctx *pulumi.Context, name, prefix string, retentionDays int) (*LogGroups, error) {
+	groups := &LogGroups{
+		ContainersName: "/" + prefix + "/containers",
+		SystemName:     "/" + prefix + "/system",
+	}
+
+	var err error
+	groups.Containers, err = cloudwatch.NewLogGroup(ctx, name+"-containers", &cloudwatch.LogGroupArgs{
+		Name:            pulumi.String(groups.ContainersName),
+		RetentionInDays: pulumi.Int(retentionDays),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	groups.System, err = cloudwatch.NewLogGroup(ctx, name+"-system", &cloudwatch.LogGroupArgs{
+		Name:            pulumi.String(groups.SystemName),
+		RetentionInDays: pulumi.Int(retentionDays),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
@@ -0,0 +1,56 @@
+package instance
+
+import (
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/ec2"
+	"github.com/pulumi/pulumi-command/sdk/go/command/remote"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+)
+
+// Readiness controls how long we wait for a new instance to come up.
+type Readiness struct {
+	// DialAttempts is how many SSH connection attempts are made while the
+	// instance boots.
+	DialAttempts int
+	// Timeout bounds the whole wait, as a Go duration string.
+	Timeout string
+}
+
+func LoadReadiness(conf *config.Config) Readiness {
+	r := Readiness{
+		DialAttempts: conf.GetInt("readinessDialAttempts"),
+		Timeout:      conf.Get("readinessTimeout"),
+	}
+	if r.DialAttempts == 0 {
+		r.DialAttempts = 40
+	}
+	if r.Timeout == "" {
+		r.Timeout = "15m"
+	}
+	return r
+}
+
+// WaitForCloudInit blocks until cloud-init (including user data) has finished
+// on server. SSH connection failures are retried while the instance boots.
+// A "degraded" status (exit code 2, recoverable errors) still counts as ready;
+// anything else fails the update.
+func WaitForCloudInit(ctx *pulumi.Context, name string, server *ec2.Instance, key *SSHKey, r Readiness, deps []pulumi.Resource) (*remote.Command, error) {
+	privateKey, err := key.PrivateKeyPEM()
+	if err != nil {
+		return nil, err
+	}
+
+	return remote.NewCommand(ctx, name, &remote.CommandArgs{
+		Connection: &remote.ConnectionArgs{
+			Host:           server.PublicIp,
+			User:           pulumi.String("ec2-user"),
+			PrivateKey:     privateKey,
+			DialErrorLimit: pulumi.Int(r.DialAttempts),
+			PerDialTimeout: pulumi.Int(15),
+		},
+		Create: pulumi.String("sudo cloud-init status --wait --long; rc=$?; [ $rc -eq 0 ] || [ $rc -eq 2 ]"),
+		Triggers: pulumi.Array{
+			server.ID(),
+		},
+	}, pulumi.DependsOn(deps), pulumi.Timeouts(&pulumi.CustomTimeouts{Create: r.Timeout}))
+}
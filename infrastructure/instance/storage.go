@@ -0,0 +1,134 @@
+package instance
+
+import (
+	"strconv"
+
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/ebs"
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/ec2"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+)
+
+// DataVolumeDevice is the device name the optional data volume is attached as.
+const DataVolumeDevice = "/dev/sdf"
+
+// Storage holds the EBS settings for the instance's root and data volumes.
+//
+// The root volume keeps the AMI's size, type and encryption unless
+// rootVolumeSize, volumeType or volumeEncrypted is set. Setting any of them
+// on an existing stack resizes or retypes the root volume in place, but
+// turning on encryption replaces the instance, so enable it on a stack whose
+// state lives on the data volume or in RDS. Volumes that don't exist yet,
+// the data volume and the roots of instances launched from a launch
+// template, default to encrypted gp3, the latter of 30 GB.
+type Storage struct {
+	// RootVolumeSize is 0 to keep the AMI's size.
+	RootVolumeSize int
+	// VolumeType is "" to keep the AMI's type.
+	VolumeType string
+	// Encrypted is nil to keep the AMI's encryption.
+	Encrypted      *bool
+	DataVolumeSize int
+}
+
+func LoadStorage(conf *config.Config) Storage {
+	s := Storage{
+		RootVolumeSize: conf.GetInt("rootVolumeSize"),
+		VolumeType:     conf.Get("volumeType"),
+		DataVolumeSize: conf.GetInt("dataVolumeSize"),
+	}
+	if encrypted, err := conf.TryBool("volumeEncrypted"); err == nil {
+		s.Encrypted = &encrypted
+	}
+	return s
+}
+
+// volumeType is the type of new volumes.
+func (s Storage) volumeType() string {
+	if s.VolumeType == "" {
+		return "gp3"
+	}
+	return s.VolumeType
+}
+
+// encrypted is whether new volumes are encrypted.
+func (s Storage) encrypted() bool {
+	return s.Encrypted == nil || *s.Encrypted
+}
+
+// RootBlockDevice overrides the settings of the root volume that are
+// configured, or is nil when none are.
+func (s Storage) RootBlockDevice() ec2.InstanceRootBlockDevicePtrInput {
+	if s.RootVolumeSize == 0 && s.VolumeType == "" && s.Encrypted == nil {
+		return nil
+	}
+	root := &ec2.InstanceRootBlockDeviceArgs{
+		DeleteOnTermination: pulumi.Bool(true),
+	}
+	if s.RootVolumeSize != 0 {
+		root.VolumeSize = pulumi.Int(s.RootVolumeSize)
+	}
+	if s.VolumeType != "" {
+		root.VolumeType = pulumi.String(s.VolumeType)
+	}
+	if s.Encrypted != nil {
+		root.Encrypted = pulumi.Bool(*s.Encrypted)
+	}
+	return root
+}
+
+// LaunchTemplateRootDevice is RootBlockDevice for instances launched from a
+// launch template.
+func (s Storage) LaunchTemplateRootDevice() *ec2.LaunchTemplateBlockDeviceMappingArgs {
+	size := s.RootVolumeSize
+	if size == 0 {
+		size = 30
+	}
+	return &ec2.LaunchTemplateBlockDeviceMappingArgs{
+		DeviceName: pulumi.String("/dev/xvda"),
+		Ebs: &ec2.LaunchTemplateBlockDeviceMappingEbsArgs{
+			VolumeSize:          pulumi.Int(size),
+			VolumeType:          pulumi.String(s.volumeType()),
+			Encrypted:           pulumi.String(strconv.FormatBool(s.encrypted())),
+			DeleteOnTermination: pulumi.String("true"),
+		},
+	}
+}
+
+// NewDataVolume creates the optional data volume and attaches it to server.
+// It returns nil when no data volume is configured.
+//
+// Each instance gets its own volume: a volume attaches to one instance at a
+// time, and moving it would take /data away from the serving instance while
+// its blue/green replacement comes up. A replacement instance gets a new,
+// empty volume, and the retired instance's volume is snapshotted when it is
+// deleted along with the instance. /data therefore only holds what an
+// instance can rebuild, Docker's images and containers; backups are kept off
+// the instance, the database's as RDS snapshots exported to S3
+// (snapshotExportEnabled).
+func NewDataVolume(ctx *pulumi.Context, name string, s Storage, server *ec2.Instance) (*ec2.VolumeAttachment, error) {
+	if s.DataVolumeSize == 0 {
+		return nil, nil
+	}
+
+	volume, err := ebs.NewVolume(ctx, name, &ebs.VolumeArgs{
+		AvailabilityZone: server.AvailabilityZone,
+		Size:             pulumi.Int(s.DataVolumeSize),
+		Type:             pulumi.String(s.volumeType()),
+		Encrypted:        pulumi.Bool(s.encrypted()),
+		FinalSnapshot:    pulumi.Bool(true),
+		Tags: pulumi.StringMap{
+			"Name":     pulumi.String(name),
+			"Instance": server.ID(),
+		},
+	}, pulumi.ReplaceOnChanges([]string{"tags"}))
+	if err != nil {
+		return nil, err
+	}
+
+	return ec2.NewVolumeAttachment(ctx, name+"-attachment", &ec2.VolumeAttachmentArgs{
+		DeviceName: pulumi.String(DataVolumeDevice),
+		InstanceId: server.ID(),
+		VolumeId:   volume.ID(),
+	})
+}
@@ -0,0 +1,68 @@
+#!/bin/bash
+set -euo pipefail
+
+# CloudWatch agent: ship container and system logs plus host metrics
+dnf install -y amazon-cloudwatch-agent rsyslog
+systemctl enable --now rsyslog
+
+cat > /opt/aws/amazon-cloudwatch-agent/etc/amazon-cloudwatch-agent.json <<'CONFIG'
+{
+  "agent": {
+    "metrics_collection_interval": 60
+  },
+  "logs": {
+    "logs_collected": {
+      "files": {
+        "collect_list": [
+          {
+            "file_path": "/var/lib/docker/containers/*/*-json.log",
+            "log_group_name": "{{ .ContainerLogGroup }}",
+            "log_stream_name": "{instance_id}/containers",
+            "timezone": "UTC"
+          },
+          {
+            "file_path": "/data/docker/containers/*/*-json.log",
+            "log_group_name": "{{ .ContainerLogGroup }}",
+            "log_stream_name": "{instance_id}/containers",
+            "timezone": "UTC"
+          },
+          {
+            "file_path": "/var/log/messages",
+            "log_group_name": "{{ .SystemLogGroup }}",
+            "log_stream_name": "{instance_id}/messages",
+            "timezone": "UTC"
+          },
+          {
+            "file_path": "/var/log/cloud-init-output.log",
+            "log_group_name": "{{ .SystemLogGroup }}",
+            "log_stream_name": "{instance_id}/cloud-init",
+            "timezone": "UTC"
+          }
+        ]
+      }
+    }
+  },
+  "metrics": {
+    "namespace": "{{ .MetricsNamespace }}",
+    "append_dimensions": {
+      "InstanceId": "${aws:InstanceId}"
+    },
+    "metrics_collected": {
+      "cpu": {
+        "measurement": ["cpu_usage_active"],
+        "totalcpu": true
+      },
+      "mem": {
+        "measurement": ["mem_used_percent"]
+      },
+      "disk": {
+        "measurement": ["used_percent"],
+        "resources": ["/", "/data"]
+      }
+    }
+  }
+}
+CONFIG
+
+/opt/aws/amazon-cloudwatch-agent/bin/amazon-cloudwatch-agent-ctl -a fetch-config -m ec2 -s \
+  -c file:/opt/aws/amazon-cloudwatch-agent/etc/amazon-cloudwatch-agent.json
@@ -0,0 +1,78 @@
+"""Exports the latest automated Aurora snapshot to S3 and optionally copies it
+to a second region, pruning copies older than the retention period."""
+
+import datetime
+import os
+
+import boto3
+
+CLUSTER_ID = os.environ["CLUSTER_ID"]
+EXPORT_BUCKET = os.environ["EXPORT_BUCKET"]
+EXPORT_ROLE_ARN = os.environ["EXPORT_ROLE_ARN"]
+EXPORT_KMS_KEY_ID = os.environ["EXPORT_KMS_KEY_ID"]
+COPY_REGION = os.environ.get("COPY_REGION", "")
+RETENTION_DAYS = int(os.environ.get("RETENTION_DAYS", "30"))
+
+COPY_PREFIX = "todo-dr-"
+
+
+def latest_snapshot(rds):
+    snapshots = rds.describe_db_cluster_snapshots(
+        DBClusterIdentifier=CLUSTER_ID,
+        SnapshotType="automated",
+    )["DBClusterSnapshots"]
+    available = [s for s in snapshots if s["Status"] == "available"]
+    if not available:
+        return None
+    return max(available, key=lambda s: s["SnapshotCreateTime"])
+
+
+def export_snapshot(rds, snapshot):
+    stamp = snapshot["SnapshotCreateTime"].strftime("%Y%m%d%H%M")
+    task_id = f"{CLUSTER_ID}-{stamp}"[:60]
+    rds.start_export_task(
+        ExportTaskIdentifier=task_id,
+        SourceArn=snapshot["DBClusterSnapshotArn"],
+        S3BucketName=EXPORT_BUCKET,
+        S3Prefix=CLUSTER_ID,
+        IamRoleArn=EXPORT_ROLE_ARN,
+        KmsKeyId=EXPORT_KMS_KEY_ID,
+    )
+    print(f"Started export task {task_id}")
+
+
+def copy_snapshot(snapshot):
+    source_region = boto3.session.Session().region_name
+    target = boto3.client("rds", region_name=COPY_REGION)
+    stamp = snapshot["SnapshotCreateTime"].strftime("%Y%m%d%H%M")
+    copy_id = f"{COPY_PREFIX}{CLUSTER_ID}-{stamp}"[:63]
+    target.copy_db_cluster_snapshot(
+        SourceDBClusterSnapshotIdentifier=snapshot["DBClusterSnapshotArn"],
+        TargetDBClusterSnapshotIdentifier=copy_id,
+        SourceRegion=source_region,
+        CopyTags=True,
+    )
+    print(f"Copying snapshot to {COPY_REGION} as {copy_id}")
+
+    cutoff = datetime.datetime.now(datetime.timezone.utc) - datetime.timedelta(days=RETENTION_DAYS)
+    copies = target.describe_db_cluster_snapshots(SnapshotType="manual")["DBClusterSnapshots"]
+    for copy in copies:
+        if not copy["DBClusterSnapshotIdentifier"].startswith(COPY_PREFIX + CLUSTER_ID):
+            continue
+        if copy["Status"] == "available" and copy["SnapshotCreateTime"] < cutoff:
+            target.delete_db_cluster_snapshot(
+                DBClusterSnapshotIdentifier=copy["DBClusterSnapshotIdentifier"],
+            )
+            print(f"Deleted expired copy {copy['DBClusterSnapshotIdentifier']}")
+
+
+def handler(event, context):
+    rds = boto3.client("rds")
+    snapshot = latest_snapshot(rds)
+    if snapshot is None:
+        print(f"No automated snapshots found for {CLUSTER_ID}")
+        return
+
+    export_snapshot(rds, snapshot)
+    if COPY_REGION:
+        copy_snapshot(snapshot)
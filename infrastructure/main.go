@@ -3,9 +3,6 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"os"
-	"os/exec"
-	"path/filepath"
 	"strings"
 
 	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/ec2"
@@ -14,49 +11,20 @@ import (
 	"github.com/pulumi/pulumi-random/sdk/v4/go/random"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+	"github.com/velann21/todo-releaser/infrastructure/instance"
 )
 
-func ensureSSHKey(keyPath string) error {
-	if _, err := os.Stat(keyPath); os.IsNotExist(err) {
-		// Generate SSH key
-		cmd := exec.Command("ssh-keygen", "-t", "rsa", "-b", "4096", "-f", keyPath, "-N", "")
-		if err := cmd.Run(); err != nil {
-			return err
-		}
-		// Ensure correct permissions
-		if err := os.Chmod(keyPath, 0400); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
 func main() {
 	pulumi.Run(func(ctx *pulumi.Context) error {
-		// 0. Ensure SSH Key Exists
-		homeDir, err := os.UserHomeDir()
-		if err != nil {
-			return err
-		}
-		privateKeyPath := filepath.Join(homeDir, ".ssh", "todo-key.pem")
-		publicKeyPath := privateKeyPath + ".pub"
-
-		if err := ensureSSHKey(privateKeyPath); err != nil {
-			return err
-		}
-
-		publicKeyContent, err := os.ReadFile(publicKeyPath)
+		// Config
+		conf := config.New(ctx, "")
+		waf, err := loadWafConfig(conf)
 		if err != nil {
 			return err
 		}
 
-		// Create AWS Key Pair
-		keyPair, err := ec2.NewKeyPair(ctx, "todo-key-pair", &ec2.KeyPairArgs{
-			PublicKey: pulumi.String(string(publicKeyContent)),
-			Tags: pulumi.StringMap{
-				"Name": pulumi.String("todo-key-pair"),
-			},
-		})
+		// 0. SSH key pair (imported from config or generated)
+		sshKey, err := instance.NewSSHKey(ctx, "todo", conf)
 		if err != nil {
 			return err
 		}
@@ -85,6 +53,46 @@ func main() {
 			return err
 		}
 
+		// Optional account security baseline (CloudTrail, GuardDuty, EBS
+		// encryption). Only enable this in one stack per account/region.
+		var baseline *SecurityBaseline
+		if conf.GetBool("securityBaseline") {
+			baseline, err = NewSecurityBaseline(ctx, "todo-security-baseline")
+			if err != nil {
+				return err
+			}
+		}
+
+		// VPC peering with the controlplane so the releaser can reach this
+		// instance privately. Only set up when controlplaneStack is configured.
+		var peering *ec2.VpcPeeringConnection
+		var controlplaneCidr pulumi.StringOutput
+		if controlplaneStack := conf.Get("controlplaneStack"); controlplaneStack != "" {
+			controlplane, err := pulumi.NewStackReference(ctx, controlplaneStack, nil)
+			if err != nil {
+				return err
+			}
+			controlplaneCidr = controlplane.GetStringOutput(pulumi.String("vpcCidr"))
+
+			peering, err = ec2.NewVpcPeeringConnection(ctx, "todo-controlplane-peering", &ec2.VpcPeeringConnectionArgs{
+				VpcId:      vpc.ID(),
+				PeerVpcId:  controlplane.GetStringOutput(pulumi.String("vpcId")),
+				AutoAccept: pulumi.Bool(true),
+				Accepter: &ec2.VpcPeeringConnectionAccepterTypeArgs{
+					AllowRemoteVpcDnsResolution: pulumi.Bool(true),
+				},
+				Requester: &ec2.VpcPeeringConnectionRequesterArgs{
+					AllowRemoteVpcDnsResolution: pulumi.Bool(true),
+				},
+				Tags: pulumi.StringMap{
+					"Name": pulumi.String("todo-controlplane-peering"),
+				},
+			})
+			if err != nil {
+				return err
+			}
+		}
+
 		// 2. Subnets
 		// Public Subnet (for EC2)
 		publicSubnet, err := ec2.NewSubnet(ctx, "todo-public-subnet-1", &ec2.SubnetArgs{
@@ -100,6 +108,24 @@ func main() {
 			return err
 		}
 
+		// Public Subnet 2 (ALBs need subnets in two AZs)
+		albZone, err := secondAvailabilityZone(ctx, conf, "eu-west-1a")
+		if err != nil {
+			return err
+		}
+		publicSubnet2, err := ec2.NewSubnet(ctx, "todo-public-subnet-2", &ec2.SubnetArgs{
+			VpcId:               vpc.ID(),
+			CidrBlock:           pulumi.String("10.0.4.0/24"),
+			MapPublicIpOnLaunch: pulumi.Bool(true),
+			AvailabilityZone:    pulumi.String(albZone),
+			Tags: pulumi.StringMap{
+				"Name": pulumi.String("todo-public-subnet-2"),
+			},
+		})
+		if err != nil {
+			return err
+		}
+
 		// Private Subnet 1 (for RDS)
 		privateSubnet1, err := ec2.NewSubnet(ctx, "todo-private-subnet-1", &ec2.SubnetArgs{
 			VpcId:            vpc.ID(),
@@ -127,14 +153,21 @@ func main() {
 		}
 
 		// Route Table for Public Subnet
-		publicRt, err := ec2.NewRouteTable(ctx, "todo-public-rt", &ec2.RouteTableArgs{
-			VpcId: vpc.ID(),
-			Routes: ec2.RouteTableRouteArray{
-				&ec2.RouteTableRouteArgs{
-					CidrBlock: pulumi.String("0.0.0.0/0"),
-					GatewayId: igw.ID(),
-				},
+		publicRoutes := ec2.RouteTableRouteArray{
+			&ec2.RouteTableRouteArgs{
+				CidrBlock: pulumi.String("0.0.0.0/0"),
+				GatewayId: igw.ID(),
 			},
+		}
+		if peering != nil {
+			publicRoutes = append(publicRoutes, &ec2.RouteTableRouteArgs{
+				CidrBlock:              controlplaneCidr,
+				VpcPeeringConnectionId: peering.ID(),
+			})
+		}
+		publicRt, err := ec2.NewRouteTable(ctx, "todo-public-rt", &ec2.RouteTableArgs{
+			VpcId:  vpc.ID(),
+			Routes: publicRoutes,
 			Tags: pulumi.StringMap{
 				"Name": pulumi.String("todo-public-rt"),
 			},
@@ -152,41 +185,88 @@ func main() {
 			return err
 		}
 
+		_, err = ec2.NewRouteTableAssociation(ctx, "todo-public-rta-2", &ec2.RouteTableAssociationArgs{
+			SubnetId:     publicSubnet2.ID(),
+			RouteTableId: publicRt.ID(),
+		})
+		if err != nil {
+			return err
+		}
+
+		// Load balancer in front of the app instance
+		backendHealthPath := conf.Get("backendHealthPath")
+		if backendHealthPath == "" {
+			backendHealthPath = "/"
+		}
+		alb, err := newAppLoadBalancer(ctx, vpc, pulumi.StringArray{publicSubnet.ID(), publicSubnet2.ID()}, backendHealthPath)
+		if err != nil {
+			return err
+		}
+
 		// 3. Security Groups
 		// Web SG for EC2
+		webIngress := ec2.SecurityGroupIngressArray{
+			&ec2.SecurityGroupIngressArgs{
+				Protocol:    pulumi.String("tcp"),
+				FromPort:    pulumi.Int(80),
+				ToPort:      pulumi.Int(80),
+				CidrBlocks:  pulumi.StringArray{pulumi.String("0.0.0.0/0")},
+				Description: pulumi.String("HTTP"),
+			},
+			&ec2.SecurityGroupIngressArgs{
+				Protocol:    pulumi.String("tcp"),
+				FromPort:    pulumi.Int(443),
+				ToPort:      pulumi.Int(443),
+				CidrBlocks:  pulumi.StringArray{pulumi.String("0.0.0.0/0")},
+				Description: pulumi.String("HTTPS"),
+			},
+			&ec2.SecurityGroupIngressArgs{
+				Protocol:    pulumi.String("tcp"),
+				FromPort:    pulumi.Int(3000),
+				ToPort:      pulumi.Int(3000),
+				CidrBlocks:  pulumi.StringArray{pulumi.String("0.0.0.0/0")},
+				Description: pulumi.String("Frontend"),
+			},
+			&ec2.SecurityGroupIngressArgs{
+				Protocol:    pulumi.String("tcp"),
+				FromPort:    pulumi.Int(22),
+				ToPort:      pulumi.Int(22),
+				CidrBlocks:  pulumi.StringArray{pulumi.String("0.0.0.0/0")}, // Restrict this in production!
+				Description: pulumi.String("SSH"),
+			},
+		}
+		for _, port := range []int{frontendPort, backendPort} {
+			webIngress = append(webIngress, &ec2.SecurityGroupIngressArgs{
+				Protocol:       pulumi.String("tcp"),
+				FromPort:       pulumi.Int(port),
+				ToPort:         pulumi.Int(port),
+				SecurityGroups: pulumi.StringArray{alb.SecurityGroup.ID()},
+				Description:    pulumi.String("Load balancer"),
+			})
+		}
+		if peering != nil {
+			// SSH, Docker API (TLS) and backend health endpoint for the releaser
+			for _, port := range []struct {
+				port        int
+				description string
+			}{
+				{22, "Controlplane SSH"},
+				{2376, "Controlplane Docker API"},
+				{8000, "Controlplane backend health"},
+			} {
+				webIngress = append(webIngress, &ec2.SecurityGroupIngressArgs{
+					Protocol:    pulumi.String("tcp"),
+					FromPort:    pulumi.Int(port.port),
+					ToPort:      pulumi.Int(port.port),
+					CidrBlocks:  pulumi.StringArray{controlplaneCidr},
+					Description: pulumi.String(port.description),
+				})
+			}
+		}
 		webSg, err := ec2.NewSecurityGroup(ctx, "todo-web-sg", &ec2.SecurityGroupArgs{
 			VpcId:       vpc.ID(),
 			Description: pulumi.String("Allow HTTP/HTTPS and SSH"),
-			Ingress: ec2.SecurityGroupIngressArray{
-				&ec2.SecurityGroupIngressArgs{
-					Protocol:    pulumi.String("tcp"),
-					FromPort:    pulumi.Int(80),
-					ToPort:      pulumi.Int(80),
-					CidrBlocks:  pulumi.StringArray{pulumi.String("0.0.0.0/0")},
-					Description: pulumi.String("HTTP"),
-				},
-				&ec2.SecurityGroupIngressArgs{
-					Protocol:    pulumi.String("tcp"),
-					FromPort:    pulumi.Int(443),
-					ToPort:      pulumi.Int(443),
-					CidrBlocks:  pulumi.StringArray{pulumi.String("0.0.0.0/0")},
-					Description: pulumi.String("HTTPS"),
-				},
-				&ec2.SecurityGroupIngressArgs{
-					Protocol:    pulumi.String("tcp"),
-					FromPort:    pulumi.Int(3000),
-					ToPort:      pulumi.Int(3000),
-					CidrBlocks:  pulumi.StringArray{pulumi.String("0.0.0.0/0")},
-					Description: pulumi.String("Frontend"),
-				},
-				&ec2.SecurityGroupIngressArgs{
-					Protocol:    pulumi.String("tcp"),
-					FromPort:    pulumi.Int(22),
-					ToPort:      pulumi.Int(22),
-					CidrBlocks:  pulumi.StringArray{pulumi.String("0.0.0.0/0")}, // Restrict this in production!
-					Description: pulumi.String("SSH"),
-				},
-			},
+			Ingress:     webIngress,
 			Egress: ec2.SecurityGroupEgressArray{
 				&ec2.SecurityGroupEgressArgs{
 					Protocol:   pulumi.String("-1"),
@@ -228,8 +308,6 @@ func main() {
 			return err
 		}
 
-		// Config
-		conf := config.New(ctx, "")
 		dbUsername := conf.Get("dbUsername")
 		if dbUsername == "" {
 			dbUsername = "postgres"
@@ -267,7 +345,14 @@ func main() {
 
 		dockerUsername := conf.Require("dockerUsername")
 		dockerPassword := conf.RequireSecret("dockerPassword")
-		githubToken := conf.RequireSecret("githubToken")
+		// The releaser pushes as a GitHub App when githubAppId is set, with
+		// short-lived installation tokens, and otherwise with githubToken.
+		githubAppID := conf.Get("githubAppId")
+		githubAppPrivateKey := conf.GetSecret("githubAppPrivateKey")
+		githubToken := conf.GetSecret("githubToken")
+		if githubAppID == "" {
+			githubToken = conf.RequireSecret("githubToken")
+		}
 
 		releaserImage := conf.Get("releaserImage")
 		if releaserImage == "" {
@@ -278,8 +363,6 @@ func main() {
 			releaserVersion = "latest"
 		}
 
-		fmt.Println("Docker Username: ", dockerUsername)
-		fmt.Println("Docker Password: ", dockerPassword)
 		// Generate Random Password
 		dbPassword, err := random.NewRandomPassword(ctx, "db-password", &random.RandomPasswordArgs{
 			Length:          pulumi.Int(16),
@@ -319,7 +402,42 @@ func main() {
 			return err
 		}
 
-		// 5. EC2 Instance (Public Subnet, No UserData)
+		// Disaster recovery: scheduled snapshot exports and cross-region copies
+		snapshotBucket, err := newSnapshotExport(ctx, loadSnapshotConfig(conf), cluster)
+		if err != nil {
+			return err
+		}
+
+		// 5. EC2 Instance (Public Subnet)
+		storage := instance.LoadStorage(conf)
+
+		// Logging: the CloudWatch agent installed from user data ships container
+		// and system logs plus host metrics
+		logRetentionDays := conf.GetInt("logRetentionDays")
+		if logRetentionDays == 0 {
+			logRetentionDays = 14
+		}
+		logGroups, err := instance.NewLogGroups(ctx, "todo-logs", "todo/"+ctx.Stack(), logRetentionDays)
+		if err != nil {
+			return err
+		}
+		// SSM lets post-deployment checks run commands on the instance
+		_, instanceProfile, err := instance.NewRole(ctx, "todo-server-v2-role",
+			"arn:aws:iam::aws:policy/CloudWatchAgentServerPolicy",
+			"arn:aws:iam::aws:policy/AmazonSSMManagedInstanceCore",
+		)
+		if err != nil {
+			return err
+		}
+		serverUserData, err := instance.RenderUserData(instance.UserData{
+			ContainerLogGroup: logGroups.ContainersName,
+			SystemLogGroup:    logGroups.SystemName,
+			MetricsNamespace:  "todo/app",
+		})
+		if err != nil {
+			return err
+		}
+
 		ami, err := ec2.LookupAmi(ctx, &ec2.LookupAmiArgs{
 			MostRecent: pulumi.BoolRef(true),
 			Owners:     []string{"amazon"},
@@ -339,14 +457,29 @@ func main() {
 			VpcSecurityGroupIds: pulumi.StringArray{webSg.ID()},
 			Ami:                 pulumi.String(ami.Id),
 			SubnetId:            publicSubnet.ID(),
-			KeyName:             keyPair.KeyName,
+			KeyName:             sshKey.KeyPair.KeyName,
+			RootBlockDevice:     storage.RootBlockDevice(),
+			IamInstanceProfile:  instanceProfile.Name,
+			UserData:            pulumi.String(serverUserData),
 			Tags: pulumi.StringMap{
 				"Name": pulumi.String("todo-server-v2"),
 			},
-		})
+		}, pulumi.DependsOn([]pulumi.Resource{logGroups.Containers, logGroups.System}))
+		if err != nil {
+			return err
+		}
+
+		// Optional data volume for Docker images
+		dataVolume, err := instance.NewDataVolume(ctx, "todo-data-volume", storage, server)
 		if err != nil {
 			return err
 		}
+		ansibleDeps := []pulumi.Resource{server}
+		dataDevice := ""
+		if dataVolume != nil {
+			ansibleDeps = append(ansibleDeps, dataVolume)
+			dataDevice = instance.DataVolumeDevice
+		}
 
 		// Generate Django Secret Key
 		djangoSecret, err := random.NewRandomPassword(ctx, "django-secret", &random.RandomPasswordArgs{
@@ -358,40 +491,130 @@ func main() {
 		}
 
 		// 6. Run Ansible Playbook
-		_, err = local.NewCommand(ctx, "run-ansible", &local.CommandArgs{
-			Create: pulumi.Sprintf("sleep 60; ANSIBLE_HOST_KEY_CHECKING=False ansible-playbook -vvv -u ec2-user --private-key %s -i '%s,' -e 'database_url=postgres://%s:%s@%s/%s' -e 'secret_key=%s' -e 'frontend_image=%s' -e 'frontend_version=%s' -e 'backend_image=%s' -e 'backend_version=%s' -e 'docker_username=%s' -e 'docker_password=%s' -e 'github_token=%s' -e 'releaser_image=%s' -e 'releaser_version=%s' -e '{\"team_keys\": %s}' ansible/playbook.yml",
-				privateKeyPath,
+		// Wait for cloud-init to report the instance ready instead of guessing
+		ready, err := instance.WaitForCloudInit(ctx, "todo-wait-cloud-init", server, sshKey, instance.LoadReadiness(conf), ansibleDeps)
+		if err != nil {
+			return err
+		}
+		ansibleDeps = append(ansibleDeps, ready)
+
+		// Services start in deployStages order (a JSON list of stages of
+		// service names, from the manifest's depends_on); each stage waits
+		// until its services are healthy before the next one starts.
+		deployStages := conf.Get("deployStages")
+		if deployStages == "" {
+			deployStages = `[["todo-backend", "todo-frontend", "todo-releaser"]]`
+		}
+		var stages [][]string
+		if err := json.Unmarshal([]byte(deployStages), &stages); err != nil {
+			return fmt.Errorf("deployStages: %w", err)
+		}
+		// Migrations run, and must succeed, before their service's stage
+		// (a JSON object of {image, command, verify} by service name).
+		deployMigrations := conf.Get("deployMigrations")
+		if deployMigrations == "" {
+			deployMigrations = "{}"
+		}
+		var migrations map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(deployMigrations), &migrations); err != nil {
+			return fmt.Errorf("deployMigrations: %w", err)
+		}
+
+		// Secrets are passed through the environment (read by the playbook with
+		// lookup('env')) so they never appear in the command line, process
+		// listings or Pulumi logs.
+		retention := loadRetentionConfig(conf)
+		keySetup, ansibleEnv := sshKey.AnsibleKeySetup()
+		ansibleEnv["DATABASE_URL"] = pulumi.Sprintf("postgres://%s:%s@%s/%s",
+			cluster.MasterUsername,
+			dbPassword.Result,
+			cluster.Endpoint,
+			cluster.DatabaseName,
+		)
+		ansibleEnv["SECRET_KEY"] = djangoSecret.Result
+		ansibleEnv["DOCKER_PASSWORD"] = dockerPassword
+		ansibleEnv["GITHUB_TOKEN"] = githubToken
+		ansibleEnv["GITHUB_APP_ID"] = pulumi.String(githubAppID)
+		ansibleEnv["GITHUB_APP_INSTALLATION_ID"] = pulumi.String(conf.Get("githubAppInstallationId"))
+		ansibleEnv["GITHUB_APP_PRIVATE_KEY"] = githubAppPrivateKey
+
+		ansible, err := local.NewCommand(ctx, "run-ansible", &local.CommandArgs{
+			Create: pulumi.Sprintf("%sANSIBLE_HOST_KEY_CHECKING=False ansible-playbook -vvv -u ec2-user --private-key \"$SSH_KEY_FILE\" -i '%s,' -e 'frontend_image=%s' -e 'frontend_version=%s' -e 'backend_image=%s' -e 'backend_version=%s' -e 'docker_username=%s' -e 'releaser_image=%s' -e 'releaser_version=%s' -e 'data_volume_device=%s' -e 'image_retention_hours=%d' -e 'backend_health_path=%s' -e '{\"team_keys\": %s}' -e '{\"deploy_stages\": %s}' -e '{\"deploy_migrations\": %s}' ansible/playbook.yml",
+				keySetup,
 				server.PublicIp,
-				cluster.MasterUsername,
-				dbPassword.Result,
-				cluster.Endpoint,
-				cluster.DatabaseName,
-				djangoSecret.Result,
 				pulumi.String(frontendImage),
 				pulumi.String(frontendVersion),
 				pulumi.String(backendImage),
 				pulumi.String(backendVersion),
 				dockerUsername,
-				dockerPassword,
-				githubToken,
 				pulumi.String(releaserImage),
 				pulumi.String(releaserVersion),
+				pulumi.String(dataDevice),
+				retention.ImageRetentionHours,
+				pulumi.String(backendHealthPath),
 				pulumi.String(teamKeysJSON),
+				pulumi.String(deployStages),
+				pulumi.String(deployMigrations),
 			),
+			Environment: ansibleEnv,
 			Triggers: pulumi.Array{
 				server.PublicIp,
 				djangoSecret.Result,
 				dockerPassword,
 				githubToken,
+				githubAppPrivateKey,
 			},
-		}, pulumi.DependsOn([]pulumi.Resource{server}))
+		}, pulumi.DependsOn(ansibleDeps), pulumi.AdditionalSecretOutputs([]string{"stdout", "stderr"}))
+		if err != nil {
+			return err
+		}
+
+		// 7. Register with the load balancer and wait until healthy. When the
+		// instance is replaced, the old one is only deleted after this passes.
+		_, err = alb.registerInstance(ctx, server, []pulumi.Resource{ansible})
+		if err != nil {
+			return err
+		}
+
+		// Expire old release images in ECR; the instance prunes its own
+		err = newEcrLifecyclePolicies(ctx, "todo-ecr-retention", retention)
+		if err != nil {
+			return err
+		}
+
+		// 8. WAF for the public endpoints
+		webAcl, err := newWebAcl(ctx, waf, alb.LoadBalancer.Arn)
 		if err != nil {
 			return err
 		}
 
 		// Outputs
+		ctx.Export("instanceId", server.ID())
 		ctx.Export("publicIp", server.PublicIp)
+		ctx.Export("releaseVersion", pulumi.String(conf.Get("releaseVersion")))
 		ctx.Export("publicHostName", server.PublicDns)
+		ctx.Export("privateIp", server.PrivateIp)
+		ctx.Export("albDnsName", alb.LoadBalancer.DnsName)
+		ctx.Export("containerLogGroup", logGroups.Containers.Name)
+		ctx.Export("systemLogGroup", logGroups.System.Name)
+		if sshKey.Generated != nil {
+			ctx.Export("sshPrivateKey", pulumi.ToSecret(sshKey.Generated.PrivateKeyOpenssh))
+		}
+		ctx.Export("vpcId", vpc.ID())
+		ctx.Export("vpcCidr", vpc.CidrBlock)
+		if peering != nil {
+			ctx.Export("peeringConnectionId", peering.ID())
+		}
+		if webAcl != nil {
+			ctx.Export("webAclArn", webAcl.Arn)
+		}
+		if baseline != nil {
+			ctx.Export("cloudTrailBucket", baseline.TrailBucket.Bucket)
+			ctx.Export("guardDutyDetectorId", baseline.Detector.ID())
+		}
+		if snapshotBucket != nil {
+			ctx.Export("snapshotExportBucket", snapshotBucket.Bucket)
+		}
 		ctx.Export("dbEndpoint", cluster.Endpoint)
 		ctx.Export("dbUsername", cluster.MasterUsername)
 		ctx.Export("dbPassword", cluster.MasterPassword)
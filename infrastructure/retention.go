@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/ecr"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+)
+
+// retentionConfig bounds how many old images are kept around after
+// releases, on the instance and in ECR.
+type retentionConfig struct {
+	// ImageRetentionHours keeps unused images on the instance for this long
+	// so a rollback does not need a pull; older ones are pruned after each
+	// deploy and daily.
+	ImageRetentionHours int
+	// EcrRepositories are existing ECR repositories to expire old build
+	// images in: those with a tag matching EcrBuildTagPatterns, beyond the
+	// EcrKeepImages most recent. Release tags are never expired.
+	EcrRepositories     []string
+	EcrKeepImages       int
+	EcrBuildTagPatterns []string
+	// EcrUntaggedDays expires untagged images this many days after they
+	// were pushed; 0 keeps them. The manifest pins images by digest, and
+	// those digests lose their tags when a tag moves or is removed
+	// upstream, so only set it for repositories no manifest pins.
+	EcrUntaggedDays int
+}
+
+func loadRetentionConfig(conf *config.Config) retentionConfig {
+	r := retentionConfig{
+		ImageRetentionHours: conf.GetInt("imageRetentionHours"),
+		EcrKeepImages:       conf.GetInt("ecrKeepImages"),
+		EcrBuildTagPatterns: []string{"sha-*"},
+		EcrUntaggedDays:     conf.GetInt("ecrUntaggedDays"),
+	}
+	if r.ImageRetentionHours == 0 {
+		r.ImageRetentionHours = 168
+	}
+	if r.EcrKeepImages == 0 {
+		r.EcrKeepImages = 30
+	}
+	if repos := conf.Get("ecrRepositories"); repos != "" {
+		r.EcrRepositories = strings.Split(repos, ",")
+	}
+	if patterns := conf.Get("ecrBuildTagPatterns"); patterns != "" {
+		r.EcrBuildTagPatterns = strings.Split(patterns, ",")
+	}
+	return r
+}
+
+// ecrLifecyclePolicy is the lifecycle policy r puts on its repositories.
+func (r retentionConfig) ecrLifecyclePolicy() (string, error) {
+	type rule = map[string]any
+	rules := []rule{{
+		"rulePriority": 1,
+		"description":  fmt.Sprintf("Keep the last %d build images", r.EcrKeepImages),
+		"selection": rule{
+			"tagStatus":      "tagged",
+			"tagPatternList": r.EcrBuildTagPatterns,
+			"countType":      "imageCountMoreThan",
+			"countNumber":    r.EcrKeepImages,
+		},
+		"action": rule{"type": "expire"},
+	}}
+	if r.EcrUntaggedDays > 0 {
+		rules = append(rules, rule{
+			"rulePriority": 2,
+			"description":  "Expire untagged images",
+			"selection": rule{
+				"tagStatus":   "untagged",
+				"countType":   "sinceImagePushed",
+				"countUnit":   "days",
+				"countNumber": r.EcrUntaggedDays,
+			},
+			"action": rule{"type": "expire"},
+		})
+	}
+	policy, err := json.Marshal(map[string]any{"rules": rules})
+	return string(policy), err
+}
+
+// newEcrLifecyclePolicies expires old build images in each configured ECR
+// repository, and untagged images if asked to.
+func newEcrLifecyclePolicies(ctx *pulumi.Context, name string, r retentionConfig) error {
+	if len(r.EcrRepositories) == 0 {
+		return nil
+	}
+	policy, err := r.ecrLifecyclePolicy()
+	if err != nil {
+		return err
+	}
+	for _, repo := range r.EcrRepositories {
+		_, err := ecr.NewLifecyclePolicy(ctx, name+"-"+repo, &ecr.LifecyclePolicyArgs{
+			Repository: pulumi.String(repo),
+			Policy:     pulumi.String(policy),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws"
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/cloudtrail"
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/ebs"
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/guardduty"
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/s3"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// SecurityBaseline enables the account/region level controls we want in any
+// fresh account: a multi-region CloudTrail trail, GuardDuty and default EBS
+// encryption. It is meant to be deployed once per account/region.
+type SecurityBaseline struct {
+	pulumi.ResourceState
+
+	TrailBucket *s3.Bucket
+	Trail       *cloudtrail.Trail
+	Detector    *guardduty.Detector
+}
+
+// NewSecurityBaseline registers the security baseline component.
+func NewSecurityBaseline(ctx *pulumi.Context, name string, opts ...pulumi.ResourceOption) (*SecurityBaseline, error) {
+	baseline := &SecurityBaseline{}
+	err := ctx.RegisterComponentResource("todo:security:Baseline", name, baseline, opts...)
+	if err != nil {
+		return nil, err
+	}
+	parent := pulumi.Parent(baseline)
+
+	caller, err := aws.GetCallerIdentity(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// CloudTrail to S3
+	baseline.TrailBucket, err = s3.NewBucket(ctx, name+"-cloudtrail", &s3.BucketArgs{
+		Tags: pulumi.StringMap{
+			"Name": pulumi.String(name + "-cloudtrail"),
+		},
+	}, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s3.NewBucketPublicAccessBlock(ctx, name+"-cloudtrail-pab", &s3.BucketPublicAccessBlockArgs{
+		Bucket:                baseline.TrailBucket.ID(),
+		BlockPublicAcls:       pulumi.Bool(true),
+		BlockPublicPolicy:     pulumi.Bool(true),
+		IgnorePublicAcls:      pulumi.Bool(true),
+		RestrictPublicBuckets: pulumi.Bool(true),
+	}, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	bucketPolicy, err := s3.NewBucketPolicy(ctx, name+"-cloudtrail-policy", &s3.BucketPolicyArgs{
+		Bucket: baseline.TrailBucket.ID(),
+		Policy: pulumi.Sprintf(`{
+			"Version": "2012-10-17",
+			"Statement": [
+				{
+					"Sid": "AWSCloudTrailAclCheck",
+					"Effect": "Allow",
+					"Principal": {"Service": "cloudtrail.amazonaws.com"},
+					"Action": "s3:GetBucketAcl",
+					"Resource": "%s"
+				},
+				{
+					"Sid": "AWSCloudTrailWrite",
+					"Effect": "Allow",
+					"Principal": {"Service": "cloudtrail.amazonaws.com"},
+					"Action": "s3:PutObject",
+					"Resource": "%s/AWSLogs/%s/*",
+					"Condition": {"StringEquals": {"s3:x-amz-acl": "bucket-owner-full-control"}}
+				}
+			]
+		}`, baseline.TrailBucket.Arn, baseline.TrailBucket.Arn, caller.AccountId),
+	}, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	baseline.Trail, err = cloudtrail.NewTrail(ctx, name+"-trail", &cloudtrail.TrailArgs{
+		S3BucketName:               baseline.TrailBucket.ID(),
+		IsMultiRegionTrail:         pulumi.Bool(true),
+		IncludeGlobalServiceEvents: pulumi.Bool(true),
+		EnableLogFileValidation:    pulumi.Bool(true),
+	}, parent, pulumi.DependsOn([]pulumi.Resource{bucketPolicy}))
+	if err != nil {
+		return nil, err
+	}
+
+	// GuardDuty
+	baseline.Detector, err = guardduty.NewDetector(ctx, name+"-guardduty", &guardduty.DetectorArgs{
+		Enable:                     pulumi.Bool(true),
+		FindingPublishingFrequency: pulumi.String("FIFTEEN_MINUTES"),
+	}, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	// Default EBS encryption for the region
+	_, err = ebs.NewEncryptionByDefault(ctx, name+"-ebs-encryption", &ebs.EncryptionByDefaultArgs{
+		Enabled: pulumi.Bool(true),
+	}, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ctx.RegisterResourceOutputs(baseline, pulumi.Map{
+		"trailBucket": baseline.TrailBucket.Bucket,
+		"trailArn":    baseline.Trail.Arn,
+		"detectorId":  baseline.Detector.ID(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return baseline, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pulumi/pulumi-aws/sdk/v7/go/aws/wafv2"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+)
+
+// wafConfig holds the settings for the web ACL protecting the public endpoints.
+type wafConfig struct {
+	Enabled     bool
+	RateLimit   int
+	AllowIps    []string
+	DenyIps     []string
+	ResourceArn string
+}
+
+func loadWafConfig(conf *config.Config) (wafConfig, error) {
+	w := wafConfig{
+		Enabled:     conf.GetBool("wafEnabled"),
+		RateLimit:   conf.GetInt("wafRateLimit"),
+		ResourceArn: conf.Get("wafResourceArn"),
+	}
+	if w.RateLimit == 0 {
+		w.RateLimit = 2000
+	}
+	var err error
+	if w.AllowIps, err = parseIpList(conf, "wafAllowIps"); err != nil {
+		return w, err
+	}
+	if w.DenyIps, err = parseIpList(conf, "wafDenyIps"); err != nil {
+		return w, err
+	}
+	return w, nil
+}
+
+// parseIpList reads the comma-separated IPv4 CIDR ranges of the key config,
+// e.g. "203.0.113.0/24, 198.51.100.7/32".
+func parseIpList(conf *config.Config, key string) ([]string, error) {
+	var cidrs []string
+	for _, entry := range strings.Split(conf.Get(key), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		ip, _, err := net.ParseCIDR(entry)
+		if err != nil || ip.To4() == nil {
+			return nil, fmt.Errorf("%s: %q is not an IPv4 CIDR range", key, entry)
+		}
+		cidrs = append(cidrs, entry)
+	}
+	return cidrs, nil
+}
+
+func visibilityConfig(metricName string) *wafv2.WebAclRuleVisibilityConfigArgs {
+	return &wafv2.WebAclRuleVisibilityConfigArgs{
+		CloudwatchMetricsEnabled: pulumi.Bool(true),
+		MetricName:               pulumi.String(metricName),
+		SampledRequestsEnabled:   pulumi.Bool(true),
+	}
+}
+
+// newWebAcl creates a regional web ACL with the AWS common rule set, a
+// per-IP rate limit and optional allow/deny IP lists. With an allow list,
+// requests from anywhere else are blocked; allowed addresses still go
+// through the other rules. It returns nil when the WAF is disabled.
+func newWebAcl(ctx *pulumi.Context, w wafConfig, albArn pulumi.StringInput) (*wafv2.WebAcl, error) {
+	if !w.Enabled {
+		return nil, nil
+	}
+
+	var rules wafv2.WebAclRuleArray
+	priority := 0
+
+	if len(w.AllowIps) > 0 {
+		allowSet, err := wafv2.NewIpSet(ctx, "todo-waf-allow-ips", &wafv2.IpSetArgs{
+			Scope:            pulumi.String("REGIONAL"),
+			IpAddressVersion: pulumi.String("IPV4"),
+			Addresses:        pulumi.ToStringArray(w.AllowIps),
+		})
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, &wafv2.WebAclRuleArgs{
+			Name:     pulumi.String("allow-ips"),
+			Priority: pulumi.Int(priority),
+			Action: &wafv2.WebAclRuleActionArgs{
+				Block: &wafv2.WebAclRuleActionBlockArgs{},
+			},
+			Statement: &wafv2.WebAclRuleStatementArgs{
+				NotStatement: &wafv2.WebAclRuleStatementNotStatementArgs{
+					Statements: wafv2.WebAclRuleStatementArray{
+						&wafv2.WebAclRuleStatementArgs{
+							IpSetReferenceStatement: &wafv2.WebAclRuleStatementIpSetReferenceStatementArgs{
+								Arn: allowSet.Arn,
+							},
+						},
+					},
+				},
+			},
+			VisibilityConfig: visibilityConfig("todo-waf-allow-ips"),
+		})
+		priority++
+	}
+
+	if len(w.DenyIps) > 0 {
+		denySet, err := wafv2.NewIpSet(ctx, "todo-waf-deny-ips", &wafv2.IpSetArgs{
+			Scope:            pulumi.String("REGIONAL"),
+			IpAddressVersion: pulumi.String("IPV4"),
+			Addresses:        pulumi.ToStringArray(w.DenyIps),
+		})
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, &wafv2.WebAclRuleArgs{
+			Name:     pulumi.String("deny-ips"),
+			Priority: pulumi.Int(priority),
+			Action: &wafv2.WebAclRuleActionArgs{
+				Block: &wafv2.WebAclRuleActionBlockArgs{},
+			},
+			Statement: &wafv2.WebAclRuleStatementArgs{
+				IpSetReferenceStatement: &wafv2.WebAclRuleStatementIpSetReferenceStatementArgs{
+					Arn: denySet.Arn,
+				},
+			},
+			VisibilityConfig: visibilityConfig("todo-waf-deny-ips"),
+		})
+		priority++
+	}
+
+	rules = append(rules,
+		&wafv2.WebAclRuleArgs{
+			Name:     pulumi.String("rate-limit"),
+			Priority: pulumi.Int(priority),
+			Action: &wafv2.WebAclRuleActionArgs{
+				Block: &wafv2.WebAclRuleActionBlockArgs{},
+			},
+			Statement: &wafv2.WebAclRuleStatementArgs{
+				RateBasedStatement: &wafv2.WebAclRuleStatementRateBasedStatementArgs{
+					Limit:            pulumi.Int(w.RateLimit),
+					AggregateKeyType: pulumi.String("IP"),
+				},
+			},
+			VisibilityConfig: visibilityConfig("todo-waf-rate-limit"),
+		},
+		&wafv2.WebAclRuleArgs{
+			Name:     pulumi.String("aws-common-rule-set"),
+			Priority: pulumi.Int(priority + 1),
+			OverrideAction: &wafv2.WebAclRuleOverrideActionArgs{
+				None: &wafv2.WebAclRuleOverrideActionNoneArgs{},
+			},
+			Statement: &wafv2.WebAclRuleStatementArgs{
+				ManagedRuleGroupStatement: &wafv2.WebAclRuleStatementManagedRuleGroupStatementArgs{
+					VendorName: pulumi.String("AWS"),
+					Name:       pulumi.String("AWSManagedRulesCommonRuleSet"),
+				},
+			},
+			VisibilityConfig: visibilityConfig("todo-waf-common-rule-set"),
+		},
+	)
+
+	webAcl, err := wafv2.NewWebAcl(ctx, "todo-waf", &wafv2.WebAclArgs{
+		Scope:       pulumi.String("REGIONAL"),
+		Description: pulumi.String("Protects the public auth and API endpoints"),
+		DefaultAction: &wafv2.WebAclDefaultActionArgs{
+			Allow: &wafv2.WebAclDefaultActionAllowArgs{},
+		},
+		Rules: rules,
+		VisibilityConfig: &wafv2.WebAclVisibilityConfigArgs{
+			CloudwatchMetricsEnabled: pulumi.Bool(true),
+			MetricName:               pulumi.String("todo-waf"),
+			SampledRequestsEnabled:   pulumi.Bool(true),
+		},
+		Tags: pulumi.StringMap{
+			"Name": pulumi.String("todo-waf"),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Attach to the app load balancer unless another regional resource
+	// (e.g. an API Gateway stage) is configured explicitly.
+	resourceArn := albArn
+	if w.ResourceArn != "" {
+		resourceArn = pulumi.String(w.ResourceArn)
+	}
+	_, err = wafv2.NewWebAclAssociation(ctx, "todo-waf-association", &wafv2.WebAclAssociationArgs{
+		ResourceArn: resourceArn,
+		WebAclArn:   webAcl.Arn,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return webAcl, nil
+}
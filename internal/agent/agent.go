@@ -0,0 +1,556 @@
+// Package agent is the pull-based deploy agent run on app hosts. It polls
+// for the current release manifest, from the releaser's manifest API, the
+// registry the releaser publishes releases to or a git checkout, and rolls the host's compose project to it, reporting each
+// rollout back to the releaser. It replaces pushing over SSH where the host
+// can't be reached from where deploys run.
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/manifest"
+	"github.com/velann21/todo-releaser/internal/provenance"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is read from the environment by ConfigFromEnv:
+//
+//	AGENT_NAME             name reported to the releaser (default: hostname)
+//	AGENT_ENVIRONMENT      environment reported to the releaser, e.g. staging
+//	AGENT_RELEASER_URL     releaser base URL, e.g. http://10.1.0.10:9090
+//	AGENT_TOKEN            bearer token for status reports, without mTLS
+//	AGENT_BOOTSTRAP_TOKEN  one-time token to enroll for a client certificate
+//	AGENT_CA_HASH          sha256:… of the releaser's agent CA, to enroll
+//	AGENT_REPO_DIR         git checkout to read the manifest from instead
+//	AGENT_MANIFEST_REPOSITORY
+//	                       registry repository the releaser publishes releases
+//	                       to (RELEASER_MANIFEST_REPOSITORY), to read them from
+//	                       instead; a tag names the one to follow, e.g.
+//	                       registry.example.com/acme/releases:todo-latest
+//	                       (default latest)
+//	AGENT_MANIFEST_USERNAME, AGENT_MANIFEST_PASSWORD
+//	                       credentials for it, if it needs them
+//	AGENT_MANIFEST_KEYS    comma-separated base64 ed25519 public keys; manifests
+//	                       read from the registry must be signed by one of them
+//	AGENT_COMPOSE_FILE     compose file (default /opt/todo/docker-compose.yml)
+//	AGENT_COMPOSE_COMMAND  compose command (default docker-compose)
+//	AGENT_STATE_DIR        state directory (default /var/lib/todo-agent)
+//	AGENT_POLL_INTERVAL    poll interval (default 30s)
+//	DOCKER_HOST            Docker Engine API to inventory the host's containers
+//	                       from (default unix:///var/run/docker.sock)
+type Config struct {
+	Name           string
+	Environment    string
+	ReleaserURL    string
+	Token          string
+	BootstrapToken string
+	CAHash         string
+	RepoDir        string
+	// ManifestRepository and its credentials and keys; see
+	// AGENT_MANIFEST_REPOSITORY.
+	ManifestRepository string
+	ManifestUsername   string
+	ManifestPassword   string
+	ManifestKeys       []ed25519.PublicKey
+	ComposeFile        string
+	ComposeCommand     []string
+	StateDir           string
+	Interval           time.Duration
+	DockerHost         string
+}
+
+func ConfigFromEnv() (Config, error) {
+	c := Config{
+		Name:               os.Getenv("AGENT_NAME"),
+		Environment:        os.Getenv("AGENT_ENVIRONMENT"),
+		ReleaserURL:        strings.TrimSuffix(os.Getenv("AGENT_RELEASER_URL"), "/"),
+		Token:              os.Getenv("AGENT_TOKEN"),
+		BootstrapToken:     os.Getenv("AGENT_BOOTSTRAP_TOKEN"),
+		CAHash:             os.Getenv("AGENT_CA_HASH"),
+		RepoDir:            os.Getenv("AGENT_REPO_DIR"),
+		ManifestRepository: os.Getenv("AGENT_MANIFEST_REPOSITORY"),
+		ManifestUsername:   os.Getenv("AGENT_MANIFEST_USERNAME"),
+		ManifestPassword:   os.Getenv("AGENT_MANIFEST_PASSWORD"),
+		ComposeFile:        envOr("AGENT_COMPOSE_FILE", "/opt/todo/docker-compose.yml"),
+		StateDir:           envOr("AGENT_STATE_DIR", "/var/lib/todo-agent"),
+		Interval:           30 * time.Second,
+		DockerHost:         envOr("DOCKER_HOST", "unix:///var/run/docker.sock"),
+	}
+	c.ComposeCommand = strings.Fields(envOr("AGENT_COMPOSE_COMMAND", "docker-compose"))
+	if c.Name == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return Config{}, err
+		}
+		c.Name = host
+	}
+	if v := os.Getenv("AGENT_POLL_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("AGENT_POLL_INTERVAL: %w", err)
+		}
+		c.Interval = d
+	}
+	for _, s := range strings.Split(os.Getenv("AGENT_MANIFEST_KEYS"), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		pub, err := provenance.ParsePublicKey(s)
+		if err != nil {
+			return Config{}, fmt.Errorf("AGENT_MANIFEST_KEYS: %w", err)
+		}
+		c.ManifestKeys = append(c.ManifestKeys, pub)
+	}
+	if c.ReleaserURL == "" && c.RepoDir == "" && c.ManifestRepository == "" {
+		return Config{}, errors.New("set AGENT_RELEASER_URL, AGENT_MANIFEST_REPOSITORY or AGENT_REPO_DIR")
+	}
+	return c, nil
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// State is what the agent has applied, kept in StateDir between runs.
+type State struct {
+	Version  string `json:"version"`
+	Previous string `json:"previous,omitempty"`
+	// ETag of the manifest last fetched from the releaser.
+	ETag string `json:"etag,omitempty"`
+	// Pinned is set by a rollback: the agent keeps Version until resumed.
+	Pinned    bool      `json:"pinned,omitempty"`
+	AppliedAt time.Time `json:"applied_at"`
+}
+
+// Agent rolls one host to the current release.
+type Agent struct {
+	Config
+	src      source
+	reporter *reporter
+	// cert is the agent's client certificate once enrolled.
+	cert *x509.Certificate
+	// docker lists the host's containers for the releaser, with the last
+	// inventory sent and when.
+	docker         *docker
+	sentContainers []Container
+	sentAt         time.Time
+}
+
+// New returns an agent, using its client certificate from StateDir when it
+// has enrolled.
+func New(c Config) (*Agent, error) {
+	a := &Agent{Config: c}
+	client := &http.Client{Timeout: 30 * time.Second}
+	conf, cert, err := a.loadCertificate()
+	if err != nil {
+		return nil, err
+	}
+	if conf != nil {
+		client.Transport = &http.Transport{TLSClientConfig: conf}
+		a.cert = cert
+	}
+	if err := a.useClient(client); err != nil {
+		return nil, err
+	}
+	if c.DockerHost != "" {
+		if a.docker, err = newDocker(c.DockerHost); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// useClient reads releases from the registry, the releaser or the git
+// checkout, whichever is configured first, and reports to the releaser
+// through client when there is one.
+func (a *Agent) useClient(client *http.Client) error {
+	switch {
+	case a.ManifestRepository != "":
+		src, err := newRegistrySource(a.ManifestRepository, a.ManifestUsername, a.ManifestPassword, a.ManifestKeys)
+		if err != nil {
+			return err
+		}
+		a.src = src
+	case a.ReleaserURL != "":
+		a.src = &httpSource{url: a.ReleaserURL, client: client}
+	default:
+		a.src = &gitSource{dir: a.RepoDir}
+	}
+	if a.ReleaserURL != "" {
+		a.reporter = &reporter{url: a.ReleaserURL, token: a.Token, name: a.Name, client: client}
+	}
+	return nil
+}
+
+// Run polls every Interval until ctx is done, reporting the host's
+// containers after each poll.
+func (a *Agent) Run(ctx context.Context) error {
+	log.Printf("Deploy agent %s polling every %v", a.Name, a.Interval)
+	for {
+		if err := a.Poll(ctx); err != nil {
+			log.Printf("Poll failed: %v", err)
+		}
+		a.reportContainers(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(a.Interval):
+		}
+	}
+}
+
+// Poll fetches the current manifest and applies it when it is a release the
+// host isn't running. Pinned hosts are left alone.
+func (a *Agent) Poll(ctx context.Context) error {
+	st, err := a.loadState()
+	if err != nil {
+		return err
+	}
+	if st.Pinned {
+		return nil
+	}
+	if err := a.renewIfExpiring(ctx); err != nil {
+		log.Printf("Failed to renew the client certificate: %v", err)
+	}
+	data, etag, err := a.src.latest(ctx, st.ETag)
+	if err != nil || data == nil {
+		return err
+	}
+	m, err := parseManifest(data)
+	if err != nil {
+		return err
+	}
+	if m.ReleaseVersion == st.Version {
+		st.ETag = etag
+		return a.saveState(st)
+	}
+	if err := a.apply(ctx, m, &st, ""); err != nil {
+		return err
+	}
+	st.ETag = etag
+	return a.saveState(st)
+}
+
+// Rollback applies the release tagged tag, or the previously applied
+// release when tag is empty, and pins the host to it.
+func (a *Agent) Rollback(ctx context.Context, tag string) error {
+	st, err := a.loadState()
+	if err != nil {
+		return err
+	}
+	if tag == "" {
+		tag = st.Previous
+	}
+	if tag == "" {
+		return errors.New("no previous release to roll back to")
+	}
+	data, err := a.src.release(ctx, tag)
+	if err != nil {
+		return err
+	}
+	m, err := parseManifest(data)
+	if err != nil {
+		return err
+	}
+	if err := a.apply(ctx, m, &st, ""); err != nil {
+		return err
+	}
+	st.Pinned = true
+	return a.saveState(st)
+}
+
+// Resume unpins the host so the next poll follows the current release.
+func (a *Agent) Resume() error {
+	st, err := a.loadState()
+	if err != nil {
+		return err
+	}
+	st.Pinned = false
+	st.ETag = ""
+	return a.saveState(st)
+}
+
+// Status returns the agent's state.
+func (a *Agent) Status() (State, error) {
+	return a.loadState()
+}
+
+// apply rolls the host to m, from the step from when set (see Steps),
+// reporting deploying and then deployed or failed.
+func (a *Agent) apply(ctx context.Context, m *manifest.Manifest, st *State, from string) error {
+	log.Printf("Deploying %s (was %q)", m.ReleaseVersion, st.Version)
+	a.report(ctx, m.ReleaseVersion, StateDeploying, nil)
+
+	err := a.rollout(ctx, m, from)
+	a.report(ctx, m.ReleaseVersion, resultState(err), err)
+	if err != nil {
+		return fmt.Errorf("deploying %s: %w", m.ReleaseVersion, err)
+	}
+	if st.Version != m.ReleaseVersion {
+		st.Previous = st.Version
+	}
+	st.Version = m.ReleaseVersion
+	st.AppliedAt = time.Now()
+	log.Printf("Deployed %s", m.ReleaseVersion)
+	return nil
+}
+
+func resultState(err error) string {
+	if err != nil {
+		return StateFailed
+	}
+	return StateDeployed
+}
+
+// OverrideFile is the compose file the agent renders the services' runtime
+// settings into, next to the host's compose file.
+const OverrideFile = "release.compose.yml"
+
+// ConfigDir is the directory, next to the host's compose file, the agent
+// renders the services' config bundles into, as
+// ConfigDir/<service>/<path>.
+const ConfigDir = "release-config"
+
+// ConfigLabel is the container label OverrideFile sets to the hashes of a
+// service's config bundles, so compose recreates its containers when they
+// change.
+const ConfigLabel = "io.todo-releaser.config"
+
+// render writes the release's images to release.env, its config bundles to
+// ConfigDir and its runtime settings to OverrideFile next to the compose
+// file, removing an OverrideFile of an earlier release that had runtime
+// settings when this one has none.
+func (a *Agent) render(ctx context.Context, m *manifest.Manifest) error {
+	dir := filepath.Dir(a.ComposeFile)
+	if err := os.WriteFile(filepath.Join(dir, "release.env"), []byte(ComposeEnv(m)), 0644); err != nil {
+		return err
+	}
+	if err := a.renderConfig(ctx, m); err != nil {
+		return err
+	}
+	override, err := ComposeOverride(m)
+	if err != nil {
+		return err
+	}
+	overrideFile := filepath.Join(dir, OverrideFile)
+	if override != nil {
+		return os.WriteFile(overrideFile, override, 0644)
+	}
+	if err := os.Remove(overrideFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// renderConfig replaces ConfigDir with the config bundles of m, fetched as
+// the release tagged them and checked against their hashes.
+func (a *Agent) renderConfig(ctx context.Context, m *manifest.Manifest) error {
+	configDir := filepath.Join(filepath.Dir(a.ComposeFile), ConfigDir)
+	if err := os.RemoveAll(configDir); err != nil {
+		return err
+	}
+	for _, s := range m.Services {
+		for _, b := range s.Config {
+			if err := b.Validate(); err != nil {
+				return fmt.Errorf("%s: %w", s.Name, err)
+			}
+			data, err := a.src.config(ctx, m.ReleaseVersion, b.Path)
+			if err != nil {
+				return err
+			}
+			if hash := manifest.HashConfig(data); hash != b.Hash {
+				return fmt.Errorf("config %s of %s is %s, not %s", b.Path, s.Name, hash, b.Hash)
+			}
+			path := filepath.Join(configDir, s.Name, filepath.FromSlash(b.Path))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			// Env files may well hold credentials.
+			if err := os.WriteFile(path, data, 0600); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compose runs the compose command with args on the files render wrote
+// for m.
+func (a *Agent) compose(ctx context.Context, m *manifest.Manifest, args ...string) error {
+	dir := filepath.Dir(a.ComposeFile)
+	override, err := ComposeOverride(m)
+	if err != nil {
+		return err
+	}
+	argv := append([]string{}, a.ComposeCommand[1:]...)
+	argv = append(argv, "-f", a.ComposeFile)
+	if override != nil {
+		argv = append(argv, "-f", filepath.Join(dir, OverrideFile))
+	}
+	argv = append(argv, "--env-file", filepath.Join(dir, "release.env"))
+	argv = append(argv, args...)
+	cmd := exec.CommandContext(ctx, a.ComposeCommand[0], argv...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %w", strings.Join(a.ComposeCommand, " "), args[0], err)
+	}
+	return nil
+}
+
+var nonAlnum = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// ComposeEnv renders the variables the compose file refers to: RELEASE_VERSION
+// and <SERVICE>_IMAGE for every service, e.g. TODO_BACKEND_IMAGE.
+func ComposeEnv(m *manifest.Manifest) string {
+	lines := []string{"RELEASE_VERSION=" + m.ReleaseVersion}
+	for _, s := range m.Services {
+		name := nonAlnum.ReplaceAllString(strings.ToUpper(s.Name), "_")
+		lines = append(lines, name+"_IMAGE="+s.Ref())
+	}
+	sort.Strings(lines[1:])
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// composeService is a service's runtime settings and config bundles as
+// compose spells them.
+type composeService struct {
+	Healthcheck *composeHealthcheck `yaml:"healthcheck,omitempty"`
+	Restart     string              `yaml:"restart,omitempty"`
+	Deploy      *composeDeploy      `yaml:"deploy,omitempty"`
+	Logging     *manifest.Logging   `yaml:"logging,omitempty"`
+	EnvFile     []string            `yaml:"env_file,omitempty"`
+	Volumes     []string            `yaml:"volumes,omitempty"`
+	Labels      map[string]string   `yaml:"labels,omitempty"`
+}
+
+type composeHealthcheck struct {
+	Test        []string `yaml:"test,flow"`
+	Interval    string   `yaml:"interval,omitempty"`
+	Timeout     string   `yaml:"timeout,omitempty"`
+	StartPeriod string   `yaml:"start_period,omitempty"`
+	Retries     int      `yaml:"retries,omitempty"`
+}
+
+type composeDeploy struct {
+	Resources struct {
+		Limits *manifest.Limits `yaml:"limits"`
+	} `yaml:"resources"`
+}
+
+// ComposeOverride renders the runtime settings and config bundles of m's
+// services as a compose file to apply over the host's, so they change with
+// the release rather than by hand on the host. Its services are named as
+// in the manifest. It returns nil when no service has either.
+func ComposeOverride(m *manifest.Manifest) ([]byte, error) {
+	services := map[string]composeService{}
+	for _, s := range m.Services {
+		if s.Runtime == nil && len(s.Config) == 0 {
+			continue
+		}
+		var cs composeService
+		if r := s.Runtime; r != nil {
+			if err := r.Validate(); err != nil {
+				return nil, fmt.Errorf("runtime of %s: %w", s.Name, err)
+			}
+			cs.Restart, cs.Logging = r.Restart, r.Logging
+			if h := r.Healthcheck; h != nil {
+				cs.Healthcheck = &composeHealthcheck{h.Test, h.Interval, h.Timeout, h.StartPeriod, h.Retries}
+			}
+			if r.Limits != nil {
+				cs.Deploy = &composeDeploy{}
+				cs.Deploy.Resources.Limits = r.Limits
+			}
+		}
+		var hashes []string
+		for _, b := range s.Config {
+			if err := b.Validate(); err != nil {
+				return nil, fmt.Errorf("%s: %w", s.Name, err)
+			}
+			file := "./" + path.Join(ConfigDir, s.Name, b.Path)
+			if b.Target == "" {
+				cs.EnvFile = append(cs.EnvFile, file)
+			} else {
+				cs.Volumes = append(cs.Volumes, file+":"+b.Target+":ro")
+			}
+			hashes = append(hashes, b.Hash)
+		}
+		if len(hashes) > 0 {
+			cs.Labels = map[string]string{ConfigLabel: strings.Join(hashes, ",")}
+		}
+		services[s.Name] = cs
+	}
+	if len(services) == 0 {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Rendered by the deploy agent from the manifest of %s; changes here are overwritten.\n", m.ReleaseVersion)
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(map[string]any{"services": services}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), enc.Close()
+}
+
+// parseManifest decodes a manifest without decrypting its secrets, which
+// the agent neither needs nor has the keys for.
+func parseManifest(data []byte) (*manifest.Manifest, error) {
+	var m manifest.Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("error parsing manifest: %w", err)
+	}
+	if m.ReleaseVersion == "" {
+		return nil, errors.New("manifest has no release_version")
+	}
+	return &m, nil
+}
+
+func (a *Agent) statePath() string {
+	return filepath.Join(a.StateDir, "state.json")
+}
+
+func (a *Agent) loadState() (State, error) {
+	var st State
+	data, err := os.ReadFile(a.statePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return st, fmt.Errorf("error parsing %s: %w", a.statePath(), err)
+	}
+	return st, nil
+}
+
+func (a *Agent) saveState(st State) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(a.StateDir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(a.statePath(), data, 0644)
+}
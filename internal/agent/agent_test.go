@@ -0,0 +1,736 @@
+package agent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/velann21/todo-releaser/internal/manifest"
+	"github.com/velann21/todo-releaser/internal/provenance"
+)
+
+func TestComposeEnv(t *testing.T) {
+	m := &manifest.Manifest{
+		ReleaseVersion: "v202502.1.0",
+		Services: []manifest.Service{
+			{Name: "todo-frontend", Image: "singaravelan21/todo-frontend", Version: "v1.2.0"},
+			{Name: "todo-backend", Image: "registry.corp:5000/team/todo-backend", Version: "v1.1.0"},
+			{Name: "redis", Image: "redis@sha256:0123abcd"},
+		},
+	}
+	want := "RELEASE_VERSION=v202502.1.0\n" +
+		"REDIS_IMAGE=redis@sha256:0123abcd\n" +
+		"TODO_BACKEND_IMAGE=registry.corp:5000/team/todo-backend:v1.1.0\n" +
+		"TODO_FRONTEND_IMAGE=singaravelan21/todo-frontend:v1.2.0\n"
+	if got := ComposeEnv(m); got != want {
+		t.Errorf("ComposeEnv() = %q, want %q", got, want)
+	}
+}
+
+func TestComposeOverride(t *testing.T) {
+	m := &manifest.Manifest{
+		ReleaseVersion: "v202502.1.0",
+		Services: []manifest.Service{
+			{Name: "todo-frontend", Image: "singaravelan21/todo-frontend", Version: "v1.2.0"},
+			{Name: "todo-backend", Image: "singaravelan21/todo-backend", Version: "v1.1.0", Runtime: &manifest.Runtime{
+				Healthcheck: &manifest.Healthcheck{Test: []string{"CMD", "curl", "-f", "http://localhost:8080/health"}, Interval: "30s", Retries: 3},
+				Restart:     "unless-stopped",
+				Limits:      &manifest.Limits{CPUs: "0.5", Memory: "512M"},
+				Logging:     &manifest.Logging{Driver: "json-file", Options: map[string]string{"max-size": "10m"}},
+			}},
+			{Name: "redis", Image: "redis", Version: "7.2.4", Runtime: &manifest.Runtime{Restart: "always"}, Config: []manifest.ConfigBundle{
+				{Path: "config/redis.env", Hash: "sha256:0a"},
+				{Path: "config/redis.conf", Target: "/usr/local/etc/redis/redis.conf", Hash: "sha256:0b"},
+			}},
+			{Name: "worker", Image: "acme/worker", Version: "v1.0.0", Config: []manifest.ConfigBundle{{Path: "config/worker.env", Hash: "sha256:0c"}}},
+		},
+	}
+	want := `# Rendered by the deploy agent from the manifest of v202502.1.0; changes here are overwritten.
+services:
+  redis:
+    restart: always
+    env_file:
+      - ./release-config/redis/config/redis.env
+    volumes:
+      - ./release-config/redis/config/redis.conf:/usr/local/etc/redis/redis.conf:ro
+    labels:
+      io.todo-releaser.config: sha256:0a,sha256:0b
+  todo-backend:
+    healthcheck:
+      test: [CMD, curl, -f, 'http://localhost:8080/health']
+      interval: 30s
+      retries: 3
+    restart: unless-stopped
+    deploy:
+      resources:
+        limits:
+          cpus: "0.5"
+          memory: 512M
+    logging:
+      driver: json-file
+      options:
+        max-size: 10m
+  worker:
+    env_file:
+      - ./release-config/worker/config/worker.env
+    labels:
+      io.todo-releaser.config: sha256:0c
+`
+	got, err := ComposeOverride(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("ComposeOverride() =\n%s\nwant\n%s", got, want)
+	}
+
+	tests := []struct {
+		name    string
+		runtime manifest.Runtime
+	}{
+		{"restart policy", manifest.Runtime{Restart: "sometimes"}},
+		{"restart count", manifest.Runtime{Restart: "on-failure:0"}},
+		{"healthcheck without test", manifest.Runtime{Healthcheck: &manifest.Healthcheck{Interval: "30s"}}},
+		{"healthcheck interval", manifest.Runtime{Healthcheck: &manifest.Healthcheck{Test: []string{"CMD", "true"}, Interval: "often"}}},
+		{"memory", manifest.Runtime{Limits: &manifest.Limits{Memory: "lots"}}},
+		{"cpus", manifest.Runtime{Limits: &manifest.Limits{CPUs: "-1"}}},
+		{"logging driver", manifest.Runtime{Logging: &manifest.Logging{}}},
+	}
+	for _, tt := range tests {
+		m := &manifest.Manifest{Services: []manifest.Service{{Name: "todo-backend", Runtime: &tt.runtime}}}
+		if _, err := ComposeOverride(m); err == nil {
+			t.Errorf("%s: rendered invalid runtime settings", tt.name)
+		}
+	}
+	escaping := &manifest.Manifest{Services: []manifest.Service{{Name: "todo-backend", Config: []manifest.ConfigBundle{{Path: "../../etc/shadow"}}}}}
+	if _, err := ComposeOverride(escaping); err == nil {
+		t.Error("rendered a config bundle outside the repository")
+	}
+
+	if got, err := ComposeOverride(&manifest.Manifest{Services: m.Services[:1]}); got != nil || err != nil {
+		t.Errorf("ComposeOverride() without runtime settings = %q, %v, want nil", got, err)
+	}
+}
+
+// fakeReleaser serves /manifest, /releases/{tag}, /config, /agents/{name}
+// and /agents/{name}/containers like the releaser, recording the reports and
+// inventories it gets.
+type fakeReleaser struct {
+	mu       sync.Mutex
+	current  string
+	releases map[string]string
+	// configs are the config bundles by release and path, "<tag> <path>".
+	configs     map[string]string
+	reports     []Report
+	inventories []Inventory
+}
+
+func (f *fakeReleaser) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.URL.Path == "/manifest":
+		etag := `"` + f.current + `"`
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(f.releases[f.current]))
+	case strings.HasPrefix(r.URL.Path, "/releases/"):
+		data, ok := f.releases[strings.TrimPrefix(r.URL.Path, "/releases/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(data))
+	case r.URL.Path == "/config":
+		data, ok := f.configs[r.URL.Query().Get("release")+" "+r.URL.Query().Get("path")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(data))
+	case strings.HasPrefix(r.URL.Path, "/agents/") && strings.HasSuffix(r.URL.Path, "/containers"):
+		var inv Inventory
+		json.NewDecoder(r.Body).Decode(&inv)
+		f.inventories = append(f.inventories, inv)
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(r.URL.Path, "/agents/"):
+		var rep Report
+		json.NewDecoder(r.Body).Decode(&rep)
+		f.reports = append(f.reports, rep)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestAgent(t *testing.T) {
+	configs := map[string]string{"v202502.0.0": "LOG_LEVEL=info\n", "v202502.1.0": "LOG_LEVEL=debug\n"}
+	f := &fakeReleaser{current: "v202502.0.0", releases: map[string]string{}, configs: map[string]string{}}
+	for version, env := range configs {
+		f.releases[version] = fmt.Sprintf(`{"release_version": %q, "services": [{"name": "todo-backend", "image": "singaravelan21/todo-backend", "version": "v1.1.0", "config": [{"path": "config/todo-backend.env", "hash": %q}]}]}`,
+			version, manifest.HashConfig([]byte(env)))
+		f.configs[version+" config/todo-backend.env"] = env
+	}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	a, err := New(Config{
+		Name:           "todo-server",
+		ReleaserURL:    srv.URL,
+		ComposeFile:    filepath.Join(dir, "docker-compose.yml"),
+		ComposeCommand: []string{"true"},
+		StateDir:       dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		do      func() error
+		version string
+		pinned  bool
+		reports int
+	}{
+		{"first poll deploys", func() error { return a.Poll(ctx) }, "v202502.0.0", false, 2},
+		{"unchanged", func() error { return a.Poll(ctx) }, "v202502.0.0", false, 2},
+		{"new release", func() error {
+			f.mu.Lock()
+			f.current = "v202502.1.0"
+			f.mu.Unlock()
+			return a.Poll(ctx)
+		}, "v202502.1.0", false, 4},
+		{"rollback to previous", func() error { return a.Rollback(ctx, "") }, "v202502.0.0", true, 6},
+		{"pinned ignores current", func() error { return a.Poll(ctx) }, "v202502.0.0", true, 6},
+		{"resume", func() error {
+			if err := a.Resume(); err != nil {
+				return err
+			}
+			return a.Poll(ctx)
+		}, "v202502.1.0", false, 8},
+	}
+
+	for _, tt := range tests {
+		if err := tt.do(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		st, err := a.Status()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Version != tt.version || st.Pinned != tt.pinned {
+			t.Errorf("%s: state = %s pinned %v, want %s pinned %v", tt.name, st.Version, st.Pinned, tt.version, tt.pinned)
+		}
+		env, err := os.ReadFile(filepath.Join(dir, ConfigDir, "todo-backend", "config", "todo-backend.env"))
+		if err != nil || string(env) != configs[tt.version] {
+			t.Errorf("%s: config = %q, %v, want %q", tt.name, env, err, configs[tt.version])
+		}
+		f.mu.Lock()
+		reports := len(f.reports)
+		f.mu.Unlock()
+		if reports != tt.reports {
+			t.Errorf("%s: %d reports, want %d", tt.name, reports, tt.reports)
+		}
+	}
+}
+
+func TestRegistrySource(t *testing.T) {
+	reg := &fakeRegistry{manifests: map[string][]byte{}, blobs: map[string][]byte{}}
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+	key, _ := provenance.ParsePrivateKey(base64.StdEncoding.EncodeToString(make([]byte, ed25519.SeedSize)))
+	other, _ := provenance.ParsePrivateKey(base64.StdEncoding.EncodeToString([]byte("01234567890123456789012345678901")))
+	configs := map[string]string{}
+	publish := func(version string, signer ed25519.PrivateKey, tags ...string) {
+		env := "RELEASE=" + version + "\n"
+		configs[version] = env
+		m := fmt.Sprintf(`{"release_version": %q, "services": [{"name": "todo-backend", "image": "singaravelan21/todo-backend", "version": "v1.1.0", "config": [{"path": "config/todo-backend.env", "hash": %q}]}]}`,
+			version, manifest.HashConfig([]byte(env)))
+		files := map[string]string{manifest.File: m, "config/todo-backend.env": env}
+		if signer != nil {
+			sigs, _ := json.Marshal(provenance.SignManifest([]byte(m), nil, signer))
+			files[provenance.SignaturePath(manifest.File)] = string(sigs)
+		}
+		reg.publish(version, files, tags...)
+	}
+	publish("v202502.0.0", key, "v202502.0.0", "latest")
+
+	dir := t.TempDir()
+	conf := Config{
+		Name:               "todo-server",
+		ManifestRepository: strings.TrimPrefix(srv.URL, "http://") + "/acme/releases",
+		ManifestUsername:   "agent",
+		ManifestPassword:   "secret",
+		ManifestKeys:       []ed25519.PublicKey{key.Public().(ed25519.PublicKey)},
+		ComposeFile:        filepath.Join(dir, "docker-compose.yml"),
+		ComposeCommand:     []string{"true"},
+		StateDir:           dir,
+	}
+	a, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		do      func() error
+		version string
+		pinned  bool
+	}{
+		{"first poll deploys", func() error { return a.Poll(ctx) }, "v202502.0.0", false},
+		{"unchanged", func() error { return a.Poll(ctx) }, "v202502.0.0", false},
+		{"new release", func() error {
+			publish("v202502.1.0", key, "v202502.1.0", "latest")
+			return a.Poll(ctx)
+		}, "v202502.1.0", false},
+		{"rollback to previous", func() error { return a.Rollback(ctx, "") }, "v202502.0.0", true},
+	}
+	for _, tt := range tests {
+		if err := tt.do(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		st, err := a.Status()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Version != tt.version || st.Pinned != tt.pinned {
+			t.Errorf("%s: state = %s pinned %v, want %s pinned %v", tt.name, st.Version, st.Pinned, tt.version, tt.pinned)
+		}
+		env, err := os.ReadFile(filepath.Join(dir, ConfigDir, "todo-backend", "config", "todo-backend.env"))
+		if err != nil || string(env) != configs[tt.version] {
+			t.Errorf("%s: config = %q, %v, want %q", tt.name, env, err, configs[tt.version])
+		}
+	}
+
+	publish("v202502.2.0", nil, "unsigned")
+	publish("v202502.3.0", other, "other-key")
+	publish("v202502.4.0", key, "tampered")
+	reg.blobs[reg.layers["v202502.4.0 "+manifest.File]] = []byte(`{"release_version": "v202502.4.0", "services": []}`)
+	refused := []struct {
+		follow, password, want string
+	}{
+		{"unsigned", "secret", "failed verification"},
+		{"other-key", "secret", "failed verification"},
+		{"tampered", "secret", "does not match its digest"},
+		{"latest", "guess", "401"},
+	}
+	for _, tt := range refused {
+		src, err := newRegistrySource(conf.ManifestRepository+":"+tt.follow, "agent", tt.password, conf.ManifestKeys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, _, err := src.latest(ctx, ""); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s with password %q: %q, %v, want an error mentioning %q", tt.follow, tt.password, data, err, tt.want)
+		}
+	}
+}
+
+// fakeRegistry serves release artifacts and their blobs, to pull tokens
+// its token service gives agent:secret.
+type fakeRegistry struct {
+	mu        sync.Mutex
+	manifests map[string][]byte
+	blobs     map[string][]byte
+	// layers are the digests of the files published, by "<version> <path>".
+	layers map[string]string
+}
+
+func (f *fakeRegistry) publish(version string, files map[string]string, tags ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.layers == nil {
+		f.layers = map[string]string{}
+	}
+	var layers []any
+	for path, content := range files {
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(content)))
+		f.blobs[digest] = []byte(content)
+		f.layers[version+" "+path] = digest
+		layers = append(layers, map[string]any{"digest": digest, "size": len(content), "annotations": map[string]string{titleAnnotation: path}})
+	}
+	data, _ := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"artifactType":  releaseArtifactType,
+		"layers":        layers,
+		"annotations":   map[string]string{"org.opencontainers.image.version": version},
+	})
+	for _, tag := range tags {
+		f.manifests[tag] = data
+	}
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path == "/token" {
+		if user, password, _ := r.BasicAuth(); user != "agent" || password != "secret" || r.URL.Query().Get("scope") != "repository:acme/releases:pull" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"token": "pull-token"}`))
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer pull-token" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="http://`+r.Host+`/token",service="fake"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var data []byte
+	if tag, ok := strings.CutPrefix(r.URL.Path, "/v2/acme/releases/manifests/"); ok {
+		data = f.manifests[tag]
+	} else if digest, ok := strings.CutPrefix(r.URL.Path, "/v2/acme/releases/blobs/"); ok {
+		data = f.blobs[digest]
+	}
+	if data == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(data)
+}
+
+func TestReportContainers(t *testing.T) {
+	f := &fakeReleaser{}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	var mu sync.Mutex
+	image := "singaravelan21/todo-backend:v1.1.0"
+	engine := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/containers/json":
+			if !strings.Contains(r.URL.Query().Get("filters"), ComposeServiceLabel) {
+				t.Errorf("containers listed without the compose filter: %s", r.URL.RawQuery)
+			}
+			json.NewEncoder(w).Encode([]map[string]any{
+				{"Names": []string{"/todo-backend-1"}, "Image": image, "ImageID": "sha256:b1", "Labels": map[string]string{ComposeServiceLabel: "todo-backend"}},
+				{"Names": []string{"/todo-frontend-1"}, "Image": "todo-frontend:dev", "ImageID": "sha256:f1", "Labels": map[string]string{ComposeServiceLabel: "todo-frontend"}},
+			})
+		case "/images/sha256:b1/json":
+			w.Write([]byte(`{"RepoDigests": ["singaravelan21/todo-backend@sha256:0123"]}`))
+		case "/images/sha256:f1/json":
+			w.Write([]byte(`{"RepoDigests": []}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer engine.Close()
+
+	dir := t.TempDir()
+	a, err := New(Config{Name: "todo-server", ReleaserURL: srv.URL, StateDir: dir, DockerHost: "tcp://" + strings.TrimPrefix(engine.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	tests := []struct {
+		name        string
+		image       string
+		inventories int
+	}{
+		{"first inventory", image, 1},
+		{"unchanged", image, 1},
+		{"changed", "singaravelan21/todo-backend:v1.1.1", 2},
+	}
+	for _, tt := range tests {
+		mu.Lock()
+		image = tt.image
+		mu.Unlock()
+		a.reportContainers(ctx)
+		f.mu.Lock()
+		got := len(f.inventories)
+		f.mu.Unlock()
+		if got != tt.inventories {
+			t.Errorf("%s: %d inventories, want %d", tt.name, got, tt.inventories)
+		}
+	}
+
+	inv := f.inventories[0]
+	if len(inv.Containers) != 2 {
+		t.Fatalf("containers %+v", inv.Containers)
+	}
+	if c := inv.Containers[0]; c.Service != "todo-backend" || c.Name != "todo-backend-1" || c.Image != "singaravelan21/todo-backend:v1.1.0" ||
+		len(c.RepoDigests) != 1 {
+		t.Errorf("container %+v", c)
+	}
+	if c := inv.Containers[1]; c.Service != "todo-frontend" || len(c.RepoDigests) != 0 {
+		t.Errorf("container %+v", c)
+	}
+}
+
+func TestRolloutJournal(t *testing.T) {
+	release := `{"release_version": "v202502.1.0", "services": [{"name": "todo-backend", "image": "singaravelan21/todo-backend", "version": "v1.1.0"}]}`
+	f := &fakeReleaser{current: "v202502.1.0", releases: map[string]string{"v202502.1.0": release}}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	var mu sync.Mutex
+	image := "singaravelan21/todo-backend:v1.0.0"
+	engine := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/containers/json":
+			json.NewEncoder(w).Encode([]map[string]any{
+				{"Names": []string{"/todo-backend-1"}, "Image": image, "ImageID": "sha256:b1", "Labels": map[string]string{ComposeServiceLabel: "todo-backend"}},
+			})
+		case "/images/sha256:b1/json":
+			w.Write([]byte(`{"RepoDigests": []}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer engine.Close()
+
+	// The compose command logs its last argument, and fails it while a
+	// fail-<argument> file exists.
+	dir := t.TempDir()
+	composeLog := filepath.Join(dir, "compose.log")
+	script := `for arg; do last=$arg; done; echo $last >>` + composeLog + `; test ! -e ` + dir + `/fail-$last`
+	a, err := New(Config{
+		Name:           "todo-server",
+		ReleaserURL:    srv.URL,
+		ComposeFile:    filepath.Join(dir, "docker-compose.yml"),
+		ComposeCommand: []string{"sh", "-c", script, "compose"},
+		StateDir:       dir,
+		DockerHost:     "tcp://" + strings.TrimPrefix(engine.URL, "http://"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	fail := func(step string) {
+		if err := os.WriteFile(filepath.Join(dir, "fail-"+step), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fix := func(step string) { os.Remove(filepath.Join(dir, "fail-"+step)) }
+
+	tests := []struct {
+		name     string
+		do       func() error
+		wantErr  bool
+		version  string
+		compose  string
+		attempts []int
+	}{
+		{"pull fails", func() error { fail("pull"); return a.Poll(ctx) }, true, "", "pull\n", []int{1, 1}},
+		{"poll retries the pull", func() error { return a.Poll(ctx) }, true, "", "pull\n", []int{1, 2}},
+		{"verify fails on the old image", func() error { fix("pull"); return a.Poll(ctx) }, true, "", "pull\n--remove-orphans\n", []int{1, 3, 1, 1}},
+		{"retry verifies again", func() error {
+			mu.Lock()
+			image = "singaravelan21/todo-backend:v1.1.0"
+			mu.Unlock()
+			return a.Retry(ctx, "")
+		}, false, "v202502.1.0", "", []int{1, 3, 1, 2}},
+		{"nothing left to retry", func() error { return a.Retry(ctx, "") }, true, "v202502.1.0", "", []int{1, 3, 1, 2}},
+		{"retry from restart", func() error { return a.Retry(ctx, StepRestart) }, false, "v202502.1.0", "--remove-orphans\n", []int{1, 3, 1, 1}},
+		{"unknown step", func() error { return a.Retry(ctx, "reboot") }, true, "v202502.1.0", "", []int{1, 3, 1, 1}},
+	}
+	for _, tt := range tests {
+		os.Remove(composeLog)
+		err := tt.do()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		st, err := a.Status()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Version != tt.version {
+			t.Errorf("%s: version = %q, want %q", tt.name, st.Version, tt.version)
+		}
+		data, _ := os.ReadFile(composeLog)
+		if string(data) != tt.compose {
+			t.Errorf("%s: compose ran %q, want %q", tt.name, data, tt.compose)
+		}
+		j, err := a.Journal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var attempts []int
+		for _, rec := range j.Steps {
+			attempts = append(attempts, rec.Attempts)
+		}
+		if !slices.Equal(attempts, tt.attempts) {
+			t.Errorf("%s: attempts = %v, want %v", tt.name, attempts, tt.attempts)
+		}
+	}
+
+	m, err := parseManifest([]byte(release))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := IdempotencyKey(m)
+	if j, _ := a.Journal(); j.Key != key || j.Version != "v202502.1.0" {
+		t.Errorf("journal of %s under key %s, want %s", j.Version, j.Key, key)
+	}
+	m.Services[0].Version = "v1.1.1"
+	if IdempotencyKey(m) == key {
+		t.Error("a different manifest has the same idempotency key")
+	}
+}
+
+// fakeEngine serves the Docker Engine API for DeployEngine: one container
+// of todo-backend, which it recreates as asked, recording the calls.
+type fakeEngine struct {
+	mu        sync.Mutex
+	image     string
+	failStart bool
+	calls     []string
+}
+
+func (e *fakeEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	call := r.Method + " " + r.URL.Path
+	if name := r.URL.Query().Get("name"); name != "" {
+		call += " " + name
+	}
+	switch {
+	case r.URL.Path == "/containers/json":
+		json.NewEncoder(w).Encode([]map[string]any{
+			{"Id": "c1", "Names": []string{"/todo-backend-1"}, "Image": e.image, "ImageID": "sha256:b1", "Labels": map[string]string{ComposeServiceLabel: "todo-backend"}},
+			{"Id": "c2", "Names": []string{"/sidecar-1"}, "Image": "sidecar:1", "ImageID": "sha256:s1", "Labels": map[string]string{ComposeServiceLabel: "sidecar"}},
+		})
+		return
+	case strings.HasPrefix(r.URL.Path, "/images/sha256:"):
+		w.Write([]byte(`{"RepoDigests": []}`))
+		return
+	case r.URL.Path == "/images/create":
+		call += " " + r.URL.Query().Get("fromImage")
+		w.Write([]byte(`{"status": "Pulling"}` + "\n" + `{"status": "Downloaded newer image"}` + "\n"))
+	case r.URL.Path == "/containers/c1/json":
+		w.Write([]byte(`{"Config": {"Image": "old", "Env": ["PORT=8080"]}, "HostConfig": {"RestartPolicy": {"Name": "always"}}, "NetworkSettings": {"Networks": {"todo_default": {"Aliases": ["todo-backend"]}}}}`))
+	case r.URL.Path == "/containers/create":
+		var body struct {
+			Image            string
+			Env              []string
+			NetworkingConfig struct{ EndpointsConfig map[string]any }
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if len(body.Env) != 1 || body.NetworkingConfig.EndpointsConfig["todo_default"] == nil {
+			http.Error(w, `{"message": "settings lost"}`, http.StatusBadRequest)
+			return
+		}
+		call += " " + body.Image
+		w.Write([]byte(`{"Id": "c3"}`))
+	case r.URL.Path == "/containers/c3/start" && e.failStart:
+		e.calls = append(e.calls, call)
+		http.Error(w, `{"message": "port is already allocated"}`, http.StatusInternalServerError)
+		return
+	case r.URL.Path == "/containers/c3/start":
+		e.image = "singaravelan21/todo-backend:v1.1.0"
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+	e.calls = append(e.calls, call)
+}
+
+func TestDeployEngine(t *testing.T) {
+	m := &manifest.Manifest{
+		ReleaseVersion: "v202502.1.0",
+		Services:       []manifest.Service{{Name: "todo-backend", Image: "singaravelan21/todo-backend", Version: "v1.1.0"}},
+	}
+	e := &fakeEngine{}
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+	host := "tcp://" + strings.TrimPrefix(srv.URL, "http://")
+	recreate := []string{
+		"POST /images/create singaravelan21/todo-backend:v1.1.0",
+		"GET /containers/c1/json",
+		"POST /containers/c1/rename todo-backend-1-replaced",
+		"POST /containers/c1/stop",
+		"POST /containers/create todo-backend-1 singaravelan21/todo-backend:v1.1.0",
+		"POST /containers/c3/start",
+	}
+
+	tests := []struct {
+		name      string
+		image     string
+		failStart bool
+		wantErr   bool
+		calls     []string
+	}{
+		{"up to date", "singaravelan21/todo-backend:v1.1.0", false, false, nil},
+		{"recreated", "singaravelan21/todo-backend:v1.0.0", false, false, append(slices.Clip(recreate), "DELETE /containers/c1")},
+		{"put back when the new one won't start", "singaravelan21/todo-backend:v1.0.0", true, true, append(slices.Clip(recreate),
+			"DELETE /containers/c3", "POST /containers/c1/rename todo-backend-1", "POST /containers/c1/start")},
+	}
+	for _, tt := range tests {
+		e.mu.Lock()
+		e.image, e.failStart, e.calls = tt.image, tt.failStart, nil
+		e.mu.Unlock()
+		_, err := DeployEngine(context.Background(), host, m)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: DeployEngine() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		var calls []string
+		for _, c := range e.calls {
+			if !strings.HasPrefix(c, "GET /containers/json") && !strings.HasPrefix(c, "GET /images/") {
+				calls = append(calls, c)
+			}
+		}
+		if !slices.Equal(calls, tt.calls) {
+			t.Errorf("%s: calls\n%s\nwant\n%s", tt.name, strings.Join(calls, "\n"), strings.Join(tt.calls, "\n"))
+		}
+	}
+
+	// Over ssh, the engine is reached through `docker system dial-stdio`
+	// on the host, played here by the test binary.
+	dir := t.TempDir()
+	args := filepath.Join(dir, "args")
+	ssh := filepath.Join(dir, "ssh")
+	script := "#!/bin/sh\necho \"$@\" >" + args + "\nAGENT_DIAL_STDIO=" + strings.TrimPrefix(srv.URL, "http://") +
+		" exec " + os.Args[0] + " -test.run=^TestDialStdio$\n"
+	if err := os.WriteFile(ssh, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(c string) { sshCommand = c }(sshCommand)
+	sshCommand = ssh
+	e.mu.Lock()
+	e.image, e.failStart = "singaravelan21/todo-backend:v1.0.0", false
+	e.mu.Unlock()
+	recreated, err := DeployEngine(context.Background(), "ssh://deploy@10.1.0.20:2222", m)
+	if err != nil || !slices.Equal(recreated, []string{"todo-backend-1"}) {
+		t.Errorf("DeployEngine() over ssh = %v, %v, want [todo-backend-1]", recreated, err)
+	}
+	if data, _ := os.ReadFile(args); string(data) != "-o BatchMode=yes -l deploy -p 2222 -- 10.1.0.20 docker system dial-stdio\n" {
+		t.Errorf("ssh ran with %q", data)
+	}
+}
+
+// TestDialStdio stands in for `docker system dial-stdio` when run by the
+// fake ssh of TestDeployEngine, relaying its input and output to the engine
+// at AGENT_DIAL_STDIO.
+func TestDialStdio(t *testing.T) {
+	addr := os.Getenv("AGENT_DIAL_STDIO")
+	if addr == "" {
+		return
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		os.Exit(1)
+	}
+	go io.Copy(conn, os.Stdin)
+	io.Copy(os.Stdout, conn)
+	os.Exit(0)
+}
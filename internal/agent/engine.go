@@ -0,0 +1,226 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// A host without an agent can still be deployed to from elsewhere by
+// driving its Docker Engine API directly, as docker does with an ssh://
+// context: DeployEngine reaches the engine through an SSH connection
+// running `docker system dial-stdio` on the host, so nothing but sshd and
+// docker has to run there and the engine stays off the network. It rolls
+// the host's compose services to the release without the compose file,
+// recreating each container whose image the release changed with the same
+// settings and the new image. It is a middle ground between running the
+// playbook over SSH and installing the agent: no runtime settings, no
+// release.env, just the images.
+
+// sshCommand is the ssh client DeployEngine tunnels through.
+var sshCommand = "ssh"
+
+// sshDialer returns a dialer connecting to the engine of the host in u,
+// ssh://[user@]host[:port], through the ssh client. The client's own
+// configuration, ~/.ssh/config and its agent, pick the key and check the
+// host key.
+func sshDialer(u *url.URL) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	args := []string{"-o", "BatchMode=yes"}
+	if u.User != nil {
+		args = append(args, "-l", u.User.Username())
+	}
+	if port := u.Port(); port != "" {
+		args = append(args, "-p", port)
+	}
+	args = append(args, "--", u.Hostname(), "docker", "system", "dial-stdio")
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		// The connection outlives the dial, so it isn't tied to ctx.
+		cmd := exec.Command(sshCommand, args...)
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		cmd.Stderr = os.Stderr
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("ssh to %s: %w", u.Host, err)
+		}
+		return &cmdConn{cmd: cmd, r: stdout, w: stdin, host: u.Host}, nil
+	}
+}
+
+// cmdConn is a connection over the standard input and output of a command.
+type cmdConn struct {
+	cmd  *exec.Cmd
+	r    io.Reader
+	w    io.WriteCloser
+	host string
+}
+
+func (c *cmdConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *cmdConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+func (c *cmdConn) Close() error {
+	c.w.Close()
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+	return nil
+}
+
+func (c *cmdConn) LocalAddr() net.Addr              { return cmdAddr("local") }
+func (c *cmdConn) RemoteAddr() net.Addr             { return cmdAddr(c.host) }
+func (c *cmdConn) SetDeadline(time.Time) error      { return nil }
+func (c *cmdConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *cmdConn) SetWriteDeadline(time.Time) error { return nil }
+
+type cmdAddr string
+
+func (a cmdAddr) Network() string { return "ssh" }
+func (a cmdAddr) String() string  { return string(a) }
+
+// DeployEngine rolls the compose services on the Docker engine at host, a
+// DOCKER_HOST such as ssh://deploy@10.1.0.20, to the images of m. Services
+// already on them are left alone, so deploying a release twice is
+// harmless. It returns the containers it recreated.
+func DeployEngine(ctx context.Context, host string, m *manifest.Manifest) ([]string, error) {
+	d, err := newDocker(host)
+	if err != nil {
+		return nil, err
+	}
+	defer d.client.CloseIdleConnections()
+	containers, err := d.containers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pulled := map[string]bool{}
+	var recreated []string
+	for _, c := range containers {
+		s, ok := m.Service(c.Service)
+		if !ok || c.Image == s.Ref() {
+			continue
+		}
+		ref := s.Ref()
+		if !pulled[ref] {
+			log.Printf("Pulling %s on %s", ref, host)
+			if err := d.pull(ctx, ref); err != nil {
+				return recreated, fmt.Errorf("pulling %s: %w", ref, err)
+			}
+			pulled[ref] = true
+		}
+		log.Printf("Recreating %s on %s with %s (was %s)", c.Name, host, ref, c.Image)
+		if err := d.recreate(ctx, c, ref); err != nil {
+			return recreated, fmt.Errorf("recreating %s: %w", c.Name, err)
+		}
+		recreated = append(recreated, c.Name)
+	}
+	return recreated, nil
+}
+
+// pull pulls ref, reading the engine's progress to its end for the error
+// it reports there rather than in the status.
+func (d *docker) pull(ctx context.Context, ref string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.base+"/images/create?fromImage="+url.QueryEscape(ref), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("docker pull returned %d", resp.StatusCode)
+	}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var progress struct {
+			Error string `json:"error"`
+		}
+		if err := dec.Decode(&progress); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if progress.Error != "" {
+			return errors.New(progress.Error)
+		}
+	}
+}
+
+// recreate replaces the container c by one of the same name and settings
+// running ref. The old container is kept, stopped and renamed, until the
+// new one has started, and put back when it doesn't.
+func (d *docker) recreate(ctx context.Context, c Container, ref string) error {
+	var inspect struct {
+		Config          map[string]any  `json:"Config"`
+		HostConfig      json.RawMessage `json:"HostConfig"`
+		NetworkSettings struct {
+			Networks map[string]struct {
+				Aliases    []string        `json:"Aliases"`
+				Links      []string        `json:"Links"`
+				IPAMConfig json.RawMessage `json:"IPAMConfig"`
+			} `json:"Networks"`
+		} `json:"NetworkSettings"`
+	}
+	id := url.PathEscape(c.ID)
+	if err := d.get(ctx, "/containers/"+id+"/json", &inspect); err != nil {
+		return err
+	}
+	body := map[string]any{}
+	for k, v := range inspect.Config {
+		body[k] = v
+	}
+	body["Image"] = ref
+	body["HostConfig"] = inspect.HostConfig
+	body["NetworkingConfig"] = map[string]any{"EndpointsConfig": inspect.NetworkSettings.Networks}
+
+	old := c.Name + "-replaced"
+	if err := d.do(ctx, http.MethodPost, "/containers/"+id+"/rename?name="+url.QueryEscape(old), nil, nil); err != nil {
+		return err
+	}
+	if err := d.do(ctx, http.MethodPost, "/containers/"+id+"/stop", nil, nil); err != nil {
+		return d.restore(ctx, c, "", err)
+	}
+	var created struct {
+		ID string `json:"Id"`
+	}
+	if err := d.do(ctx, http.MethodPost, "/containers/create?name="+url.QueryEscape(c.Name), body, &created); err != nil {
+		return d.restore(ctx, c, "", err)
+	}
+	if err := d.do(ctx, http.MethodPost, "/containers/"+url.PathEscape(created.ID)+"/start", nil, nil); err != nil {
+		return d.restore(ctx, c, created.ID, err)
+	}
+	if err := d.do(ctx, http.MethodDelete, "/containers/"+id, nil, nil); err != nil {
+		log.Printf("Failed to remove the replaced %s: %v", old, err)
+	}
+	return nil
+}
+
+// restore puts the container c back after recreating it failed with err,
+// removing the container created to replace it, if any. It returns err,
+// with what went wrong restoring.
+func (d *docker) restore(ctx context.Context, c Container, created string, err error) error {
+	errs := []error{err}
+	if created != "" {
+		errs = append(errs, d.do(ctx, http.MethodDelete, "/containers/"+url.PathEscape(created)+"?force=true", nil, nil))
+	}
+	id := url.PathEscape(c.ID)
+	errs = append(errs,
+		d.do(ctx, http.MethodPost, "/containers/"+id+"/rename?name="+url.QueryEscape(c.Name), nil, nil),
+		d.do(ctx, http.MethodPost, "/containers/"+id+"/start", nil, nil))
+	return errors.Join(errs...)
+}
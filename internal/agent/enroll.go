@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/pki"
+)
+
+// renewBefore is how long before its certificate expires the agent renews.
+const renewBefore = 30 * 24 * time.Hour
+
+func (a *Agent) certPaths() (cert, key, ca string) {
+	return filepath.Join(a.StateDir, "agent.crt"), filepath.Join(a.StateDir, "agent.key"), filepath.Join(a.StateDir, "ca.crt")
+}
+
+// loadCertificate returns the mTLS config for the agent's certificate, or
+// nil when it hasn't enrolled.
+func (a *Agent) loadCertificate() (*tls.Config, *x509.Certificate, error) {
+	certPath, keyPath, caPath := a.certPaths()
+	certPEM, err := os.ReadFile(certPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	caPEM, err := os.ReadFile(caPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	conf, err := pki.ClientTLSConfig(certPEM, keyPEM, caPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", certPath, err)
+	}
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", certPath, err)
+	}
+	return conf, cert, nil
+}
+
+// Enroll exchanges BootstrapToken for a client certificate, trusting the
+// releaser by CAHash. It does nothing once the agent has a certificate, or
+// without a bootstrap token.
+func (a *Agent) Enroll(ctx context.Context) error {
+	if a.cert != nil || a.BootstrapToken == "" || a.ReleaserURL == "" {
+		return nil
+	}
+	if a.CAHash == "" {
+		return errors.New("AGENT_CA_HASH is required to enroll")
+	}
+	client := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: pki.PinnedTLSConfig(a.CAHash)},
+	}
+	if err := a.requestCertificate(ctx, client, "/enroll", a.BootstrapToken); err != nil {
+		return fmt.Errorf("enrolling with %s: %w", a.ReleaserURL, err)
+	}
+	log.Printf("Enrolled %s with %s", a.Name, a.ReleaserURL)
+	return nil
+}
+
+// renewIfExpiring renews the agent's certificate over mTLS when it expires
+// within renewBefore.
+func (a *Agent) renewIfExpiring(ctx context.Context) error {
+	if a.cert == nil || time.Until(a.cert.NotAfter) > renewBefore {
+		return nil
+	}
+	src, ok := a.src.(*httpSource)
+	if !ok {
+		return nil
+	}
+	if err := a.requestCertificate(ctx, src.client, "/enroll/renew", ""); err != nil {
+		return err
+	}
+	log.Printf("Renewed the client certificate, valid until %s", a.cert.NotAfter.Format(time.DateOnly))
+	return nil
+}
+
+// requestCertificate sends a new CSR to path and, on success, saves the
+// certificate and switches the agent to it.
+func (a *Agent) requestCertificate(ctx context.Context, client *http.Client, path, token string) error {
+	keyPEM, csrPEM, err := pki.NewCSR(a.Name)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]string{"token": token, "name": a.Name, "csr": string(csrPEM)})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.ReleaserURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := readOK(resp)
+	if err != nil {
+		return err
+	}
+	var out struct {
+		Certificate string `json:"certificate"`
+		CA          string `json:"ca"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return fmt.Errorf("error parsing enroll response: %w", err)
+	}
+
+	certPath, keyPath, caPath := a.certPaths()
+	if err := os.MkdirAll(a.StateDir, 0755); err != nil {
+		return err
+	}
+	for _, f := range []struct {
+		path string
+		data []byte
+		perm os.FileMode
+	}{
+		{keyPath, keyPEM, 0600},
+		{certPath, []byte(out.Certificate), 0644},
+		{caPath, []byte(out.CA), 0644},
+	} {
+		if err := os.WriteFile(f.path, f.data, f.perm); err != nil {
+			return err
+		}
+	}
+	conf, cert, err := a.loadCertificate()
+	if err != nil {
+		return err
+	}
+	a.cert = cert
+	return a.useClient(&http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{TLSClientConfig: conf}})
+}
@@ -0,0 +1,223 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ComposeServiceLabel is the label compose puts on a service's containers,
+// naming the service.
+const ComposeServiceLabel = "com.docker.compose.service"
+
+// inventoryInterval is how often an unchanged inventory is sent again, so
+// the releaser can tell a quiet host from a gone one.
+const inventoryInterval = 10 * time.Minute
+
+// Container is a running container of a compose service.
+type Container struct {
+	// ID is the container's ID on its host.
+	ID string `json:"id,omitempty"`
+	// Service is the compose service, which the agent names as in the
+	// manifest.
+	Service string `json:"service"`
+	Name    string `json:"name"`
+	// Image is the reference the container was created from, e.g.
+	// singaravelan21/todo-backend:v1.1.0.
+	Image string `json:"image"`
+	// ImageID is the local ID of the image, sha256:….
+	ImageID string `json:"image_id"`
+	// RepoDigests are the registry digests of the image, e.g.
+	// singaravelan21/todo-backend@sha256:…. An image built or committed on
+	// the host has none.
+	RepoDigests []string `json:"repo_digests,omitempty"`
+}
+
+// Inventory is what an agent sends to PUT /agents/{name}/containers: the
+// containers it finds running, whoever started them.
+type Inventory struct {
+	// Version is the release the agent last applied.
+	Version    string      `json:"version,omitempty"`
+	Containers []Container `json:"containers"`
+	Time       time.Time   `json:"time"`
+}
+
+// docker is a client of the Docker Engine API.
+type docker struct {
+	base   string
+	client *http.Client
+}
+
+// newDocker returns a client of the engine at host, a DOCKER_HOST such as
+// unix:///var/run/docker.sock, tcp://10.1.0.20:2375 or
+// ssh://deploy@10.1.0.20 (see sshDialer).
+func newDocker(host string) (*docker, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("docker host %q: %w", host, err)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	switch u.Scheme {
+	case "unix":
+		var dialer net.Dialer
+		client.Transport = &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", u.Path)
+		}}
+		return &docker{base: "http://docker", client: client}, nil
+	case "tcp", "http":
+		return &docker{base: "http://" + u.Host, client: client}, nil
+	case "ssh":
+		// Pulls and stops outlast the default timeout; the deadline is
+		// the caller's context.
+		client.Timeout = 0
+		client.Transport = &http.Transport{DialContext: sshDialer(u)}
+		return &docker{base: "http://docker", client: client}, nil
+	}
+	return nil, fmt.Errorf("docker host %q: unsupported scheme %q", host, u.Scheme)
+}
+
+func (d *docker) get(ctx context.Context, path string, v any) error {
+	return d.do(ctx, http.MethodGet, path, nil, v)
+}
+
+// do sends body, if any, as JSON to the engine and decodes the response
+// into v, if any. Not Modified, which the engine answers when asked to
+// stop a stopped container, is success.
+func (d *docker) do(ctx context.Context, method, path string, body, v any) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, d.base+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e struct {
+			Message string `json:"message"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Message != "" {
+			return fmt.Errorf("docker %s %s returned %d: %s", method, path, resp.StatusCode, e.Message)
+		}
+		return fmt.Errorf("docker %s %s returned %d", method, path, resp.StatusCode)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// containers lists the running containers of compose services, sorted by
+// service and name.
+func (d *docker) containers(ctx context.Context) ([]Container, error) {
+	filters, err := json.Marshal(map[string][]string{"label": {ComposeServiceLabel}})
+	if err != nil {
+		return nil, err
+	}
+	var list []struct {
+		ID      string            `json:"Id"`
+		Names   []string          `json:"Names"`
+		Image   string            `json:"Image"`
+		ImageID string            `json:"ImageID"`
+		Labels  map[string]string `json:"Labels"`
+	}
+	if err := d.get(ctx, "/containers/json?filters="+url.QueryEscape(string(filters)), &list); err != nil {
+		return nil, err
+	}
+	digests := map[string][]string{}
+	var containers []Container
+	for _, c := range list {
+		repoDigests, ok := digests[c.ImageID]
+		if !ok {
+			var img struct {
+				RepoDigests []string `json:"RepoDigests"`
+			}
+			if err := d.get(ctx, "/images/"+url.PathEscape(c.ImageID)+"/json", &img); err != nil {
+				return nil, err
+			}
+			repoDigests = img.RepoDigests
+			digests[c.ImageID] = repoDigests
+		}
+		var name string
+		if len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		containers = append(containers, Container{
+			ID:          c.ID,
+			Service:     c.Labels[ComposeServiceLabel],
+			Name:        name,
+			Image:       c.Image,
+			ImageID:     c.ImageID,
+			RepoDigests: repoDigests,
+		})
+	}
+	slices.SortFunc(containers, func(a, b Container) int {
+		return strings.Compare(a.Service+"\x00"+a.Name, b.Service+"\x00"+b.Name)
+	})
+	return containers, nil
+}
+
+// Containers lists the running containers of compose services on the
+// Docker engine at host, a DOCKER_HOST as for DeployEngine.
+func Containers(ctx context.Context, host string) ([]Container, error) {
+	d, err := newDocker(host)
+	if err != nil {
+		return nil, err
+	}
+	defer d.client.CloseIdleConnections()
+	return d.containers(ctx)
+}
+
+// reportContainers sends the host's containers to the releaser when they
+// changed since the last inventory or inventoryInterval has passed. It
+// does nothing without a releaser to report to or a Docker host.
+func (a *Agent) reportContainers(ctx context.Context) {
+	if a.reporter == nil || a.docker == nil {
+		return
+	}
+	containers, err := a.docker.containers(ctx)
+	if err != nil {
+		log.Printf("Failed to list containers: %v", err)
+		return
+	}
+	if slices.EqualFunc(containers, a.sentContainers, func(x, y Container) bool {
+		return x.Service == y.Service && x.Name == y.Name && x.Image == y.Image && x.ImageID == y.ImageID && slices.Equal(x.RepoDigests, y.RepoDigests)
+	}) && time.Since(a.sentAt) < inventoryInterval {
+		return
+	}
+	st, err := a.loadState()
+	if err != nil {
+		log.Printf("Failed to report containers: %v", err)
+		return
+	}
+	inv := Inventory{Version: st.Version, Containers: containers, Time: time.Now()}
+	if err := a.reporter.put(ctx, "/containers", inv); err != nil {
+		log.Printf("Failed to report containers: %v", err)
+		return
+	}
+	a.sentContainers, a.sentAt = containers, inv.Time
+}
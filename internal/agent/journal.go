@@ -0,0 +1,255 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// A rollout runs these steps in order, recording each in the journal in
+// StateDir as it finishes. A rollout that fails at a step and is tried
+// again, by the next poll or by Retry, skips the steps it already got
+// through rather than starting from scratch, as long as it deploys the
+// same manifest: the one with the journal's idempotency key.
+const (
+	// StepRender writes release.env, the config bundles and OverrideFile.
+	StepRender = "render"
+	// StepPull pulls the release's images.
+	StepPull = "pull"
+	// StepRestart brings the compose project up on them.
+	StepRestart = "restart"
+	// StepVerify checks the host's containers run the release's images.
+	StepVerify = "verify"
+)
+
+// Steps is the order the steps of a rollout run in.
+var Steps = []string{StepRender, StepPull, StepRestart, StepVerify}
+
+// Step states recorded in the journal.
+const (
+	StepDone   = "done"
+	StepFailed = "failed"
+)
+
+// IdempotencyKey identifies the rollout of m: the same for every attempt at
+// deploying it, on any host, and different for any manifest that would
+// deploy differently.
+func IdempotencyKey(m *manifest.Manifest) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s", m.ReleaseVersion, ComposeEnv(m))
+	if override, err := ComposeOverride(m); err == nil {
+		h.Write(override)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Journal records the steps of the last rollout the agent ran.
+type Journal struct {
+	// Key is the IdempotencyKey of the manifest rolled out.
+	Key     string       `json:"key"`
+	Version string       `json:"version"`
+	Started time.Time    `json:"started"`
+	Steps   []StepRecord `json:"steps"`
+}
+
+// StepRecord is how a step of a rollout went.
+type StepRecord struct {
+	Name     string    `json:"name"`
+	State    string    `json:"state"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// finished reports whether every step of the rollout is done.
+func (j *Journal) finished() bool {
+	for _, name := range Steps {
+		if rec := j.step(name); rec == nil || rec.State != StepDone {
+			return false
+		}
+	}
+	return true
+}
+
+// step returns the record of the step name, nil when it hasn't run.
+func (j *Journal) step(name string) *StepRecord {
+	for i := range j.Steps {
+		if j.Steps[i].Name == name {
+			return &j.Steps[i]
+		}
+	}
+	return nil
+}
+
+// reset forgets the steps from the step name on, so they run again.
+func (j *Journal) reset(name string) {
+	i := slices.Index(Steps, name)
+	j.Steps = slices.DeleteFunc(j.Steps, func(rec StepRecord) bool {
+		return slices.Index(Steps, rec.Name) >= i
+	})
+}
+
+// rollout runs the steps of deploying m the journal doesn't have done, or
+// all of them when the journal is of another manifest or of a rollout that
+// finished. With from set, the steps from it on run again whatever the
+// journal says.
+func (a *Agent) rollout(ctx context.Context, m *manifest.Manifest, from string) error {
+	j, err := a.loadJournal()
+	if err != nil {
+		return err
+	}
+	key := IdempotencyKey(m)
+	if j.Key != key || (from == "" && j.finished()) {
+		j = Journal{Key: key, Version: m.ReleaseVersion, Started: time.Now()}
+	}
+	if from != "" {
+		j.reset(from)
+	}
+	for _, name := range Steps {
+		rec := j.step(name)
+		if rec != nil && rec.State == StepDone {
+			log.Printf("Skipping %s of %s, done %s", name, m.ReleaseVersion, rec.Time.Format(time.RFC3339))
+			continue
+		}
+		if rec == nil {
+			j.Steps = append(j.Steps, StepRecord{Name: name})
+			rec = &j.Steps[len(j.Steps)-1]
+		}
+		rec.Attempts++
+		err := a.runStep(ctx, name, m)
+		rec.State, rec.Error, rec.Time = StepDone, "", time.Now()
+		if err != nil {
+			rec.State, rec.Error = StepFailed, err.Error()
+		}
+		if serr := a.saveJournal(j); serr != nil {
+			return serr
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Retry runs the rollout of the journal again from its failed step, or
+// from the step from when set. The release's manifest must not have
+// changed since.
+func (a *Agent) Retry(ctx context.Context, from string) error {
+	if from != "" && !slices.Contains(Steps, from) {
+		return fmt.Errorf("unknown step %q, want one of %s", from, strings.Join(Steps, ", "))
+	}
+	j, err := a.loadJournal()
+	if err != nil {
+		return err
+	}
+	if j.Key == "" {
+		return errors.New("no rollout to retry")
+	}
+	if from == "" && j.finished() {
+		return fmt.Errorf("the rollout of %s finished; name a step to run it again from", j.Version)
+	}
+	data, err := a.src.release(ctx, j.Version)
+	if err != nil {
+		return err
+	}
+	m, err := parseManifest(data)
+	if err != nil {
+		return err
+	}
+	if IdempotencyKey(m) != j.Key {
+		return fmt.Errorf("the manifest of %s changed since its rollout; poll to deploy it afresh", j.Version)
+	}
+	st, err := a.loadState()
+	if err != nil {
+		return err
+	}
+	if err := a.apply(ctx, m, &st, from); err != nil {
+		return err
+	}
+	return a.saveState(st)
+}
+
+// Journal returns the journal of the last rollout.
+func (a *Agent) Journal() (Journal, error) {
+	return a.loadJournal()
+}
+
+// runStep runs the step name of deploying m.
+func (a *Agent) runStep(ctx context.Context, name string, m *manifest.Manifest) error {
+	switch name {
+	case StepRender:
+		return a.render(ctx, m)
+	case StepPull:
+		return a.compose(ctx, m, "pull")
+	case StepRestart:
+		return a.compose(ctx, m, "up", "-d", "--remove-orphans")
+	case StepVerify:
+		return a.verify(ctx, m)
+	}
+	return fmt.Errorf("unknown step %q", name)
+}
+
+// verify checks that the containers of m's services run the images m
+// names. Services without containers on the host aren't checked, nor is
+// anything without a Docker host to ask.
+func (a *Agent) verify(ctx context.Context, m *manifest.Manifest) error {
+	if a.docker == nil {
+		log.Printf("No Docker host to verify %s on", m.ReleaseVersion)
+		return nil
+	}
+	containers, err := a.docker.containers(ctx)
+	if err != nil {
+		return err
+	}
+	var wrong []string
+	for _, c := range containers {
+		if s, ok := m.Service(c.Service); ok && c.Image != s.Ref() {
+			wrong = append(wrong, fmt.Sprintf("%s runs %s, not %s", c.Name, c.Image, s.Ref()))
+		}
+	}
+	if len(wrong) > 0 {
+		return errors.New(strings.Join(wrong, "; "))
+	}
+	return nil
+}
+
+func (a *Agent) journalPath() string {
+	return filepath.Join(a.StateDir, "journal.json")
+}
+
+func (a *Agent) loadJournal() (Journal, error) {
+	var j Journal
+	data, err := os.ReadFile(a.journalPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return j, nil
+	}
+	if err != nil {
+		return j, err
+	}
+	if err := json.Unmarshal(data, &j); err != nil {
+		return j, fmt.Errorf("error parsing %s: %w", a.journalPath(), err)
+	}
+	return j, nil
+}
+
+func (a *Agent) saveJournal(j Journal) error {
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(a.StateDir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(a.journalPath(), data, 0644)
+}
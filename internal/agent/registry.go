@@ -0,0 +1,289 @@
+package agent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/image"
+	"github.com/velann21/todo-releaser/internal/manifest"
+	"github.com/velann21/todo-releaser/internal/provenance"
+)
+
+// releaseArtifactType is the artifact type the releaser publishes releases
+// to RELEASER_MANIFEST_REPOSITORY as.
+const releaseArtifactType = "application/vnd.todo-releaser.release.v1"
+
+// titleAnnotation names the file a layer of a release artifact holds.
+const titleAnnotation = "org.opencontainers.image.title"
+
+// maxArtifactSize bounds the manifests and files read from the registry.
+const maxArtifactSize = 16 << 20
+
+// registrySource reads the releases the releaser publishes to a registry
+// as OCI artifacts, one per release tag, following the tag that moves to
+// the newest release. Every file is checked against its digest, and the
+// manifest, when keys are set, against its signatures.
+type registrySource struct {
+	base   string
+	repo   string
+	follow string
+	keys   []ed25519.PublicKey
+	client *http.Client
+
+	username, password string
+	// basic or token is set once the registry has asked for credentials.
+	basic bool
+	token string
+}
+
+// newRegistrySource returns a source for the release artifacts at ref, a
+// repository and optionally the tag to follow (default latest).
+func newRegistrySource(ref, username, password string, keys []ed25519.PublicKey) (*registrySource, error) {
+	r, err := image.Parse(ref)
+	if err != nil {
+		return nil, fmt.Errorf("AGENT_MANIFEST_REPOSITORY: %w", err)
+	}
+	if r.Digest != "" {
+		return nil, fmt.Errorf("AGENT_MANIFEST_REPOSITORY: %s is pinned to one release; name the tag to follow instead", ref)
+	}
+	host := r.Registry
+	if r.IsDockerHub() {
+		host = "registry-1.docker.io"
+	}
+	s := &registrySource{
+		base:     registryScheme(host) + "://" + host,
+		repo:     r.Repository,
+		follow:   r.Tag,
+		keys:     keys,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		username: username,
+		password: password,
+	}
+	if s.follow == "" {
+		s.follow = "latest"
+	}
+	return s, nil
+}
+
+// registryScheme is http for registries on the host itself and https for
+// all others.
+func registryScheme(host string) string {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	if ip := net.ParseIP(hostname); hostname == "localhost" || ip != nil && ip.IsLoopback() {
+		return "http"
+	}
+	return "https"
+}
+
+func (s *registrySource) latest(ctx context.Context, etag string) ([]byte, string, error) {
+	art, digest, err := s.artifact(ctx, s.follow)
+	if err != nil {
+		return nil, "", err
+	}
+	if digest == etag {
+		return nil, etag, nil
+	}
+	data, err := s.manifest(ctx, art)
+	return data, digest, err
+}
+
+func (s *registrySource) release(ctx context.Context, tag string) ([]byte, error) {
+	art, _, err := s.artifact(ctx, strings.ReplaceAll(tag, "/", "-"))
+	if err != nil {
+		return nil, err
+	}
+	return s.manifest(ctx, art)
+}
+
+func (s *registrySource) config(ctx context.Context, tag, path string) ([]byte, error) {
+	art, _, err := s.artifact(ctx, strings.ReplaceAll(tag, "/", "-"))
+	if err != nil {
+		return nil, err
+	}
+	return s.file(ctx, art, path)
+}
+
+// releaseArtifact is the part of a release artifact's manifest the agent
+// reads.
+type releaseArtifact struct {
+	ArtifactType string `json:"artifactType"`
+	Layers       []struct {
+		Digest      string            `json:"digest"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"layers"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// artifact fetches the release artifact tagged tag, and its digest.
+func (s *registrySource) artifact(ctx context.Context, tag string) (*releaseArtifact, string, error) {
+	data, err := s.get(ctx, "/manifests/"+tag, "application/vnd.oci.image.manifest.v1+json")
+	if err != nil {
+		return nil, "", err
+	}
+	var art releaseArtifact
+	if err := json.Unmarshal(data, &art); err != nil {
+		return nil, "", fmt.Errorf("release artifact %s: %w", tag, err)
+	}
+	if art.ArtifactType != releaseArtifactType {
+		return nil, "", fmt.Errorf("%s:%s is a %q, not a release", s.repo, tag, art.ArtifactType)
+	}
+	sum := sha256.Sum256(data)
+	return &art, "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// manifest returns the manifest of art, once its signatures check out
+// when keys are set.
+func (s *registrySource) manifest(ctx context.Context, art *releaseArtifact) ([]byte, error) {
+	data, err := s.file(ctx, art, manifest.File)
+	if err != nil || len(s.keys) == 0 {
+		return data, err
+	}
+	sigPath := provenance.SignaturePath(manifest.File)
+	sigData, err := s.file(ctx, art, sigPath)
+	if err != nil {
+		return nil, fmt.Errorf("%s failed verification: %w", manifest.File, err)
+	}
+	var sigs []provenance.Signature
+	if err := json.Unmarshal(sigData, &sigs); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", sigPath, err)
+	}
+	if _, err := provenance.VerifyManifestSignatures(data, sigs, s.keys); err != nil {
+		return nil, fmt.Errorf("%s failed verification: %w", manifest.File, err)
+	}
+	return data, nil
+}
+
+// file returns the layer of art titled name, checked against its digest.
+func (s *registrySource) file(ctx context.Context, art *releaseArtifact, name string) ([]byte, error) {
+	for _, l := range art.Layers {
+		if l.Annotations[titleAnnotation] != name {
+			continue
+		}
+		data, err := s.get(ctx, "/blobs/"+l.Digest, "")
+		if err != nil {
+			return nil, err
+		}
+		if sum := sha256.Sum256(data); "sha256:"+hex.EncodeToString(sum[:]) != l.Digest {
+			return nil, fmt.Errorf("%s of release %s does not match its digest", name, art.Annotations["org.opencontainers.image.version"])
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("release %s has no %s", art.Annotations["org.opencontainers.image.version"], name)
+}
+
+// get reads path under the repository, logging in as the registry's
+// challenge asks the first time it refuses.
+func (s *registrySource) get(ctx context.Context, path, accept string) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.base+"/v2/"+s.repo+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if s.basic {
+			req.SetBasicAuth(s.username, s.password)
+		} else if s.token != "" {
+			req.Header.Set("Authorization", "Bearer "+s.token)
+		}
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			resp.Body.Close()
+			if err := s.login(ctx, resp.Header.Get("WWW-Authenticate")); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(io.LimitReader(resp.Body, maxArtifactSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s returned %d", req.URL.Redacted(), resp.StatusCode)
+		}
+		if len(data) > maxArtifactSize {
+			return nil, fmt.Errorf("%s is over %d bytes", req.URL.Redacted(), maxArtifactSize)
+		}
+		return data, nil
+	}
+}
+
+// challengeParam matches the key="value" parameters of a challenge.
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// login sets s up to authenticate as challenge asks: with basic auth, or
+// with a pull token from the registry's token service, asked for as the
+// agent's user if set.
+func (s *registrySource) login(ctx context.Context, challenge string) error {
+	scheme, rest, _ := strings.Cut(challenge, " ")
+	params := map[string]string{}
+	for _, p := range challengeParam.FindAllStringSubmatch(rest, -1) {
+		params[p[1]] = p[2]
+	}
+	switch {
+	case strings.EqualFold(scheme, "basic"):
+		if s.username == "" {
+			return fmt.Errorf("%s needs AGENT_MANIFEST_USERNAME and AGENT_MANIFEST_PASSWORD", s.base)
+		}
+		s.basic = true
+		return nil
+	case !strings.EqualFold(scheme, "bearer") || params["realm"] == "":
+		return fmt.Errorf("%s asks for unsupported authentication %q", s.base, scheme)
+	}
+	u, err := url.Parse(params["realm"])
+	if err != nil {
+		return fmt.Errorf("%s token service: %w", s.base, err)
+	}
+	q := u.Query()
+	if service := params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	q.Set("scope", "repository:"+s.repo+":pull")
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s token service returned %d", s.base, resp.StatusCode)
+	}
+	var auth struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&auth); err != nil {
+		return err
+	}
+	s.token = auth.Token
+	if s.token == "" {
+		s.token = auth.AccessToken
+	}
+	return nil
+}
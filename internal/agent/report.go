@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Rollout states reported by agents.
+const (
+	StateDeploying = "deploying"
+	StateDeployed  = "deployed"
+	StateFailed    = "failed"
+)
+
+// Report is what an agent sends to PUT /agents/{name} on the releaser. With
+// a client certificate the report is authenticated by mTLS, otherwise by
+// the bearer token.
+type Report struct {
+	// Environment the host belongs to, e.g. staging. Hosts without one are
+	// shown as an environment of their own.
+	Environment string    `json:"environment,omitempty"`
+	Version     string    `json:"version"`
+	State       string    `json:"state"`
+	Error       string    `json:"error,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// reporter sends reports to the releaser.
+type reporter struct {
+	url    string
+	token  string
+	name   string
+	client *http.Client
+}
+
+func (r *reporter) send(ctx context.Context, rep Report) error {
+	return r.put(ctx, "", rep)
+}
+
+// put sends v to /agents/{name} followed by path.
+func (r *reporter) put(ctx context.Context, path string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, r.url+"/agents/"+url.PathEscape(r.name)+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("releaser returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// report tells the releaser about a rollout. Failing to report doesn't stop
+// the rollout.
+func (a *Agent) report(ctx context.Context, version, state string, err error) {
+	if a.reporter == nil {
+		return
+	}
+	rep := Report{Environment: a.Environment, Version: version, State: state, Time: time.Now()}
+	if err != nil {
+		rep.Error = err.Error()
+	}
+	if err := a.reporter.send(ctx, rep); err != nil {
+		log.Printf("Failed to report %s %s: %v", version, state, err)
+	}
+}
@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// source is where the agent reads release manifests from.
+type source interface {
+	// latest returns the current manifest and its ETag, or nil data when it
+	// is unchanged since etag.
+	latest(ctx context.Context, etag string) (data []byte, newETag string, err error)
+	// release returns the manifest tagged for a release.
+	release(ctx context.Context, tag string) ([]byte, error)
+	// config returns the config bundle path as a release tagged it.
+	config(ctx context.Context, tag, path string) ([]byte, error)
+}
+
+// httpSource reads the releaser's GET /manifest, /releases/{tag} and
+// /config.
+type httpSource struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpSource) latest(ctx context.Context, etag string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url+"/manifest", nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, etag, nil
+	}
+	data, err := readOK(resp)
+	return data, resp.Header.Get("ETag"), err
+}
+
+func (s *httpSource) release(ctx context.Context, tag string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url+"/releases/"+url.PathEscape(tag), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return readOK(resp)
+}
+
+func (s *httpSource) config(ctx context.Context, tag, path string) ([]byte, error) {
+	q := url.Values{"release": {tag}, "path": {path}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url+"/config?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return readOK(resp)
+}
+
+func readOK(resp *http.Response) ([]byte, error) {
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %d: %s", resp.Request.URL, resp.StatusCode, bytes.TrimSpace(data))
+	}
+	return data, nil
+}
+
+// gitSource reads the manifest from a checkout of the release repository,
+// pulling it first.
+type gitSource struct {
+	dir string
+}
+
+func (s *gitSource) latest(ctx context.Context, etag string) ([]byte, string, error) {
+	if _, err := s.git(ctx, "pull", "--ff-only", "--tags"); err != nil {
+		return nil, "", err
+	}
+	head, err := s.git(ctx, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, "", err
+	}
+	if head == etag {
+		return nil, etag, nil
+	}
+	data, err := os.ReadFile(filepath.Join(s.dir, manifest.File))
+	return data, head, err
+}
+
+func (s *gitSource) release(ctx context.Context, tag string) ([]byte, error) {
+	out, err := s.git(ctx, "show", "refs/tags/"+tag+":"+manifest.File)
+	return []byte(out), err
+}
+
+func (s *gitSource) config(ctx context.Context, tag, path string) ([]byte, error) {
+	out, err := exec.CommandContext(ctx, "git", "-C", s.dir, "show", "refs/tags/"+tag+":"+path).Output()
+	if err != nil {
+		return nil, fmt.Errorf("git show %s:%s: %w", tag, path, err)
+	}
+	return out, nil
+}
+
+func (s *gitSource) git(ctx context.Context, args ...string) (string, error) {
+	out, err := exec.CommandContext(ctx, "git", append([]string{"-C", s.dir}, args...)...).Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w", strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -5,10 +5,12 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"net/url"
 	"os"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
 )
 
 // Authenticator is used to authenticate our users.
@@ -66,3 +68,15 @@ func GenerateCodeChallenge(verifier string) string {
 	s := sha256.Sum256([]byte(verifier))
 	return base64.RawURLEncoding.EncodeToString(s[:])
 }
+
+// ClientCredentialsToken gets an access token for AUTH0_AUDIENCE with the
+// client credentials grant, for scripts and services calling the API.
+func ClientCredentialsToken(ctx context.Context) (*oauth2.Token, error) {
+	conf := clientcredentials.Config{
+		ClientID:       os.Getenv("AUTH0_CLIENT_ID"),
+		ClientSecret:   os.Getenv("AUTH0_CLIENT_SECRET"),
+		TokenURL:       "https://" + os.Getenv("AUTH0_DOMAIN") + "/oauth/token",
+		EndpointParams: url.Values{"audience": {os.Getenv("AUTH0_AUDIENCE")}},
+	}
+	return conf.Token(ctx)
+}
@@ -0,0 +1,188 @@
+// Package blobstore keeps release artifacts where they outlive the CI
+// runner that produced them: in S3, in Google Cloud Storage or in a local
+// directory such as a mounted volume.
+//
+// The S3 and GCS drivers run the aws and gcloud CLIs, so they pick up the
+// credentials those are configured with, e.g. from the runner's OIDC role.
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotFound is returned by Get for keys that aren't stored.
+var ErrNotFound = errors.New("blob not found")
+
+// Store keeps blobs by key. Keys are slash-separated paths relative to the
+// store's prefix, e.g. v202502.1.0/result.json.
+type Store interface {
+	Put(ctx context.Context, key string, data io.Reader) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// URL names where key is stored, e.g. s3://bucket/prefix/key.
+	URL(key string) string
+}
+
+// Drivers.
+const (
+	S3    = "s3"
+	GCS   = "gcs"
+	Local = "local"
+)
+
+// Config selects a driver and where it stores blobs.
+type Config struct {
+	// Driver is s3, gcs or local.
+	Driver string `json:"driver"`
+	// Bucket is the S3 or GCS bucket.
+	Bucket string `json:"bucket,omitempty"`
+	// Path is the local driver's directory.
+	Path string `json:"path,omitempty"`
+	// Prefix is prepended to every key.
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// Open returns the store c configures.
+func Open(c Config) (Store, error) {
+	prefix := strings.Trim(c.Prefix, "/")
+	switch c.Driver {
+	case Local:
+		if c.Path == "" {
+			return nil, errors.New("the local driver needs a path")
+		}
+		return &localStore{root: filepath.Join(c.Path, filepath.FromSlash(prefix))}, nil
+	case S3:
+		if c.Bucket == "" {
+			return nil, errors.New("the s3 driver needs a bucket")
+		}
+		return &cliStore{scheme: "s3", bucket: c.Bucket, prefix: prefix,
+			put: []string{"aws", "s3", "cp", "--only-show-errors", "-"},
+			get: []string{"aws", "s3", "cp", "--only-show-errors"}}, nil
+	case GCS:
+		if c.Bucket == "" {
+			return nil, errors.New("the gcs driver needs a bucket")
+		}
+		return &cliStore{scheme: "gs", bucket: c.Bucket, prefix: prefix,
+			put: []string{"gcloud", "storage", "cp", "-"},
+			get: []string{"gcloud", "storage", "cat"}}, nil
+	default:
+		return nil, fmt.Errorf("unknown driver %q, expected s3, gcs or local", c.Driver)
+	}
+}
+
+// cleanKey rejects keys that would escape the store's prefix.
+func cleanKey(key string) (string, error) {
+	clean := path.Clean("/" + key)[1:]
+	if key == "" || clean != key {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return clean, nil
+}
+
+type localStore struct {
+	root string
+}
+
+func (s *localStore) URL(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+// Put writes data next to its destination first and renames it into
+// place, so a failed write never leaves a partial blob.
+func (s *localStore) Put(ctx context.Context, key string, data io.Reader) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+	dest := s.URL(key)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(dest), ".blob-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), dest)
+}
+
+func (s *localStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(s.URL(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}
+	return f, err
+}
+
+// cliStore copies blobs with a cloud provider's CLI: put streams the blob
+// to stdin of put + URL, and get reads it from stdout of get + URL (+ "-").
+type cliStore struct {
+	scheme, bucket, prefix string
+	put, get               []string
+}
+
+func (s *cliStore) URL(key string) string {
+	return s.scheme + "://" + s.bucket + "/" + path.Join(s.prefix, key)
+}
+
+func (s *cliStore) Put(ctx context.Context, key string, data io.Reader) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+	args := append(s.put[1:len(s.put):len(s.put)], s.URL(key))
+	cmd := exec.CommandContext(ctx, s.put[0], args...)
+	cmd.Stdin = data
+	_, err = run(cmd)
+	return err
+}
+
+func (s *cliStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	args := append(s.get[1:len(s.get):len(s.get)], s.URL(key))
+	if s.scheme == "s3" {
+		args = append(args, "-")
+	}
+	out, err := run(exec.CommandContext(ctx, s.get[0], args...))
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(out)), nil
+}
+
+// run runs cmd, returning its output, or an error with what it printed to
+// stderr when it fails.
+func run(cmd *exec.Cmd) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", strings.Join(cmd.Args[:3], " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
@@ -0,0 +1,102 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocal(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(Config{Driver: Local, Path: dir, Prefix: "/releases/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := s.Put(ctx, "v202502.1.0/result.json", strings.NewReader(`{"version": "v202502.1.0"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "releases", "v202502.1.0", "result.json")); err != nil {
+		t.Errorf("blob not stored under the prefix: %v", err)
+	}
+	r, err := s.Get(ctx, "v202502.1.0/result.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != `{"version": "v202502.1.0"}` {
+		t.Errorf("Get = %q", data)
+	}
+
+	if _, err := s.Get(ctx, "v202502.1.0/missing.json"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of a missing key = %v, want ErrNotFound", err)
+	}
+	for _, key := range []string{"", "../escape", "/abs", "a//b", "a/./b"} {
+		if err := s.Put(ctx, key, strings.NewReader("x")); err == nil {
+			t.Errorf("Put(%q) succeeded, want an invalid key error", key)
+		}
+	}
+}
+
+func TestCLI(t *testing.T) {
+	// Fake CLIs record their arguments and stdin, and print "blob".
+	bin := t.TempDir()
+	log := filepath.Join(t.TempDir(), "calls")
+	script := "#!/bin/sh\necho \"$(basename $0) $*\" >> " + log + "\ncat > /dev/null\necho -n blob\n"
+	for _, name := range []string{"aws", "gcloud"} {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	tests := []struct {
+		config Config
+		url    string
+		calls  string
+	}{
+		{Config{Driver: S3, Bucket: "todo-artifacts", Prefix: "releases"}, "s3://todo-artifacts/releases/v1/result.json",
+			"aws s3 cp --only-show-errors - s3://todo-artifacts/releases/v1/result.json\n" +
+				"aws s3 cp --only-show-errors s3://todo-artifacts/releases/v1/result.json -\n"},
+		{Config{Driver: GCS, Bucket: "todo-artifacts"}, "gs://todo-artifacts/v1/result.json",
+			"gcloud storage cp - gs://todo-artifacts/v1/result.json\n" +
+				"gcloud storage cat gs://todo-artifacts/v1/result.json\n"},
+	}
+	ctx := context.Background()
+	for _, tt := range tests {
+		os.Remove(log)
+		s, err := Open(tt.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.URL("v1/result.json"); got != tt.url {
+			t.Errorf("%s: URL = %q, want %q", tt.config.Driver, got, tt.url)
+		}
+		if err := s.Put(ctx, "v1/result.json", strings.NewReader("{}")); err != nil {
+			t.Errorf("%s: Put: %v", tt.config.Driver, err)
+		}
+		r, err := s.Get(ctx, "v1/result.json")
+		if err != nil {
+			t.Errorf("%s: Get: %v", tt.config.Driver, err)
+		} else if data, _ := io.ReadAll(r); string(data) != "blob" {
+			t.Errorf("%s: Get = %q, want %q", tt.config.Driver, data, "blob")
+		}
+		calls, _ := os.ReadFile(log)
+		if string(calls) != tt.calls {
+			t.Errorf("%s: calls = %q, want %q", tt.config.Driver, calls, tt.calls)
+		}
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	for _, c := range []Config{{Driver: "azure"}, {Driver: S3}, {Driver: GCS}, {Driver: Local}} {
+		if _, err := Open(c); err == nil {
+			t.Errorf("Open(%+v) succeeded, want an error", c)
+		}
+	}
+}
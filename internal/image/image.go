@@ -0,0 +1,104 @@
+// Package image parses container image references such as
+// registry.corp:5000/team/app/api:v1.2.0 into their registry, repository
+// path, tag and digest, following Docker's normalisation rules.
+package image
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DockerHub is the registry of references that don't name one.
+const DockerHub = "docker.io"
+
+// Reference is a parsed image reference.
+type Reference struct {
+	// Registry is the registry host, with its port if any, e.g. ghcr.io or
+	// registry.corp:5000. It is DockerHub when the reference has none.
+	Registry string
+	// Repository is the path within the registry, e.g. team/app/api. Official
+	// Docker Hub images get the library/ prefix.
+	Repository string
+	Tag        string
+	// Digest is the content digest, e.g. sha256:…, when pinned.
+	Digest string
+}
+
+var (
+	pathComponent = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+	tagPattern    = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	digestPattern = regexp.MustCompile(`^[a-z0-9]+(?:[+._-][a-z0-9]+)*:[a-zA-Z0-9=_-]+$`)
+)
+
+// Parse parses ref. The tag and digest are optional.
+func Parse(ref string) (Reference, error) {
+	var r Reference
+	name := ref
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, r.Digest = name[:i], name[i+1:]
+		if !digestPattern.MatchString(r.Digest) {
+			return Reference{}, fmt.Errorf("image %q: invalid digest %q", ref, r.Digest)
+		}
+	}
+	// A colon after the last slash starts the tag; one before it is the
+	// registry's port.
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, r.Tag = name[:i], name[i+1:]
+		if !tagPattern.MatchString(r.Tag) {
+			return Reference{}, fmt.Errorf("image %q: invalid tag %q", ref, r.Tag)
+		}
+	}
+
+	r.Registry = DockerHub
+	if first, rest, ok := strings.Cut(name, "/"); ok && isRegistry(first) {
+		r.Registry, name = first, rest
+	}
+	if r.Registry == "index.docker.io" {
+		r.Registry = DockerHub
+	}
+	if name == "" {
+		return Reference{}, fmt.Errorf("image %q: missing repository", ref)
+	}
+	for _, c := range strings.Split(name, "/") {
+		if !pathComponent.MatchString(c) {
+			return Reference{}, fmt.Errorf("image %q: invalid repository path component %q", ref, c)
+		}
+	}
+	if r.Registry == DockerHub && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	r.Repository = name
+	return r, nil
+}
+
+// isRegistry reports whether the first path component of a reference names
+// a registry host rather than a Docker Hub namespace.
+func isRegistry(s string) bool {
+	return strings.ContainsAny(s, ".:") || s == "localhost"
+}
+
+// IsDockerHub reports whether r is hosted on Docker Hub.
+func (r Reference) IsDockerHub() bool {
+	return r.Registry == DockerHub
+}
+
+// Name is the reference without tag or digest, in its shortest form for
+// Docker Hub images (nginx, singaravelan21/todo-backend).
+func (r Reference) Name() string {
+	if !r.IsDockerHub() {
+		return r.Registry + "/" + r.Repository
+	}
+	return strings.TrimPrefix(r.Repository, "library/")
+}
+
+func (r Reference) String() string {
+	s := r.Name()
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
@@ -0,0 +1,56 @@
+package image
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		ref     string
+		want    Reference
+		wantErr bool
+	}{
+		{"nginx", Reference{Registry: "docker.io", Repository: "library/nginx"}, false},
+		{"singaravelan21/todo-backend:v1.1.0", Reference{Registry: "docker.io", Repository: "singaravelan21/todo-backend", Tag: "v1.1.0"}, false},
+		{"docker.io/library/postgres:16", Reference{Registry: "docker.io", Repository: "library/postgres", Tag: "16"}, false},
+		{"index.docker.io/singaravelan21/todo-frontend", Reference{Registry: "docker.io", Repository: "singaravelan21/todo-frontend"}, false},
+		{"ghcr.io/org/sub/name:1.0", Reference{Registry: "ghcr.io", Repository: "org/sub/name", Tag: "1.0"}, false},
+		{"registry.corp:5000/team/app/api", Reference{Registry: "registry.corp:5000", Repository: "team/app/api"}, false},
+		{"registry.corp:5000/team/app/api:v2", Reference{Registry: "registry.corp:5000", Repository: "team/app/api", Tag: "v2"}, false},
+		{"localhost/app@sha256:abc123", Reference{Registry: "localhost", Repository: "app", Digest: "sha256:abc123"}, false},
+		{"123456789012.dkr.ecr.eu-west-1.amazonaws.com/todo/api:v1@sha256:ff", Reference{Registry: "123456789012.dkr.ecr.eu-west-1.amazonaws.com", Repository: "todo/api", Tag: "v1", Digest: "sha256:ff"}, false},
+		{"", Reference{}, true},
+		{"ghcr.io/", Reference{}, true},
+		{"Org/App", Reference{}, true},
+		{"app:v1:extra", Reference{}, true},
+		{"app@notadigest", Reference{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := Parse(tt.ref)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Parse(%q) error = %v, wantErr %v", tt.ref, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q) = %+v, want %+v", tt.ref, got, tt.want)
+		}
+	}
+}
+
+func TestReferenceString(t *testing.T) {
+	tests := []string{
+		"nginx",
+		"singaravelan21/todo-backend:v1.1.0",
+		"ghcr.io/org/sub/name:1.0",
+		"registry.corp:5000/team/app/api:v2@sha256:abc123",
+	}
+
+	for _, ref := range tests {
+		r, err := Parse(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := r.String(); got != ref {
+			t.Errorf("Parse(%q).String() = %q", ref, got)
+		}
+	}
+}
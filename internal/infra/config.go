@@ -0,0 +1,77 @@
+package infra
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/velann21/todo-releaser/internal/secrets"
+)
+
+// ConfigValue is a single stack config value. In the config file it is either
+// a plain string or an object:
+//
+//	{"value": "...", "secret": true}
+//	{"env": "DOCKER_PASSWORD", "secret": true}
+//
+// where env reads the value from the environment at run time, so secrets can
+// come from CI instead of the file. Values encrypted with `todoctl encrypt`
+// (ENC[age,...]) are decrypted when the config is used and always set as
+// secrets.
+type ConfigValue struct {
+	Value  string `json:"value"`
+	Env    string `json:"env"`
+	Secret bool   `json:"secret"`
+}
+
+func (v *ConfigValue) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*v = ConfigValue{Value: s}
+		return nil
+	}
+	type plain ConfigValue
+	return json.Unmarshal(data, (*plain)(v))
+}
+
+// StackConfig is the config file: values under "common" are set on every
+// project, values under a project name only on that project's stack.
+type StackConfig map[string]map[string]ConfigValue
+
+func LoadStackConfig(path string) (StackConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c StackConfig
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// For returns the config for project, with project values overriding common
+// ones, env references resolved and encrypted values decrypted.
+func (c StackConfig) For(project string) (auto.ConfigMap, error) {
+	out := auto.ConfigMap{}
+	for _, section := range []string{"common", project} {
+		for key, v := range c[section] {
+			value := v.Value
+			if v.Env != "" {
+				var ok bool
+				value, ok = os.LookupEnv(v.Env)
+				if !ok {
+					return nil, fmt.Errorf("config %s: environment variable %s is not set", key, v.Env)
+				}
+			}
+			secret := v.Secret || secrets.IsEncrypted(value)
+			value, err := secrets.Decrypt(value)
+			if err != nil {
+				return nil, fmt.Errorf("config %s: %w", key, err)
+			}
+			out[key] = auto.ConfigValue{Value: value, Secret: secret}
+		}
+	}
+	return out, nil
+}
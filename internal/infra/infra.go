@@ -0,0 +1,263 @@
+// Package infra previews, deploys and destroys the app and controlplane
+// stacks through the Pulumi Automation API, so it can run where the pulumi
+// CLI is not installed (the CLI is downloaded on first use).
+//
+// With Options.Manifest the app stack is pinned to the image versions in a
+// release manifest, which is how the releaser rolls out a new release tag.
+//
+// With Options.PR the app stack is deployed as a preview environment for a
+// pull request: a separate, smaller "pr-<n>" stack whose endpoint is posted
+// to the pull request. The expire action destroys previews past their TTL.
+//
+// After up, smoke checks probe the stack's endpoints (see smokeChecks) and
+// fail the run with details when one does not respond.
+package infra
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optdestroy"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optpreview"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optrefresh"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optup"
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// Project is a Pulumi program in this repository.
+type Project struct {
+	// Name is how the project is selected on the command line and in the
+	// config file.
+	Name string
+	// Dir is the program directory relative to the repository root.
+	Dir string
+}
+
+// Projects are listed in deployment order: the app stack peers with the
+// controlplane VPC, so the controlplane goes first.
+var Projects = []Project{
+	{"controlplane", "infrastructure-controlplane"},
+	{"app", "infrastructure"},
+}
+
+// Options are the settings shared by every action.
+type Options struct {
+	Stack      string
+	ConfigFile string
+	Root       string
+	// Manifest pins the app stack to a release manifest's versions.
+	Manifest string
+	// VerifyKey is a base64 ed25519 public key; when set, the manifest's
+	// signed provenance must verify against it before anything is deployed.
+	VerifyKey string
+	// PR deploys the app stack as a preview environment for the pull request.
+	PR         int
+	PreviewTTL time.Duration
+	Smoke      bool
+	PulumiRoot string
+	// Output receives the Pulumi progress; nil means stdout.
+	Output io.Writer
+}
+
+func (o Options) output() io.Writer {
+	if o.Output == nil {
+		return os.Stdout
+	}
+	return o.Output
+}
+
+func installPulumi(ctx context.Context, o Options) (auto.PulumiCommand, error) {
+	pulumi, err := auto.InstallPulumiCommand(ctx, &auto.PulumiCommandOptions{Root: o.PulumiRoot})
+	if err != nil {
+		return nil, fmt.Errorf("error installing the pulumi CLI: %w", err)
+	}
+	return pulumi, nil
+}
+
+// RegisterFlags binds o to flags in fs, with their defaults.
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Stack, "stack", "dev", "stack name, used for every project")
+	fs.StringVar(&o.ConfigFile, "config", "", "JSON file with stack config to set before running")
+	fs.StringVar(&o.Root, "root", ".", "repository root containing the Pulumi programs")
+	fs.StringVar(&o.Manifest, "manifest", "", "release manifest whose versions the app stack is deployed with")
+	fs.StringVar(&o.VerifyKey, "verify-key", os.Getenv("RELEASER_VERIFY_KEY"), "base64 ed25519 key the manifest's provenance must be signed with (default $RELEASER_VERIFY_KEY)")
+	fs.IntVar(&o.PR, "pr", 0, "deploy the app stack as a preview environment for this pull request")
+	fs.DurationVar(&o.PreviewTTL, "preview-ttl", 72*time.Hour, "how long a preview environment lives before expire destroys it")
+	fs.BoolVar(&o.Smoke, "smoke", true, "run smoke checks against the stack outputs after up")
+	fs.StringVar(&o.PulumiRoot, "pulumi-root", "", "where to install the pulumi CLI (default ~/.pulumi/versions/<version>)")
+}
+
+// Usage is the argument synopsis after the flags.
+const Usage = "preview|up|refresh|destroy|expire app|controlplane|all"
+
+// Run performs action on the target project(s).
+func Run(ctx context.Context, o Options, action, target string) error {
+	switch action {
+	case "preview", "up", "refresh", "destroy", "expire":
+	default:
+		return fmt.Errorf("unknown action %q, expected preview, up, refresh, destroy or expire", action)
+	}
+
+	projects, err := selectProjects(target, action == "destroy")
+	if err != nil {
+		return err
+	}
+	stackName := o.Stack
+	if o.PR != 0 || action == "expire" {
+		if target != ManifestProject {
+			return fmt.Errorf("preview environments only cover the %s stack", ManifestProject)
+		}
+		if o.PR != 0 {
+			stackName = previewStackName(o.PR)
+		}
+	}
+
+	var config StackConfig
+	if o.ConfigFile != "" {
+		config, err = LoadStackConfig(o.ConfigFile)
+		if err != nil {
+			return fmt.Errorf("error loading config: %w", err)
+		}
+	}
+
+	var release *manifest.Manifest
+	if o.Manifest != "" {
+		release, err = manifest.Load(o.Manifest)
+		if err != nil {
+			return fmt.Errorf("error loading manifest: %w", err)
+		}
+		if o.VerifyKey != "" {
+			if err := verifyProvenance(o.Manifest, release.ReleaseVersion, o.VerifyKey); err != nil {
+				return fmt.Errorf("refusing to deploy %s: %w", release.ReleaseVersion, err)
+			}
+			log.Printf("Verified provenance of %s", release.ReleaseVersion)
+		}
+	}
+
+	pulumi, err := installPulumi(ctx, o)
+	if err != nil {
+		return err
+	}
+
+	if action == "expire" {
+		if err := expirePreviews(ctx, filepath.Join(o.Root, projects[0].Dir), pulumi, time.Now()); err != nil {
+			return fmt.Errorf("expire failed: %w", err)
+		}
+		return nil
+	}
+
+	for _, p := range projects {
+		log.Printf("%s %s (%s)", action, p.Name, stackName)
+		s, err := auto.UpsertStackLocalSource(ctx, stackName, filepath.Join(o.Root, p.Dir), auto.Pulumi(pulumi))
+		if err != nil {
+			return fmt.Errorf("error selecting stack for %s: %w", p.Name, err)
+		}
+		if config != nil {
+			values, err := config.For(p.Name)
+			if err != nil {
+				return err
+			}
+			if err := s.SetAllConfig(ctx, values); err != nil {
+				return fmt.Errorf("error setting config for %s: %w", p.Name, err)
+			}
+		}
+		if release != nil && p.Name == ManifestProject {
+			log.Printf("Deploying release %s", release.ReleaseVersion)
+			values, err := ManifestConfig(release)
+			if err != nil {
+				return fmt.Errorf("error in release manifest: %w", err)
+			}
+			if err := s.SetAllConfig(ctx, values); err != nil {
+				return fmt.Errorf("error setting release config for %s: %w", p.Name, err)
+			}
+		}
+		var preview auto.ConfigMap
+		if o.PR != 0 {
+			preview = PreviewConfig(time.Now(), o.PreviewTTL)
+			if err := s.SetAllConfig(ctx, preview); err != nil {
+				return fmt.Errorf("error setting preview config for %s: %w", p.Name, err)
+			}
+		}
+		outputs, err := run(ctx, s, action, o.output())
+		if err != nil {
+			return fmt.Errorf("%s %s failed: %w", action, p.Name, err)
+		}
+		if action == "up" && o.Smoke {
+			region, _ := s.GetConfig(ctx, "aws:region")
+			if err := runSmokeChecks(ctx, p.Name, region.Value, outputs); err != nil {
+				return fmt.Errorf("%s %s: %w", action, p.Name, err)
+			}
+		}
+		if o.PR == 0 {
+			continue
+		}
+		switch action {
+		case "up":
+			if err := commentPreview(o.PR, outputs, preview[previewExpiryKey].Value); err != nil {
+				log.Printf("Failed to post the preview endpoint: %v", err)
+			}
+		case "destroy":
+			if err := s.Workspace().RemoveStack(ctx, stackName); err != nil {
+				return fmt.Errorf("error removing %s: %w", stackName, err)
+			}
+		}
+	}
+	return nil
+}
+
+// selectProjects returns the projects for target in the order they should be
+// processed; destroy goes in reverse.
+func selectProjects(target string, reverse bool) ([]Project, error) {
+	var selected []Project
+	for _, p := range Projects {
+		if target == "all" || target == p.Name {
+			selected = append(selected, p)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("unknown stack %q, expected app, controlplane or all", target)
+	}
+	if reverse {
+		for i, j := 0, len(selected)-1; i < j; i, j = i+1, j-1 {
+			selected[i], selected[j] = selected[j], selected[i]
+		}
+	}
+	return selected, nil
+}
+
+// run performs action on s. For up it prints and returns the stack outputs.
+func run(ctx context.Context, s auto.Stack, action string, out io.Writer) (auto.OutputMap, error) {
+	switch action {
+	case "preview":
+		_, err := s.Preview(ctx, optpreview.ProgressStreams(out))
+		return nil, err
+	case "up":
+		res, err := s.Up(ctx, optup.ProgressStreams(out))
+		if err != nil {
+			return nil, err
+		}
+		for name, output := range res.Outputs {
+			if output.Secret {
+				fmt.Fprintf(out, "%s: [secret]\n", name)
+				continue
+			}
+			fmt.Fprintf(out, "%s: %v\n", name, output.Value)
+		}
+		return res.Outputs, nil
+	case "refresh":
+		_, err := s.Refresh(ctx, optrefresh.ProgressStreams(out))
+		return nil, err
+	case "destroy":
+		_, err := s.Destroy(ctx, optdestroy.ProgressStreams(out))
+		return nil, err
+	default:
+		return nil, fmt.Errorf("unknown action %q, expected preview, up, refresh or destroy", action)
+	}
+}
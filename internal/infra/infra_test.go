@@ -0,0 +1,262 @@
+package infra
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/velann21/todo-releaser/internal/manifest"
+	"github.com/velann21/todo-releaser/internal/secrets"
+)
+
+func TestSelectProjects(t *testing.T) {
+	tests := []struct {
+		target  string
+		reverse bool
+		want    []string
+		wantErr bool
+	}{
+		{"all", false, []string{"controlplane", "app"}, false},
+		{"all", true, []string{"app", "controlplane"}, false},
+		{"app", false, []string{"app"}, false},
+		{"controlplane", true, []string{"controlplane"}, false},
+		{"db", false, nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := selectProjects(tt.target, tt.reverse)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("selectProjects(%q, %v) error = %v, wantErr %v", tt.target, tt.reverse, err, tt.wantErr)
+			continue
+		}
+		var names []string
+		for _, p := range got {
+			names = append(names, p.Name)
+		}
+		if len(names) != len(tt.want) {
+			t.Errorf("selectProjects(%q, %v) = %v, want %v", tt.target, tt.reverse, names, tt.want)
+			continue
+		}
+		for i := range names {
+			if names[i] != tt.want[i] {
+				t.Errorf("selectProjects(%q, %v) = %v, want %v", tt.target, tt.reverse, names, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestStackConfigFor(t *testing.T) {
+	t.Setenv("TEST_DOCKER_PASSWORD", "hunter2")
+
+	var c StackConfig
+	err := json.Unmarshal([]byte(`{
+		"common": {"aws:region": "eu-west-1", "dockerUsername": "common"},
+		"app": {"dbUsername": "todo"},
+		"controlplane": {
+			"dockerUsername": "releaser",
+			"dockerPassword": {"env": "TEST_DOCKER_PASSWORD", "secret": true},
+			"githubToken": {"value": "ghp_x", "secret": true}
+		}
+	}`), &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := c.For("controlplane")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key    string
+		value  string
+		secret bool
+	}{
+		{"aws:region", "eu-west-1", false},
+		{"dockerUsername", "releaser", false},
+		{"dockerPassword", "hunter2", true},
+		{"githubToken", "ghp_x", true},
+	}
+	for _, tt := range tests {
+		v, ok := got[tt.key]
+		if !ok {
+			t.Errorf("For(controlplane) missing %s", tt.key)
+			continue
+		}
+		if v.Value != tt.value || v.Secret != tt.secret {
+			t.Errorf("For(controlplane)[%s] = %+v, want %q secret=%v", tt.key, v, tt.value, tt.secret)
+		}
+	}
+	if _, ok := got["dbUsername"]; ok {
+		t.Errorf("For(controlplane) includes app-only dbUsername")
+	}
+
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := secrets.Encrypt("s3cret", id.Recipient().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOPS_AGE_KEY", id.String())
+	c["app"]["dbPassword"] = ConfigValue{Value: enc}
+	got, err = c.For("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := got["dbPassword"]; v.Value != "s3cret" || !v.Secret {
+		t.Errorf("For(app)[dbPassword] = %+v, want decrypted secret", v)
+	}
+
+	c["app"]["missing"] = ConfigValue{Env: "TEST_UNSET_VARIABLE"}
+	if _, err := c.For("app"); err == nil {
+		t.Errorf("For(app) with an unset env reference succeeded")
+	}
+}
+
+func TestManifestConfig(t *testing.T) {
+	m := &manifest.Manifest{
+		ReleaseVersion: "v202552.0.0",
+		Services: []manifest.Service{
+			{Name: "todo-frontend", Image: "singaravelan21/todo-frontend", Version: "v1.1.0", DependsOn: []string{"todo-backend"}},
+			{Name: "todo-backend", Image: "singaravelan21/todo-backend", Version: "v1.2.0", DependsOn: []string{"todo-worker"},
+				Migration: &manifest.Migration{Command: []string{"python", "manage.py", "migrate"}}},
+			{Name: "todo-worker", Image: "singaravelan21/todo-worker", Version: "v0.1.0"},
+		},
+	}
+
+	got, err := ManifestConfig(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"deployStages":     `[["todo-backend"],["todo-frontend"]]`,
+		"deployMigrations": `{"todo-backend":{"image":"singaravelan21/todo-backend:v1.2.0","command":["python","manage.py","migrate"]}}`,
+		"releaseVersion":   "v202552.0.0",
+		"frontendImage":    "singaravelan21/todo-frontend",
+		"frontendVersion":  "v1.1.0",
+		"backendImage":     "singaravelan21/todo-backend",
+		"backendVersion":   "v1.2.0",
+	}
+	if len(got) != len(want) {
+		t.Errorf("ManifestConfig() = %v, want %v", got, want)
+	}
+	for key, value := range want {
+		if got[key].Value != value {
+			t.Errorf("ManifestConfig()[%s] = %q, want %q", key, got[key].Value, value)
+		}
+	}
+}
+
+func TestPreviewConfig(t *testing.T) {
+	now := time.Date(2025, 1, 6, 12, 0, 0, 0, time.UTC)
+	got := PreviewConfig(now, 72*time.Hour)
+	want := map[string]string{
+		"controlplaneStack":     "",
+		"wafEnabled":            "false",
+		"snapshotExportEnabled": "false",
+		"securityBaseline":      "false",
+		"ecrRepositories":       "",
+		"logRetentionDays":      "3",
+		previewExpiryKey:        "2025-01-09T12:00:00Z",
+	}
+	if len(got) != len(want) {
+		t.Errorf("PreviewConfig() = %v, want %v", got, want)
+	}
+	for key, value := range want {
+		if v, ok := got[key]; !ok || v.Value != value {
+			t.Errorf("PreviewConfig()[%s] = %q (set %v), want %q", key, v.Value, ok, value)
+		}
+	}
+}
+
+func TestPreviewExpired(t *testing.T) {
+	now := time.Date(2025, 1, 6, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		expiresAt string
+		want      bool
+	}{
+		{PreviewConfig(now.Add(-73*time.Hour), 72*time.Hour)[previewExpiryKey].Value, true},
+		{PreviewConfig(now, 72*time.Hour)[previewExpiryKey].Value, false},
+		{"", false},
+		{"next week", false},
+	}
+
+	for _, tt := range tests {
+		if got := previewExpired(tt.expiresAt, now); got != tt.want {
+			t.Errorf("previewExpired(%q) = %v, want %v", tt.expiresAt, got, tt.want)
+		}
+	}
+}
+
+func TestCheckAppHTTP(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{"ok", http.StatusOK, false},
+		{"bad gateway", http.StatusBadGateway, true},
+	}
+
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+		}))
+		outputs := auto.OutputMap{"albDnsName": {Value: strings.TrimPrefix(srv.URL, "http://")}}
+		err := checkAppHTTP(context.Background(), "", outputs)
+		srv.Close()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkAppHTTP() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRollout(t *testing.T) {
+	tests := []struct {
+		name        string
+		parallel    int
+		maxFailures int
+		failing     map[string]bool
+		wantStarted []string
+		wantErr     bool
+	}{
+		{"all succeed", 2, 0, nil, []string{"a", "b", "c"}, false},
+		{"abort after first failure", 1, 0, map[string]bool{"a": true}, []string{"a"}, true},
+		{"tolerate one failure", 1, 1, map[string]bool{"a": true}, []string{"a", "b", "c"}, true},
+		{"abort after second failure", 1, 1, map[string]bool{"a": true, "b": true}, []string{"a", "b"}, true},
+	}
+
+	for _, tt := range tests {
+		var mu sync.Mutex
+		var started []string
+		err := rollout(context.Background(), RolloutOptions{
+			Stacks:      []string{"a", "b", "c"},
+			Parallel:    tt.parallel,
+			MaxFailures: tt.maxFailures,
+		}, func(ctx context.Context, stack string) error {
+			mu.Lock()
+			started = append(started, stack)
+			mu.Unlock()
+			if tt.failing[stack] {
+				return errors.New("unhealthy")
+			}
+			return nil
+		})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: rollout() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if len(started) != len(tt.wantStarted) {
+			t.Errorf("%s: started %v, want %v", tt.name, started, tt.wantStarted)
+		}
+	}
+}
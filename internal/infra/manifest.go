@@ -0,0 +1,113 @@
+package infra
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/velann21/todo-releaser/internal/manifest"
+	"github.com/velann21/todo-releaser/internal/provenance"
+)
+
+// ManifestProject is the stack that runs the services in the release
+// manifest.
+const ManifestProject = "app"
+
+// manifestConfigPrefixes maps release manifest services to the app stack's
+// <prefix>Image and <prefix>Version config keys.
+var manifestConfigPrefixes = map[string]string{
+	"todo-frontend": "frontend",
+	"todo-backend":  "backend",
+	"todo-releaser": "releaser",
+}
+
+// ManifestConfig returns the app stack config that pins the images to the
+// versions in m, the deployStages the services are rolled out in (a JSON
+// list of stages, each a list of service names) and the deployMigrations run
+// before them (a JSON object by service name). Services the app stack does
+// not run are ignored.
+func ManifestConfig(m *manifest.Manifest) (auto.ConfigMap, error) {
+	out := auto.ConfigMap{
+		"releaseVersion": auto.ConfigValue{Value: m.ReleaseVersion},
+	}
+	migrations := map[string]manifest.Migration{}
+	for _, s := range m.Services {
+		prefix, ok := manifestConfigPrefixes[s.Name]
+		if !ok {
+			continue
+		}
+		img, version := s.Image, s.Version
+		if digest := s.Digest(); digest != "" {
+			// The playbook runs image:version; a tag next to a digest is
+			// ignored when pulling, so any will do.
+			img = strings.TrimSuffix(img, "@"+digest)
+			version = cmp.Or(version, "latest") + "@" + digest
+		}
+		out[prefix+"Image"] = auto.ConfigValue{Value: img}
+		out[prefix+"Version"] = auto.ConfigValue{Value: version}
+		if s.Migration != nil {
+			if len(s.Migration.Command) == 0 {
+				return nil, fmt.Errorf("service %s: migration has no command", s.Name)
+			}
+			mig := *s.Migration
+			if mig.Image == "" {
+				mig.Image = s.Ref()
+			}
+			migrations[s.Name] = mig
+		}
+	}
+	data, err := json.Marshal(migrations)
+	if err != nil {
+		return nil, err
+	}
+	out["deployMigrations"] = auto.ConfigValue{Value: string(data)}
+
+	stages, err := m.Stages()
+	if err != nil {
+		return nil, err
+	}
+	deployStages := [][]string{}
+	for _, stage := range stages {
+		var run []string
+		for _, name := range stage {
+			if _, ok := manifestConfigPrefixes[name]; ok {
+				run = append(run, name)
+			}
+		}
+		if len(run) > 0 {
+			deployStages = append(deployStages, run)
+		}
+	}
+	data, err = json.Marshal(deployStages)
+	if err != nil {
+		return nil, err
+	}
+	out["deployStages"] = auto.ConfigValue{Value: string(data)}
+	return out, nil
+}
+
+// verifyProvenance checks the attestation stored next to the manifest at
+// path was signed with verifyKey and covers the manifest as it is now.
+func verifyProvenance(path, version, verifyKey string) error {
+	pub, err := provenance.ParsePublicKey(verifyKey)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	env, err := provenance.Read(filepath.Join(filepath.Dir(path), provenance.Path(version)))
+	if err != nil {
+		return err
+	}
+	st, err := provenance.Verify(env, pub)
+	if err != nil {
+		return err
+	}
+	return st.VerifyManifest(manifest.File, data)
+}
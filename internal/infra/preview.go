@@ -0,0 +1,130 @@
+package infra
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optdestroy"
+)
+
+const (
+	// previewStackPrefix names the app stacks created for pull requests.
+	previewStackPrefix = "pr-"
+	// previewExpiryKey holds the RFC 3339 time after which the expire action
+	// destroys a preview stack.
+	previewExpiryKey = "previewExpiresAt"
+)
+
+func previewStackName(pr int) string {
+	return fmt.Sprintf("%s%d", previewStackPrefix, pr)
+}
+
+// PreviewConfig is the app stack config for a preview environment: no
+// controlplane peering (previews would all claim the same CIDR in its route
+// table), no WAF or snapshot exports, short log retention, and the expiry.
+// Previews also leave the account-wide security baseline and the shared ECR
+// repositories' lifecycle policies to the environment they are copied from:
+// destroying a preview would otherwise turn them off for everyone.
+func PreviewConfig(now time.Time, ttl time.Duration) auto.ConfigMap {
+	return auto.ConfigMap{
+		"controlplaneStack":     auto.ConfigValue{Value: ""},
+		"wafEnabled":            auto.ConfigValue{Value: "false"},
+		"snapshotExportEnabled": auto.ConfigValue{Value: "false"},
+		"securityBaseline":      auto.ConfigValue{Value: "false"},
+		"ecrRepositories":       auto.ConfigValue{Value: ""},
+		"logRetentionDays":      auto.ConfigValue{Value: "3"},
+		previewExpiryKey:        auto.ConfigValue{Value: now.Add(ttl).UTC().Format(time.RFC3339)},
+	}
+}
+
+// previewExpired reports whether a preview stack's expiry has passed. Stacks
+// without a valid expiry are never considered expired.
+func previewExpired(expiresAt string, now time.Time) bool {
+	t, err := time.Parse(time.RFC3339, expiresAt)
+	if err != nil {
+		return false
+	}
+	return now.After(t)
+}
+
+// expirePreviews destroys and removes every preview stack of the app project
+// whose TTL has passed. It is meant to run on a schedule, e.g. from CI.
+func expirePreviews(ctx context.Context, dir string, pulumi auto.PulumiCommand, now time.Time) error {
+	ws, err := auto.NewLocalWorkspace(ctx, auto.WorkDir(dir), auto.Pulumi(pulumi))
+	if err != nil {
+		return err
+	}
+	stacks, err := ws.ListStacks(ctx)
+	if err != nil {
+		return err
+	}
+	for _, summary := range stacks {
+		if !strings.HasPrefix(path.Base(summary.Name), previewStackPrefix) {
+			continue
+		}
+		s, err := auto.SelectStack(ctx, summary.Name, ws)
+		if err != nil {
+			return err
+		}
+		expiry, err := s.GetConfig(ctx, previewExpiryKey)
+		if err != nil || !previewExpired(expiry.Value, now) {
+			continue
+		}
+		log.Printf("destroy expired preview %s (expired %s)", summary.Name, expiry.Value)
+		if _, err := s.Destroy(ctx, optdestroy.ProgressStreams(os.Stdout)); err != nil {
+			return fmt.Errorf("destroy %s: %w", summary.Name, err)
+		}
+		if err := ws.RemoveStack(ctx, summary.Name); err != nil {
+			return fmt.Errorf("remove %s: %w", summary.Name, err)
+		}
+	}
+	return nil
+}
+
+// commentPreview posts the preview endpoint to the pull request. It needs
+// GITHUB_TOKEN and GITHUB_REPOSITORY ("owner/repo"), as set in GitHub
+// Actions, and is skipped without them.
+func commentPreview(pr int, outputs auto.OutputMap, expiresAt string) error {
+	token, repo := os.Getenv("GITHUB_TOKEN"), os.Getenv("GITHUB_REPOSITORY")
+	if token == "" || repo == "" {
+		log.Printf("GITHUB_TOKEN or GITHUB_REPOSITORY not set, not commenting on #%d", pr)
+		return nil
+	}
+
+	endpoint := fmt.Sprint(outputs["albDnsName"].Value)
+	body, err := json.Marshal(map[string]string{
+		"body": fmt.Sprintf("Preview environment `%s` is up at http://%s\n\nIt is destroyed after %s.",
+			previewStackName(pr), endpoint, expiresAt),
+	})
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("https://api.github.com/repos/%s/issues/%d/comments", repo, pr)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("commenting on #%d: github returned %d", pr, resp.StatusCode)
+	}
+	return nil
+}
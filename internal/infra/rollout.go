@@ -0,0 +1,124 @@
+package infra
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// RolloutOptions control Rollout.
+type RolloutOptions struct {
+	// Stacks are the app stacks (one per environment/host) to deploy to.
+	Stacks []string
+	// Parallel is how many stacks are deployed at once.
+	Parallel int
+	// MaxFailures is how many stacks may fail before no further stacks are
+	// started; stacks already deploying are left to finish.
+	MaxFailures int
+}
+
+// Rollout deploys the app stack with o to every stack in r, each verified
+// by the smoke checks, and stops starting new ones once more than
+// r.MaxFailures have failed.
+func Rollout(ctx context.Context, o Options, r RolloutOptions) error {
+	// Install the CLI once up front rather than racing to in every deploy.
+	if _, err := installPulumi(ctx, o); err != nil {
+		return err
+	}
+	return rollout(ctx, r, func(ctx context.Context, stack string) error {
+		so := o
+		so.Stack = stack
+		so.Output = newPrefixWriter(os.Stdout, "["+stack+"] ")
+		return Run(ctx, so, "up", ManifestProject)
+	})
+}
+
+func rollout(ctx context.Context, r RolloutOptions, deploy func(ctx context.Context, stack string) error) error {
+	if r.Parallel < 1 {
+		r.Parallel = 1
+	}
+
+	var (
+		mu       sync.Mutex
+		failed   []string
+		skipped  []string
+		wg       sync.WaitGroup
+		capacity = make(chan struct{}, r.Parallel)
+	)
+	for _, stack := range r.Stacks {
+		capacity <- struct{}{}
+
+		mu.Lock()
+		aborted := len(failed) > r.MaxFailures
+		if aborted {
+			skipped = append(skipped, stack)
+		}
+		mu.Unlock()
+		if aborted {
+			<-capacity
+			continue
+		}
+
+		wg.Add(1)
+		go func(stack string) {
+			defer wg.Done()
+			defer func() { <-capacity }()
+
+			log.Printf("Deploying %s", stack)
+			if err := deploy(ctx, stack); err != nil {
+				log.Printf("Deploying %s failed: %v", stack, err)
+				mu.Lock()
+				failed = append(failed, fmt.Sprintf("%s: %v", stack, err))
+				mu.Unlock()
+				return
+			}
+			log.Printf("Deployed %s", stack)
+		}(stack)
+	}
+	wg.Wait()
+
+	if len(failed) == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("%d of %d stacks failed:\n  %s", len(failed), len(r.Stacks), strings.Join(failed, "\n  "))
+	if len(skipped) > 0 {
+		msg += fmt.Sprintf("\nrollout aborted, not deployed: %s", strings.Join(skipped, ", "))
+	}
+	return fmt.Errorf("%s", msg)
+}
+
+// prefixWriter prefixes each line written to w, so parallel deploys stay
+// readable.
+type prefixWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    bytes.Buffer
+}
+
+func newPrefixWriter(w io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{w: w, prefix: prefix}
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.buf.Write(b)
+	for {
+		line, err := p.buf.ReadBytes('\n')
+		if err != nil {
+			// Keep the partial line for the next write.
+			p.buf.Write(line)
+			return len(b), nil
+		}
+		if _, err := fmt.Fprintf(p.w, "%s%s", p.prefix, line); err != nil {
+			return 0, err
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package infra
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+)
+
+// smokeTimeout bounds how long each check retries before it fails; the load
+// balancer and containers can take a moment to settle after an update.
+var smokeTimeout = 5 * time.Minute
+
+// smokeCheck verifies one endpoint of a freshly deployed stack.
+type smokeCheck struct {
+	Name string
+	Run  func(ctx context.Context, region string, outputs auto.OutputMap) error
+}
+
+// smokeChecks are run after up, per project.
+var smokeChecks = map[string][]smokeCheck{
+	"app": {
+		{"app responds on the load balancer", checkAppHTTP},
+		{"database reachable from the instance", checkDatabaseTCP},
+	},
+	"controlplane": {
+		{"releaser healthy", checkReleaserHealth},
+	},
+}
+
+// runSmokeChecks runs the project's checks against the stack outputs and
+// returns an error listing every check that failed.
+func runSmokeChecks(ctx context.Context, project, region string, outputs auto.OutputMap) error {
+	var failed []string
+	for _, check := range smokeChecks[project] {
+		log.Printf("smoke check: %s", check.Name)
+		if err := retry(ctx, smokeTimeout, func() error { return check.Run(ctx, region, outputs) }); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", check.Name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("smoke checks failed:\n  %s", strings.Join(failed, "\n  "))
+	}
+	return nil
+}
+
+// retry calls fn every 10 seconds until it succeeds or timeout passes, and
+// returns the last error.
+func retry(ctx context.Context, timeout time.Duration, fn func() error) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := fn()
+		if err == nil || errSkipped(err) || time.Now().After(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+// errSkip is returned by checks that cannot run against this stack, e.g. one
+// needing an instance ID on an auto scaling group.
+type errSkip string
+
+func (e errSkip) Error() string { return string(e) }
+
+func errSkipped(err error) bool {
+	if s, ok := err.(errSkip); ok {
+		log.Printf("skipped: %s", s)
+		return true
+	}
+	return false
+}
+
+func stringOutput(outputs auto.OutputMap, name string) string {
+	v, ok := outputs[name].Value.(string)
+	if !ok {
+		return ""
+	}
+	return v
+}
+
+func checkAppHTTP(ctx context.Context, region string, outputs auto.OutputMap) error {
+	host := stringOutput(outputs, "albDnsName")
+	if host == "" {
+		return fmt.Errorf("stack has no albDnsName output")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+host+"/", nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET http://%s/ returned %d", host, resp.StatusCode)
+	}
+	return nil
+}
+
+// checkDatabaseTCP connects to the database from the app instance, which is
+// the only place inside the VPC the checks can run from.
+func checkDatabaseTCP(ctx context.Context, region string, outputs auto.OutputMap) error {
+	endpoint := stringOutput(outputs, "dbEndpoint")
+	if endpoint == "" {
+		return fmt.Errorf("stack has no dbEndpoint output")
+	}
+	host, port, ok := strings.Cut(endpoint, ":")
+	if !ok {
+		port = "5432"
+	}
+	_, err := ssmRunShell(ctx, region, stringOutput(outputs, "instanceId"),
+		fmt.Sprintf("timeout 5 bash -c '</dev/tcp/%s/%s'", host, port))
+	return err
+}
+
+func checkReleaserHealth(ctx context.Context, region string, outputs auto.OutputMap) error {
+	port, ok := outputs["releaserPort"].Value.(float64)
+	if !ok {
+		return errSkip("stack has no releaserPort output")
+	}
+	_, err := ssmRunShell(ctx, region, stringOutput(outputs, "instanceId"),
+		fmt.Sprintf("curl -fsS http://localhost:%d/healthz", int(port)))
+	return err
+}
+
+// ssmRunShell runs command on the instance through SSM Run Command with the
+// aws CLI and returns its output. The command's output is included in the
+// error when it fails.
+func ssmRunShell(ctx context.Context, region, instanceID, command string) (string, error) {
+	if instanceID == "" {
+		return "", errSkip("stack has no instanceId output")
+	}
+	params, err := json.Marshal(map[string][]string{"commands": {command}})
+	if err != nil {
+		return "", err
+	}
+	commandID, err := awsCLI(ctx, region, "ssm", "send-command",
+		"--instance-ids", instanceID,
+		"--document-name", "AWS-RunShellScript",
+		"--parameters", string(params),
+		"--query", "Command.CommandId",
+		"--output", "text")
+	if err != nil {
+		return "", err
+	}
+	// wait exits non-zero when the command fails; the invocation below has
+	// the details either way.
+	awsCLI(ctx, region, "ssm", "wait", "command-executed",
+		"--command-id", commandID, "--instance-id", instanceID)
+
+	out, err := awsCLI(ctx, region, "ssm", "get-command-invocation",
+		"--command-id", commandID, "--instance-id", instanceID, "--output", "json")
+	if err != nil {
+		return "", err
+	}
+	var invocation struct {
+		Status                string
+		StandardOutputContent string
+		StandardErrorContent  string
+	}
+	if err := json.Unmarshal([]byte(out), &invocation); err != nil {
+		return "", err
+	}
+	if invocation.Status != "Success" {
+		return "", fmt.Errorf("%q on %s: %s: %s%s", command, instanceID, invocation.Status,
+			invocation.StandardOutputContent, invocation.StandardErrorContent)
+	}
+	return invocation.StandardOutputContent, nil
+}
+
+func awsCLI(ctx context.Context, region string, args ...string) (string, error) {
+	if region != "" {
+		args = append(args, "--region", region)
+	}
+	out, err := exec.CommandContext(ctx, "aws", args...).Output()
+	if err != nil {
+		if exit, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("aws %s: %v: %s", strings.Join(args[:2], " "), err, exit.Stderr)
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,68 @@
+package infra
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+)
+
+// StackOutputs returns the current outputs of project's stack, along with
+// the stack for reading its config.
+func StackOutputs(ctx context.Context, o Options, project string) (auto.OutputMap, auto.Stack, error) {
+	projects, err := selectProjects(project, false)
+	if err != nil {
+		return nil, auto.Stack{}, err
+	}
+	pulumi, err := installPulumi(ctx, o)
+	if err != nil {
+		return nil, auto.Stack{}, err
+	}
+	s, err := auto.SelectStackLocalSource(ctx, o.Stack, filepath.Join(o.Root, projects[0].Dir), auto.Pulumi(pulumi))
+	if err != nil {
+		return nil, auto.Stack{}, err
+	}
+	outputs, err := s.Outputs(ctx)
+	return outputs, s, err
+}
+
+// DBTunnel forwards localPort to the app database through an SSM port
+// forwarding session on the app instance, so the database stays private. It
+// returns when the session ends.
+func DBTunnel(ctx context.Context, o Options, localPort int) error {
+	outputs, s, err := StackOutputs(ctx, o, ManifestProject)
+	if err != nil {
+		return err
+	}
+	instanceID, endpoint := stringOutput(outputs, "instanceId"), stringOutput(outputs, "dbEndpoint")
+	if instanceID == "" || endpoint == "" {
+		return fmt.Errorf("stack %s has no instanceId or dbEndpoint output; run up first", o.Stack)
+	}
+	region, _ := s.GetConfig(ctx, "aws:region")
+
+	params, err := json.Marshal(map[string][]string{
+		"host":            {endpoint},
+		"portNumber":      {"5432"},
+		"localPortNumber": {strconv.Itoa(localPort)},
+	})
+	if err != nil {
+		return err
+	}
+	args := []string{"ssm", "start-session",
+		"--target", instanceID,
+		"--document-name", "AWS-StartPortForwardingSessionToRemoteHost",
+		"--parameters", string(params),
+	}
+	if region.Value != "" {
+		args = append(args, "--region", region.Value)
+	}
+	fmt.Printf("Forwarding localhost:%d to %s:5432, Ctrl-C to stop\n", localPort, endpoint)
+	cmd := exec.CommandContext(ctx, "aws", args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,400 @@
+// Package manifest reads and writes the release manifest, the list of
+// service images and versions that make up a release.
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/secrets"
+)
+
+// File is the manifest's path relative to the repository root.
+const File = "release_manifest.json"
+
+type Service struct {
+	Comment Comment `json:"//,omitempty"`
+	Name    string  `json:"name"`
+	// Image is the image repository, or for a digest-only service the
+	// repository pinned by digest, e.g. nginx@sha256:….
+	Image string `json:"image"`
+	// Version is the image tag. A digest-only service runs its digest
+	// whatever the tag, which then records the tag the digest was resolved
+	// from, and can be left out.
+	Version string `json:"version,omitempty"`
+	// Changelog is an optional URL for a version's release notes, with
+	// {version} in place of the tag.
+	Changelog string `json:"changelog,omitempty"`
+	// DependsOn names the services that must be rolled out, and healthy,
+	// before this one.
+	DependsOn []string `json:"depends_on,omitempty"`
+	// Migration is run before the service is switched to a new version.
+	Migration *Migration `json:"migration,omitempty"`
+	// CheckInterval is how often the daemon checks the service's registry
+	// for a new version, e.g. "5m" or "24h", if not at its usual interval.
+	CheckInterval string `json:"check_interval,omitempty"`
+	// Platforms marks a multi-arch service: the platforms, e.g.
+	// linux/amd64 and linux/arm64, each new version must be published for.
+	Platforms []string `json:"platforms,omitempty"`
+	// Runtime is how the service's container is run, versioned with the
+	// release rather than set on the hosts.
+	Runtime *Runtime `json:"runtime,omitempty"`
+	// Config are the service's config bundles, released with it.
+	Config []ConfigBundle `json:"config,omitempty"`
+	// StatusComponents are the status page components a rollout of the
+	// service affects: Statuspage.io component IDs, or the component names
+	// of an internal status service.
+	StatusComponents []string `json:"status_components,omitempty"`
+	// Owners are the teams, @org/team, and users, @login, one of whom must
+	// approve the service's update pull requests. Without them the owners
+	// come from CODEOWNERS.
+	Owners []string `json:"owners,omitempty"`
+	// LastBump is written by the releaser whenever it changes Version.
+	LastBump *Bump `json:"last_bump,omitempty"`
+}
+
+// Bump records a change of a service's version.
+type Bump struct {
+	At   time.Time `json:"at"`
+	From string    `json:"from"`
+	// FromDigest is the previous digest of a digest-only service.
+	FromDigest string `json:"from_digest,omitempty"`
+	// Run identifies the releaser run that made the change.
+	Run string `json:"run,omitempty"`
+}
+
+// Migration is a one-off container run, with the service's environment,
+// before the service is rolled out. A failure aborts the rollout.
+type Migration struct {
+	Comment Comment `json:"//,omitempty"`
+	// Image defaults to the service's image at the new version.
+	Image   string   `json:"image,omitempty"`
+	Command []string `json:"command"`
+	// Verify, when set, runs after Command and must also succeed, e.g.
+	// ["python", "manage.py", "migrate", "--check"].
+	Verify []string `json:"verify,omitempty"`
+}
+
+// Runtime is the container settings deploy agents render into the compose
+// project with each release, overriding those in the host's compose file.
+type Runtime struct {
+	Healthcheck *Healthcheck `json:"healthcheck,omitempty"`
+	// Restart is the restart policy: no, always, on-failure, on-failure:N
+	// or unless-stopped.
+	Restart string `json:"restart,omitempty"`
+	// Limits caps the container's resources.
+	Limits  *Limits  `json:"limits,omitempty"`
+	Logging *Logging `json:"logging,omitempty"`
+}
+
+// ConfigBundle is a file of a service's configuration kept in the
+// repository with the manifest, such as an env file. It is versioned by its
+// content hash, which the releaser records with each release, so a change
+// of the file alone makes a release, and deploy agents render the file as
+// the release they deploy tagged it, so a rollback restores it with the
+// images. Bundles are served to agents like the manifest: keep secrets out
+// of them.
+type ConfigBundle struct {
+	// Path is the file relative to the repository root, e.g.
+	// config/todo-backend.env.
+	Path string `json:"path"`
+	// Target is where the container reads the file, e.g.
+	// /etc/todo/config.yaml. Without one the file is an env file, setting
+	// the container's environment.
+	Target string `json:"target,omitempty"`
+	// Hash is the released content's HashConfig, written by the releaser.
+	Hash string `json:"hash,omitempty"`
+}
+
+// Validate checks b for a path outside the repository or a relative
+// target.
+func (b ConfigBundle) Validate() error {
+	if !fs.ValidPath(b.Path) || b.Path == "." {
+		return fmt.Errorf("config %q is not a path within the repository", b.Path)
+	}
+	if b.Target != "" && !path.IsAbs(b.Target) {
+		return fmt.Errorf("config %s: target %q is not an absolute path", b.Path, b.Target)
+	}
+	return nil
+}
+
+// HashConfig is the hash config bundles are versioned by, sha256:….
+func HashConfig(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Healthcheck is a container healthcheck. Durations are Go durations such
+// as "30s", which compose reads alike.
+type Healthcheck struct {
+	// Test is the check, e.g. ["CMD", "curl", "-f", "http://localhost/health"].
+	Test        []string `json:"test"`
+	Interval    string   `json:"interval,omitempty"`
+	Timeout     string   `json:"timeout,omitempty"`
+	StartPeriod string   `json:"start_period,omitempty"`
+	Retries     int      `json:"retries,omitempty"`
+}
+
+// Limits are resource limits, in compose's notation.
+type Limits struct {
+	// CPUs is a number of CPUs, e.g. "0.5".
+	CPUs string `json:"cpus,omitempty" yaml:"cpus,omitempty"`
+	// Memory is a byte amount, e.g. "512M".
+	Memory string `json:"memory,omitempty" yaml:"memory,omitempty"`
+	Pids   int    `json:"pids,omitempty" yaml:"pids,omitempty"`
+}
+
+// Logging is the container's logging driver and its options.
+type Logging struct {
+	Driver  string            `json:"driver" yaml:"driver"`
+	Options map[string]string `json:"options,omitempty" yaml:"options,omitempty"`
+}
+
+// Validate checks r for settings compose would refuse.
+func (r *Runtime) Validate() error {
+	if h := r.Healthcheck; h != nil {
+		if len(h.Test) == 0 {
+			return fmt.Errorf("healthcheck has no test")
+		}
+		for name, d := range map[string]string{"interval": h.Interval, "timeout": h.Timeout, "start_period": h.StartPeriod} {
+			if d == "" {
+				continue
+			}
+			if v, err := time.ParseDuration(d); err != nil || v <= 0 {
+				return fmt.Errorf("healthcheck %s %q is not a positive duration", name, d)
+			}
+		}
+		if h.Retries < 0 {
+			return fmt.Errorf("healthcheck retries %d is negative", h.Retries)
+		}
+	}
+	switch policy, count, _ := strings.Cut(r.Restart, ":"); {
+	case policy == "on-failure" && count != "":
+		if n, err := strconv.Atoi(count); err != nil || n < 1 {
+			return fmt.Errorf("restart %q: the retry count must be a positive number", r.Restart)
+		}
+	case r.Restart == "", r.Restart == "no", r.Restart == "always", r.Restart == "on-failure", r.Restart == "unless-stopped":
+	default:
+		return fmt.Errorf("restart %q is not no, always, on-failure[:N] or unless-stopped", r.Restart)
+	}
+	if l := r.Limits; l != nil && l.CPUs != "" {
+		if v, err := strconv.ParseFloat(l.CPUs, 64); err != nil || v <= 0 {
+			return fmt.Errorf("limits cpus %q is not a positive number", l.CPUs)
+		}
+	}
+	if l := r.Limits; l != nil && l.Memory != "" && !memoryAmount.MatchString(l.Memory) {
+		return fmt.Errorf("limits memory %q is not a byte amount like 512M", l.Memory)
+	}
+	if r.Logging != nil && r.Logging.Driver == "" {
+		return fmt.Errorf("logging has no driver")
+	}
+	return nil
+}
+
+var memoryAmount = regexp.MustCompile(`^(?i)[0-9]+(\.[0-9]+)?\s*([kmgt]i?b?|b)?$`)
+
+// Manifest is the release manifest. Being JSON it has no comments, so notes
+// go in "//" keys, which the manifest, each service and each migration can
+// have, holding a string or a list of strings (one per line). They are kept
+// as written whenever the manifest is saved:
+//
+//	{
+//	  "//": "Bumped by the releaser; pin a version by hand and it stays put.",
+//	  "release_version": "v202510.0.3",
+//	  "services": [
+//	    {
+//	      "//": ["Held at 1.1 until the v2 API ships.", "See #412."],
+//	      "name": "todo-backend",
+//	      ...
+type Manifest struct {
+	Comment        Comment   `json:"//,omitempty"`
+	ReleaseVersion string    `json:"release_version"`
+	Services       []Service `json:"services"`
+	// Secrets holds sensitive settings such as webhook URLs, normally
+	// encrypted with age (see package secrets) so the manifest can be
+	// public. They are saved back exactly as loaded.
+	Secrets map[string]string `json:"secrets,omitempty"`
+
+	// decrypted holds the plaintext of Secrets.
+	decrypted map[string]string
+}
+
+func Load(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse decodes a manifest, e.g. one read from an earlier git revision, and
+// decrypts its secrets.
+func Parse(data []byte) (*Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	m.decrypted = make(map[string]string, len(m.Secrets))
+	for name, value := range m.Secrets {
+		plaintext, err := secrets.Decrypt(value)
+		if err != nil {
+			return nil, fmt.Errorf("error decrypting secret %s: %w", name, err)
+		}
+		m.decrypted[name] = plaintext
+	}
+	return &m, nil
+}
+
+func Save(path string, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// SetVersion moves the service at index i to version, recording in its
+// LastBump the version it moved from, when and by which run. It does
+// nothing if the service is already at version.
+func (m *Manifest) SetVersion(i int, version, run string, at time.Time) {
+	s := &m.Services[i]
+	if s.Version == version {
+		return
+	}
+	s.LastBump = &Bump{At: at.UTC().Truncate(time.Second), From: s.Version, Run: run}
+	s.Version = version
+}
+
+// SetDigest pins the digest-only service at index i to digest, which tag
+// points to, recording the move like SetVersion.
+func (m *Manifest) SetDigest(i int, tag, digest, run string, at time.Time) {
+	s := &m.Services[i]
+	name, old, _ := strings.Cut(s.Image, "@")
+	if old == digest && s.Version == tag {
+		return
+	}
+	s.LastBump = &Bump{At: at.UTC().Truncate(time.Second), From: s.Version, FromDigest: old, Run: run}
+	s.Image = name + "@" + digest
+	s.Version = tag
+}
+
+// Digest is the digest a digest-only service's Image is pinned to, or ""
+// for a service that runs its tag.
+func (s Service) Digest() string {
+	_, digest, _ := strings.Cut(s.Image, "@")
+	return digest
+}
+
+// Ref is the reference of the image the service runs: Image:Version, or
+// for a digest-only service its Image with Version, when set, as the tag,
+// e.g. nginx:1.27.3@sha256:…, which is still pulled by digest.
+func (s Service) Ref() string {
+	name, digest, ok := strings.Cut(s.Image, "@")
+	switch {
+	case !ok:
+		return s.Image + ":" + s.Version
+	case s.Version == "":
+		return s.Image
+	default:
+		return name + ":" + s.Version + "@" + digest
+	}
+}
+
+// Comment is the text of a "//" key, one entry per line.
+type Comment []string
+
+// UnmarshalJSON accepts a string or a list of strings.
+func (c *Comment) UnmarshalJSON(data []byte) error {
+	var line string
+	if err := json.Unmarshal(data, &line); err == nil {
+		*c = Comment{line}
+		return nil
+	}
+	var lines []string
+	if err := json.Unmarshal(data, &lines); err != nil {
+		return fmt.Errorf("a \"//\" comment must be a string or a list of strings")
+	}
+	*c = lines
+	return nil
+}
+
+// MarshalJSON writes a one-line comment back as a string.
+func (c Comment) MarshalJSON() ([]byte, error) {
+	if len(c) == 1 {
+		return json.Marshal(c[0])
+	}
+	return json.Marshal([]string(c))
+}
+
+// Service returns the service called name.
+func (m *Manifest) Service(name string) (Service, bool) {
+	for _, s := range m.Services {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return Service{}, false
+}
+
+// Secret returns the decrypted value of the named secret, or "" when unset.
+func (m *Manifest) Secret(name string) string {
+	return m.decrypted[name]
+}
+
+// Stages orders the services for a rollout: every service comes in a later
+// stage than the services it depends on, and services in the same stage can
+// be rolled out together. Within a stage services keep their manifest order.
+func (m *Manifest) Stages() ([][]string, error) {
+	remaining := map[string][]string{}
+	for _, s := range m.Services {
+		remaining[s.Name] = s.DependsOn
+	}
+	for _, s := range m.Services {
+		for _, dep := range s.DependsOn {
+			if _, ok := remaining[dep]; !ok {
+				return nil, fmt.Errorf("service %s depends on unknown service %s", s.Name, dep)
+			}
+		}
+	}
+
+	done := map[string]bool{}
+	var stages [][]string
+	for len(done) < len(m.Services) {
+		var stage []string
+		for _, s := range m.Services {
+			if done[s.Name] {
+				continue
+			}
+			ready := true
+			for _, dep := range remaining[s.Name] {
+				ready = ready && done[dep]
+			}
+			if ready {
+				stage = append(stage, s.Name)
+			}
+		}
+		if len(stage) == 0 {
+			var cycle []string
+			for _, s := range m.Services {
+				if !done[s.Name] {
+					cycle = append(cycle, s.Name)
+				}
+			}
+			return nil, fmt.Errorf("services %s have circular dependencies", strings.Join(cycle, ", "))
+		}
+		for _, name := range stage {
+			done[name] = true
+		}
+		stages = append(stages, stage)
+	}
+	return stages, nil
+}
@@ -0,0 +1,164 @@
+package manifest
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStages(t *testing.T) {
+	tests := []struct {
+		name     string
+		services []Service
+		want     [][]string
+		wantErr  bool
+	}{
+		{"no dependencies", []Service{
+			{Name: "todo-frontend"}, {Name: "todo-backend"},
+		}, [][]string{{"todo-frontend", "todo-backend"}}, false},
+		{"chain", []Service{
+			{Name: "todo-frontend", DependsOn: []string{"todo-backend"}},
+			{Name: "todo-backend", DependsOn: []string{"migrate-db"}},
+			{Name: "migrate-db"},
+		}, [][]string{{"migrate-db"}, {"todo-backend"}, {"todo-frontend"}}, false},
+		{"diamond", []Service{
+			{Name: "todo-frontend", DependsOn: []string{"todo-backend", "todo-auth-server"}},
+			{Name: "todo-backend", DependsOn: []string{"migrate-db"}},
+			{Name: "todo-auth-server", DependsOn: []string{"migrate-db"}},
+			{Name: "migrate-db"},
+			{Name: "todo-releaser"},
+		}, [][]string{{"migrate-db", "todo-releaser"}, {"todo-backend", "todo-auth-server"}, {"todo-frontend"}}, false},
+		{"unknown dependency", []Service{
+			{Name: "todo-backend", DependsOn: []string{"redis"}},
+		}, nil, true},
+		{"cycle", []Service{
+			{Name: "todo-frontend", DependsOn: []string{"todo-backend"}},
+			{Name: "todo-backend", DependsOn: []string{"todo-frontend"}},
+		}, nil, true},
+	}
+
+	for _, tt := range tests {
+		m := &Manifest{Services: tt.services}
+		got, err := m.Stages()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Stages() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Stages() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSaveKeepsComments(t *testing.T) {
+	in := `{
+  "//": "Edited by hand and by the releaser.",
+  "release_version": "v202510.0.3",
+  "services": [
+    {
+      "//": [
+        "Held at 1.1 until the v2 API ships.",
+        "See #412."
+      ],
+      "name": "todo-backend",
+      "image": "singaravelan21/todo-backend",
+      "version": "v1.1.0",
+      "migration": {
+        "//": "Idempotent.",
+        "command": [
+          "migrate"
+        ]
+      }
+    }
+  ]
+}`
+	m, err := Parse([]byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), File)
+	if err := Save(path, m); err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != in {
+		t.Errorf("saved manifest:\n%s\nwant:\n%s", out, in)
+	}
+
+	if _, err := Parse([]byte(`{"//": 1}`)); err == nil {
+		t.Error("Parse accepted a comment that is not text")
+	}
+}
+
+func TestSetVersion(t *testing.T) {
+	at := time.Date(2025, 3, 4, 9, 30, 15, 500, time.FixedZone("CET", 3600))
+	m := &Manifest{Services: []Service{{Name: "todo-backend", Version: "v1.1.0"}}}
+
+	m.SetVersion(0, "v1.1.0", "run-1", at)
+	if m.Services[0].LastBump != nil {
+		t.Errorf("SetVersion to the same version recorded %+v", m.Services[0].LastBump)
+	}
+
+	m.SetVersion(0, "v1.2.0", "run-2", at)
+	want := &Bump{At: time.Date(2025, 3, 4, 8, 30, 15, 0, time.UTC), From: "v1.1.0", Run: "run-2"}
+	if s := m.Services[0]; s.Version != "v1.2.0" || !reflect.DeepEqual(s.LastBump, want) {
+		t.Errorf("SetVersion = %s %+v, want v1.2.0 %+v", s.Version, s.LastBump, want)
+	}
+}
+
+func TestServiceRef(t *testing.T) {
+	tests := []struct {
+		service    Service
+		ref        string
+		wantDigest string
+	}{
+		{Service{Image: "singaravelan21/todo-backend", Version: "v1.1.0"}, "singaravelan21/todo-backend:v1.1.0", ""},
+		{Service{Image: "redis@sha256:0123abcd"}, "redis@sha256:0123abcd", "sha256:0123abcd"},
+		{Service{Image: "registry.corp:5000/redis@sha256:0123abcd", Version: "7.4.1"}, "registry.corp:5000/redis:7.4.1@sha256:0123abcd", "sha256:0123abcd"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.service.Ref(); got != tt.ref {
+			t.Errorf("Ref() of %+v = %q, want %q", tt.service, got, tt.ref)
+		}
+		if got := tt.service.Digest(); got != tt.wantDigest {
+			t.Errorf("Digest() of %+v = %q, want %q", tt.service, got, tt.wantDigest)
+		}
+	}
+}
+
+func TestSetDigest(t *testing.T) {
+	at := time.Date(2025, 3, 4, 8, 30, 0, 0, time.UTC)
+	m := &Manifest{Services: []Service{{Name: "redis", Image: "redis@sha256:0123"}}}
+
+	m.SetDigest(0, "7.4.2", "sha256:4567", "run-1", at)
+	want := Service{Name: "redis", Image: "redis@sha256:4567", Version: "7.4.2",
+		LastBump: &Bump{At: at, FromDigest: "sha256:0123", Run: "run-1"}}
+	if !reflect.DeepEqual(m.Services[0], want) {
+		t.Errorf("SetDigest = %+v, want %+v", m.Services[0], want)
+	}
+}
+
+func TestConfigBundleValidate(t *testing.T) {
+	tests := []struct {
+		bundle  ConfigBundle
+		wantErr bool
+	}{
+		{ConfigBundle{Path: "config/todo-backend.env"}, false},
+		{ConfigBundle{Path: "config/nginx.conf", Target: "/etc/nginx/nginx.conf"}, false},
+		{ConfigBundle{Path: "../secrets.env"}, true},
+		{ConfigBundle{Path: "/etc/passwd"}, true},
+		{ConfigBundle{Path: ""}, true},
+		{ConfigBundle{Path: "config/nginx.conf", Target: "nginx.conf"}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.bundle.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("Validate() of %+v = %v, want error %v", tt.bundle, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package pki
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLoadOrCreateCA(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := LoadOrCreateCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := LoadOrCreateCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.Hash() != again.Hash() {
+		t.Errorf("reloaded CA hash = %s, want %s", again.Hash(), ca.Hash())
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca, err := LoadOrCreateCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := LoadOrCreateCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConf, err := ca.ServerTLSConfig([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, AgentName(r.TLS))
+	}))
+	srv.TLS = serverConf
+	srv.StartTLS()
+	defer srv.Close()
+
+	keyPEM, csrPEM, err := NewCSR("ignored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, err := ca.SignClient(csrPEM, "todo-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConf, err := ClientTLSConfig(certPEM, keyPEM, ca.CertPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCert, err := other.SignClient(csrPEM, "intruder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherConf, err := ClientTLSConfig(otherCert, keyPEM, ca.CertPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		conf    *tls.Config
+		want    string
+		wantErr bool
+	}{
+		{name: "pinned CA", conf: PinnedTLSConfig(ca.Hash()), want: ""},
+		{name: "wrong pin", conf: PinnedTLSConfig(other.Hash()), wantErr: true},
+		{name: "client certificate", conf: clientConf, want: "todo-server"},
+		{name: "certificate from another CA", conf: otherConf, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: tt.conf}}
+			resp, err := client.Get(srv.URL)
+			if tt.wantErr {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var got string
+			fmt.Fscan(resp.Body, &got)
+			if got != tt.want {
+				t.Errorf("AgentName = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
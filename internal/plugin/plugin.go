@@ -0,0 +1,142 @@
+// Package plugin runs releaser plugins: executables that add registry
+// backends, notifiers and deploy hooks without changing the releaser.
+//
+// A plugin is called once per request. It reads a single JSON-RPC 2.0
+// request from stdin and writes the response to stdout; anything it prints
+// to stderr is passed through to the releaser's log. Every plugin answers
+// "describe" with an Info saying what it provides, and then the methods for
+// those capabilities:
+//
+//	latest_tag  {"image": ref, "constraint": "~1.1.0"} -> {"tag": "v1.1.3"}
+//	tag_digest  {"image": ref, "tag": "v1.2.0"} -> {"digest": "sha256:…"}
+//	image_labels {"image": ref, "tag": "v1.2.0"} -> {"labels": {"org.opencontainers.image.revision": …}}
+//	image_size  {"image": ref, "tag": "v1.2.0"} -> {"size": 52428800}
+//	image_platforms {"image": ref, "tag": "v1.2.0"} -> {"platforms": ["linux/amd64", "linux/arm64/v8"]}
+//	notify      {"text": "...", "version": "v202502.1.0", "locale": "en"} -> {}
+//	deploy      {"version": "v202502.1.0", "manifest": {…}, "idempotency_key": "…"} -> {}
+//
+// The latest_tag constraint is optional: a semver range the tag must be in.
+//
+// Errors are returned as JSON-RPC errors, or by exiting non-zero.
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Timeout bounds a single plugin call.
+var Timeout = 2 * time.Minute
+
+// Info is a plugin's answer to describe.
+type Info struct {
+	Name string `json:"name"`
+	// Registries are the registry hosts, e.g. registry.corp:5000, whose
+	// tags and digests the plugin resolves.
+	Registries []string `json:"registries,omitempty"`
+	// Labels is set when the plugin also answers image_labels for its
+	// registries.
+	Labels bool `json:"labels,omitempty"`
+	// Sizes is set when it answers image_size, the compressed size of an
+	// image in bytes.
+	Sizes bool `json:"sizes,omitempty"`
+	// Platforms is set when it answers image_platforms, the os/arch[/variant]
+	// platforms a tag is published for.
+	Platforms  bool `json:"platforms,omitempty"`
+	Notifier   bool `json:"notifier,omitempty"`
+	DeployHook bool `json:"deploy_hook,omitempty"`
+}
+
+// Plugin is a described plugin executable.
+type Plugin struct {
+	Path string
+	Info Info
+}
+
+// Load describes the plugin at path.
+func Load(ctx context.Context, path string) (*Plugin, error) {
+	p := &Plugin{Path: path}
+	if err := p.Call(ctx, "describe", struct{}{}, &p.Info); err != nil {
+		return nil, err
+	}
+	if p.Info.Name == "" {
+		p.Info.Name = filepath.Base(path)
+	}
+	return p, nil
+}
+
+// Handles reports whether p resolves images on registry.
+func (p *Plugin) Handles(registry string) bool {
+	return slices.Contains(p.Info.Registries, registry)
+}
+
+type request struct {
+	JSONRPC string `json:"jsonrpc"`
+	ID      int    `json:"id"`
+	Method  string `json:"method"`
+	Params  any    `json:"params"`
+}
+
+type response struct {
+	Result json.RawMessage `json:"result"`
+	Error  *Error          `json:"error"`
+}
+
+// Error is a JSON-RPC error returned by a plugin.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+// Call runs method with params and decodes the result into result, which
+// may be nil.
+func (p *Plugin) Call(ctx context.Context, method string, params, result any) error {
+	in, err := json.Marshal(request{JSONRPC: "2.0", ID: 1, Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.Path)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("plugin %s %s: %w", p.name(), method, err)
+	}
+
+	var resp response
+	if err := json.Unmarshal(out.Bytes(), &resp); err != nil {
+		return fmt.Errorf("plugin %s %s: invalid response: %w", p.name(), method, err)
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("plugin %s %s: %w", p.name(), method, resp.Error)
+	}
+	if result == nil || len(resp.Result) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(resp.Result, result); err != nil {
+		return fmt.Errorf("plugin %s %s: invalid result: %w", p.name(), method, err)
+	}
+	return nil
+}
+
+func (p *Plugin) name() string {
+	if p.Info.Name != "" {
+		return p.Info.Name
+	}
+	return filepath.Base(p.Path)
+}
@@ -0,0 +1,64 @@
+package plugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writePlugin writes a shell plugin that answers every request with body.
+func writePlugin(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "plugin")
+	script := "#!/bin/sh\ncat >/dev/null\necho '" + body + "'\n"
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	path := writePlugin(t, `{"jsonrpc": "2.0", "id": 1, "result": {"name": "corp-registry", "registries": ["registry.corp:5000"]}}`)
+	p, err := Load(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Info.Name != "corp-registry" || !p.Handles("registry.corp:5000") || p.Handles("ghcr.io") {
+		t.Errorf("Load() = %+v", p.Info)
+	}
+}
+
+func TestCall(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    string
+		wantErr string
+	}{
+		{"result", `{"jsonrpc": "2.0", "id": 1, "result": {"tag": "v1.2.0"}}`, "v1.2.0", ""},
+		{"rpc error", `{"jsonrpc": "2.0", "id": 1, "error": {"code": -32601, "message": "method not found"}}`, "", "method not found"},
+		{"not json", `tag v1.2.0`, "", "invalid response"},
+	}
+
+	for _, tt := range tests {
+		p := &Plugin{Path: writePlugin(t, tt.body)}
+		var result struct {
+			Tag string `json:"tag"`
+		}
+		err := p.Call(context.Background(), "latest_tag", map[string]string{"image": "registry.corp:5000/team/api"}, &result)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: Call() error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if result.Tag != tt.want {
+			t.Errorf("%s: tag = %q, want %q", tt.name, result.Tag, tt.want)
+		}
+	}
+}
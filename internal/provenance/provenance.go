@@ -0,0 +1,302 @@
+// Package provenance creates and verifies signed SLSA provenance for
+// releases: an in-toto statement naming the release manifest and the image
+// digests it pins, wrapped in a DSSE envelope signed with ed25519.
+package provenance
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	PayloadType   = "application/vnd.in-toto+json"
+	StatementType = "https://in-toto.io/Statement/v1"
+	PredicateType = "https://slsa.dev/provenance/v1"
+	BuildType     = "https://github.com/velann21/todo-releaser/release/v1"
+	BuilderID     = "https://github.com/velann21/todo-releaser/cmd/releaser"
+)
+
+// Dir holds the attestations, one per release, next to the manifest.
+const Dir = "attestations"
+
+// Path is where the attestation for version is stored, relative to the
+// repository root.
+func Path(version string) string {
+	return filepath.Join(Dir, version+".intoto.json")
+}
+
+type Subject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type ResourceDescriptor struct {
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest"`
+}
+
+type Statement struct {
+	Type          string    `json:"_type"`
+	Subject       []Subject `json:"subject"`
+	PredicateType string    `json:"predicateType"`
+	Predicate     Predicate `json:"predicate"`
+}
+
+type Predicate struct {
+	BuildDefinition struct {
+		BuildType            string               `json:"buildType"`
+		ExternalParameters   map[string]string    `json:"externalParameters"`
+		ResolvedDependencies []ResourceDescriptor `json:"resolvedDependencies"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID string `json:"id"`
+		} `json:"builder"`
+		Metadata struct {
+			StartedOn time.Time `json:"startedOn"`
+		} `json:"metadata"`
+	} `json:"runDetails"`
+}
+
+// Release describes what a release was made from.
+type Release struct {
+	Version string
+	// ManifestName and Manifest are the manifest file's path and content.
+	ManifestName string
+	Manifest     []byte
+	// SourceURI and Commit identify the repository state released.
+	SourceURI string
+	Commit    string
+	// Images are the pinned images, named "<image>:<tag>", with their
+	// digests ("sha256:...").
+	Images map[string]string
+	Time   time.Time
+}
+
+// New returns the provenance statement for r.
+func New(r Release) (*Statement, error) {
+	st := &Statement{
+		Type:          StatementType,
+		PredicateType: PredicateType,
+		Subject: []Subject{{
+			Name:   r.ManifestName,
+			Digest: map[string]string{"sha256": sha256Hex(r.Manifest)},
+		}},
+	}
+	for name, digest := range r.Images {
+		algo, hash, ok := strings.Cut(digest, ":")
+		if !ok {
+			return nil, fmt.Errorf("image %s: malformed digest %q", name, digest)
+		}
+		st.Subject = append(st.Subject, Subject{Name: name, Digest: map[string]string{algo: hash}})
+	}
+
+	def := &st.Predicate.BuildDefinition
+	def.BuildType = BuildType
+	def.ExternalParameters = map[string]string{
+		"manifest":       r.ManifestName,
+		"releaseVersion": r.Version,
+	}
+	def.ResolvedDependencies = []ResourceDescriptor{{
+		URI:    r.SourceURI,
+		Digest: map[string]string{"gitCommit": r.Commit},
+	}}
+	st.Predicate.RunDetails.Builder.ID = BuilderID
+	st.Predicate.RunDetails.Metadata.StartedOn = r.Time.UTC()
+	return st, nil
+}
+
+// VerifyManifest checks that data is the manifest st was issued for.
+func (st *Statement) VerifyManifest(name string, data []byte) error {
+	for _, s := range st.Subject {
+		if s.Name == name {
+			if s.Digest["sha256"] != sha256Hex(data) {
+				return fmt.Errorf("%s does not match its attestation", name)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("attestation does not cover %s", name)
+}
+
+// Envelope is a DSSE envelope.
+type Envelope struct {
+	PayloadType string      `json:"payloadType"`
+	Payload     string      `json:"payload"`
+	Signatures  []Signature `json:"signatures"`
+}
+
+type Signature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+// Sign wraps st in an envelope signed with key.
+func Sign(st *Statement, key ed25519.PrivateKey) (*Envelope, error) {
+	payload, err := json.Marshal(st)
+	if err != nil {
+		return nil, err
+	}
+	sig := ed25519.Sign(key, pae(PayloadType, payload))
+	return &Envelope{
+		PayloadType: PayloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures: []Signature{{
+			KeyID: KeyID(key.Public().(ed25519.PublicKey)),
+			Sig:   base64.StdEncoding.EncodeToString(sig),
+		}},
+	}, nil
+}
+
+// Verify checks env is signed by pub and returns the statement it carries.
+func Verify(env *Envelope, pub ed25519.PublicKey) (*Statement, error) {
+	if env.PayloadType != PayloadType {
+		return nil, fmt.Errorf("unexpected payload type %q", env.PayloadType)
+	}
+	payload, err := base64.StdEncoding.DecodeString(env.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding payload: %w", err)
+	}
+	verified := false
+	for _, s := range env.Signatures {
+		sig, err := base64.StdEncoding.DecodeString(s.Sig)
+		if err == nil && ed25519.Verify(pub, pae(env.PayloadType, payload), sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("no valid signature for the verification key")
+	}
+
+	var st Statement
+	if err := json.Unmarshal(payload, &st); err != nil {
+		return nil, err
+	}
+	if st.Type != StatementType || st.PredicateType != PredicateType {
+		return nil, fmt.Errorf("unexpected statement %s / %s", st.Type, st.PredicateType)
+	}
+	return &st, nil
+}
+
+// Write stores env at path.
+func Write(path string, env *Envelope) error {
+	data, err := json.MarshalIndent(env, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func Read(path string) (*Envelope, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	return &env, nil
+}
+
+// ManifestPayloadType is what detached manifest signatures sign, so they
+// can't be passed off as signatures of anything else.
+const ManifestPayloadType = "application/vnd.todo-releaser.manifest+json"
+
+// SignaturePath is where the detached signatures of the manifest at path
+// are stored.
+func SignaturePath(path string) string {
+	return path + ".sig"
+}
+
+// SignManifest adds key's signature of the manifest data to sigs, replacing
+// any earlier one by the same key.
+func SignManifest(data []byte, sigs []Signature, key ed25519.PrivateKey) []Signature {
+	id := KeyID(key.Public().(ed25519.PublicKey))
+	sig := Signature{KeyID: id, Sig: base64.StdEncoding.EncodeToString(ed25519.Sign(key, pae(ManifestPayloadType, data)))}
+	kept := []Signature{sig}
+	for _, s := range sigs {
+		if s.KeyID != id {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// VerifyManifestSignatures checks that one of sigs is a signature of the
+// manifest data by one of keys, and returns that key's ID.
+func VerifyManifestSignatures(data []byte, sigs []Signature, keys []ed25519.PublicKey) (string, error) {
+	signed := pae(ManifestPayloadType, data)
+	for _, pub := range keys {
+		id := KeyID(pub)
+		for _, s := range sigs {
+			if s.KeyID != id {
+				continue
+			}
+			sig, err := base64.StdEncoding.DecodeString(s.Sig)
+			if err == nil && ed25519.Verify(pub, signed, sig) {
+				return id, nil
+			}
+		}
+	}
+	return "", errors.New("no valid signature by a trusted key")
+}
+
+// ParsePrivateKey decodes a base64 ed25519 private key or 32-byte seed.
+func ParsePrivateKey(s string) (ed25519.PrivateKey, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	switch len(b) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(b), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(b), nil
+	}
+	return nil, fmt.Errorf("signing key is %d bytes, expected %d or %d", len(b), ed25519.SeedSize, ed25519.PrivateKeySize)
+}
+
+// ParsePublicKey decodes a base64 ed25519 public key.
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("verification key is %d bytes, expected %d", len(b), ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// KeyID identifies pub in signatures.
+func KeyID(pub ed25519.PublicKey) string {
+	return sha256Hex(pub)[:16]
+}
+
+// pae is DSSE's pre-authentication encoding.
+func pae(payloadType string, payload []byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "DSSEv1 %d %s %d ", len(payloadType), payloadType, len(payload))
+	b.Write(payload)
+	return b.Bytes()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,95 @@
+package provenance
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	manifest := []byte(`{"release_version": "v202502.0.1"}`)
+	st, err := New(Release{
+		Version:      "v202502.0.1",
+		ManifestName: "release_manifest.json",
+		Manifest:     manifest,
+		SourceURI:    "git+https://github.com/velann21/todo-releaser",
+		Commit:       "0123456789abcdef",
+		Images:       map[string]string{"singaravelan21/todo-backend:v1.1.0": "sha256:ab12"},
+		Time:         time.Date(2025, 1, 6, 12, 0, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	env, err := Sign(st, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := ed25519.NewKeyFromSeed([]byte("01234567890123456789012345678901"))
+
+	tests := []struct {
+		name     string
+		pub      ed25519.PublicKey
+		manifest []byte
+		wantErr  bool
+	}{
+		{"valid", key.Public().(ed25519.PublicKey), manifest, false},
+		{"wrong key", other.Public().(ed25519.PublicKey), manifest, true},
+		{"tampered manifest", key.Public().(ed25519.PublicKey), []byte(`{}`), true},
+	}
+
+	for _, tt := range tests {
+		got, err := Verify(env, tt.pub)
+		if err == nil {
+			err = got.VerifyManifest("release_manifest.json", tt.manifest)
+		}
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestManifestSignatures(t *testing.T) {
+	manifest := []byte(`{"release_version": "v202502.0.1"}`)
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	other := ed25519.NewKeyFromSeed([]byte("01234567890123456789012345678901"))
+	pub, otherPub := key.Public().(ed25519.PublicKey), other.Public().(ed25519.PublicKey)
+
+	sigs := SignManifest(manifest, nil, other)
+	sigs = SignManifest(manifest, sigs, key)
+	// Signing again replaces the key's signature rather than adding one.
+	sigs = SignManifest(manifest, sigs, key)
+	if len(sigs) != 2 {
+		t.Fatalf("signatures = %+v, want one per key", sigs)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		keys []ed25519.PublicKey
+		want string
+	}{
+		{"trusted key", manifest, []ed25519.PublicKey{pub}, KeyID(pub)},
+		{"any trusted key", manifest, []ed25519.PublicKey{otherPub, pub}, KeyID(otherPub)},
+		{"tampered manifest", []byte(`{"release_version": "v202502.0.2"}`), []ed25519.PublicKey{pub}, ""},
+		{"no trusted keys", manifest, nil, ""},
+	}
+	for _, tt := range tests {
+		got, err := VerifyManifestSignatures(tt.data, sigs, tt.keys)
+		if got != tt.want || (err == nil) != (tt.want != "") {
+			t.Errorf("%s: VerifyManifestSignatures = %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+
+	// A provenance envelope's signature doesn't verify as a manifest's.
+	env, err := Sign(&Statement{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := base64.StdEncoding.DecodeString(env.Payload)
+	if _, err := VerifyManifestSignatures(payload, env.Signatures, []ed25519.PublicKey{pub}); err == nil {
+		t.Error("a provenance signature verified as a manifest signature")
+	}
+}
@@ -0,0 +1,157 @@
+// Package ratelimit paces requests to registries: a token bucket per host,
+// so no one registry sees more than its rate however many services it
+// serves, and a budget capping the requests of a whole run.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrBudgetExhausted is returned once a run has used its request budget.
+var ErrBudgetExhausted = errors.New("registry request budget exhausted")
+
+// Limiter is a token bucket allowing Rate requests a second in bursts of
+// up to Burst.
+type Limiter struct {
+	Rate  float64
+	Burst int
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a full bucket for rate requests a second, with a burst
+// of one second's worth (at least one request).
+func NewLimiter(rate float64) *Limiter {
+	burst := max(int(math.Ceil(rate)), 1)
+	return &Limiter{Rate: rate, Burst: burst, tokens: float64(burst)}
+}
+
+// Reserve takes a token at now and returns how long to wait before the
+// request it stands for may be made.
+func (l *Limiter) Reserve(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.last.IsZero() {
+		l.tokens = math.Min(float64(l.Burst), l.tokens+now.Sub(l.last).Seconds()*l.Rate)
+	}
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.Rate * float64(time.Second))
+}
+
+// Wait blocks until a request may be made, returning how long it waited.
+func (l *Limiter) Wait(ctx context.Context) (time.Duration, error) {
+	d := l.Reserve(time.Now())
+	if d == 0 {
+		return 0, nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-t.C:
+		return d, nil
+	}
+}
+
+// Budget caps the requests of a run. A Max of zero is unlimited.
+type Budget struct {
+	Max int
+
+	mu   sync.Mutex
+	used int
+}
+
+// Take uses one request of the budget, or reports that none is left.
+func (b *Budget) Take() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.Max > 0 && b.used >= b.Max {
+		return ErrBudgetExhausted
+	}
+	b.used++
+	return nil
+}
+
+// Reset starts a new run.
+func (b *Budget) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used = 0
+}
+
+// Hosts keeps a Limiter per host: Default requests a second, or the
+// host's entry in Overrides.
+type Hosts struct {
+	Default   float64
+	Overrides map[string]float64
+
+	mu       sync.Mutex
+	limiters map[string]*Limiter
+}
+
+// Limiter returns the limiter for host.
+func (h *Hosts) Limiter(host string) *Limiter {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if l, ok := h.limiters[host]; ok {
+		return l
+	}
+	rate, ok := h.Overrides[host]
+	if !ok {
+		rate = h.Default
+	}
+	if h.limiters == nil {
+		h.limiters = map[string]*Limiter{}
+	}
+	l := NewLimiter(rate)
+	h.limiters[host] = l
+	return l
+}
+
+// ParseRates parses comma-separated host=rate pairs, e.g.
+// "hub.docker.com=1,ghcr.io=10", with rates in requests a second.
+func ParseRates(s string) (map[string]float64, error) {
+	rates := map[string]float64{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		host, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not host=rate", pair)
+		}
+		rate, err := ParseRate(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", host, err)
+		}
+		rates[strings.TrimSpace(host)] = rate
+	}
+	return rates, nil
+}
+
+// ParseRate parses a positive number of requests a second.
+func ParseRate(s string) (float64, error) {
+	rate, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0, err
+	}
+	if rate <= 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return 0, fmt.Errorf("rate %s must be a positive number of requests a second", s)
+	}
+	return rate, nil
+}
@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLimiterReserve(t *testing.T) {
+	start := time.Date(2025, 3, 3, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		rate  float64
+		at    []time.Duration // offsets from start of each request
+		waits []time.Duration
+	}{
+		{"within burst", 2, []time.Duration{0, 0}, []time.Duration{0, 0}},
+		{"over burst", 2, []time.Duration{0, 0, 0, 0}, []time.Duration{0, 0, 500 * time.Millisecond, time.Second}},
+		{"refills", 2, []time.Duration{0, 0, time.Second, time.Second}, []time.Duration{0, 0, 0, 0}},
+		{"refill caps at burst", 1, []time.Duration{0, 10 * time.Second, 10 * time.Second}, []time.Duration{0, 0, time.Second}},
+		{"slow rate", 0.5, []time.Duration{0, 0}, []time.Duration{0, 2 * time.Second}},
+	}
+
+	for _, tt := range tests {
+		l := NewLimiter(tt.rate)
+		for i, at := range tt.at {
+			if got := l.Reserve(start.Add(at)); got != tt.waits[i] {
+				t.Errorf("%s: request %d waits %v, want %v", tt.name, i, got, tt.waits[i])
+			}
+		}
+	}
+}
+
+func TestBudget(t *testing.T) {
+	b := &Budget{Max: 2}
+	for i := 0; i < 2; i++ {
+		if err := b.Take(); err != nil {
+			t.Fatalf("Take %d: %v", i, err)
+		}
+	}
+	if err := b.Take(); !errors.Is(err, ErrBudgetExhausted) {
+		t.Errorf("Take over budget = %v, want ErrBudgetExhausted", err)
+	}
+	b.Reset()
+	if err := b.Take(); err != nil {
+		t.Errorf("Take after Reset: %v", err)
+	}
+
+	unlimited := &Budget{}
+	for i := 0; i < 100; i++ {
+		if err := unlimited.Take(); err != nil {
+			t.Fatalf("Take %d of unlimited budget: %v", i, err)
+		}
+	}
+}
+
+func TestHosts(t *testing.T) {
+	h := &Hosts{Default: 2, Overrides: map[string]float64{"hub.docker.com": 1}}
+	if got := h.Limiter("hub.docker.com").Rate; got != 1 {
+		t.Errorf("override rate = %v, want 1", got)
+	}
+	if got := h.Limiter("ghcr.io").Rate; got != 2 {
+		t.Errorf("default rate = %v, want 2", got)
+	}
+	if h.Limiter("ghcr.io") != h.Limiter("ghcr.io") {
+		t.Error("a host's requests are paced by different limiters")
+	}
+}
+
+func TestParseRates(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    map[string]float64
+		wantErr bool
+	}{
+		{"", map[string]float64{}, false},
+		{"hub.docker.com=1, ghcr.io=10", map[string]float64{"hub.docker.com": 1, "ghcr.io": 10}, false},
+		{"registry.corp:5000=0.5,", map[string]float64{"registry.corp:5000": 0.5}, false},
+		{"ghcr.io", nil, true},
+		{"ghcr.io=fast", nil, true},
+		{"ghcr.io=0", nil, true},
+		{"ghcr.io=-1", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseRates(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRates(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("ParseRates(%q) = %v, want %v", tt.in, got, tt.want)
+			continue
+		}
+		for host, rate := range tt.want {
+			if got[host] != rate {
+				t.Errorf("ParseRates(%q)[%s] = %v, want %v", tt.in, host, got[host], rate)
+			}
+		}
+	}
+}
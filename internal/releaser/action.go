@@ -0,0 +1,139 @@
+package releaser
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// RunAction runs a single reconcile as a GitHub Actions step and returns the
+// process exit code. Inputs come from the INPUT_* variables Actions sets from
+// action.yml:
+//
+//	INPUT_PUSH            "true" pushes the release commit and tag
+//	INPUT_GIT-USER-NAME   committer name (default github-actions[bot])
+//	INPUT_GIT-USER-EMAIL  committer email
+//
+// The outcome is written to GITHUB_OUTPUT (released, version, changes) and
+// the version diff to GITHUB_STEP_SUMMARY. Errors are reported as workflow
+// error annotations and exit 1. A cancelled workflow's SIGINT or SIGTERM
+// stops the run, leaving the checkout as it was.
+func RunAction() int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := runAction(ctx); err != nil {
+		fmt.Printf("::error title=releaser::%s\n", escapeAnnotation(err.Error()))
+		return 1
+	}
+	return 0
+}
+
+func runAction(ctx context.Context) error {
+	if workspace := os.Getenv("GITHUB_WORKSPACE"); workspace != "" {
+		if err := os.Chdir(workspace); err != nil {
+			return err
+		}
+		// The checkout belongs to the runner user, not the container's.
+		if err := runGitCommand("config", "--global", "--add", "safe.directory", workspace); err != nil {
+			return err
+		}
+	}
+	if err := runGitCommand("config", "user.name", actionInput("git-user-name", "github-actions[bot]")); err != nil {
+		return err
+	}
+	if err := runGitCommand("config", "user.email", actionInput("git-user-email", "41898282+github-actions[bot]@users.noreply.github.com")); err != nil {
+		return err
+	}
+
+	result, err := Reconcile(ctx)
+	if result != nil && actionInput("push", "false") == "true" {
+		if pushErr := runGitCommandContext(ctx, "push", "origin", "HEAD", "refs/tags/"+result.Version); pushErr != nil && err == nil {
+			err = pushErr
+		}
+	}
+
+	if outErr := writeActionOutputs(result); outErr != nil && err == nil {
+		err = outErr
+	}
+	return err
+}
+
+// actionInput reads an action input, falling back to def when unset.
+func actionInput(name, def string) string {
+	v := strings.TrimSpace(os.Getenv("INPUT_" + strings.ToUpper(name)))
+	if v == "" {
+		return def
+	}
+	return v
+}
+
+// writeActionOutputs appends the step outputs and summary to the files named
+// by GITHUB_OUTPUT and GITHUB_STEP_SUMMARY, when set.
+func writeActionOutputs(result *Result) error {
+	if path := os.Getenv("GITHUB_OUTPUT"); path != "" {
+		changes := []Change{}
+		version := ""
+		if result != nil {
+			changes, version = result.Changes, result.Version
+		}
+		changesJSON, err := json.Marshal(changes)
+		if err != nil {
+			return err
+		}
+		err = appendFile(path, func(w io.Writer) {
+			fmt.Fprintf(w, "released=%t\n", result != nil)
+			fmt.Fprintf(w, "version=%s\n", version)
+			fmt.Fprintf(w, "changes=%s\n", changesJSON)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if path := os.Getenv("GITHUB_STEP_SUMMARY"); path != "" {
+		return appendFile(path, func(w io.Writer) { writeSummary(w, result) })
+	}
+	return nil
+}
+
+// writeSummary renders the release diff as Markdown, followed by the
+// services left out because their check failed.
+func writeSummary(w io.Writer, result *Result) {
+	if result == nil {
+		fmt.Fprintln(w, "### No release")
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "All services are at their latest versions.")
+		return
+	}
+	fmt.Fprintf(w, "### Release %s\n\n", result.Version)
+	fmt.Fprintln(w, "| Service | From | To |")
+	fmt.Fprintln(w, "| --- | --- | --- |")
+	for _, c := range result.Changes {
+		fmt.Fprintf(w, "| %s | `%s` | `%s` |\n", c.Service, c.From, c.To)
+	}
+	if len(result.Failed) > 0 {
+		fmt.Fprintln(w)
+	}
+	for _, g := range result.Failed {
+		fmt.Fprintf(w, "- :warning: %s (%s)\n", g, strings.Join(g.Services, ", "))
+	}
+}
+
+func appendFile(path string, write func(io.Writer)) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	write(f)
+	return f.Close()
+}
+
+// escapeAnnotation escapes a workflow command message.
+func escapeAnnotation(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
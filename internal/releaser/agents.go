@@ -0,0 +1,92 @@
+package releaser
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/velann21/todo-releaser/internal/agent"
+	"github.com/velann21/todo-releaser/internal/pki"
+)
+
+var agentsMu sync.Mutex
+
+const agentsState = "agents.json"
+
+// AgentStatus is the last report from a host, with the last release it
+// deployed successfully, which is what it runs while a later one is
+// deploying or after one failed.
+type AgentStatus struct {
+	agent.Report
+	Deployed string `json:"deployed,omitempty"`
+}
+
+// AgentReports returns the status of every deploy agent and deploy hook,
+// by name.
+func AgentReports() (map[string]AgentStatus, error) {
+	agentsMu.Lock()
+	defer agentsMu.Unlock()
+	return readAgentReports()
+}
+
+func readAgentReports() (map[string]AgentStatus, error) {
+	reports := map[string]AgentStatus{}
+	if err := readStateJSON(agentsState, &reports); err != nil {
+		return nil, err
+	}
+	return reports, nil
+}
+
+// recordAgentReport stores rep as the latest report from the agent name.
+func recordAgentReport(name string, rep agent.Report) error {
+	agentsMu.Lock()
+	defer agentsMu.Unlock()
+
+	reports, err := readAgentReports()
+	if err != nil {
+		return err
+	}
+	st := reports[name]
+	st.Report = rep
+	if rep.State == agent.StateDeployed {
+		st.Deployed = rep.Version
+	}
+	reports[name] = st
+	return writeStateJSON(agentsState, reports)
+}
+
+// handleAgentReport serves PUT /agents/{name}, where deploy agents report
+// their rollouts, either over mTLS with a certificate for name or with the
+// API token.
+func handleAgentReport(token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if pki.AgentName(r.TLS) != name && !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var rep agent.Report
+		if err := json.NewDecoder(r.Body).Decode(&rep); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := recordAgentReport(name, rep); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("Agent %s: %s %s\n", name, rep.Version, rep.State)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleAgents serves GET /agents, the status of every agent.
+func handleAgents(w http.ResponseWriter, r *http.Request) {
+	reports, err := AgentReports()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
@@ -0,0 +1,125 @@
+package releaser
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// tagName restricts the tags /releases/{tag} looks up to plain names, in a
+// tag namespace or not.
+var tagName = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9._-]*/)?[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// handleManifest serves the current release manifest. Agents poll it with
+// If-None-Match and only download it when a new release has been made.
+func handleManifest(w http.ResponseWriter, r *http.Request) {
+	data, err := os.ReadFile(ManifestFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := verifyManifest("", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	serveManifest(w, r, data)
+}
+
+// handleRelease serves the manifest as it was tagged for a release. Tags do
+// not move, so it may be cached.
+func handleRelease(w http.ResponseWriter, r *http.Request) {
+	tag := r.PathValue("tag")
+	if !tagName.MatchString(tag) {
+		http.Error(w, "invalid tag", http.StatusBadRequest)
+		return
+	}
+	data, err := gitShow("refs/tags/"+tag, ManifestFile)
+	if err != nil {
+		http.Error(w, "no release "+tag, http.StatusNotFound)
+		return
+	}
+	if err := verifyManifest("refs/tags/"+tag, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=86400, immutable")
+	serveManifest(w, r, data)
+}
+
+// PublicStatus is served by /public/status.json: what is released, and
+// nothing about how.
+type PublicStatus struct {
+	Release  string                `json:"release"`
+	Services []PublicServiceStatus `json:"services"`
+}
+
+// PublicServiceStatus is a service's version in PublicStatus.
+type PublicServiceStatus struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// newPublicStatus is the public status of m.
+func newPublicStatus(m *manifest.Manifest) PublicStatus {
+	status := PublicStatus{Release: m.ReleaseVersion, Services: []PublicServiceStatus{}}
+	for _, s := range m.Services {
+		version := s.Version
+		if version == "" {
+			version = currentVersion(s)
+		}
+		status.Services = append(status.Services, PublicServiceStatus{s.Name, version})
+	}
+	return status
+}
+
+// handlePublicStatus serves the public status of the current release
+// manifest, without credentials and to any origin, so pages such as a
+// wiki or the app's footer can show the release. Clients may cache it
+// for a minute and revalidate it with its ETag.
+func handlePublicStatus(w http.ResponseWriter, r *http.Request) {
+	m, err := manifest.Load(ManifestFile)
+	if err != nil {
+		http.Error(w, "the release manifest can't be read", http.StatusInternalServerError)
+		return
+	}
+	data, err := json.Marshal(newPublicStatus(m))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	serveManifest(w, r, data)
+}
+
+// serveManifest writes data with a strong ETag of its content, or 304 when
+// the client already has it.
+func serveManifest(w http.ResponseWriter, r *http.Request, data []byte) {
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// etagMatches reports whether an If-None-Match header lists etag.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+package releaser
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/image"
+	"github.com/velann21/todo-releaser/internal/manifest"
+	"github.com/velann21/todo-releaser/internal/provenance"
+)
+
+// With RELEASER_MANIFEST_REPOSITORY set, e.g.
+// registry.example.com/acme/releases, each release is also pushed there as
+// an OCI artifact tagged as the release, a / in the tag made a -, for
+// deploy agents that can reach the registry but not the repository (see
+// AGENT_MANIFEST_REPOSITORY). Its layers are the release's manifest, the
+// manifest's signatures if it was signed, and its config bundles, as the
+// release tagged them, titled by their paths, so
+//
+//	oras pull registry.example.com/acme/releases:v202452.1.0
+//
+// writes them out too. The newest release is also tagged latest, or
+// <prefix>-latest for releases tagged <prefix>/v…, for agents to follow.
+// The registry is logged in to as RELEASER_MANIFEST_USERNAME with
+// RELEASER_MANIFEST_PASSWORD, if set.
+
+// ManifestArtifactType is the artifact type of published releases.
+const ManifestArtifactType = "application/vnd.todo-releaser.release.v1"
+
+// Media types of the files of a published release.
+const (
+	manifestLayerType  = "application/vnd.todo-releaser.manifest.v1+json"
+	signatureLayerType = "application/vnd.todo-releaser.manifest.signatures.v1+json"
+	configLayerType    = "application/vnd.todo-releaser.config.v1"
+)
+
+// emptyConfig is the OCI empty descriptor's content, the config of
+// artifacts that need none.
+const emptyConfig = "{}"
+
+// titleAnnotation names the file a layer is pulled to.
+const titleAnnotation = "org.opencontainers.image.title"
+
+// publishManifest pushes the release version to RELEASER_MANIFEST_REPOSITORY,
+// if set.
+func publishManifest(ctx context.Context, version string) error {
+	repository := os.Getenv("RELEASER_MANIFEST_REPOSITORY")
+	if repository == "" {
+		return nil
+	}
+	r, err := image.Parse(repository)
+	if err != nil {
+		return fmt.Errorf("RELEASER_MANIFEST_REPOSITORY: %w", err)
+	}
+	if r.Tag != "" || r.Digest != "" {
+		return fmt.Errorf("RELEASER_MANIFEST_REPOSITORY: %s names an image, not a repository", repository)
+	}
+	rev := "refs/tags/" + version
+	data, err := gitShow(rev, ManifestFile)
+	if err != nil {
+		return err
+	}
+	m, err := manifest.Parse(data)
+	if err != nil {
+		return err
+	}
+	files := []ociDescriptor{blobDescriptor(manifestLayerType, data, ManifestFile)}
+	contents := [][]byte{data}
+	sigPath := provenance.SignaturePath(ManifestFile)
+	if sigs, err := gitShow(rev, sigPath); err == nil {
+		files = append(files, blobDescriptor(signatureLayerType, sigs, sigPath))
+		contents = append(contents, sigs)
+	}
+	published := map[string]bool{}
+	for _, s := range m.Services {
+		for _, b := range s.Config {
+			if published[b.Path] {
+				continue
+			}
+			published[b.Path] = true
+			content, err := gitShow(rev, b.Path)
+			if err != nil {
+				return err
+			}
+			files = append(files, blobDescriptor(configLayerType, content, b.Path))
+			contents = append(contents, content)
+		}
+	}
+
+	host := r.Registry
+	if r.IsDockerHub() {
+		host = "registry-1.docker.io"
+	}
+	c, err := newRegistryClient(ctx, host, r.Repository, "pull,push", os.Getenv("RELEASER_MANIFEST_USERNAME"), os.Getenv("RELEASER_MANIFEST_PASSWORD"))
+	if err != nil {
+		return err
+	}
+	config := blobDescriptor("application/vnd.oci.empty.v1+json", []byte(emptyConfig), "")
+	if err := c.pushBlob(ctx, config.Digest, config.Size, strings.NewReader(emptyConfig)); err != nil {
+		return err
+	}
+	for i, d := range files {
+		if err := c.pushBlob(ctx, d.Digest, d.Size, bytes.NewReader(contents[i])); err != nil {
+			return fmt.Errorf("%s: %w", d.Annotations[titleAnnotation], err)
+		}
+	}
+	annotations := map[string]string{
+		"org.opencontainers.image.version": version,
+		"org.opencontainers.image.created": time.Now().UTC().Format(time.RFC3339),
+	}
+	if source := repositoryURL(); source != "" {
+		annotations["org.opencontainers.image.source"] = source
+	}
+	artifact, err := json.MarshalIndent(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"artifactType":  ManifestArtifactType,
+		"config":        config,
+		"layers":        files,
+		"annotations":   annotations,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tag := strings.ReplaceAll(version, "/", "-")
+	for _, t := range []string{tag, latestArtifactTag(version)} {
+		if err := c.pushManifest(ctx, t, "application/vnd.oci.image.manifest.v1+json", artifact); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Published %s as %s:%s\n", version, repository, tag)
+	return nil
+}
+
+// latestArtifactTag is the tag that follows the newest release of
+// version's prefix: latest, or <prefix>-latest for <prefix>/v….
+func latestArtifactTag(version string) string {
+	if i := strings.LastIndex(version, "/"); i >= 0 {
+		return strings.ReplaceAll(version[:i], "/", "-") + "-latest"
+	}
+	return "latest"
+}
+
+// blobDescriptor describes data, as the file title if not "".
+func blobDescriptor(mediaType string, data []byte, title string) ociDescriptor {
+	sum := sha256.Sum256(data)
+	d := ociDescriptor{MediaType: mediaType, Digest: "sha256:" + hex.EncodeToString(sum[:]), Size: int64(len(data))}
+	if title != "" {
+		d.Annotations = map[string]string{titleAnnotation: title}
+	}
+	return d
+}
@@ -0,0 +1,181 @@
+package releaser
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/blobstore"
+	"github.com/velann21/todo-releaser/internal/manifest"
+	"github.com/velann21/todo-releaser/internal/provenance"
+)
+
+// ArtifactsFile configures where release artifacts are archived. It is
+// optional; without it nothing is archived.
+const ArtifactsFile = "artifacts.json"
+
+// ArtifactsConfig lists the stores each release's artifacts are copied to:
+//
+//	{"targets": [
+//	  {"name": "compliance", "driver": "s3", "bucket": "todo-compliance", "prefix": "releases",
+//	   "artifacts": ["manifest", "attestation", "sbom"]},
+//	  {"name": "archive", "driver": "gcs", "bucket": "todo-release-archive"},
+//	  {"name": "nas", "driver": "local", "path": "/mnt/releases"}
+//	]}
+//
+// Each artifact is stored as <prefix>/<version>/<file>.
+type ArtifactsConfig struct {
+	Targets []ArtifactTarget `json:"targets"`
+}
+
+// ArtifactTarget is a store and the artifacts kept in it.
+type ArtifactTarget struct {
+	Name string `json:"name"`
+	blobstore.Config
+	// Artifacts are the kinds stored, all of them when empty.
+	Artifacts []string `json:"artifacts,omitempty"`
+}
+
+// Artifact kinds and the files they are stored as:
+//
+//	manifest     release_manifest.json, the released manifest
+//	result       result.json, the release and its changes
+//	attestation  <version>.intoto.json, the signed provenance
+//	notes        notes/<output><ext>, each release notes output
+//	sbom         sbom/<service>.syft.json, the SBOMs the license gate read
+const (
+	ArtifactManifest    = "manifest"
+	ArtifactResult      = "result"
+	ArtifactAttestation = "attestation"
+	ArtifactNotes       = "notes"
+	ArtifactSBOM        = "sbom"
+)
+
+var artifactKinds = []string{ArtifactManifest, ArtifactResult, ArtifactAttestation, ArtifactNotes, ArtifactSBOM}
+
+type artifact struct {
+	kind, file string
+	data       []byte
+}
+
+func loadArtifactsConfig(file string) (*ArtifactsConfig, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var c ArtifactsConfig
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", file, err)
+	}
+	for _, t := range c.Targets {
+		if t.Name == "" {
+			return nil, fmt.Errorf("%s: every target needs a name", file)
+		}
+		for _, kind := range t.Artifacts {
+			if !slices.Contains(artifactKinds, kind) {
+				return nil, fmt.Errorf("%s: target %s: unknown artifact %q, expected one of %s",
+					file, t.Name, kind, strings.Join(artifactKinds, ", "))
+			}
+		}
+	}
+	return &c, nil
+}
+
+// releaseArtifacts collects the artifacts of result, which m was released
+// as.
+func releaseArtifacts(m *manifest.Manifest, result *Result) ([]artifact, error) {
+	var artifacts []artifact
+	data, err := os.ReadFile(ManifestFile)
+	if err != nil {
+		return nil, err
+	}
+	artifacts = append(artifacts, artifact{ArtifactManifest, ManifestFile, data})
+	if data, err = json.MarshalIndent(result, "", "  "); err != nil {
+		return nil, err
+	}
+	artifacts = append(artifacts, artifact{ArtifactResult, "result.json", data})
+
+	attestation := provenance.Path(result.Version)
+	if data, err := os.ReadFile(attestation); err == nil {
+		artifacts = append(artifacts, artifact{ArtifactAttestation, filepath.Base(attestation), data})
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	notes, err := loadNotesConfig(NotesFile)
+	if err != nil {
+		return nil, err
+	}
+	if notes != nil {
+		previous, _ := previousRelease(result.Version + "^")
+		d := newNotesData(m, result, repositoryURL(), previous, time.Now())
+		for _, out := range notes.Outputs {
+			body, err := renderNotes(out.Template, d)
+			if err != nil {
+				return nil, fmt.Errorf("rendering %s release notes: %w", out.Name, err)
+			}
+			name := out.Name + path.Ext(strings.TrimSuffix(out.Template, ".tmpl"))
+			artifacts = append(artifacts, artifact{ArtifactNotes, "notes/" + name, []byte(body)})
+		}
+	}
+
+	for _, c := range result.Changes {
+		if c.sbom != nil {
+			artifacts = append(artifacts, artifact{ArtifactSBOM, "sbom/" + c.Service + ".syft.json", c.sbom})
+		}
+	}
+	return artifacts, nil
+}
+
+// archiveRelease copies the artifacts of result to every target in
+// ArtifactsFile. All targets are attempted; the error lists those that
+// failed.
+func archiveRelease(ctx context.Context, m *manifest.Manifest, result *Result) error {
+	conf, err := loadArtifactsConfig(ArtifactsFile)
+	if err != nil || conf == nil {
+		return err
+	}
+	artifacts, err := releaseArtifacts(m, result)
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, t := range conf.Targets {
+		if err := archiveTo(ctx, t, result.Version, artifacts); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", t.Name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("archiving failed:\n  %s", strings.Join(failed, "\n  "))
+	}
+	return nil
+}
+
+func archiveTo(ctx context.Context, t ArtifactTarget, version string, artifacts []artifact) error {
+	store, err := blobstore.Open(t.Config)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Archiving %s artifacts to %s\n", version, store.URL(version))
+	for _, a := range artifacts {
+		if len(t.Artifacts) > 0 && !slices.Contains(t.Artifacts, a.kind) {
+			continue
+		}
+		if err := store.Put(ctx, version+"/"+a.file, bytes.NewReader(a.data)); err != nil {
+			return fmt.Errorf("%s: %w", a.file, err)
+		}
+	}
+	return nil
+}
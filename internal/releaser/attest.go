@@ -0,0 +1,104 @@
+package releaser
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/image"
+	"github.com/velann21/todo-releaser/internal/manifest"
+	"github.com/velann21/todo-releaser/internal/provenance"
+)
+
+// attestRelease writes signed SLSA provenance for m, which must already be
+// saved, when RELEASER_SIGNING_KEY (a base64 ed25519 key) is set. It returns
+// the attestation's path, or "" when signing is not configured. The deploy
+// side verifies it with the matching public key before rolling out.
+func attestRelease(ctx context.Context, m *manifest.Manifest) (string, error) {
+	signingKey := os.Getenv("RELEASER_SIGNING_KEY")
+	if signingKey == "" {
+		return "", nil
+	}
+	key, err := provenance.ParsePrivateKey(signingKey)
+	if err != nil {
+		return "", fmt.Errorf("RELEASER_SIGNING_KEY: %w", err)
+	}
+
+	data, err := os.ReadFile(ManifestFile)
+	if err != nil {
+		return "", err
+	}
+	commit, err := commitOf("HEAD")
+	if err != nil {
+		return "", err
+	}
+	source, err := currentRepo().remoteURL()
+	if err != nil {
+		source = "unknown"
+	}
+
+	images := map[string]string{}
+	for _, s := range m.Services {
+		digest := s.Digest()
+		if digest == "" {
+			if digest, err = tagDigest(ctx, s.Image, s.Version); err != nil {
+				return "", fmt.Errorf("error resolving %s: %w", s.Ref(), err)
+			}
+		}
+		images[s.Ref()] = digest
+	}
+
+	st, err := provenance.New(provenance.Release{
+		Version:      m.ReleaseVersion,
+		ManifestName: ManifestFile,
+		Manifest:     data,
+		SourceURI:    "git+" + source,
+		Commit:       commit,
+		Images:       images,
+		Time:         time.Now(),
+	})
+	if err != nil {
+		return "", err
+	}
+	env, err := provenance.Sign(st, key)
+	if err != nil {
+		return "", err
+	}
+	path := provenance.Path(m.ReleaseVersion)
+	fmt.Printf("Writing provenance to %s\n", path)
+	return path, provenance.Write(path, env)
+}
+
+func getTagDigestFromDockerHub(ctx context.Context, ref image.Reference, tag string) (string, error) {
+	url := fmt.Sprintf("https://hub.docker.com/v2/repositories/%s/tags/%s", ref.Repository, tag)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := registryHTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", fmt.Errorf("%s:%s: %w", ref.Repository, tag, errTagNotFound)
+	}
+	if resp.StatusCode != 200 {
+		return "", &statusError{"docker hub", resp.StatusCode}
+	}
+
+	var t struct {
+		Digest string `json:"digest"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", err
+	}
+	if t.Digest == "" {
+		return "", fmt.Errorf("docker hub returned no digest")
+	}
+	return t.Digest, nil
+}
@@ -0,0 +1,117 @@
+package releaser
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/statestore"
+)
+
+// AuditEvent is an entry of the audit log, which records changes to what
+// the releaser runs with, such as rotated credentials.
+type AuditEvent struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	// Names are what the action concerns, e.g. the environment variables
+	// a rotation changed. Secret values are never logged.
+	Names  []string `json:"names,omitempty"`
+	Source string   `json:"source,omitempty"`
+	Detail string   `json:"detail,omitempty"`
+}
+
+var auditMu sync.Mutex
+
+// auditState is the log of the state store the audit log is kept in.
+const auditState = "audit"
+
+// audit appends e to the audit log: the file RELEASER_AUDIT_LOG, one JSON
+// object a line, or else the state store. Failing to write it is logged
+// and otherwise ignored.
+func audit(e AuditEvent) {
+	e.Time = Clock.Now().UTC()
+	if err := appendAudit(e); err != nil {
+		fmt.Printf("Error writing the audit log: %v\n", err)
+	}
+}
+
+func appendAudit(e AuditEvent) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	path := os.Getenv("RELEASER_AUDIT_LOG")
+	if path == "" {
+		store, err := stateStore()
+		if err != nil {
+			return err
+		}
+		if err := importAuditLog(store); err != nil {
+			return err
+		}
+		return store.Append(context.Background(), auditState, line)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// importAuditLog moves the audit log the releaser kept in audit.jsonl in
+// StateDir before into store.
+func importAuditLog(store statestore.Store) error {
+	legacy := filepath.Join(StateDir(), "audit.jsonl")
+	data, err := os.ReadFile(legacy)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for line := range strings.Lines(string(data)) {
+		if line = strings.TrimSpace(line); line != "" {
+			if err := store.Append(context.Background(), auditState, []byte(line)); err != nil {
+				return fmt.Errorf("error importing %s: %w", legacy, err)
+			}
+		}
+	}
+	return os.Rename(legacy, legacy+".imported")
+}
+
+// readAuditLog returns the audit log kept in the state store, oldest
+// first.
+func readAuditLog() ([]AuditEvent, error) {
+	store, err := stateStore()
+	if err != nil {
+		return nil, err
+	}
+	records, err := store.Records(context.Background(), auditState)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]AuditEvent, 0, len(records))
+	for _, r := range records {
+		var e AuditEvent
+		if err := json.Unmarshal(r, &e); err != nil {
+			return nil, fmt.Errorf("error parsing the audit log: %w", err)
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
@@ -0,0 +1,287 @@
+package releaser
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// ChangelogFile is the changelog the releaser keeps when the repository
+// has one: each release adds an entry listing the services it moved, newest
+// first.
+const ChangelogFile = "CHANGELOG.md"
+
+// changelogHeading matches the heading of a changelog entry, capturing its
+// release.
+var changelogHeading = regexp.MustCompile(`(?m)^## (v\S+)`)
+
+// bumpedServices returns the changes the current run made to m's services,
+// as recorded in their LastBump.
+func bumpedServices(m *manifest.Manifest) []Change {
+	var changes []Change
+	for _, s := range m.Services {
+		b := s.LastBump
+		if b == nil || b.Run != runID {
+			continue
+		}
+		from, to := b.From, s.Version
+		if s.Digest() != "" && (from == "" || from == to) {
+			from, to = shortDigest(b.FromDigest), shortDigest(s.Digest())
+		}
+		changes = append(changes, Change{Service: s.Name, From: from, To: to})
+	}
+	return changes
+}
+
+// changelogEntry is the changelog entry of the release version of m,
+// naming the CVEs updates were found to fix.
+func changelogEntry(m *manifest.Manifest, version string, date time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "## %s - %s\n\n", version, date.Format(time.DateOnly))
+	changes := bumpedServices(m)
+	if len(changes) == 0 {
+		b.WriteString("- No service changes.\n")
+	}
+	for _, c := range changes {
+		fmt.Fprintf(&b, "- %s: `%s` → `%s`", c.Service, c.From, c.To)
+		if s, ok := m.Service(c.Service); ok {
+			if fixes := cachedFixes(s, c.From, c.To); len(fixes) > 0 {
+				fmt.Fprintf(&b, " (fixes %s)", strings.Join(fixes, ", "))
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// insertChangelogEntry adds entry, of release version, to the changelog
+// data above the entries of older releases. It returns false when the
+// changelog already has an entry for version.
+func insertChangelogEntry(data []byte, version, entry string) ([]byte, bool) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return []byte("# Changelog\n\n" + entry), true
+	}
+	v, _ := semver.NewVersion(version)
+	at := len(data)
+	for _, loc := range changelogHeading.FindAllSubmatchIndex(data, -1) {
+		heading := string(data[loc[2]:loc[3]])
+		if heading == version {
+			return data, false
+		}
+		if other, err := semver.NewVersion(heading); v != nil && err == nil && other.LessThan(v) && at == len(data) {
+			at = loc[0]
+		}
+	}
+	if at == len(data) {
+		return append(bytes.TrimRight(data, "\n"), "\n\n"+entry...), true
+	}
+	out := append(slices.Clip(data[:at]), entry+"\n"...)
+	return append(out, data[at:]...), true
+}
+
+// updateChangelog adds the entry of the release version of m to
+// ChangelogFile, if the repository keeps one, and stages it.
+func updateChangelog(m *manifest.Manifest, version string) error {
+	data, err := os.ReadFile(ChangelogFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, added := insertChangelogEntry(data, version, changelogEntry(m, version, Clock.Now()))
+	if !added {
+		return nil
+	}
+	if err := os.WriteFile(ChangelogFile, data, 0644); err != nil {
+		return err
+	}
+	return currentRepo().add(context.Background(), ChangelogFile)
+}
+
+// backportServices moves target's services to the versions the current run
+// released them at in released, where target is behind: at the version the
+// release moved from, or an older one. It returns the changes.
+func backportServices(target, released *manifest.Manifest) []Change {
+	var changes []Change
+	for _, s := range released.Services {
+		b := s.LastBump
+		if b == nil || b.Run != runID {
+			continue
+		}
+		i := serviceIndex(target, s.Name)
+		if i < 0 {
+			continue
+		}
+		t := target.Services[i]
+		if (s.Digest() == "") != (t.Digest() == "") || t.Image == s.Image && t.Version == s.Version {
+			continue
+		}
+		behind := t.Version == b.From && (s.Digest() == "" || t.Digest() == b.FromDigest)
+		if to, err := semver.NewVersion(s.Version); err == nil {
+			if from, err := semver.NewVersion(t.Version); err == nil {
+				behind = behind || from.LessThan(to)
+			}
+		}
+		if !behind {
+			continue
+		}
+		from := currentVersion(t)
+		if s.Digest() != "" {
+			target.SetDigest(i, s.Version, s.Digest(), runID, Clock.Now())
+		} else {
+			target.SetVersion(i, s.Version, runID, Clock.Now())
+		}
+		changes = append(changes, Change{Service: s.Name, From: from, To: currentVersion(target.Services[i])})
+	}
+	return changes
+}
+
+// backportRelease opens a pull request bringing the release result, made
+// on a release branch, back to the branch BranchesFile names as "backport":
+// its changelog entry, and the service versions the release moved that the
+// branch is behind on. Releases on the backport branch itself, or without
+// one configured, aren't backported. The pull request's branch is rebuilt
+// from the backport branch each time, so a retried release updates it.
+func backportRelease(m *manifest.Manifest, result *Result) error {
+	c, err := loadBranchesConfig(BranchesFile)
+	if err != nil || c.Backport == "" {
+		return err
+	}
+	branch, err := baseBranch()
+	if err != nil {
+		return err
+	}
+	if branch == c.Backport {
+		return nil
+	}
+	if memRepo != nil {
+		return errors.New("backports need the git CLI, which the in-memory checkout doesn't use")
+	}
+	head, err := currentRepo().fetch(context.Background(), c.Backport)
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "releaser-backport-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err := runGitCommand("worktree", "add", "-q", "--detach", dir, head); err != nil {
+		return err
+	}
+	defer runGitCommand("worktree", "remove", "--force", dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(dir); err != nil {
+		return err
+	}
+	defer os.Chdir(wd)
+
+	target, err := manifest.Load(ManifestFile)
+	if err != nil {
+		return fmt.Errorf("error loading the manifest of %s: %w", c.Backport, err)
+	}
+	changes := backportServices(target, m)
+	if len(changes) > 0 {
+		if err := manifest.Save(ManifestFile, target); err != nil {
+			return err
+		}
+		if err := stageManifest(); err != nil {
+			return err
+		}
+	}
+	changelog, err := backportChangelog(filepath.Join(wd, ChangelogFile), result.Version)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 && !changelog {
+		fmt.Printf("%s has everything of %s already\n", c.Backport, result.Version)
+		return nil
+	}
+
+	u := UpdateBranch{
+		Branch: "releaser/backport/" + result.Version,
+		Title:  fmt.Sprintf("chore: backport %s to %s", result.Version, c.Backport),
+		Labels: []string{"backport"},
+	}
+	if err := currentRepo().commit(context.Background(), u.Title); err != nil {
+		return err
+	}
+	if !branchHasTree(u.Branch) {
+		if err := currentRepo().push(context.Background(), true, "HEAD:refs/heads/"+u.Branch); err != nil {
+			return err
+		}
+	}
+	var body strings.Builder
+	fmt.Fprintf(&body, "This PR brings %s, released on %s, back to %s so their histories don't diverge.\n", result.Version, branch, c.Backport)
+	if len(changes) > 0 {
+		body.WriteString("\nIt moves:\n\n")
+		for _, ch := range changes {
+			fmt.Fprintf(&body, "- %s from `%s` to `%s`\n", ch.Service, ch.From, ch.To)
+		}
+	}
+	if changelog {
+		fmt.Fprintf(&body, "\nIt adds the release to %s.\n", ChangelogFile)
+	}
+	_, err = pullRequest(u, c.Backport, body.String())
+	return err
+}
+
+// backportChangelog adds the entry of version in the changelog at path to
+// the changelog of the working directory, creating it if need be, and
+// stages it. It reports whether it added the entry.
+func backportChangelog(path, version string) (bool, error) {
+	entry, err := changelogSection(path, version)
+	if err != nil || entry == "" {
+		return false, err
+	}
+	data, err := os.ReadFile(ChangelogFile)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	data, added := insertChangelogEntry(data, version, entry)
+	if !added {
+		return false, nil
+	}
+	if err := os.WriteFile(ChangelogFile, data, 0644); err != nil {
+		return false, err
+	}
+	return true, currentRepo().add(context.Background(), ChangelogFile)
+}
+
+// changelogSection returns the entry of version in the changelog at path,
+// or "" when there is none.
+func changelogSection(path, version string) (string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	locs := changelogHeading.FindAllSubmatchIndex(data, -1)
+	for i, loc := range locs {
+		if string(data[loc[2]:loc[3]]) != version {
+			continue
+		}
+		end := len(data)
+		if i+1 < len(locs) {
+			end = locs[i+1][0]
+		}
+		return strings.TrimRight(string(data[loc[0]:end]), "\n") + "\n", nil
+	}
+	return "", nil
+}
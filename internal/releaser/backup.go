@@ -0,0 +1,256 @@
+package releaser
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/blobstore"
+	"github.com/velann21/todo-releaser/internal/statestore"
+)
+
+// A backup of the releaser's state is a gzipped tarball of
+//
+//	backup.json         when it was made, and from which state store
+//	state/<name>        the state store's documents, e.g. state/freeze.json
+//	logs/<name>.jsonl   its logs, a record a line, e.g. logs/audit.jsonl
+//	files/<path>        the files in StateDir, such as the agent CA
+//
+// The managed checkout, which is cloned again, and the SQLite database,
+// whose content is under state/ and logs/, are left out, so a backup
+// restores into a store of either driver. Backups hold the webhooks'
+// secrets and the CA's key: keep them as safe as the state.
+const backupInfoName = "backup.json"
+
+// DefaultBackupInterval is how often the daemon backs its state up to
+// RELEASER_BACKUP_BUCKET, unless RELEASER_BACKUP_INTERVAL says otherwise.
+const DefaultBackupInterval = 24 * time.Hour
+
+type backupInfo struct {
+	Created time.Time `json:"created"`
+	Store   string    `json:"store"`
+}
+
+// Backup writes a backup of the releaser's state to w.
+func Backup(w io.Writer) error {
+	driver, _, err := stateStoreConfig()
+	if err != nil {
+		return err
+	}
+	store, err := stateStore()
+	if err != nil {
+		return err
+	}
+	snap, err := store.Dump(context.Background())
+	if err != nil {
+		return fmt.Errorf("error reading the state store: %w", err)
+	}
+
+	tmp, err := os.MkdirTemp("", "releaser-backup")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	info, err := json.MarshalIndent(backupInfo{Created: Clock.Now().UTC(), Store: driver}, "", "  ")
+	if err != nil {
+		return err
+	}
+	files := map[string][]byte{backupInfoName: info}
+	for name, data := range snap.State {
+		files["state/"+name] = data
+	}
+	for name, records := range snap.Logs {
+		files["logs/"+name+".jsonl"] = append(bytes.Join(records, []byte("\n")), '\n')
+	}
+	for name, data := range files {
+		if !fs.ValidPath(name) {
+			return fmt.Errorf("can't back up %q", name)
+		}
+		p := filepath.Join(tmp, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			return err
+		}
+		if err := os.WriteFile(p, data, 0600); err != nil {
+			return err
+		}
+	}
+	if err := copyStateFiles(StateDir(), filepath.Join(tmp, "files")); err != nil {
+		return err
+	}
+	return archiveState(w, tmp)
+}
+
+// copyStateFiles copies the regular files under dir to dst, but for the
+// managed checkout, the SQLite state database and the state files imported
+// into the state store.
+func copyStateFiles(dir, dst string) error {
+	var db string
+	if driver, dsn, err := stateStoreConfig(); err == nil && driver == statestore.SQLite {
+		db, _ = filepath.Abs(dsn)
+	}
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && p == dir {
+			return fs.SkipAll
+		}
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if rel == lambdaStateSkip && d.IsDir() {
+			return fs.SkipDir
+		}
+		// The database's journal is named after it.
+		abs, _ := filepath.Abs(p)
+		if !d.Type().IsRegular() || db != "" && strings.HasPrefix(abs, db) || strings.HasSuffix(rel, ".imported") {
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, info.Mode().Perm())
+	})
+}
+
+// Restore replaces the releaser's state with the backup r, writing its
+// documents and logs to the state store and its files to StateDir. The
+// daemon should be stopped while it runs.
+func Restore(r io.Reader) error {
+	tmp, err := os.MkdirTemp("", "releaser-restore")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := extractState(r, tmp); err != nil {
+		return fmt.Errorf("error reading the backup: %w", err)
+	}
+	var info backupInfo
+	data, err := os.ReadFile(filepath.Join(tmp, backupInfoName))
+	if err != nil {
+		return fmt.Errorf("not a backup of the releaser's state: %w", err)
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return fmt.Errorf("error parsing %s: %w", backupInfoName, err)
+	}
+
+	snap := &statestore.Snapshot{State: map[string][]byte{}, Logs: map[string][][]byte{}}
+	states, err := os.ReadDir(filepath.Join(tmp, "state"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for _, e := range states {
+		if snap.State[e.Name()], err = os.ReadFile(filepath.Join(tmp, "state", e.Name())); err != nil {
+			return err
+		}
+	}
+	logs, err := os.ReadDir(filepath.Join(tmp, "logs"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for _, e := range logs {
+		data, err := os.ReadFile(filepath.Join(tmp, "logs", e.Name()))
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(e.Name(), ".jsonl")
+		for line := range strings.Lines(string(data)) {
+			if line = strings.TrimSpace(line); line != "" {
+				snap.Logs[name] = append(snap.Logs[name], []byte(line))
+			}
+		}
+	}
+
+	store, err := stateStore()
+	if err != nil {
+		return err
+	}
+	if err := store.Load(context.Background(), snap); err != nil {
+		return fmt.Errorf("error writing the state store: %w", err)
+	}
+	if err := copyStateFiles(filepath.Join(tmp, "files"), StateDir()); err != nil {
+		return err
+	}
+	fmt.Printf("Restored %d state documents and %d logs from the backup of %s\n", len(snap.State), len(snap.Logs), info.Created.Format(time.RFC3339))
+	audit(AuditEvent{Action: "state.restored", Source: info.Store, Detail: info.Created.Format(time.RFC3339)})
+	return nil
+}
+
+// backupStore is where RELEASER_BACKUP_BUCKET has the daemon keep backups,
+// under RELEASER_BACKUP_PREFIX, releaser/backups unless set; nil when it
+// isn't set.
+func backupStore() (blobstore.Store, error) {
+	bucket := os.Getenv("RELEASER_BACKUP_BUCKET")
+	if bucket == "" {
+		return nil, nil
+	}
+	prefix := os.Getenv("RELEASER_BACKUP_PREFIX")
+	if prefix == "" {
+		prefix = "releaser/backups"
+	}
+	return blobstore.Open(blobstore.Config{Driver: blobstore.S3, Bucket: bucket, Prefix: prefix})
+}
+
+// backupTo writes a backup to store, named after the time it was made,
+// and returns where.
+func backupTo(ctx context.Context, store blobstore.Store) (string, error) {
+	var buf bytes.Buffer
+	if err := Backup(&buf); err != nil {
+		return "", err
+	}
+	key := Clock.Now().UTC().Format("20060102T150405Z") + ".tar.gz"
+	if err := store.Put(ctx, key, &buf); err != nil {
+		return "", err
+	}
+	return store.URL(key), nil
+}
+
+// startBackups backs the state up to RELEASER_BACKUP_BUCKET every
+// RELEASER_BACKUP_INTERVAL in the background, when the bucket is set. Old
+// backups are left to the bucket's lifecycle rules to expire. A failed
+// backup is logged and tried again at the next interval.
+func startBackups() {
+	store, err := backupStore()
+	if err != nil {
+		fmt.Printf("Not backing up the state: %v\n", err)
+		return
+	}
+	if store == nil {
+		return
+	}
+	interval := DefaultBackupInterval
+	if s := os.Getenv("RELEASER_BACKUP_INTERVAL"); s != "" {
+		if interval, err = time.ParseDuration(s); err != nil || interval <= 0 {
+			fmt.Printf("RELEASER_BACKUP_INTERVAL: %q is not a positive duration, using %v\n", s, DefaultBackupInterval)
+			interval = DefaultBackupInterval
+		}
+	}
+	go func() {
+		for range time.Tick(interval) {
+			url, err := backupTo(context.Background(), store)
+			if err != nil {
+				fmt.Printf("Error backing up the state: %v\n", err)
+				continue
+			}
+			fmt.Printf("Backed up the state to %s\n", url)
+		}
+	}()
+}
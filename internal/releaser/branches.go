@@ -0,0 +1,118 @@
+package releaser
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// BranchesFile maps branches to the updates they take. Without it, or for
+// branches it doesn't list, every update is released.
+//
+//	{
+//	  "branches": {
+//	    "master": "all",
+//	    "release/*": "patch"
+//	  },
+//	  "backport": "master"
+//	}
+//
+// Branch names are matched with path.Match, so release/* matches
+// release/2025-01. On a "patch" branch services only move to newer patch
+// versions of the minor version they are on, and each release is the next
+// patch of the branch's last release, so customers pinned to an older
+// train get fixes without features.
+//
+// With backport set, every release made on another branch, such as a
+// hotfix on a release branch, opens a pull request bringing its changelog
+// entry and service versions back to that branch; see backportRelease.
+const BranchesFile = "release_branches.json"
+
+// Update policies for a branch.
+const (
+	UpdateAll   = "all"
+	UpdatePatch = "patch"
+)
+
+// BranchesConfig is the content of BranchesFile.
+type BranchesConfig struct {
+	Branches map[string]string `json:"branches"`
+	// Backport is the branch releases on other branches are backported to.
+	Backport string `json:"backport,omitempty"`
+}
+
+func loadBranchesConfig(file string) (*BranchesConfig, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return &BranchesConfig{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var c BranchesConfig
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", file, err)
+	}
+	for pattern, policy := range c.Branches {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s: bad branch pattern %q: %w", file, pattern, err)
+		}
+		if policy != UpdateAll && policy != UpdatePatch {
+			return nil, fmt.Errorf("%s: %s has policy %q, expected %s or %s", file, pattern, policy, UpdateAll, UpdatePatch)
+		}
+	}
+	return &c, nil
+}
+
+// Policy returns the update policy for branch. An exact entry wins over a
+// pattern; if several patterns match, the most restrictive applies.
+func (c *BranchesConfig) Policy(branch string) string {
+	if policy, ok := c.Branches[branch]; ok {
+		return policy
+	}
+	policy := UpdateAll
+	for pattern, p := range c.Branches {
+		if ok, _ := path.Match(pattern, branch); ok && p == UpdatePatch {
+			policy = UpdatePatch
+		}
+	}
+	return policy
+}
+
+// currentBranchPolicy is the policy for the checked-out branch.
+func currentBranchPolicy() (string, error) {
+	c, err := loadBranchesConfig(BranchesFile)
+	if err != nil {
+		return "", err
+	}
+	if len(c.Branches) == 0 {
+		return UpdateAll, nil
+	}
+	branch, err := currentRepo().branch()
+	if err != nil {
+		return "", err
+	}
+	policy := c.Policy(branch)
+	fmt.Printf("Releasing %s updates on %s\n", policy, branch)
+	return policy, nil
+}
+
+// patchConstraint limits updates of version to its patch releases. It
+// returns nil when version isn't a full semver version, as there is nothing
+// to stay within.
+func patchConstraint(version string) *semver.Constraints {
+	v, err := semver.StrictNewVersion(strings.TrimPrefix(version, "v"))
+	if err != nil {
+		return nil
+	}
+	c, err := semver.NewConstraint(fmt.Sprintf("~%d.%d.%d", v.Major(), v.Minor(), v.Patch()))
+	if err != nil {
+		return nil
+	}
+	return c
+}
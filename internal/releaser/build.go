@@ -0,0 +1,135 @@
+package releaser
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// OwnImage is a service image built from this repository.
+type OwnImage struct {
+	// Service is the manifest service name.
+	Service    string
+	Dockerfile string
+}
+
+// OwnImages are the images Build builds and pushes.
+var OwnImages = []OwnImage{
+	{"todo-releaser", "cmd/releaser/Dockerfile"},
+	{"todo-auth-server", "cmd/auth-server/Dockerfile"},
+}
+
+// BuildOptions control Build.
+type BuildOptions struct {
+	// Push pushes the images; without it they are only built locally and
+	// the manifest is left alone.
+	Push bool
+	// Repository is used for services not yet in the manifest, as
+	// <Repository>/<service>. It defaults to DOCKER_USERNAME.
+	Repository string
+}
+
+// RegisterFlags binds o to flags in fs.
+func (o *BuildOptions) RegisterFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&o.Push, "push", false, "push the images, update the manifest and release")
+	fs.StringVar(&o.Repository, "repository", "", "Docker Hub namespace for images not in the manifest (default $DOCKER_USERNAME)")
+}
+
+// Build builds and pushes OwnImages from HEAD, tagged with buildTag and
+// labelled with the commit they were built from, then points the manifest
+// at the new tags and creates a release in the same run.
+func Build(ctx context.Context, opts BuildOptions) error {
+	if err := startRun(); err != nil {
+		return err
+	}
+	if opts.Push {
+		freeze, err := CurrentFreeze(time.Now())
+		if err != nil {
+			return err
+		}
+		if freeze != nil {
+			return fmt.Errorf("releases are frozen: %s", freeze.Reason)
+		}
+	}
+
+	head, err := currentRepo().lookup("HEAD")
+	if err != nil {
+		return err
+	}
+	sha := shortRevision(head.hash)
+	tag := buildTag(head.time, sha)
+
+	m, err := loadManifest()
+	if err != nil {
+		return fmt.Errorf("error loading manifest: %w", err)
+	}
+	if opts.Repository == "" {
+		opts.Repository = os.Getenv("DOCKER_USERNAME")
+	}
+	labels := []string{"--label", LabelRevision + "=" + head.hash}
+	if repo := repositoryURL(); repo != "" {
+		labels = append(labels, "--label", LabelSource+"="+repo)
+	}
+
+	for _, own := range OwnImages {
+		i := serviceIndex(m, own.Service)
+		if i < 0 {
+			if opts.Repository == "" {
+				return fmt.Errorf("%s is not in the manifest; set DOCKER_USERNAME to choose its repository", own.Service)
+			}
+			m.Services = append(m.Services, manifest.Service{Name: own.Service, Image: opts.Repository + "/" + own.Service})
+			i = len(m.Services) - 1
+		}
+		ref := m.Services[i].Image + ":" + tag
+
+		fmt.Printf("Building %s\n", ref)
+		args := append([]string{"build", "-f", own.Dockerfile, "-t", ref}, labels...)
+		if err := runCommand("docker", append(args, ".")...); err != nil {
+			return fmt.Errorf("error building %s: %w", ref, err)
+		}
+		if !opts.Push {
+			continue
+		}
+		if err := runCommand("docker", "push", ref); err != nil {
+			return fmt.Errorf("error pushing %s: %w", ref, err)
+		}
+		m.SetVersion(i, tag, runID, Clock.Now())
+	}
+
+	if !opts.Push {
+		fmt.Println("Images built locally; run with -push to publish them and release.")
+		return nil
+	}
+	_, err = release(ctx, m, IncrementPatch, fmt.Sprintf("chore: build images at %s", sha))
+	return err
+}
+
+// buildTag is the image tag for a commit: the calver week of the commit
+// time (UTC) and the short SHA, so rebuilding the same commit gives the same
+// tag wherever it runs.
+func buildTag(committed time.Time, sha string) string {
+	return calverPrefix(committed.UTC()) + "-" + sha
+}
+
+func serviceIndex(m *manifest.Manifest, name string) int {
+	for i, s := range m.Services {
+		if s.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func runCommand(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	fmt.Printf("Running: %s %s\n", name, strings.Join(args, " "))
+	return cmd.Run()
+}
@@ -0,0 +1,630 @@
+package releaser
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/velann21/todo-releaser/internal/image"
+	"github.com/velann21/todo-releaser/internal/manifest"
+	"github.com/velann21/todo-releaser/internal/provenance"
+)
+
+// A release bundle carries a release to a site with no access to the
+// registries or the repository. It is a tar of:
+//
+//	release_manifest.json      the manifest as the release tagged it
+//	release_manifest.json.sig  its signatures, if the release was signed
+//	config/<path>              each config bundle, as the release tagged it
+//	oci-layout, index.json     the images, as an OCI image layout whose
+//	blobs/sha256/<hex>         index names each by its reference
+//	SHA256SUMS                 the checksum of every other file
+//
+// Images are copied from their registries as they are, every platform of a
+// multi-platform image included, so their digests hold on the site. The
+// manifest is verified on import as RELEASER_MANIFEST_VERIFY asks there,
+// and the config bundles and images against the manifest, so under
+// verification every image has to be pinned by digest.
+
+// ociDescriptor points to a blob or manifest by its digest.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ociManifest is the part of an image manifest or index naming what it
+// needs: a config and layers, or other manifests.
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Config    *ociDescriptor  `json:"config"`
+	Layers    []ociDescriptor `json:"layers"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+// refNameAnnotation names an image of an image layout's index.
+const refNameAnnotation = "org.opencontainers.image.ref.name"
+
+// bundleSums is the checksum file of a release bundle.
+const bundleSums = "SHA256SUMS"
+
+// ExportOptions control Export.
+type ExportOptions struct {
+	// Release is the release tag exported.
+	Release string
+	// Out is the bundle written, <release>.tar unless set.
+	Out string
+}
+
+// RegisterFlags binds o to flags in fs.
+func (o *ExportOptions) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Release, "release", "", "release to export, e.g. v202452.1.0")
+	fs.StringVar(&o.Out, "out", "", "bundle to write (default <release>.tar)")
+}
+
+// Export writes the release opts.Release, its manifest, config bundles and
+// images, as a release bundle for `releaser import -bundle` to apply on a
+// disconnected site. Images are read as for release checks, or, on
+// registries the releaser has no credentials for, anonymously.
+func Export(ctx context.Context, opts ExportOptions) error {
+	if !tagName.MatchString(opts.Release) {
+		return fmt.Errorf("export needs -release, a release tag, not %q", opts.Release)
+	}
+	rev := "refs/tags/" + opts.Release
+	data, err := gitShow(rev, ManifestFile)
+	if err != nil {
+		return fmt.Errorf("no release %s", opts.Release)
+	}
+	if err := verifyManifest(rev, data); err != nil {
+		return err
+	}
+	m, err := manifest.Parse(data)
+	if err != nil {
+		return fmt.Errorf("error reading the manifest of %s: %w", opts.Release, err)
+	}
+	if opts.Out == "" {
+		opts.Out = strings.ReplaceAll(opts.Release, "/", "-") + ".tar"
+	}
+
+	f, err := os.Create(opts.Out)
+	if err != nil {
+		return err
+	}
+	buf := bufio.NewWriter(f)
+	w := &bundleWriter{tw: tar.NewWriter(buf), buf: buf, blobs: map[string]bool{}}
+	err = w.release(ctx, rev, m, data)
+	if err == nil {
+		err = w.close()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(opts.Out)
+		return err
+	}
+	fmt.Printf("Exported %s to %s\n", opts.Release, opts.Out)
+	return nil
+}
+
+// bundleWriter writes a release bundle.
+type bundleWriter struct {
+	tw    *tar.Writer
+	buf   *bufio.Writer
+	sums  strings.Builder
+	blobs map[string]bool
+	index []ociDescriptor
+}
+
+func (w *bundleWriter) release(ctx context.Context, rev string, m *manifest.Manifest, data []byte) error {
+	if err := w.file(ManifestFile, data); err != nil {
+		return err
+	}
+	sigPath := provenance.SignaturePath(ManifestFile)
+	if sigs, err := gitShow(rev, sigPath); err == nil {
+		if err := w.file(sigPath, sigs); err != nil {
+			return err
+		}
+	}
+	for _, s := range m.Services {
+		for _, b := range s.Config {
+			if err := b.Validate(); err != nil {
+				return fmt.Errorf("%s: %w", s.Name, err)
+			}
+			content, err := gitShow(rev, b.Path)
+			if err != nil {
+				return err
+			}
+			if manifest.HashConfig(content) != b.Hash {
+				return fmt.Errorf("config %s of %s does not match its hash", b.Path, s.Name)
+			}
+			if err := w.file("config/"+b.Path, content); err != nil {
+				return err
+			}
+		}
+	}
+	exported := map[string]bool{}
+	for _, s := range m.Services {
+		if ref := s.Ref(); !exported[ref] {
+			fmt.Printf("Exporting %s\n", ref)
+			if err := w.image(ctx, s); err != nil {
+				return fmt.Errorf("error exporting %s: %w", ref, err)
+			}
+			exported[ref] = true
+		}
+	}
+	layout, _ := json.Marshal(map[string]string{"imageLayoutVersion": "1.0.0"})
+	if err := w.file("oci-layout", layout); err != nil {
+		return err
+	}
+	index, err := json.MarshalIndent(map[string]any{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.index.v1+json", "manifests": w.index}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return w.file("index.json", index)
+}
+
+// image copies s's image into the bundle and names it in the index.
+func (w *bundleWriter) image(ctx context.Context, s manifest.Service) error {
+	r, err := image.Parse(s.Image)
+	if err != nil {
+		return err
+	}
+	var c *registryClient
+	if r.IsDockerHub() {
+		c, err = dockerHubRegistry(ctx, r)
+	} else if c, _, err = nativeRegistry(ctx, r); c == nil && err == nil {
+		c, err = newRegistryClient(ctx, r.Registry, r.Repository, "pull", "", "")
+	}
+	if err != nil {
+		return err
+	}
+	// Blobs take as long as they take, and as many requests.
+	copied := *c
+	copied.http = &http.Client{Transport: bulkTransport(registryHTTP.Transport)}
+	c = &copied
+	reference := s.Version
+	if d := s.Digest(); d != "" {
+		reference = d
+	}
+	d, err := w.manifest(ctx, c, reference)
+	if err != nil {
+		return err
+	}
+	d.Annotations = map[string]string{refNameAnnotation: s.Ref()}
+	w.index = append(w.index, d)
+	return nil
+}
+
+// manifest copies the manifest or index of reference, and all it needs,
+// into the bundle and returns its descriptor.
+func (w *bundleWriter) manifest(ctx context.Context, c *registryClient, reference string) (ociDescriptor, error) {
+	data, mediaType, err := c.rawManifest(ctx, reference)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	sum := sha256.Sum256(data)
+	d := ociDescriptor{MediaType: mediaType, Digest: "sha256:" + hex.EncodeToString(sum[:]), Size: int64(len(data))}
+	if strings.HasPrefix(reference, "sha256:") && reference != d.Digest {
+		return ociDescriptor{}, fmt.Errorf("registry served %s for %s", d.Digest, reference)
+	}
+	var m ociManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return ociDescriptor{}, fmt.Errorf("manifest %s: %w", d.Digest, err)
+	}
+	if d.MediaType == "" {
+		d.MediaType = m.MediaType
+	}
+	for _, child := range m.Manifests {
+		if _, err := w.manifest(ctx, c, child.Digest); err != nil {
+			return ociDescriptor{}, err
+		}
+	}
+	blobs := m.Layers
+	if m.Config != nil {
+		blobs = append(blobs, *m.Config)
+	}
+	for _, b := range blobs {
+		if err := w.blob(ctx, c, b); err != nil {
+			return ociDescriptor{}, err
+		}
+	}
+	if !w.blobs[d.Digest] {
+		if err := w.file(blobPath(d.Digest), data); err != nil {
+			return ociDescriptor{}, err
+		}
+		w.blobs[d.Digest] = true
+	}
+	return d, nil
+}
+
+// blob copies the blob d into the bundle, checking its digest.
+func (w *bundleWriter) blob(ctx context.Context, c *registryClient, d ociDescriptor) error {
+	if w.blobs[d.Digest] {
+		return nil
+	}
+	if !strings.HasPrefix(d.Digest, "sha256:") {
+		return fmt.Errorf("blob %s is not a sha256 digest", d.Digest)
+	}
+	body, err := c.blob(ctx, d.Digest)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	name := blobPath(d.Digest)
+	if err := w.tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: d.Size}); err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(w.tw, io.TeeReader(io.LimitReader(body, d.Size), h)); err != nil {
+		return fmt.Errorf("blob %s: %w", d.Digest, err)
+	}
+	if got := "sha256:" + hex.EncodeToString(h.Sum(nil)); got != d.Digest {
+		return fmt.Errorf("registry served %s for blob %s", got, d.Digest)
+	}
+	fmt.Fprintf(&w.sums, "%s  %s\n", strings.TrimPrefix(d.Digest, "sha256:"), name)
+	w.blobs[d.Digest] = true
+	return nil
+}
+
+// file writes name to the bundle.
+func (w *bundleWriter) file(name string, data []byte) error {
+	if err := w.tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}); err != nil {
+		return err
+	}
+	if _, err := w.tw.Write(data); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	fmt.Fprintf(&w.sums, "%x  %s\n", sum, name)
+	return nil
+}
+
+// close writes the checksums and ends the bundle.
+func (w *bundleWriter) close() error {
+	sums := w.sums.String()
+	if err := w.tw.WriteHeader(&tar.Header{Name: bundleSums, Mode: 0644, Size: int64(len(sums))}); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w.tw, sums); err != nil {
+		return err
+	}
+	if err := w.tw.Close(); err != nil {
+		return err
+	}
+	return w.buf.Flush()
+}
+
+func blobPath(digest string) string {
+	return "blobs/sha256/" + strings.TrimPrefix(digest, "sha256:")
+}
+
+// importBundle loads the images of the release bundle opts.Bundle into the
+// registry opts.Registry, as RELEASER_IMPORT_USERNAME with
+// RELEASER_IMPORT_PASSWORD if it needs credentials, and applies the
+// release: its config bundles are written to their paths, its manifest,
+// with the images moved to opts.Registry, to opts.Out, and it is deployed
+// with the deploy hooks configured here (see deployRelease).
+func importBundle(ctx context.Context, opts ImportOptions) (*manifest.Manifest, error) {
+	if opts.Registry == "" {
+		return nil, errors.New("import -bundle needs -registry, the registry to load the images into")
+	}
+	if opts.Out == "-" {
+		return nil, errors.New("import -bundle writes the manifest to a file, not -")
+	}
+	dir, err := os.MkdirTemp("", "release-bundle-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if err := extractBundle(opts.Bundle, dir); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyBundleManifest(dir, data); err != nil {
+		return nil, err
+	}
+	m, err := manifest.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	// SHA256SUMS only catches damage on the way: it isn't signed, so what
+	// the bundle carries is checked against the manifest, which is, before
+	// any of it is loaded.
+	if err := checkBundleConfig(dir, m); err != nil {
+		return nil, err
+	}
+	images, err := bundleImages(dir, m)
+	if err != nil {
+		return nil, err
+	}
+	for _, img := range images {
+		r, err := image.Parse(img.ref)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("Loading %s into %s\n", img.ref, opts.Registry)
+		c, err := newRegistryClient(ctx, opts.Registry, r.Repository, "pull,push", os.Getenv("RELEASER_IMPORT_USERNAME"), os.Getenv("RELEASER_IMPORT_PASSWORD"))
+		if err != nil {
+			return nil, err
+		}
+		c.http.Transport = bulkTransport(c.http.Transport)
+		reference := r.Tag
+		if reference == "" {
+			reference = img.d.Digest
+		}
+		if err := pushBundleManifest(ctx, c, dir, img.d, reference); err != nil {
+			return nil, fmt.Errorf("error loading %s: %w", img.ref, err)
+		}
+	}
+
+	for i := range m.Services {
+		s := &m.Services[i]
+		r, err := image.Parse(s.Image)
+		if err != nil {
+			return nil, err
+		}
+		s.Image = opts.Registry + "/" + r.Repository
+		if r.Digest != "" {
+			s.Image += "@" + r.Digest
+		}
+		for _, b := range s.Config {
+			if err := b.Validate(); err != nil {
+				return nil, fmt.Errorf("%s: %w", s.Name, err)
+			}
+			content, err := os.ReadFile(filepath.Join(dir, "config", filepath.FromSlash(b.Path)))
+			if err != nil {
+				return nil, err
+			}
+			if err := os.MkdirAll(filepath.Dir(filepath.FromSlash(b.Path)), 0755); err != nil {
+				return nil, err
+			}
+			if err := os.WriteFile(filepath.FromSlash(b.Path), content, 0644); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if opts.Out == "" {
+		opts.Out = ManifestFile
+	}
+	if err := manifest.Save(opts.Out, m); err != nil {
+		return nil, err
+	}
+	fmt.Printf("Imported %s into %s; applying it\n", m.ReleaseVersion, opts.Registry)
+	if err := deployRelease(ctx, m); err != nil {
+		return m, fmt.Errorf("error deploying %s: %w", m.ReleaseVersion, err)
+	}
+	return m, nil
+}
+
+// verifyBundleManifest checks data, the manifest of the bundle extracted to
+// dir, as RELEASER_MANIFEST_VERIFY asks: under signature verification,
+// against the signatures the bundle carries. Commit verification needs the
+// repository, which bundles leave behind, so it refuses them.
+func verifyBundleManifest(dir string, data []byte) error {
+	mode, err := manifestVerifyMode()
+	if err != nil || mode == "" {
+		return err
+	}
+	if mode == ManifestVerifyCommit {
+		return fmt.Errorf("%s of a bundle can't be verified by its commit; verify bundles by signature", ManifestFile)
+	}
+	var sigs []provenance.Signature
+	sigData, err := os.ReadFile(filepath.Join(dir, provenance.SignaturePath(ManifestFile)))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(sigData, &sigs); err != nil {
+			return fmt.Errorf("error parsing %s: %w", provenance.SignaturePath(ManifestFile), err)
+		}
+	}
+	return checkManifestSignatures(data, sigs)
+}
+
+// checkBundleConfig checks that every config bundle m names is in the
+// bundle in dir as m hashes it.
+func checkBundleConfig(dir string, m *manifest.Manifest) error {
+	for _, s := range m.Services {
+		for _, b := range s.Config {
+			if err := b.Validate(); err != nil {
+				return fmt.Errorf("%s: %w", s.Name, err)
+			}
+			content, err := os.ReadFile(filepath.Join(dir, "config", filepath.FromSlash(b.Path)))
+			if err != nil {
+				return err
+			}
+			if manifest.HashConfig(content) != b.Hash {
+				return fmt.Errorf("config %s of %s does not match its hash", b.Path, s.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// bundleImage is an image of a bundle's index, by the reference it is
+// loaded as.
+type bundleImage struct {
+	ref string
+	d   ociDescriptor
+}
+
+// bundleImages returns the image of each service of m from the index of
+// the bundle in dir. The index must name the images of m's services and
+// nothing else, and each must be the digest m pins it at. An image m
+// pins by tag alone can't be tied to m, so under manifest verification it
+// is refused.
+func bundleImages(dir string, m *manifest.Manifest) ([]bundleImage, error) {
+	mode, err := manifestVerifyMode()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	var index ociManifest
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("index.json: %w", err)
+	}
+	byRef := map[string]ociDescriptor{}
+	for _, d := range index.Manifests {
+		byRef[d.Annotations[refNameAnnotation]] = d
+	}
+	var images []bundleImage
+	seen := map[string]bool{}
+	for _, s := range m.Services {
+		ref := s.Ref()
+		if seen[ref] {
+			continue
+		}
+		seen[ref] = true
+		d, ok := byRef[ref]
+		switch digest := s.Digest(); {
+		case !ok:
+			return nil, fmt.Errorf("bundle has no image for %s", ref)
+		case digest != "" && d.Digest != digest:
+			return nil, fmt.Errorf("bundle has %s for %s, not the digest %s pins it at", d.Digest, ref, ManifestFile)
+		case digest == "" && mode != "":
+			return nil, fmt.Errorf("%s runs %s, pinned by tag alone, so its image can't be verified; pin it by digest", s.Name, ref)
+		}
+		images = append(images, bundleImage{ref, d})
+	}
+	for ref := range byRef {
+		if !seen[ref] {
+			return nil, fmt.Errorf("index.json names %q, which no service of %s runs", ref, ManifestFile)
+		}
+	}
+	return images, nil
+}
+
+// pushBundleManifest uploads the manifest or index d of the bundle in dir,
+// and all it needs, as reference.
+func pushBundleManifest(ctx context.Context, c *registryClient, dir string, d ociDescriptor, reference string) error {
+	data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(blobPath(d.Digest))))
+	if err != nil {
+		return err
+	}
+	// The registry checks the digest of blobs and of manifests pushed by
+	// digest, but takes a tag's for whatever it is sent.
+	if sum := sha256.Sum256(data); "sha256:"+hex.EncodeToString(sum[:]) != d.Digest {
+		return fmt.Errorf("manifest %s does not match its digest", d.Digest)
+	}
+	var m ociManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("manifest %s: %w", d.Digest, err)
+	}
+	for _, child := range m.Manifests {
+		if err := pushBundleManifest(ctx, c, dir, child, child.Digest); err != nil {
+			return err
+		}
+	}
+	blobs := m.Layers
+	if m.Config != nil {
+		blobs = append(blobs, *m.Config)
+	}
+	for _, b := range blobs {
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(blobPath(b.Digest))))
+		if err != nil {
+			return err
+		}
+		err = c.pushBlob(ctx, b.Digest, b.Size, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	mediaType := d.MediaType
+	if mediaType == "" {
+		mediaType = m.MediaType
+	}
+	return c.pushManifest(ctx, reference, mediaType, data)
+}
+
+// extractBundle extracts the release bundle at name into dir, checking
+// every file against the bundle's checksums.
+func extractBundle(name, dir string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	got := map[string]string{}
+	var sums []byte
+	tr := tar.NewReader(bufio.NewReader(f))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", name, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if !fs.ValidPath(hdr.Name) {
+			return fmt.Errorf("%s has a file outside the bundle: %q", name, hdr.Name)
+		}
+		if hdr.Name == bundleSums {
+			if sums, err = io.ReadAll(tr); err != nil {
+				return err
+			}
+			continue
+		}
+		dst := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		out, err := os.Create(dst)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		_, err = io.Copy(io.MultiWriter(out, h), tr)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		got[hdr.Name] = hex.EncodeToString(h.Sum(nil))
+	}
+	if sums == nil {
+		return fmt.Errorf("%s has no %s; is it a release bundle?", name, bundleSums)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(sums)), "\n") {
+		sum, file, ok := strings.Cut(line, "  ")
+		if !ok {
+			return fmt.Errorf("%s: malformed line %q", bundleSums, line)
+		}
+		if got[file] != sum {
+			return fmt.Errorf("%s of %s does not match its checksum", file, name)
+		}
+		delete(got, file)
+	}
+	for file := range got {
+		return fmt.Errorf("%s of %s has no checksum", file, name)
+	}
+	if !fileExists(filepath.Join(dir, ManifestFile)) {
+		return fmt.Errorf("%s has no %s", name, ManifestFile)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package releaser
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ClockSource tells the time versions are generated at.
+type ClockSource interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// Clock is the time releases are versioned by. Tests replace it.
+var Clock ClockSource = systemClock{}
+
+// releaseLocation is the timezone release weeks are counted in:
+// RELEASER_TIMEZONE (an IANA name such as Europe/Berlin), or UTC, so that
+// runs from different machines agree on the week.
+func releaseLocation() (*time.Location, error) {
+	name := os.Getenv("RELEASER_TIMEZONE")
+	if name == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("RELEASER_TIMEZONE: %w", err)
+	}
+	return loc, nil
+}
+
+// namespaceName restricts RELEASER_TAG_NAMESPACE to a single path segment.
+var namespaceName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// tagNamespace is what release tags are prefixed with: RELEASER_TAG_NAMESPACE
+// and a slash, e.g. todo/ for todo/v202452.1.0, or "" when it is unset.
+// Products that share a repository each set their own, and keep their own
+// release sequence.
+func tagNamespace() (string, error) {
+	name := os.Getenv("RELEASER_TAG_NAMESPACE")
+	if name == "" {
+		return "", nil
+	}
+	if !namespaceName.MatchString(name) {
+		return "", fmt.Errorf("RELEASER_TAG_NAMESPACE: %q must be letters, digits, '.', '_' and '-'", name)
+	}
+	return name + "/", nil
+}
+
+// calverPrefix is the vYYYYWW prefix of releases made at t, e.g. v202452.
+// YYYY is the ISO week-numbering year, not the calendar year: 29-31
+// December can be in week 01 of the next year, and 1-3 January in week 52
+// or 53 of the previous one, so the prefix never goes backwards at New
+// Year.
+func calverPrefix(t time.Time) string {
+	year, week := t.ISOWeek()
+	return fmt.Sprintf("v%d%02d", year, week)
+}
+
+// nextVersion is the release after the latest of tags with prefix, e.g.
+// v202452 or todo/v202452: the next minor version for a minor or major
+// increment, else the next patch.
+func nextVersion(prefix string, tags []string, incType IncrementType) string {
+	type version struct {
+		minor, patch int
+	}
+	var versions []version
+
+	for _, tag := range tags {
+		if rest, ok := strings.CutPrefix(tag, prefix+"."); ok {
+			// Parse Minor.Patch, skipping tags that only look like
+			// releases, such as v202452.1.0-rc or v202452.-1.0.
+			parts := strings.Split(rest, ".")
+			if len(parts) == 2 {
+				m, err1 := versionNumber(parts[0])
+				p, err2 := versionNumber(parts[1])
+
+				if err1 == nil && err2 == nil {
+					versions = append(versions, version{m, p})
+				}
+			}
+		}
+	}
+
+	// Sort versions to find the latest
+	sort.Slice(versions, func(i, j int) bool {
+		if versions[i].minor != versions[j].minor {
+			return versions[i].minor < versions[j].minor
+		}
+		return versions[i].patch < versions[j].patch
+	})
+
+	currentMinor := 0
+	currentPatch := -1 // So that if no tags exist, we start at 0
+
+	if len(versions) > 0 {
+		last := versions[len(versions)-1]
+		currentMinor = last.minor
+		currentPatch = last.patch
+	}
+
+	newMinor := currentMinor
+	newPatch := currentPatch
+
+	if incType == IncrementMinor || incType == IncrementMajor {
+		newMinor++
+		newPatch = 0
+	} else {
+		newPatch++
+	}
+
+	return fmt.Sprintf("%s.%d.%d", prefix, newMinor, newPatch)
+}
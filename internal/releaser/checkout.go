@@ -0,0 +1,191 @@
+package releaser
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// A managed checkout lets the releaser run with only a repository URL,
+// e.g. server-side on the control plane, instead of inside a checkout. It
+// is configured from the environment:
+//
+//	RELEASER_REPO_URL     URL of the repository; unset disables it
+//	RELEASER_REPO_BRANCH  branch to release from, default the remote's default branch
+//	RELEASER_REPO_DIR     where the clone is kept, default <state dir>/repo
+//	RELEASER_GIT_TOKEN    token for fetching and pushing, default GITHUB_TOKEN or
+//	                      the GitHub App's (see githubToken)
+//
+// The repository is cloned bare into RELEASER_REPO_DIR/repo.git once, with
+// a detached worktree in RELEASER_REPO_DIR/worktree that the releaser
+// works in. Every run fetches and resets the worktree to the branch, so
+// nothing is left over from the last one, and releases are pushed as soon
+// as they are tagged. Commits are made as "releaser" unless GIT_AUTHOR_NAME
+// and friends say otherwise. With gitInMemory, as in Lambda mode, go-git
+// clones the repository into memory instead, with only the worktree on
+// disk, and the releaser works on it with go-git (see gitRepo).
+type checkout struct {
+	url, branch, dir string
+}
+
+var (
+	checkoutMu sync.Mutex
+	managed    *checkout
+)
+
+func (c *checkout) bare() string     { return filepath.Join(c.dir, "repo.git") }
+func (c *checkout) worktree() string { return filepath.Join(c.dir, "worktree") }
+
+// syncCheckout brings the managed checkout, if any, up to date with the
+// remote and makes it the working directory. The first call clones it.
+func syncCheckout() error {
+	checkoutMu.Lock()
+	defer checkoutMu.Unlock()
+	if managed == nil {
+		c, err := openCheckout()
+		if err != nil {
+			return err
+		}
+		if c == nil {
+			// A checkout of its own authenticates as it is configured to,
+			// unless the releaser is a GitHub App.
+			if githubAppConfigured() {
+				setGitConfig(&url.URL{Scheme: "https", Host: "github.com"}, false)
+			}
+			return nil
+		}
+		managed = c
+	} else {
+		// Installation tokens expire within the hour and the git token may
+		// have been rotated.
+		u, err := url.Parse(managed.url)
+		if err != nil {
+			return err
+		}
+		setGitConfig(u, true)
+	}
+	return managed.sync()
+}
+
+// openCheckout clones the repository unless it already is.
+func openCheckout() (*checkout, error) {
+	repo := os.Getenv("RELEASER_REPO_URL")
+	if repo == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(repo)
+	if err != nil || u.Scheme == "" {
+		return nil, fmt.Errorf("RELEASER_REPO_URL: %q is not a URL", repo)
+	}
+
+	// The state dir is relative to the working directory, which is about to
+	// become the worktree.
+	state, err := filepath.Abs(StateDir())
+	if err != nil {
+		return nil, err
+	}
+	os.Setenv("RELEASER_STATE_DIR", state)
+	c := &checkout{url: repo, branch: os.Getenv("RELEASER_REPO_BRANCH"), dir: os.Getenv("RELEASER_REPO_DIR")}
+	if c.dir == "" {
+		c.dir = filepath.Join(state, "repo")
+	}
+	if c.dir, err = filepath.Abs(c.dir); err != nil {
+		return nil, err
+	}
+	setGitConfig(u, true)
+
+	if gitInMemory {
+		fmt.Printf("Cloning %s into memory\n", u.Redacted())
+		if memRepo, err = cloneInMemory(context.Background(), u, c.worktree()); err != nil {
+			return nil, err
+		}
+		if c.branch == "" {
+			if c.branch, err = memRepo.defaultBranch(); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		if _, err := os.Stat(c.bare()); errors.Is(err, os.ErrNotExist) {
+			fmt.Printf("Cloning %s into %s\n", u.Redacted(), c.bare())
+			if err := os.MkdirAll(c.dir, 0700); err != nil {
+				return nil, err
+			}
+			if err := runGitCommand("clone", "--bare", repo, c.bare()); err != nil {
+				return nil, err
+			}
+			if err := runGitCommand("--git-dir", c.bare(), "config", "remote.origin.fetch", "+refs/heads/*:refs/heads/*"); err != nil {
+				return nil, err
+			}
+		}
+		if c.branch == "" {
+			if c.branch, err = gitOutput("--git-dir", c.bare(), "symbolic-ref", "--short", "HEAD"); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := os.Stat(c.worktree()); errors.Is(err, os.ErrNotExist) {
+			if err := runGitCommand("--git-dir", c.bare(), "worktree", "add", "--detach", c.worktree(), c.branch); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := os.Chdir(c.worktree()); err != nil {
+		return nil, err
+	}
+	fmt.Printf("Releasing %s from %s\n", c.branch, c.worktree())
+	return c, nil
+}
+
+// sync fetches the remote, dropping local tags it doesn't have, such as
+// those of releases that failed to push, and resets the worktree to the
+// branch.
+func (c *checkout) sync() error {
+	return currentRepo().sync(context.Background(), c.branch)
+}
+
+// setGitConfig passes git the token for the repository's host and, with
+// identity, a default committer identity, through the environment so they
+// never land in the clone's config.
+func setGitConfig(u *url.URL, identity bool) {
+	var config [][2]string
+	if identity {
+		config = append(config, [2]string{"user.name", "releaser"}, [2]string{"user.email", "releaser@localhost"})
+	}
+	if token := gitToken(); token != "" && u.Scheme == "https" {
+		basic := base64.StdEncoding.EncodeToString([]byte("x-access-token:" + token))
+		config = append(config, [2]string{"http.https://" + u.Host + "/.extraHeader", "Authorization: Basic " + basic})
+	}
+	os.Setenv("GIT_CONFIG_COUNT", strconv.Itoa(len(config)))
+	for i, kv := range config {
+		os.Setenv("GIT_CONFIG_KEY_"+strconv.Itoa(i), kv[0])
+		os.Setenv("GIT_CONFIG_VALUE_"+strconv.Itoa(i), kv[1])
+	}
+}
+
+// gitToken is the token git authenticates to the repository with:
+// RELEASER_GIT_TOKEN, else GITHUB_TOKEN or the GitHub App's, else "".
+func gitToken() string {
+	token := os.Getenv("RELEASER_GIT_TOKEN")
+	if token == "" && (githubAppConfigured() || os.Getenv("GITHUB_TOKEN") != "") {
+		var err error
+		if token, err = githubToken(); err != nil {
+			fmt.Printf("Not authenticating git: %v\n", err)
+		}
+	}
+	return token
+}
+
+// pushRelease publishes a release tagged in the managed checkout to its
+// branch. Without a managed checkout publishing is left to the operator.
+func pushRelease(ctx context.Context, version string) error {
+	if managed == nil {
+		fmt.Println("Release created locally. Run 'git push --tags origin master' to publish.")
+		return nil
+	}
+	return currentRepo().push(ctx, false, "HEAD:refs/heads/"+managed.branch, "refs/tags/"+version)
+}
@@ -0,0 +1,176 @@
+package releaser
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// CheckEvent is one step of a check run streamed by POST /checks:
+//
+//	queued   the check waits for the reconcile or operation in progress
+//	started  the registries are being asked about Total services
+//	service  Service was checked, the Done'th of Total
+//	done     every service was checked; Updates counts those behind
+//	error    the check failed with Error
+type CheckEvent struct {
+	Type    string        `json:"type"`
+	Total   int           `json:"total"`
+	Done    int           `json:"done"`
+	Updates int           `json:"updates"`
+	Service *ServiceCheck `json:"service,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// ServiceCheck is what a check found for one service.
+type ServiceCheck struct {
+	Name    string `json:"name"`
+	Current string `json:"current"`
+	Latest  string `json:"latest,omitempty"`
+	Update  bool   `json:"update"`
+	// Skipped is set for services the release policy or the Renovate config
+	// doesn't update.
+	Skipped bool `json:"skipped,omitempty"`
+	// Reason says why the service was skipped or its update held back.
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Failure is the category of Error, such as rate-limited, and Registry
+	// the registry the check failed at.
+	Failure  string `json:"failure,omitempty"`
+	Registry string `json:"registry,omitempty"`
+}
+
+// Check event types.
+const (
+	CheckQueued  = "queued"
+	CheckStarted = "started"
+	CheckService = "service"
+	CheckDone    = "done"
+	CheckError   = "error"
+)
+
+// runCheck asks the registries for the latest version of every service,
+// without releasing anything, and sends each outcome as it comes in. It
+// stops sending, and starts no more lookups, once send returns false.
+func runCheck(ctx context.Context, send func(CheckEvent) bool) {
+	if err := startRun(); err != nil {
+		send(CheckEvent{Type: CheckError, Error: err.Error()})
+		return
+	}
+	m, err := loadManifest()
+	if err != nil {
+		send(CheckEvent{Type: CheckError, Error: fmt.Sprintf("error loading manifest: %v", err)})
+		return
+	}
+	policy, err := currentBranchPolicy()
+	if err != nil {
+		send(CheckEvent{Type: CheckError, Error: err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	total := len(m.Services)
+	if !send(CheckEvent{Type: CheckStarted, Total: total}) {
+		return
+	}
+	var mu sync.Mutex
+	checked, updates := 0, 0
+	lookupServices(ctx, m, policy, nil, func(i int, l serviceLookup) {
+		s := m.Services[i]
+		sc := &ServiceCheck{Name: s.Name, Current: currentVersion(s), Latest: l.tag, Skipped: l.skipped != "", Reason: l.skipped}
+		if l.err != nil {
+			sc.fail(s.Image, l.err)
+		} else {
+			sc.Update = l.update(s)
+		}
+
+		// Sends are serialized so Done counts up in the order events arrive.
+		mu.Lock()
+		defer mu.Unlock()
+		checked++
+		if sc.Update {
+			updates++
+		}
+		if !send(CheckEvent{Type: CheckService, Total: total, Done: checked, Updates: updates, Service: sc}) {
+			cancel()
+		}
+	})
+	if ctx.Err() == nil {
+		send(CheckEvent{Type: CheckDone, Total: total, Done: checked, Updates: updates})
+	}
+}
+
+// handleChecks starts a check run and streams its progress, so a dashboard
+// can show services coming in as registries answer rather than wait for
+// the whole run. Events are sent as server-sent events when the client
+// accepts text/event-stream and as newline-delimited JSON otherwise. The
+// check is queued behind any reconcile in progress, and abandoned when the
+// client goes away.
+func handleChecks(token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+		sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+		if sse {
+			w.Header().Set("Content-Type", "text/event-stream")
+		} else {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+
+		ctx := r.Context()
+		events := make(chan CheckEvent)
+		send := func(e CheckEvent) bool {
+			select {
+			case events <- e:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		go func() {
+			select {
+			case operations <- func(context.Context, *Status) {
+				defer close(events)
+				if ctx.Err() == nil {
+					runCheck(ctx, send)
+				}
+			}:
+			case <-ctx.Done():
+			}
+		}()
+
+		write := func(e CheckEvent) {
+			data, _ := json.Marshal(e)
+			if sse {
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+			} else {
+				fmt.Fprintf(w, "%s\n", data)
+			}
+			flusher.Flush()
+		}
+		write(CheckEvent{Type: CheckQueued})
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					return
+				}
+				write(e)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package releaser
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// configChanges hashes the config bundles of m's services, recording in m
+// the new hash of each bundle that changed since the last release, and
+// returns a change for each.
+func configChanges(m *manifest.Manifest) ([]Change, error) {
+	var changes []Change
+	for i := range m.Services {
+		s := &m.Services[i]
+		for j := range s.Config {
+			b := &s.Config[j]
+			if err := b.Validate(); err != nil {
+				return nil, fmt.Errorf("%s: %w", s.Name, err)
+			}
+			data, err := os.ReadFile(filepath.FromSlash(b.Path))
+			if err != nil {
+				return nil, fmt.Errorf("error reading the config of %s: %w", s.Name, err)
+			}
+			hash := manifest.HashConfig(data)
+			if hash == b.Hash {
+				continue
+			}
+			fmt.Printf("Config %s of %s changed\n", b.Path, s.Name)
+			c := Change{Service: s.Name, Config: b.Path, To: shortDigest(hash)}
+			if b.Hash != "" {
+				c.From = shortDigest(b.Hash)
+			}
+			changes = append(changes, c)
+			b.Hash = hash
+		}
+	}
+	return changes, nil
+}
+
+// restoreConfig checks out the config bundles of prev, the manifest of the
+// release tag, as tag has them, staging them for the commit of a rollback.
+func restoreConfig(ctx context.Context, tag string, prev *manifest.Manifest) error {
+	var paths []string
+	for _, s := range prev.Services {
+		for _, b := range s.Config {
+			if err := b.Validate(); err != nil {
+				return fmt.Errorf("%s: %w", s.Name, err)
+			}
+			paths = append(paths, b.Path)
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	return currentRepo().restore(ctx, tag, paths...)
+}
+
+// handleConfig serves a config bundle as a release tagged it, for
+// ?release=<tag>&path=<path>. Only the files the release's manifest lists
+// as bundles are served, and only with the hash it records.
+func handleConfig(w http.ResponseWriter, r *http.Request) {
+	tag, path := r.URL.Query().Get("release"), r.URL.Query().Get("path")
+	if !tagName.MatchString(tag) {
+		http.Error(w, "invalid tag", http.StatusBadRequest)
+		return
+	}
+	data, err := gitShow("refs/tags/"+tag, ManifestFile)
+	if err != nil {
+		http.Error(w, "no release "+tag, http.StatusNotFound)
+		return
+	}
+	if err := verifyManifest("refs/tags/"+tag, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var m manifest.Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var hash string
+	for _, s := range m.Services {
+		for _, b := range s.Config {
+			if b.Path == path && b.Validate() == nil {
+				hash = b.Hash
+			}
+		}
+	}
+	if hash == "" {
+		http.Error(w, fmt.Sprintf("%s has no config %q", tag, path), http.StatusNotFound)
+		return
+	}
+	content, err := gitShow("refs/tags/"+tag, path)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s has no config %q", tag, path), http.StatusNotFound)
+		return
+	}
+	if manifest.HashConfig(content) != hash {
+		http.Error(w, fmt.Sprintf("config %s of %s does not match its hash", path, tag), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "public, max-age=86400, immutable")
+	w.Write(content)
+}
@@ -0,0 +1,173 @@
+package releaser
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/agent"
+	"github.com/velann21/todo-releaser/internal/manifest"
+	"github.com/velann21/todo-releaser/internal/provenance"
+)
+
+// deployTimeout bounds the deploy webhook request.
+const deployTimeout = 30 * time.Second
+
+// deployRelease hands a freshly tagged release to the deployment step so the
+// app stack rolls out the manifest's versions. All hooks are optional:
+//
+//   - RELEASER_DEPLOY_WEBHOOK, or the manifest's deploy_webhook secret, is
+//     POSTed the manifest as JSON.
+//   - RELEASER_DEPLOY_COMMAND is run with sh, with RELEASE_VERSION and
+//     RELEASE_MANIFEST set, e.g. `todoctl deploy -manifest "$RELEASE_MANIFEST"`,
+//     and RELEASE_ATTESTATION when the release was signed.
+//   - the Docker engines of RELEASER_DEPLOY_DOCKER_HOSTS, comma-separated
+//     DOCKER_HOSTs such as ssh://deploy@10.1.0.20, have their compose
+//     services recreated on the release's images (see agent.DeployEngine),
+//     for hosts that run neither the playbook nor the deploy agent.
+//   - deploy hook plugins (see RELEASER_PLUGINS) are called with the manifest.
+//
+// Each hook gets the rollout's idempotency key, agent.IdempotencyKey: the
+// webhook as its Idempotency-Key header, the command as
+// RELEASE_IDEMPOTENCY_KEY and plugins as idempotency_key. The key is the
+// same each time the release is deployed, and the same the deploy agents
+// journal their rollouts of it under, so a hook run again after a failure
+// can tell the steps it already took from new work.
+//
+// With RELEASER_DEPLOY_ENVIRONMENT set the rollout is recorded as that
+// environment's status, alongside the agents' reports. The rollout is
+// announced on the status page (see beginMaintenance) and, when it
+// succeeds, published as a deploy-succeeded event (see RELEASER_EVENTS).
+// A failed rollout pages (see pageRelease). The hooks are stopped when ctx
+// is done or RELEASER_DEPLOY_TIMEOUT passes, which fails the rollout.
+func deployRelease(ctx context.Context, m *manifest.Manifest) error {
+	ctx, cancel := context.WithTimeout(ctx, phaseTimeout("RELEASER_DEPLOY_TIMEOUT", DefaultDeployTimeout))
+	defer cancel()
+	recordDeploy(m.ReleaseVersion, agent.StateDeploying, nil)
+	mt := beginMaintenance(m)
+	err := runDeployHooks(ctx, m)
+	mt.end(m, err)
+	state := agent.StateDeployed
+	if err != nil {
+		state = agent.StateFailed
+		pageRelease(m, m.ReleaseVersion, "deploy", pagerDutyError, fmt.Sprintf("Rollout of %s failed: %v", m.ReleaseVersion, err),
+			map[string]string{"error": err.Error()})
+	}
+	recordDeploy(m.ReleaseVersion, state, err)
+	if err == nil {
+		publishEvent(LifecycleEvent{Type: EventDeploySucceeded, Version: m.ReleaseVersion})
+	}
+	return err
+}
+
+func runDeployHooks(ctx context.Context, m *manifest.Manifest) error {
+	if url := deployWebhookURL(m); url != "" {
+		fmt.Printf("Notifying deploy webhook of %s\n", m.ReleaseVersion)
+		if err := postDeployWebhook(ctx, url, m); err != nil {
+			return err
+		}
+	}
+
+	if command := os.Getenv("RELEASER_DEPLOY_COMMAND"); command != "" {
+		fmt.Printf("Running deploy command for %s\n", m.ReleaseVersion)
+		cmd := exec.CommandContext(ctx, "sh", "-c", command)
+		cmd.Env = append(os.Environ(), deployCommandEnv(m)...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+		cmd.WaitDelay = stopDelay
+		if err := cmd.Run(); err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("deploy command: %w", context.Cause(ctx))
+			}
+			return fmt.Errorf("deploy command: %w", err)
+		}
+	}
+	for _, host := range deployDockerHosts() {
+		fmt.Printf("Deploying %s to %s over the Docker API\n", m.ReleaseVersion, host)
+		recreated, err := agent.DeployEngine(ctx, host, m)
+		if err != nil {
+			return fmt.Errorf("deploying to %s: %w", host, err)
+		}
+		if len(recreated) == 0 {
+			fmt.Printf("%s already runs %s\n", host, m.ReleaseVersion)
+		}
+	}
+	return deployPlugins(ctx, m)
+}
+
+// deployDockerHosts returns the engines of RELEASER_DEPLOY_DOCKER_HOSTS.
+func deployDockerHosts() []string {
+	var hosts []string
+	for _, host := range strings.Split(os.Getenv("RELEASER_DEPLOY_DOCKER_HOSTS"), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+func deployWebhookURL(m *manifest.Manifest) string {
+	if url := os.Getenv("RELEASER_DEPLOY_WEBHOOK"); url != "" {
+		return url
+	}
+	return m.Secret("deploy_webhook")
+}
+
+// deployCommandEnv is what RELEASER_DEPLOY_COMMAND gets on top of the
+// releaser's environment.
+func deployCommandEnv(m *manifest.Manifest) []string {
+	env := []string{
+		"RELEASE_VERSION=" + m.ReleaseVersion,
+		"RELEASE_MANIFEST=" + ManifestFile,
+		"RELEASE_IDEMPOTENCY_KEY=" + agent.IdempotencyKey(m),
+	}
+	if attestation := provenance.Path(m.ReleaseVersion); fileExists(attestation) {
+		env = append(env, "RELEASE_ATTESTATION="+attestation)
+	}
+	return env
+}
+
+// deployPayload is the manifest as deploy hooks receive it: the versions,
+// not the (encrypted) secrets.
+func deployPayload(m *manifest.Manifest) manifest.Manifest {
+	payload := *m
+	payload.Secrets = nil
+	return payload
+}
+
+func postDeployWebhook(ctx context.Context, url string, m *manifest.Manifest) error {
+	body, err := json.Marshal(deployPayload(m))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("deploy webhook: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", agent.IdempotencyKey(m))
+	client := &http.Client{Timeout: deployTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("deploy webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("deploy webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,445 @@
+package releaser
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/velann21/todo-releaser/internal/image"
+)
+
+// Kinds of dependency UpdateDeps keeps fresh.
+const (
+	DepGoModule  = "go-module"
+	DepBaseImage = "base-image"
+)
+
+// DepsOptions control UpdateDeps.
+type DepsOptions struct {
+	// DryRun lists the updates without opening pull requests.
+	DryRun bool
+}
+
+// RegisterFlags binds o to flags in fs.
+func (o *DepsOptions) RegisterFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&o.DryRun, "dry-run", false, "list the updates without opening pull requests")
+}
+
+// DepUpdate is an update to one of the repository's own dependencies.
+type DepUpdate struct {
+	Kind string `json:"kind"`
+	// Name is the module path or the image, e.g. golang.
+	Name string `json:"name"`
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Files are the Dockerfiles a base image is updated in.
+	Files  []string `json:"files,omitempty"`
+	Branch string   `json:"branch"`
+	Title  string   `json:"title"`
+	Labels []string `json:"labels,omitempty"`
+}
+
+// UpdateDeps keeps the repository's own supply chain fresh, the way the
+// releaser keeps the manifest's images fresh: it checks the direct
+// requirements of go.mod, with the go command, and the versioned base
+// images of the Dockerfiles tracked in git, on Docker Hub, and opens a pull
+// request for each update through the GitHub integration of
+// RELEASER_UPDATE_MODE=pr. Branches, titles and labels follow the Renovate
+// config, and its ignoreDeps and disabled package rules hold updates back.
+// Base images are moved to the newest tag of the same shape, e.g.
+// golang:1.25-alpine to golang:1.26-alpine; untagged and latest images are
+// left alone.
+func UpdateDeps(opts DepsOptions) ([]DepUpdate, error) {
+	if err := startRun(); err != nil {
+		return nil, err
+	}
+	var updates []DepUpdate
+	if _, err := os.Stat("go.mod"); err == nil {
+		found, err := goModuleUpdates()
+		if err != nil {
+			return nil, fmt.Errorf("error checking Go modules: %w", err)
+		}
+		updates = append(updates, found...)
+	}
+	found, err := baseImageUpdates()
+	if err != nil {
+		return nil, fmt.Errorf("error checking base images: %w", err)
+	}
+	updates = append(updates, found...)
+
+	var kept []DepUpdate
+	for _, u := range updates {
+		typ := depUpdateType(u.From, u.To)
+		if renovate.depDisabled(u.Name, typ) {
+			fmt.Printf("Holding back %s %s -> %s: disabled by the Renovate config\n", u.Name, u.From, u.To)
+			continue
+		}
+		u.Labels = renovate.depLabels(u.Name, typ)
+		kept = append(kept, u)
+	}
+	if len(kept) == 0 {
+		fmt.Println("Dependencies are up to date.")
+		return nil, nil
+	}
+	for _, u := range kept {
+		fmt.Printf("%s %s: %s -> %s\n", u.Kind, u.Name, u.From, u.To)
+	}
+	if opts.DryRun {
+		return kept, nil
+	}
+	return kept, openDepPRs(kept)
+}
+
+// depUpdateType is the Renovate update type of an update from one version
+// to another.
+func depUpdateType(from, to string) string {
+	f, err1 := semver.NewVersion(from)
+	t, err2 := semver.NewVersion(to)
+	switch {
+	case err1 != nil || err2 != nil:
+		return "patch"
+	case t.Major() > f.Major():
+		return "major"
+	case t.Minor() > f.Minor():
+		return "minor"
+	default:
+		return "patch"
+	}
+}
+
+// goModule is a module as `go list -m -json` prints it.
+type goModule struct {
+	Path     string
+	Version  string
+	Main     bool
+	Indirect bool
+	Update   *struct{ Version string }
+}
+
+// goModuleUpdates returns the updates of the direct requirements of go.mod
+// within their major version.
+func goModuleUpdates() ([]DepUpdate, error) {
+	if _, err := exec.LookPath("go"); err != nil {
+		fmt.Println("Not checking Go modules: the go command is not installed")
+		return nil, nil
+	}
+	cmd := exec.Command("go", "list", "-m", "-u", "-json", "all")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list: %w", err)
+	}
+	return parseGoModuleUpdates(out)
+}
+
+// parseGoModuleUpdates reads the output of `go list -m -u -json all`.
+func parseGoModuleUpdates(out []byte) ([]DepUpdate, error) {
+	var updates []DepUpdate
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		var mod goModule
+		err := dec.Decode(&mod)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if mod.Main || mod.Indirect || mod.Update == nil {
+			continue
+		}
+		updates = append(updates, DepUpdate{
+			Kind:   DepGoModule,
+			Name:   mod.Path,
+			From:   mod.Version,
+			To:     mod.Update.Version,
+			Branch: renovate.versionBranch(mod.Path, mod.Update.Version),
+			Title:  renovate.semanticTitle(fmt.Sprintf("Update module %s to %s", mod.Path, mod.Update.Version)),
+		})
+	}
+	return updates, nil
+}
+
+// baseImage is an image a Dockerfile builds FROM.
+type baseImage struct {
+	ref  image.Reference
+	file string
+}
+
+// fromLine matches a FROM instruction, capturing its image.
+var fromLine = regexp.MustCompile(`(?i)^\s*FROM\s+(?:--\S+\s+)*(\S+)`)
+
+// parseBaseImages returns the versioned base images of a Dockerfile: those
+// with a tag, leaving out build stages, scratch, images named by build
+// arguments and latest.
+func parseBaseImages(file string, data []byte) []baseImage {
+	var images []baseImage
+	stages := map[string]bool{"scratch": true}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := sc.Text()
+		m := fromLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		from := m[1]
+		if stages[strings.ToLower(from)] || strings.Contains(from, "$") {
+			from = ""
+		}
+		// A stage can only be built from the stages before it.
+		if fields := strings.Fields(line); len(fields) >= 2 && strings.EqualFold(fields[len(fields)-2], "AS") {
+			stages[strings.ToLower(fields[len(fields)-1])] = true
+		}
+		ref, err := image.Parse(from)
+		if err != nil || ref.Tag == "" || ref.Tag == "latest" || ref.Digest != "" {
+			continue
+		}
+		images = append(images, baseImage{ref, file})
+	}
+	return images
+}
+
+// tagShape splits a tag into its numeric version and the suffix after it,
+// e.g. 1.25-alpine into [1 25] and -alpine.
+var tagShape = regexp.MustCompile(`^(v?)(\d+(?:\.\d+)*)(.*)$`)
+
+// newerBaseTag returns the newest of tags with the same shape as current,
+// the same prefix, number of version components and suffix, when it is
+// newer than current, or "".
+func newerBaseTag(current string, tags []string) string {
+	cm := tagShape.FindStringSubmatch(current)
+	if cm == nil {
+		return ""
+	}
+	parse := func(version string) []int {
+		var parts []int
+		for _, p := range strings.Split(version, ".") {
+			n, _ := strconv.Atoi(p)
+			parts = append(parts, n)
+		}
+		return parts
+	}
+	best, newest := parse(cm[2]), ""
+	for _, tag := range tags {
+		tm := tagShape.FindStringSubmatch(tag)
+		if tm == nil || tm[1] != cm[1] || tm[3] != cm[3] {
+			continue
+		}
+		if v := parse(tm[2]); len(v) == len(best) && slices.Compare(v, best) > 0 {
+			best, newest = v, tag
+		}
+	}
+	return newest
+}
+
+// baseImageUpdates returns the updates of the versioned base images of the
+// Dockerfiles tracked in git, one per image and tag, covering every file
+// that uses it.
+func baseImageUpdates() ([]DepUpdate, error) {
+	files, err := currentRepo().files()
+	if err != nil {
+		return nil, err
+	}
+	var images []baseImage
+	for _, file := range files {
+		name := path.Base(file)
+		if name != "Dockerfile" && !strings.HasPrefix(name, "Dockerfile.") && !strings.HasSuffix(name, ".Dockerfile") {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, parseBaseImages(file, data)...)
+	}
+
+	var updates []DepUpdate
+	tags := map[string][]string{}
+	for _, img := range images {
+		current := img.ref.Name() + ":" + img.ref.Tag
+		if i := slices.IndexFunc(updates, func(u DepUpdate) bool { return u.Name+":"+u.From == current }); i >= 0 {
+			if !slices.Contains(updates[i].Files, img.file) {
+				updates[i].Files = append(updates[i].Files, img.file)
+			}
+			continue
+		}
+		if !img.ref.IsDockerHub() {
+			fmt.Printf("Not checking %s in %s: only Docker Hub base images are checked\n", current, img.file)
+			continue
+		}
+		names, ok := tags[img.ref.Repository]
+		if !ok {
+			if names, err = dockerHubTags(img.ref); err != nil {
+				return nil, fmt.Errorf("%s: %w", img.ref.Name(), err)
+			}
+			tags[img.ref.Repository] = names
+		}
+		newer := newerBaseTag(img.ref.Tag, names)
+		if newer == "" {
+			continue
+		}
+		to := newer
+		if !strings.HasPrefix(to, "v") {
+			to = "v" + to
+		}
+		updates = append(updates, DepUpdate{
+			Kind:   DepBaseImage,
+			Name:   img.ref.Name(),
+			From:   img.ref.Tag,
+			To:     newer,
+			Files:  []string{img.file},
+			Branch: renovate.versionBranch(img.ref.Name(), newer),
+			Title:  renovate.semanticTitle(fmt.Sprintf("Update %s Docker tag to %s", img.ref.Name(), to)),
+		})
+	}
+	return updates, nil
+}
+
+// dockerHubTags returns the most recently pushed tags of ref's repository.
+func dockerHubTags(ref image.Reference) ([]string, error) {
+	resp, err := registryHTTP.Get(fmt.Sprintf("https://hub.docker.com/v2/repositories/%s/tags?page_size=100", ref.Repository))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("docker hub api returned %d", resp.StatusCode)
+	}
+	var tags DockerHubTags
+	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, tag := range tags.Results {
+		names = append(names, tag.Name)
+	}
+	return names, nil
+}
+
+// openDepPRs puts each update on its own branch off the base branch and
+// opens a pull request for it, leaving the checkout as it was.
+func openDepPRs(updates []DepUpdate) error {
+	base, err := baseBranch()
+	if err != nil {
+		return err
+	}
+	head, err := commitOf("HEAD")
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, u := range updates {
+		if err := openDepPR(u, base); err != nil {
+			fmt.Printf("Error opening the pull request for %s: %v\n", u.Name, err)
+			failed = append(failed, u.Name)
+		}
+		// A failed update can leave go.mod or a Dockerfile changed.
+		if err := currentRepo().reset(context.Background(), head, resetHard); err != nil {
+			return err
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("opening pull requests failed for %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func openDepPR(u DepUpdate, base string) error {
+	files, err := applyDepUpdate(u)
+	if err != nil {
+		return err
+	}
+	repo := currentRepo()
+	if err := repo.add(context.Background(), files...); err != nil {
+		return err
+	}
+	if err := repo.commit(context.Background(), u.Title); err != nil {
+		return err
+	}
+	// The branch is ours to rebuild; it is only pushed when it changes.
+	if !branchHasTree(u.Branch) {
+		if err := repo.push(context.Background(), true, "HEAD:refs/heads/"+u.Branch); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("%s is up to date on %s\n", u.Name, u.Branch)
+	}
+	var body string
+	switch u.Kind {
+	case DepGoModule:
+		body = fmt.Sprintf("This PR updates the Go module `%s` from `%s` to `%s`.", u.Name, u.From, u.To)
+	default:
+		body = fmt.Sprintf("This PR updates the base image `%s` from `%s` to `%s` in %s.", u.Name, u.From, u.To, strings.Join(u.Files, ", "))
+	}
+	_, err = pullRequest(UpdateBranch{Service: u.Name, From: u.From, To: u.To, Branch: u.Branch, Title: u.Title, Labels: u.Labels}, base, body)
+	return err
+}
+
+// applyDepUpdate makes u in the worktree and returns the files it changed.
+func applyDepUpdate(u DepUpdate) ([]string, error) {
+	if u.Kind == DepGoModule {
+		for _, args := range [][]string{{"get", u.Name + "@" + u.To}, {"mod", "tidy"}} {
+			cmd := exec.Command("go", args...)
+			cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+			if err := cmd.Run(); err != nil {
+				return nil, fmt.Errorf("go %s: %w", strings.Join(args, " "), err)
+			}
+		}
+		return []string{"go.mod", "go.sum"}, nil
+	}
+	for _, file := range u.Files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(file, rewriteBaseImage(data, u.Name, u.From, u.To), 0644); err != nil {
+			return nil, err
+		}
+	}
+	return u.Files, nil
+}
+
+// rewriteBaseImage moves the FROM instructions of a Dockerfile on name:from
+// to name:to.
+func rewriteBaseImage(data []byte, name, from, to string) []byte {
+	lines := strings.SplitAfter(string(data), "\n")
+	for i, line := range lines {
+		m := fromLine.FindStringSubmatchIndex(line)
+		if m == nil {
+			continue
+		}
+		ref, err := image.Parse(line[m[2]:m[3]])
+		if err != nil || ref.Name() != name || ref.Tag != from || ref.Digest != "" {
+			continue
+		}
+		old := line[m[2]:m[3]]
+		lines[i] = line[:m[2]] + strings.TrimSuffix(old, ":"+from) + ":" + to + line[m[3]:]
+	}
+	return []byte(strings.Join(lines, ""))
+}
+
+// branchHasTree reports whether origin's branch already has the tree of
+// HEAD, so it needn't be pushed again.
+func branchHasTree(branch string) bool {
+	repo := currentRepo()
+	fetched, err := repo.fetch(context.Background(), branch)
+	if err != nil {
+		return false
+	}
+	theirs, err1 := repo.lookup(fetched)
+	ours, err2 := repo.lookup("HEAD")
+	return err1 == nil && err2 == nil && theirs.tree == ours.tree
+}
@@ -0,0 +1,35 @@
+package releaser
+
+import (
+	"context"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/velann21/todo-releaser/internal/image"
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// latestPinned returns the newest semver tag within c of a digest-only
+// service's image and the digest it points to. The service is up to date
+// when that is the digest it is pinned to.
+func latestPinned(ctx context.Context, s manifest.Service, c *semver.Constraints) (tag, digest string, err error) {
+	r, err := image.Parse(s.Image)
+	if err != nil {
+		return "", "", err
+	}
+	if tag, err = latestTag(ctx, r.Name(), c); err != nil || tag == "" {
+		return "", "", err
+	}
+	digest, err = tagDigest(ctx, r.Name(), tag)
+	return tag, digest, err
+}
+
+// shortDigest abbreviates a digest to its first 12 hex digits, as docker
+// does image IDs.
+func shortDigest(digest string) string {
+	algorithm, hex, _ := strings.Cut(digest, ":")
+	if len(hex) > 12 {
+		hex = hex[:12]
+	}
+	return algorithm + ":" + hex
+}
@@ -0,0 +1,231 @@
+package releaser
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/agent"
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// DefaultDryRunDir is where DryRun writes unless told otherwise.
+const DefaultDryRunDir = "release-dry-run"
+
+// DryRun works out the release Reconcile would make now and renders what it
+// would hand to the deploy side into dir, without committing, tagging,
+// deploying or notifying anything:
+//
+//	result.json            the release and its changes
+//	release_manifest.json  the manifest as it would be committed
+//	release.env            the compose variables deploy agents would apply
+//	release.compose.yml    the runtime settings they would apply, if any
+//	deploy_webhook.json    the body POSTed to the deploy webhook
+//	deploy_command.sh      the deploy command with its environment
+//	deploy_plugins.json    the calls deploy hook plugins would get
+//	notifications/<channel>.txt  the release notification for each channel
+//	notes/<output>         each release notes output, rendered
+//	update_branches.json   the branch, pull request title, labels and
+//	                       owners of each change, as RELEASER_UPDATE_MODE=pr
+//	                       names them
+//
+// Hooks that aren't configured are left out. It returns nil when there is
+// nothing to release.
+func DryRun(ctx context.Context, dir string) (*Result, error) {
+	if err := startRun(); err != nil {
+		return nil, err
+	}
+	if freeze, err := CurrentFreeze(time.Now()); err != nil {
+		return nil, fmt.Errorf("error reading release freeze: %w", err)
+	} else if freeze != nil {
+		fmt.Printf("Releases are frozen (%s); planning the release anyway\n", freeze.Reason)
+	}
+
+	m, err := loadManifest()
+	if err != nil {
+		return nil, fmt.Errorf("error loading manifest: %w", err)
+	}
+	policy, err := currentBranchPolicy()
+	if err != nil {
+		return nil, err
+	}
+	before := slices.Clone(m.Services)
+	planned, _ := planUpdates(ctx, m, policy, nil)
+	changes, _ := holdBack(m, before, planned)
+	changes, blocked, err := gateLicenses(m, before, changes)
+	if err != nil {
+		return nil, err
+	}
+	configs, err := configChanges(m)
+	if err != nil {
+		return nil, err
+	}
+	changes = append(changes, configs...)
+	if len(changes) == 0 {
+		fmt.Println("No updates found.")
+		return nil, nil
+	}
+	if err := checkLocks(m); err != nil {
+		fmt.Printf("The release would be refused: %v\n", err)
+	}
+
+	var version string
+	if policy == UpdatePatch {
+		var tags []string
+		if tags, err = releaseTags(); err == nil {
+			version, err = nextPatch(m.ReleaseVersion, tags)
+		}
+	} else {
+		version, err = generateNewVersion(incrementOf(changes))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error generating new version: %w", err)
+	}
+	m.ReleaseVersion = version
+	linkSources(ctx, m, changes)
+	measureSizes(ctx, m, changes)
+	result := &Result{Version: version, Changes: changes, Blocked: blocked}
+
+	for _, sub := range []string{"notes", "notifications"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	if err := renderDryRun(ctx, dir, m, result); err != nil {
+		return nil, err
+	}
+	fmt.Printf("Dry run of %s written to %s\n", version, dir)
+	return result, nil
+}
+
+func renderDryRun(ctx context.Context, dir string, m *manifest.Manifest, result *Result) error {
+	write := func(name string, data []byte, perm os.FileMode) error {
+		fmt.Printf("Writing %s\n", filepath.Join(dir, name))
+		return os.WriteFile(filepath.Join(dir, name), data, perm)
+	}
+	writeJSON := func(name string, v any) error {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		return write(name, append(data, '\n'), 0644)
+	}
+
+	if err := writeJSON("result.json", result); err != nil {
+		return err
+	}
+	if err := manifest.Save(filepath.Join(dir, ManifestFile), m); err != nil {
+		return err
+	}
+	if err := writeJSON("update_branches.json", updateBranches(m, result.Changes)); err != nil {
+		return err
+	}
+	if err := write("release.env", []byte(agent.ComposeEnv(m)), 0644); err != nil {
+		return err
+	}
+	override, err := agent.ComposeOverride(m)
+	if err != nil {
+		return err
+	}
+	if override != nil {
+		if err := write(agent.OverrideFile, override, 0644); err != nil {
+			return err
+		}
+	}
+	if hook := deployWebhookURL(m); hook != "" {
+		fmt.Printf("The deploy webhook on %s would get deploy_webhook.json\n", webhookHost(hook))
+		if err := writeJSON("deploy_webhook.json", deployPayload(m)); err != nil {
+			return err
+		}
+	}
+	if command := os.Getenv("RELEASER_DEPLOY_COMMAND"); command != "" {
+		var script strings.Builder
+		script.WriteString("#!/bin/sh\n")
+		for _, kv := range deployCommandEnv(m) {
+			name, value, _ := strings.Cut(kv, "=")
+			fmt.Fprintf(&script, "export %s=%s\n", name, shellQuote(value))
+		}
+		script.WriteString(command + "\n")
+		if err := write("deploy_command.sh", []byte(script.String()), 0755); err != nil {
+			return err
+		}
+	}
+
+	for _, host := range deployDockerHosts() {
+		fmt.Printf("The compose services on %s would be recreated on the images of release.env\n", host)
+	}
+
+	ps, err := loadPlugins(ctx)
+	if err != nil {
+		return err
+	}
+	type pluginCall struct {
+		Plugin string         `json:"plugin"`
+		Method string         `json:"method"`
+		Params map[string]any `json:"params"`
+	}
+	var calls []pluginCall
+	for _, p := range ps {
+		if p.Info.DeployHook {
+			calls = append(calls, pluginCall{p.Info.Name, "deploy", deployPluginParams(m)})
+		}
+	}
+	if len(calls) > 0 {
+		if err := writeJSON("deploy_plugins.json", calls); err != nil {
+			return err
+		}
+	}
+
+	previous, _ := previousRelease("HEAD")
+	repo := repositoryURL()
+	d := newNotesData(m, result, repo, previous, time.Now())
+	notifyConf, err := loadNotifyConfig(NotifyFile)
+	if err != nil {
+		return err
+	}
+	for _, ch := range notifyConf.Channels {
+		text, err := renderNotification(ch, NotifyRelease, d)
+		if err != nil {
+			return fmt.Errorf("rendering the %s notification: %w", ch.Name, err)
+		}
+		if err := write(filepath.Join("notifications", ch.Name+".txt"), []byte(text), 0644); err != nil {
+			return err
+		}
+	}
+	conf, err := loadNotesConfig(NotesFile)
+	if err != nil || conf == nil {
+		return err
+	}
+	for _, out := range conf.Outputs {
+		body, err := renderNotes(out.Template, d)
+		if err != nil {
+			return fmt.Errorf("rendering %s release notes: %w", out.Name, err)
+		}
+		name := out.Name + path.Ext(strings.TrimSuffix(out.Template, ".tmpl"))
+		if err := write(filepath.Join("notes", name), []byte(body), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// webhookHost names a webhook without the path, which often holds its
+// credentials.
+func webhookHost(hook string) string {
+	u, err := url.Parse(hook)
+	if err != nil {
+		return "(unparseable URL)"
+	}
+	return u.Host
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,103 @@
+package releaser
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/velann21/todo-releaser/internal/image"
+)
+
+// ecrHost matches the hosts of Amazon ECR private registries,
+// <account>.dkr.ecr.<region>.amazonaws.com, capturing the region.
+var ecrHost = regexp.MustCompile(`^[0-9]{12}\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
+
+// ecrRegistry reads images of Amazon ECR private repositories, logging in
+// with an authorization token from the ECR API. The SDK takes its
+// credentials from the standard chain: the environment, the shared config
+// and credentials files with AWS_PROFILE, or the instance, task or pod
+// role. The credentials need ecr:GetAuthorizationToken, ecr:ListImages and
+// ecr:BatchGetImage.
+var ecrRegistry = &registryBackend{
+	name:    "ECR",
+	handles: ecrHost.MatchString,
+	client: func(ctx context.Context, r image.Reference) (*registryClient, error) {
+		password, err := ecrPassword(ctx, ecrHost.FindStringSubmatch(r.Registry)[1])
+		if err != nil {
+			return nil, err
+		}
+		return newRegistryClient(ctx, r.Registry, r.Repository, "pull", "AWS", password)
+	},
+}
+
+// ecrPasswordMargin is how long before it expires an ECR password is
+// replaced.
+const ecrPasswordMargin = time.Hour
+
+var (
+	ecrPasswordsMu sync.Mutex
+	ecrPasswords   = map[string]cachedPassword{}
+)
+
+type cachedPassword struct {
+	password string
+	expires  time.Time
+}
+
+// ecrPassword returns a password for the ECR registries of region. The
+// lock isn't held while a password is fetched, so lookups in other
+// regions, or with a cached password, don't wait for it.
+func ecrPassword(ctx context.Context, region string) (string, error) {
+	ecrPasswordsMu.Lock()
+	cached, ok := ecrPasswords[region]
+	ecrPasswordsMu.Unlock()
+	if ok && time.Until(cached.expires) > ecrPasswordMargin {
+		return cached.password, nil
+	}
+	password, expires, err := ecrLoginPassword(ctx, region)
+	if err != nil {
+		return "", err
+	}
+	ecrPasswordsMu.Lock()
+	ecrPasswords[region] = cachedPassword{password, expires}
+	ecrPasswordsMu.Unlock()
+	return password, nil
+}
+
+// ecrLoginPassword gets an authorization token for the ECR registries of
+// region and returns its password and when it expires. Tests replace it.
+var ecrLoginPassword = func(ctx context.Context, region string) (string, time.Time, error) {
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(region))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("error loading the AWS config: %w", err)
+	}
+	out, err := ecr.NewFromConfig(cfg).GetAuthorizationToken(ctx, &ecr.GetAuthorizationTokenInput{})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("ecr GetAuthorizationToken: %w", err)
+	}
+	if len(out.AuthorizationData) == 0 || out.AuthorizationData[0].AuthorizationToken == nil {
+		return "", time.Time{}, errors.New("ecr GetAuthorizationToken returned no token")
+	}
+	data := out.AuthorizationData[0]
+	// The token is base64 of AWS:<password>.
+	token, err := base64.StdEncoding.DecodeString(*data.AuthorizationToken)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid ECR authorization token: %w", err)
+	}
+	_, password, ok := strings.Cut(string(token), ":")
+	if !ok {
+		return "", time.Time{}, errors.New("invalid ECR authorization token")
+	}
+	expires := time.Now().Add(12 * time.Hour)
+	if data.ExpiresAt != nil {
+		expires = *data.ExpiresAt
+	}
+	return password, expires, nil
+}
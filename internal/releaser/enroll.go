@@ -0,0 +1,230 @@
+package releaser
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/pki"
+)
+
+// DefaultEnrollTokenTTL is how long a bootstrap token can be used.
+const DefaultEnrollTokenTTL = time.Hour
+
+var enrollMu sync.Mutex
+
+// enrollTokensState holds the bootstrap tokens, each bound to the agent it
+// enrolls. The tokens of enroll_tokens.json, which were bound to none, are
+// no longer honoured.
+const enrollTokensState = "agent_enroll_tokens.json"
+
+// enrollToken is a bootstrap token, by its SHA-256.
+type enrollToken struct {
+	// Name is the agent the token enrolls.
+	Name    string    `json:"name"`
+	Expires time.Time `json:"expires"`
+}
+
+// PKIDir holds the agent CA.
+func PKIDir() string {
+	return filepath.Join(StateDir(), "pki")
+}
+
+// readEnrollTokens returns the unexpired tokens, by SHA-256.
+func readEnrollTokens(now time.Time) (map[string]enrollToken, error) {
+	tokens := map[string]enrollToken{}
+	if err := readStateJSON(enrollTokensState, &tokens); err != nil {
+		return nil, err
+	}
+	for hash, t := range tokens {
+		if !now.Before(t.Expires) {
+			delete(tokens, hash)
+		}
+	}
+	return tokens, nil
+}
+
+func writeEnrollTokens(tokens map[string]enrollToken) error {
+	return writeStateJSON(enrollTokensState, tokens)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateEnrollToken mints a one-time bootstrap token valid for ttl, that
+// enrolls the agent name and no other. Only its hash is stored.
+func CreateEnrollToken(now time.Time, ttl time.Duration, name string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	enrollMu.Lock()
+	defer enrollMu.Unlock()
+	tokens, err := readEnrollTokens(now)
+	if err != nil {
+		return "", err
+	}
+	tokens[hashToken(token)] = enrollToken{Name: name, Expires: now.Add(ttl)}
+	return token, writeEnrollTokens(tokens)
+}
+
+// consumeEnrollToken reports whether token is valid for enrolling name, and
+// if so uses it up.
+func consumeEnrollToken(token, name string, now time.Time) (bool, error) {
+	enrollMu.Lock()
+	defer enrollMu.Unlock()
+	tokens, err := readEnrollTokens(now)
+	if err != nil {
+		return false, err
+	}
+	hash := hashToken(token)
+	if t, ok := tokens[hash]; !ok || t.Name != name {
+		return false, nil
+	}
+	delete(tokens, hash)
+	return true, writeEnrollTokens(tokens)
+}
+
+// EnrollTokenResponse is returned by POST /enroll/tokens.
+type EnrollTokenResponse struct {
+	Token   string    `json:"token"`
+	CAHash  string    `json:"ca_hash"`
+	Expires time.Time `json:"expires"`
+}
+
+// enrollRequest is the body of POST /enroll and /enroll/renew.
+type enrollRequest struct {
+	Token string `json:"token,omitempty"`
+	Name  string `json:"name,omitempty"`
+	CSR   string `json:"csr"`
+}
+
+// EnrollResponse carries the agent's certificate and the CA to trust.
+type EnrollResponse struct {
+	Certificate string `json:"certificate"`
+	CA          string `json:"ca"`
+}
+
+// handleEnrollTokens serves POST /enroll/tokens (API token): a new bootstrap
+// token for the agent "name" in the body, valid for the "ttl" (default
+// DefaultEnrollTokenTTL).
+func handleEnrollTokens(ca *pki.CA, apiToken string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, apiToken) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			Name string `json:"name"`
+			TTL  string `json:"ttl"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(req.Name) == "" {
+			http.Error(w, "the name of the agent to enroll is required", http.StatusBadRequest)
+			return
+		}
+		ttl := DefaultEnrollTokenTTL
+		if req.TTL != "" {
+			var err error
+			if ttl, err = time.ParseDuration(req.TTL); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		now := time.Now()
+		token, err := CreateEnrollToken(now, ttl, req.Name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(EnrollTokenResponse{Token: token, CAHash: ca.Hash(), Expires: now.Add(ttl)})
+	}
+}
+
+// handleEnroll serves POST /enroll: an agent exchanges a bootstrap token and
+// a CSR for a client certificate named after the agent. The token must have
+// been minted for that name, so it can't enroll as another agent.
+func handleEnroll(ca *pki.CA) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req enrollRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(req.Name) == "" {
+			http.Error(w, "a name is required", http.StatusBadRequest)
+			return
+		}
+		// A bad CSR leaves the token for another try.
+		if err := pki.CheckCSR([]byte(req.CSR)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ok, err := consumeEnrollToken(req.Token, req.Name, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "invalid or expired bootstrap token for this agent", http.StatusUnauthorized)
+			return
+		}
+		fmt.Printf("Enrolling agent %s\n", req.Name)
+		signClient(w, ca, req.CSR, req.Name)
+	}
+}
+
+// handleRenew serves POST /enroll/renew: an enrolled agent, over mTLS, gets
+// a fresh certificate for the same name before its current one expires.
+func handleRenew(ca *pki.CA) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := pki.AgentName(r.TLS)
+		if name == "" {
+			http.Error(w, "a client certificate is required", http.StatusUnauthorized)
+			return
+		}
+		var req enrollRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		signClient(w, ca, req.CSR, name)
+	}
+}
+
+func signClient(w http.ResponseWriter, ca *pki.CA, csr, name string) {
+	cert, err := ca.SignClient([]byte(csr), name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(EnrollResponse{Certificate: string(cert), CA: string(ca.CertPEM)})
+}
+
+// NewEnrollToken asks the releaser at addr for a bootstrap token that
+// enrolls the agent name, valid for ttl, and returns the JSON
+// EnrollTokenResponse.
+func NewEnrollToken(addr, apiToken, name string, ttl time.Duration) (string, error) {
+	body, err := json.Marshal(map[string]string{"name": name, "ttl": ttl.String()})
+	if err != nil {
+		return "", err
+	}
+	return apiRequest(addr, apiToken, http.MethodPost, "/enroll/tokens", body)
+}
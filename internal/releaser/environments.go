@@ -0,0 +1,185 @@
+package releaser
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/agent"
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// DefaultDriftMaxBehind is how many releases an environment may lag the
+// manifest before /status warns about it, unless RELEASER_DRIFT_MAX_BEHIND
+// overrides it.
+const DefaultDriftMaxBehind = 2
+
+// releaseTag matches the calver tags releases are made as, but for their
+// tag namespace.
+var releaseTag = regexp.MustCompile(`^v\d{6}\.\d+\.\d+$`)
+
+// isRelease reports whether tag is a release tag in namespace.
+func isRelease(tag, namespace string) bool {
+	version, ok := strings.CutPrefix(tag, namespace)
+	return ok && releaseTag.MatchString(version)
+}
+
+// HostStatus is where one host (or deploy hook) of an environment is.
+type HostStatus struct {
+	Host string `json:"host"`
+	AgentStatus
+	// Behind is how many releases Deployed lags the manifest, or -1 when
+	// it isn't a known release.
+	Behind int `json:"behind"`
+}
+
+// EnvironmentStatus groups the hosts of one environment.
+type EnvironmentStatus struct {
+	Name  string       `json:"name"`
+	Hosts []HostStatus `json:"hosts"`
+	// Behind is how far the environment's furthest-behind host lags, or -1
+	// when none runs a known release.
+	Behind int `json:"behind"`
+}
+
+// environmentStatus groups reports by environment and works out how far
+// each host lags current, given releases oldest first. It returns a
+// warning for every environment more than maxBehind releases behind.
+func environmentStatus(reports map[string]AgentStatus, releases []string, current string, maxBehind int) ([]EnvironmentStatus, []string) {
+	index := map[string]int{}
+	for i, tag := range releases {
+		index[tag] = i
+	}
+	latest, known := index[current]
+
+	byName := map[string]*EnvironmentStatus{}
+	var envs []*EnvironmentStatus
+	for host, st := range reports {
+		name := st.Environment
+		if name == "" {
+			name = host
+		}
+		env := byName[name]
+		if env == nil {
+			env = &EnvironmentStatus{Name: name, Behind: -1}
+			byName[name] = env
+			envs = append(envs, env)
+		}
+		behind := -1
+		if i, ok := index[st.Deployed]; ok && known {
+			behind = max(latest-i, 0)
+		}
+		env.Hosts = append(env.Hosts, HostStatus{Host: host, AgentStatus: st, Behind: behind})
+		env.Behind = max(env.Behind, behind)
+	}
+
+	sort.Slice(envs, func(i, j int) bool { return envs[i].Name < envs[j].Name })
+	out := make([]EnvironmentStatus, 0, len(envs))
+	var warnings []string
+	for _, env := range envs {
+		sort.Slice(env.Hosts, func(i, j int) bool { return env.Hosts[i].Host < env.Hosts[j].Host })
+		if env.Behind > maxBehind {
+			var lagging []string
+			for _, h := range env.Hosts {
+				if h.Behind > maxBehind {
+					lagging = append(lagging, fmt.Sprintf("%s on %s", h.Host, h.Deployed))
+				}
+			}
+			warnings = append(warnings, fmt.Sprintf("%s is %d releases behind %s (%s)",
+				env.Name, env.Behind, current, strings.Join(lagging, ", ")))
+		}
+		out = append(out, *env)
+	}
+	return out, warnings
+}
+
+// releaseTags lists the release tags in the tag namespace, oldest first.
+func releaseTags() ([]string, error) {
+	namespace, err := tagNamespace()
+	if err != nil {
+		return nil, err
+	}
+	all, err := currentRepo().tags(namespace + "v*")
+	if err != nil {
+		return nil, err
+	}
+	sortTags(all)
+	var tags []string
+	for _, tag := range tagNames(all) {
+		if isRelease(tag, namespace) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, nil
+}
+
+// previousRelease is the latest release tag in the tag namespace that rev
+// is descended from.
+func previousRelease(rev string) (string, error) {
+	namespace, err := tagNamespace()
+	if err != nil {
+		return "", err
+	}
+	return currentRepo().describe(namespace+"v*", rev)
+}
+
+func driftMaxBehind() (int, error) {
+	v := os.Getenv("RELEASER_DRIFT_MAX_BEHIND")
+	if v == "" {
+		return DefaultDriftMaxBehind, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("RELEASER_DRIFT_MAX_BEHIND: %w", err)
+	}
+	return n, nil
+}
+
+// Environments reports where every environment is against the manifest's
+// release, with drift warnings.
+func Environments() ([]EnvironmentStatus, []string, error) {
+	reports, err := AgentReports()
+	if err != nil || len(reports) == 0 {
+		return nil, nil, err
+	}
+	data, err := os.ReadFile(ManifestFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	var m manifest.Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, nil, fmt.Errorf("error parsing %s: %w", ManifestFile, err)
+	}
+	releases, err := releaseTags()
+	if err != nil {
+		return nil, nil, err
+	}
+	maxBehind, err := driftMaxBehind()
+	if err != nil {
+		return nil, nil, err
+	}
+	envs, warnings := environmentStatus(reports, releases, m.ReleaseVersion, maxBehind)
+	return envs, warnings, nil
+}
+
+// recordDeploy records a deploy hook's rollout of version to the
+// environment RELEASER_DEPLOY_ENVIRONMENT, when it is set, as if an agent of
+// that name had reported it.
+func recordDeploy(version, state string, err error) {
+	env := os.Getenv("RELEASER_DEPLOY_ENVIRONMENT")
+	if env == "" {
+		return
+	}
+	rep := agent.Report{Environment: env, Version: version, State: state, Time: time.Now()}
+	if err != nil {
+		rep.Error = err.Error()
+	}
+	if err := recordAgentReport(env, rep); err != nil {
+		fmt.Printf("Error recording the deploy of %s to %s: %v\n", version, env, err)
+	}
+}
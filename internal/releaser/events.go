@@ -0,0 +1,98 @@
+package releaser
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// RELEASER_EVENTS lists, comma-separated, the SNS topic ARNs and SQS queue
+// URLs release lifecycle events are published to, so other systems such as
+// the data warehouse or the status page can follow releases without polling
+// the releaser. Events are JSON LifecycleEvents, sent with the aws CLI and
+// its credentials, with the event type as the "type" message attribute for
+// subscription filters. Publishing is best effort: a failure is logged and
+// never holds up a release.
+func eventTargets() []string {
+	var targets []string
+	for _, t := range strings.Split(os.Getenv("RELEASER_EVENTS"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
+
+// Lifecycle event types.
+const (
+	EventUpdateDetected  = "update-detected"
+	EventReleaseCreated  = "release-created"
+	EventDeploySucceeded = "deploy-succeeded"
+	EventRollback        = "rollback"
+)
+
+// LifecycleEvent is what is published for each step of a release.
+type LifecycleEvent struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Run is the releaser run the event comes from.
+	Run string `json:"run,omitempty"`
+	// Repository is the manifest repository's web URL.
+	Repository string `json:"repository,omitempty"`
+	// Version is the release; for a rollback, the release restoring the
+	// versions of Previous in place of RolledBack's.
+	Version    string   `json:"version,omitempty"`
+	Changes    []Change `json:"changes,omitempty"`
+	Hotfix     bool     `json:"hotfix,omitempty"`
+	Previous   string   `json:"previous,omitempty"`
+	RolledBack string   `json:"rolled_back,omitempty"`
+	Reason     string   `json:"reason,omitempty"`
+}
+
+// publishEvent publishes e to every target in RELEASER_EVENTS.
+func publishEvent(e LifecycleEvent) {
+	targets := eventTargets()
+	if len(targets) == 0 {
+		return
+	}
+	e.Time = Clock.Now().UTC()
+	e.Run = runID
+	e.Repository = repositoryURL()
+	body, err := json.Marshal(e)
+	if err != nil {
+		fmt.Printf("Error encoding %s event: %v\n", e.Type, err)
+		return
+	}
+	for _, target := range targets {
+		args, err := publishArgs(target, e.Type, body)
+		if err == nil {
+			var out []byte
+			if out, err = exec.Command("aws", args...).CombinedOutput(); err != nil {
+				err = fmt.Errorf("aws %s %s: %w: %s", args[0], args[1], err, strings.TrimSpace(string(out)))
+			}
+		}
+		if err != nil {
+			fmt.Printf("Error publishing %s event to %s: %v\n", e.Type, target, err)
+		}
+	}
+}
+
+// publishArgs returns the aws CLI arguments that send body to target, an
+// SNS topic ARN or SQS queue URL. The region is the topic's or queue's.
+func publishArgs(target, eventType string, body []byte) ([]string, error) {
+	attributes := fmt.Sprintf(`{"type": {"DataType": "String", "StringValue": %q}}`, eventType)
+	if arn, ok := strings.CutPrefix(target, "arn:aws:sns:"); ok {
+		region, _, _ := strings.Cut(arn, ":")
+		return []string{"sns", "publish", "--region", region, "--topic-arn", target,
+			"--message", string(body), "--message-attributes", attributes}, nil
+	}
+	if host, ok := strings.CutPrefix(target, "https://sqs."); ok {
+		region, _, _ := strings.Cut(host, ".")
+		return []string{"sqs", "send-message", "--region", region, "--queue-url", target,
+			"--message-body", string(body), "--message-attributes", attributes}, nil
+	}
+	return nil, fmt.Errorf("%q is neither an SNS topic ARN nor an SQS queue URL", target)
+}
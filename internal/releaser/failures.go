@@ -0,0 +1,134 @@
+package releaser
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+
+	"github.com/velann21/todo-releaser/internal/image"
+	"github.com/velann21/todo-releaser/internal/ratelimit"
+)
+
+// Failure categories of a service check, which the run's Result, the checks
+// comment of update pull requests and release notifications group failed
+// checks by.
+const (
+	FailureAuth        = "auth"
+	FailureNotFound    = "not-found"
+	FailureRateLimited = "rate-limited"
+	FailureNetwork     = "network"
+	FailurePolicy      = "policy"
+	// FailureOther is any other failure.
+	FailureOther = "error"
+)
+
+// statusError is an unexpected status from a registry's API.
+type statusError struct {
+	api  string
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s api returned %d", e.api, e.code)
+}
+
+// policyError is a check that found nothing the release policy allows.
+type policyError struct{ error }
+
+// failureCategory is the category of a check's err.
+func failureCategory(err error) string {
+	var status *statusError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ratelimit.ErrBudgetExhausted):
+		return FailureRateLimited
+	case errors.As(err, &status):
+		switch {
+		case status.code == http.StatusUnauthorized || status.code == http.StatusForbidden:
+			return FailureAuth
+		case status.code == http.StatusNotFound:
+			return FailureNotFound
+		case status.code == http.StatusTooManyRequests:
+			return FailureRateLimited
+		case status.code >= 500:
+			return FailureNetwork
+		}
+	case errors.Is(err, errTagNotFound):
+		return FailureNotFound
+	case errors.As(err, &policyError{}):
+		return FailurePolicy
+	case errors.As(err, &netErr), errors.Is(err, context.DeadlineExceeded), errors.Is(err, io.ErrUnexpectedEOF):
+		return FailureNetwork
+	}
+	return FailureOther
+}
+
+// fail records err as the failure of c, a check of the image ref.
+func (c *ServiceCheck) fail(ref string, err error) {
+	c.Error = err.Error()
+	if errors.Is(err, ratelimit.ErrBudgetExhausted) {
+		c.Error = "registry request budget spent"
+	}
+	c.Failure = failureCategory(err)
+	if r, err := image.Parse(ref); err == nil {
+		c.Registry = r.Registry
+	}
+}
+
+// FailureGroup are the services whose checks failed alike: for the same
+// reason, at the same registry.
+type FailureGroup struct {
+	Failure  string   `json:"failure"`
+	Registry string   `json:"registry,omitempty"`
+	Services []string `json:"services"`
+}
+
+// String summarises g, e.g. "3 services skipped: rate-limited by docker.io".
+func (g FailureGroup) String() string {
+	n := fmt.Sprintf("%d services", len(g.Services))
+	if len(g.Services) == 1 {
+		n = "1 service"
+	}
+	var why string
+	switch g.Failure {
+	case FailureAuth:
+		why = "access denied by " + g.Registry
+	case FailureNotFound:
+		why = "not found on " + g.Registry
+	case FailureRateLimited:
+		why = "rate-limited by " + g.Registry
+	case FailureNetwork:
+		why = "could not reach " + g.Registry
+	case FailurePolicy:
+		why = "nothing the release policy allows on " + g.Registry
+	default:
+		why = "failed on " + g.Registry
+	}
+	return fmt.Sprintf("%s skipped: %s", n, why)
+}
+
+// failureGroups groups the failed checks among checks, the largest group
+// first.
+func failureGroups(checks []ServiceCheck) []FailureGroup {
+	var groups []FailureGroup
+	for _, c := range checks {
+		if c.Failure == "" {
+			continue
+		}
+		i := slices.IndexFunc(groups, func(g FailureGroup) bool { return g.Failure == c.Failure && g.Registry == c.Registry })
+		if i < 0 {
+			groups = append(groups, FailureGroup{Failure: c.Failure, Registry: c.Registry})
+			i = len(groups) - 1
+		}
+		groups[i].Services = append(groups[i].Services, c.Name)
+	}
+	slices.SortStableFunc(groups, func(a, b FailureGroup) int {
+		return cmp.Compare(len(b.Services), len(a.Services))
+	})
+	return groups
+}
@@ -0,0 +1,199 @@
+package releaser
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Freeze stops releases until it is lifted or Until passes.
+type Freeze struct {
+	Reason string    `json:"reason"`
+	By     string    `json:"by,omitempty"`
+	Since  time.Time `json:"since"`
+	// Until is when the freeze lifts by itself; zero means never.
+	Until time.Time `json:"until,omitempty"`
+}
+
+// Active reports whether f is in force at now.
+func (f *Freeze) Active(now time.Time) bool {
+	return f != nil && (f.Until.IsZero() || now.Before(f.Until))
+}
+
+// StateDir holds the releaser's state between runs: RELEASER_STATE_DIR, or
+// .releaser in the working directory.
+func StateDir() string {
+	if dir := os.Getenv("RELEASER_STATE_DIR"); dir != "" {
+		return dir
+	}
+	return ".releaser"
+}
+
+var freezeMu sync.Mutex
+
+const freezeState = "freeze.json"
+
+// CurrentFreeze returns the freeze in force, or nil.
+func CurrentFreeze(now time.Time) (*Freeze, error) {
+	freezeMu.Lock()
+	defer freezeMu.Unlock()
+
+	var f *Freeze
+	if err := readStateJSON(freezeState, &f); err != nil {
+		return nil, err
+	}
+	if !f.Active(now) {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// SetFreeze stores f, replacing any earlier freeze. A nil f lifts it.
+func SetFreeze(f *Freeze) error {
+	freezeMu.Lock()
+	defer freezeMu.Unlock()
+
+	if f == nil {
+		return deleteState(freezeState)
+	}
+	return writeStateJSON(freezeState, f)
+}
+
+// freezeRequest is the body of PUT /freeze.
+type freezeRequest struct {
+	Reason string `json:"reason"`
+	By     string `json:"by"`
+	// For is a duration such as "24h"; empty freezes until lifted.
+	For string `json:"for"`
+}
+
+// handleFreeze serves GET (anyone), PUT and DELETE (API token) on /freeze.
+func handleFreeze(token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		now := time.Now()
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var req freezeRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if strings.TrimSpace(req.Reason) == "" {
+				http.Error(w, "a reason is required", http.StatusBadRequest)
+				return
+			}
+			f := &Freeze{Reason: req.Reason, By: req.By, Since: now}
+			if req.For != "" {
+				d, err := time.ParseDuration(req.For)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				f.Until = now.Add(d)
+			}
+			if err := SetFreeze(f); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			fmt.Printf("Releases frozen by %q: %s\n", f.By, f.Reason)
+		case http.MethodDelete:
+			if err := SetFreeze(nil); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			fmt.Println("Release freeze lifted")
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		f, err := CurrentFreeze(now)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Frozen bool    `json:"frozen"`
+			Freeze *Freeze `json:"freeze,omitempty"`
+		}{f != nil, f})
+	}
+}
+
+// authorized checks the request's bearer token. Without a configured token
+// the mutating endpoints are disabled.
+func authorized(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// FreezeClient changes the freeze on a running releaser.
+type FreezeClient struct {
+	// Addr is the releaser's base URL, e.g. http://10.1.0.10:9090.
+	Addr  string
+	Token string
+}
+
+// Freeze stops releases for d (or until lifted when d is zero).
+func (c FreezeClient) Freeze(reason, by string, d time.Duration) (string, error) {
+	req := freezeRequest{Reason: reason, By: by}
+	if d > 0 {
+		req.For = d.String()
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	return c.do(http.MethodPut, body)
+}
+
+func (c FreezeClient) Lift() (string, error) {
+	return c.do(http.MethodDelete, nil)
+}
+
+func (c FreezeClient) Status() (string, error) {
+	return c.do(http.MethodGet, nil)
+}
+
+func (c FreezeClient) do(method string, body []byte) (string, error) {
+	return apiRequest(c.Addr, c.Token, method, "/freeze", body)
+}
+
+// apiRequest calls path on the releaser at addr with the API token and
+// returns the response body.
+func apiRequest(addr, token, method, path string, body []byte) (string, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(addr, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var out bytes.Buffer
+	out.ReadFrom(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("releaser returned %d: %s", resp.StatusCode, strings.TrimSpace(out.String()))
+	}
+	return out.String(), nil
+}
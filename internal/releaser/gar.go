@@ -0,0 +1,215 @@
+package releaser
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/image"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jwt"
+)
+
+// garHost matches the hosts of Google Artifact Registry's Docker
+// repositories, <location>-docker.pkg.dev, and of Container Registry,
+// gcr.io and its regional hosts such as eu.gcr.io.
+var garHost = regexp.MustCompile(`^(?:[a-z0-9-]+-docker\.pkg\.dev|(?:[a-z]+\.)?gcr\.io)$`)
+
+// garRegistry reads images of Google Artifact Registry and Container
+// Registry with Application Default Credentials, found where Google's
+// libraries look for them: the file GOOGLE_APPLICATION_CREDENTIALS names,
+// else gcloud's application_default_credentials.json (see `gcloud auth
+// application-default login`), else the service account of the GCE
+// instance, GKE workload or Cloud Run service the releaser runs as.
+// Service account keys and gcloud user credentials are supported, external
+// account (workload identity federation) files are not. Without
+// credentials, images are read anonymously, which is enough for public
+// ones. Private ones need the Artifact Registry Reader role.
+var garRegistry = &registryBackend{
+	name:    "GAR",
+	handles: garHost.MatchString,
+	client: func(ctx context.Context, r image.Reference) (*registryClient, error) {
+		token, err := googleAccessToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		user := ""
+		if token != "" {
+			user = "oauth2accesstoken"
+		}
+		return newRegistryClient(ctx, r.Registry, r.Repository, "pull", user, token)
+	},
+}
+
+const (
+	googleCloudScope = "https://www.googleapis.com/auth/cloud-platform"
+	googleTokenURL   = "https://oauth2.googleapis.com/token"
+	// googleMetadataHost serves the instance's service account tokens on
+	// GCE, GKE and Cloud Run. GCE_METADATA_HOST overrides it.
+	googleMetadataHost = "metadata.google.internal"
+)
+
+// googleProbeTimeout bounds the look for a metadata server, which off
+// Google Cloud there is none of.
+const googleProbeTimeout = 3 * time.Second
+
+// googleCredentials are the Application Default Credentials, found once.
+var googleCredentials struct {
+	sync.Mutex
+	found bool
+	// tokens is nil when there are no credentials.
+	tokens oauth2.TokenSource
+}
+
+// googleAccessToken returns an access token of the Application Default
+// Credentials, or "" when there are none.
+func googleAccessToken(ctx context.Context) (string, error) {
+	googleCredentials.Lock()
+	defer googleCredentials.Unlock()
+	if !googleCredentials.found {
+		tokens, err := findGoogleCredentials(ctx)
+		if err != nil {
+			return "", err
+		}
+		googleCredentials.tokens, googleCredentials.found = tokens, true
+	}
+	if googleCredentials.tokens == nil {
+		return "", nil
+	}
+	t, err := googleCredentials.tokens.Token()
+	if err != nil {
+		return "", fmt.Errorf("error getting a Google access token: %w", err)
+	}
+	return t.AccessToken, nil
+}
+
+func findGoogleCredentials(ctx context.Context) (oauth2.TokenSource, error) {
+	// oauth2 keeps the context to refresh tokens with, so not ctx.
+	octx := context.WithValue(context.Background(), oauth2.HTTPClient, registryHTTP)
+	name := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if name == "" {
+		name = filepath.Join(gcloudConfigDir(), "application_default_credentials.json")
+		if _, err := os.Stat(name); errors.Is(err, fs.ErrNotExist) {
+			return findGoogleMetadata(ctx)
+		}
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("error reading Google credentials: %w", err)
+	}
+	var f struct {
+		Type         string `json:"type"`
+		ClientEmail  string `json:"client_email"`
+		PrivateKeyID string `json:"private_key_id"`
+		PrivateKey   string `json:"private_key"`
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		RefreshToken string `json:"refresh_token"`
+		TokenURI     string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if f.TokenURI == "" {
+		f.TokenURI = googleTokenURL
+	}
+	switch f.Type {
+	case "service_account":
+		c := &jwt.Config{
+			Email:        f.ClientEmail,
+			PrivateKeyID: f.PrivateKeyID,
+			PrivateKey:   []byte(f.PrivateKey),
+			Scopes:       []string{googleCloudScope},
+			TokenURL:     f.TokenURI,
+		}
+		return c.TokenSource(octx), nil
+	case "authorized_user":
+		c := &oauth2.Config{
+			ClientID:     f.ClientID,
+			ClientSecret: f.ClientSecret,
+			Endpoint:     oauth2.Endpoint{TokenURL: f.TokenURI, AuthStyle: oauth2.AuthStyleInParams},
+			Scopes:       []string{googleCloudScope},
+		}
+		return c.TokenSource(octx, &oauth2.Token{RefreshToken: f.RefreshToken}), nil
+	default:
+		return nil, fmt.Errorf("%s: Google credentials of type %q are not supported", name, f.Type)
+	}
+}
+
+// gcloudConfigDir is where gcloud keeps its configuration.
+func gcloudConfigDir() string {
+	if dir := os.Getenv("CLOUDSDK_CONFIG"); dir != "" {
+		return dir
+	}
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("APPDATA"), "gcloud")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".config", "gcloud")
+}
+
+// findGoogleMetadata returns the metadata server's tokens, or nil when
+// there is no metadata server.
+func findGoogleMetadata(ctx context.Context) (oauth2.TokenSource, error) {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = googleMetadataHost
+	}
+	m := metadataTokens{host}
+	probe, cancel := context.WithTimeout(ctx, googleProbeTimeout)
+	defer cancel()
+	t, err := m.token(probe)
+	var status *statusError
+	if err != nil && !errors.As(err, &status) {
+		// Not on Google Cloud.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting a token from the metadata server: %w", err)
+	}
+	return oauth2.ReuseTokenSource(t, m), nil
+}
+
+// metadataTokens are the tokens of the default service account of a
+// metadata server.
+type metadataTokens struct {
+	host string
+}
+
+func (m metadataTokens) Token() (*oauth2.Token, error) {
+	return m.token(context.Background())
+}
+
+func (m metadataTokens) token(ctx context.Context) (*oauth2.Token, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+m.host+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := registryHTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{m.host, resp.StatusCode}
+	}
+	var t struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		TokenType   string `json:"token_type"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return nil, fmt.Errorf("metadata server token: %w", err)
+	}
+	return &oauth2.Token{AccessToken: t.AccessToken, TokenType: t.TokenType, Expiry: time.Now().Add(time.Duration(t.ExpiresIn) * time.Second)}, nil
+}
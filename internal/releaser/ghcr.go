@@ -0,0 +1,29 @@
+package releaser
+
+import (
+	"context"
+	"os"
+
+	"github.com/velann21/todo-releaser/internal/image"
+)
+
+// ghcrRegistry reads images of the GitHub Container Registry, ghcr.io. Its
+// token service hands out anonymous pull tokens for public packages; for
+// private ones it is asked with RELEASER_GHCR_TOKEN, or else GITHUB_TOKEN,
+// a token with the read:packages scope.
+var ghcrRegistry = &registryBackend{
+	name:    "GHCR",
+	handles: func(host string) bool { return host == "ghcr.io" },
+	client: func(ctx context.Context, r image.Reference) (*registryClient, error) {
+		token := os.Getenv("RELEASER_GHCR_TOKEN")
+		if token == "" {
+			token = os.Getenv("GITHUB_TOKEN")
+		}
+		user := ""
+		if token != "" {
+			// GHCR takes any username with a token.
+			user = "releaser"
+		}
+		return newRegistryClient(ctx, r.Registry, r.Repository, "pull", user, token)
+	},
+}
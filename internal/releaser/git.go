@@ -0,0 +1,334 @@
+package releaser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gitRepo is what the releaser does with the repository it works in. The
+// git CLI does it in the working directory (cliGit); an in-memory managed
+// checkout does it with go-git (memCheckout). What only some setups need,
+// such as the managed checkout's bare clone or a backport's worktree, is
+// left to the git CLI.
+type gitRepo interface {
+	// lookup returns the commit rev names.
+	lookup(rev string) (gitCommit, error)
+	// branch returns the branch checked out, "" when HEAD is detached.
+	branch() (string, error)
+	// show returns path as of rev, byte for byte.
+	show(rev, path string) ([]byte, error)
+	// fileCommits returns the commits of rev's history that change path,
+	// newest first, up to limit of them unless limit is 0.
+	fileCommits(rev, path string, limit int) ([]string, error)
+	// tags returns the tags matching pattern, in no particular order.
+	tags(pattern string) ([]gitTag, error)
+	// describe returns the tag matching pattern nearest to rev in its
+	// history.
+	describe(pattern, rev string) (string, error)
+	// isAncestor reports whether ancestor is rev or in its history.
+	isAncestor(ancestor, rev string) (bool, error)
+	// remoteURL returns the URL of origin.
+	remoteURL() (string, error)
+	// files lists the paths in the index.
+	files() ([]string, error)
+	// staged lists the paths the index changes from rev, HEAD if "".
+	staged(rev string) ([]string, error)
+
+	// add stages paths as they are in the worktree, removals included.
+	add(ctx context.Context, paths ...string) error
+	// commit commits the index with the message msg.
+	commit(ctx context.Context, msg string) error
+	// tag tags HEAD as name.
+	tag(ctx context.Context, name string) error
+	deleteTag(ctx context.Context, name string) error
+	// reset moves HEAD to rev, resetting what mode says.
+	reset(ctx context.Context, rev string, mode resetMode) error
+	// restore writes paths as of rev to the worktree and the index.
+	restore(ctx context.Context, rev string, paths ...string) error
+	// checkout checks out the local branch rev, or rev detached if there
+	// is none. With branch set, it creates branch at rev and checks it out.
+	checkout(ctx context.Context, rev, branch string) error
+	// fetch fetches origin's branch and returns its commit.
+	fetch(ctx context.Context, branch string) (string, error)
+	// push pushes refspecs to origin, all or none of them, with force
+	// whether or not they fast-forward.
+	push(ctx context.Context, force bool, refspecs ...string) error
+	// sync fetches origin's branches and tags, dropping local tags it
+	// doesn't have, and checks out branch detached, the worktree reset
+	// and emptied of everything untracked.
+	sync(ctx context.Context, branch string) error
+}
+
+// gitCommit is a commit as lookup returns it.
+type gitCommit struct {
+	hash, tree string
+	time       time.Time
+}
+
+// gitTag is a tag and when it was made: for a lightweight tag, when its
+// commit was.
+type gitTag struct {
+	name string
+	date time.Time
+}
+
+// resetMode is what reset resets besides HEAD.
+type resetMode int
+
+const (
+	// resetMixed resets the index and keeps the worktree.
+	resetMixed resetMode = iota
+	// resetKeep resets the index and the files of the worktree that
+	// differ between HEAD and the commit, refusing to lose changes.
+	resetKeep
+	// resetHard resets the index and the worktree.
+	resetHard
+)
+
+// currentRepo is the repository the releaser works in: the in-memory
+// managed checkout if there is one, else the git CLI's.
+func currentRepo() gitRepo {
+	if memRepo != nil {
+		return memRepo
+	}
+	return cliGit{}
+}
+
+// commitOf returns the commit rev names.
+func commitOf(rev string) (string, error) {
+	c, err := currentRepo().lookup(rev)
+	return c.hash, err
+}
+
+// sortTags orders tags as git's v:refname does, comparing runs of digits
+// as numbers, so both backends list them alike.
+func sortTags(tags []gitTag) {
+	slices.SortFunc(tags, func(a, b gitTag) int {
+		switch {
+		case versionRefLess(a.name, b.name):
+			return -1
+		case versionRefLess(b.name, a.name):
+			return 1
+		}
+		return 0
+	})
+}
+
+// tagNames returns the names of tags.
+func tagNames(tags []gitTag) []string {
+	names := make([]string, len(tags))
+	for i, t := range tags {
+		names[i] = t.name
+	}
+	return names
+}
+
+// versionRefLess orders tags as git's v:refname does, comparing runs of
+// digits as numbers: v1.9.0 before v1.10.0.
+func versionRefLess(a, b string) bool {
+	for a != "" && b != "" {
+		da, db := digitsPrefix(a), digitsPrefix(b)
+		if da != "" && db != "" {
+			na, _ := strconv.ParseUint(da, 10, 64)
+			nb, _ := strconv.ParseUint(db, 10, 64)
+			if na != nb {
+				return na < nb
+			}
+			a, b = a[len(da):], b[len(db):]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func digitsPrefix(s string) string {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return s[:i]
+}
+
+// cliGit is the repository in the working directory, worked on with the
+// git CLI.
+type cliGit struct{}
+
+func (cliGit) lookup(rev string) (gitCommit, error) {
+	out, err := gitOutput("show", "-s", "--format=%H %T %ct", rev+"^{commit}", "--")
+	if err != nil {
+		return gitCommit{}, err
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 3 {
+		return gitCommit{}, fmt.Errorf("git show %s: unexpected output %q", rev, out)
+	}
+	unix, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return gitCommit{}, fmt.Errorf("error parsing the commit time of %s: %w", rev, err)
+	}
+	return gitCommit{hash: fields[0], tree: fields[1], time: time.Unix(unix, 0)}, nil
+}
+
+func (cliGit) branch() (string, error) {
+	branch, err := gitOutput("rev-parse", "--abbrev-ref", "HEAD")
+	if branch == "HEAD" {
+		return "", err
+	}
+	return branch, err
+}
+
+func (cliGit) show(rev, path string) ([]byte, error) {
+	out, err := exec.Command("git", "show", rev+":"+path).Output()
+	if err != nil {
+		return nil, fmt.Errorf("git show %s:%s: %w", rev, path, err)
+	}
+	return out, nil
+}
+
+func (cliGit) fileCommits(rev, path string, limit int) ([]string, error) {
+	args := []string{"log", "--format=%H"}
+	if limit > 0 {
+		args = append(args, "-n", strconv.Itoa(limit))
+	}
+	out, err := gitOutput(append(args, rev, "--", path)...)
+	return strings.Fields(out), err
+}
+
+func (cliGit) tags(pattern string) ([]gitTag, error) {
+	out, err := gitOutput("for-each-ref", "--format=%(refname:short) %(creatordate:unix)", "refs/tags/"+pattern)
+	if err != nil {
+		return nil, err
+	}
+	var tags []gitTag
+	for _, line := range strings.Split(out, "\n") {
+		name, date, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		unix, err := strconv.ParseInt(date, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("tag %s: %w", name, err)
+		}
+		tags = append(tags, gitTag{name, time.Unix(unix, 0)})
+	}
+	return tags, nil
+}
+
+func (cliGit) describe(pattern, rev string) (string, error) {
+	return gitOutput("describe", "--tags", "--abbrev=0", "--match", pattern, rev)
+}
+
+func (cliGit) isAncestor(ancestor, rev string) (bool, error) {
+	err := exec.Command("git", "merge-base", "--is-ancestor", ancestor, rev).Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() == 1 {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("git merge-base --is-ancestor %s %s: %w", ancestor, rev, err)
+	}
+	return true, nil
+}
+
+func (cliGit) remoteURL() (string, error) {
+	return gitOutput("remote", "get-url", "origin")
+}
+
+func (cliGit) files() ([]string, error) {
+	out, err := gitOutput("ls-files")
+	return strings.Fields(out), err
+}
+
+func (cliGit) staged(rev string) ([]string, error) {
+	args := []string{"diff", "--cached", "--name-only"}
+	if rev != "" {
+		args = append(args, rev)
+	}
+	out, err := gitOutput(args...)
+	return strings.Fields(out), err
+}
+
+func (cliGit) add(ctx context.Context, paths ...string) error {
+	return runGitCommandContext(ctx, append([]string{"add", "--"}, paths...)...)
+}
+
+func (cliGit) commit(ctx context.Context, msg string) error {
+	return runGitCommandContext(ctx, "commit", "-m", msg)
+}
+
+func (cliGit) tag(ctx context.Context, name string) error {
+	return runGitCommandContext(ctx, "tag", name)
+}
+
+func (cliGit) deleteTag(ctx context.Context, name string) error {
+	return runGitCommandContext(ctx, "tag", "-d", name)
+}
+
+func (cliGit) reset(ctx context.Context, rev string, mode resetMode) error {
+	flag := map[resetMode]string{resetMixed: "--mixed", resetKeep: "--keep", resetHard: "--hard"}[mode]
+	return runGitCommandContext(ctx, "reset", "-q", flag, rev)
+}
+
+func (cliGit) restore(ctx context.Context, rev string, paths ...string) error {
+	return runGitCommandContext(ctx, append([]string{"checkout", "-q", rev, "--"}, paths...)...)
+}
+
+func (cliGit) checkout(ctx context.Context, rev, branch string) error {
+	if branch != "" {
+		return runGitCommandContext(ctx, "checkout", "-b", branch, rev)
+	}
+	return runGitCommandContext(ctx, "checkout", rev)
+}
+
+func (cliGit) fetch(ctx context.Context, branch string) (string, error) {
+	if err := runGitCommandContext(ctx, "fetch", "-q", "origin", "refs/heads/"+branch); err != nil {
+		return "", err
+	}
+	return gitOutput("rev-parse", "FETCH_HEAD")
+}
+
+func (cliGit) push(ctx context.Context, force bool, refspecs ...string) error {
+	args := []string{"push"}
+	if len(refspecs) > 1 {
+		args = append(args, "--atomic")
+	}
+	if force {
+		args = append(args, "--force")
+	}
+	return runGitCommandContext(ctx, append(append(args, "origin"), refspecs...)...)
+}
+
+func (cliGit) sync(ctx context.Context, branch string) error {
+	if err := runGitCommandContext(ctx, "fetch", "--prune", "origin", "+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"); err != nil {
+		return err
+	}
+	if err := runGitCommandContext(ctx, "checkout", "--force", "--detach", branch); err != nil {
+		return err
+	}
+	return runGitCommandContext(ctx, "clean", "-ffdx")
+}
+
+// gitOutput runs the git CLI with args and returns its output.
+func gitOutput(args ...string) (string, error) {
+	out, err := exec.Command("git", args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w", strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// runGitCommand runs the git CLI with args, its output going to the
+// releaser's.
+func runGitCommand(args ...string) error {
+	return runGitCommandContext(context.Background(), args...)
+}
@@ -0,0 +1,247 @@
+package releaser
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The releaser can talk to GitHub as a GitHub App installation instead of
+// with GITHUB_TOKEN: pushes, pull requests, releases, issues and checks
+// then use installation tokens, which last an hour and only reach this
+// repository. It is configured from the environment:
+//
+//	RELEASER_GITHUB_APP_ID                the App's ID
+//	RELEASER_GITHUB_APP_PRIVATE_KEY       its private key, PEM encoded
+//	RELEASER_GITHUB_APP_PRIVATE_KEY_FILE  or a file holding it
+//	RELEASER_GITHUB_APP_INSTALLATION_ID   the installation, default the one on the repository
+//	RELEASER_GITHUB_APP_PERMISSIONS       permissions to narrow tokens to, e.g.
+//	                                      contents=write,pull_requests=write,issues=write;
+//	                                      default all those of the installation
+//
+// The App needs contents write access for pushing and releases, pull
+// requests write access for RELEASER_UPDATE_MODE=pr and issues write access
+// for comments. Tokens are minted when needed and renewed before they
+// expire.
+
+// githubAppRenewal is how long before it expires an installation token is
+// replaced.
+const githubAppRenewal = 10 * time.Minute
+
+var githubApp struct {
+	sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// githubAppConfigured reports whether the releaser authenticates as a
+// GitHub App.
+func githubAppConfigured() bool {
+	return os.Getenv("RELEASER_GITHUB_APP_ID") != ""
+}
+
+// githubToken returns the token for the GitHub API and git: an
+// installation token of the GitHub App when one is configured, otherwise
+// GITHUB_TOKEN.
+func githubToken() (string, error) {
+	if !githubAppConfigured() {
+		token := os.Getenv("GITHUB_TOKEN")
+		if token == "" {
+			return "", fmt.Errorf("GITHUB_TOKEN is not set")
+		}
+		return token, nil
+	}
+	githubApp.Lock()
+	defer githubApp.Unlock()
+	if githubApp.token != "" && Clock.Now().Before(githubApp.expires.Add(-githubAppRenewal)) {
+		return githubApp.token, nil
+	}
+	token, expires, err := newInstallationToken()
+	if err != nil {
+		return "", fmt.Errorf("error getting a GitHub App installation token: %w", err)
+	}
+	githubApp.token, githubApp.expires = token, expires
+	return token, nil
+}
+
+// resetGitHubAppToken drops the cached installation token, so the next
+// one is minted with the App's current settings.
+func resetGitHubAppToken() {
+	githubApp.Lock()
+	defer githubApp.Unlock()
+	githubApp.token, githubApp.expires = "", time.Time{}
+}
+
+// GitHubToken prints a GitHub App installation token for this repository,
+// or GITHUB_TOKEN without an App, for scripts that clone or push.
+func GitHubToken() error {
+	token, err := githubToken()
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
+
+// newInstallationToken mints an installation token for this repository.
+func newInstallationToken() (string, time.Time, error) {
+	key, err := githubAppKey()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	jwt, err := githubAppJWT(os.Getenv("RELEASER_GITHUB_APP_ID"), key, Clock.Now())
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	repo := githubRepository()
+	if repo == "" {
+		return "", time.Time{}, fmt.Errorf("cannot tell the GitHub repository from GITHUB_REPOSITORY or the origin remote")
+	}
+	installation := os.Getenv("RELEASER_GITHUB_APP_INSTALLATION_ID")
+	if installation == "" {
+		var inst struct {
+			ID int64 `json:"id"`
+		}
+		if err := githubAppAPI(http.MethodGet, "/repos/"+repo+"/installation", jwt, nil, &inst); err != nil {
+			return "", time.Time{}, fmt.Errorf("finding the App's installation on %s: %w", repo, err)
+		}
+		installation = fmt.Sprint(inst.ID)
+	}
+	_, name, _ := strings.Cut(repo, "/")
+	req := map[string]any{"repositories": []string{name}}
+	if perms := os.Getenv("RELEASER_GITHUB_APP_PERMISSIONS"); perms != "" {
+		permissions, err := parseGitHubPermissions(perms)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		req["permissions"] = permissions
+	}
+	var token struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := githubAppAPI(http.MethodPost, "/app/installations/"+installation+"/access_tokens", jwt, req, &token); err != nil {
+		return "", time.Time{}, err
+	}
+	if token.Token == "" {
+		return "", time.Time{}, errors.New("GitHub returned no token")
+	}
+	return token.Token, token.ExpiresAt, nil
+}
+
+// parseGitHubPermissions parses RELEASER_GITHUB_APP_PERMISSIONS, e.g.
+// contents=write,issues=read.
+func parseGitHubPermissions(s string) (map[string]string, error) {
+	permissions := map[string]string{}
+	for _, p := range strings.Split(s, ",") {
+		name, access, ok := strings.Cut(strings.TrimSpace(p), "=")
+		if !ok || name == "" || !slices.Contains([]string{"read", "write"}, access) {
+			return nil, fmt.Errorf("RELEASER_GITHUB_APP_PERMISSIONS: %q is not permission=read or permission=write", p)
+		}
+		permissions[name] = access
+	}
+	return permissions, nil
+}
+
+// githubAppKey reads the App's private key.
+func githubAppKey() (*rsa.PrivateKey, error) {
+	data := []byte(os.Getenv("RELEASER_GITHUB_APP_PRIVATE_KEY"))
+	if file := os.Getenv("RELEASER_GITHUB_APP_PRIVATE_KEY_FILE"); len(data) == 0 && file != "" {
+		var err error
+		if data, err = os.ReadFile(file); err != nil {
+			return nil, err
+		}
+	}
+	if len(data) == 0 {
+		return nil, errors.New("set RELEASER_GITHUB_APP_PRIVATE_KEY or RELEASER_GITHUB_APP_PRIVATE_KEY_FILE")
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("the GitHub App private key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the GitHub App private key: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("the GitHub App private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// githubAppJWT is the JWT the App authenticates with to mint installation
+// tokens, issued a minute in the past against clock drift and valid for
+// nine minutes of GitHub's ten.
+func githubAppJWT(appID string, key *rsa.PrivateKey, now time.Time) (string, error) {
+	enc := base64.RawURLEncoding
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]any{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": appID,
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + enc.EncodeToString(sig), nil
+}
+
+// githubAppAPI calls the GitHub API at path as the App.
+func githubAppAPI(method, path, jwt string, payload, out any) error {
+	api := os.Getenv("GITHUB_API_URL")
+	if api == "" {
+		api = "https://api.github.com"
+	}
+	var body bytes.Buffer
+	if payload != nil {
+		if err := json.NewEncoder(&body).Encode(payload); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, api+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: deployTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var msg bytes.Buffer
+	msg.ReadFrom(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %d: %s", req.URL.Host, resp.StatusCode, strings.TrimSpace(msg.String()))
+	}
+	return json.Unmarshal(msg.Bytes(), out)
+}
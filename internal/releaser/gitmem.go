@@ -0,0 +1,543 @@
+package releaser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// gitInMemory makes the managed checkout keep its repository in memory
+// with go-git instead of cloning it with the git CLI. Lambda mode sets it:
+// the function's disk is small and doesn't outlive it, and its image
+// needn't carry git.
+var gitInMemory bool
+
+// memRepo is the repository of an in-memory managed checkout, or nil.
+// While it is set it is the releaser's gitRepo (see currentRepo).
+var memRepo *memCheckout
+
+// memCheckout is a clone whose objects and refs go-git keeps in memory.
+// Only its worktree, which the releaser reads and writes the manifest and
+// the rest of the release in, is on disk.
+type memCheckout struct {
+	repo *git.Repository
+	root string
+	url  *url.URL
+}
+
+// cloneInMemory clones u with its worktree in dir, which is emptied first.
+func cloneInMemory(ctx context.Context, u *url.URL, dir string) (*memCheckout, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	m := &memCheckout{root: dir, url: u}
+	repo, err := git.CloneContext(ctx, memory.NewStorage(), osfs.New(dir), &git.CloneOptions{URL: u.String(), Auth: m.auth()})
+	if err != nil {
+		return nil, fmt.Errorf("error cloning %s: %w", u.Redacted(), err)
+	}
+	m.repo = repo
+	return m, nil
+}
+
+// defaultBranch is the branch the clone checked out, the remote's default.
+func (m *memCheckout) defaultBranch() (string, error) {
+	head, err := m.repo.Head()
+	if err != nil {
+		return "", err
+	}
+	return head.Name().Short(), nil
+}
+
+// auth authenticates fetches and pushes as setGitConfig does the git CLI.
+func (m *memCheckout) auth() transport.AuthMethod {
+	if m.url.Scheme != "https" {
+		return nil
+	}
+	if token := gitToken(); token != "" {
+		return &githttp.BasicAuth{Username: "x-access-token", Password: token}
+	}
+	return nil
+}
+
+// hash resolves rev to a commit.
+func (m *memCheckout) hash(rev string) (plumbing.Hash, error) {
+	h, err := m.repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("%s: %w", rev, err)
+	}
+	return *h, nil
+}
+
+func (m *memCheckout) commitObject(rev string) (*object.Commit, error) {
+	h, err := m.hash(rev)
+	if err != nil {
+		return nil, err
+	}
+	return m.repo.CommitObject(h)
+}
+
+func (m *memCheckout) lookup(rev string) (gitCommit, error) {
+	c, err := m.commitObject(rev)
+	if err != nil {
+		return gitCommit{}, err
+	}
+	return gitCommit{hash: c.Hash.String(), tree: c.TreeHash.String(), time: c.Committer.When}, nil
+}
+
+func (m *memCheckout) branch() (string, error) {
+	head, err := m.repo.Head()
+	if err != nil {
+		return "", err
+	}
+	if head.Name() == plumbing.HEAD {
+		// Detached.
+		return "", nil
+	}
+	return head.Name().Short(), nil
+}
+
+func (m *memCheckout) show(rev, p string) ([]byte, error) {
+	c, err := m.commitObject(rev)
+	if err != nil {
+		return nil, err
+	}
+	f, err := c.File(p)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%s: %w", rev, p, err)
+	}
+	data, err := f.Contents()
+	return []byte(data), err
+}
+
+var errStopLog = errors.New("stop")
+
+func (m *memCheckout) fileCommits(rev, p string, limit int) ([]string, error) {
+	h, err := m.hash(rev)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := m.repo.Log(&git.LogOptions{From: h, FileName: &p})
+	if err != nil {
+		return nil, err
+	}
+	var commits []string
+	err = iter.ForEach(func(c *object.Commit) error {
+		commits = append(commits, c.Hash.String())
+		if len(commits) == limit {
+			return errStopLog
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopLog) {
+		return nil, err
+	}
+	return commits, nil
+}
+
+// matchingTags calls fn with each tag matching pattern and the commit it
+// points to.
+func (m *memCheckout) matchingTags(pattern string, fn func(ref *plumbing.Reference, c *object.Commit) error) error {
+	iter, err := m.repo.Tags()
+	if err != nil {
+		return err
+	}
+	return iter.ForEach(func(ref *plumbing.Reference) error {
+		if ok, _ := path.Match(pattern, ref.Name().Short()); !ok {
+			return nil
+		}
+		c, err := m.commitObject(ref.Name().String())
+		if err != nil {
+			return err
+		}
+		return fn(ref, c)
+	})
+}
+
+func (m *memCheckout) tags(pattern string) ([]gitTag, error) {
+	var tags []gitTag
+	err := m.matchingTags(pattern, func(ref *plumbing.Reference, c *object.Commit) error {
+		date := c.Committer.When
+		if t, err := m.repo.TagObject(ref.Hash()); err == nil {
+			date = t.Tagger.When
+		}
+		tags = append(tags, gitTag{ref.Name().Short(), date})
+		return nil
+	})
+	return tags, err
+}
+
+// describe walks rev's history breadth first, nearest commits first, to
+// the first that has a tag matching pattern, and returns the newest of its
+// tags.
+func (m *memCheckout) describe(pattern, rev string) (string, error) {
+	byCommit := map[plumbing.Hash][]string{}
+	err := m.matchingTags(pattern, func(ref *plumbing.Reference, c *object.Commit) error {
+		byCommit[c.Hash] = append(byCommit[c.Hash], ref.Name().Short())
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	start, err := m.commitObject(rev)
+	if err != nil {
+		return "", err
+	}
+	seen := map[plumbing.Hash]bool{start.Hash: true}
+	for queue := []*object.Commit{start}; len(queue) > 0; queue = queue[1:] {
+		c := queue[0]
+		if names := byCommit[c.Hash]; len(names) > 0 {
+			sort.Slice(names, func(i, j int) bool { return versionRefLess(names[i], names[j]) })
+			return names[len(names)-1], nil
+		}
+		err := c.Parents().ForEach(func(p *object.Commit) error {
+			if !seen[p.Hash] {
+				seen[p.Hash] = true
+				queue = append(queue, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("no names found, cannot describe %s", rev)
+}
+
+func (m *memCheckout) isAncestor(ancestor, rev string) (bool, error) {
+	a, err := m.commitObject(ancestor)
+	if err != nil {
+		return false, err
+	}
+	b, err := m.commitObject(rev)
+	if err != nil {
+		return false, err
+	}
+	if a.Hash == b.Hash {
+		return true, nil
+	}
+	return a.IsAncestor(b)
+}
+
+func (m *memCheckout) remoteURL() (string, error) {
+	return m.url.String(), nil
+}
+
+func (m *memCheckout) files() ([]string, error) {
+	idx, err := m.repo.Storer.Index()
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, len(idx.Entries))
+	for i, e := range idx.Entries {
+		paths[i] = e.Name
+	}
+	return paths, nil
+}
+
+func (m *memCheckout) staged(rev string) ([]string, error) {
+	if rev == "" {
+		rev = "HEAD"
+	}
+	c, err := m.commitObject(rev)
+	if err != nil {
+		return nil, err
+	}
+	files, err := c.Files()
+	if err != nil {
+		return nil, err
+	}
+	tree := map[string]plumbing.Hash{}
+	err = files.ForEach(func(f *object.File) error {
+		tree[f.Name] = f.Hash
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	idx, err := m.repo.Storer.Index()
+	if err != nil {
+		return nil, err
+	}
+	var changed []string
+	for _, e := range idx.Entries {
+		if h, ok := tree[e.Name]; !ok || h != e.Hash {
+			changed = append(changed, e.Name)
+		}
+		delete(tree, e.Name)
+	}
+	for p := range tree {
+		changed = append(changed, p)
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// relative makes p, absolute or relative to the working directory,
+// relative to the worktree.
+func (m *memCheckout) relative(p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(m.root, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside the worktree", p)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+func (m *memCheckout) add(ctx context.Context, paths ...string) error {
+	w, err := m.repo.Worktree()
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		rel, err := m.relative(p)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(p); errors.Is(err, fs.ErrNotExist) {
+			// Adding a deleted file stages its removal.
+			if _, err := w.Remove(rel); err != nil {
+				return fmt.Errorf("%s: %w", p, err)
+			}
+			continue
+		}
+		if _, err := w.Add(rel); err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// commit commits as the identity in GIT_AUTHOR_NAME and friends, or
+// "releaser".
+func (m *memCheckout) commit(ctx context.Context, msg string) error {
+	w, err := m.repo.Worktree()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	author := &object.Signature{Name: envOr("GIT_AUTHOR_NAME", "releaser"), Email: envOr("GIT_AUTHOR_EMAIL", "releaser@localhost"), When: now}
+	committer := &object.Signature{Name: envOr("GIT_COMMITTER_NAME", author.Name), Email: envOr("GIT_COMMITTER_EMAIL", author.Email), When: now}
+	_, err = w.Commit(msg, &git.CommitOptions{Author: author, Committer: committer})
+	return err
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func (m *memCheckout) tag(ctx context.Context, name string) error {
+	head, err := m.hash("HEAD")
+	if err != nil {
+		return err
+	}
+	_, err = m.repo.CreateTag(name, head, nil)
+	return err
+}
+
+func (m *memCheckout) deleteTag(ctx context.Context, name string) error {
+	return m.repo.DeleteTag(name)
+}
+
+func (m *memCheckout) reset(ctx context.Context, rev string, mode resetMode) error {
+	h, err := m.hash(rev)
+	if err != nil {
+		return err
+	}
+	w, err := m.repo.Worktree()
+	if err != nil {
+		return err
+	}
+	gitMode := map[resetMode]git.ResetMode{resetMixed: git.MixedReset, resetKeep: git.MergeReset, resetHard: git.HardReset}[mode]
+	return w.Reset(&git.ResetOptions{Commit: h, Mode: gitMode})
+}
+
+func (m *memCheckout) restore(ctx context.Context, rev string, paths ...string) error {
+	c, err := m.commitObject(rev)
+	if err != nil {
+		return err
+	}
+	w, err := m.repo.Worktree()
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		rel, err := m.relative(p)
+		if err != nil {
+			return err
+		}
+		f, err := c.File(rel)
+		if err != nil {
+			return fmt.Errorf("%s:%s: %w", rev, rel, err)
+		}
+		data, err := f.Contents()
+		if err != nil {
+			return err
+		}
+		mode, err := f.Mode.ToOSFileMode()
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(p, []byte(data), mode.Perm()); err != nil {
+			return err
+		}
+		if _, err := w.Add(rel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memCheckout) checkout(ctx context.Context, rev, branch string) error {
+	w, err := m.repo.Worktree()
+	if err != nil {
+		return err
+	}
+	if branch != "" {
+		h, err := m.hash(rev)
+		if err != nil {
+			return err
+		}
+		return w.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName(branch), Hash: h, Create: true})
+	}
+	local := plumbing.NewBranchReferenceName(rev)
+	if _, err := m.repo.Reference(local, false); err == nil {
+		return w.Checkout(&git.CheckoutOptions{Branch: local})
+	}
+	h, err := m.hash(rev)
+	if err != nil {
+		return err
+	}
+	return w.Checkout(&git.CheckoutOptions{Hash: h})
+}
+
+func (m *memCheckout) fetch(ctx context.Context, branch string) (string, error) {
+	ctx, cancel := gitContext(ctx)
+	defer cancel()
+	remote := plumbing.NewRemoteReferenceName("origin", branch)
+	spec := config.RefSpec("+" + plumbing.NewBranchReferenceName(branch).String() + ":" + remote.String())
+	err := m.repo.FetchContext(ctx, &git.FetchOptions{RemoteName: "origin", RefSpecs: []config.RefSpec{spec}, Tags: git.NoTags, Auth: m.auth()})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return "", fmt.Errorf("error fetching %s: %w", branch, err)
+	}
+	ref, err := m.repo.Reference(remote, true)
+	if err != nil {
+		return "", err
+	}
+	return ref.Hash().String(), nil
+}
+
+// push pushes refspecs whose source is a ref, or a revision such as HEAD.
+func (m *memCheckout) push(ctx context.Context, force bool, refspecs ...string) error {
+	ctx, cancel := gitContext(ctx)
+	defer cancel()
+	var specs []config.RefSpec
+	for _, s := range refspecs {
+		src, dst, ok := strings.Cut(s, ":")
+		if !ok {
+			dst = src
+		}
+		if !strings.HasPrefix(src, "refs/") {
+			h, err := m.hash(src)
+			if err != nil {
+				return err
+			}
+			src = h.String()
+		}
+		spec := src + ":" + dst
+		if force {
+			spec = "+" + spec
+		}
+		specs = append(specs, config.RefSpec(spec))
+	}
+	err := m.repo.PushContext(ctx, &git.PushOptions{RemoteName: "origin", RefSpecs: specs, Atomic: len(specs) > 1, Auth: m.auth()})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return fmt.Errorf("error pushing %s: %w", strings.Join(refspecs, " "), err)
+	}
+	return nil
+}
+
+func (m *memCheckout) sync(ctx context.Context, branch string) error {
+	ctx, cancel := gitContext(ctx)
+	defer cancel()
+	specs := []config.RefSpec{"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"}
+	err := m.repo.FetchContext(ctx, &git.FetchOptions{RemoteName: "origin", RefSpecs: specs, Prune: true, Tags: git.NoTags, Auth: m.auth()})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return fmt.Errorf("error fetching %s: %w", m.url.Redacted(), err)
+	}
+	h, err := m.hash(plumbing.NewBranchReferenceName(branch).String())
+	if err != nil {
+		return err
+	}
+	w, err := m.repo.Worktree()
+	if err != nil {
+		return err
+	}
+	if err := w.Checkout(&git.CheckoutOptions{Hash: h, Force: true}); err != nil {
+		return err
+	}
+	return m.clean()
+}
+
+// clean removes every file of the worktree the index doesn't have,
+// ignored or not, and the directories left empty.
+func (m *memCheckout) clean() error {
+	paths, err := m.files()
+	if err != nil {
+		return err
+	}
+	tracked := map[string]bool{}
+	for _, p := range paths {
+		tracked[p] = true
+		for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+			tracked[dir] = true
+		}
+	}
+	return filepath.WalkDir(m.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == m.root {
+			return err
+		}
+		rel, err := filepath.Rel(m.root, p)
+		if err != nil {
+			return err
+		}
+		if tracked[filepath.ToSlash(rel)] {
+			return nil
+		}
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return fs.SkipDir
+		}
+		return nil
+	})
+}
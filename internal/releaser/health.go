@@ -0,0 +1,297 @@
+package releaser
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/pki"
+	"github.com/velann21/todo-releaser/internal/schedule"
+)
+
+// DefaultHTTPAddr is where /healthz and /metrics are served unless
+// RELEASER_HTTP_ADDR overrides it.
+const DefaultHTTPAddr = ":9090"
+
+// Status tracks the outcome of reconcile runs for health reporting.
+type Status struct {
+	mu          sync.Mutex
+	started     time.Time
+	runs        int
+	failures    int
+	releases    int
+	lastRun     time.Time
+	lastSuccess time.Time
+	// lastIdle is when Run last woke to find no service due.
+	lastIdle time.Time
+	// schedule is when each service is checked next.
+	schedule *schedule.Scheduler
+}
+
+func NewStatus(now time.Time) *Status {
+	return &Status{started: now, schedule: schedule.New(scheduleJitter())}
+}
+
+// Record stores the result of a reconcile run finished at now.
+func (s *Status) Record(now time.Time, released bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.runs++
+	s.lastRun = now
+	if released {
+		s.releases++
+	}
+	if err != nil {
+		s.failures++
+		return
+	}
+	s.lastSuccess = now
+}
+
+// Idle records that Run woke at now and found no service due. It keeps a
+// daemon whose services are all checked rarely healthy, as long as its last
+// reconcile succeeded.
+func (s *Status) Idle(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastIdle = now
+}
+
+// Healthy reports whether a reconcile run succeeded recently, or the daemon
+// has been idle since one did. A fresh process gets the same grace period
+// before its first successful run.
+func (s *Status) Healthy(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	last := s.lastSuccess
+	if last.IsZero() {
+		last = s.started
+	}
+	if s.lastRun.Equal(s.lastSuccess) && s.lastIdle.After(last) {
+		last = s.lastIdle
+	}
+	return now.Sub(last) <= 3*PollingInterval
+}
+
+func (s *Status) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if !s.Healthy(time.Now()) {
+		http.Error(w, "no successful reconcile recently", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// handleMetrics writes the counters in the Prometheus text format.
+func (s *Status) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP releaser_reconcile_total Reconcile runs since start.\n")
+	fmt.Fprintf(w, "# TYPE releaser_reconcile_total counter\n")
+	fmt.Fprintf(w, "releaser_reconcile_total %d\n", s.runs)
+	fmt.Fprintf(w, "# HELP releaser_reconcile_failures_total Reconcile runs that returned an error.\n")
+	fmt.Fprintf(w, "# TYPE releaser_reconcile_failures_total counter\n")
+	fmt.Fprintf(w, "releaser_reconcile_failures_total %d\n", s.failures)
+	fmt.Fprintf(w, "# HELP releaser_releases_total Releases tagged since start.\n")
+	fmt.Fprintf(w, "# TYPE releaser_releases_total counter\n")
+	fmt.Fprintf(w, "releaser_releases_total %d\n", s.releases)
+	fmt.Fprintf(w, "# HELP releaser_last_success_timestamp_seconds Unix time of the last successful reconcile.\n")
+	fmt.Fprintf(w, "# TYPE releaser_last_success_timestamp_seconds gauge\n")
+	fmt.Fprintf(w, "releaser_last_success_timestamp_seconds %d\n", unixOrZero(s.lastSuccess))
+	fmt.Fprintf(w, "# HELP releaser_last_run_timestamp_seconds Unix time of the last reconcile.\n")
+	fmt.Fprintf(w, "# TYPE releaser_last_run_timestamp_seconds gauge\n")
+	fmt.Fprintf(w, "releaser_last_run_timestamp_seconds %d\n", unixOrZero(s.lastRun))
+	frozen := 0
+	if f, _ := CurrentFreeze(time.Now()); f != nil {
+		frozen = 1
+	}
+	fmt.Fprintf(w, "# HELP releaser_frozen Whether a release freeze is in force.\n")
+	fmt.Fprintf(w, "# TYPE releaser_frozen gauge\n")
+	fmt.Fprintf(w, "releaser_frozen %d\n", frozen)
+	writeRegistryMetrics(w)
+	writeSizeMetrics(w)
+	writeReleaseSLOMetrics(w)
+}
+
+// handleStatus reports the counters, health, release freeze and where each
+// environment is as JSON.
+func (s *Status) handleStatus(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	freeze, err := CurrentFreeze(now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	healthy := s.Healthy(now)
+	envs, warnings, err := Environments()
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf("environment status unavailable: %v", err))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Healthy      bool                `json:"healthy"`
+		Runs         int                 `json:"runs"`
+		Failures     int                 `json:"failures"`
+		Releases     int                 `json:"releases"`
+		LastRun      time.Time           `json:"last_run"`
+		LastSuccess  time.Time           `json:"last_success"`
+		Frozen       bool                `json:"frozen"`
+		Freeze       *Freeze             `json:"freeze,omitempty"`
+		Environments []EnvironmentStatus `json:"environments,omitempty"`
+		Warnings     []string            `json:"warnings,omitempty"`
+	}{healthy, s.runs, s.failures, s.releases, s.lastRun, s.lastSuccess, freeze != nil, freeze, envs, warnings})
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// ServeStatus exposes /healthz, /metrics, /status, /schedule, /freeze,
+// /manifest, /releases, /releases/{tag}, /config, /agents, /skew, /slo,
+// /checks and /webhooks in the background. Changing the freeze, agent reports, starting
+// checks and the release webhooks need RELEASER_API_TOKEN as a bearer token.
+//
+// With RELEASER_TLS_ADDR set the same endpoints are also served over TLS
+// for deploy agents, with a certificate for RELEASER_TLS_HOSTS from the
+// agent CA, along with /enroll for agents to get client certificates.
+// Agents then report with their certificate instead of the API token.
+//
+// With RELEASER_SLACK_SIGNING_SECRET set, /slack/commands serves the
+// /release slash command of a Slack app and /slack/actions its buttons
+// (the app's interactivity request URL). RELEASER_SLACK_ROLES gives Slack
+// users the viewer, operator or admin role; see parseSlackRoles.
+//
+// With RELEASER_PUBLIC_STATUS=true, /public/status.json serves the
+// release and service versions, and nothing else, to anyone.
+//
+// The API token and Slack settings are read again when the secret sources
+// rotate them.
+func ServeStatus(s *Status) {
+	addr := os.Getenv("RELEASER_HTTP_ADDR")
+	if addr == "" {
+		addr = DefaultHTTPAddr
+	}
+
+	var ca *pki.CA
+	tlsAddr := os.Getenv("RELEASER_TLS_ADDR")
+	if tlsAddr != "" {
+		var err error
+		if ca, err = pki.LoadOrCreateCA(PKIDir()); err != nil {
+			fmt.Printf("Not serving agents over TLS: %v\n", err)
+			tlsAddr = ""
+		}
+	}
+	// The routes are rebuilt when the API token or Slack secrets rotate.
+	var mux statusMux
+	mux.Store(newStatusMux(s, ca))
+	onSecretsRotated(func(names []string) {
+		if slices.ContainsFunc(names, func(name string) bool {
+			return name == "RELEASER_API_TOKEN" || strings.HasPrefix(name, "RELEASER_SLACK_")
+		}) {
+			mux.Store(newStatusMux(s, ca))
+		}
+	})
+
+	if tlsAddr != "" {
+		if err := serveTLS(&mux, tlsAddr, ca); err != nil {
+			fmt.Printf("Not serving agents over TLS: %v\n", err)
+		}
+	}
+
+	go func() {
+		fmt.Printf("Serving health and metrics on %s\n", addr)
+		if err := http.ListenAndServe(addr, &mux); err != nil {
+			fmt.Printf("Health server stopped: %v\n", err)
+		}
+	}()
+}
+
+// statusMux serves with the routes last stored in it.
+type statusMux struct {
+	atomic.Pointer[http.ServeMux]
+}
+
+func (m *statusMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Load().ServeHTTP(w, r)
+}
+
+// newStatusMux routes the endpoints of ServeStatus, with the API token and
+// Slack secrets currently in the environment. With the agent CA it also
+// routes POST /enroll/tokens.
+func newStatusMux(s *Status, ca *pki.CA) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("GET /schedule", s.handleSchedule)
+	token := os.Getenv("RELEASER_API_TOKEN")
+	mux.HandleFunc("/freeze", handleFreeze(token))
+	mux.HandleFunc("GET /manifest", handleManifest)
+	mux.HandleFunc("GET /releases", handleReleases)
+	mux.HandleFunc("GET /releases/{tag...}", handleRelease)
+	mux.HandleFunc("GET /config", handleConfig)
+	mux.HandleFunc("GET /agents", handleAgents)
+	mux.HandleFunc("PUT /agents/{name}", handleAgentReport(token))
+	mux.HandleFunc("PUT /agents/{name}/containers", handleAgentContainers(token))
+	mux.HandleFunc("GET /skew", handleSkew)
+	mux.HandleFunc("GET /slo", handleSLO)
+	mux.HandleFunc("POST /checks", handleChecks(token))
+	mux.HandleFunc("/webhooks", handleWebhooks(token))
+	mux.HandleFunc("DELETE /webhooks/{id}", handleWebhook(token))
+	mux.HandleFunc("GET /webhooks/{id}/deliveries", handleWebhookDeliveries(token))
+	if secret := os.Getenv("RELEASER_SLACK_SIGNING_SECRET"); secret != "" {
+		roles, err := parseSlackRoles(os.Getenv("RELEASER_SLACK_ROLES"))
+		if err != nil {
+			fmt.Printf("Not serving Slack commands: RELEASER_SLACK_ROLES: %v\n", err)
+		} else {
+			bot := &slackBot{secret: secret, roles: roles, status: s}
+			mux.HandleFunc("POST /slack/commands", bot.handleCommand)
+			mux.HandleFunc("POST /slack/actions", bot.handleAction)
+		}
+	}
+	if ca != nil {
+		mux.HandleFunc("POST /enroll/tokens", handleEnrollTokens(ca, token))
+	}
+	if os.Getenv("RELEASER_PUBLIC_STATUS") == "true" {
+		mux.HandleFunc("GET /public/status.json", handlePublicStatus)
+	}
+	return mux
+}
+
+// serveTLS serves mux over TLS, plus the enrollment endpoints, which are
+// only offered over TLS so bootstrap tokens never travel in the clear.
+func serveTLS(mux http.Handler, addr string, ca *pki.CA) error {
+	conf, err := ca.ServerTLSConfig(strings.Split(os.Getenv("RELEASER_TLS_HOSTS"), ","))
+	if err != nil {
+		return err
+	}
+
+	tlsMux := http.NewServeMux()
+	tlsMux.Handle("/", mux)
+	tlsMux.HandleFunc("POST /enroll", handleEnroll(ca))
+	tlsMux.HandleFunc("POST /enroll/renew", handleRenew(ca))
+
+	srv := &http.Server{Addr: addr, Handler: tlsMux, TLSConfig: conf}
+	go func() {
+		fmt.Printf("Serving agents over TLS on %s (CA %s)\n", addr, ca.Hash())
+		if err := srv.ListenAndServeTLS("", ""); err != nil {
+			fmt.Printf("TLS server stopped: %v\n", err)
+		}
+	}()
+	return nil
+}
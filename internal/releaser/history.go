@@ -0,0 +1,229 @@
+package releaser
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// A page of GET /releases holds DefaultHistoryLimit releases, unless
+// ?limit asks for up to MaxHistoryLimit.
+const (
+	DefaultHistoryLimit = 50
+	MaxHistoryLimit     = 500
+)
+
+// Release is a release of the history served by GET /releases.
+type Release struct {
+	Tag  string    `json:"tag"`
+	Time time.Time `json:"time"`
+	// Services are the versions of the release's services, by name.
+	Services map[string]string `json:"services"`
+	// Changed are the services the release moved to a new version, or
+	// added, since the release before it.
+	Changed []string `json:"changed"`
+}
+
+// ReleasePage is a page of the release history. Next is the cursor of the
+// page after it, empty on the last page.
+type ReleasePage struct {
+	Releases []Release `json:"releases"`
+	Next     string    `json:"next,omitempty"`
+}
+
+// HistoryQuery selects a page of the release history.
+type HistoryQuery struct {
+	// Since and Until bound when the releases were tagged; zero is
+	// unbounded. Until is exclusive.
+	Since, Until time.Time
+	// Services keeps the releases that changed any of them; none keeps all.
+	Services []string
+	// Oldest sorts the oldest release first rather than the newest.
+	Oldest bool
+	// Cursor is the Next of the page before, "" for the first page.
+	Cursor string
+	Limit  int
+}
+
+// parseHistoryQuery reads a HistoryQuery from the query string of
+// GET /releases: ?since and ?until as RFC 3339 times, ?service, repeated
+// or comma-separated, ?sort=newest or oldest, ?cursor and ?limit.
+func parseHistoryQuery(v url.Values) (HistoryQuery, error) {
+	q := HistoryQuery{Cursor: v.Get("cursor"), Limit: DefaultHistoryLimit}
+	for _, bound := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		if s := v.Get(bound.name); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return q, fmt.Errorf("%s: %w", bound.name, err)
+			}
+			*bound.t = t
+		}
+	}
+	for _, s := range v["service"] {
+		for name := range strings.SplitSeq(s, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				q.Services = append(q.Services, name)
+			}
+		}
+	}
+	switch v.Get("sort") {
+	case "", "newest":
+	case "oldest":
+		q.Oldest = true
+	default:
+		return q, fmt.Errorf("sort: %q must be newest or oldest", v.Get("sort"))
+	}
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > MaxHistoryLimit {
+			return q, fmt.Errorf("limit: %q must be a number from 1 to %d", s, MaxHistoryLimit)
+		}
+		q.Limit = n
+	}
+	namespace, err := tagNamespace()
+	if err != nil {
+		return q, err
+	}
+	if q.Cursor != "" && !isRelease(q.Cursor, namespace) {
+		return q, fmt.Errorf("cursor: %q is not a release", q.Cursor)
+	}
+	return q, nil
+}
+
+// errUnknownCursor is returned for a cursor that names no release.
+var errUnknownCursor = errors.New("cursor: no such release")
+
+// releaseVersions caches the service versions of each release tag, as
+// tags don't move and the history would otherwise read every manifest on
+// each request.
+var releaseVersions sync.Map
+
+// tagVersions returns the versions of the services in the manifest tagged
+// tag, by name.
+func tagVersions(tag string) (map[string]string, error) {
+	if versions, ok := releaseVersions.Load(tag); ok {
+		return versions.(map[string]string), nil
+	}
+	data, err := gitShow("refs/tags/"+tag, ManifestFile)
+	if err != nil {
+		return nil, err
+	}
+	var m manifest.Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("error parsing %s at %s: %w", ManifestFile, tag, err)
+	}
+	versions := make(map[string]string, len(m.Services))
+	for _, s := range m.Services {
+		versions[s.Name] = currentVersion(s)
+	}
+	releaseVersions.Store(tag, versions)
+	return versions, nil
+}
+
+// releaseHistory lists every release, oldest first, by when it was tagged.
+func releaseHistory() ([]Release, error) {
+	namespace, err := tagNamespace()
+	if err != nil {
+		return nil, err
+	}
+	tags, err := currentRepo().tags(namespace + "v*")
+	if err != nil {
+		return nil, err
+	}
+	// Tags made in the same second keep their version order.
+	sortTags(tags)
+	slices.SortStableFunc(tags, func(a, b gitTag) int { return a.date.Compare(b.date) })
+	var releases []Release
+	var previous map[string]string
+	for _, t := range tags {
+		tag := t.name
+		if !isRelease(tag, namespace) {
+			continue
+		}
+		versions, err := tagVersions(tag)
+		if err != nil {
+			return nil, err
+		}
+		changed := []string{}
+		for name, version := range versions {
+			if prev, ok := previous[name]; !ok || prev != version {
+				changed = append(changed, name)
+			}
+		}
+		slices.Sort(changed)
+		releases = append(releases, Release{Tag: tag, Time: t.date.UTC(), Services: versions, Changed: changed})
+		previous = versions
+	}
+	return releases, nil
+}
+
+// ReleaseHistory returns the page of the release history q selects.
+func ReleaseHistory(q HistoryQuery) (*ReleasePage, error) {
+	releases, err := releaseHistory()
+	if err != nil {
+		return nil, err
+	}
+	if !q.Oldest {
+		slices.Reverse(releases)
+	}
+	if q.Cursor != "" {
+		i := slices.IndexFunc(releases, func(r Release) bool { return r.Tag == q.Cursor })
+		if i < 0 {
+			return nil, fmt.Errorf("%w: %s", errUnknownCursor, q.Cursor)
+		}
+		releases = releases[i+1:]
+	}
+	page := &ReleasePage{Releases: []Release{}}
+	for _, r := range releases {
+		if !q.Since.IsZero() && r.Time.Before(q.Since) ||
+			!q.Until.IsZero() && !r.Time.Before(q.Until) ||
+			len(q.Services) > 0 && !slices.ContainsFunc(q.Services, func(name string) bool { return slices.Contains(r.Changed, name) }) {
+			continue
+		}
+		if len(page.Releases) == q.Limit {
+			page.Next = page.Releases[len(page.Releases)-1].Tag
+			break
+		}
+		page.Releases = append(page.Releases, r)
+	}
+	return page, nil
+}
+
+// handleReleases serves GET /releases, a page of the release history; see
+// parseHistoryQuery for the query it takes. A page that isn't the last
+// links the next with its cursor.
+func handleReleases(w http.ResponseWriter, r *http.Request) {
+	q, err := parseHistoryQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := ReleaseHistory(q)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errUnknownCursor) {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if page.Next != "" {
+		next := r.URL.Query()
+		next.Set("cursor", page.Next)
+		w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, next.Encode()))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
@@ -0,0 +1,194 @@
+package releaser
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/image"
+)
+
+// HotfixOptions control Hotfix.
+type HotfixOptions struct {
+	// Service is the manifest service to bump.
+	Service string
+	// Tag is the image tag to bump it to.
+	Tag string
+	// Branch makes the release on the last release's branch,
+	// release/<vYYYYWW.minor>, instead of the current one.
+	Branch bool
+}
+
+// RegisterFlags binds o to flags in fs.
+func (o *HotfixOptions) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Service, "service", "", "service to bump (required)")
+	fs.StringVar(&o.Tag, "tag", "", "image tag to bump it to (required)")
+	fs.BoolVar(&o.Branch, "branch", false, "release on the last release's branch instead of the current one")
+}
+
+// Hotfix releases exactly one service at opts.Tag as a patch of the
+// current release, without polling the registry for the other services.
+// Hotfixes are how fixes go out during a freeze, so they aren't held by
+// one. The release is marked as a hotfix in its commit, notification and
+// notes.
+func Hotfix(ctx context.Context, opts HotfixOptions) (*Result, error) {
+	if opts.Service == "" || opts.Tag == "" {
+		return nil, errors.New("a service and a tag are required")
+	}
+	if err := startRun(); err != nil {
+		return nil, err
+	}
+	if freeze, err := CurrentFreeze(time.Now()); err != nil {
+		return nil, fmt.Errorf("error reading release freeze: %w", err)
+	} else if freeze != nil {
+		fmt.Printf("Releases are frozen (%s); releasing the hotfix anyway\n", freeze.Reason)
+	}
+
+	if opts.Branch {
+		if managed != nil {
+			return nil, errors.New("hotfixing on a release branch needs a checkout; it isn't supported with RELEASER_REPO_URL")
+		}
+		restore, err := checkoutReleaseBranch()
+		if err != nil {
+			return nil, err
+		}
+		defer restore()
+	}
+
+	m, err := loadManifest()
+	if err != nil {
+		return nil, fmt.Errorf("error loading manifest: %w", err)
+	}
+	i := serviceIndex(m, opts.Service)
+	if i < 0 {
+		return nil, fmt.Errorf("no service %q in %s", opts.Service, ManifestFile)
+	}
+	s := m.Services[i]
+	if err := checkPlatforms(ctx, s, opts.Tag); err != nil {
+		return nil, err
+	}
+	from := s.Version
+	if pinned := s.Digest(); pinned != "" {
+		// A digest-only service stays pinned, to the digest of the tag.
+		r, err := image.Parse(s.Image)
+		if err != nil {
+			return nil, err
+		}
+		digest, err := tagDigest(ctx, r.Name(), opts.Tag)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving %s:%s: %w", r.Name(), opts.Tag, err)
+		}
+		if digest == pinned {
+			return nil, fmt.Errorf("%s is already at %s (%s)", opts.Service, opts.Tag, shortDigest(digest))
+		}
+		if from == "" || from == opts.Tag {
+			from = shortDigest(pinned)
+		}
+		fmt.Printf("Hotfixing %s: %s -> %s (%s)\n", opts.Service, from, opts.Tag, shortDigest(digest))
+		m.SetDigest(i, opts.Tag, digest, runID, Clock.Now())
+	} else {
+		if from == opts.Tag {
+			return nil, fmt.Errorf("%s is already at %s", opts.Service, opts.Tag)
+		}
+		fmt.Printf("Hotfixing %s: %s -> %s\n", opts.Service, from, opts.Tag)
+		m.SetVersion(i, opts.Tag, runID, Clock.Now())
+	}
+	version, err := releasePatch(ctx, m, fmt.Sprintf("fix(hotfix): bump %s to %s", opts.Service, opts.Tag))
+	if version == "" {
+		return nil, err
+	}
+	changes := []Change{{Service: opts.Service, From: from, To: opts.Tag}}
+	linkSources(ctx, m, changes)
+	measureSizes(ctx, m, changes)
+	result := &Result{Version: version, Changes: changes, Hotfix: true}
+	recordSizes(result)
+	recordTimeToRelease(ctx, m, result)
+	if notifyErr := notifyRelease(ctx, m, result); notifyErr != nil {
+		fmt.Printf("Error sending release notification: %v\n", notifyErr)
+	}
+	publishEvent(LifecycleEvent{Type: EventReleaseCreated, Version: version, Changes: changes, Hotfix: result.Hotfix})
+	if notesErr := publishReleaseNotes(ctx, m, result); notesErr != nil {
+		fmt.Printf("Error publishing release notes: %v\n", notesErr)
+	}
+	if hookErr := deliverReleaseWebhooks(m, result); hookErr != nil {
+		fmt.Printf("Error delivering release webhooks: %v\n", hookErr)
+	}
+	if archiveErr := archiveRelease(ctx, m, result); archiveErr != nil {
+		fmt.Printf("Error archiving release artifacts: %v\n", archiveErr)
+	}
+	if backportErr := backportRelease(m, result); backportErr != nil {
+		fmt.Printf("Error backporting %s: %v\n", version, backportErr)
+	}
+	if err == nil {
+		err = watchRelease(ctx, m, version)
+	}
+	return result, err
+}
+
+// calver matches release versions, in a tag namespace or not, e.g.
+// todo/v202452.1.0, with the release line and the patch number.
+var calver = regexp.MustCompile(`^((?:[A-Za-z0-9][A-Za-z0-9._-]*/)?v\d{6}\.\d+)\.(\d+)$`)
+
+// nextPatch is the first patch release of version's line that isn't
+// already tagged.
+func nextPatch(version string, tags []string) (string, error) {
+	match := calver.FindStringSubmatch(version)
+	if match == nil {
+		return "", fmt.Errorf("%q is not a release version", version)
+	}
+	patch, _ := strconv.Atoi(match[2])
+	taken := map[string]bool{}
+	for _, tag := range tags {
+		taken[tag] = true
+	}
+	for {
+		patch++
+		next := fmt.Sprintf("%s.%d", match[1], patch)
+		if !taken[next] {
+			return next, nil
+		}
+	}
+}
+
+// checkoutReleaseBranch checks out the branch of the last release tag,
+// creating it at the tag the first time, and returns a func that goes back
+// to where HEAD was.
+func checkoutReleaseBranch() (func(), error) {
+	tags, err := releaseTags()
+	if err != nil {
+		return nil, err
+	}
+	if len(tags) == 0 {
+		return nil, errors.New("no release to branch from")
+	}
+	last := tags[len(tags)-1]
+	branch := "release/" + calver.FindStringSubmatch(last)[1]
+
+	repo := currentRepo()
+	head, err := repo.branch()
+	if err != nil {
+		return nil, err
+	}
+	if head == "" {
+		if head, err = commitOf("HEAD"); err != nil {
+			return nil, err
+		}
+	}
+	rev, create := last, branch
+	if _, err := commitOf("refs/heads/" + branch); err == nil {
+		rev, create = branch, ""
+	}
+	if err := repo.checkout(context.Background(), rev, create); err != nil {
+		return nil, err
+	}
+	fmt.Printf("Hotfixing on %s; push it with 'git push --tags origin %s'\n", branch, branch)
+	return func() {
+		if err := repo.checkout(context.Background(), head, ""); err != nil {
+			fmt.Printf("Error checking out %s again: %v\n", head, err)
+		}
+	}, nil
+}
@@ -0,0 +1,254 @@
+package releaser
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/velann21/todo-releaser/internal/agent"
+	"github.com/velann21/todo-releaser/internal/image"
+	"github.com/velann21/todo-releaser/internal/manifest"
+	"gopkg.in/yaml.v3"
+)
+
+// ImportOptions control Import.
+type ImportOptions struct {
+	// Host is a DOCKER_HOST, e.g. ssh://deploy@10.1.0.20, whose running
+	// compose services are imported.
+	Host string
+	// Compose is a compose file whose services' images are imported.
+	Compose string
+	// Out is the manifest written, ManifestFile unless set; - for stdout.
+	Out string
+	// Pin pins every service to the digest of its image rather than its
+	// tag.
+	Pin bool
+	// Force overwrites an existing manifest.
+	Force bool
+	// Bundle is a release bundle, written by Export, to load into Registry
+	// and apply instead.
+	Bundle string
+	// Registry is the registry host, e.g. registry.site:5000, a bundle's
+	// images are loaded into.
+	Registry string
+}
+
+// RegisterFlags binds o to flags in fs.
+func (o *ImportOptions) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Host, "host", "", "import the compose services running on this Docker host, e.g. ssh://deploy@10.1.0.20")
+	fs.StringVar(&o.Compose, "compose", "", "import the services of this compose file")
+	fs.StringVar(&o.Out, "out", ManifestFile, "manifest to write, - for stdout")
+	fs.BoolVar(&o.Pin, "pin", false, "pin every service to its image's digest rather than its tag")
+	fs.BoolVar(&o.Force, "force", false, "overwrite an existing manifest")
+	fs.StringVar(&o.Bundle, "bundle", "", "load the images of this release bundle into -registry and apply its release")
+	fs.StringVar(&o.Registry, "registry", "", "registry to load a bundle's images into, e.g. registry.site:5000")
+}
+
+// Import writes a first release manifest for an environment that already
+// runs, with the services of opts.Host's running containers or of the
+// compose file opts.Compose at the images they run. A service runs its tag,
+// unless the tag is latest or missing, or opts.Pin is set, when it is
+// pinned to its image's digest: the one the host pulled, or for a compose
+// file the one the registry serves. Containers of images built on the host,
+// which no registry has, are left out. The release version is left empty
+// until the first release.
+//
+// With opts.Bundle, it applies a release bundle instead; see importBundle.
+func Import(ctx context.Context, opts ImportOptions) (*manifest.Manifest, error) {
+	if opts.Bundle != "" && opts.Host == "" && opts.Compose == "" {
+		return importBundle(ctx, opts)
+	}
+	if (opts.Host == "") == (opts.Compose == "") || opts.Bundle != "" {
+		return nil, errors.New("import needs one of -host, -compose or -bundle")
+	}
+	if opts.Out == "" {
+		opts.Out = ManifestFile
+	}
+	if opts.Out != "-" && !opts.Force && fileExists(opts.Out) {
+		return nil, fmt.Errorf("%s exists; pass -force to overwrite it", opts.Out)
+	}
+
+	var services []manifest.Service
+	var err error
+	if opts.Host != "" {
+		services, err = importHost(ctx, opts.Host, opts.Pin)
+	} else {
+		services, err = importCompose(ctx, opts.Compose, opts.Pin)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(services) == 0 {
+		return nil, errors.New("found no service to import")
+	}
+	m := &manifest.Manifest{Services: services}
+	if opts.Out == "-" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return m, enc.Encode(m)
+	}
+	if err := manifest.Save(opts.Out, m); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d services into %s\n", len(services), opts.Out)
+	return m, nil
+}
+
+// importHost returns the compose services running on the Docker engine at
+// host, at the images their containers run.
+func importHost(ctx context.Context, host string, pin bool) ([]manifest.Service, error) {
+	containers, err := agent.Containers(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("error listing the containers on %s: %w", host, err)
+	}
+	var services []manifest.Service
+	images := map[string]string{}
+	for _, c := range containers {
+		ref := c.Image
+		// A container of an image since retagged, or never tagged, reports
+		// the image's ID.
+		if strings.HasPrefix(ref, "sha256:") {
+			if len(c.RepoDigests) == 0 {
+				fmt.Fprintf(os.Stderr, "Leaving out %s: image %s was not pulled from a registry\n", c.Service, shortDigest(ref))
+				continue
+			}
+			ref = c.RepoDigests[0]
+		}
+		if seen, ok := images[c.Service]; ok {
+			if seen != ref {
+				return nil, fmt.Errorf("%s runs both %s and %s on %s", c.Service, seen, ref, host)
+			}
+			continue
+		}
+		images[c.Service] = ref
+		s, err := importedService(c.Service, ref, c.RepoDigests, pin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Leaving out %s: %v\n", c.Service, err)
+			continue
+		}
+		services = append(services, s)
+	}
+	return services, nil
+}
+
+// importCompose returns the services of the compose file path that run
+// an image, rather than build one, in the order of their names. The
+// registry is asked for the digests of the images to pin.
+func importCompose(ctx context.Context, path string, pin bool) ([]manifest.Service, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var compose struct {
+		Services map[string]struct {
+			Image string `yaml:"image"`
+		} `yaml:"services"`
+	}
+	if err := yaml.Unmarshal(data, &compose); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	var services []manifest.Service
+	for _, name := range slices.Sorted(maps.Keys(compose.Services)) {
+		ref, err := interpolate(compose.Services[name].Image)
+		if err != nil {
+			return nil, fmt.Errorf("%s: service %s: %w", path, name, err)
+		}
+		if ref == "" {
+			fmt.Fprintf(os.Stderr, "Leaving out %s: it builds its image\n", name)
+			continue
+		}
+		r, err := image.Parse(ref)
+		if err != nil {
+			return nil, fmt.Errorf("%s: service %s: %w", path, name, err)
+		}
+		var digests []string
+		if r.Digest == "" && (pin || mutableTag(r.Tag)) {
+			tag := r.Tag
+			if tag == "" {
+				tag = "latest"
+			}
+			digest, err := tagDigest(ctx, r.Name(), tag)
+			if err != nil {
+				return nil, fmt.Errorf("error resolving %s:%s: %w", r.Name(), tag, err)
+			}
+			digests = []string{r.Name() + "@" + digest}
+		}
+		s, err := importedService(name, ref, digests, pin)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, s)
+	}
+	return services, nil
+}
+
+// mutableTag reports whether tag says nothing of the image it points to.
+func mutableTag(tag string) bool {
+	return tag == "" || tag == "latest"
+}
+
+// importedService is the manifest entry of the service name running ref,
+// whose image has the registry digests digests, name@sha256:… as Docker
+// reports them.
+func importedService(name, ref string, digests []string, pin bool) (manifest.Service, error) {
+	r, err := image.Parse(ref)
+	if err != nil {
+		return manifest.Service{}, err
+	}
+	s := manifest.Service{Name: name, Image: r.Name(), Version: r.Tag}
+	if mutableTag(r.Tag) {
+		s.Version = ""
+	} else if !pin {
+		return s, nil
+	}
+	digest := r.Digest
+	for _, d := range digests {
+		if dr, err := image.Parse(d); digest == "" && err == nil && dr.Name() == r.Name() {
+			digest = dr.Digest
+		}
+	}
+	if digest == "" {
+		return manifest.Service{}, fmt.Errorf("%s was not pulled from a registry", ref)
+	}
+	s.Image += "@" + digest
+	return s, nil
+}
+
+// interpolate expands the variables of a compose file value from the
+// environment: $NAME, ${NAME}, ${NAME:-default} when unset or empty,
+// ${NAME-default} when unset, and $$ for a dollar sign.
+func interpolate(s string) (string, error) {
+	var missing []string
+	out := os.Expand(s, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		if name, def, ok := strings.Cut(name, ":-"); ok {
+			if v := os.Getenv(name); v != "" {
+				return v
+			}
+			return def
+		}
+		if name, def, ok := strings.Cut(name, "-"); ok {
+			if v, set := os.LookupEnv(name); set {
+				return v
+			}
+			return def
+		}
+		v, set := os.LookupEnv(name)
+		if !set {
+			missing = append(missing, name)
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("%s is not set", strings.Join(missing, ", "))
+	}
+	return out, nil
+}
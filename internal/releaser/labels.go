@@ -0,0 +1,261 @@
+package releaser
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/velann21/todo-releaser/internal/image"
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// OCI annotation keys images carry their source in.
+const (
+	LabelSource   = "org.opencontainers.image.source"
+	LabelRevision = "org.opencontainers.image.revision"
+)
+
+// Media types accepted when fetching image manifests.
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// imageLabels returns the labels in the config of the image ref at tag,
+// from Docker Hub, the registry plugin that handles it or one of
+// registryBackends. It returns nil when the registry has no way to read
+// them.
+func imageLabels(ctx context.Context, ref, tag string) (map[string]string, error) {
+	r, err := image.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	if r.IsDockerHub() {
+		return getImageLabelsFromDockerHub(ctx, r, tag)
+	}
+	if rc, _, err := nativeRegistry(ctx, r); err != nil || rc != nil {
+		if err != nil {
+			return nil, err
+		}
+		return rc.labels(ctx, tag)
+	}
+	p, err := registryPlugin(ctx, r.Registry)
+	if err != nil || p == nil || !p.Info.Labels {
+		return nil, err
+	}
+	var result struct {
+		Labels map[string]string `json:"labels"`
+	}
+	if err := throttle(ctx, r.Registry); err != nil {
+		return nil, err
+	}
+	err = p.Call(ctx, "image_labels", map[string]string{"image": ref, "tag": tag}, &result)
+	return result.Labels, err
+}
+
+// registryClient reads manifests and blobs from a registry's v2 API with a
+// bearer token, or basic auth when username is set instead.
+type registryClient struct {
+	base  string
+	repo  string
+	token string
+	http  *http.Client
+
+	username, password string
+}
+
+// authorize adds c's credentials to req, if it is for the registry. The
+// absolute URLs a registry returns, such as the next page of a tags list
+// or an upload location, can be on another host, which mustn't get them.
+func (c *registryClient) authorize(req *http.Request) {
+	if req.URL.Scheme+"://"+req.URL.Host != c.base {
+		return
+	}
+	if c.username != "" && c.token == "" {
+		req.SetBasicAuth(c.username, c.password)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+}
+
+func (c *registryClient) get(ctx context.Context, path string, accept []string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base+"/v2/"+c.repo+path, nil)
+	if err != nil {
+		return err
+	}
+	c.authorize(req)
+	if len(accept) > 0 {
+		req.Header.Set("Accept", strings.Join(accept, ", "))
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("registry returned %d for %s", resp.StatusCode, path)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// imageManifest is the part of an image manifest or index labels and
+// sizes are found through.
+type imageManifest struct {
+	Manifests []struct {
+		Digest   string `json:"digest"`
+		Platform struct {
+			OS           string `json:"os"`
+			Architecture string `json:"architecture"`
+			Variant      string `json:"variant"`
+		} `json:"platform"`
+	} `json:"manifests"`
+	Config struct {
+		Digest string `json:"digest"`
+		Size   int64  `json:"size"`
+	} `json:"config"`
+	Layers []struct {
+		Size int64 `json:"size"`
+	} `json:"layers"`
+}
+
+// imageManifest fetches the manifest of tag, taking the linux/amd64 image
+// of a multi-platform index.
+func (c *registryClient) imageManifest(ctx context.Context, tag string) (*imageManifest, error) {
+	var m imageManifest
+	if err := c.get(ctx, "/manifests/"+tag, manifestMediaTypes, &m); err != nil {
+		return nil, err
+	}
+	if len(m.Manifests) > 0 {
+		digest := m.Manifests[0].Digest
+		for _, d := range m.Manifests {
+			if d.Platform.OS == "linux" && d.Platform.Architecture == "amd64" {
+				digest = d.Digest
+				break
+			}
+		}
+		m = imageManifest{}
+		if err := c.get(ctx, "/manifests/"+digest, manifestMediaTypes, &m); err != nil {
+			return nil, err
+		}
+	}
+	if m.Config.Digest == "" {
+		return nil, fmt.Errorf("manifest of %s has no config", tag)
+	}
+	return &m, nil
+}
+
+// labels returns the labels in the config of tag's image.
+func (c *registryClient) labels(ctx context.Context, tag string) (map[string]string, error) {
+	m, err := c.imageManifest(ctx, tag)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Config struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"config"`
+	}
+	if err := c.get(ctx, "/blobs/"+m.Config.Digest, nil, &config); err != nil {
+		return nil, err
+	}
+	return config.Config.Labels, nil
+}
+
+// size returns the compressed size of tag's image, its config and layers,
+// which is what a pull downloads.
+func (c *registryClient) size(ctx context.Context, tag string) (int64, error) {
+	m, err := c.imageManifest(ctx, tag)
+	if err != nil {
+		return 0, err
+	}
+	size := m.Config.Size
+	for _, l := range m.Layers {
+		size += l.Size
+	}
+	return size, nil
+}
+
+func getImageLabelsFromDockerHub(ctx context.Context, ref image.Reference, tag string) (map[string]string, error) {
+	c, err := dockerHubRegistry(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return c.labels(ctx, tag)
+}
+
+// dockerHubRegistry returns a client for ref's repository on Docker Hub's
+// registry, with an anonymous pull token.
+func dockerHubRegistry(ctx context.Context, ref image.Reference) (*registryClient, error) {
+	tokenURL := fmt.Sprintf("https://auth.docker.io/token?service=registry.docker.io&scope=repository:%s:pull", ref.Repository)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := registryHTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("docker hub auth returned %d", resp.StatusCode)
+	}
+	var auth struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&auth); err != nil {
+		return nil, err
+	}
+	return &registryClient{base: "https://registry-1.docker.io", repo: ref.Repository, token: auth.Token, http: registryHTTP}, nil
+}
+
+// sourceWebURL turns an image's source label (a repository web or clone
+// URL) into its web URL, or "" when it isn't one.
+func sourceWebURL(source string) string {
+	source = strings.TrimSuffix(strings.TrimSuffix(source, "/"), ".git")
+	if rest, ok := strings.CutPrefix(source, "git@"); ok {
+		host, path, ok := strings.Cut(rest, ":")
+		if !ok {
+			return ""
+		}
+		return "https://" + host + "/" + path
+	}
+	u, err := url.Parse(source)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host + u.Path
+}
+
+// linkSources fills in each change's source revision and links from the
+// labels of its images: the commit the new image was built from and, when
+// the old image came from the same repository, the compare view of
+// everything in between, which is where the issues and pull requests a
+// release includes are found. Images without labels are left unlinked.
+func linkSources(ctx context.Context, m *manifest.Manifest, changes []Change) {
+	for i, c := range changes {
+		s, ok := m.Service(c.Service)
+		if !ok || c.Config != "" {
+			continue
+		}
+		to, err := imageLabels(ctx, s.Image, c.To)
+		if err != nil {
+			fmt.Printf("Error reading the labels of %s:%s: %v\n", s.Image, c.To, err)
+			continue
+		}
+		repo := sourceWebURL(to[LabelSource])
+		changes[i].Revision = to[LabelRevision]
+		if repo == "" || changes[i].Revision == "" {
+			continue
+		}
+		changes[i].CommitURL = repo + "/commit/" + changes[i].Revision
+		if from, err := imageLabels(ctx, s.Image, c.From); err == nil &&
+			sourceWebURL(from[LabelSource]) == repo && from[LabelRevision] != "" && from[LabelRevision] != changes[i].Revision {
+			changes[i].CompareURL = fmt.Sprintf("%s/compare/%s...%s", repo, from[LabelRevision], changes[i].Revision)
+		}
+	}
+}
@@ -0,0 +1,484 @@
+package releaser
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/blobstore"
+	"github.com/velann21/todo-releaser/internal/image"
+)
+
+// lambdaStateKey is where the state dir is saved, relative to
+// RELEASER_STATE_PREFIX.
+const lambdaStateKey = "state.tar.gz"
+
+// lambdaRuntimeAPI is the version prefix of the Lambda runtime API.
+const lambdaRuntimeAPI = "/2018-06-01/runtime"
+
+// RunLambda runs the releaser as an AWS Lambda function, serving
+// invocations from the Lambda runtime API until the process is stopped,
+// instead of as a daemon on the control plane. The function runs the
+// releaser image on a custom runtime with "lambda" as its command. Each
+// invocation is one reconcile of the managed checkout (RELEASER_REPO_URL),
+// which go-git clones into memory on a cold start and keeps while the
+// function stays warm; only its worktree is written, under /tmp. It is
+// triggered by
+//
+//   - an EventBridge schedule, which checks every service;
+//   - an ECR "Image Action" push event, which checks the services of the
+//     pushed repository;
+//   - a registry webhook through API Gateway, Docker Hub's or a
+//     distribution registry's notifications, which does the same.
+//
+// The state dir does not survive a cold start, so it is restored from and
+// saved back to S3 around every invocation:
+//
+//	RELEASER_STATE_BUCKET   bucket the state is kept in; required
+//	RELEASER_STATE_PREFIX   key prefix, default releaser
+//	RELEASER_WEBHOOK_TOKEN  token webhooks must send as "Authorization: Bearer <token>";
+//	                        unset refuses them
+//
+// Docker Hub's webhooks can't set headers, so they have to go through a
+// proxy that adds it.
+//
+// Invocations must not overlap, so the function wants a reserved
+// concurrency of 1. RunLambda returns an error only when it cannot serve.
+func RunLambda() error {
+	api := os.Getenv("AWS_LAMBDA_RUNTIME_API")
+	if api == "" {
+		return errors.New("AWS_LAMBDA_RUNTIME_API is not set; the lambda command only runs inside AWS Lambda")
+	}
+	if os.Getenv("RELEASER_REPO_URL") == "" {
+		return errors.New("RELEASER_REPO_URL must be set in Lambda mode")
+	}
+	store, err := lambdaStateStore()
+	if err != nil {
+		return err
+	}
+	// /tmp is the only writable directory.
+	if os.Getenv("RELEASER_STATE_DIR") == "" {
+		os.Setenv("RELEASER_STATE_DIR", filepath.Join(os.TempDir(), "releaser"))
+	}
+	gitInMemory = true
+	base := "http://" + api + lambdaRuntimeAPI
+
+	for {
+		resp, err := http.Get(base + "/invocation/next")
+		if err != nil {
+			return fmt.Errorf("error fetching the next invocation: %w", err)
+		}
+		event, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("error reading the next invocation: %w", err)
+		}
+		id := resp.Header.Get("Lambda-Runtime-Aws-Request-Id")
+		deadline, err := lambdaDeadline(resp.Header)
+		if err != nil {
+			return err
+		}
+
+		out, err := invokeLambda(deadline, store, event)
+		if err != nil {
+			fmt.Printf("Error during invocation %s: %v\n", id, err)
+			out = map[string]string{"errorType": "ReleaserError", "errorMessage": err.Error()}
+			err = postLambda(base+"/invocation/"+id+"/error", out)
+		} else {
+			err = postLambda(base+"/invocation/"+id+"/response", out)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// lambdaStateStore opens the S3 store the state dir is kept in.
+func lambdaStateStore() (blobstore.Store, error) {
+	bucket := os.Getenv("RELEASER_STATE_BUCKET")
+	if bucket == "" {
+		return nil, errors.New("RELEASER_STATE_BUCKET must be set in Lambda mode")
+	}
+	prefix := os.Getenv("RELEASER_STATE_PREFIX")
+	if prefix == "" {
+		prefix = "releaser"
+	}
+	return blobstore.Open(blobstore.Config{Driver: blobstore.S3, Bucket: bucket, Prefix: prefix})
+}
+
+func postLambda(url string, out any) error {
+	body, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error posting the invocation result: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("error posting the invocation result: %s", resp.Status)
+	}
+	return nil
+}
+
+// lambdaSaveTime is kept from the end of an invocation for saving the
+// state dir, so a run cut short by the deadline still saves what it did.
+const lambdaSaveTime = 15 * time.Second
+
+// lambdaDeadline returns when an invocation times out, from the headers h
+// the runtime API sent it with.
+func lambdaDeadline(h http.Header) (time.Time, error) {
+	ms, err := strconv.ParseInt(h.Get("Lambda-Runtime-Deadline-Ms"), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid Lambda-Runtime-Deadline-Ms %q", h.Get("Lambda-Runtime-Deadline-Ms"))
+	}
+	return time.UnixMilli(ms), nil
+}
+
+// invokeLambda handles one event, with the state dir restored from store
+// before and saved to it after. The event is handled until lambdaSaveTime
+// before deadline, the state saved until deadline.
+func invokeLambda(deadline time.Time, store blobstore.Store, event []byte) (any, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := restoreState(ctx, store); err != nil {
+		return nil, err
+	}
+	runCtx, cancelRun := context.WithDeadline(ctx, deadline.Add(-lambdaSaveTime))
+	out, err := handleLambdaEvent(runCtx, event)
+	cancelRun()
+	if saveErr := saveState(ctx, store); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	return out, err
+}
+
+// lambdaEvent holds the fields of the events the function is triggered by
+// that tell them apart.
+type lambdaEvent struct {
+	// EventBridge.
+	Source     string          `json:"source"`
+	DetailType string          `json:"detail-type"`
+	Detail     json.RawMessage `json:"detail"`
+	// API Gateway, REST and HTTP APIs.
+	Body            *string           `json:"body"`
+	IsBase64Encoded bool              `json:"isBase64Encoded"`
+	Headers         map[string]string `json:"headers"`
+}
+
+// header returns the value of the request header name, which API Gateway
+// passes as sent by REST APIs and lowercased by HTTP APIs.
+func (e lambdaEvent) header(name string) string {
+	for k, v := range e.Headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// LambdaOutcome is what an invocation reports.
+type LambdaOutcome struct {
+	// Checked are the services checked, or nil for all of them.
+	Checked []string `json:"checked"`
+	Release *Result  `json:"release,omitempty"`
+	// Skipped says why nothing was checked.
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// handleLambdaEvent reconciles the services event concerns. API Gateway
+// events get an HTTP response back.
+func handleLambdaEvent(ctx context.Context, data []byte) (any, error) {
+	var event lambdaEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, fmt.Errorf("error parsing the event: %w", err)
+	}
+
+	if event.Body == nil {
+		repos, err := eventBridgeRepositories(event)
+		if err != nil {
+			return nil, err
+		}
+		return lambdaReconcile(ctx, repos)
+	}
+
+	want := os.Getenv("RELEASER_WEBHOOK_TOKEN")
+	got, _ := strings.CutPrefix(event.header("Authorization"), "Bearer ")
+	if want == "" || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+		return apiGatewayResponse(http.StatusUnauthorized, map[string]string{"error": "invalid token"}), nil
+	}
+	body := []byte(*event.Body)
+	if event.IsBase64Encoded {
+		var err error
+		if body, err = base64.StdEncoding.DecodeString(*event.Body); err != nil {
+			return apiGatewayResponse(http.StatusBadRequest, map[string]string{"error": "invalid body"}), nil
+		}
+	}
+	repos, err := webhookRepositories(body)
+	if err != nil {
+		return apiGatewayResponse(http.StatusBadRequest, map[string]string{"error": err.Error()}), nil
+	}
+	outcome, err := lambdaReconcile(ctx, repos)
+	if err != nil {
+		return apiGatewayResponse(http.StatusInternalServerError, map[string]string{"error": err.Error()}), nil
+	}
+	return apiGatewayResponse(http.StatusOK, outcome), nil
+}
+
+// eventBridgeRepositories returns the repositories an EventBridge event
+// pushed to, or nil for a scheduled event.
+func eventBridgeRepositories(event lambdaEvent) ([]string, error) {
+	switch {
+	case event.DetailType == "Scheduled Event":
+		return nil, nil
+	case event.Source == "aws.ecr" && event.DetailType == "ECR Image Action":
+		var detail struct {
+			ActionType string `json:"action-type"`
+			Result     string `json:"result"`
+			Repository string `json:"repository-name"`
+		}
+		if err := json.Unmarshal(event.Detail, &detail); err != nil {
+			return nil, fmt.Errorf("error parsing the ECR event: %w", err)
+		}
+		if detail.ActionType != "PUSH" || detail.Result != "SUCCESS" {
+			return []string{}, nil
+		}
+		return []string{detail.Repository}, nil
+	default:
+		return nil, fmt.Errorf("unsupported event %q from %q", event.DetailType, event.Source)
+	}
+}
+
+// webhookRepositories returns the repositories a Docker Hub or
+// distribution registry webhook reports pushes to.
+func webhookRepositories(body []byte) ([]string, error) {
+	var hook struct {
+		// Docker Hub.
+		Repository *struct {
+			RepoName string `json:"repo_name"`
+		} `json:"repository"`
+		// Distribution notifications.
+		Events []struct {
+			Action string `json:"action"`
+			Target struct {
+				Repository string `json:"repository"`
+			} `json:"target"`
+		} `json:"events"`
+	}
+	if err := json.Unmarshal(body, &hook); err != nil {
+		return nil, fmt.Errorf("invalid webhook: %w", err)
+	}
+	if hook.Repository != nil {
+		return []string{hook.Repository.RepoName}, nil
+	}
+	repos := []string{}
+	for _, e := range hook.Events {
+		if e.Action == "push" && !slices.Contains(repos, e.Target.Repository) {
+			repos = append(repos, e.Target.Repository)
+		}
+	}
+	if len(hook.Events) == 0 {
+		return nil, errors.New("unrecognised webhook")
+	}
+	return repos, nil
+}
+
+// lambdaReconcile reconciles the services whose image is in one of repos,
+// or all of them when repos is nil.
+func lambdaReconcile(ctx context.Context, repos []string) (*LambdaOutcome, error) {
+	var due []string
+	if repos != nil {
+		if len(repos) == 0 {
+			return &LambdaOutcome{Checked: []string{}, Skipped: "no image was pushed"}, nil
+		}
+		if err := syncCheckout(); err != nil {
+			return nil, fmt.Errorf("error updating the checkout: %w", err)
+		}
+		m, err := loadManifest()
+		if err != nil {
+			return nil, fmt.Errorf("error loading manifest: %w", err)
+		}
+		due = []string{}
+		for _, s := range m.Services {
+			if slices.ContainsFunc(repos, func(repo string) bool { return imageInRepository(s.Image, repo) }) {
+				due = append(due, s.Name)
+			}
+		}
+		if len(due) == 0 {
+			return &LambdaOutcome{Checked: due, Skipped: "no service uses " + strings.Join(repos, ", ")}, nil
+		}
+	}
+	result, err := reconcile(ctx, due)
+	if err != nil {
+		return nil, err
+	}
+	return &LambdaOutcome{Checked: due, Release: result}, nil
+}
+
+// imageInRepository reports whether ref is an image of repo, a repository
+// path as registries name them in their events, e.g. team/app for
+// 123456789012.dkr.ecr.eu-west-1.amazonaws.com/team/app.
+func imageInRepository(ref, repo string) bool {
+	r, err := image.Parse(ref)
+	if err != nil || repo == "" {
+		return false
+	}
+	return r.Repository == repo || strings.TrimPrefix(r.Repository, "library/") == repo
+}
+
+func apiGatewayResponse(status int, body any) map[string]any {
+	data, _ := json.Marshal(body)
+	return map[string]any{
+		"statusCode": status,
+		"headers":    map[string]string{"Content-Type": "application/json"},
+		"body":       string(data),
+	}
+}
+
+// lambdaStateSkip is left out of the saved state: the managed checkout,
+// which is cloned again on a cold start.
+const lambdaStateSkip = "repo"
+
+// restoreState replaces the state dir with the one saved in store, if any.
+func restoreState(ctx context.Context, store blobstore.Store) error {
+	r, err := store.Get(ctx, lambdaStateKey)
+	if errors.Is(err, blobstore.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading the state from %s: %w", store.URL(lambdaStateKey), err)
+	}
+	defer r.Close()
+
+	closeStateStore()
+	dir := StateDir()
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for _, e := range entries {
+		if e.Name() != lambdaStateSkip {
+			if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	if err := extractState(r, dir); err != nil {
+		return fmt.Errorf("error restoring the state from %s: %w", store.URL(lambdaStateKey), err)
+	}
+	return nil
+}
+
+// saveState writes the state dir to store.
+func saveState(ctx context.Context, store blobstore.Store) error {
+	// Closing the SQLite state store leaves its file complete.
+	closeStateStore()
+	var buf bytes.Buffer
+	if err := archiveState(&buf, StateDir()); err != nil {
+		return fmt.Errorf("error archiving the state: %w", err)
+	}
+	if err := store.Put(ctx, lambdaStateKey, &buf); err != nil {
+		return fmt.Errorf("error saving the state to %s: %w", store.URL(lambdaStateKey), err)
+	}
+	return nil
+}
+
+// archiveState writes the regular files under dir, but for the managed
+// checkout, to w as a gzipped tarball.
+func archiveState(w io.Writer, dir string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && p == dir {
+			return fs.SkipAll
+		}
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if rel == lambdaStateSkip && d.IsDir() {
+			return fs.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{Name: filepath.ToSlash(rel), Mode: int64(info.Mode().Perm()), Size: int64(len(data)), ModTime: info.ModTime()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// extractState unpacks a tarball written by archiveState into dir.
+func extractState(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(hdr.Name)
+		if !fs.ValidPath(name) || name == "." || hdr.Typeflag != tar.TypeReg {
+			return fmt.Errorf("unexpected entry %q", hdr.Name)
+		}
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(hdr.Mode).Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
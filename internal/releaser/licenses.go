@@ -0,0 +1,193 @@
+package releaser
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// LicensePolicyFile configures the license gate. It is optional; without it
+// images aren't scanned.
+const LicensePolicyFile = "license_policy.json"
+
+// LicensePolicy lists the licenses new image versions may not bring in:
+//
+//	{"disallowed": ["AGPL-*", "GPL-3.0*", "SSPL-1.0"], "action": "block"}
+//
+// Patterns match SPDX license IDs as path.Match does. Action is block,
+// which leaves a service at its current version when its update
+// introduces a disallowed license, or warn, which releases it with a
+// warning in the notification and notes.
+type LicensePolicy struct {
+	Disallowed []string `json:"disallowed"`
+	Action     string   `json:"action"`
+}
+
+// License gate actions and verdicts.
+const (
+	LicensePass  = "pass"
+	LicenseWarn  = "warn"
+	LicenseBlock = "block"
+)
+
+// LicenseVerdict is the gate's decision on a change.
+type LicenseVerdict struct {
+	Verdict string `json:"verdict"`
+	// Introduced are the licenses in the new image but not the old one,
+	// and Disallowed those of them the policy disallows.
+	Introduced []string `json:"introduced,omitempty"`
+	Disallowed []string `json:"disallowed,omitempty"`
+}
+
+func loadLicensePolicy(file string) (*LicensePolicy, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var p LicensePolicy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", file, err)
+	}
+	switch p.Action {
+	case "":
+		p.Action = LicenseBlock
+	case LicenseBlock, LicenseWarn:
+	default:
+		return nil, fmt.Errorf("%s: action %q must be block or warn", file, p.Action)
+	}
+	for _, pattern := range p.Disallowed {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s: bad pattern %q: %w", file, pattern, err)
+		}
+	}
+	return &p, nil
+}
+
+// verdict judges a change from the licenses of the old and new image.
+func (p *LicensePolicy) verdict(from, to []string) *LicenseVerdict {
+	old := map[string]bool{}
+	for _, l := range from {
+		old[l] = true
+	}
+	v := &LicenseVerdict{Verdict: LicensePass}
+	for _, l := range to {
+		if old[l] {
+			continue
+		}
+		v.Introduced = append(v.Introduced, l)
+		for _, pattern := range p.Disallowed {
+			if ok, _ := path.Match(pattern, l); ok {
+				v.Disallowed = append(v.Disallowed, l)
+				break
+			}
+		}
+	}
+	if len(v.Disallowed) > 0 {
+		v.Verdict = p.Action
+	}
+	return v
+}
+
+// imageLicenses lists the SPDX licenses of the packages in the image ref,
+// as found by syft (or RELEASER_LICENSE_SCANNER, a command taking the same
+// arguments), and returns the SBOM they were read from.
+func imageLicenses(ref string) ([]string, []byte, error) {
+	scanner := os.Getenv("RELEASER_LICENSE_SCANNER")
+	if scanner == "" {
+		scanner = "syft"
+	}
+	out, err := exec.Command(scanner, "registry:"+ref, "-o", "json", "-q").Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, nil, fmt.Errorf("%s %s: %w: %s", scanner, ref, err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, nil, err
+	}
+	var sbom struct {
+		Artifacts []struct {
+			Licenses []struct {
+				Value          string `json:"value"`
+				SPDXExpression string `json:"spdxExpression"`
+			} `json:"licenses"`
+		} `json:"artifacts"`
+	}
+	if err := json.Unmarshal(out, &sbom); err != nil {
+		return nil, nil, fmt.Errorf("error parsing the %s output for %s: %w", scanner, ref, err)
+	}
+	seen := map[string]bool{}
+	var licenses []string
+	for _, a := range sbom.Artifacts {
+		for _, l := range a.Licenses {
+			id := l.SPDXExpression
+			if id == "" {
+				id = l.Value
+			}
+			if id != "" && !seen[id] {
+				seen[id] = true
+				licenses = append(licenses, id)
+			}
+		}
+	}
+	sort.Strings(licenses)
+	return licenses, out, nil
+}
+
+// gateLicenses scans the images of changes, which move m's services from
+// their versions in before, against LicensePolicyFile. Blocked changes are
+// undone in m and returned separately; the verdicts, and the SBOMs of the
+// new images for archiving, are recorded on the changes. An image that can't be scanned blocks its change under a
+// blocking policy and is released with a warning otherwise.
+func gateLicenses(m *manifest.Manifest, before []manifest.Service, changes []Change) (kept, blocked []Change, err error) {
+	policy, err := loadLicensePolicy(LicensePolicyFile)
+	if err != nil || policy == nil {
+		return changes, nil, err
+	}
+	for _, c := range changes {
+		i := serviceIndex(m, c.Service)
+		if i < 0 {
+			kept = append(kept, c)
+			continue
+		}
+		from, _, err := imageLicenses(before[i].Ref())
+		var to []string
+		if err == nil {
+			to, c.sbom, err = imageLicenses(m.Services[i].Ref())
+		}
+		if err != nil {
+			fmt.Printf("Error scanning %s for licenses: %v\n", c.Service, err)
+			c.Licenses = &LicenseVerdict{Verdict: policy.Action}
+		} else {
+			c.Licenses = policy.verdict(from, to)
+		}
+		switch c.Licenses.Verdict {
+		case LicenseBlock:
+			fmt.Printf("Holding %s at %s: %s -> %s %s\n", c.Service, c.From, c.From, c.To, licenseProblem(c.Licenses))
+			m.Services[i] = before[i]
+			blocked = append(blocked, c)
+			continue
+		case LicenseWarn:
+			fmt.Printf("Warning: %s -> %s %s\n", c.Service, c.To, licenseProblem(c.Licenses))
+		}
+		kept = append(kept, c)
+	}
+	return kept, blocked, nil
+}
+
+// licenseProblem says why a verdict isn't a pass.
+func licenseProblem(v *LicenseVerdict) string {
+	if len(v.Disallowed) == 0 {
+		return "could not be scanned for licenses"
+	}
+	return "introduces disallowed licenses " + strings.Join(v.Disallowed, ", ")
+}
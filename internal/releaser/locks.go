@@ -0,0 +1,151 @@
+package releaser
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// LocksFile ties services this manifest shares with the manifest of
+// another branch, such as a shared auth image run in staging and prod, to
+// that manifest's releases of them. It is optional.
+//
+//	{"locks": [
+//	  {"service": "todo-auth", "leader": "staging", "max_behind": 1}
+//	]}
+//
+// Leader is the branch whose manifest leads. A release is refused while it
+// would leave a locked service more than max_behind of the leader's
+// releases of it behind, counted as the versions the leader's manifest has
+// moved the service to since the version this one runs. A version the
+// leader never ran counts the leader's versions newer than it.
+const LocksFile = "release_locks.json"
+
+// LocksConfig is the content of LocksFile.
+type LocksConfig struct {
+	Locks []Lock `json:"locks"`
+}
+
+// Lock ties Service to its releases on the branch Leader.
+type Lock struct {
+	Service   string `json:"service"`
+	Leader    string `json:"leader"`
+	MaxBehind int    `json:"max_behind"`
+}
+
+func loadLocksConfig(file string) (*LocksConfig, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return &LocksConfig{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var c LocksConfig
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", file, err)
+	}
+	for _, l := range c.Locks {
+		if l.Service == "" || l.Leader == "" || l.MaxBehind < 0 {
+			return nil, fmt.Errorf("%s: locks need a service, a leader branch and a max_behind of 0 or more", file)
+		}
+	}
+	return &c, nil
+}
+
+// leaderVersions returns the versions the manifest on branch has run
+// service at, newest first, each once.
+func leaderVersions(branch, service string) ([]string, error) {
+	head, err := currentRepo().fetch(context.Background(), branch)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching %s: %w", branch, err)
+	}
+	commits, err := currentRepo().fileCommits(head, ManifestFile, 0)
+	if err != nil {
+		return nil, err
+	}
+	var versions []string
+	for _, commit := range commits {
+		data, err := gitShow(commit, ManifestFile)
+		if err != nil {
+			return nil, err
+		}
+		m, err := manifest.Parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing the manifest of %s at %s: %w", branch, shortRevision(commit), err)
+		}
+		if s, ok := m.Service(service); ok && !slices.Contains(versions, currentVersion(s)) {
+			versions = append(versions, currentVersion(s))
+		}
+	}
+	return versions, nil
+}
+
+// releasesBehind returns the versions of leader, newest first, that
+// version lags: those before it, or when leader never ran it, those newer
+// than it. ok is false when version can't be placed.
+func releasesBehind(leader []string, version string) (ahead []string, ok bool) {
+	if i := slices.Index(leader, version); i >= 0 {
+		return leader[:i], true
+	}
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		return nil, false
+	}
+	for _, l := range leader {
+		if lv, err := semver.NewVersion(l); err == nil && lv.GreaterThan(v) {
+			ahead = append(ahead, l)
+		}
+	}
+	return ahead, true
+}
+
+// checkLocks returns an error naming every service of m LocksFile locks
+// that is further behind its leader than the lock allows.
+func checkLocks(m *manifest.Manifest) error {
+	c, err := loadLocksConfig(LocksFile)
+	if err != nil || len(c.Locks) == 0 {
+		return err
+	}
+	var problems []string
+	for _, l := range c.Locks {
+		s, ok := m.Service(l.Service)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s is locked to %s but isn't in the manifest", l.Service, l.Leader))
+			continue
+		}
+		leader, err := leaderVersions(l.Leader, l.Service)
+		if err != nil {
+			return err
+		}
+		if len(leader) == 0 {
+			problems = append(problems, fmt.Sprintf("%s is locked to %s, whose manifest never ran it", l.Service, l.Leader))
+			continue
+		}
+		version := currentVersion(s)
+		ahead, ok := releasesBehind(leader, version)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s runs %s, which %s never ran and isn't a version to compare", l.Service, version, l.Leader))
+			continue
+		}
+		if len(ahead) > l.MaxBehind {
+			releases := "releases"
+			if len(ahead) == 1 {
+				releases = "release"
+			}
+			problems = append(problems, fmt.Sprintf("%s at %s is %d %s behind %s, which has run %s since; at most %d allowed",
+				l.Service, version, len(ahead), releases, l.Leader, strings.Join(ahead, ", "), l.MaxBehind))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s: %s", LocksFile, strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package releaser
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/velann21/todo-releaser/internal/manifest"
+	"github.com/velann21/todo-releaser/internal/provenance"
+)
+
+// Manifest verification guards against someone with write access to the
+// repository slipping the daemon a manifest of their own. It is off unless
+// RELEASER_MANIFEST_VERIFY is one of:
+//
+//	signature  the manifest must be signed, in release_manifest.json.sig, by
+//	           one of RELEASER_MANIFEST_KEYS (comma-separated base64 ed25519
+//	           public keys). The releaser signs its own releases with
+//	           RELEASER_SIGNING_KEY, which must be one of them.
+//	commit     the last commit to change the manifest must have a good
+//	           signature by a key git trusts (git verify-commit). The
+//	           releaser's own commits must then be signed too, e.g. with
+//	           commit.gpgsign and user.signingkey set for it.
+//
+// A manifest that fails verification is neither released from nor served
+// to agents. People sign the manifests they edit with todoctl manifest sign.
+const (
+	ManifestVerifySignature = "signature"
+	ManifestVerifyCommit    = "commit"
+)
+
+func manifestVerifyMode() (string, error) {
+	switch mode := os.Getenv("RELEASER_MANIFEST_VERIFY"); mode {
+	case "", ManifestVerifySignature, ManifestVerifyCommit:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("RELEASER_MANIFEST_VERIFY: %q must be signature or commit", mode)
+	}
+}
+
+// trustedManifestKeys parses RELEASER_MANIFEST_KEYS.
+func trustedManifestKeys() ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	for _, s := range strings.Split(os.Getenv("RELEASER_MANIFEST_KEYS"), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		pub, err := provenance.ParsePublicKey(s)
+		if err != nil {
+			return nil, fmt.Errorf("RELEASER_MANIFEST_KEYS: %w", err)
+		}
+		keys = append(keys, pub)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("RELEASER_MANIFEST_KEYS is not set")
+	}
+	return keys, nil
+}
+
+// gitShow returns path as of rev, byte for byte.
+func gitShow(rev, path string) ([]byte, error) {
+	return currentRepo().show(rev, path)
+}
+
+// readManifestSignatures reads the manifest's detached signatures as of
+// rev, or from the working tree when rev is "".
+func readManifestSignatures(rev string) ([]provenance.Signature, error) {
+	path := provenance.SignaturePath(ManifestFile)
+	var data []byte
+	var err error
+	if rev == "" {
+		data, err = os.ReadFile(path)
+	} else if data, err = gitShow(rev, path); err != nil {
+		// The release wasn't signed.
+		return nil, nil
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var sigs []provenance.Signature
+	if err := json.Unmarshal(data, &sigs); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	return sigs, nil
+}
+
+// verifyManifest checks data, the manifest as of rev or in the working
+// tree when rev is "", as RELEASER_MANIFEST_VERIFY asks.
+func verifyManifest(rev string, data []byte) error {
+	mode, err := manifestVerifyMode()
+	if err != nil || mode == "" {
+		return err
+	}
+	switch mode {
+	case ManifestVerifySignature:
+		sigs, err := readManifestSignatures(rev)
+		if err != nil {
+			return err
+		}
+		return checkManifestSignatures(data, sigs)
+	case ManifestVerifyCommit:
+		if rev == "" {
+			rev = "HEAD"
+			if committed, err := gitShow(rev, ManifestFile); err != nil || !bytes.Equal(committed, data) {
+				return fmt.Errorf("%s failed verification: it has uncommitted changes", ManifestFile)
+			}
+		}
+		commits, err := currentRepo().fileCommits(rev, ManifestFile, 1)
+		if err != nil {
+			return err
+		}
+		if len(commits) == 0 {
+			return fmt.Errorf("%s failed verification: it isn't committed at %s", ManifestFile, rev)
+		}
+		commit := commits[0]
+		if memRepo != nil {
+			return fmt.Errorf("%s failed verification: verifying commits needs the git CLI, which the in-memory checkout doesn't use", ManifestFile)
+		}
+		if out, err := exec.Command("git", "verify-commit", commit).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s failed verification: commit %s: %s", ManifestFile, shortRevision(commit), strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// checkManifestSignatures checks that one of sigs, data's signatures, is by
+// one of RELEASER_MANIFEST_KEYS.
+func checkManifestSignatures(data []byte, sigs []provenance.Signature) error {
+	keys, err := trustedManifestKeys()
+	if err != nil {
+		return err
+	}
+	if _, err := provenance.VerifyManifestSignatures(data, sigs, keys); err != nil {
+		return fmt.Errorf("%s failed verification: %w", ManifestFile, err)
+	}
+	return nil
+}
+
+// loadManifest loads ManifestFile once it passes verification.
+func loadManifest() (*manifest.Manifest, error) {
+	data, err := os.ReadFile(ManifestFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyManifest("", data); err != nil {
+		return nil, err
+	}
+	return manifest.Parse(data)
+}
+
+// stageManifest adds the saved manifest to the next commit, signed with
+// RELEASER_SIGNING_KEY under signature verification.
+func stageManifest() error {
+	mode, err := manifestVerifyMode()
+	if err != nil {
+		return err
+	}
+	if mode != ManifestVerifySignature {
+		return currentRepo().add(context.Background(), ManifestFile)
+	}
+
+	signingKey := os.Getenv("RELEASER_SIGNING_KEY")
+	if signingKey == "" {
+		return errors.New("RELEASER_SIGNING_KEY is needed to sign the manifest")
+	}
+	key, err := provenance.ParsePrivateKey(signingKey)
+	if err != nil {
+		return fmt.Errorf("RELEASER_SIGNING_KEY: %w", err)
+	}
+	if err := signManifestFile(key); err != nil {
+		return err
+	}
+	// Refuse to commit a release the daemon would then refuse to load.
+	data, err := os.ReadFile(ManifestFile)
+	if err != nil {
+		return err
+	}
+	if err := verifyManifest("", data); err != nil {
+		return fmt.Errorf("RELEASER_SIGNING_KEY is not one of RELEASER_MANIFEST_KEYS: %w", err)
+	}
+	return currentRepo().add(context.Background(), ManifestFile, provenance.SignaturePath(ManifestFile))
+}
+
+// signManifestFile adds key's signature of ManifestFile to its signatures.
+func signManifestFile(key ed25519.PrivateKey) error {
+	data, err := os.ReadFile(ManifestFile)
+	if err != nil {
+		return err
+	}
+	sigs, err := readManifestSignatures("")
+	if err != nil {
+		return err
+	}
+	out, err := json.MarshalIndent(provenance.SignManifest(data, sigs, key), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(provenance.SignaturePath(ManifestFile), out, 0644)
+}
+
+// SignManifest signs the manifest in the working directory with key, a
+// base64 ed25519 private key, for signature verification. Signatures of
+// other keys are kept, though they no longer match once it has changed.
+func SignManifest(key string) error {
+	k, err := provenance.ParsePrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := signManifestFile(k); err != nil {
+		return err
+	}
+	fmt.Printf("Signed %s as %s in %s\n", ManifestFile, provenance.KeyID(k.Public().(ed25519.PublicKey)), provenance.SignaturePath(ManifestFile))
+	return nil
+}
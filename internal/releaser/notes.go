@@ -0,0 +1,317 @@
+package releaser
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/blobstore"
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// NotesFile configures the release notes published for each release. It is
+// optional; without it no notes are published.
+const NotesFile = "release_notes.json"
+
+// NotesConfig lists the release-note outputs. Each renders its own template
+// from the same NotesData, so one release can have engineering,
+// customer-facing and compliance variants:
+//
+//	{"outputs": [
+//	  {"name": "engineering", "template": "notes/engineering.md.tmpl", "target": "github"},
+//	  {"name": "customers", "template": "notes/customers.xhtml.tmpl", "target": "confluence",
+//	   "confluence": {"url": "https://corp.atlassian.net/wiki", "space": "TODO", "parent": "12345"}},
+//	  {"name": "compliance", "template": "notes/compliance.md.tmpl", "target": "s3",
+//	   "s3": {"bucket": "todo-compliance", "prefix": "releases"}}
+//	]}
+type NotesConfig struct {
+	Outputs []NotesOutput `json:"outputs"`
+}
+
+// NotesOutput is one rendered variant and where it is published.
+type NotesOutput struct {
+	Name string `json:"name"`
+	// Template is a text/template file, relative to the repository root.
+	Template string `json:"template"`
+	// Target is github (the release for the tag, needs GITHUB_TOKEN or a
+	// GitHub App), confluence (a child page, needs CONFLUENCE_USER and
+	// CONFLUENCE_TOKEN) or s3 (<prefix>/<version>/<name><ext> with the aws
+	// CLI).
+	Target     string            `json:"target"`
+	Confluence *ConfluenceTarget `json:"confluence,omitempty"`
+	S3         *S3Target         `json:"s3,omitempty"`
+}
+
+type ConfluenceTarget struct {
+	// URL is the Confluence base URL, e.g. https://corp.atlassian.net/wiki.
+	URL   string `json:"url"`
+	Space string `json:"space"`
+	// Parent is the ID of the page the notes are created under.
+	Parent string `json:"parent,omitempty"`
+}
+
+type S3Target struct {
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// NotesData is what the templates are rendered from.
+type NotesData struct {
+	Version    string
+	Previous   string
+	Date       time.Time
+	RepoURL    string
+	CompareURL string
+	Changes    []NoteChange
+	// Services is every service in the release, changed or not.
+	Services []manifest.Service
+	// Hotfix is set for releases made by Hotfix.
+	Hotfix bool
+	// Blocked are the updates the license gate held back.
+	Blocked []NoteChange
+	// Bypassed is the freeze security updates were released through.
+	Bypassed *Freeze
+	// Failed are the services left out of the release because their check
+	// failed, grouped by why.
+	Failed []FailureGroup
+}
+
+type NoteChange struct {
+	Service string
+	// Config is the path of a changed config bundle.
+	Config    string
+	From      string
+	To        string
+	Image     string
+	Changelog string
+	// Revision, CommitURL and CompareURL trace the change to its source,
+	// when the image is labelled with it.
+	Revision   string
+	CommitURL  string
+	CompareURL string
+	// SizeFrom and SizeTo are the compressed image sizes in bytes, 0 when
+	// unknown; SizeDelta renders them with the growth, e.g.
+	// "45.3 MB → 50.7 MB, +12%", and SizeWarning flags a ballooning image.
+	SizeFrom    int64
+	SizeTo      int64
+	SizeDelta   string
+	SizeWarning bool
+	// Licenses is the license gate's verdict, nil without a policy.
+	Licenses *LicenseVerdict
+	// Security says why the change is a security update, if it is.
+	Security []string
+	// Fixes are the vulnerabilities the change fixes.
+	Fixes []string
+}
+
+func loadNotesConfig(path string) (*NotesConfig, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var c NotesConfig
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	return &c, nil
+}
+
+// newNotesData collects the template data for result.
+func newNotesData(m *manifest.Manifest, result *Result, repo, previous string, now time.Time) NotesData {
+	d := NotesData{
+		Version:  result.Version,
+		Previous: previous,
+		Hotfix:   result.Hotfix,
+		Bypassed: result.Bypassed,
+		Failed:   result.Failed,
+		Date:     now,
+		RepoURL:  repo,
+		Services: m.Services,
+	}
+	if repo != "" && previous != "" {
+		d.CompareURL = fmt.Sprintf("%s/compare/%s...%s", repo, previous, result.Version)
+	}
+	for _, c := range result.Changes {
+		d.Changes = append(d.Changes, newNoteChange(m, c))
+	}
+	for _, c := range result.Blocked {
+		d.Blocked = append(d.Blocked, newNoteChange(m, c))
+	}
+	return d
+}
+
+func newNoteChange(m *manifest.Manifest, c Change) NoteChange {
+	nc := NoteChange{Service: c.Service, Config: c.Config, From: c.From, To: c.To,
+		Revision: c.Revision, CommitURL: c.CommitURL, CompareURL: c.CompareURL,
+		SizeFrom: c.SizeFrom, SizeTo: c.SizeTo, SizeDelta: sizeDelta(c), SizeWarning: c.SizeWarning,
+		Licenses: c.Licenses, Security: c.Security, Fixes: c.Fixes}
+	if s, ok := m.Service(c.Service); ok {
+		nc.Image = s.Image
+		if c.Config == "" {
+			nc.Changelog = changelogURL(s, c.To)
+		}
+	}
+	return nc
+}
+
+func renderNotes(templateFile string, d NotesData) (string, error) {
+	tmpl, err := template.ParseFiles(templateFile)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, d); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// publishReleaseNotes renders and publishes every output in NotesFile. All
+// outputs are attempted; the error lists those that failed.
+func publishReleaseNotes(ctx context.Context, m *manifest.Manifest, result *Result) error {
+	conf, err := loadNotesConfig(NotesFile)
+	if err != nil || conf == nil {
+		return err
+	}
+	previous, _ := previousRelease(result.Version + "^")
+	d := newNotesData(m, result, repositoryURL(), previous, time.Now())
+
+	var failed []string
+	for _, out := range conf.Outputs {
+		fmt.Printf("Publishing %s release notes to %s\n", out.Name, out.Target)
+		if err := publishNotes(ctx, out, d); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", out.Name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("release notes failed:\n  %s", strings.Join(failed, "\n  "))
+	}
+	return nil
+}
+
+func publishNotes(ctx context.Context, out NotesOutput, d NotesData) error {
+	body, err := renderNotes(out.Template, d)
+	if err != nil {
+		return err
+	}
+	switch out.Target {
+	case "github":
+		return publishGitHubRelease(ctx, d.Version, body)
+	case "confluence":
+		if out.Confluence == nil {
+			return fmt.Errorf("target confluence needs a confluence section")
+		}
+		return publishConfluencePage(ctx, *out.Confluence, fmt.Sprintf("Release %s (%s)", d.Version, out.Name), body)
+	case "s3":
+		if out.S3 == nil {
+			return fmt.Errorf("target s3 needs an s3 section")
+		}
+		ext := path.Ext(strings.TrimSuffix(out.Template, ".tmpl"))
+		key := path.Join(out.S3.Prefix, d.Version, out.Name+ext)
+		return publishS3(ctx, *out.S3, key, body)
+	default:
+		return fmt.Errorf("unknown target %q, expected github, confluence or s3", out.Target)
+	}
+}
+
+// publishGitHubRelease creates the GitHub release for tag, at the release
+// commit so an unpushed tag is created in the right place.
+func publishGitHubRelease(ctx context.Context, tag, body string) error {
+	token, err := githubToken()
+	if err != nil {
+		return err
+	}
+	repo := githubRepository()
+	if repo == "" {
+		return fmt.Errorf("cannot tell the GitHub repository from GITHUB_REPOSITORY or the origin remote")
+	}
+	commit, err := commitOf(tag)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(map[string]string{
+		"tag_name":         tag,
+		"target_commitish": commit,
+		"name":             tag,
+		"body":             body,
+	})
+	if err != nil {
+		return err
+	}
+	api := os.Getenv("GITHUB_API_URL")
+	if api == "" {
+		api = "https://api.github.com"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, api+"/repos/"+repo+"/releases", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	return doNotesRequest(req)
+}
+
+// publishConfluencePage creates a page whose body is in Confluence's storage
+// format, so its template should produce XHTML.
+func publishConfluencePage(ctx context.Context, t ConfluenceTarget, title, body string) error {
+	user, token := os.Getenv("CONFLUENCE_USER"), os.Getenv("CONFLUENCE_TOKEN")
+	if user == "" || token == "" {
+		return fmt.Errorf("CONFLUENCE_USER and CONFLUENCE_TOKEN must be set")
+	}
+	page := map[string]any{
+		"type":  "page",
+		"title": title,
+		"space": map[string]string{"key": t.Space},
+		"body": map[string]any{
+			"storage": map[string]string{"value": body, "representation": "storage"},
+		},
+	}
+	if t.Parent != "" {
+		page["ancestors"] = []map[string]string{{"id": t.Parent}}
+	}
+	payload, err := json.Marshal(page)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(t.URL, "/")+"/rest/api/content", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(user, token)
+	return doNotesRequest(req)
+}
+
+func publishS3(ctx context.Context, t S3Target, key, body string) error {
+	store, err := blobstore.Open(blobstore.Config{Driver: blobstore.S3, Bucket: t.Bucket})
+	if err != nil {
+		return err
+	}
+	return store.Put(ctx, key, strings.NewReader(body))
+}
+
+func doNotesRequest(req *http.Request) error {
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: deployTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var msg bytes.Buffer
+		msg.ReadFrom(resp.Body)
+		return fmt.Errorf("%s returned %d: %s", req.URL.Host, resp.StatusCode, strings.TrimSpace(msg.String()))
+	}
+	return nil
+}
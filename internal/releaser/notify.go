@@ -0,0 +1,352 @@
+package releaser
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/image"
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// NotifyFile configures who is notified of releases and rollbacks, and in
+// which language. It is optional; without it notifications are sent in
+// RELEASER_NOTIFY_LOCALE, default English, to RELEASER_NOTIFY_WEBHOOK or the
+// manifest's notify_webhook secret, and to the notifier plugins.
+const NotifyFile = "notifications.json"
+
+// NotifyConfig lists the channels every notification goes to. Each renders
+// the same event in its own locale, so engineering and operations can follow
+// releases in different languages:
+//
+//	{"channels": [
+//	  {"name": "engineering", "locale": "en", "webhook_secret": "notify_webhook", "plugins": true},
+//	  {"name": "operations", "locale": "ja", "webhook_secret": "notify_webhook_ops",
+//	   "templates": {"release": "notify/operations-release.tmpl"}}
+//	]}
+type NotifyConfig struct {
+	Channels []NotifyChannel `json:"channels"`
+}
+
+// NotifyChannel is one audience of the notifications.
+type NotifyChannel struct {
+	Name string `json:"name"`
+	// Locale picks the built-in templates: en (the default) or ja. A
+	// regional locale such as ja-JP falls back to its language.
+	Locale string `json:"locale,omitempty"`
+	// WebhookEnv and WebhookSecret name the environment variable and the
+	// manifest secret holding the channel's Slack incoming-webhook URL. The
+	// variable wins when both are set.
+	WebhookEnv    string `json:"webhook_env,omitempty"`
+	WebhookSecret string `json:"webhook_secret,omitempty"`
+	// Plugins sends the channel's notifications to the notifier plugins too.
+	Plugins bool `json:"plugins,omitempty"`
+	// Templates replaces built-in templates by event, with text/template
+	// files relative to the repository root.
+	Templates map[string]string `json:"templates,omitempty"`
+}
+
+// Notification events. A release renders NotesData, a rollback
+// RollbackData and a yanked tag YankedData.
+const (
+	NotifyRelease  = "release"
+	NotifyRollback = "rollback"
+	NotifyYanked   = "yanked"
+)
+
+// DefaultLocale is the locale of channels that don't set one.
+const DefaultLocale = "en"
+
+// RollbackData is what rollback notifications are rendered from.
+type RollbackData struct {
+	// Version is the release rolled back, Previous the release whose
+	// versions were restored and Tag the release that restored them.
+	Version  string
+	Previous string
+	Tag      string
+	Reason   string
+}
+
+// notificationTemplates are the built-in templates, named
+// <event>.<locale>.tmpl.
+//
+//go:embed notifications
+var notificationTemplates embed.FS
+
+var notifyFuncs = template.FuncMap{
+	"short": shortRevision,
+	"join":  strings.Join,
+}
+
+// loadNotifyConfig reads path, or returns the default single channel when it
+// doesn't exist. Every channel must have a template for every event.
+func loadNotifyConfig(path string) (*NotifyConfig, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &NotifyConfig{Channels: []NotifyChannel{{
+			Name:          "default",
+			Locale:        os.Getenv("RELEASER_NOTIFY_LOCALE"),
+			WebhookEnv:    "RELEASER_NOTIFY_WEBHOOK",
+			WebhookSecret: "notify_webhook",
+			Plugins:       true,
+		}}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var c NotifyConfig
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	for i, ch := range c.Channels {
+		if ch.Name == "" {
+			return nil, fmt.Errorf("%s: channel %d has no name", path, i+1)
+		}
+		for _, event := range []string{NotifyRelease, NotifyRollback, NotifyYanked} {
+			if _, err := notifyTemplate(ch, event); err != nil {
+				return nil, fmt.Errorf("%s: channel %s: %w", path, ch.Name, err)
+			}
+		}
+	}
+	return &c, nil
+}
+
+// notifyTemplate returns ch's template for event: its own if it has one,
+// else the built-in one for its locale or the locale's language.
+func notifyTemplate(ch NotifyChannel, event string) (*template.Template, error) {
+	if file, ok := ch.Templates[event]; ok {
+		return template.New(filepath.Base(file)).Funcs(notifyFuncs).ParseFiles(file)
+	}
+	locale := strings.ToLower(strings.ReplaceAll(ch.Locale, "_", "-"))
+	if locale == "" {
+		locale = DefaultLocale
+	}
+	language, _, _ := strings.Cut(locale, "-")
+	for _, l := range []string{locale, language} {
+		name := event + "." + l + ".tmpl"
+		if _, err := fs.Stat(notificationTemplates, "notifications/"+name); err == nil {
+			return template.New(name).Funcs(notifyFuncs).ParseFS(notificationTemplates, "notifications/"+name)
+		}
+	}
+	return nil, fmt.Errorf("no %s notification for locale %q", event, ch.Locale)
+}
+
+// renderNotification renders event for ch in Slack mrkdwn.
+func renderNotification(ch NotifyChannel, event string, data any) (string, error) {
+	tmpl, err := notifyTemplate(ch, event)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// notifyRelease posts a summary of a release to every channel. Only the
+// services that changed are listed, each with a link to its upstream
+// changelog, followed by the compare link to the previous release so the
+// message alone is enough to review it.
+func notifyRelease(ctx context.Context, m *manifest.Manifest, result *Result) error {
+	previous, _ := previousRelease(result.Version + "^")
+	return notify(ctx, m, NotifyRelease, newNotesData(m, result, repositoryURL(), previous, time.Now()))
+}
+
+// notify renders event from data for each channel in NotifyFile and posts
+// it to the channel's webhook and, if it asks for them, the notifier
+// plugins. All channels are attempted; the error lists those that failed.
+func notify(ctx context.Context, m *manifest.Manifest, event string, data any) error {
+	conf, err := loadNotifyConfig(NotifyFile)
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, ch := range conf.Channels {
+		if err := notifyChannel(ctx, m, ch, event, data); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", ch.Name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("notifications failed:\n  %s", strings.Join(failed, "\n  "))
+	}
+	return nil
+}
+
+func notifyChannel(ctx context.Context, m *manifest.Manifest, ch NotifyChannel, event string, data any) error {
+	text, err := renderNotification(ch, event, data)
+	if err != nil {
+		return err
+	}
+	if ch.Plugins {
+		locale := ch.Locale
+		if locale == "" {
+			locale = DefaultLocale
+		}
+		if err := notifyPlugins(ctx, m.ReleaseVersion, locale, text); err != nil {
+			return err
+		}
+	}
+	var hook string
+	if ch.WebhookEnv != "" {
+		hook = os.Getenv(ch.WebhookEnv)
+	}
+	if hook == "" && ch.WebhookSecret != "" {
+		hook = m.Secret(ch.WebhookSecret)
+	}
+	if hook == "" {
+		return nil
+	}
+
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: deployTimeout}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("notify webhook: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("notify webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("notify webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func shortRevision(rev string) string {
+	if len(rev) > 7 {
+		return rev[:7]
+	}
+	return rev
+}
+
+// changelogURL links to the notes for version of s: the service's
+// changelog template with {version} replaced, or its Docker Hub tag page.
+// It returns "" when there is nothing to link to.
+func changelogURL(s manifest.Service, version string) string {
+	if s.Changelog != "" {
+		return strings.ReplaceAll(s.Changelog, "{version}", url.PathEscape(version))
+	}
+	ref, err := image.Parse(s.Image)
+	if err != nil || !ref.IsDockerHub() {
+		return ""
+	}
+	if repo, ok := strings.CutPrefix(ref.Repository, "library/"); ok {
+		return fmt.Sprintf("https://hub.docker.com/_/%s/tags?name=%s", repo, url.QueryEscape(version))
+	}
+	return fmt.Sprintf("https://hub.docker.com/r/%s/tags?name=%s", ref.Repository, url.QueryEscape(version))
+}
+
+// repositoryURL is the web URL of this repository on GitHub: from the
+// Actions environment when set, else derived from the origin remote.
+func repositoryURL() string {
+	if repo := os.Getenv("GITHUB_REPOSITORY"); repo != "" {
+		server := os.Getenv("GITHUB_SERVER_URL")
+		if server == "" {
+			server = "https://github.com"
+		}
+		return server + "/" + repo
+	}
+	remote, err := currentRepo().remoteURL()
+	if err != nil {
+		return ""
+	}
+	return remoteWebURL(remote)
+}
+
+// githubAPI calls the GitHub API for this repository at path, e.g.
+// /pulls, with githubToken, sending payload as JSON unless it is nil and
+// decoding the response into out unless it is nil. It returns the status
+// code along with any error.
+func githubAPI(method, path string, payload, out any) (int, error) {
+	repo := githubRepository()
+	if repo == "" {
+		return 0, fmt.Errorf("cannot tell the GitHub repository from GITHUB_REPOSITORY or the origin remote")
+	}
+	return githubRootAPI(method, "/repos/"+repo+path, payload, out)
+}
+
+// githubRootAPI is githubAPI for paths outside the repository, e.g.
+// /orgs/velann21/teams.
+func githubRootAPI(method, path string, payload, out any) (int, error) {
+	token, err := githubToken()
+	if err != nil {
+		return 0, err
+	}
+	api := os.Getenv("GITHUB_API_URL")
+	if api == "" {
+		api = "https://api.github.com"
+	}
+	var body bytes.Buffer
+	if payload != nil {
+		if err := json.NewEncoder(&body).Encode(payload); err != nil {
+			return 0, err
+		}
+	}
+	req, err := http.NewRequest(method, api+path, &body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: deployTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var msg bytes.Buffer
+	msg.ReadFrom(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("%s returned %d: %s", req.URL.Host, resp.StatusCode, strings.TrimSpace(msg.String()))
+	}
+	if out != nil {
+		return resp.StatusCode, json.Unmarshal(msg.Bytes(), out)
+	}
+	return resp.StatusCode, nil
+}
+
+// githubRepository is this repository's owner/name on GitHub, or "".
+func githubRepository() string {
+	if repo := os.Getenv("GITHUB_REPOSITORY"); repo != "" {
+		return repo
+	}
+	remote, err := currentRepo().remoteURL()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(remoteWebURL(remote), "https://github.com/")
+}
+
+// remoteWebURL turns a GitHub clone URL (https or scp-style ssh) into the
+// repository's web URL, or "" for other hosts.
+func remoteWebURL(remote string) string {
+	remote = strings.TrimSuffix(remote, ".git")
+	if path, ok := strings.CutPrefix(remote, "git@github.com:"); ok {
+		return "https://github.com/" + path
+	}
+	u, err := url.Parse(remote)
+	if err != nil || u.Host != "github.com" {
+		return ""
+	}
+	return "https://github.com" + u.Path
+}
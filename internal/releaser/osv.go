@@ -0,0 +1,211 @@
+package releaser
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// With RELEASER_CVE_LOOKUP=osv, updates are annotated with the
+// vulnerabilities they fix: those OSV (osv.dev, which carries NVD's CVEs
+// among others) knows to affect the image an update moves from but not the
+// one it moves to. An image labelled with its source revision is looked up
+// by that commit, others as pkg:docker/<image> at their tag. Fixes are
+// named by CVE ID where there is one, and show in update pull requests and
+// changelog entries. RELEASER_OSV_URL points the lookups at a mirror of
+// the OSV API. Lookups are best effort: an update OSV can't be asked about
+// goes out unannotated.
+
+// DefaultOSVURL is the OSV API asked unless RELEASER_OSV_URL says
+// otherwise.
+const DefaultOSVURL = "https://api.osv.dev"
+
+func cveLookup() (bool, error) {
+	switch lookup := os.Getenv("RELEASER_CVE_LOOKUP"); lookup {
+	case "":
+		return false, nil
+	case "osv":
+		return true, nil
+	default:
+		return false, fmt.Errorf("RELEASER_CVE_LOOKUP: %q must be osv", lookup)
+	}
+}
+
+// osvQuery is the body of an OSV query: a commit, or a package at a
+// version.
+type osvQuery struct {
+	Commit  string      `json:"commit,omitempty"`
+	Version string      `json:"version,omitempty"`
+	Package *osvPackage `json:"package,omitempty"`
+}
+
+type osvPackage struct {
+	PURL string `json:"purl"`
+}
+
+// osvVuln is a vulnerability OSV returns.
+type osvVuln struct {
+	ID      string   `json:"id"`
+	Aliases []string `json:"aliases"`
+}
+
+// cve is the CVE ID of v, or its OSV ID when it has none.
+func (v osvVuln) cve() string {
+	if strings.HasPrefix(v.ID, "CVE-") {
+		return v.ID
+	}
+	for _, alias := range v.Aliases {
+		if strings.HasPrefix(alias, "CVE-") {
+			return alias
+		}
+	}
+	return v.ID
+}
+
+// fixesCache is what lookups found each update fixes, by image, from and
+// to, so pull requests rebuilt every run and the changelog written at
+// release don't ask again.
+var fixesCache struct {
+	sync.Mutex
+	fixes map[string][]string
+}
+
+func fixesKey(dep, from, to string) string {
+	return dep + " " + from + " " + to
+}
+
+// cachedFixes returns what the update of s from from to to was found to
+// fix, if it was looked up.
+func cachedFixes(s manifest.Service, from, to string) []string {
+	fixesCache.Lock()
+	defer fixesCache.Unlock()
+	return fixesCache.fixes[fixesKey(depName(s), from, to)]
+}
+
+// annotateFixes sets the Fixes of each of changes, made to m, to the
+// vulnerabilities it fixes, when RELEASER_CVE_LOOKUP asks for them.
+// Digest updates of the same tag aren't looked up.
+func annotateFixes(ctx context.Context, m *manifest.Manifest, changes []Change) {
+	lookup, err := cveLookup()
+	if err != nil {
+		fmt.Printf("Not looking up fixed CVEs: %v\n", err)
+	}
+	if !lookup {
+		return
+	}
+	for i, c := range changes {
+		s, ok := m.Service(c.Service)
+		if !ok || c.From == "" || c.From == s.Version || strings.HasPrefix(c.From, "sha256:") {
+			continue
+		}
+		fixes, err := lookupFixes(ctx, depName(s), c.From, s.Version)
+		if err != nil {
+			fmt.Printf("Error looking up the CVEs %s %s -> %s fixes: %v\n", c.Service, c.From, s.Version, err)
+			continue
+		}
+		changes[i].Fixes = fixes
+		if len(fixes) > 0 {
+			fmt.Printf("%s %s -> %s fixes %s\n", c.Service, c.From, s.Version, strings.Join(fixes, ", "))
+		}
+	}
+}
+
+// lookupFixes returns the vulnerabilities of the image dep at tag from
+// that it hasn't at tag to.
+func lookupFixes(ctx context.Context, dep, from, to string) ([]string, error) {
+	key := fixesKey(dep, from, to)
+	fixesCache.Lock()
+	fixes, ok := fixesCache.fixes[key]
+	fixesCache.Unlock()
+	if ok {
+		return fixes, nil
+	}
+	before, err := imageVulns(ctx, dep, from)
+	if err != nil {
+		return nil, err
+	}
+	after, err := imageVulns(ctx, dep, to)
+	if err != nil {
+		return nil, err
+	}
+	fixes = []string{}
+	for _, v := range before {
+		if !slices.ContainsFunc(after, func(a osvVuln) bool { return a.ID == v.ID }) {
+			fixes = append(fixes, v.cve())
+		}
+	}
+	slices.Sort(fixes)
+	fixes = slices.Compact(fixes)
+
+	fixesCache.Lock()
+	defer fixesCache.Unlock()
+	if fixesCache.fixes == nil {
+		fixesCache.fixes = map[string][]string{}
+	}
+	fixesCache.fixes[key] = fixes
+	return fixes, nil
+}
+
+// imageVulns asks OSV about the image dep at tag: by its source revision
+// when it is labelled with one, else as a Docker package.
+func imageVulns(ctx context.Context, dep, tag string) ([]osvVuln, error) {
+	q := osvQuery{Version: tag, Package: &osvPackage{PURL: "pkg:docker/" + dep}}
+	if labels, err := imageLabels(ctx, dep, tag); err == nil && labels[LabelRevision] != "" {
+		q = osvQuery{Commit: labels[LabelRevision]}
+	}
+	return osvVulns(ctx, q)
+}
+
+// osvVulns runs q against the OSV API, following its pages.
+func osvVulns(ctx context.Context, q osvQuery) ([]osvVuln, error) {
+	base := os.Getenv("RELEASER_OSV_URL")
+	if base == "" {
+		base = DefaultOSVURL
+	}
+	client := &http.Client{Timeout: deployTimeout}
+	var vulns []osvVuln
+	page := ""
+	for {
+		body, err := json.Marshal(struct {
+			osvQuery
+			PageToken string `json:"page_token,omitempty"`
+		}{q, page})
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(base, "/")+"/v1/query", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var out struct {
+			Vulns         []osvVuln `json:"vulns"`
+			NextPageToken string    `json:"next_page_token"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("OSV returned %s", resp.Status)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&out)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error parsing the OSV response: %w", err)
+		}
+		vulns = append(vulns, out.Vulns...)
+		if page = out.NextPageToken; page == "" {
+			return vulns, nil
+		}
+	}
+}
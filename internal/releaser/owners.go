@@ -0,0 +1,292 @@
+package releaser
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// With RELEASER_UPDATE_MODE=pr, an update pull request needs the approval
+// of the team that owns the service it updates, not just of whoever may
+// approve changes to the manifest. A service's owners are the owners of
+// its manifest entry, e.g.
+//
+//	{"name": "todo-backend", "image": "…", "owners": ["@velann21/backend"]}
+//
+// or else those the repository's CODEOWNERS, the first of CodeownersFiles
+// there is, gives the service's config bundles, or failing that the
+// directory services/<name>/. As on GitHub, the last matching CODEOWNERS
+// rule wins, and owners given by email are ignored.
+//
+// The owners are asked to review the pull request when it is opened, and
+// every run sets its head commit's OwnerApprovalContext status: success
+// once one of them, a user named or an active member of a team named, has
+// approved that commit, pending until then. Once any service has owners,
+// the pull requests of services without them get a success, so the status
+// can be made a required check of the base branch, which is what makes
+// the approval necessary to merge.
+
+// CodeownersFiles are where CODEOWNERS is looked for, in GitHub's order.
+var CodeownersFiles = []string{".github/CODEOWNERS", "CODEOWNERS", "docs/CODEOWNERS"}
+
+// OwnerApprovalContext is the commit status reporting the owners' approval
+// of an update pull request.
+const OwnerApprovalContext = "releaser/owner-approval"
+
+// ownerName is an owner: @login or @org/team.
+var ownerName = regexp.MustCompile(`^@[A-Za-z0-9][A-Za-z0-9-]*(/[A-Za-z0-9][A-Za-z0-9._-]*)?$`)
+
+// ownerRule is a CODEOWNERS line: a path pattern and its owners.
+type ownerRule struct {
+	pattern string
+	owners  []string
+}
+
+// ownerRules are the rules of a CODEOWNERS file, in its order.
+type ownerRules []ownerRule
+
+// codeowners is the CODEOWNERS of the current run, nil without one.
+var codeowners ownerRules
+
+// loadCodeowners reads the first of CodeownersFiles there is, or returns
+// nil when there is none.
+func loadCodeowners() (ownerRules, error) {
+	for _, name := range CodeownersFiles {
+		data, err := os.ReadFile(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return parseCodeowners(data), nil
+	}
+	return nil, nil
+}
+
+func parseCodeowners(data []byte) ownerRules {
+	var rules ownerRules
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		rule := ownerRule{pattern: fields[0]}
+		for _, owner := range fields[1:] {
+			if ownerName.MatchString(owner) {
+				rule.owners = append(rule.owners, owner)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// owners are the owners the last rule matching name gives it. A name
+// ending in / is a directory.
+func (r ownerRules) owners(name string) []string {
+	for i := len(r) - 1; i >= 0; i-- {
+		if codeownersMatch(r[i].pattern, name) {
+			return r[i].owners
+		}
+	}
+	return nil
+}
+
+// codeownersMatch reports whether the CODEOWNERS pattern matches name, or
+// a directory name is in. Patterns follow gitignore: one with a slash
+// other than at its end is relative to the repository root, others match
+// at any depth, and a trailing / or /** only matches directories. ** only
+// works at either end.
+func codeownersMatch(pattern, name string) bool {
+	dirOnly := strings.HasSuffix(pattern, "/") || strings.HasSuffix(pattern, "/**")
+	pattern = strings.TrimSuffix(strings.TrimSuffix(pattern, "**"), "/")
+	anchored := strings.Contains(pattern, "/")
+	if rest, ok := strings.CutPrefix(pattern, "**/"); ok {
+		pattern, anchored = rest, false
+	}
+	pattern = strings.TrimPrefix(pattern, "/")
+	isDir := strings.HasSuffix(name, "/")
+	segs := strings.Split(strings.TrimSuffix(name, "/"), "/")
+	n := strings.Count(pattern, "/") + 1
+	for start := 0; start+n <= len(segs); start++ {
+		if anchored && start > 0 {
+			break
+		}
+		ok, _ := path.Match(pattern, strings.Join(segs[start:start+n], "/"))
+		if ok && (start+n < len(segs) || isDir || !dirOnly) {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceOwners are the owners of s: its own, or those CODEOWNERS gives its
+// config bundles, or else services/<name>/.
+func serviceOwners(s manifest.Service) []string {
+	var owners []string
+	add := func(names []string) {
+		for _, o := range names {
+			if !slices.Contains(owners, o) {
+				owners = append(owners, o)
+			}
+		}
+	}
+	if len(s.Owners) > 0 {
+		for _, o := range s.Owners {
+			if !ownerName.MatchString(o) {
+				fmt.Printf("Ignoring owner %q of %s: owners are @login or @org/team\n", o, s.Name)
+				continue
+			}
+			add([]string{o})
+		}
+		return owners
+	}
+	for _, b := range s.Config {
+		add(codeowners.owners(b.Path))
+	}
+	if len(owners) == 0 {
+		add(codeowners.owners(path.Join("services", s.Name) + "/"))
+	}
+	return owners
+}
+
+// ownersInUse reports whether any of m's services have owners, so update
+// pull requests get the OwnerApprovalContext status.
+func ownersInUse(m *manifest.Manifest) bool {
+	return slices.ContainsFunc(m.Services, func(s manifest.Service) bool { return len(serviceOwners(s)) > 0 })
+}
+
+// requestOwnerReviews asks owners to review pull request number.
+func requestOwnerReviews(number int, owners []string) error {
+	owner, _, _ := strings.Cut(githubRepository(), "/")
+	reviewers := map[string][]string{"reviewers": {}, "team_reviewers": {}}
+	for _, o := range owners {
+		org, team, isTeam := strings.Cut(strings.TrimPrefix(o, "@"), "/")
+		switch {
+		case !isTeam:
+			reviewers["reviewers"] = append(reviewers["reviewers"], org)
+		case strings.EqualFold(org, owner):
+			reviewers["team_reviewers"] = append(reviewers["team_reviewers"], team)
+		default:
+			// Only teams of the repository's organization can be asked.
+			fmt.Printf("Not asking %s to review: not a team of %s\n", o, owner)
+		}
+	}
+	_, err := githubAPI(http.MethodPost, fmt.Sprintf("/pulls/%d/requested_reviewers", number), reviewers, nil)
+	return err
+}
+
+// reportedApprovals is the approval status last set on each update pull
+// request head, so unchanged ones cost no API call to set again.
+var reportedApprovals = map[string]string{}
+
+// reportApproval sets the OwnerApprovalContext status of pull request
+// number's head: whether one of owners approved it.
+func reportApproval(number int, owners []string) error {
+	var pr struct {
+		Head struct {
+			SHA string `json:"sha"`
+		} `json:"head"`
+	}
+	if _, err := githubAPI(http.MethodGet, fmt.Sprintf("/pulls/%d", number), nil, &pr); err != nil {
+		return err
+	}
+	state, description := "success", "The service has no owners"
+	if len(owners) > 0 {
+		by, err := ownerApproval(number, pr.Head.SHA, owners)
+		if err != nil {
+			return err
+		}
+		if by == "" {
+			state, description = "pending", "Needs approval from "+strings.Join(owners, " or ")
+		} else {
+			description = "Approved by @" + by
+		}
+	}
+	if len(description) > 140 {
+		// GitHub's limit.
+		description = description[:137] + "..."
+	}
+	if reportedApprovals[pr.Head.SHA] == state+" "+description {
+		return nil
+	}
+	status := map[string]string{"state": state, "context": OwnerApprovalContext, "description": description}
+	if _, err := githubAPI(http.MethodPost, "/statuses/"+pr.Head.SHA, status, nil); err != nil {
+		return err
+	}
+	reportedApprovals[pr.Head.SHA] = state + " " + description
+	return nil
+}
+
+// ownerApproval returns the login of one of owners whose latest review of
+// commit on pull request number approves it, or "" when there is none.
+// Reviews of earlier commits don't count: the releaser only pushes to an
+// update branch when the update changes.
+func ownerApproval(number int, commit string, owners []string) (string, error) {
+	var reviews []struct {
+		User struct {
+			Login string `json:"login"`
+		} `json:"user"`
+		State    string `json:"state"`
+		CommitID string `json:"commit_id"`
+	}
+	if _, err := githubAPI(http.MethodGet, fmt.Sprintf("/pulls/%d/reviews?per_page=100", number), nil, &reviews); err != nil {
+		return "", err
+	}
+	var logins []string
+	latest := map[string]string{}
+	for _, r := range reviews {
+		if r.CommitID != commit || r.State == "COMMENTED" || r.State == "PENDING" {
+			continue
+		}
+		if _, ok := latest[r.User.Login]; !ok {
+			logins = append(logins, r.User.Login)
+		}
+		latest[r.User.Login] = r.State
+	}
+	for _, login := range logins {
+		if latest[login] != "APPROVED" {
+			continue
+		}
+		for _, o := range owners {
+			ok, err := isOwner(login, o)
+			if err != nil {
+				return "", err
+			}
+			if ok {
+				return login, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// isOwner reports whether login is owner: the user, or an active member of
+// the team.
+func isOwner(login, owner string) (bool, error) {
+	org, team, isTeam := strings.Cut(strings.TrimPrefix(owner, "@"), "/")
+	if !isTeam {
+		return strings.EqualFold(org, login), nil
+	}
+	var membership struct {
+		State string `json:"state"`
+	}
+	status, err := githubRootAPI(http.MethodGet, fmt.Sprintf("/orgs/%s/teams/%s/memberships/%s", org, team, login), nil, &membership)
+	if status == http.StatusNotFound {
+		return false, nil
+	}
+	return err == nil && membership.State == "active", err
+}
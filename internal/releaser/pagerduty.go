@@ -0,0 +1,104 @@
+package releaser
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// DefaultPagerDutyURL is the PagerDuty Events API v2 endpoint unless
+// RELEASER_PAGERDUTY_URL overrides it.
+const DefaultPagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// PagerDuty severities.
+const (
+	pagerDutyCritical = "critical"
+	pagerDutyError    = "error"
+)
+
+// pagerDutyAlert is a PagerDuty trigger event.
+type pagerDutyAlert struct {
+	RoutingKey  string           `json:"routing_key"`
+	EventAction string           `json:"event_action"`
+	DedupKey    string           `json:"dedup_key"`
+	Payload     pagerDutyPayload `json:"payload"`
+	Links       []pagerDutyLink  `json:"links,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string            `json:"summary"`
+	Source        string            `json:"source"`
+	Severity      string            `json:"severity"`
+	Component     string            `json:"component,omitempty"`
+	Class         string            `json:"class,omitempty"`
+	CustomDetails map[string]string `json:"custom_details,omitempty"`
+}
+
+type pagerDutyLink struct {
+	Href string `json:"href"`
+	Text string `json:"text"`
+}
+
+// pageRelease triggers a PagerDuty incident for a release that failed: its
+// rollout failed, or it breached during its bake and was rolled back.
+// RELEASER_PAGERDUTY_ROUTING_KEY, or the manifest's pagerduty_routing_key
+// secret, is the Events API v2 integration key; without one nobody is
+// paged. Incidents are deduplicated by release tag, so a release pages
+// once however many times it fails. Paging is best effort: a failure to
+// page is logged.
+func pageRelease(m *manifest.Manifest, version, class, severity, summary string, details map[string]string) {
+	key := os.Getenv("RELEASER_PAGERDUTY_ROUTING_KEY")
+	if key == "" {
+		key = m.Secret("pagerduty_routing_key")
+	}
+	if key == "" {
+		return
+	}
+	alert := pagerDutyAlert{
+		RoutingKey:  key,
+		EventAction: "trigger",
+		DedupKey:    "releaser-" + version,
+		Payload: pagerDutyPayload{
+			Summary:       summary,
+			Source:        "releaser",
+			Severity:      severity,
+			Component:     version,
+			Class:         class,
+			CustomDetails: details,
+		},
+	}
+	if repo := repositoryURL(); repo != "" {
+		alert.Payload.Source = repo
+		alert.Links = append(alert.Links, pagerDutyLink{Href: repo + "/releases/tag/" + version, Text: "Release " + version})
+	}
+	fmt.Printf("Paging for %s: %s\n", version, summary)
+	if err := postPagerDuty(alert); err != nil {
+		fmt.Printf("Error paging for %s: %v\n", version, err)
+	}
+}
+
+func postPagerDuty(alert pagerDutyAlert) error {
+	url := os.Getenv("RELEASER_PAGERDUTY_URL")
+	if url == "" {
+		url = DefaultPagerDutyURL
+	}
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: deployTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("pagerduty: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("pagerduty returned %d", resp.StatusCode)
+	}
+	return nil
+}
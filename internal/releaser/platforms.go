@@ -0,0 +1,125 @@
+package releaser
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/velann21/todo-releaser/internal/image"
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// platforms returns the os/arch[/variant] platforms tag is published for:
+// those of its index, or the one of a single-platform image.
+func (c *registryClient) platforms(ctx context.Context, tag string) ([]string, error) {
+	var m imageManifest
+	if err := c.get(ctx, "/manifests/"+tag, manifestMediaTypes, &m); err != nil {
+		return nil, err
+	}
+	var platforms []string
+	for _, d := range m.Manifests {
+		p := d.Platform
+		// Attestations and signatures are listed as unknown/unknown.
+		if p.OS == "" || p.OS == "unknown" {
+			continue
+		}
+		platforms = append(platforms, platformName(p.OS, p.Architecture, p.Variant))
+	}
+	if len(m.Manifests) > 0 {
+		return platforms, nil
+	}
+	var config struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+		Variant      string `json:"variant"`
+	}
+	if err := c.get(ctx, "/blobs/"+m.Config.Digest, nil, &config); err != nil {
+		return nil, err
+	}
+	return []string{platformName(config.OS, config.Architecture, config.Variant)}, nil
+}
+
+func platformName(os, arch, variant string) string {
+	if variant != "" {
+		return os + "/" + arch + "/" + variant
+	}
+	return os + "/" + arch
+}
+
+// imagePlatforms returns the platforms the image ref is published for at
+// tag, from Docker Hub, the registry plugin that handles it or one of
+// registryBackends.
+func imagePlatforms(ctx context.Context, ref, tag string) ([]string, error) {
+	r, err := image.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	if r.IsDockerHub() {
+		c, err := dockerHubRegistry(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		return c.platforms(ctx, tag)
+	}
+	if rc, _, err := nativeRegistry(ctx, r); err != nil || rc != nil {
+		if err != nil {
+			return nil, err
+		}
+		return rc.platforms(ctx, tag)
+	}
+	p, err := registryPlugin(ctx, r.Registry)
+	if err != nil || p == nil {
+		return nil, unsupportedRegistry(r, err)
+	}
+	if !p.Info.Platforms {
+		return nil, fmt.Errorf("plugin %s can't tell the platforms of %s images", p.Info.Name, r.Registry)
+	}
+	if err := throttle(ctx, r.Registry); err != nil {
+		return nil, err
+	}
+	var result struct {
+		Platforms []string `json:"platforms"`
+	}
+	err = p.Call(ctx, "image_platforms", map[string]string{"image": r.Name(), "tag": tag}, &result)
+	return result.Platforms, err
+}
+
+// missingPlatforms returns the platforms required of s that published
+// lacks. A platform without a variant is met by any of its variants, e.g.
+// linux/arm64 by linux/arm64/v8, and one without an OS means linux.
+func missingPlatforms(s manifest.Service, published []string) []string {
+	var missing []string
+	for _, want := range s.Platforms {
+		if !strings.Contains(want, "/") {
+			want = "linux/" + want
+		}
+		found := false
+		for _, p := range published {
+			if p == want || strings.HasPrefix(p, want+"/") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, want)
+		}
+	}
+	return missing
+}
+
+// checkPlatforms checks that tag of the multi-arch service s is published
+// for all its platforms, so a bump never drops one.
+func checkPlatforms(ctx context.Context, s manifest.Service, tag string) error {
+	if len(s.Platforms) == 0 {
+		return nil
+	}
+	name, _, _ := strings.Cut(s.Image, "@")
+	published, err := imagePlatforms(ctx, name, tag)
+	if err != nil {
+		return fmt.Errorf("error reading the platforms of %s:%s: %w", name, tag, err)
+	}
+	if missing := missingPlatforms(s, published); len(missing) > 0 {
+		return fmt.Errorf("%s:%s is not published for %s", name, tag, strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package releaser
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/velann21/todo-releaser/internal/agent"
+	"github.com/velann21/todo-releaser/internal/manifest"
+	"github.com/velann21/todo-releaser/internal/plugin"
+)
+
+var (
+	pluginsMu     sync.Mutex
+	pluginsLoaded bool
+	plugins       []*plugin.Plugin
+	pluginsErr    error
+)
+
+// loadPlugins describes the plugin executables listed, comma-separated, in
+// RELEASER_PLUGINS. They are loaded once per process; a load cut short by
+// ctx is tried again on the next call.
+func loadPlugins(ctx context.Context) ([]*plugin.Plugin, error) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+	if pluginsLoaded {
+		return plugins, pluginsErr
+	}
+	var ps []*plugin.Plugin
+	for _, path := range strings.Split(os.Getenv("RELEASER_PLUGINS"), ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		p, err := plugin.Load(ctx, path)
+		if err != nil {
+			err = fmt.Errorf("error loading plugin %s: %w", path, err)
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			ps, pluginsErr = nil, err
+			break
+		}
+		fmt.Printf("Loaded plugin %s from %s\n", p.Info.Name, path)
+		ps = append(ps, p)
+	}
+	plugins, pluginsLoaded = ps, true
+	return plugins, pluginsErr
+}
+
+// registryPlugin returns the plugin resolving images on registry, or nil.
+func registryPlugin(ctx context.Context, registry string) (*plugin.Plugin, error) {
+	ps, err := loadPlugins(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range ps {
+		if p.Handles(registry) {
+			return p, nil
+		}
+	}
+	return nil, nil
+}
+
+// notifyPlugins sends text, in locale, to every notifier plugin.
+func notifyPlugins(ctx context.Context, version, locale, text string) error {
+	ps, err := loadPlugins(ctx)
+	if err != nil {
+		return err
+	}
+	for _, p := range ps {
+		if !p.Info.Notifier {
+			continue
+		}
+		params := map[string]string{"text": text, "version": version, "locale": locale}
+		if err := p.Call(ctx, "notify", params, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deployPluginParams are the params of the deploy call of deploy hook
+// plugins.
+func deployPluginParams(m *manifest.Manifest) map[string]any {
+	return map[string]any{"version": m.ReleaseVersion, "manifest": deployPayload(m), "idempotency_key": agent.IdempotencyKey(m)}
+}
+
+// deployPlugins hands the release to every deploy hook plugin, without the
+// manifest's secrets.
+func deployPlugins(ctx context.Context, m *manifest.Manifest) error {
+	ps, err := loadPlugins(ctx)
+	if err != nil {
+		return err
+	}
+	params := deployPluginParams(m)
+	for _, p := range ps {
+		if !p.Info.DeployHook {
+			continue
+		}
+		fmt.Printf("Running deploy plugin %s for %s\n", p.Info.Name, m.ReleaseVersion)
+		if err := p.Call(ctx, "deploy", params, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
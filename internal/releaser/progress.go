@@ -0,0 +1,193 @@
+package releaser
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// On a terminal, the registry checks of a run show as a spinner counting
+// the services checked, a line for each service as its check finishes and
+// a table of them all at the end, colored unless NO_COLOR is set. In CI
+// (CI set), on a dumb terminal or when the output isn't a terminal, they
+// are logged line by line instead. RELEASER_PROGRESS=tty or plain forces
+// either.
+
+// spinnerFrames are the frames of the progress spinner.
+var spinnerFrames = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+// spinnerInterval is how often the spinner turns.
+const spinnerInterval = 100 * time.Millisecond
+
+// ANSI colors of the progress output.
+const (
+	ansiReset  = "\033[0m"
+	ansiRed    = "\033[31m"
+	ansiGreen  = "\033[32m"
+	ansiYellow = "\033[33m"
+	ansiDim    = "\033[2m"
+	ansiClear  = "\r\033[K"
+)
+
+// progress shows the registry checks of a run.
+type progress struct {
+	out io.Writer
+	// tty is set for a terminal, color when it may be colored.
+	tty, color bool
+
+	mu       sync.Mutex
+	total    int
+	finished int
+	frame    int
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+// newProgress returns the progress of a run's checks, shown on stdout.
+func newProgress() *progress {
+	tty := isTerminal(os.Stdout) && os.Getenv("CI") == "" && os.Getenv("TERM") != "dumb"
+	switch os.Getenv("RELEASER_PROGRESS") {
+	case "tty":
+		tty = true
+	case "plain":
+		tty = false
+	}
+	return &progress{out: os.Stdout, tty: tty, color: tty && os.Getenv("NO_COLOR") == ""}
+}
+
+// isTerminal reports whether f is a terminal: a character device other
+// than the null device.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(fi, null)
+}
+
+// printf logs a step of the checks, which on a terminal the status lines
+// and table tell instead.
+func (p *progress) printf(format string, args ...any) {
+	if !p.tty {
+		fmt.Fprintf(p.out, format, args...)
+	}
+}
+
+// paint colors s, on a terminal that may be colored.
+func (p *progress) paint(color, s string) string {
+	if !p.color {
+		return s
+	}
+	return color + s + ansiReset
+}
+
+// start starts the spinner for total checks.
+func (p *progress) start(total int) {
+	if !p.tty {
+		return
+	}
+	p.total = total
+	p.stop, p.stopped = make(chan struct{}), make(chan struct{})
+	p.draw()
+	go func() {
+		defer close(p.stopped)
+		t := time.NewTicker(spinnerInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-t.C:
+				p.mu.Lock()
+				p.frame++
+				p.draw()
+				p.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// draw redraws the spinner line. p.mu must be held once started.
+func (p *progress) draw() {
+	fmt.Fprintf(p.out, "%s%s Checking registries %d/%d", ansiClear, p.paint(ansiYellow, spinnerFrames[p.frame%len(spinnerFrames)]), p.finished, p.total)
+}
+
+// done shows the finished check of s, at current, above the spinner.
+func (p *progress) done(name, current string, l serviceLookup, update bool) {
+	if !p.tty {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.finished++
+	var line string
+	switch {
+	case l.skipped != "":
+		line = p.paint(ansiDim, "- "+name+"  skipped: "+l.skipped)
+	case l.err != nil:
+		line = p.paint(ansiRed, "✗ "+name) + "  " + failureCategory(l.err) + ": " + l.err.Error()
+	case update:
+		line = p.paint(ansiGreen, "✓ "+name) + "  " + current + " → " + l.tag
+	default:
+		line = p.paint(ansiDim, "· "+name+"  "+current+" is the latest")
+	}
+	fmt.Fprintf(p.out, "%s  %s\n", ansiClear, line)
+	p.draw()
+}
+
+// end stops the spinner.
+func (p *progress) end() {
+	if !p.tty || p.stop == nil {
+		return
+	}
+	close(p.stop)
+	<-p.stopped
+	fmt.Fprint(p.out, ansiClear)
+}
+
+// summary tabulates checks, with a count of each outcome.
+func (p *progress) summary(checks []ServiceCheck) {
+	if !p.tty || len(checks) == 0 {
+		return
+	}
+	var updates, latest, held, skipped, failed int
+	tw := tabwriter.NewWriter(p.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVICE\tCURRENT\tLATEST\tSTATUS")
+	for _, c := range checks {
+		var status string
+		switch {
+		case c.Skipped:
+			skipped++
+			status = p.paint(ansiDim, "skipped: "+c.Reason)
+		case c.Error != "":
+			failed++
+			status = p.paint(ansiRed, "failed ("+c.Failure+"): "+c.Error)
+		case c.Update:
+			updates++
+			status = p.paint(ansiGreen, "update")
+		case c.Reason != "":
+			held++
+			status = p.paint(ansiYellow, "held back: "+c.Reason)
+		default:
+			latest++
+			status = "up to date"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", c.Name, c.Current, c.Latest, status)
+	}
+	tw.Flush()
+	fmt.Fprintf(p.out, "%s, %d up to date, %s, %d skipped, %s\n",
+		p.paint(ansiGreen, plural(updates, "update")), latest, p.paint(ansiYellow, fmt.Sprintf("%d held back", held)),
+		skipped, p.paint(ansiRed, fmt.Sprintf("%d failed", failed)))
+}
+
+// plural is n things, e.g. "1 update" or "3 updates".
+func plural(n int, thing string) string {
+	if n == 1 {
+		return "1 " + thing
+	}
+	return fmt.Sprintf("%d %ss", n, thing)
+}
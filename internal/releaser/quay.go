@@ -0,0 +1,72 @@
+package releaser
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/velann21/todo-releaser/internal/image"
+)
+
+// quayRegistry reads images of Quay, quay.io. Tags are listed with Quay's
+// API, which leaves out expired and deleted tags the v2 tags list may
+// still name; private repositories need RELEASER_QUAY_TOKEN, an OAuth
+// application token with the repo:read scope. Digests are read through
+// the registry as RELEASER_QUAY_USERNAME with RELEASER_QUAY_PASSWORD, e.g.
+// a robot account, or anonymously without them.
+var quayRegistry = &registryBackend{
+	name:    "Quay",
+	handles: func(host string) bool { return host == "quay.io" },
+	client: func(ctx context.Context, r image.Reference) (*registryClient, error) {
+		return newRegistryClient(ctx, r.Registry, r.Repository, "pull", os.Getenv("RELEASER_QUAY_USERNAME"), os.Getenv("RELEASER_QUAY_PASSWORD"))
+	},
+	tags: quayTags,
+}
+
+// quayTags lists the active tags of r's repository, a page of 100 at a
+// time.
+func quayTags(ctx context.Context, c *registryClient, r image.Reference) ([]string, error) {
+	var tags []string
+	for page := 1; page <= maxTagPages; page++ {
+		q := url.Values{"onlyActiveTags": {"true"}, "limit": {"100"}, "page": {fmt.Sprint(page)}}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base+"/api/v1/repository/"+r.Repository+"/tag/?"+q.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if token := os.Getenv("RELEASER_QUAY_TOKEN"); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := registryHTTP.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			resp.Body.Close()
+			return nil, fmt.Errorf("%w for %s: %s", &statusError{"quay", resp.StatusCode}, req.URL.Path, strings.TrimSpace(string(msg)))
+		}
+		var list struct {
+			Tags []struct {
+				Name string `json:"name"`
+			} `json:"tags"`
+			HasAdditional bool `json:"has_additional"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("quay tags of %s: %w", r.Repository, err)
+		}
+		for _, t := range list.Tags {
+			tags = append(tags, t.Name)
+		}
+		if !list.HasAdditional {
+			break
+		}
+	}
+	return tags, nil
+}
@@ -0,0 +1,446 @@
+package releaser
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/velann21/todo-releaser/internal/image"
+)
+
+// latestTag returns the newest semver tag of the image ref within c (any
+// tag when c is nil), or "" when it has none, from the registry the
+// reference names: Docker Hub, the registry plugin that handles it, or one
+// of registryBackends. The tags seen are recorded for replays (see
+// recordRegistryHistory); while one runs they come from the history instead.
+func latestTag(ctx context.Context, ref string, c *semver.Constraints) (string, error) {
+	r, err := image.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	if registryReplay != nil {
+		return registryReplay.latestTag(r, c)
+	}
+	if r.IsDockerHub() {
+		return getLatestTagFromDockerHub(ctx, r, c)
+	}
+	if rc, b, err := nativeRegistry(ctx, r); err != nil || rc != nil {
+		if err != nil {
+			return "", err
+		}
+		tags, err := b.listTags(ctx, rc, r)
+		if err != nil {
+			return "", err
+		}
+		observeTags(r, tags)
+		return newestTag(tags, c), nil
+	}
+	p, err := registryPlugin(ctx, r.Registry)
+	if err != nil || p == nil {
+		return "", unsupportedRegistry(r, err)
+	}
+	params := map[string]string{"image": ref}
+	if c != nil {
+		params["constraint"] = c.String()
+	}
+	var result struct {
+		Tag string `json:"tag"`
+	}
+	if err := throttle(ctx, r.Registry); err != nil {
+		return "", err
+	}
+	if err := p.Call(ctx, "latest_tag", params, &result); err != nil {
+		return "", err
+	}
+	if c != nil && result.Tag != "" {
+		// Plugins written before constraints were passed ignore them.
+		if v, err := semver.NewVersion(result.Tag); err != nil || !c.Check(v) {
+			return "", policyError{fmt.Errorf("plugin %s returned %s, which is not in %s", p.Info.Name, result.Tag, c)}
+		}
+	}
+	if result.Tag != "" {
+		observeTags(r, []string{result.Tag})
+	}
+	return result.Tag, nil
+}
+
+// tagDigest returns the digest tag points to in the image ref's repository.
+// Like latestTag's tags, digests are recorded for replays.
+func tagDigest(ctx context.Context, ref, tag string) (string, error) {
+	r, err := image.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	if registryReplay != nil {
+		return registryReplay.tagDigest(r, tag)
+	}
+	digest, err := registryTagDigest(ctx, ref, r, tag)
+	if err == nil {
+		observeDigest(r, tag, digest)
+	}
+	return digest, err
+}
+
+func registryTagDigest(ctx context.Context, ref string, r image.Reference, tag string) (string, error) {
+	if r.IsDockerHub() {
+		return getTagDigestFromDockerHub(ctx, r, tag)
+	}
+	if rc, _, err := nativeRegistry(ctx, r); err != nil || rc != nil {
+		if err != nil {
+			return "", err
+		}
+		return rc.digest(ctx, tag)
+	}
+	p, err := registryPlugin(ctx, r.Registry)
+	if err != nil || p == nil {
+		return "", unsupportedRegistry(r, err)
+	}
+	var result struct {
+		Digest string `json:"digest"`
+	}
+	if err := throttle(ctx, r.Registry); err != nil {
+		return "", err
+	}
+	err = p.Call(ctx, "tag_digest", map[string]string{"image": ref, "tag": tag}, &result)
+	if err == nil && result.Digest == "" {
+		err = fmt.Errorf("plugin %s returned no digest", p.Info.Name)
+	}
+	return result.Digest, err
+}
+
+// registryBackend is a registry the releaser reads itself, through its v2
+// API, when no plugin handles its host.
+type registryBackend struct {
+	// name names the registry in messages, e.g. GHCR.
+	name    string
+	handles func(host string) bool
+	// client returns a client for r's repository, authorized to pull.
+	client func(ctx context.Context, r image.Reference) (*registryClient, error)
+	// tags lists r's tags, when the registry has a better way to than the
+	// v2 tags list.
+	tags func(ctx context.Context, c *registryClient, r image.Reference) ([]string, error)
+}
+
+// registryBackends are the registries read without a plugin, besides
+// Docker Hub.
+var registryBackends = []*registryBackend{ghcrRegistry, ecrRegistry, garRegistry, quayRegistry}
+
+// registryClientTTL is how long a registry client, and its token, is
+// reused.
+const registryClientTTL = time.Minute
+
+var (
+	registryClientsMu sync.Mutex
+	registryClients   = map[string]*cachedRegistryClient{}
+)
+
+type cachedRegistryClient struct {
+	client *registryClient
+	at     time.Time
+}
+
+// nativeRegistry returns a client for r's repository, and its backend,
+// when r's registry is one of registryBackends and no plugin handles it.
+// It returns a nil client otherwise.
+func nativeRegistry(ctx context.Context, r image.Reference) (*registryClient, *registryBackend, error) {
+	if p, err := registryPlugin(ctx, r.Registry); err != nil || p != nil {
+		return nil, nil, err
+	}
+	i := slices.IndexFunc(registryBackends, func(b *registryBackend) bool { return b.handles(r.Registry) })
+	if i < 0 {
+		return nil, nil, nil
+	}
+	b := registryBackends[i]
+	key := r.Registry + "/" + r.Repository
+	registryClientsMu.Lock()
+	defer registryClientsMu.Unlock()
+	if cached := registryClients[key]; cached != nil && time.Since(cached.at) < registryClientTTL {
+		return cached.client, b, nil
+	}
+	c, err := b.client(ctx, r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", b.name, err)
+	}
+	c.http = registryHTTP
+	registryClients[key] = &cachedRegistryClient{c, time.Now()}
+	return c, b, nil
+}
+
+// listTags lists r's tags with c.
+func (b *registryBackend) listTags(ctx context.Context, c *registryClient, r image.Reference) ([]string, error) {
+	if b.tags != nil {
+		return b.tags(ctx, c, r)
+	}
+	return c.tags(ctx)
+}
+
+// maxTagPages bounds the pages of a v2 tags list read.
+const maxTagPages = 20
+
+// tags lists the repository's tags, following the pages of the v2 tags
+// list.
+func (c *registryClient) tags(ctx context.Context) ([]string, error) {
+	var tags []string
+	next := "/tags/list?n=1000"
+	for page := 0; next != "" && page < maxTagPages; page++ {
+		resp, err := c.do(ctx, http.MethodGet, next, nil, nil, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+		var list struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, list.Tags...)
+		next = ""
+		if link := linkNext.FindStringSubmatch(resp.Header.Get("Link")); link != nil {
+			u, err := resp.Request.URL.Parse(link[1])
+			if err != nil {
+				return nil, err
+			}
+			next = u.String()
+		}
+	}
+	return tags, nil
+}
+
+// linkNext finds the next page in a Link header.
+var linkNext = regexp.MustCompile(`<([^>]+)>;\s*rel="?next"?`)
+
+// digest returns the digest tag points to.
+func (c *registryClient) digest(ctx context.Context, tag string) (string, error) {
+	resp, err := c.do(ctx, http.MethodHead, "/manifests/"+tag, http.Header{"Accept": {strings.Join(manifestMediaTypes, ", ")}}, nil, http.StatusOK)
+	if err != nil {
+		var status *statusError
+		if errors.As(err, &status) && status.code == http.StatusNotFound {
+			return "", fmt.Errorf("%s:%s: %w", c.repo, tag, errTagNotFound)
+		}
+		return "", err
+	}
+	resp.Body.Close()
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("registry returned no digest for %s:%s", c.repo, tag)
+	}
+	return digest, nil
+}
+
+func unsupportedRegistry(r image.Reference, pluginErr error) error {
+	if pluginErr != nil {
+		return pluginErr
+	}
+	return fmt.Errorf("registry %s is not supported; add a plugin for it to RELEASER_PLUGINS", r.Registry)
+}
+
+// registryScheme is the scheme a registry host is reached with: http for
+// the loopback interface and the hosts of RELEASER_INSECURE_REGISTRIES,
+// comma-separated, as registries of a disconnected site often are, and
+// https for any other.
+func registryScheme(host string) string {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	if ip := net.ParseIP(hostname); hostname == "localhost" || ip != nil && ip.IsLoopback() {
+		return "http"
+	}
+	for _, insecure := range strings.Split(os.Getenv("RELEASER_INSECURE_REGISTRIES"), ",") {
+		if strings.TrimSpace(insecure) == host {
+			return "http"
+		}
+	}
+	return "https"
+}
+
+// challengeParam is a parameter of a WWW-Authenticate challenge.
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// newRegistryClient returns a client for repo on the v2 registry host,
+// authorized for actions, e.g. pull or pull,push, as the registry's
+// challenge asks: with a token from its token service, requested
+// anonymously or as username, or with basic auth. Its requests have no
+// timeout, for blobs of any size; ctx bounds them instead.
+func newRegistryClient(ctx context.Context, host, repo, actions, username, password string) (*registryClient, error) {
+	c := &registryClient{base: registryScheme(host) + "://" + host, repo: repo, http: &http.Client{Transport: registryHTTP.Transport}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base+"/v2/", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		return c, nil
+	}
+
+	scheme, rest, _ := strings.Cut(resp.Header.Get("WWW-Authenticate"), " ")
+	params := map[string]string{}
+	for _, p := range challengeParam.FindAllStringSubmatch(rest, -1) {
+		params[p[1]] = p[2]
+	}
+	switch {
+	case strings.EqualFold(scheme, "basic"):
+		if username == "" {
+			return nil, fmt.Errorf("%s needs a username and password", host)
+		}
+		c.username, c.password = username, password
+		return c, nil
+	case !strings.EqualFold(scheme, "bearer") || params["realm"] == "":
+		return nil, fmt.Errorf("%s asks for unsupported authentication %q", host, scheme)
+	}
+	u, err := url.Parse(params["realm"])
+	if err != nil {
+		return nil, fmt.Errorf("%s token service: %w", host, err)
+	}
+	q := u.Query()
+	if service := params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	q.Set("scope", "repository:"+repo+":"+actions)
+	u.RawQuery = q.Encode()
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	resp, err = c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{host + " token service", resp.StatusCode}
+	}
+	var auth struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&auth); err != nil {
+		return nil, err
+	}
+	c.token = auth.Token
+	if c.token == "" {
+		c.token = auth.AccessToken
+	}
+	return c, nil
+}
+
+// do sends a request for path, under the repository, or for an absolute
+// URL the registry returned, and returns the response when its status is
+// one of ok.
+func (c *registryClient) do(ctx context.Context, method, path string, header http.Header, body io.Reader, ok ...int) (*http.Response, error) {
+	target := path
+	if !strings.Contains(path, "://") {
+		target = c.base + "/v2/" + c.repo + path
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	c.authorize(req)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(ok, resp.StatusCode) {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w for %s %s: %s", &statusError{req.URL.Host, resp.StatusCode}, method, req.URL.Path, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// maxManifestSize bounds the manifests read, which registries cap at 4MiB.
+const maxManifestSize = 4 << 20
+
+// rawManifest returns the manifest or index of reference, a tag or digest,
+// as the registry serves it, with its media type.
+func (c *registryClient) rawManifest(ctx context.Context, reference string) ([]byte, string, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/manifests/"+reference, http.Header{"Accept": {strings.Join(manifestMediaTypes, ", ")}}, nil, http.StatusOK)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+	return data, resp.Header.Get("Content-Type"), err
+}
+
+// blob opens the blob digest.
+func (c *registryClient) blob(ctx context.Context, digest string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/blobs/"+digest, nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// pushBlob uploads the blob digest of size bytes from r, unless the
+// repository has it already.
+func (c *registryClient) pushBlob(ctx context.Context, digest string, size int64, r io.Reader) error {
+	if resp, err := c.do(ctx, http.MethodHead, "/blobs/"+digest, nil, nil, http.StatusOK); err == nil {
+		resp.Body.Close()
+		return nil
+	}
+	resp, err := c.do(ctx, http.MethodPost, "/blobs/uploads/", nil, nil, http.StatusAccepted)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return err
+	}
+	q := location.Query()
+	q.Set("digest", digest)
+	location.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, location.String(), r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	c.authorize(req)
+	if resp, err = c.http.Do(req); err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("registry returned %d uploading %s", resp.StatusCode, digest)
+	}
+	return nil
+}
+
+// pushManifest uploads data, a manifest or index of mediaType, as
+// reference, a tag or its digest.
+func (c *registryClient) pushManifest(ctx context.Context, reference, mediaType string, data []byte) error {
+	resp, err := c.do(ctx, http.MethodPut, "/manifests/"+reference, http.Header{"Content-Type": {mediaType}}, bytes.NewReader(data), http.StatusCreated, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
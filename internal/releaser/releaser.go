@@ -0,0 +1,855 @@
+// Package releaser bumps the release manifest to the latest image tags,
+// tags a calver release and hands it to the deploy hooks.
+package releaser
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/velann21/todo-releaser/internal/image"
+	"github.com/velann21/todo-releaser/internal/manifest"
+	"github.com/velann21/todo-releaser/internal/ratelimit"
+)
+
+const (
+	ManifestFile    = manifest.File
+	PollingInterval = 30 * time.Second
+)
+
+type DockerHubTags struct {
+	Results []struct {
+		Name string `json:"name"`
+	} `json:"results"`
+}
+
+type IncrementType int
+
+const (
+	IncrementPatch IncrementType = iota
+	IncrementMinor
+	IncrementMajor
+)
+
+// Run checks each service when its schedule says it is due, every
+// PollingInterval unless configured otherwise, until ctx is done, serving
+// health and metrics in the background. A release under way when ctx is
+// done is abandoned, unless it was pushed already.
+func Run(ctx context.Context) {
+	fmt.Println("Starting Releaser in Reconciler Mode...")
+	startSecretWatcher()
+	startBackups()
+
+	// Serve from the managed checkout, if any, from the start.
+	if err := syncCheckout(); err != nil {
+		fmt.Printf("Error updating the checkout: %v\n", err)
+	}
+	status := NewStatus(time.Now())
+	ServeStatus(status)
+
+	// advised records the security advisories that brought services'
+	// checks forward.
+	advised := map[string]bool{}
+	timer := time.NewTimer(0)
+	for {
+		select {
+		case <-timer.C:
+			now := time.Now()
+			if err := syncSchedule(status.schedule, now); err != nil {
+				fmt.Printf("Error during reconciliation: %v\n", err)
+				status.Record(now, false, err)
+			} else if due := dueServices(status.schedule, now, advised); len(due) > 0 {
+				reconcileOnce(ctx, status, due)
+			} else {
+				status.Idle(now)
+			}
+			wait := nextWake(status.schedule, time.Now())
+			fmt.Printf("Sleeping for %v...\n", wait.Round(time.Second))
+			timer.Reset(wait)
+		case op := <-operations:
+			op(ctx, status)
+		case <-ctx.Done():
+			fmt.Println("Stopping the reconciler")
+			return
+		}
+	}
+}
+
+// operations are run by Run between reconciles, so releases are only ever
+// made by one thing at a time.
+var operations = make(chan func(context.Context, *Status))
+
+// reconcileOnce reconciles the services due, or all of them when due is
+// nil, and records the outcome and the services checked in status.
+func reconcileOnce(ctx context.Context, status *Status, due []string) (*Result, error) {
+	result, err := reconcile(ctx, due)
+	if err != nil {
+		fmt.Printf("Error during reconciliation: %v\n", err)
+	}
+	now := time.Now()
+	status.Record(now, result != nil, err)
+	if due == nil {
+		for _, e := range status.schedule.Entries() {
+			due = append(due, e.Key)
+		}
+	}
+	status.schedule.Done(due, now)
+	return result, err
+}
+
+// Change is a service version bump in a release, or a change of one of its
+// config bundles.
+type Change struct {
+	Service string `json:"service"`
+	// Config is the path of the config bundle changed; From and To are
+	// then its abbreviated hashes rather than image tags.
+	Config string `json:"config,omitempty"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	// Revision is the source commit the new image was built from, and
+	// CommitURL and CompareURL link to it, from the image's OCI labels.
+	Revision   string `json:"revision,omitempty"`
+	CommitURL  string `json:"commit_url,omitempty"`
+	CompareURL string `json:"compare_url,omitempty"`
+	// SizeFrom and SizeTo are the compressed image sizes in bytes, when
+	// the registry tells them, and SizeWarning flags a change growing its
+	// image past RELEASER_SIZE_GROWTH_WARN.
+	SizeFrom    int64 `json:"size_from,omitempty"`
+	SizeTo      int64 `json:"size_to,omitempty"`
+	SizeWarning bool  `json:"size_warning,omitempty"`
+	// Licenses is the license gate's verdict, when LicensePolicyFile
+	// configures one.
+	Licenses *LicenseVerdict `json:"licenses,omitempty"`
+	// Security says why the change is a security update, if it is: the
+	// advisories it fixes and the security labels of its image.
+	Security []string `json:"security,omitempty"`
+	// Fixes are the vulnerabilities the change fixes, by CVE ID where
+	// there is one, when RELEASER_CVE_LOOKUP looks them up.
+	Fixes []string `json:"fixes,omitempty"`
+	// sbom is the new image's SBOM, when the license gate scanned it.
+	sbom []byte
+}
+
+// Result describes a release created by Reconcile.
+type Result struct {
+	Version string   `json:"version"`
+	Changes []Change `json:"changes"`
+	// Hotfix marks a release made by Hotfix rather than Reconcile.
+	Hotfix bool `json:"hotfix,omitempty"`
+	// Blocked are the updates the license gate held back.
+	Blocked []Change `json:"blocked,omitempty"`
+	// Bypassed is the freeze security updates were released through.
+	Bypassed *Freeze `json:"bypassed,omitempty"`
+	// Failed are the services left out because their check failed, grouped
+	// by why.
+	Failed []FailureGroup `json:"failed,omitempty"`
+}
+
+// Reconcile bumps the manifest to the latest image tags and tags a release.
+// It returns the release, or nil when nothing was released. When ctx is done
+// before the release is pushed, the checkout is put back as it was.
+func Reconcile(ctx context.Context) (*Result, error) {
+	return reconcile(ctx, nil)
+}
+
+// reconcile is Reconcile for only the services named in due, or all of
+// them when due is nil.
+func reconcile(ctx context.Context, due []string) (*Result, error) {
+	if err := startRun(); err != nil {
+		return nil, err
+	}
+	freeze, err := CurrentFreeze(time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("error reading release freeze: %w", err)
+	}
+	if freeze != nil {
+		fmt.Printf("Releases are frozen (%s); only security updates go out\n", freeze.Reason)
+	}
+
+	// 1. Load Manifest
+	m, err := loadManifest()
+	if err != nil {
+		return nil, fmt.Errorf("error loading manifest: %w", err)
+	}
+
+	policy, err := currentBranchPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	mode, err := updateMode()
+	if err != nil {
+		return nil, err
+	}
+	approval, err := securityApproval()
+	if err != nil {
+		return nil, err
+	}
+	var changes, blocked, configs []Change
+	var checks []ServiceCheck
+	msg := "chore: update services to latest versions"
+	if freeze == nil {
+		if configs, err = configChanges(m); err != nil {
+			return nil, err
+		}
+	}
+	if mode == UpdateModePR {
+		// Update pull requests merged since the last release go out first.
+		if changes, err = mergedChanges(m); err != nil {
+			return nil, err
+		}
+		markSecurity(ctx, m, changes)
+		annotateFixes(ctx, m, changes)
+		if _, other := splitSecurity(changes); freeze != nil && len(other) > 0 {
+			fmt.Printf("Releases are frozen: %s\n", freeze.Reason)
+			return nil, nil
+		}
+		if len(changes) > 0 {
+			msg = "chore: release merged updates"
+		}
+	}
+	if len(changes) == 0 {
+		before := slices.Clone(m.Services)
+		var only map[string]bool
+		if due != nil {
+			only = map[string]bool{}
+			for _, name := range due {
+				only[name] = true
+			}
+		}
+		var planned []Change
+		planned, checks = planUpdates(ctx, m, policy, only)
+		recordRegistryHistory(Clock.Now())
+		var held []Change
+		changes, held = holdBack(m, before, planned)
+		changes, blocked, err = gateLicenses(m, before, changes)
+		if err != nil {
+			return nil, err
+		}
+		markSecurity(ctx, m, changes)
+		if freeze != nil {
+			var frozen []Change
+			changes, frozen = splitSecurity(changes)
+			restoreServices(m, before, frozen)
+		} else {
+			pins, err := checkYankedTags(ctx, m, before, only)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, pins...)
+		}
+		annotateFixes(ctx, m, changes)
+		if len(changes) > 0 {
+			publishEvent(LifecycleEvent{Type: EventUpdateDetected, Changes: changes})
+		}
+		if mode == UpdateModePR && len(changes) > 0 {
+			var expedited []Change
+			if approval == SecurityApprovalRelease {
+				expedited, changes = splitSecurity(changes)
+			}
+			var prErr error
+			if len(changes) > 0 {
+				holdChecks(checks, held, func(Change) string { return "disabled by the Renovate config" })
+				holdChecks(checks, blocked, func(c Change) string { return licenseProblem(c.Licenses) })
+				prErr = openUpdatePRs(m, before, changes, checks)
+			}
+			if len(expedited) == 0 && len(configs) == 0 {
+				return nil, prErr
+			}
+			if prErr != nil {
+				fmt.Printf("Error opening update pull requests: %v\n", prErr)
+			}
+			// Security updates skip their pull requests.
+			restoreServices(m, before, changes)
+			changes = expedited
+		}
+		if security, other := splitSecurity(changes); len(security) > 0 && len(other) == 0 {
+			msg = "chore: release security updates"
+		}
+	}
+	if len(changes) == 0 && len(configs) > 0 {
+		msg = "chore: release config changes"
+	}
+	changes = append(changes, configs...)
+	if len(changes) == 0 {
+		if freeze != nil {
+			fmt.Printf("Releases are frozen: %s\n", freeze.Reason)
+		} else {
+			fmt.Println("No updates found.")
+		}
+		return nil, nil
+	}
+	if err := checkLocks(m); err != nil {
+		return nil, err
+	}
+
+	var version string
+	if policy == UpdatePatch {
+		version, err = releasePatch(ctx, m, "chore: update services to latest patch versions")
+	} else {
+		version, err = release(ctx, m, incrementOf(changes), msg)
+	}
+	if errors.Is(err, errChecksPending) {
+		fmt.Printf("Not releasing yet: %v\n", err)
+		return nil, nil
+	}
+	if version == "" {
+		return nil, err
+	}
+	linkSources(ctx, m, changes)
+	measureSizes(ctx, m, changes)
+	result := &Result{Version: version, Changes: changes, Blocked: blocked, Bypassed: freeze, Failed: failureGroups(checks)}
+	if freeze != nil {
+		auditFreezeBypass(result, freeze)
+	}
+	recordSizes(result)
+	recordTimeToRelease(ctx, m, result)
+	if notifyErr := notifyRelease(ctx, m, result); notifyErr != nil {
+		fmt.Printf("Error sending release notification: %v\n", notifyErr)
+	}
+	publishEvent(LifecycleEvent{Type: EventReleaseCreated, Version: version, Changes: changes, Hotfix: result.Hotfix})
+	if notesErr := publishReleaseNotes(ctx, m, result); notesErr != nil {
+		fmt.Printf("Error publishing release notes: %v\n", notesErr)
+	}
+	if hookErr := deliverReleaseWebhooks(m, result); hookErr != nil {
+		fmt.Printf("Error delivering release webhooks: %v\n", hookErr)
+	}
+	if archiveErr := archiveRelease(ctx, m, result); archiveErr != nil {
+		fmt.Printf("Error archiving release artifacts: %v\n", archiveErr)
+	}
+	if backportErr := backportRelease(m, result); backportErr != nil {
+		fmt.Printf("Error backporting %s: %v\n", version, backportErr)
+	}
+	if err == nil {
+		err = watchRelease(ctx, m, version)
+	}
+	return result, err
+}
+
+// runID identifies the current run in the manifest's records of version
+// bumps: the GitHub Actions run when run as the action, else a random ID
+// per run.
+var runID string
+
+// startRun starts a reconcile, dry run, hotfix or build.
+func startRun() error {
+	if err := syncCheckout(); err != nil {
+		return fmt.Errorf("error updating the checkout: %w", err)
+	}
+	runID = os.Getenv("GITHUB_RUN_ID")
+	if runID != "" {
+		runID = "github-" + runID
+	} else {
+		b := make([]byte, 6)
+		rand.Read(b)
+		runID = hex.EncodeToString(b)
+	}
+	var err error
+	if renovate, err = loadRenovateConfig(); err != nil {
+		return err
+	}
+	if codeowners, err = loadCodeowners(); err != nil {
+		return fmt.Errorf("error reading CODEOWNERS: %w", err)
+	}
+	return startRegistryRun()
+}
+
+// release commits the updated manifest with msg, tags the next calver
+// version for inc and hands the release to the deploy hooks, once the
+// required checks have passed. It returns the new tag, or "" if it was not
+// created.
+func release(ctx context.Context, m *manifest.Manifest, inc IncrementType, msg string) (string, error) {
+	newVersion, err := generateNewVersion(inc)
+	if err != nil {
+		return "", fmt.Errorf("error generating new version: %w", err)
+	}
+	return releaseAs(ctx, m, newVersion, msg)
+}
+
+// serviceLookup is the latest version of a service that its registry
+// offers within the release policy.
+type serviceLookup struct {
+	tag    string
+	digest string
+	err    error
+	// skipped says why the service isn't updated, if it isn't.
+	skipped string
+	// notDue is set for services left out of the run.
+	notDue bool
+}
+
+// currentVersion is the version s is at: its tag, or for digest-only services an
+// abbreviated digest.
+func currentVersion(s manifest.Service) string {
+	if digest := s.Digest(); digest != "" {
+		return shortDigest(digest)
+	}
+	return s.Version
+}
+
+// update tells whether l moves s to a new image.
+func (l serviceLookup) update(s manifest.Service) bool {
+	if pinned := s.Digest(); pinned != "" {
+		// The tag may be unchanged and the image rebuilt under it.
+		return l.tag != "" && l.digest != pinned
+	}
+	return l.tag != s.Version && l.tag != ""
+}
+
+// lookupServices asks the registries for the latest versions of m's
+// services that policy allows, up to RELEASER_REGISTRY_CONCURRENCY services
+// at once. With only set, only the services in it are looked up. If done
+// is not nil, it is called with each service's index as its lookup
+// finishes, from the goroutine that made it. Lookups not started when ctx
+// is done fail with its error.
+func lookupServices(ctx context.Context, m *manifest.Manifest, policy string, only map[string]bool, done func(i int, l serviceLookup)) []serviceLookup {
+	lookups := make([]serviceLookup, len(m.Services))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, service := range m.Services {
+		if only != nil && !only[service.Name] {
+			lookups[i].notDue = true
+			continue
+		}
+		constraint, skipped := serviceConstraint(service, policy)
+		if skipped != "" {
+			lookups[i].skipped = skipped
+			if done != nil {
+				done(i, lookups[i])
+			}
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			l := &lookups[i]
+			switch {
+			case ctx.Err() != nil:
+				l.err = ctx.Err()
+			case service.Digest() != "":
+				l.tag, l.digest, l.err = latestPinned(ctx, service, constraint)
+			default:
+				l.tag, l.err = latestTag(ctx, service.Image, constraint)
+			}
+			if done != nil {
+				done(i, *l)
+			}
+		}()
+	}
+	wg.Wait()
+	return lookups
+}
+
+// serviceConstraint is the range of versions policy and the Renovate
+// config allow s, or why s isn't updated at all.
+func serviceConstraint(s manifest.Service, policy string) (*semver.Constraints, string) {
+	if renovate.ignored(s) {
+		return nil, "ignored by the Renovate config"
+	}
+	var ranges []string
+	if policy == UpdatePatch {
+		c := patchConstraint(s.Version)
+		if c == nil {
+			return nil, fmt.Sprintf("%s is not a semver version to take patches of", s.Version)
+		}
+		ranges = append(ranges, c.String())
+	}
+	if c := renovate.constraint(s); c != nil {
+		ranges = append(ranges, c.String())
+	}
+	if len(ranges) == 0 {
+		return nil, ""
+	}
+	c, err := semver.NewConstraint(strings.Join(ranges, ", "))
+	if err != nil {
+		return nil, err.Error()
+	}
+	return c, ""
+}
+
+// planUpdates moves m's services to the latest tags policy allows and
+// returns the changes, along with what was found for each service checked.
+// Registries are asked about up to RELEASER_REGISTRY_CONCURRENCY services
+// at once; once the run's request budget is spent the services left are
+// skipped until the next run. Digest-only services move to the digest of
+// their image's latest tag. Multi-arch services are held back at tags not
+// published for all their platforms. With only set, only the services in
+// it are checked. Services not looked up within RELEASER_REGISTRY_TIMEOUT
+// fail their check. The checks are shown as they go (see progress).
+func planUpdates(ctx context.Context, m *manifest.Manifest, policy string, only map[string]bool) ([]Change, []ServiceCheck) {
+	ctx, cancel := context.WithTimeout(ctx, phaseTimeout("RELEASER_REGISTRY_TIMEOUT", DefaultRegistryTimeout))
+	defer cancel()
+	p := newProgress()
+	due := 0
+	for _, s := range m.Services {
+		if only == nil || only[s.Name] {
+			due++
+		}
+	}
+	p.start(due)
+	lookups := lookupServices(ctx, m, policy, only, func(i int, l serviceLookup) {
+		s := m.Services[i]
+		p.done(s.Name, currentVersion(s), l, l.err == nil && l.update(s))
+	})
+	p.end()
+
+	var changes []Change
+	var checks []ServiceCheck
+	exhausted := 0
+
+	for i, service := range m.Services {
+		if lookups[i].notDue {
+			continue
+		}
+		current := currentVersion(service)
+		p.printf("Checking service: %s (current: %s)\n", service.Name, current)
+		checks = append(checks, ServiceCheck{Name: service.Name, Current: current, Latest: lookups[i].tag})
+		check := &checks[len(checks)-1]
+		if lookups[i].skipped != "" {
+			p.printf("Skipping %s: %s\n", service.Name, lookups[i].skipped)
+			check.Skipped, check.Reason = true, lookups[i].skipped
+			continue
+		}
+		latestTag, err := lookups[i].tag, lookups[i].err
+		if err != nil {
+			check.fail(service.Image, err)
+			if errors.Is(err, ratelimit.ErrBudgetExhausted) {
+				exhausted++
+			} else {
+				p.printf("Error checking the registry for %s (%s): %v\n", service.Name, check.Failure, err)
+			}
+			continue
+		}
+
+		if lookups[i].update(service) {
+			p.printf("Found update for %s: %s -> %s\n", service.Name, current, latestTag)
+			if err := checkPlatforms(ctx, service, latestTag); err != nil {
+				p.printf("Holding back %s: %v\n", service.Name, err)
+				check.Reason = err.Error()
+				continue
+			}
+
+			from := service.Version
+			if from == "" || from == latestTag {
+				from = current
+			}
+			changes = append(changes, Change{Service: service.Name, From: from, To: latestTag})
+			check.Update = true
+			if service.Digest() != "" {
+				m.SetDigest(i, latestTag, lookups[i].digest, runID, Clock.Now())
+			} else {
+				m.SetVersion(i, latestTag, runID, Clock.Now())
+			}
+		} else {
+			p.printf("No update for %s\n", service.Name)
+		}
+	}
+	p.summary(checks)
+	if exhausted > 0 {
+		fmt.Printf("Registry request budget spent; %d services left for the next run\n", exhausted)
+	}
+	for _, g := range failureGroups(checks) {
+		fmt.Println(g)
+	}
+
+	return changes, checks
+}
+
+// incrementOf is the largest version increment among changes.
+func incrementOf(changes []Change) IncrementType {
+	maxIncrement := IncrementPatch
+	for _, c := range changes {
+		if incType := determineIncrementType(c.From, c.To); incType > maxIncrement {
+			maxIncrement = incType
+		}
+	}
+	return maxIncrement
+}
+
+// releasePatch releases m as the next patch of its current release, as
+// release branches and hotfixes do.
+func releasePatch(ctx context.Context, m *manifest.Manifest, msg string) (string, error) {
+	tags, err := releaseTags()
+	if err != nil {
+		return "", err
+	}
+	newVersion, err := nextPatch(m.ReleaseVersion, tags)
+	if err != nil {
+		return "", err
+	}
+	return releaseAs(ctx, m, newVersion, msg)
+}
+
+// releaseAs is release with the tag chosen by the caller. When it fails or
+// ctx is done before the release is pushed, the checkout is put back as it
+// was (see abandonRelease), so an interrupted run leaves no half-made
+// release behind.
+func releaseAs(ctx context.Context, m *manifest.Manifest, newVersion, msg string) (version string, err error) {
+	if err := gateRequiredChecks(); err != nil {
+		return "", err
+	}
+	repo := currentRepo()
+	head, _ := commitOf("HEAD")
+	tagged, pushed := false, false
+	defer func() {
+		if err != nil && !pushed {
+			abandonRelease(context.WithoutCancel(ctx), head, newVersion, tagged)
+		}
+	}()
+
+	// 2. Update Manifest File
+	err = manifest.Save(ManifestFile, m)
+	if err != nil {
+		return "", fmt.Errorf("error saving manifest: %w", err)
+	}
+
+	// 3. Git Operations
+	// Commit
+	err = stageManifest()
+	if err != nil {
+		return "", err
+	}
+
+	// Updates merged from pull requests are committed already.
+	if staged, err := repo.staged(""); err != nil || len(staged) > 0 {
+		err = repo.commit(ctx, msg)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Tag
+	fmt.Printf("Creating new tag: %s\n", newVersion)
+
+	// Update manifest with new version
+	m.ReleaseVersion = newVersion
+	err = manifest.Save(ManifestFile, m)
+	if err != nil {
+		return "", fmt.Errorf("error saving manifest with new version: %w", err)
+	}
+
+	if err := updateChangelog(m, newVersion); err != nil {
+		return "", fmt.Errorf("error updating %s: %w", ChangelogFile, err)
+	}
+
+	// Sign provenance for the release commit
+	attestation, err := attestRelease(ctx, m)
+	if err != nil {
+		return "", fmt.Errorf("error attesting %s: %w", newVersion, err)
+	}
+
+	// Commit again with the version update
+	err = stageManifest()
+	if err != nil {
+		return "", err
+	}
+	if attestation != "" {
+		err = repo.add(ctx, attestation)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	msg = fmt.Sprintf("chore: release %s", newVersion)
+	err = repo.commit(ctx, msg)
+	if err != nil {
+		return "", err
+	}
+
+	err = repo.tag(ctx, newVersion)
+	if err != nil {
+		return "", err
+	}
+	tagged = true
+
+	if err := pushRelease(ctx, newVersion); err != nil {
+		return "", fmt.Errorf("error pushing %s: %w", newVersion, err)
+	}
+	pushed = true
+
+	if err := publishManifest(ctx, newVersion); err != nil {
+		fmt.Printf("Error publishing %s to RELEASER_MANIFEST_REPOSITORY: %v\n", newVersion, err)
+	}
+
+	// 4. Roll out
+	if err := deployRelease(ctx, m); err != nil {
+		return newVersion, fmt.Errorf("error deploying %s: %w", newVersion, err)
+	}
+	return newVersion, nil
+}
+
+// abandonRelease undoes an unfinished release of version made on top of
+// head: its tag is deleted if it was tagged, the branch reset to head and
+// the files the release changed, such as the manifest, changelog and
+// attestation, put back as they are at head. Other changes in the checkout
+// are kept.
+func abandonRelease(ctx context.Context, head, version string, tagged bool) {
+	if head == "" {
+		fmt.Printf("Can't undo the unfinished release %s in a repository without commits\n", version)
+		return
+	}
+	fmt.Printf("Undoing the unfinished release %s\n", version)
+	repo := currentRepo()
+	if tagged {
+		if err := repo.deleteTag(ctx, version); err != nil {
+			fmt.Printf("Error deleting the tag %s: %v\n", version, err)
+		}
+	}
+	changed, err := repo.staged(head)
+	if err != nil {
+		fmt.Printf("Error undoing %s: %v\n", version, err)
+		return
+	}
+	paths := append(changed, ManifestFile, ChangelogFile)
+	if err := repo.reset(ctx, head, resetMixed); err != nil {
+		fmt.Printf("Error undoing %s: %v\n", version, err)
+		return
+	}
+	for _, path := range slices.Compact(slices.Sorted(slices.Values(paths))) {
+		if _, err := repo.show(head, path); err != nil {
+			os.Remove(path)
+			continue
+		}
+		if err := repo.restore(ctx, head, path); err != nil {
+			fmt.Printf("Error restoring %s: %v\n", path, err)
+		}
+	}
+}
+
+func getLatestTagFromDockerHub(ctx context.Context, ref image.Reference, c *semver.Constraints) (string, error) {
+	// Fetch more tags to ensure we find a semantic one
+	url := fmt.Sprintf("https://hub.docker.com/v2/repositories/%s/tags?page_size=20", ref.Repository)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := registryHTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", &statusError{"docker hub", resp.StatusCode}
+	}
+
+	var tags DockerHubTags
+	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		return "", err
+	}
+
+	var names []string
+	for _, tag := range tags.Results {
+		names = append(names, tag.Name)
+	}
+	observeTags(ref, names)
+	return newestTag(names, c), nil
+}
+
+// newestTag returns the highest semver tag in names within c (any when c
+// is nil), or "" when there is none.
+func newestTag(names []string, c *semver.Constraints) string {
+	var semverTags []*semver.Version
+	for _, name := range names {
+		// Attempt to parse as semantic version
+		// We handle 'v' prefix if present, though semver lib handles it too usually
+		v, err := semver.NewVersion(name)
+		if err == nil && (c == nil || c.Check(v)) {
+			semverTags = append(semverTags, v)
+		}
+	}
+
+	if len(semverTags) == 0 {
+		return ""
+	}
+
+	// Sort to find the latest
+	sort.Sort(semver.Collection(semverTags))
+
+	// Return the latest version
+	return semverTags[len(semverTags)-1].Original()
+}
+
+// parseVersion parses the major, minor and patch numbers of a tag such as
+// v1.2.3. A pre-release or build suffix, as in 1.27.3-alpine, is ignored,
+// as are components after the patch.
+func parseVersion(v string) (major, minor, patch int, err error) {
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	parts := strings.Split(v, ".")
+	if len(parts) < 3 {
+		return 0, 0, 0, fmt.Errorf("invalid version format: %s", v)
+	}
+	var n [3]int
+	for i := range n {
+		if n[i], err = versionNumber(parts[i]); err != nil {
+			return 0, 0, 0, fmt.Errorf("invalid version format: %s: %w", v, err)
+		}
+	}
+	return n[0], n[1], n[2], nil
+}
+
+// versionNumber parses a component of a version: decimal digits only, no
+// sign, and few enough that the number can be incremented without
+// overflowing.
+func versionNumber(s string) (int, error) {
+	if s == "" || len(s) > 9 || strings.Trim(s, "0123456789") != "" {
+		return 0, fmt.Errorf("%q is not a version number", s)
+	}
+	return strconv.Atoi(s)
+}
+
+func determineIncrementType(oldVer, newVer string) IncrementType {
+	oMaj, oMin, _, err1 := parseVersion(oldVer)
+	nMaj, nMin, _, err2 := parseVersion(newVer)
+
+	if err1 != nil || err2 != nil {
+		// Fallback to patch if parsing fails (e.g. "latest")
+		return IncrementPatch
+	}
+
+	if nMaj > oMaj {
+		return IncrementMajor
+	}
+	if nMaj == oMaj && nMin > oMin {
+		return IncrementMinor
+	}
+	return IncrementPatch
+}
+
+// generateNewVersion returns the next calver tag for incType in the
+// current week, read from Clock in the release timezone.
+func generateNewVersion(incType IncrementType) (string, error) {
+	loc, err := releaseLocation()
+	if err != nil {
+		return "", err
+	}
+
+	namespace, err := tagNamespace()
+	if err != nil {
+		return "", err
+	}
+
+	// Get existing tags
+	tags, err := currentRepo().tags(namespace + "v*")
+	if err != nil {
+		return "", err
+	}
+	return nextVersion(namespace+calverPrefix(Clock.Now().In(loc)), tagNames(tags), incType), nil
+}
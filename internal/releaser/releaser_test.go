@@ -0,0 +1,5088 @@
+package releaser
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"filippo.io/age"
+	"github.com/Masterminds/semver/v3"
+	"github.com/velann21/todo-releaser/internal/agent"
+	"github.com/velann21/todo-releaser/internal/blobstore"
+	"github.com/velann21/todo-releaser/internal/image"
+	"github.com/velann21/todo-releaser/internal/manifest"
+	"github.com/velann21/todo-releaser/internal/pki"
+	"github.com/velann21/todo-releaser/internal/provenance"
+	"github.com/velann21/todo-releaser/internal/ratelimit"
+	"github.com/velann21/todo-releaser/internal/secrets"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		input           string
+		maj, min, patch int
+		wantErr         bool
+	}{
+		{"v1.2.3", 1, 2, 3, false},
+		{"1.2.3", 1, 2, 3, false},
+		{"v0.0.1", 0, 0, 1, false},
+		{"latest", 0, 0, 0, true},
+		{"v1.2", 0, 0, 0, true},
+		{"1.27.3-alpine", 1, 27, 3, false},
+		{"v2.0.0-rc.1+build.5", 2, 0, 0, false},
+		{"v1.2.3.4", 1, 2, 3, false},
+		{"v1.-2.3", 0, 0, 0, true},
+		{"v+1.2.3", 0, 0, 0, true},
+		{"v1.2.", 0, 0, 0, true},
+		{"v1.2.9999999999", 0, 0, 0, true},
+		{"v1.2.٣", 0, 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		maj, min, patch, err := parseVersion(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseVersion(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if maj != tt.maj || min != tt.min || patch != tt.patch {
+			t.Errorf("parseVersion(%q) = %d.%d.%d, want %d.%d.%d", tt.input, maj, min, patch, tt.maj, tt.min, tt.patch)
+		}
+	}
+}
+
+func TestDetermineIncrementType(t *testing.T) {
+	tests := []struct {
+		oldVer, newVer string
+		want           IncrementType
+	}{
+		{"v1.0.0", "v1.0.1", IncrementPatch},
+		{"v1.0.0", "v1.1.0", IncrementMinor},
+		{"v1.0.0", "v2.0.0", IncrementMajor},
+		{"v1.0.0", "v1.0.0", IncrementPatch}, // No change, but shouldn't happen in loop logic
+		{"latest", "v1.0.0", IncrementPatch}, // Fallback
+		{"v1.0.0", "latest", IncrementPatch}, // Fallback
+		{"1.26.3-alpine", "2.0.0-alpine", IncrementMajor},
+		{"1.26.3-alpine", "1.27.0-alpine", IncrementMinor},
+		{"v1.9.0", "v1.-10.0", IncrementPatch},
+		{"v2.0.0", "v1.5.0", IncrementPatch},
+	}
+
+	for _, tt := range tests {
+		got := determineIncrementType(tt.oldVer, tt.newVer)
+		if got != tt.want {
+			t.Errorf("determineIncrementType(%q, %q) = %v, want %v", tt.oldVer, tt.newVer, got, tt.want)
+		}
+	}
+}
+
+// versionPattern is what parseVersion accepts, stated apart from it: up to
+// nine ASCII digits for each of major, minor and patch, any components
+// after the patch, and a pre-release or build suffix from the first - or +.
+var versionPattern = regexp.MustCompile(`(?s)^v?([0-9]{1,9})\.([0-9]{1,9})\.([0-9]{1,9})(?:\.[^-+]*)?(?:[-+].*)?$`)
+
+// wantVersion is the version versionPattern reads v as.
+func wantVersion(v string) (major, minor, patch int, ok bool) {
+	m := versionPattern.FindStringSubmatch(v)
+	if m == nil {
+		return 0, 0, 0, false
+	}
+	major, _ = strconv.Atoi(m[1])
+	minor, _ = strconv.Atoi(m[2])
+	patch, _ = strconv.Atoi(m[3])
+	return major, minor, patch, true
+}
+
+func FuzzParseVersion(f *testing.F) {
+	for _, seed := range []string{"v1.2.3", "1.27.3-alpine", "v1.2", "latest", "v1.-2.3", "v+1.2.3", "v1.2.3.4", "v01.2.3", "v1.2.9999999999", "v1.2.999999999"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, v string) {
+		major, minor, patch, err := parseVersion(v)
+		wantMajor, wantMinor, wantPatch, ok := wantVersion(v)
+		if (err == nil) != ok || major != wantMajor || minor != wantMinor || patch != wantPatch {
+			t.Errorf("parseVersion(%q) = %d.%d.%d, %v, want %d.%d.%d, ok %v", v, major, minor, patch, err, wantMajor, wantMinor, wantPatch, ok)
+		}
+	})
+}
+
+func FuzzDetermineIncrementType(f *testing.F) {
+	f.Add("v1.0.0", "v1.0.1")
+	f.Add("1.26.3-alpine", "2.0.0-alpine")
+	f.Add("latest", "v1.0.0")
+	f.Add("v1.9.0", "v1.-10.0")
+	f.Fuzz(func(t *testing.T, from, to string) {
+		got := determineIncrementType(from, to)
+		if got != IncrementPatch && got != IncrementMinor && got != IncrementMajor {
+			t.Fatalf("determineIncrementType(%q, %q) = %v", from, to, got)
+		}
+		oMaj, oMin, _, ok1 := wantVersion(from)
+		nMaj, nMin, _, ok2 := wantVersion(to)
+		var want IncrementType
+		switch {
+		case !ok1 || !ok2:
+			want = IncrementPatch
+		case nMaj > oMaj:
+			want = IncrementMajor
+		case nMaj == oMaj && nMin > oMin:
+			want = IncrementMinor
+		default:
+			// Patches and downgrades.
+			want = IncrementPatch
+		}
+		if got != want {
+			t.Errorf("determineIncrementType(%q, %q) = %v, want %v", from, to, got, want)
+		}
+	})
+}
+
+func FuzzNextVersion(f *testing.F) {
+	for _, seed := range []string{"v202452.1.3", "v202452.1.3-rc", "v202452.-1.0", "v202452.+2.0", "v202452.1.2.3", "v202452.999999999.0", "v202452.1.9999999999", "v2024521.0.0", "v202452.01.10"} {
+		f.Add(seed, uint8(IncrementPatch))
+		f.Add(seed, uint8(IncrementMinor))
+	}
+	// Releases of the week are tagged v202452.<minor>.<patch>, each of up
+	// to nine ASCII digits, with nothing after.
+	released := regexp.MustCompile(`^v202452\.([0-9]{1,9})\.([0-9]{1,9})$`)
+	f.Fuzz(func(t *testing.T, tag string, inc uint8) {
+		const prefix = "v202452"
+		tags := []string{"v202451.7.0", "v202452.1.2", tag}
+		next := nextVersion(prefix, tags, IncrementType(inc%3))
+		// The next release is in the week, a release tag, and after every
+		// release of the week. Bumping a nine-digit 999999999 makes it ten.
+		if !releaseTag.MatchString(next) || !strings.HasPrefix(next, prefix+".") || slices.Contains(tags, next) {
+			t.Fatalf("nextVersion(%q) = %q", tags, next)
+		}
+		parts := strings.Split(next, ".")
+		minor, _ := strconv.Atoi(parts[1])
+		patch, _ := strconv.Atoi(parts[2])
+		for _, tag := range tags {
+			r := released.FindStringSubmatch(tag)
+			if r == nil {
+				continue
+			}
+			m, _ := strconv.Atoi(r[1])
+			p, _ := strconv.Atoi(r[2])
+			if minor < m || minor == m && patch <= p {
+				t.Errorf("nextVersion(%q) = %q, not after %s", tags, next, tag)
+			}
+		}
+	})
+}
+
+func TestNextVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		tags []string
+		inc  IncrementType
+		want string
+	}{
+		{"first of the week", []string{"v202451.7.0"}, IncrementPatch, "v202452.0.0"},
+		{"patch", []string{"v202452.1.2"}, IncrementPatch, "v202452.1.3"},
+		{"minor", []string{"v202452.1.2"}, IncrementMinor, "v202452.2.0"},
+		{"extra component", []string{"v202452.1.0", "v202452.2.0.1"}, IncrementMinor, "v202452.2.0"},
+		{"pre-release", []string{"v202452.1.0", "v202452.2.0-rc"}, IncrementMinor, "v202452.2.0"},
+		{"signed number", []string{"v202452.1.0", "v202452.1.+7"}, IncrementPatch, "v202452.1.1"},
+		{"ten digits", []string{"v202452.1.0", "v202452.1.9999999999"}, IncrementPatch, "v202452.1.1"},
+	}
+	for _, tt := range tests {
+		if got := nextVersion("v202452", tt.tags, tt.inc); got != tt.want {
+			t.Errorf("%s: nextVersion(%q) = %q, want %q", tt.name, tt.tags, got, tt.want)
+		}
+	}
+}
+
+func TestCalverRollover(t *testing.T) {
+	// Days from 1990 to 2090, years with an ISO week 53 among them.
+	day := func(n uint16) time.Time {
+		return time.Date(1990, 1, 1, 12, 0, 0, 0, time.UTC).AddDate(0, 0, int(n)%36500)
+	}
+	properties := []struct {
+		name string
+		f    any
+	}{
+		{"the prefix never goes backwards", func(n uint16) bool {
+			return calverPrefix(day(n)) <= calverPrefix(day(n).AddDate(0, 0, 1))
+		}},
+		{"the prefix changes on Mondays only", func(n uint16) bool {
+			t := day(n)
+			return (calverPrefix(t) != calverPrefix(t.AddDate(0, 0, -1))) == (t.Weekday() == time.Monday)
+		}},
+		{"the prefix is a week of a year", func(n uint16) bool {
+			year, week := day(n).ISOWeek()
+			return calverPrefix(day(n)) == fmt.Sprintf("v%d%02d", year, week) && week >= 1 && week <= 53 &&
+				// Years with a week 53 start or end on a Thursday.
+				(week < 53 || time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC).Weekday() == time.Thursday ||
+					time.Date(year, 12, 31, 0, 0, 0, 0, time.UTC).Weekday() == time.Thursday)
+		}},
+		{"a new week starts at .0.0 or .1.0", func(n uint16, minor bool) bool {
+			t := day(n)
+			for t.Weekday() != time.Monday {
+				t = t.AddDate(0, 0, 1)
+			}
+			last := calverPrefix(t.AddDate(0, 0, -1)) + ".4.2"
+			inc, want := IncrementPatch, ".0.0"
+			if minor {
+				inc, want = IncrementMinor, ".1.0"
+			}
+			return nextVersion(calverPrefix(t), []string{last}, inc) == calverPrefix(t)+want
+		}},
+	}
+	for _, p := range properties {
+		if err := quick.Check(p.f, &quick.Config{MaxCount: 2000}); err != nil {
+			t.Errorf("%s: %v", p.name, err)
+		}
+	}
+}
+
+func TestStatusHealthy(t *testing.T) {
+	start := time.Date(2025, 1, 6, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		record  func(s *Status)
+		at      time.Duration
+		healthy bool
+	}{
+		{"fresh process", func(s *Status) {}, time.Second, true},
+		{"never succeeded", func(s *Status) {}, 3*PollingInterval + time.Second, false},
+		{"recent success", func(s *Status) {
+			s.Record(start.Add(5*PollingInterval), false, nil)
+		}, 6 * PollingInterval, true},
+		{"only failures since last success", func(s *Status) {
+			s.Record(start.Add(PollingInterval), true, nil)
+			s.Record(start.Add(2*PollingInterval), false, errors.New("docker hub down"))
+			s.Record(start.Add(5*PollingInterval), false, errors.New("docker hub down"))
+		}, 5 * PollingInterval, false},
+		{"idle since a success", func(s *Status) {
+			s.Record(start.Add(PollingInterval), false, nil)
+			s.Idle(start.Add(5 * PollingInterval))
+		}, 6 * PollingInterval, true},
+		{"idle since a failure", func(s *Status) {
+			s.Record(start.Add(PollingInterval), false, nil)
+			s.Record(start.Add(2*PollingInterval), false, errors.New("docker hub down"))
+			s.Idle(start.Add(5 * PollingInterval))
+		}, 6 * PollingInterval, false},
+	}
+
+	for _, tt := range tests {
+		s := NewStatus(start)
+		tt.record(s)
+		if got := s.Healthy(start.Add(tt.at)); got != tt.healthy {
+			t.Errorf("%s: Healthy() = %v, want %v", tt.name, got, tt.healthy)
+		}
+	}
+}
+
+func TestDeployReleaseWebhook(t *testing.T) {
+	m := &manifest.Manifest{
+		ReleaseVersion: "v202502.0.1",
+		Services:       []manifest.Service{{Name: "todo-backend", Image: "velann21/todo-backend", Version: "v1.0.1"}},
+	}
+	tests := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{"accepted", http.StatusAccepted, false},
+		{"rejected", http.StatusInternalServerError, true},
+	}
+
+	for _, tt := range tests {
+		var got manifest.Manifest
+		var key string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+				t.Errorf("%s: decoding webhook body: %v", tt.name, err)
+			}
+			key = r.Header.Get("Idempotency-Key")
+			w.WriteHeader(tt.status)
+		}))
+		t.Setenv("RELEASER_DEPLOY_WEBHOOK", srv.URL)
+
+		err := deployRelease(context.Background(), m)
+		srv.Close()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: deployRelease() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if got.ReleaseVersion != m.ReleaseVersion {
+			t.Errorf("%s: webhook got release %q, want %q", tt.name, got.ReleaseVersion, m.ReleaseVersion)
+		}
+		if want := agent.IdempotencyKey(m); key != want {
+			t.Errorf("%s: Idempotency-Key = %q, want %q", tt.name, key, want)
+		}
+	}
+}
+
+func TestBuildTag(t *testing.T) {
+	tests := []struct {
+		committed time.Time
+		sha       string
+		want      string
+	}{
+		{time.Date(2025, 1, 6, 12, 0, 0, 0, time.UTC), "abc1234", "v202502-abc1234"},
+		// ISO week 1 of 2025 starts on Monday 30 December 2024.
+		{time.Date(2024, 12, 30, 9, 0, 0, 0, time.UTC), "def5678", "v202501-def5678"},
+		// Sunday night in New York is already Monday in UTC.
+		{time.Date(2025, 1, 5, 20, 0, 0, 0, time.FixedZone("EST", -5*3600)), "0a1b2c3", "v202502-0a1b2c3"},
+	}
+
+	for _, tt := range tests {
+		if got := buildTag(tt.committed, tt.sha); got != tt.want {
+			t.Errorf("buildTag(%v, %q) = %q, want %q", tt.committed, tt.sha, got, tt.want)
+		}
+	}
+}
+
+func TestHandleFreeze(t *testing.T) {
+	t.Setenv("RELEASER_STATE_DIR", t.TempDir())
+	handler := handleFreeze("s3cret")
+
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		body   string
+		status int
+		frozen bool
+	}{
+		{"status without token", http.MethodGet, "", "", http.StatusOK, false},
+		{"freeze without token", http.MethodPut, "", `{"reason": "quarter end"}`, http.StatusUnauthorized, false},
+		{"freeze without reason", http.MethodPut, "s3cret", `{}`, http.StatusBadRequest, false},
+		{"freeze", http.MethodPut, "s3cret", `{"reason": "quarter end", "for": "24h"}`, http.StatusOK, true},
+		{"lift with wrong token", http.MethodDelete, "guess", "", http.StatusUnauthorized, true},
+		{"lift", http.MethodDelete, "s3cret", "", http.StatusOK, false},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/freeze", strings.NewReader(tt.body))
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.status)
+		}
+		f, err := CurrentFreeze(time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (f != nil) != tt.frozen {
+			t.Errorf("%s: frozen = %v, want %v", tt.name, f != nil, tt.frozen)
+		}
+	}
+}
+
+func TestHandleEnroll(t *testing.T) {
+	t.Setenv("RELEASER_STATE_DIR", t.TempDir())
+	ca, err := pki.LoadOrCreateCA(PKIDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, csr, err := pki.NewCSR("web-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := CreateEnrollToken(time.Now(), time.Hour, "web-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := handleEnroll(ca)
+
+	tests := []struct {
+		name   string
+		agent  string
+		csr    string
+		status int
+	}{
+		{"another agent's name", "db-1", string(csr), http.StatusUnauthorized},
+		{"bad CSR", "web-1", "not a CSR", http.StatusBadRequest},
+		{"enroll", "web-1", string(csr), http.StatusOK},
+		{"token used up", "web-1", string(csr), http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		body, err := json.Marshal(enrollRequest{Token: token, Name: tt.agent, CSR: tt.csr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, "/enroll", bytes.NewReader(body)))
+		if rec.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, rec.Code, tt.status, rec.Body)
+		}
+	}
+}
+
+func TestFreezeActive(t *testing.T) {
+	now := time.Date(2025, 1, 6, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		freeze *Freeze
+		want   bool
+	}{
+		{"none", nil, false},
+		{"until lifted", &Freeze{Reason: "incident"}, true},
+		{"not yet expired", &Freeze{Reason: "incident", Until: now.Add(time.Hour)}, true},
+		{"expired", &Freeze{Reason: "incident", Until: now.Add(-time.Hour)}, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.freeze.Active(now); got != tt.want {
+			t.Errorf("%s: Active() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWriteActionOutputs(t *testing.T) {
+	dir := t.TempDir()
+	output, summary := filepath.Join(dir, "output"), filepath.Join(dir, "summary")
+	t.Setenv("GITHUB_OUTPUT", output)
+	t.Setenv("GITHUB_STEP_SUMMARY", summary)
+
+	err := writeActionOutputs(&Result{
+		Version: "v202502.1.0",
+		Changes: []Change{{Service: "todo-backend", From: "v1.0.0", To: "v1.1.0"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		file string
+		want string
+	}{
+		{output, "released=true\n"},
+		{output, "version=v202502.1.0\n"},
+		{output, `changes=[{"service":"todo-backend","from":"v1.0.0","to":"v1.1.0"}]`},
+		{summary, "### Release v202502.1.0"},
+		{summary, "| todo-backend | `v1.0.0` | `v1.1.0` |"},
+	}
+	for _, tt := range tests {
+		data, err := os.ReadFile(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), tt.want) {
+			t.Errorf("%s = %q, missing %q", filepath.Base(tt.file), data, tt.want)
+		}
+	}
+}
+
+func TestReleaseNotification(t *testing.T) {
+	m := &manifest.Manifest{Services: []manifest.Service{
+		{Name: "todo-frontend", Image: "singaravelan21/todo-frontend", Version: "v1.2.0"},
+		{Name: "todo-backend", Image: "singaravelan21/todo-backend", Version: "v1.1.0",
+			Changelog: "https://github.com/velann21/todo-backend/releases/tag/{version}"},
+	}}
+	result := &Result{
+		Version: "v202502.1.0",
+		Changes: []Change{{Service: "todo-backend", From: "v1.0.0", To: "v1.1.0",
+			Revision: "0a1b2c3d4e5f", CommitURL: "https://github.com/velann21/todo-backend/commit/0a1b2c3d4e5f",
+			Security: []string{"CVE-2025-0001"}},
+			{Service: "todo-backend", Config: "config/todo-backend.env", From: "sha256:0a1b2c3d4e5f", To: "sha256:f5e4d3c2b1a0"}},
+		Bypassed: &Freeze{Reason: "end of quarter"},
+		Failed:   []FailureGroup{{Failure: FailureRateLimited, Registry: "docker.io", Services: []string{"todo-worker", "todo-cron", "todo-mail"}}},
+	}
+	repo := remoteWebURL("git@github.com:velann21/todo-releaser.git")
+
+	tests := []struct {
+		name     string
+		locale   string
+		previous string
+		want     string
+		contains bool
+	}{
+		{"changed service", "", "v202501.0.3", "todo-backend: `v1.0.0` → `v1.1.0`", true},
+		{"changelog template", "", "v202501.0.3", "<https://github.com/velann21/todo-backend/releases/tag/v1.1.0|changelog>", true},
+		{"config change", "", "v202501.0.3", "todo-backend config config/todo-backend.env: `sha256:0a1b2c3d4e5f` → `sha256:f5e4d3c2b1a0`\n", true},
+		{"japanese config change", "ja", "v202501.0.3", "todo-backend 設定 config/todo-backend.env: `sha256:0a1b2c3d4e5f` → `sha256:f5e4d3c2b1a0`\n", true},
+		{"source commit", "", "v202501.0.3", "<https://github.com/velann21/todo-backend/commit/0a1b2c3d4e5f|0a1b2c3>", true},
+		{"unchanged service left out", "", "v202501.0.3", "todo-frontend", false},
+		{"compare link", "", "v202501.0.3", "<https://github.com/velann21/todo-releaser/compare/v202501.0.3...v202502.1.0|Diff to v202501.0.3>", true},
+		{"no compare link for first release", "", "", "/compare/", false},
+		{"japanese", "ja", "v202501.0.3", "*リリース <https://github.com/velann21/todo-releaser/releases/tag/v202502.1.0|v202502.1.0>*", true},
+		{"japanese changelog", "ja", "v202501.0.3", "<https://github.com/velann21/todo-backend/releases/tag/v1.1.0|変更履歴>", true},
+		{"regional locale", "ja_JP", "v202501.0.3", "|v202501.0.3 との差分>", true},
+		{"security update", "", "v202501.0.3", ":lock: security update (CVE-2025-0001)", true},
+		{"freeze bypassed", "", "v202501.0.3", "released through the freeze: end of quarter", true},
+		{"japanese freeze bypassed", "ja", "v202501.0.3", "セキュリティ更新をリリースしました：end of quarter", true},
+		{"failed checks", "", "v202501.0.3", "• 3 services skipped: rate-limited by docker.io (todo-worker, todo-cron, todo-mail)", true},
+		{"japanese failed checks", "ja", "v202501.0.3", "• 3 件：docker.io のレート制限を受けました（todo-worker, todo-cron, todo-mail）", true},
+	}
+
+	for _, tt := range tests {
+		d := newNotesData(m, result, repo, tt.previous, time.Time{})
+		got, err := renderNotification(NotifyChannel{Locale: tt.locale}, NotifyRelease, d)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if strings.Contains(got, tt.want) != tt.contains {
+			t.Errorf("%s: notification = %q, contains %q = %v, want %v", tt.name, got, tt.want, !tt.contains, tt.contains)
+		}
+	}
+	if _, err := renderNotification(NotifyChannel{Locale: "de"}, NotifyRelease, NotesData{}); err == nil {
+		t.Error("expected an error for a locale without templates")
+	}
+}
+
+func TestNotifyChannels(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	got := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Text string }
+		json.NewDecoder(r.Body).Decode(&body)
+		got[r.URL.Path] = body.Text
+	}))
+	defer srv.Close()
+	t.Setenv("ENGINEERING_WEBHOOK", srv.URL+"/engineering")
+	t.Setenv("OPERATIONS_WEBHOOK", srv.URL+"/operations")
+	conf := `{"channels": [
+	  {"name": "engineering", "webhook_env": "ENGINEERING_WEBHOOK"},
+	  {"name": "operations", "locale": "ja-JP", "webhook_env": "OPERATIONS_WEBHOOK"}
+	]}`
+	if err := os.WriteFile(NotifyFile, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &manifest.Manifest{ReleaseVersion: "v202502.1.1"}
+	data := RollbackData{Version: "v202502.1.0", Previous: "v202501.0.3", Tag: "v202502.1.1", Reason: "health check failed"}
+	if err := notify(context.Background(), m, NotifyRollback, data); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		channel string
+		want    string
+	}{
+		{"/engineering", "*Rolled back v202502.1.0* to the versions of v202501.0.3 as v202502.1.1: health check failed"},
+		{"/operations", "*v202502.1.0 をロールバックしました*"},
+	}
+	for _, tt := range tests {
+		if !strings.Contains(got[tt.channel], tt.want) {
+			t.Errorf("%s got %q, want it to contain %q", tt.channel, got[tt.channel], tt.want)
+		}
+	}
+
+	if err := os.WriteFile(NotifyFile, []byte(`{"channels": [{"name": "sales", "locale": "fr"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := notify(context.Background(), m, NotifyRollback, data); err == nil {
+		t.Error("expected an error for a channel without templates")
+	}
+}
+
+func TestWatchdogWatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		status func(poll int) int
+		breach bool
+	}{
+		{"healthy", func(int) int { return http.StatusOK }, false},
+		{"down", func(int) int { return http.StatusBadGateway }, true},
+		{"flapping below the threshold", func(poll int) int {
+			if poll%3 == 0 {
+				return http.StatusOK
+			}
+			return http.StatusServiceUnavailable
+		}, false},
+	}
+
+	for _, tt := range tests {
+		poll := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			poll++
+			w.WriteHeader(tt.status(poll))
+		}))
+		w := &Watchdog{
+			Bake:              50 * time.Millisecond,
+			Interval:          time.Millisecond,
+			HealthURL:         srv.URL,
+			MaxHealthFailures: 3,
+		}
+		err := w.Watch(context.Background())
+		srv.Close()
+		if (err != nil) != tt.breach {
+			t.Errorf("%s: Watch() = %v, want breach %v", tt.name, err, tt.breach)
+		}
+	}
+}
+
+func TestRenderNotes(t *testing.T) {
+	m := &manifest.Manifest{Services: []manifest.Service{
+		{Name: "todo-frontend", Image: "singaravelan21/todo-frontend", Version: "v1.2.0"},
+		{Name: "todo-backend", Image: "singaravelan21/todo-backend", Version: "v1.1.0"},
+	}}
+	result := &Result{
+		Version: "v202502.1.0",
+		Changes: []Change{{Service: "todo-backend", From: "v1.0.0", To: "v1.1.0"}},
+	}
+	d := newNotesData(m, result, "https://github.com/velann21/todo-releaser", "v202501.0.3",
+		time.Date(2025, 1, 6, 12, 0, 0, 0, time.UTC))
+
+	dir := t.TempDir()
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{"engineering",
+			"{{range .Changes}}- {{.Service}} {{.From}} -> {{.To}} ({{.Changelog}})\n{{end}}{{.CompareURL}}",
+			"- todo-backend v1.0.0 -> v1.1.0 (https://hub.docker.com/r/singaravelan21/todo-backend/tags?name=v1.1.0)\n" +
+				"https://github.com/velann21/todo-releaser/compare/v202501.0.3...v202502.1.0"},
+		{"customers",
+			`Released {{.Date.Format "2 January 2006"}}: {{len .Changes}} of {{len .Services}} services updated.`,
+			"Released 6 January 2025: 1 of 2 services updated."},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name+".md.tmpl")
+		if err := os.WriteFile(path, []byte(tt.template), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := renderNotes(path, d)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: renderNotes() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHandleManifest(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	data := []byte(`{"release_version": "v202502.1.0", "services": []}`)
+	if err := os.WriteFile(ManifestFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	first := httptest.NewRecorder()
+	handleManifest(first, httptest.NewRequest(http.MethodGet, "/manifest", nil))
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || first.Body.String() != string(data) || etag == "" {
+		t.Fatalf("GET /manifest = %d %q with ETag %q", first.Code, first.Body, etag)
+	}
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		status      int
+	}{
+		{"no validator", "", http.StatusOK},
+		{"current", etag, http.StatusNotModified},
+		{"weak current", "W/" + etag, http.StatusNotModified},
+		{"one of several", `"stale", ` + etag, http.StatusNotModified},
+		{"stale", `"stale"`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/manifest", nil)
+		if tt.ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", tt.ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		handleManifest(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.status)
+		}
+	}
+}
+
+func TestPublicStatus(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	data := []byte(`{"release_version": "v202510.4.0", "services": [
+		{"name": "todo-backend", "image": "singaravelan21/todo-backend", "version": "v1.1.1",
+		 "runtime": {"env": {"DB_PASSWORD": "hunter2"}}, "last_bump": {"at": "2025-10-06T12:00:00Z", "from": "v1.1.0", "run": "run1"}},
+		{"name": "nginx", "image": "nginx@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"}
+	]}`)
+	if err := os.WriteFile(ManifestFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"release":"v202510.4.0","services":[{"name":"todo-backend","version":"v1.1.1"},{"name":"nginx","version":"sha256:0123456789ab"}]}`
+
+	tests := []struct {
+		name   string
+		public string
+		status int
+		body   string
+	}{
+		{"opted in", "true", http.StatusOK, want},
+		{"not opted in", "", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Setenv("RELEASER_PUBLIC_STATUS", tt.public)
+		mux := newStatusMux(NewStatus(time.Now()), nil)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/public/status.json", nil))
+		if rec.Code != tt.status || tt.body != "" && rec.Body.String() != tt.body {
+			t.Errorf("%s: GET /public/status.json = %d %q, want %d %q", tt.name, rec.Code, rec.Body, tt.status, tt.body)
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+		if rec.Header().Get("Access-Control-Allow-Origin") != "*" || !strings.HasPrefix(rec.Header().Get("Cache-Control"), "public") {
+			t.Errorf("%s: headers %v", tt.name, rec.Header())
+		}
+		req := httptest.NewRequest(http.MethodGet, "/public/status.json", nil)
+		req.Header.Set("If-None-Match", rec.Header().Get("ETag"))
+		rec = httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotModified {
+			t.Errorf("%s: revalidation returned %d", tt.name, rec.Code)
+		}
+	}
+}
+
+func TestEnvironmentStatus(t *testing.T) {
+	releases := []string{"v202501.0.0", "v202501.1.0", "v202502.0.0", "v202502.0.1", "v202502.1.0"}
+	host := func(env, deployed, state string) AgentStatus {
+		return AgentStatus{Report: agent.Report{Environment: env, Version: "v202502.1.0", State: state}, Deployed: deployed}
+	}
+
+	tests := []struct {
+		name     string
+		reports  map[string]AgentStatus
+		behind   map[string]int
+		warnings int
+	}{
+		{"up to date", map[string]AgentStatus{
+			"web-1": host("production", "v202502.1.0", agent.StateDeployed),
+		}, map[string]int{"production": 0}, 0},
+		{"within the limit", map[string]AgentStatus{
+			"web-1": host("staging", "v202502.0.0", agent.StateDeployed),
+		}, map[string]int{"staging": 2}, 0},
+		{"furthest-behind host counts", map[string]AgentStatus{
+			"web-1": host("production", "v202502.1.0", agent.StateDeployed),
+			"web-2": host("production", "v202501.0.0", agent.StateFailed),
+		}, map[string]int{"production": 4}, 1},
+		{"host without environment", map[string]AgentStatus{
+			"todo-server": host("", "v202501.1.0", agent.StateDeploying),
+		}, map[string]int{"todo-server": 3}, 1},
+		{"never deployed", map[string]AgentStatus{
+			"web-1": host("staging", "", agent.StateFailed),
+		}, map[string]int{"staging": -1}, 0},
+	}
+	for _, tt := range tests {
+		envs, warnings := environmentStatus(tt.reports, releases, "v202502.1.0", 2)
+		got := map[string]int{}
+		for _, env := range envs {
+			got[env.Name] = env.Behind
+		}
+		for name, want := range tt.behind {
+			if got[name] != want {
+				t.Errorf("%s: %s behind = %d, want %d", tt.name, name, got[name], want)
+			}
+		}
+		if len(warnings) != tt.warnings {
+			t.Errorf("%s: warnings = %q, want %d", tt.name, warnings, tt.warnings)
+		}
+	}
+}
+
+func TestNextPatch(t *testing.T) {
+	tags := []string{"v202502.0.0", "v202502.1.0", "v202502.1.1", "v202503.0.0", "todo/v202502.1.1"}
+	tests := []struct {
+		version string
+		want    string
+		wantErr bool
+	}{
+		{"v202503.0.0", "v202503.0.1", false},
+		{"v202502.0.0", "v202502.0.1", false},
+		{"v202502.1.0", "v202502.1.2", false},
+		{"todo/v202502.1.0", "todo/v202502.1.2", false},
+		{"billing/v202502.1.0", "billing/v202502.1.1", false},
+		{"v202502-abc1234", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		got, err := nextPatch(tt.version, tags)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("nextPatch(%q) = %q, %v; want %q, error %v", tt.version, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestBranchPolicy(t *testing.T) {
+	c := &BranchesConfig{Branches: map[string]string{
+		"master":          UpdateAll,
+		"release/*":       UpdatePatch,
+		"release/2025-06": UpdateAll,
+	}}
+	tests := []struct {
+		branch string
+		want   string
+	}{
+		{"master", UpdateAll},
+		{"release/2025-01", UpdatePatch},
+		{"release/2025-06", UpdateAll},
+		{"feature/x", UpdateAll},
+	}
+	for _, tt := range tests {
+		if got := c.Policy(tt.branch); got != tt.want {
+			t.Errorf("Policy(%q) = %q, want %q", tt.branch, got, tt.want)
+		}
+	}
+}
+
+func TestNewestTag(t *testing.T) {
+	tags := []string{"latest", "v1.4.2", "v1.4.10", "v1.5.0", "v2.0.0", "v1.4.11-rc.1"}
+	tests := []struct {
+		name    string
+		current string
+		want    string
+	}{
+		{"any update", "", "v2.0.0"},
+		{"patches of 1.4", "v1.4.2", "v1.4.10"},
+		{"patches of 1.5", "1.5.0", "v1.5.0"},
+		{"no patches of 1.3", "v1.3.0", ""},
+	}
+	for _, tt := range tests {
+		var c *semver.Constraints
+		if tt.current != "" {
+			c = patchConstraint(tt.current)
+		}
+		if got := newestTag(tags, c); got != tt.want {
+			t.Errorf("%s: newestTag = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if patchConstraint("v202502-abc1234") != nil {
+		t.Error("patchConstraint of a build tag should be nil")
+	}
+}
+
+func TestRegistryLabels(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer t0ken" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/acme/api/manifests/v1.2.0":
+			w.Write([]byte(`{"manifests": [
+				{"digest": "sha256:arm", "platform": {"os": "linux", "architecture": "arm64"}},
+				{"digest": "sha256:amd", "platform": {"os": "linux", "architecture": "amd64"}}]}`))
+		case "/v2/acme/api/manifests/sha256:amd", "/v2/acme/api/manifests/v1.1.0":
+			w.Write([]byte(`{"config": {"digest": "sha256:cfg", "size": 1000},
+				"layers": [{"size": 30000000}, {"size": 2000000}]}`))
+		case "/v2/acme/api/blobs/sha256:cfg":
+			w.Write([]byte(`{"config": {"Labels": {"org.opencontainers.image.revision": "abc123"}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	c := &registryClient{base: srv.URL, repo: "acme/api", token: "t0ken", http: srv.Client()}
+
+	tests := []struct {
+		tag     string
+		want    string
+		wantErr bool
+	}{
+		{"v1.2.0", "abc123", false},
+		{"v1.1.0", "abc123", false},
+		{"v0.9.0", "", true},
+	}
+	for _, tt := range tests {
+		labels, err := c.labels(context.Background(), tt.tag)
+		if (err != nil) != tt.wantErr || labels[LabelRevision] != tt.want {
+			t.Errorf("labels(%s) = %v, %v; want revision %q, error %v", tt.tag, labels, err, tt.want, tt.wantErr)
+		}
+	}
+
+	if size, err := c.size(context.Background(), "v1.2.0"); err != nil || size != 32001000 {
+		t.Errorf("size(v1.2.0) = %d, %v; want 32001000", size, err)
+	}
+
+	sources := map[string]string{
+		"https://github.com/acme/api":      "https://github.com/acme/api",
+		"https://github.com/acme/api.git":  "https://github.com/acme/api",
+		"git@gitlab.com:acme/api.git":      "https://gitlab.com/acme/api",
+		"https://user@github.com/acme/api": "https://github.com/acme/api",
+		"acme/api":                         "",
+	}
+	for source, want := range sources {
+		if got := sourceWebURL(source); got != want {
+			t.Errorf("sourceWebURL(%q) = %q, want %q", source, got, want)
+		}
+	}
+}
+
+func TestRegistryAuthorize(t *testing.T) {
+	c := &registryClient{base: "https://registry.example.com", repo: "acme/api", token: "t0ken"}
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://registry.example.com/v2/acme/api/tags/list?n=1000", "Bearer t0ken"},
+		{"https://registry.example.com/v2/acme/api/tags/list?last=b", "Bearer t0ken"},
+		{"https://elsewhere.example.com/v2/acme/api/tags/list?last=b", ""},
+		{"http://registry.example.com/v2/acme/api/tags/list?last=b", ""},
+		{"https://registry.example.com:8443/upload/1", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+		c.authorize(req)
+		if got := req.Header.Get("Authorization"); got != tt.want {
+			t.Errorf("authorize(%s) sent %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+func TestGenerateNewVersion(t *testing.T) {
+	if _, err := time.LoadLocation("Europe/Berlin"); err != nil {
+		t.Skip("no timezone database:", err)
+	}
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if _, err := gitOutput("init", "-q"); err != nil {
+		t.Skip("git unavailable:", err)
+	}
+	for _, args := range [][]string{
+		{"-c", "user.name=t", "-c", "user.email=t@example.com", "commit", "-q", "--allow-empty", "-m", "init"},
+		{"tag", "v202501.0.0"},
+		{"tag", "v202501.0.1"},
+		{"tag", "v202501-abc1234"},
+		{"tag", "todo/v202501.2.0"},
+		{"tag", "billing.eu/v202501.0.4"},
+	} {
+		if _, err := gitOutput(args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(c ClockSource) { Clock = c }(Clock)
+
+	tests := []struct {
+		name      string
+		now       time.Time
+		timezone  string
+		namespace string
+		inc       IncrementType
+		want      string
+	}{
+		{"patch in a tagged week", time.Date(2025, 1, 2, 12, 0, 0, 0, time.UTC), "", "", IncrementPatch, "v202501.0.2"},
+		{"minor in a tagged week", time.Date(2025, 1, 2, 12, 0, 0, 0, time.UTC), "", "", IncrementMinor, "v202501.1.0"},
+		// ISO week 1 of 2025 starts on Monday 30 December 2024.
+		{"December in next year's week 1", time.Date(2024, 12, 30, 9, 0, 0, 0, time.UTC), "", "", IncrementPatch, "v202501.0.2"},
+		// 1 January 2021 is a Friday in week 53 of 2020.
+		{"January in last year's week 53", time.Date(2021, 1, 1, 9, 0, 0, 0, time.UTC), "", "", IncrementPatch, "v202053.0.0"},
+		{"Sunday night in UTC", time.Date(2024, 12, 29, 23, 30, 0, 0, time.UTC), "", "", IncrementPatch, "v202452.0.0"},
+		{"already Monday in Berlin", time.Date(2024, 12, 29, 23, 30, 0, 0, time.UTC), "Europe/Berlin", "", IncrementPatch, "v202501.0.2"},
+		{"namespace of its own", time.Date(2025, 1, 2, 12, 0, 0, 0, time.UTC), "", "todo", IncrementPatch, "todo/v202501.2.1"},
+		{"namespace with a dot", time.Date(2025, 1, 2, 12, 0, 0, 0, time.UTC), "", "billing.eu", IncrementMinor, "billing.eu/v202501.1.0"},
+		{"new namespace", time.Date(2025, 1, 2, 12, 0, 0, 0, time.UTC), "", "search", IncrementPatch, "search/v202501.0.0"},
+	}
+	for _, tt := range tests {
+		Clock = fixedClock(tt.now)
+		t.Setenv("RELEASER_TIMEZONE", tt.timezone)
+		t.Setenv("RELEASER_TAG_NAMESPACE", tt.namespace)
+		got, err := generateNewVersion(tt.inc)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: generateNewVersion = %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+
+	t.Setenv("RELEASER_TAG_NAMESPACE", "todo/api")
+	if _, err := generateNewVersion(IncrementPatch); err == nil {
+		t.Error("expected an error for a namespace of two segments")
+	}
+	t.Setenv("RELEASER_TAG_NAMESPACE", "")
+	t.Setenv("RELEASER_TIMEZONE", "Mars/Olympus_Mons")
+	if _, err := generateNewVersion(IncrementPatch); err == nil {
+		t.Error("expected an error for an unknown timezone")
+	}
+}
+
+func TestRenderDryRun(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	t.Setenv("RELEASER_DEPLOY_WEBHOOK", "https://deploy.example.com/hooks/s3cret")
+	t.Setenv("RELEASER_DEPLOY_COMMAND", `todoctl deploy -manifest "$RELEASE_MANIFEST"`)
+
+	m := &manifest.Manifest{ReleaseVersion: "v202502.1.0", Services: []manifest.Service{
+		{Name: "todo-backend", Image: "singaravelan21/todo-backend", Version: "v1.1.0"},
+	}}
+	result := &Result{Version: "v202502.1.0", Changes: []Change{{Service: "todo-backend", From: "v1.0.0", To: "v1.1.0"}}}
+	out := filepath.Join(dir, "out")
+	for _, sub := range []string{"notes", "notifications"} {
+		if err := os.MkdirAll(filepath.Join(out, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := renderDryRun(context.Background(), out, m, result); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		file string
+		want string
+	}{
+		{"result.json", `"to": "v1.1.0"`},
+		{ManifestFile, `"release_version": "v202502.1.0"`},
+		{"release.env", "TODO_BACKEND_IMAGE=singaravelan21/todo-backend:v1.1.0"},
+		{"deploy_webhook.json", `"release_version": "v202502.1.0"`},
+		{"deploy_command.sh", "export RELEASE_MANIFEST='release_manifest.json'\nexport RELEASE_IDEMPOTENCY_KEY='" + agent.IdempotencyKey(m) + "'\ntodoctl deploy"},
+		{"notifications/default.txt", "todo-backend: `v1.0.0` → `v1.1.0`"},
+	}
+	for _, tt := range tests {
+		data, err := os.ReadFile(filepath.Join(out, tt.file))
+		if err != nil {
+			t.Errorf("%s: %v", tt.file, err)
+			continue
+		}
+		if !strings.Contains(string(data), tt.want) {
+			t.Errorf("%s = %q, want it to contain %q", tt.file, data, tt.want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, ManifestFile)); err == nil {
+		t.Error("dry run wrote the real manifest")
+	}
+}
+
+func TestSlackRoles(t *testing.T) {
+	roles, err := parseSlackRoles("U1=admin, U2=operator,*=viewer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		user, command string
+		want          bool
+	}{
+		{"U1", "rollback", true},
+		{"U2", "freeze", true},
+		{"U2", "rollback", false},
+		{"U3", "status", true},
+		{"U3", "now", false},
+		{"U1", "deploy", false},
+	}
+	for _, tt := range tests {
+		if got := slackAllowed(roles, tt.user, tt.command); got != tt.want {
+			t.Errorf("slackAllowed(%s, %s) = %v, want %v", tt.user, tt.command, got, tt.want)
+		}
+	}
+	if slackAllowed(map[string]string{"U1": RoleAdmin}, "U3", "status") {
+		t.Error("a user without a role may run /release status")
+	}
+	for _, bad := range []string{"U1", "U1=root"} {
+		if _, err := parseSlackRoles(bad); err == nil {
+			t.Errorf("parseSlackRoles(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestVerifySlack(t *testing.T) {
+	now := time.Unix(1741084200, 0)
+	body := []byte("command=%2Frelease&text=status&user_id=U1")
+	header := func(ts, sig string) http.Header {
+		h := http.Header{}
+		h.Set("X-Slack-Request-Timestamp", ts)
+		h.Set("X-Slack-Signature", sig)
+		return h
+	}
+	const secret = "8f742231b10e8888abcd99yyyzzz85a5"
+
+	good := "v0=" + slackSignature(secret, "1741084200", body)
+	tests := []struct {
+		name    string
+		h       http.Header
+		body    []byte
+		wantErr bool
+	}{
+		{"valid", header("1741084200", good), body, false},
+		{"tampered body", header("1741084200", good), []byte("command=%2Frelease&text=rollback&user_id=U1"), true},
+		{"wrong secret", header("1741084200", "v0="+slackSignature("other", "1741084200", body)), body, true},
+		{"replayed", header("1741083000", "v0="+slackSignature(secret, "1741083000", body)), body, true},
+		{"unsigned", http.Header{}, body, true},
+	}
+	for _, tt := range tests {
+		if err := verifySlack(secret, tt.h, tt.body, now); (err != nil) != tt.wantErr {
+			t.Errorf("%s: verifySlack() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSizeDelta(t *testing.T) {
+	tests := []struct {
+		from, to int64
+		want     string
+	}{
+		{45300000, 50700000, "45.3 MB → 50.7 MB, +12%"},
+		{50000000, 40000000, "50.0 MB → 40.0 MB, -20%"},
+		{0, 50000000, ""},
+		{50000000, 0, ""},
+	}
+	for _, tt := range tests {
+		if got := sizeDelta(Change{SizeFrom: tt.from, SizeTo: tt.to}); got != tt.want {
+			t.Errorf("sizeDelta(%d, %d) = %q, want %q", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestGateLicenses(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	// The fake scanner finds AGPL in todo-backend v1.2.0 and MIT elsewhere.
+	scanner := filepath.Join(dir, "syft")
+	script := `#!/bin/sh
+case "$1" in
+registry:*todo-backend:v1.2.0) echo '{"artifacts": [{"licenses": [{"value": "MIT"}]}, {"licenses": [{"value": "AGPL-3.0-only"}]}]}' ;;
+registry:*broken*) echo "no such image" >&2; exit 1 ;;
+*) echo '{"artifacts": [{"licenses": [{"spdxExpression": "MIT"}]}]}' ;;
+esac
+`
+	if err := os.WriteFile(scanner, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RELEASER_LICENSE_SCANNER", scanner)
+
+	before := []manifest.Service{
+		{Name: "todo-backend", Image: "singaravelan21/todo-backend", Version: "v1.1.0"},
+		{Name: "todo-frontend", Image: "singaravelan21/todo-frontend", Version: "v1.1.0"},
+	}
+	changes := []Change{
+		{Service: "todo-backend", From: "v1.1.0", To: "v1.2.0"},
+		{Service: "todo-frontend", From: "v1.1.0", To: "v1.2.0"},
+	}
+	tests := []struct {
+		action      string
+		wantKept    []string
+		wantBlocked []string
+		wantBackend string
+	}{
+		{"block", []string{"todo-frontend"}, []string{"todo-backend"}, "v1.1.0"},
+		{"warn", []string{"todo-backend", "todo-frontend"}, nil, "v1.2.0"},
+	}
+	for _, tt := range tests {
+		policy := `{"disallowed": ["AGPL-*", "SSPL-1.0"], "action": "` + tt.action + `"}`
+		if err := os.WriteFile(LicensePolicyFile, []byte(policy), 0644); err != nil {
+			t.Fatal(err)
+		}
+		m := &manifest.Manifest{Services: []manifest.Service{before[0], before[1]}}
+		m.Services[0].Version, m.Services[1].Version = "v1.2.0", "v1.2.0"
+
+		kept, blocked, err := gateLicenses(m, before, slices.Clone(changes))
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := func(cs []Change) []string {
+			var out []string
+			for _, c := range cs {
+				out = append(out, c.Service)
+			}
+			return out
+		}
+		if !slices.Equal(names(kept), tt.wantKept) || !slices.Equal(names(blocked), tt.wantBlocked) {
+			t.Errorf("%s: kept %v, blocked %v; want %v, %v", tt.action, names(kept), names(blocked), tt.wantKept, tt.wantBlocked)
+		}
+		if m.Services[0].Version != tt.wantBackend {
+			t.Errorf("%s: todo-backend left at %s, want %s", tt.action, m.Services[0].Version, tt.wantBackend)
+		}
+		for _, c := range append(kept, blocked...) {
+			want := LicensePass
+			if c.Service == "todo-backend" {
+				want = tt.action
+			}
+			if c.Licenses == nil || c.Licenses.Verdict != want {
+				t.Errorf("%s: %s verdict %+v, want %s", tt.action, c.Service, c.Licenses, want)
+			}
+		}
+	}
+
+	if err := os.WriteFile(LicensePolicyFile, []byte(`{"disallowed": ["GPL-3.0"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := &manifest.Manifest{Services: []manifest.Service{{Name: "broken", Image: "acme/broken", Version: "v2"}}}
+	_, blocked, err := gateLicenses(m, []manifest.Service{{Name: "broken", Image: "acme/broken", Version: "v1"}},
+		[]Change{{Service: "broken", From: "v1", To: "v2"}})
+	if err != nil || len(blocked) != 1 {
+		t.Errorf("an image that can't be scanned under a blocking policy: blocked %v, %v", blocked, err)
+	}
+}
+
+func TestManagedCheckout(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	for _, name := range []string{"GIT_CONFIG_COUNT", "GIT_CONFIG_KEY_0", "GIT_CONFIG_VALUE_0", "GIT_CONFIG_KEY_1", "GIT_CONFIG_VALUE_1"} {
+		t.Setenv(name, "")
+	}
+
+	// The remote: a repository with a manifest on main.
+	origin := filepath.Join(dir, "origin")
+	if err := os.MkdirAll(origin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(origin); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gitOutput("init", "-q", "-b", "main"); err != nil {
+		t.Skip("git unavailable:", err)
+	}
+	if err := os.WriteFile(ManifestFile, []byte(`{"release_version": "v202501.0.0", "services": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"add", ManifestFile},
+		{"-c", "user.name=t", "-c", "user.email=t@example.com", "commit", "-q", "-m", "init"},
+		{"config", "receive.denyCurrentBranch", "ignore"},
+	} {
+		if _, err := gitOutput(args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Setenv("RELEASER_REPO_URL", "file://"+origin)
+	t.Setenv("RELEASER_STATE_DIR", filepath.Join(dir, "state"))
+	t.Setenv("RELEASER_REPO_BRANCH", "")
+	t.Setenv("RELEASER_REPO_DIR", "")
+	defer func() { managed = nil }()
+	if err := syncCheckout(); err != nil {
+		t.Fatal(err)
+	}
+	cwd, _ := os.Getwd()
+	if want := filepath.Join(dir, "state", "repo", "worktree"); cwd != want {
+		t.Fatalf("working in %s, want %s", cwd, want)
+	}
+	if _, err := os.Stat(ManifestFile); err != nil {
+		t.Fatalf("manifest not checked out: %v", err)
+	}
+
+	// A release is pushed to the branch; leftovers are cleaned by the next sync.
+	if err := runGitCommand("commit", "-q", "--allow-empty", "-m", "chore: release v202501.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := runGitCommand("tag", "v202501.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pushRelease(context.Background(), "v202501.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("leftover", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := syncCheckout(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat("leftover"); !os.IsNotExist(err) {
+		t.Errorf("leftover file survived the sync: %v", err)
+	}
+	head, _ := gitOutput("rev-parse", "HEAD")
+	pushed, err := gitOutput("--git-dir", filepath.Join(origin, ".git"), "rev-parse", "main", "v202501.0.1^{commit}")
+	if err != nil || pushed != head+"\n"+head {
+		t.Errorf("origin main and tag at %q (%v), want both at %s", pushed, err, head)
+	}
+}
+
+func TestInMemoryCheckout(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+
+	origin := filepath.Join(dir, "origin")
+	if err := os.MkdirAll(origin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(origin); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gitOutput("init", "-q", "-b", "main"); err != nil {
+		t.Skip("git unavailable:", err)
+	}
+	if err := os.WriteFile(ManifestFile, []byte(`{"release_version": "v202501.0.9", "services": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"add", ManifestFile},
+		{"-c", "user.name=t", "-c", "user.email=t@example.com", "commit", "-q", "-m", "init"},
+		{"tag", "v202501.0.9"},
+		{"config", "receive.denyCurrentBranch", "ignore"},
+	} {
+		if _, err := gitOutput(args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Setenv("RELEASER_REPO_URL", "file://"+origin)
+	t.Setenv("RELEASER_STATE_DIR", filepath.Join(dir, "state"))
+	t.Setenv("RELEASER_REPO_BRANCH", "")
+	t.Setenv("RELEASER_REPO_DIR", "")
+	gitInMemory = true
+	defer func() { gitInMemory, memRepo, managed = false, nil, nil }()
+	if err := syncCheckout(); err != nil {
+		t.Fatal(err)
+	}
+	if managed.branch != "main" {
+		t.Errorf("releasing from %q, want the default branch main", managed.branch)
+	}
+	cwd, _ := os.Getwd()
+	if want := filepath.Join(dir, "state", "repo", "worktree"); cwd != want {
+		t.Fatalf("working in %s, want %s", cwd, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "state", "repo", "repo.git")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("cloned onto disk: %v", err)
+	}
+	if _, err := os.Stat(".git"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("worktree has a .git: %v", err)
+	}
+
+	// A release, as releaseAs makes it.
+	repo := currentRepo()
+	if repo != memRepo {
+		t.Fatalf("working on %T, want the in-memory checkout", repo)
+	}
+	ctx := context.Background()
+	if err := os.WriteFile(ManifestFile, []byte(`{"release_version": "v202501.0.10", "services": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.add(ctx, ManifestFile); err != nil {
+		t.Fatal(err)
+	}
+	if staged, err := repo.staged(""); err != nil || !slices.Equal(staged, []string{ManifestFile}) {
+		t.Errorf("staged %q (%v), want the manifest", staged, err)
+	}
+	if err := repo.commit(ctx, "chore: release v202501.0.10"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.tag(ctx, "v202501.0.10"); err != nil {
+		t.Fatal(err)
+	}
+	if tags, err := releaseTags(); err != nil || !slices.Equal(tags, []string{"v202501.0.9", "v202501.0.10"}) {
+		t.Errorf("tags %q (%v), want v202501.0.9 then v202501.0.10", tags, err)
+	}
+	if previous, err := previousRelease("v202501.0.10^"); err != nil || previous != "v202501.0.9" {
+		t.Errorf("release before v202501.0.10: %q (%v), want v202501.0.9", previous, err)
+	}
+	if data, err := gitShow("v202501.0.9", ManifestFile); err != nil || !strings.Contains(string(data), "v202501.0.9") {
+		t.Errorf("manifest of v202501.0.9: %q (%v)", data, err)
+	}
+	if err := pushRelease(ctx, "v202501.0.10"); err != nil {
+		t.Fatal(err)
+	}
+
+	// An abandoned change is put back; leftovers are cleaned by the next sync.
+	if err := os.WriteFile(ManifestFile, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.restore(ctx, "HEAD", ManifestFile); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(ManifestFile); !strings.Contains(string(data), "v202501.0.10") {
+		t.Errorf("manifest not restored: %s", data)
+	}
+	if err := os.WriteFile("leftover", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := syncCheckout(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat("leftover"); !os.IsNotExist(err) {
+		t.Errorf("leftover file survived the sync: %v", err)
+	}
+
+	// The origin, read with the git CLI, has the release, and tells the
+	// same story of it as the in-memory checkout.
+	head, _ := commitOf("HEAD")
+	memTags, _ := repo.tags("v*")
+	sortTags(memTags)
+	memRepo = nil
+	if err := os.Chdir(origin); err != nil {
+		t.Fatal(err)
+	}
+	cli := currentRepo()
+	for _, rev := range []string{"main", "v202501.0.10"} {
+		if pushed, err := commitOf(rev); err != nil || pushed != head {
+			t.Errorf("origin %s at %q (%v), want %s", rev, pushed, err, head)
+		}
+	}
+	cliTags, err := cli.tags("v*")
+	sortTags(cliTags)
+	if err != nil || !slices.Equal(tagNames(cliTags), tagNames(memTags)) {
+		t.Errorf("git CLI tags %q (%v), in memory %q", tagNames(cliTags), err, tagNames(memTags))
+	}
+	for i := range min(len(cliTags), len(memTags)) {
+		if !cliTags[i].date.Equal(memTags[i].date) {
+			t.Errorf("%s made at %v with the git CLI, %v in memory", cliTags[i].name, cliTags[i].date, memTags[i].date)
+		}
+	}
+	if previous, err := cli.describe("v*", "v202501.0.10^"); err != nil || previous != "v202501.0.9" {
+		t.Errorf("git CLI release before v202501.0.10: %q (%v), want v202501.0.9", previous, err)
+	}
+}
+
+func TestArchiveRelease(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	m := &manifest.Manifest{ReleaseVersion: "v202502.1.0", Services: []manifest.Service{
+		{Name: "todo-backend", Image: "singaravelan21/todo-backend", Version: "v1.1.0"},
+	}}
+	if err := manifest.Save(ManifestFile, m); err != nil {
+		t.Fatal(err)
+	}
+	conf := `{"targets": [
+	  {"name": "everything", "driver": "local", "path": "archive"},
+	  {"name": "compliance", "driver": "local", "path": "compliance", "prefix": "releases", "artifacts": ["manifest", "sbom"]}
+	]}`
+	if err := os.WriteFile(ArtifactsFile, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result := &Result{Version: "v202502.1.0", Changes: []Change{
+		{Service: "todo-backend", From: "v1.0.0", To: "v1.1.0", sbom: []byte(`{"artifacts": []}`)},
+	}}
+	if err := archiveRelease(context.Background(), m, result); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		file   string
+		stored bool
+	}{
+		{"archive/v202502.1.0/release_manifest.json", true},
+		{"archive/v202502.1.0/result.json", true},
+		{"archive/v202502.1.0/sbom/todo-backend.syft.json", true},
+		{"compliance/releases/v202502.1.0/release_manifest.json", true},
+		{"compliance/releases/v202502.1.0/sbom/todo-backend.syft.json", true},
+		{"compliance/releases/v202502.1.0/result.json", false},
+	}
+	for _, tt := range tests {
+		if _, err := os.Stat(tt.file); (err == nil) != tt.stored {
+			t.Errorf("%s stored = %v, want %v", tt.file, err == nil, tt.stored)
+		}
+	}
+
+	if err := os.WriteFile(ArtifactsFile, []byte(`{"targets": [{"name": "x", "driver": "local", "path": "x", "artifacts": ["bundle"]}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := archiveRelease(context.Background(), m, result); err == nil {
+		t.Error("expected an error for an unknown artifact kind")
+	}
+}
+
+func TestHandleChecks(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	// Registries without a plugin fail at once, which is enough to follow a
+	// check run through.
+	m := &manifest.Manifest{Services: []manifest.Service{
+		{Name: "todo-frontend", Image: "registry.corp/todo-frontend", Version: "v1.2.0"},
+		{Name: "todo-backend", Image: "registry.corp/todo-backend", Version: "v1.1.0"},
+	}}
+	if err := manifest.Save(ManifestFile, m); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(handleChecks("s3cret"))
+	defer srv.Close()
+
+	tests := []struct {
+		name        string
+		accept      string
+		contentType string
+	}{
+		{"ndjson", "", "application/x-ndjson"},
+		{"server-sent events", "text/event-stream", "text/event-stream"},
+	}
+	for _, tt := range tests {
+		go func() {
+			op := <-operations
+			op(context.Background(), NewStatus(time.Now()))
+		}()
+		req, _ := http.NewRequest(http.MethodPost, srv.URL, nil)
+		req.Header.Set("Authorization", "Bearer s3cret")
+		req.Header.Set("Accept", tt.accept)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if got := resp.Header.Get("Content-Type"); got != tt.contentType {
+			t.Errorf("%s: Content-Type = %q, want %q", tt.name, got, tt.contentType)
+		}
+
+		var events []CheckEvent
+		for _, line := range strings.Split(string(body), "\n") {
+			if tt.accept != "" {
+				var ok bool
+				if line, ok = strings.CutPrefix(line, "data: "); !ok {
+					continue
+				}
+			}
+			if line == "" {
+				continue
+			}
+			var e CheckEvent
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				t.Fatalf("%s: bad event %q: %v", tt.name, line, err)
+			}
+			events = append(events, e)
+		}
+		var types []string
+		for _, e := range events {
+			types = append(types, e.Type)
+		}
+		want := []string{CheckQueued, CheckStarted, CheckService, CheckService, CheckDone}
+		if !slices.Equal(types, want) {
+			t.Fatalf("%s: events %v, want %v", tt.name, types, want)
+		}
+		if e := events[3]; e.Done != 2 || e.Total != 2 || e.Service == nil || e.Service.Error == "" {
+			t.Errorf("%s: last service event = %+v, want 2 of 2 with an error", tt.name, e)
+		}
+	}
+
+	resp, err := http.Post(srv.URL, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without a token: %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestServiceIntervals(t *testing.T) {
+	t.Setenv("RELEASER_REGISTRY_INTERVALS", "docker.io=24h, ghcr.io=10m")
+	m := &manifest.Manifest{Services: []manifest.Service{
+		{Name: "nginx", Image: "nginx", Version: "1.27.0"},
+		{Name: "todo-backend", Image: "singaravelan21/todo-backend", Version: "v1.1.0", CheckInterval: "5m"},
+		{Name: "todo-worker", Image: "ghcr.io/velann21/todo-worker", Version: "v1.0.0"},
+		{Name: "todo-frontend", Image: "registry.corp/todo-frontend", Version: "v1.2.0"},
+		{Name: "todo-cron", Image: "registry.corp/todo-cron", Version: "v1.0.0", CheckInterval: "often"},
+	}}
+	want := map[string]time.Duration{
+		"nginx":         24 * time.Hour,
+		"todo-backend":  5 * time.Minute,
+		"todo-worker":   10 * time.Minute,
+		"todo-frontend": PollingInterval,
+		"todo-cron":     PollingInterval,
+	}
+	if got := serviceIntervals(m); !maps.Equal(got, want) {
+		t.Errorf("serviceIntervals = %v, want %v", got, want)
+	}
+
+	now := time.Date(2025, 3, 3, 12, 0, 0, 0, time.UTC)
+	s := NewStatus(now)
+	s.schedule.Jitter = 0
+	if got := nextWake(s.schedule, now); got != PollingInterval {
+		t.Errorf("nextWake with nothing scheduled = %v, want %v", got, PollingInterval)
+	}
+	s.schedule.Set(want, now)
+	if got := nextWake(s.schedule, now); got != 0 {
+		t.Errorf("nextWake with services due = %v, want 0", got)
+	}
+	s.schedule.Done(s.schedule.Due(now), now)
+	if got := nextWake(s.schedule, now); got != PollingInterval {
+		t.Errorf("nextWake after checking = %v, want %v", got, PollingInterval)
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleSchedule(rec, httptest.NewRequest(http.MethodGet, "/schedule", nil))
+	var checks []ScheduledCheck
+	if err := json.Unmarshal(rec.Body.Bytes(), &checks); err != nil {
+		t.Fatal(err)
+	}
+	if len(checks) != 5 || checks[4].Service != "nginx" || checks[4].Interval != "24h0m0s" || !checks[4].NextCheck.Equal(now.Add(24*time.Hour)) {
+		t.Errorf("GET /schedule = %+v, want nginx last, next checked in 24h", checks)
+	}
+}
+
+func TestManifestVerification(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if _, err := gitOutput("init", "-q"); err != nil {
+		t.Skip("git unavailable:", err)
+	}
+	if err := os.WriteFile(ManifestFile, []byte(`{"release_version": "v202501.0.0", "services": []}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	trusted := base64.StdEncoding.EncodeToString(make([]byte, ed25519.SeedSize))
+	untrusted := base64.StdEncoding.EncodeToString([]byte("01234567890123456789012345678901"))
+	key, _ := provenance.ParsePrivateKey(trusted)
+	t.Setenv("RELEASER_MANIFEST_KEYS", base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)))
+	t.Setenv("RELEASER_MANIFEST_VERIFY", ManifestVerifySignature)
+
+	if _, err := loadManifest(); err == nil {
+		t.Error("loaded an unsigned manifest")
+	}
+	if err := SignManifest(untrusted); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadManifest(); err == nil {
+		t.Error("loaded a manifest signed by an untrusted key")
+	}
+	if err := SignManifest(trusted); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadManifest(); err != nil {
+		t.Errorf("signed manifest: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	handleManifest(rec, httptest.NewRequest(http.MethodGet, "/manifest", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("GET /manifest of a signed manifest = %d", rec.Code)
+	}
+
+	// Tampering breaks the signature, for the releaser and agents alike.
+	if err := os.WriteFile(ManifestFile, []byte(`{"release_version": "v202501.0.0", "services": [{"name": "miner", "image": "evil/miner"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadManifest(); err == nil {
+		t.Error("loaded a tampered manifest")
+	}
+	rec = httptest.NewRecorder()
+	handleManifest(rec, httptest.NewRequest(http.MethodGet, "/manifest", nil))
+	if rec.Code == http.StatusOK {
+		t.Error("served a tampered manifest")
+	}
+
+	// The releaser signs what it commits, with a trusted key only.
+	t.Setenv("RELEASER_SIGNING_KEY", untrusted)
+	if err := stageManifest(); err == nil {
+		t.Error("staged a manifest signed by an untrusted key")
+	}
+	t.Setenv("RELEASER_SIGNING_KEY", trusted)
+	if err := stageManifest(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadManifest(); err != nil {
+		t.Errorf("manifest signed by the releaser: %v", err)
+	}
+
+	// Under commit verification an unsigned commit is refused, and so are
+	// uncommitted changes.
+	t.Setenv("RELEASER_MANIFEST_VERIFY", ManifestVerifyCommit)
+	if _, err := gitOutput("-c", "user.name=t", "-c", "user.email=t@example.com", "commit", "-q", "-m", "init"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadManifest(); err == nil {
+		t.Error("loaded a manifest from an unsigned commit")
+	}
+	if err := os.WriteFile(ManifestFile, []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyManifest("", []byte(`{}`)); err == nil || !strings.Contains(err.Error(), "uncommitted") {
+		t.Errorf("verifyManifest of an uncommitted change = %v", err)
+	}
+}
+
+func TestRenovateConfig(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	defer func() { renovate = nil }()
+	os.Mkdir(".github", 0755)
+	config := `{
+  "$schema": "https://docs.renovatebot.com/renovate-schema.json",
+  "ignoreDeps": ["redis"],
+  "labels": ["dependencies"],
+  "semanticCommits": "enabled",
+  "packageRules": [
+    {"matchPackageNames": ["postgres"], "allowedVersions": "<17"},
+    {"matchPackageNames": ["/^ghcr.io\\//"], "matchUpdateTypes": ["major"], "enabled": false},
+    {"matchPackageNames": ["singaravelan21/*", "!singaravelan21/todo-legacy"], "labels": ["todo"]}
+  ]
+}`
+	if err := os.WriteFile(".github/renovate.json", []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if renovate, err = loadRenovateConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		service manifest.Service
+		change  Change
+		skipped bool
+		held    bool
+		allowed string // a version the constraint must allow, and
+		refused string // one it must refuse
+		branch  string
+		title   string
+		labels  []string
+	}{
+		{
+			service: manifest.Service{Name: "cache", Image: "redis", Version: "7.2.0"},
+			skipped: true,
+		},
+		{
+			service: manifest.Service{Name: "db", Image: "postgres", Version: "16.4.0"},
+			change:  Change{Service: "db", From: "16.3.0", To: "16.4.0"},
+			allowed: "16.9.0", refused: "17.0.0",
+			branch: "renovate/postgres-16.x", title: "chore(deps): update postgres Docker tag to v16.4.0",
+			labels: []string{"dependencies"},
+		},
+		{
+			service: manifest.Service{Name: "worker", Image: "ghcr.io/velann21/todo-worker", Version: "v2.0.0"},
+			change:  Change{Service: "worker", From: "v1.4.0", To: "v2.0.0"},
+			held:    true,
+			branch:  "renovate/ghcr.io-velann21-todo-worker-2.x", title: "chore(deps): update ghcr.io/velann21/todo-worker Docker tag to v2",
+			labels: []string{"dependencies"},
+		},
+		{
+			service: manifest.Service{Name: "backend", Image: "singaravelan21/todo-backend", Version: "v1.2.0"},
+			change:  Change{Service: "backend", From: "v1.1.0", To: "v1.2.0"},
+			branch:  "renovate/singaravelan21-todo-backend-1.x", title: "chore(deps): update singaravelan21/todo-backend Docker tag to v1.2.0",
+			labels: []string{"dependencies", "todo"},
+		},
+		{
+			service: manifest.Service{Name: "legacy", Image: "singaravelan21/todo-legacy", Version: "v0.9.1"},
+			change:  Change{Service: "legacy", From: "v0.9.0", To: "v0.9.1"},
+			branch:  "renovate/singaravelan21-todo-legacy-0.x", title: "chore(deps): update singaravelan21/todo-legacy Docker tag to v0.9.1",
+			labels: []string{"dependencies"},
+		},
+		{
+			service: manifest.Service{Name: "proxy", Image: "nginx@sha256:4c0fdaa8b6341bfdeca5f18f7837462c80cff90527ee35ef185571e1c327beac", Version: "1.27.3"},
+			change:  Change{Service: "proxy", From: "sha256:0123456789ab", To: "1.27.3"},
+			branch:  "renovate/nginx-digest", title: "chore(deps): update nginx Docker digest to 4c0fdaa",
+			labels: []string{"dependencies"},
+		},
+	}
+	for _, tt := range tests {
+		name := tt.service.Name
+		_, skipped := serviceConstraint(tt.service, UpdateAll)
+		if (skipped != "") != tt.skipped {
+			t.Errorf("%s: skipped = %q, want skipped %v", name, skipped, tt.skipped)
+		}
+		if tt.skipped {
+			continue
+		}
+		if held := renovate.disabled(tt.service, updateType(tt.service, tt.change)); held != tt.held {
+			t.Errorf("%s: held back = %v, want %v", name, held, tt.held)
+		}
+		if tt.allowed != "" {
+			c, _ := serviceConstraint(tt.service, UpdateAll)
+			if c == nil || !c.Check(semver.MustParse(tt.allowed)) || c.Check(semver.MustParse(tt.refused)) {
+				t.Errorf("%s: constraint %v should allow %s but not %s", name, c, tt.allowed, tt.refused)
+			}
+		}
+		if got := renovate.updateBranch(tt.service, tt.change); got != tt.branch {
+			t.Errorf("%s: branch = %q, want %q", name, got, tt.branch)
+		}
+		if got := renovate.updateTitle(tt.service, tt.change); got != tt.title {
+			t.Errorf("%s: title = %q, want %q", name, got, tt.title)
+		}
+		if got := renovate.updateLabels(tt.service, tt.change); !slices.Equal(got, tt.labels) {
+			t.Errorf("%s: labels = %q, want %q", name, got, tt.labels)
+		}
+	}
+
+	renovate = nil
+	s := manifest.Service{Name: "proxy", Image: "nginx", Version: "1.27.3"}
+	if got := renovate.updateTitle(s, Change{From: "1.27.2", To: "1.27.3"}); got != "Update nginx Docker tag to v1.27.3" {
+		t.Errorf("title without a config = %q", got)
+	}
+}
+
+func TestRequiredChecks(t *testing.T) {
+	const commit = "0123456789abcdef0123456789abcdef01234567"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer gh-token" {
+			t.Errorf("%s: missing token", r.URL.Path)
+		}
+		switch r.URL.Path {
+		case "/repos/velann21/todo-releaser/commits/" + commit + "/status":
+			io.WriteString(w, `{"statuses": [{"context": "ci/build", "state": "success"}, {"context": "ci/lint", "state": "failure"}]}`)
+		case "/repos/velann21/todo-releaser/commits/" + commit + "/check-runs":
+			io.WriteString(w, `{"check_runs": [
+				{"name": "test", "status": "completed", "conclusion": "success"},
+				{"name": "test", "status": "completed", "conclusion": "failure"},
+				{"name": "e2e", "status": "in_progress"}
+			]}`)
+		case "/repos/velann21/todo-releaser/actions/runs":
+			if r.URL.Query().Get("head_sha") != commit {
+				t.Errorf("workflow runs asked for %q", r.URL.Query().Get("head_sha"))
+			}
+			io.WriteString(w, `{"workflow_runs": [{"name": "CI", "status": "completed", "conclusion": "success"}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	t.Setenv("GITHUB_API_URL", srv.URL)
+	t.Setenv("GITHUB_REPOSITORY", "velann21/todo-releaser")
+	t.Setenv("GITHUB_TOKEN", "gh-token")
+
+	tests := []struct {
+		required []string
+		pending  bool
+		wantErr  bool
+	}{
+		{[]string{"ci/build", "test", "CI"}, false, false},
+		{[]string{"ci/build", "e2e"}, true, true},
+		{[]string{"ci/lint", "e2e"}, false, true},
+		{[]string{"deploy"}, false, true},
+	}
+	for _, tt := range tests {
+		err := checkCommit(commit, tt.required)
+		if (err != nil) != tt.wantErr || errors.Is(err, errChecksPending) != tt.pending {
+			t.Errorf("checkCommit(%v) = %v, want error %v, pending %v", tt.required, err, tt.wantErr, tt.pending)
+		}
+	}
+}
+
+func TestPlatforms(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/acme/api/manifests/v1.2.0":
+			w.Write([]byte(`{"manifests": [
+				{"digest": "sha256:amd", "platform": {"os": "linux", "architecture": "amd64"}},
+				{"digest": "sha256:arm", "platform": {"os": "linux", "architecture": "arm64", "variant": "v8"}},
+				{"digest": "sha256:att", "platform": {"os": "unknown", "architecture": "unknown"}}]}`))
+		case "/v2/acme/api/manifests/v1.3.0":
+			w.Write([]byte(`{"config": {"digest": "sha256:cfg"}}`))
+		case "/v2/acme/api/blobs/sha256:cfg":
+			w.Write([]byte(`{"os": "linux", "architecture": "amd64"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	c := &registryClient{base: srv.URL, repo: "acme/api", http: srv.Client()}
+
+	s := manifest.Service{Name: "api", Image: "acme/api", Platforms: []string{"linux/amd64", "arm64"}}
+	tests := []struct {
+		tag     string
+		missing []string
+	}{
+		{"v1.2.0", nil},
+		{"v1.3.0", []string{"linux/arm64"}},
+	}
+	for _, tt := range tests {
+		published, err := c.platforms(context.Background(), tt.tag)
+		if err != nil {
+			t.Fatalf("platforms(%s): %v", tt.tag, err)
+		}
+		if got := missingPlatforms(s, published); !slices.Equal(got, tt.missing) {
+			t.Errorf("%s published for %v: missing %v, want %v", tt.tag, published, got, tt.missing)
+		}
+	}
+	if got := missingPlatforms(manifest.Service{Platforms: []string{"linux/arm/v7"}}, []string{"linux/arm/v6"}); !slices.Equal(got, []string{"linux/arm/v7"}) {
+		t.Errorf("linux/arm/v6 met linux/arm/v7: missing %v", got)
+	}
+}
+
+func TestChecksComment(t *testing.T) {
+	checks := []ServiceCheck{
+		{Name: "nginx", Current: "1.27.2", Latest: "1.27.3", Update: true},
+		{Name: "redis", Current: "7.2.0", Latest: "7.4.0", Update: true},
+		{Name: "postgres", Current: "16.3.0", Skipped: true, Reason: "ignored by the Renovate config"},
+		{Name: "worker", Current: "v1.4.0", Latest: "v2.0.0", Reason: "ghcr.io/velann21/todo-worker:v2.0.0 is not published for linux/arm64"},
+		{Name: "api", Current: "v1.0.0", Error: "registry returned 500 for /manifests/v1.0.0 | retrying"},
+		{Name: "web", Current: "v1.2.0", Latest: "v1.2.0"},
+		{Name: "queue", Current: "v3.1.0", Error: "docker hub api returned 429", Failure: FailureRateLimited, Registry: "docker.io"},
+		{Name: "cache", Current: "7.0.0", Error: "docker hub api returned 429", Failure: FailureRateLimited, Registry: "docker.io"},
+	}
+	updates := []UpdateBranch{
+		{Service: "nginx", Branch: "renovate/nginx-1.x"},
+		{Service: "redis", Branch: "renovate/redis-7.x"},
+	}
+	want := checksMarker + "\n" + `### Registry check
+
+- :warning: 2 services skipped: rate-limited by docker.io (queue, cache)
+
+| Service | Current | Latest | Result |
+| --- | --- | --- | --- |
+| nginx | ` + "`1.27.2` | `1.27.3`" + ` | **updated here** |
+| redis | ` + "`7.2.0` | `7.4.0` | updated on `renovate/redis-7.x`" + ` |
+| postgres | ` + "`16.3.0`" + ` |  | skipped: ignored by the Renovate config |
+| worker | ` + "`v1.4.0` | `v2.0.0`" + ` | held back: ghcr.io/velann21/todo-worker:v2.0.0 is not published for linux/arm64 |
+| api | ` + "`v1.0.0`" + ` |  | error: registry returned 500 for /manifests/v1.0.0 \| retrying |
+| web | ` + "`v1.2.0` | `v1.2.0`" + ` | up to date |
+| queue | ` + "`v3.1.0`" + ` |  | rate-limited: docker hub api returned 429 |
+| cache | ` + "`7.0.0`" + ` |  | rate-limited: docker hub api returned 429 |
+`
+	table := checksTable(checks, updates, updates[0])
+	if table != want {
+		t.Errorf("checksTable =\n%s\nwant\n%s", table, want)
+	}
+
+	var mu sync.Mutex
+	var comments []map[string]any
+	var calls []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/repos/velann21/todo-releaser/issues/7/comments":
+			json.NewEncoder(w).Encode(comments)
+		case r.Method == http.MethodPost && r.URL.Path == "/repos/velann21/todo-releaser/issues/7/comments":
+			comments = append(comments, map[string]any{"id": 1, "body": "LGTM"}, map[string]any{"id": 42, "body": body["body"]})
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodPatch && r.URL.Path == "/repos/velann21/todo-releaser/issues/comments/42":
+			comments[1]["body"] = body["body"]
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	t.Setenv("GITHUB_API_URL", srv.URL)
+	t.Setenv("GITHUB_REPOSITORY", "velann21/todo-releaser")
+	t.Setenv("GITHUB_TOKEN", "gh-token")
+
+	updated := checksTable(checks[:1], updates, updates[0])
+	for _, body := range []string{table, table, updated} {
+		if err := reportChecks(7, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantCalls := []string{
+		"GET /repos/velann21/todo-releaser/issues/7/comments",
+		"POST /repos/velann21/todo-releaser/issues/7/comments",
+		"GET /repos/velann21/todo-releaser/issues/7/comments",
+		"GET /repos/velann21/todo-releaser/issues/7/comments",
+		"PATCH /repos/velann21/todo-releaser/issues/comments/42",
+	}
+	if !slices.Equal(calls, wantCalls) {
+		t.Errorf("GitHub calls = %q, want %q", calls, wantCalls)
+	}
+	if len(comments) != 2 || comments[1]["body"] != updated {
+		t.Errorf("comments = %v, want the checks comment edited in place", comments)
+	}
+}
+
+func TestOwners(t *testing.T) {
+	defer func() { codeowners = nil }()
+	codeowners = parseCodeowners([]byte(`# Default owners
+*                     @velann21/platform
+/config/              @velann21/ops someone@example.com
+config/backend.env    @velann21/backend @alice
+**/worker/            @velann21/jobs
+/services/web/**      @velann21/frontend
+`))
+	matches := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"*", "release_manifest.json", true},
+		{"/config/", "config/backend.env", true},
+		{"/config/", "config", false},
+		{"/config/", "deploy/config/backend.env", false},
+		{"config/", "deploy/config/backend.env", true},
+		{"*.env", "config/backend.env", true},
+		{"config/*.env", "config/prod/backend.env", false},
+		{"**/worker/", "services/worker/", true},
+		{"/services/web/**", "services/web/", true},
+		{"/services/web/**", "services/webapp/", false},
+	}
+	for _, tt := range matches {
+		if got := codeownersMatch(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("codeownersMatch(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+
+	services := []struct {
+		s    manifest.Service
+		want []string
+	}{
+		{manifest.Service{Name: "backend", Config: []manifest.ConfigBundle{{Path: "config/backend.env"}, {Path: "config/nginx.conf"}}}, []string{"@velann21/backend", "@alice", "@velann21/ops"}},
+		{manifest.Service{Name: "worker"}, []string{"@velann21/jobs"}},
+		{manifest.Service{Name: "web"}, []string{"@velann21/frontend"}},
+		{manifest.Service{Name: "api"}, []string{"@velann21/platform"}},
+		{manifest.Service{Name: "proxy", Owners: []string{"@bob", "ops team"}, Config: []manifest.ConfigBundle{{Path: "config/nginx.conf"}}}, []string{"@bob"}},
+	}
+	for _, tt := range services {
+		if got := serviceOwners(tt.s); !slices.Equal(got, tt.want) {
+			t.Errorf("owners of %s = %q, want %q", tt.s.Name, got, tt.want)
+		}
+	}
+
+	const head = "0123456789abcdef0123456789abcdef01234567"
+	reviews := map[string]string{
+		"7": `[{"user": {"login": "carol"}, "state": "APPROVED", "commit_id": "` + head + `"},
+			{"user": {"login": "alice"}, "state": "APPROVED", "commit_id": "fedcba"}]`,
+		"8": `[{"user": {"login": "dave"}, "state": "APPROVED", "commit_id": "` + head + `"},
+			{"user": {"login": "dave"}, "state": "COMMENTED", "commit_id": "` + head + `"}]`,
+		"9": `[{"user": {"login": "dave"}, "state": "APPROVED", "commit_id": "` + head + `"},
+			{"user": {"login": "dave"}, "state": "DISMISSED", "commit_id": "` + head + `"}]`,
+	}
+	var mu sync.Mutex
+	var statuses []map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch p := r.URL.Path; {
+		case strings.HasSuffix(p, "/reviews"):
+			io.WriteString(w, reviews[strings.Split(p, "/")[5]])
+		case strings.HasPrefix(p, "/repos/velann21/todo-releaser/pulls/"):
+			io.WriteString(w, `{"head": {"sha": "`+head+`"}}`)
+		case p == "/orgs/velann21/teams/backend/memberships/dave":
+			io.WriteString(w, `{"state": "active"}`)
+		case p == "/repos/velann21/todo-releaser/statuses/"+head:
+			var status map[string]string
+			json.NewDecoder(r.Body).Decode(&status)
+			statuses = append(statuses, status)
+			w.WriteHeader(http.StatusCreated)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	t.Setenv("GITHUB_API_URL", srv.URL)
+	t.Setenv("GITHUB_REPOSITORY", "velann21/todo-releaser")
+	t.Setenv("GITHUB_TOKEN", "gh-token")
+	defer func() { reportedApprovals = map[string]string{} }()
+
+	approvals := []struct {
+		number      int
+		owners      []string
+		state, desc string
+	}{
+		{7, []string{"@velann21/backend", "@alice"}, "pending", "Needs approval from @velann21/backend or @alice"},
+		{8, []string{"@velann21/backend", "@alice"}, "success", "Approved by @dave"},
+		{9, []string{"@velann21/backend"}, "pending", "Needs approval from @velann21/backend"},
+		{7, nil, "success", "The service has no owners"},
+	}
+	for _, tt := range approvals {
+		statuses = nil
+		reportedApprovals = map[string]string{}
+		if err := reportApproval(tt.number, tt.owners); err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{"state": tt.state, "context": OwnerApprovalContext, "description": tt.desc}
+		if len(statuses) != 1 || !maps.Equal(statuses[0], want) {
+			t.Errorf("pull request %d owned by %q: statuses %v, want %v", tt.number, tt.owners, statuses, want)
+		}
+	}
+	if err := reportApproval(7, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 {
+		t.Errorf("an unchanged approval was set again: %v", statuses)
+	}
+}
+
+func TestLambdaEvents(t *testing.T) {
+	tests := []struct {
+		name  string
+		event string
+		repos []string
+	}{
+		{"schedule", `{"source": "aws.events", "detail-type": "Scheduled Event", "detail": {}}`, nil},
+		{"ecr push", `{"source": "aws.ecr", "detail-type": "ECR Image Action",
+			"detail": {"action-type": "PUSH", "result": "SUCCESS", "repository-name": "team/api", "image-tag": "v1.3.0"}}`, []string{"team/api"}},
+		{"ecr delete", `{"source": "aws.ecr", "detail-type": "ECR Image Action",
+			"detail": {"action-type": "DELETE", "result": "SUCCESS", "repository-name": "team/api"}}`, []string{}},
+	}
+	for _, tt := range tests {
+		var event lambdaEvent
+		if err := json.Unmarshal([]byte(tt.event), &event); err != nil {
+			t.Fatal(err)
+		}
+		repos, err := eventBridgeRepositories(event)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !slices.Equal(repos, tt.repos) || (repos == nil) != (tt.repos == nil) {
+			t.Errorf("%s: repositories %#v, want %#v", tt.name, repos, tt.repos)
+		}
+	}
+
+	hooks := []struct {
+		body  string
+		repos []string
+	}{
+		{`{"push_data": {"tag": "v1.3.0"}, "repository": {"repo_name": "singaravelan21/todo-backend"}}`, []string{"singaravelan21/todo-backend"}},
+		{`{"events": [{"action": "pull", "target": {"repository": "team/web"}},
+			{"action": "push", "target": {"repository": "team/api"}},
+			{"action": "push", "target": {"repository": "team/api"}}]}`, []string{"team/api"}},
+	}
+	for _, tt := range hooks {
+		repos, err := webhookRepositories([]byte(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(repos, tt.repos) {
+			t.Errorf("webhook %s: repositories %v, want %v", tt.body, repos, tt.repos)
+		}
+	}
+	if _, err := webhookRepositories([]byte(`{"zen": "hi"}`)); err == nil {
+		t.Error("unrecognised webhook accepted")
+	}
+
+	images := []struct {
+		ref, repo string
+		want      bool
+	}{
+		{"123456789012.dkr.ecr.eu-west-1.amazonaws.com/team/api", "team/api", true},
+		{"singaravelan21/todo-backend", "singaravelan21/todo-backend", true},
+		{"nginx", "nginx", true},
+		{"nginx", "library/nginx", true},
+		{"ghcr.io/team/api-worker", "team/api", false},
+	}
+	for _, tt := range images {
+		if got := imageInRepository(tt.ref, tt.repo); got != tt.want {
+			t.Errorf("imageInRepository(%s, %s) = %t, want %t", tt.ref, tt.repo, got, tt.want)
+		}
+	}
+
+	t.Setenv("RELEASER_WEBHOOK_TOKEN", "s3cret")
+	auth := []struct {
+		name, event string
+		want        int
+	}{
+		{"wrong token", `{"body": "{}", "headers": {"Authorization": "Bearer guess"}}`, http.StatusUnauthorized},
+		{"token in the query", `{"body": "{}", "queryStringParameters": {"token": "s3cret"}}`, http.StatusUnauthorized},
+		// Past the token, the empty body is refused.
+		{"token", `{"body": "{}", "headers": {"Authorization": "Bearer s3cret"}}`, http.StatusBadRequest},
+		{"token, lowercased header", `{"body": "{}", "headers": {"authorization": "Bearer s3cret"}}`, http.StatusBadRequest},
+	}
+	for _, tt := range auth {
+		out, err := handleLambdaEvent(context.Background(), []byte(tt.event))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := out.(map[string]any)["statusCode"]; status != tt.want {
+			t.Errorf("webhook with %s: status %v, want %d", tt.name, status, tt.want)
+		}
+	}
+}
+
+func TestLambdaState(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("RELEASER_STATE_DIR", dir)
+	files := map[string]string{"freeze.json": `{"reason": "launch"}`, "pki/ca.pem": "ca"}
+	for name, data := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0700)
+		os.WriteFile(filepath.Join(dir, name), []byte(data), 0600)
+	}
+	os.MkdirAll(filepath.Join(dir, "repo", "worktree"), 0700)
+	os.WriteFile(filepath.Join(dir, "repo", "worktree", "release_manifest.json"), []byte("{}"), 0600)
+
+	store, err := blobstore.Open(blobstore.Config{Driver: blobstore.Local, Path: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := restoreState(ctx, store); err != nil {
+		t.Fatalf("restoring with nothing saved: %v", err)
+	}
+	if err := saveState(ctx, store); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "agents.json"), []byte("{}"), 0600)
+	os.Remove(filepath.Join(dir, "freeze.json"))
+	if err := restoreState(ctx, store); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range files {
+		if got, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(got) != want {
+			t.Errorf("%s restored as %q (%v), want %q", name, got, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "agents.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("agents.json left behind by restore: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "repo", "worktree", "release_manifest.json")); err != nil {
+		t.Errorf("restore removed the checkout: %v", err)
+	}
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	body := []byte(`{"type":"release-created"}`)
+	tests := []struct {
+		target string
+		want   []string
+	}{
+		{"arn:aws:sns:eu-west-1:123456789012:releases", []string{"sns", "publish", "--region", "eu-west-1",
+			"--topic-arn", "arn:aws:sns:eu-west-1:123456789012:releases", "--message", string(body),
+			"--message-attributes", `{"type": {"DataType": "String", "StringValue": "release-created"}}`}},
+		{"https://sqs.us-east-1.amazonaws.com/123456789012/releases", []string{"sqs", "send-message", "--region", "us-east-1",
+			"--queue-url", "https://sqs.us-east-1.amazonaws.com/123456789012/releases", "--message-body", string(body),
+			"--message-attributes", `{"type": {"DataType": "String", "StringValue": "release-created"}}`}},
+		{"https://hooks.example.com/releases", nil},
+	}
+	for _, tt := range tests {
+		got, err := publishArgs(tt.target, EventReleaseCreated, body)
+		if (err != nil) != (tt.want == nil) {
+			t.Errorf("%s: error %v", tt.target, err)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: args %q, want %q", tt.target, got, tt.want)
+		}
+	}
+
+	t.Setenv("RELEASER_EVENTS", " arn:aws:sns:eu-west-1:123456789012:releases, ,https://sqs.us-east-1.amazonaws.com/1/q")
+	if got := eventTargets(); len(got) != 2 || got[1] != "https://sqs.us-east-1.amazonaws.com/1/q" {
+		t.Errorf("eventTargets() = %q", got)
+	}
+}
+
+func TestStatusPage(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	var hooks []StatusEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var body struct {
+			Incident struct {
+				Status     string            `json:"status"`
+				Components map[string]string `json:"components"`
+			} `json:"incident"`
+		}
+		switch {
+		case r.URL.Path == "/status":
+			var e StatusEvent
+			json.NewDecoder(r.Body).Decode(&e)
+			hooks = append(hooks, e)
+			return
+		case r.Header.Get("Authorization") != "OAuth key":
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		requests = append(requests, fmt.Sprintf("%s %s %s %v", r.Method, r.URL.Path, body.Incident.Status, body.Incident.Components))
+		w.Write([]byte(`{"id": "inc1"}`))
+	}))
+	defer srv.Close()
+	t.Setenv("RELEASER_STATUSPAGE_API_URL", srv.URL)
+	t.Setenv("RELEASER_STATUSPAGE_PAGE_ID", "page1")
+	t.Setenv("RELEASER_STATUSPAGE_API_KEY", "key")
+	t.Setenv("RELEASER_STATUS_WEBHOOK", srv.URL+"/status")
+
+	prevRun := runID
+	runID = "run2"
+	defer func() { runID = prevRun }()
+	m := &manifest.Manifest{ReleaseVersion: "v202510.2.0", Services: []manifest.Service{
+		{Name: "api", StatusComponents: []string{"cmp-api", "cmp-web"}, LastBump: &manifest.Bump{Run: "run2"}},
+		{Name: "web", StatusComponents: []string{"cmp-web"}, LastBump: &manifest.Bump{Run: "run1"}},
+		{Name: "worker", StatusComponents: []string{"cmp-jobs"}},
+	}}
+	if got := affectedComponents(m); !slices.Equal(got, []string{"cmp-api", "cmp-web"}) {
+		t.Errorf("affected components %v", got)
+	}
+
+	mt := beginMaintenance(m)
+	mt.end(m, errors.New("deploy command: exit status 1"))
+	want := []string{
+		"POST /pages/page1/incidents in_progress map[cmp-api:under_maintenance cmp-web:under_maintenance]",
+		"PATCH /pages/page1/incidents/inc1 completed map[cmp-api:operational cmp-web:operational]",
+	}
+	if !slices.Equal(requests, want) {
+		t.Errorf("Statuspage requests:\n%s\nwant:\n%s", strings.Join(requests, "\n"), strings.Join(want, "\n"))
+	}
+	if len(hooks) != 2 || hooks[0].Event != StatusDeployStarted || hooks[1].Event != StatusDeployFinished ||
+		hooks[1].Succeeded || hooks[1].Error != "deploy command: exit status 1" {
+		t.Errorf("status webhook events %+v", hooks)
+	}
+
+	runID = "run3"
+	if got := affectedComponents(m); !slices.Equal(got, []string{"cmp-api", "cmp-jobs", "cmp-web"}) {
+		t.Errorf("affected components without bumps %v", got)
+	}
+}
+
+func TestPageRelease(t *testing.T) {
+	var alerts []pagerDutyAlert
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a pagerDutyAlert
+		json.NewDecoder(r.Body).Decode(&a)
+		alerts = append(alerts, a)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+	t.Setenv("RELEASER_PAGERDUTY_URL", srv.URL)
+	t.Setenv("GITHUB_REPOSITORY", "velann21/todo-releaser")
+	t.Setenv("RELEASER_DEPLOY_COMMAND", "exit 3")
+	m := &manifest.Manifest{ReleaseVersion: "v202510.3.0"}
+
+	if err := deployRelease(context.Background(), m); err == nil {
+		t.Fatal("deployRelease succeeded with a failing command")
+	}
+	if len(alerts) != 0 {
+		t.Errorf("paged without a routing key: %+v", alerts)
+	}
+
+	t.Setenv("RELEASER_PAGERDUTY_ROUTING_KEY", "routing")
+	deployRelease(context.Background(), m)
+	if len(alerts) != 1 {
+		t.Fatalf("%d alerts, want 1", len(alerts))
+	}
+	a := alerts[0]
+	if a.RoutingKey != "routing" || a.EventAction != "trigger" || a.DedupKey != "releaser-v202510.3.0" ||
+		a.Payload.Severity != pagerDutyError || a.Payload.Class != "deploy" ||
+		a.Payload.Summary != "Rollout of v202510.3.0 failed: deploy command: exit status 3" {
+		t.Errorf("alert %+v", a)
+	}
+	if len(a.Links) != 1 || a.Links[0].Href != "https://github.com/velann21/todo-releaser/releases/tag/v202510.3.0" {
+		t.Errorf("alert links %+v", a.Links)
+	}
+}
+
+func TestReleaseWebhooks(t *testing.T) {
+	t.Setenv("RELEASER_STATE_DIR", t.TempDir())
+	t.Setenv("GITHUB_REPOSITORY", "velann21/todo-releaser")
+	prevBackoff := webhookBackoff
+	webhookBackoff = time.Millisecond
+	defer func() { webhookBackoff = prevBackoff }()
+
+	var mu sync.Mutex
+	calls := map[string]int{}
+	var payload ReleasePayload
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[r.URL.Path]++
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("X-Releaser-Signature") != webhookSignature("s3cret", body) && r.URL.Path == "/ok" {
+			t.Errorf("bad signature %q", r.Header.Get("X-Releaser-Signature"))
+		}
+		switch r.URL.Path {
+		case "/ok":
+			json.Unmarshal(body, &payload)
+		case "/flaky":
+			if calls[r.URL.Path] < 3 {
+				w.WriteHeader(http.StatusBadGateway)
+			}
+		case "/gone":
+			w.WriteHeader(http.StatusGone)
+		}
+	}))
+	defer srv.Close()
+
+	ids := map[string]string{}
+	for _, path := range []string{"/ok", "/flaky", "/gone"} {
+		hook, err := AddWebhook(srv.URL+path, "s3cret", path, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[path] = hook.ID
+	}
+	if _, err := AddWebhook("ftp://example.com", "", "", time.Now()); err == nil {
+		t.Error("registered an ftp webhook")
+	}
+
+	m := &manifest.Manifest{Services: []manifest.Service{{Name: "api", Image: "acme/api", Version: "v1.3.0"}}}
+	result := &Result{Version: "v202510.4.0", Changes: []Change{{Service: "api", From: "v1.2.0", To: "v1.3.0"}}}
+	err := deliverReleaseWebhooks(m, result)
+	if err == nil || !strings.Contains(err.Error(), ids["/gone"]+": webhook returned 410") || strings.Contains(err.Error(), ids["/flaky"]) {
+		t.Errorf("deliverReleaseWebhooks() error = %v", err)
+	}
+	if calls["/ok"] != 1 || calls["/flaky"] != 3 || calls["/gone"] != 1 {
+		t.Errorf("calls %v, want /ok once, /flaky 3 times, /gone once", calls)
+	}
+	if payload.Version != "v202510.4.0" || len(payload.Changes) != 1 || payload.Changes[0].Image != "acme/api" ||
+		payload.Changes[0].Changelog != "https://hub.docker.com/r/acme/api/tags?name=v1.3.0" {
+		t.Errorf("payload %+v", payload)
+	}
+
+	log, ok, err := WebhookDeliveries(ids["/flaky"])
+	if err != nil || !ok || len(log) != 1 || !log[0].Succeeded || len(log[0].Attempts) != 3 || log[0].Attempts[0].Status != http.StatusBadGateway {
+		t.Errorf("flaky deliveries %+v, %t, %v", log, ok, err)
+	}
+
+	hooks, err := Webhooks()
+	if err != nil || len(hooks) != 3 || hooks[0].Secret != "" {
+		t.Errorf("Webhooks() = %+v, %v", hooks, err)
+	}
+	if ok, err := RemoveWebhook(ids["/gone"]); !ok || err != nil {
+		t.Errorf("RemoveWebhook() = %t, %v", ok, err)
+	}
+	if _, ok, _ := WebhookDeliveries(ids["/gone"]); ok {
+		t.Error("deliveries of a removed webhook")
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git unavailable")
+	}
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	defer func() { managed = nil }()
+	transport := registryHTTP.Transport
+	defer func() { registryHTTP.Transport = transport }()
+	for _, name := range []string{"RELEASER_REPO_URL", "RELEASER_REPO_DIR", "RELEASER_STATE_DIR", "RELEASER_SANDBOX_DEPLOYED",
+		"RELEASER_DEPLOY_COMMAND", "GIT_CONFIG_COUNT", "GIT_CONFIG_KEY_0", "GIT_CONFIG_VALUE_0", "GIT_CONFIG_KEY_1", "GIT_CONFIG_VALUE_1"} {
+		t.Setenv(name, "")
+	}
+
+	result, err := Sandbox(context.Background(), SandboxOptions{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result == nil {
+		t.Fatal("the sandbox released nothing")
+	}
+	var changes []string
+	for _, c := range result.Changes {
+		changes = append(changes, c.Service+" "+c.From+" -> "+c.To)
+	}
+	slices.Sort(changes)
+	want := []string{"nginx 1.27.2 -> 1.27.3", "todo-backend v1.1.0 -> v1.1.1", "todo-frontend v1.1.0 -> v1.2.0"}
+	if !slices.Equal(changes, want) {
+		t.Errorf("changes %q, want %q", changes, want)
+	}
+	if want := calverPrefix(Clock.Now()) + ".1.0"; result.Version != want {
+		t.Errorf("released %s, want %s", result.Version, want)
+	}
+	if result.Changes[0].CommitURL == "" {
+		t.Errorf("change not linked to its source: %+v", result.Changes[0])
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "deployed", result.Version+".json"))
+	if err != nil {
+		t.Fatalf("release not deployed: %v", err)
+	}
+	deployed, err := manifest.Parse(data)
+	if err != nil || deployed.ReleaseVersion != result.Version {
+		t.Errorf("deployed manifest %+v, %v", deployed, err)
+	}
+	if tags, err := gitOutput("--git-dir", filepath.Join(dir, "origin.git"), "tag"); err != nil || !strings.Contains(tags, result.Version) {
+		t.Errorf("release not pushed to origin: %q, %v", tags, err)
+	}
+}
+
+func TestSkew(t *testing.T) {
+	t.Setenv("RELEASER_STATE_DIR", t.TempDir())
+	transport := registryHTTP.Transport
+	defer func() { registryHTTP.Transport = transport }()
+	registryHTTP.Transport = sandboxTransport{newSandboxRegistry()}
+
+	backend, frontend := "singaravelan21/todo-backend", "singaravelan21/todo-frontend"
+	nginx := sandboxDigest("library/nginx", "1.27.3")
+	m := &manifest.Manifest{ReleaseVersion: "v202510.4.0", Services: []manifest.Service{
+		{Name: "todo-backend", Image: backend, Version: "v1.1.1"},
+		{Name: "todo-frontend", Image: frontend, Version: "v1.2.0"},
+		{Name: "nginx", Image: "nginx@" + nginx, Version: "1.27.3"},
+		{Name: "api", Image: "acme/api", Version: "v2.0.0"},
+	}}
+	inventories := map[string][]agent.Container{
+		"app-1": {
+			{Service: "todo-backend", Name: "todo-backend-1", Image: backend + ":v1.1.1", RepoDigests: []string{backend + "@" + sandboxDigest(backend, "v1.1.1")}},
+			{Service: "todo-frontend", Name: "todo-frontend-1", Image: frontend + ":v1.1.0", RepoDigests: []string{frontend + "@" + sandboxDigest(frontend, "v1.1.0")}},
+			{Service: "todo-frontend", Name: "todo-frontend-2", Image: frontend + ":v1.2.0", RepoDigests: []string{frontend + "@" + sandboxDigest(frontend, "v1.1.0")}},
+			{Service: "nginx", Name: "nginx-1", Image: "nginx:1.27.3@" + nginx, RepoDigests: []string{"nginx@" + nginx}},
+			{Service: "worker", Name: "worker-1", Image: "acme/worker:dev"},
+		},
+		"app-2": {
+			{Service: "todo-backend", Name: "todo-backend-1", Image: backend + ":v1.1.1"},
+			{Service: "todo-frontend", Name: "todo-frontend-1", Image: "acme/frontend:v1.2.0", RepoDigests: []string{"acme/frontend@" + sandboxDigest("x")}},
+			{Service: "api", Name: "api-1", Image: "acme/api:v2.0.0", RepoDigests: []string{"acme/api@" + sandboxDigest("api")}},
+		},
+	}
+	handler := handleAgentContainers("token")
+	for host, containers := range inventories {
+		body, _ := json.Marshal(agent.Inventory{Version: "v202510.3.0", Containers: containers, Time: time.Now()})
+		req := httptest.NewRequest(http.MethodPut, "/agents/"+host+"/containers", strings.NewReader(string(body)))
+		req.SetPathValue("name", host)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: inventory accepted without the token: %d", host, rec.Code)
+		}
+		req = httptest.NewRequest(http.MethodPut, "/agents/"+host+"/containers", strings.NewReader(string(body)))
+		req.SetPathValue("name", host)
+		req.Header.Set("Authorization", "Bearer token")
+		rec = httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("%s: inventory returned %d: %s", host, rec.Code, rec.Body)
+		}
+	}
+
+	hosts, err := Skew(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, h := range hosts {
+		if h.Release != "v202510.3.0" || !h.Skewed() {
+			t.Errorf("%s: release %s, skewed %v", h.Host, h.Release, h.Skewed())
+		}
+		for _, s := range h.Services {
+			got[h.Host+" "+s.Service+" "+s.Container] = s.Status
+		}
+	}
+	tests := []struct {
+		container string
+		status    string
+	}{
+		{"app-1 todo-backend todo-backend-1", SkewCurrent},
+		{"app-1 todo-frontend todo-frontend-1", SkewOutdated},
+		{"app-1 todo-frontend todo-frontend-2", SkewModified},
+		{"app-1 nginx nginx-1", SkewCurrent},
+		{"app-1 api ", SkewMissing},
+		{"app-1 worker worker-1", SkewUnmanaged},
+		{"app-2 todo-backend todo-backend-1", SkewModified},
+		{"app-2 todo-frontend todo-frontend-1", SkewModified},
+		{"app-2 nginx ", SkewMissing},
+		{"app-2 api api-1", SkewCurrent},
+	}
+	for _, tt := range tests {
+		if got[tt.container] != tt.status {
+			t.Errorf("%s: %q, want %q", tt.container, got[tt.container], tt.status)
+		}
+	}
+	if len(got) != len(tests) {
+		t.Errorf("%d containers compared, want %d: %v", len(got), len(tests), got)
+	}
+}
+
+func TestDepUpdates(t *testing.T) {
+	dockerfile := `FROM golang:1.25-alpine AS builder
+RUN go build ./...
+FROM --platform=$BUILDPLATFORM node:22.11.0 AS assets
+FROM builder AS test
+FROM ${BASE}
+FROM scratch
+FROM alpine:latest
+FROM ghcr.io/velann21/base:v1.2 as base
+from golang:1.25-alpine
+`
+	var got []string
+	for _, img := range parseBaseImages("Dockerfile", []byte(dockerfile)) {
+		got = append(got, img.ref.String())
+	}
+	want := []string{"golang:1.25-alpine", "node:22.11.0", "ghcr.io/velann21/base:v1.2", "golang:1.25-alpine"}
+	if !slices.Equal(got, want) {
+		t.Errorf("base images %q, want %q", got, want)
+	}
+
+	rewritten := string(rewriteBaseImage([]byte(dockerfile), "golang", "1.25-alpine", "1.26-alpine"))
+	if strings.Count(rewritten, "golang:1.26-alpine") != 2 || strings.Contains(rewritten, "1.25") ||
+		!strings.Contains(rewritten, "FROM golang:1.26-alpine AS builder\n") {
+		t.Errorf("rewritten Dockerfile:\n%s", rewritten)
+	}
+
+	tags := []string{"latest", "1.26-alpine", "1.26.1-alpine", "1.26", "1.27rc1-alpine", "1.25-alpine", "1.24-bookworm", "v1.30-alpine"}
+	tests := []struct {
+		current, want string
+	}{
+		{"1.25-alpine", "1.26-alpine"},
+		{"1.25.3-alpine", "1.26.1-alpine"},
+		{"1.25", "1.26"},
+		{"1.26-alpine", ""},
+		{"1.23-bookworm", "1.24-bookworm"},
+		{"bookworm", ""},
+	}
+	for _, tt := range tests {
+		if got := newerBaseTag(tt.current, tags); got != tt.want {
+			t.Errorf("newerBaseTag(%s) = %q, want %q", tt.current, got, tt.want)
+		}
+	}
+
+	out := `{"Path": "github.com/velann21/todo-releaser", "Main": true}
+{"Path": "github.com/Masterminds/semver/v3", "Version": "v3.4.0", "Update": {"Version": "v3.5.0"}}
+{"Path": "gopkg.in/yaml.v3", "Version": "v3.0.1"}
+{"Path": "golang.org/x/net", "Version": "v0.42.0", "Indirect": true, "Update": {"Version": "v0.43.0"}}
+`
+	updates, err := parseGoModuleUpdates([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 1 {
+		t.Fatalf("updates %+v", updates)
+	}
+	if u := updates[0]; u.Name != "github.com/Masterminds/semver/v3" || u.From != "v3.4.0" || u.To != "v3.5.0" ||
+		u.Branch != "renovate/github.com-masterminds-semver-v3-3.x" || u.Title != "Update module github.com/Masterminds/semver/v3 to v3.5.0" {
+		t.Errorf("update %+v", u)
+	}
+}
+
+func TestGitHubApp(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2025, 10, 6, 12, 0, 0, 0, time.UTC)
+	defer func(c ClockSource) { Clock = c }(Clock)
+	Clock = fixedClock(start)
+	defer func() { githubApp.token, githubApp.expires = "", time.Time{} }()
+
+	var minted []map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The App's JWT is signed with its key and issued by its ID.
+		jwt := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		parts := strings.Split(jwt, ".")
+		if len(parts) != 3 {
+			t.Errorf("%s authorized with %q", r.URL.Path, jwt)
+			http.Error(w, "bad JWT", http.StatusUnauthorized)
+			return
+		}
+		sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], sig); err != nil || !strings.Contains(string(claims), `"iss":"1234"`) {
+			t.Errorf("JWT %s: %v", claims, err)
+		}
+		switch r.URL.Path {
+		case "/repos/velann21/todo-releaser/installation":
+			w.Write([]byte(`{"id": 42}`))
+		case "/app/installations/42/access_tokens":
+			var req map[string]any
+			json.NewDecoder(r.Body).Decode(&req)
+			minted = append(minted, req)
+			json.NewEncoder(w).Encode(map[string]any{
+				"token":      fmt.Sprintf("ghs_%d", len(minted)),
+				"expires_at": Clock.Now().Add(time.Hour),
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	t.Setenv("GITHUB_API_URL", srv.URL)
+	t.Setenv("GITHUB_REPOSITORY", "velann21/todo-releaser")
+	t.Setenv("GITHUB_TOKEN", "pat")
+	keyFile := filepath.Join(t.TempDir(), "app.pem")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if token, err := githubToken(); token != "pat" || err != nil {
+		t.Errorf("githubToken() without an App = %q, %v", token, err)
+	}
+	t.Setenv("RELEASER_GITHUB_APP_ID", "1234")
+	t.Setenv("RELEASER_GITHUB_APP_PRIVATE_KEY_FILE", keyFile)
+	t.Setenv("RELEASER_GITHUB_APP_PERMISSIONS", "contents=write, pull_requests=write")
+
+	tests := []struct {
+		name  string
+		after time.Duration
+		token string
+	}{
+		{"minted", 0, "ghs_1"},
+		{"cached", 30 * time.Minute, "ghs_1"},
+		{"renewed before it expires", 55 * time.Minute, "ghs_2"},
+	}
+	for _, tt := range tests {
+		Clock = fixedClock(start.Add(tt.after))
+		token, err := githubToken()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if token != tt.token {
+			t.Errorf("%s: token %q, want %q", tt.name, token, tt.token)
+		}
+	}
+	want := map[string]any{
+		"repositories": []any{"todo-releaser"},
+		"permissions":  map[string]any{"contents": "write", "pull_requests": "write"},
+	}
+	if len(minted) != 2 || fmt.Sprint(minted[0]) != fmt.Sprint(want) {
+		t.Errorf("token requests %v, want %v", minted, want)
+	}
+
+	t.Setenv("RELEASER_GITHUB_APP_PERMISSIONS", "contents=admin")
+	githubApp.token = ""
+	if _, err := githubToken(); err == nil {
+		t.Error("minted a token with invalid permissions")
+	}
+}
+
+func TestSecretRotation(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := func(s string) string {
+		enc, err := secrets.Encrypt(s, id.Recipient().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return enc
+	}
+	t.Setenv("SOPS_AGE_KEY", id.String())
+	t.Setenv("RELEASER_STATE_DIR", t.TempDir())
+	for _, name := range []string{"RELEASER_API_TOKEN", "RELEASER_WEBHOOK_TOKEN", "RELEASER_GITHUB_APP_ID"} {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+	defer func() { secretState.loaded, secretState.hooks = nil, nil }()
+	defer func() { githubApp.token, githubApp.expires = "", time.Time{} }()
+	var hooked [][]string
+	onSecretsRotated(func(names []string) { hooked = append(hooked, names) })
+
+	file := filepath.Join(t.TempDir(), "secrets.env")
+	other := filepath.Join(t.TempDir(), "other.env")
+	if err := os.WriteFile(other, []byte("RELEASER_WEBHOOK_TOKEN=from-other\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sources, err := parseSecretSources("file:" + file + ", file:" + other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		audited []string
+		reset   bool
+	}{
+		{"loaded", "# releaser\nexport RELEASER_API_TOKEN=" + encrypted("one") + "\nRELEASER_WEBHOOK_TOKEN='hook'\n",
+			map[string]string{"RELEASER_API_TOKEN": "one", "RELEASER_WEBHOOK_TOKEN": "from-other"},
+			[]string{"RELEASER_API_TOKEN", "RELEASER_WEBHOOK_TOKEN"}, false},
+		{"unchanged", "RELEASER_API_TOKEN=" + encrypted("one") + "\nRELEASER_WEBHOOK_TOKEN=hook\n",
+			map[string]string{"RELEASER_API_TOKEN": "one", "RELEASER_WEBHOOK_TOKEN": "from-other"}, nil, false},
+		{"rotated", "RELEASER_API_TOKEN=two\nRELEASER_GITHUB_APP_ID=1234\n",
+			map[string]string{"RELEASER_API_TOKEN": "two", "RELEASER_WEBHOOK_TOKEN": "from-other", "RELEASER_GITHUB_APP_ID": "1234"},
+			[]string{"RELEASER_API_TOKEN", "RELEASER_GITHUB_APP_ID"}, true},
+		{"unreadable keeps values", "",
+			map[string]string{"RELEASER_API_TOKEN": "two", "RELEASER_GITHUB_APP_ID": "1234"}, nil, false},
+		{"removed", "RELEASER_API_TOKEN=two\n",
+			map[string]string{"RELEASER_API_TOKEN": "two", "RELEASER_GITHUB_APP_ID": ""},
+			[]string{"RELEASER_GITHUB_APP_ID"}, true},
+	}
+	for _, tt := range tests {
+		if tt.file == "" {
+			os.Remove(file)
+		} else if err := os.WriteFile(file, []byte(tt.file), 0600); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("RELEASER_STATE_DIR", t.TempDir())
+		hooked = nil
+		githubApp.token = "ghs_1"
+		refreshSecrets(sources)
+
+		for name, want := range tt.env {
+			if got := os.Getenv(name); got != want {
+				t.Errorf("%s: %s = %q, want %q", tt.name, name, got, want)
+			}
+		}
+		events, err := readAuditLog()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := json.Marshal(events)
+		var e AuditEvent
+		if len(tt.audited) > 0 && len(events) == 1 {
+			e = events[0]
+		} else if len(events) > 0 {
+			t.Errorf("%s: audited %s", tt.name, data)
+		}
+		if !slices.Equal(e.Names, tt.audited) || strings.Contains(string(data), "two") {
+			t.Errorf("%s: audited %s, want names %v", tt.name, data, tt.audited)
+		}
+		if tt.reset != (githubApp.token == "") {
+			t.Errorf("%s: GitHub App token reset = %v, want %v", tt.name, githubApp.token == "", tt.reset)
+		}
+		if tt.name != "loaded" && len(tt.audited) > 0 && (len(hooked) != 1 || !slices.Equal(hooked[0], tt.audited)) {
+			t.Errorf("%s: hooks called with %v", tt.name, hooked)
+		}
+	}
+}
+
+func TestYankedTags(t *testing.T) {
+	t.Setenv("RELEASER_STATE_DIR", t.TempDir())
+	transport := registryHTTP.Transport
+	defer func() { registryHTTP.Transport = transport }()
+	registryHTTP.Transport = sandboxTransport{newSandboxRegistry()}
+	images := sandboxImages
+	defer func() { sandboxImages = images }()
+
+	var notified []string
+	var alerts []pagerDutyAlert
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pagerduty" {
+			var a pagerDutyAlert
+			json.NewDecoder(r.Body).Decode(&a)
+			alerts = append(alerts, a)
+			return
+		}
+		var body struct{ Text string }
+		json.NewDecoder(r.Body).Decode(&body)
+		notified = append(notified, body.Text)
+	}))
+	defer srv.Close()
+	t.Setenv("RELEASER_NOTIFY_WEBHOOK", srv.URL)
+	t.Setenv("RELEASER_PAGERDUTY_URL", srv.URL+"/pagerduty")
+	t.Setenv("RELEASER_PAGERDUTY_ROUTING_KEY", "routing")
+
+	backend, frontend := "singaravelan21/todo-backend", "singaravelan21/todo-frontend"
+	yanked := map[string][]string{backend: {"v1.0.0", "v1.1.1"}}
+	tests := []struct {
+		name string
+		mode string
+		tags map[string][]string
+		// frontend adds a service whose tag is only checked once gone.
+		frontend  bool
+		changes   []Change
+		notice    string
+		pinned    string
+		wantError bool
+	}{
+		{"present", "", nil, false, nil, "", "", false},
+		{"yanked", "notify", yanked, false, nil,
+			"`" + backend + ":v1.1.0` last pointed to `" + sandboxDigest(backend, "v1.1.0") + "`", "", false},
+		{"still yanked", "", yanked, false, nil, "", "", false},
+		{"pinned", "pin", map[string][]string{backend: {"v1.0.0", "v1.1.1"}, frontend: {"v1.2.0"}}, true,
+			[]Change{{Service: "todo-backend", From: "v1.1.0", To: shortDigest(sandboxDigest(backend, "v1.1.0"))}},
+			"`" + frontend + ":v1.1.0` has no recorded digest", backend + "@" + sandboxDigest(backend, "v1.1.0"), false},
+		{"invalid mode", "delete", nil, false, nil, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Setenv("RELEASER_YANKED_TAGS", tt.mode)
+		sandboxImages = nil
+		for _, img := range images {
+			if tags, ok := tt.tags[img.repo]; ok {
+				img.tags = tags
+			}
+			sandboxImages = append(sandboxImages, img)
+		}
+		notified, alerts = nil, nil
+		services := []manifest.Service{{Name: "todo-backend", Image: backend, Version: "v1.1.0"}}
+		if tt.frontend {
+			services = append(services, manifest.Service{Name: "todo-frontend", Image: frontend, Version: "v1.1.0"})
+		}
+		m := &manifest.Manifest{ReleaseVersion: "v202510.4.0", Services: slices.Clone(services)}
+
+		changes, err := checkYankedTags(context.Background(), m, services, nil)
+		if (err != nil) != tt.wantError {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		if fmt.Sprint(changes) != fmt.Sprint(tt.changes) {
+			t.Errorf("%s: changes %v, want %v", tt.name, changes, tt.changes)
+		}
+		if tt.notice == "" && (len(notified) > 0 || len(alerts) > 0) {
+			t.Errorf("%s: notified %q, paged %+v", tt.name, notified, alerts)
+		}
+		if tt.notice != "" && (len(notified) != 1 || !strings.Contains(notified[0], tt.notice) ||
+			len(alerts) != 1 || alerts[0].Payload.Severity != pagerDutyCritical || alerts[0].Payload.Class != "yanked-tag") {
+			t.Errorf("%s: notified %q, paged %+v, want a notice of %s", tt.name, notified, alerts, tt.notice)
+		}
+		if tt.pinned != "" && m.Services[0].Image != tt.pinned {
+			t.Errorf("%s: backend runs %s, want %s", tt.name, m.Services[0].Image, tt.pinned)
+		}
+	}
+}
+
+func TestBackport(t *testing.T) {
+	defer func(id string) { runID = id }(runID)
+	runID = "run1"
+	at := time.Date(2025, 10, 6, 12, 0, 0, 0, time.UTC)
+	released := &manifest.Manifest{ReleaseVersion: "v202538.1.2", Services: []manifest.Service{
+		{Name: "todo-backend", Image: "singaravelan21/todo-backend", Version: "v1.1.2",
+			LastBump: &manifest.Bump{At: at, From: "v1.1.1", Run: "run1"}},
+		{Name: "todo-frontend", Image: "singaravelan21/todo-frontend", Version: "v1.1.3",
+			LastBump: &manifest.Bump{At: at, From: "v1.1.2", Run: "run1"}},
+		{Name: "nginx", Image: "nginx@sha256:2222222222222222", Version: "1.27.3",
+			LastBump: &manifest.Bump{At: at, From: "1.27.3", FromDigest: "sha256:1111111111111111", Run: "run1"}},
+		{Name: "worker", Image: "acme/worker", Version: "v2.0.1",
+			LastBump: &manifest.Bump{At: at, From: "v2.0.0", Run: "earlier"}},
+	}}
+
+	entry := changelogEntry(released, "v202538.1.2", at)
+	wantEntry := "## v202538.1.2 - 2025-10-06\n\n" +
+		"- todo-backend: `v1.1.1` → `v1.1.2`\n" +
+		"- todo-frontend: `v1.1.2` → `v1.1.3`\n" +
+		"- nginx: `sha256:111111111111` → `sha256:222222222222`\n"
+	if entry != wantEntry {
+		t.Errorf("changelog entry:\n%s\nwant:\n%s", entry, wantEntry)
+	}
+
+	changelog := "# Changelog\n\n## v202540.0.0 - 2025-10-01\n\n- a\n\n## v202538.1.1 - 2025-09-20\n\n- b\n"
+	tests := []struct {
+		name, data, version string
+		want                string
+		added               bool
+	}{
+		{"empty", "", "v202538.1.2", "# Changelog\n\n" + entry, true},
+		{"between releases", changelog, "v202538.1.2",
+			"# Changelog\n\n## v202540.0.0 - 2025-10-01\n\n- a\n\n" + entry + "\n## v202538.1.1 - 2025-09-20\n\n- b\n", true},
+		{"oldest", changelog, "v202530.0.0", changelog + "\n" + strings.Replace(entry, "v202538.1.2", "v202530.0.0", 1), true},
+		{"already there", changelog, "v202538.1.1", changelog, false},
+	}
+	for _, tt := range tests {
+		e := strings.Replace(entry, "v202538.1.2", tt.version, 1)
+		got, added := insertChangelogEntry([]byte(tt.data), tt.version, e)
+		if string(got) != tt.want || added != tt.added {
+			t.Errorf("%s: inserted (%v):\n%s\nwant (%v):\n%s", tt.name, added, got, tt.added, tt.want)
+		}
+	}
+
+	file := filepath.Join(t.TempDir(), ChangelogFile)
+	os.WriteFile(file, []byte("# Changelog\n\n"+entry+"\n## v202538.1.1 - 2025-09-20\n\n- b\n"), 0644)
+	if got, err := changelogSection(file, "v202538.1.2"); got != entry || err != nil {
+		t.Errorf("changelog section %q, %v", got, err)
+	}
+
+	// master moved the frontend on already, and never saw the worker's
+	// earlier release.
+	target := &manifest.Manifest{ReleaseVersion: "v202540.0.0", Services: []manifest.Service{
+		{Name: "todo-backend", Image: "singaravelan21/todo-backend", Version: "v1.1.1"},
+		{Name: "todo-frontend", Image: "singaravelan21/todo-frontend", Version: "v1.2.0"},
+		{Name: "nginx", Image: "nginx@sha256:1111111111111111", Version: "1.27.3"},
+		{Name: "worker", Image: "acme/worker", Version: "v2.0.0"},
+	}}
+	changes := backportServices(target, released)
+	want := []Change{
+		{Service: "todo-backend", From: "v1.1.1", To: "v1.1.2"},
+		{Service: "nginx", From: "sha256:111111111111", To: "sha256:222222222222"},
+	}
+	if fmt.Sprint(changes) != fmt.Sprint(want) {
+		t.Errorf("backported %v, want %v", changes, want)
+	}
+	if target.Services[0].Version != "v1.1.2" || target.Services[1].Version != "v1.2.0" ||
+		target.Services[2].Image != "nginx@sha256:2222222222222222" || target.Services[3].Version != "v2.0.0" {
+		t.Errorf("backported manifest %+v", target.Services)
+	}
+}
+
+func TestReleaseSLO(t *testing.T) {
+	t.Setenv("RELEASER_STATE_DIR", t.TempDir())
+	transport := registryHTTP.Transport
+	defer func() { registryHTTP.Transport = transport }()
+	registryHTTP.Transport = sandboxTransport{newSandboxRegistry()}
+	defer func(c ClockSource) { Clock = c }(Clock)
+
+	created, _ := time.Parse(time.RFC3339, sandboxCreated)
+	backend, frontend := "singaravelan21/todo-backend", "singaravelan21/todo-frontend"
+	tests := []struct {
+		name    string
+		slo     string
+		after   time.Duration
+		changes []Change
+		// recorded is the delay of each release recorded, by service.
+		recorded map[string]time.Duration
+		services []ServiceSLO
+		types    []TypeSLO
+		missed   int
+	}{
+		{"patch within", "", 6 * time.Hour,
+			[]Change{{Service: "todo-backend", From: "v1.1.0", To: "v1.1.1"}},
+			map[string]time.Duration{"todo-backend": 6 * time.Hour},
+			[]ServiceSLO{{Service: "todo-backend", Releases: 1, Median: 6 * time.Hour, Max: 6 * time.Hour}},
+			[]TypeSLO{{Type: "patch", Target: 24 * time.Hour, Releases: 1, Within: 1}}, 0},
+		{"patch missed", "", 48 * time.Hour,
+			[]Change{{Service: "todo-backend", From: "v1.1.0", To: "v1.1.1"}, {Service: "todo-frontend", From: "v1.1.0", To: "v1.2.0"}},
+			map[string]time.Duration{"todo-backend": 48 * time.Hour, "todo-frontend": 48 * time.Hour},
+			[]ServiceSLO{{Service: "todo-backend", Releases: 2, Median: 48 * time.Hour, Max: 48 * time.Hour}, {Service: "todo-frontend", Releases: 1, Median: 48 * time.Hour, Max: 48 * time.Hour}},
+			[]TypeSLO{{Type: "patch", Target: 24 * time.Hour, Releases: 2, Within: 1}}, 1},
+		{"minor target", "patch=24h,minor=72h", 48 * time.Hour, nil, nil,
+			[]ServiceSLO{{Service: "todo-backend", Releases: 2, Median: 48 * time.Hour, Max: 48 * time.Hour}, {Service: "todo-frontend", Releases: 1, Median: 48 * time.Hour, Max: 48 * time.Hour}},
+			[]TypeSLO{{Type: "minor", Target: 72 * time.Hour, Releases: 1, Within: 1}, {Type: "patch", Target: 24 * time.Hour, Releases: 2, Within: 1}}, 1},
+		{"pin", "", 72 * time.Hour,
+			[]Change{{Service: "todo-backend", From: "v1.1.1", To: shortDigest(sandboxDigest(backend, "v1.1.1"))}}, nil,
+			[]ServiceSLO{{Service: "todo-backend", Releases: 2, Median: 48 * time.Hour, Max: 48 * time.Hour}, {Service: "todo-frontend", Releases: 1, Median: 48 * time.Hour, Max: 48 * time.Hour}},
+			[]TypeSLO{{Type: "patch", Target: 24 * time.Hour, Releases: 2, Within: 1}}, 1},
+		{"past the window", "", 40 * 24 * time.Hour, nil, nil, []ServiceSLO{}, []TypeSLO{{Type: "patch", Target: 24 * time.Hour}}, 0},
+	}
+	for _, tt := range tests {
+		t.Setenv("RELEASER_RELEASE_SLO", tt.slo)
+		Clock = fixedClock(created.Add(tt.after))
+		m := &manifest.Manifest{ReleaseVersion: "v202510.4.0", Services: []manifest.Service{
+			{Name: "todo-backend", Image: backend, Version: "v1.1.1"},
+			{Name: "todo-frontend", Image: frontend, Version: "v1.2.0"},
+		}}
+		before, _ := readReleasedTags()
+		recordTimeToRelease(context.Background(), m, &Result{Version: m.ReleaseVersion, Changes: tt.changes})
+
+		tags, err := readReleasedTags()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		recorded := map[string]time.Duration{}
+		for _, tag := range tags[len(before):] {
+			recorded[tag.Service] = tag.Delay()
+		}
+		if len(recorded) != len(tt.recorded) || fmt.Sprint(recorded) != fmt.Sprint(tt.recorded) {
+			t.Errorf("%s: recorded %v, want %v", tt.name, recorded, tt.recorded)
+		}
+
+		report, err := ReleaseSLO(Clock.Now().Add(-sloWindow))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for i := range report.Services {
+			report.Services[i].Breaches = nil
+		}
+		if fmt.Sprint(report.Services) != fmt.Sprint(tt.services) || fmt.Sprint(report.Types) != fmt.Sprint(tt.types) {
+			t.Errorf("%s: report %+v %+v, want %+v %+v", tt.name, report.Services, report.Types, tt.services, tt.types)
+		}
+		report, _ = ReleaseSLO(Clock.Now().Add(-sloWindow))
+		if report.Breaches() != tt.missed {
+			t.Errorf("%s: %d missed, want %d", tt.name, report.Breaches(), tt.missed)
+		}
+	}
+
+	t.Setenv("RELEASER_RELEASE_SLO", "security=24h")
+	if _, err := ReleaseSLO(time.Time{}); err == nil {
+		t.Error("an unknown update type was accepted")
+	}
+}
+
+func TestSecurityUpdates(t *testing.T) {
+	transport := registryHTTP.Transport
+	defer func() { registryHTTP.Transport = transport }()
+	registryHTTP.Transport = sandboxTransport{newSandboxRegistry()}
+	defer func(c *RenovateConfig) { renovate = c }(renovate)
+	renovate = nil
+
+	feed := filepath.Join(t.TempDir(), "cves.json")
+	os.WriteFile(feed, []byte(`[
+		{"id": "CVE-2025-0001", "package": "singaravelan21/todo-backend", "fixed": "v1.1.1"},
+		{"id": "CVE-2025-0002", "package": "nginx", "fixed": "1.27.3"},
+		{"id": "CVE-2025-0003", "package": "singaravelan21/*", "fixed": "v1.3.0"}
+	]`), 0644)
+	backend, frontend := "singaravelan21/todo-backend", "singaravelan21/todo-frontend"
+	tests := []struct {
+		name   string
+		feed   string
+		labels string
+		// security are the reasons found for each service's update.
+		security map[string]string
+		due      []string
+	}{
+		{"no feed", "", "", map[string]string{}, []string{"todo-frontend"}},
+		{"feed", feed, "", map[string]string{"todo-backend": "[CVE-2025-0001]", "nginx": "[CVE-2025-0002]"},
+			[]string{"todo-frontend", "todo-backend", "nginx"}},
+		{"label", "", LabelCreated + "=" + sandboxCreated, map[string]string{
+			"todo-backend": "[label " + LabelCreated + "=" + sandboxCreated + "]", "todo-frontend": "[label " + LabelCreated + "=" + sandboxCreated + "]",
+			"nginx": "[label " + LabelCreated + "=" + sandboxCreated + "]"}, []string{"todo-frontend"}},
+		{"other label value", "", LabelCreated + "=2020-01-01T00:00:00Z, security", map[string]string{}, []string{"todo-frontend"}},
+		{"unreadable feed", filepath.Join(t.TempDir(), "missing.json"), "", map[string]string{}, []string{"todo-frontend"}},
+	}
+	for _, tt := range tests {
+		t.Setenv("RELEASER_CVE_FEED", tt.feed)
+		t.Setenv("RELEASER_SECURITY_LABELS", tt.labels)
+		m := &manifest.Manifest{Services: []manifest.Service{
+			{Name: "todo-backend", Image: backend, Version: "v1.1.1"},
+			{Name: "todo-frontend", Image: frontend, Version: "v1.2.0"},
+			{Name: "nginx", Image: "nginx", Version: "1.27.3"},
+		}}
+		changes := []Change{
+			{Service: "todo-backend", From: "v1.1.0", To: "v1.1.1"},
+			{Service: "todo-frontend", From: "v1.1.0", To: "v1.2.0"},
+			{Service: "nginx", From: "1.27.2", To: "1.27.3"},
+		}
+		markSecurity(context.Background(), m, changes)
+		security := map[string]string{}
+		for _, c := range changes {
+			if c.Security != nil {
+				security[c.Service] = fmt.Sprint(c.Security)
+			}
+		}
+		if !maps.Equal(security, tt.security) {
+			t.Errorf("%s: security %v, want %v", tt.name, security, tt.security)
+		}
+		for _, u := range updateBranches(m, changes) {
+			if slices.Contains(u.Labels, SecurityLabel) != (tt.security[u.Service] != "") {
+				t.Errorf("%s: %s labelled %v", tt.name, u.Service, u.Labels)
+			}
+		}
+
+		// The services before the update, running vulnerable versions.
+		m.Services[0].Version, m.Services[1].Version, m.Services[2].Version = "v1.1.0", "v1.1.0", "1.27.2"
+		advised := map[string]bool{}
+		due := securityDue(m, []string{"todo-frontend"}, advised)
+		if !slices.Equal(due, tt.due) {
+			t.Errorf("%s: due %v, want %v", tt.name, due, tt.due)
+		}
+		if due := securityDue(m, []string{"todo-frontend"}, advised); !slices.Equal(due, []string{"todo-frontend"}) {
+			t.Errorf("%s: advisories brought %v forward again", tt.name, due)
+		}
+	}
+
+	t.Setenv("RELEASER_SECURITY_APPROVAL", "skip")
+	if _, err := securityApproval(); err == nil {
+		t.Error("an unknown approval policy was accepted")
+	}
+}
+
+func TestCVEFixes(t *testing.T) {
+	transport := registryHTTP.Transport
+	defer func() { registryHTTP.Transport = transport }()
+	registryHTTP.Transport = sandboxTransport{newSandboxRegistry()}
+	defer func(id string) { runID = id }(runID)
+	runID = "run1"
+	defer func() { fixesCache.fixes = nil }()
+
+	backend := "singaravelan21/todo-backend"
+	revision := func(tag string) string { return sandboxDigest(backend, tag)[len("sha256:"):][:40] }
+	vulns := map[string][]osvVuln{
+		revision("v1.1.0"):             {{ID: "GHSA-aaaa", Aliases: []string{"CVE-2025-0001"}}, {ID: "CVE-2025-0002"}, {ID: "GO-2025-0003"}},
+		revision("v1.1.1"):             {{ID: "GO-2025-0003"}},
+		"pkg:docker/acme/api 1.0.0":    {{ID: "OSV-2025-0004"}},
+		"pkg:docker/acme/worker 1.0.0": {{ID: "CVE-2025-0005"}},
+	}
+	var queries int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var q osvQuery
+		json.NewDecoder(r.Body).Decode(&q)
+		queries++
+		key := q.Commit
+		if q.Package != nil {
+			key = q.Package.PURL + " " + q.Version
+		}
+		if key == "pkg:docker/acme/worker 1.1.0" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"vulns": vulns[key]})
+	}))
+	defer srv.Close()
+	t.Setenv("RELEASER_OSV_URL", srv.URL)
+
+	bump := &manifest.Bump{From: "v1.1.0", Run: runID}
+	m := &manifest.Manifest{Services: []manifest.Service{
+		{Name: "todo-backend", Image: backend, Version: "v1.1.1", LastBump: bump},
+		{Name: "api", Image: "acme/api", Version: "1.1.0", LastBump: &manifest.Bump{From: "1.0.0", Run: runID}},
+		{Name: "worker", Image: "acme/worker", Version: "1.1.0", LastBump: &manifest.Bump{From: "1.0.0", Run: runID}},
+	}}
+	tests := []struct {
+		name   string
+		lookup string
+		fixes  map[string]string
+		// changelog is a line the changelog entry has.
+		changelog string
+		queries   int
+	}{
+		{"off", "", map[string]string{}, "- todo-backend: `v1.1.0` → `v1.1.1`\n", 0},
+		{"osv", "osv", map[string]string{"todo-backend": "[CVE-2025-0001 CVE-2025-0002]", "api": "[OSV-2025-0004]"},
+			"- todo-backend: `v1.1.0` → `v1.1.1` (fixes CVE-2025-0001, CVE-2025-0002)\n", 6},
+		{"cached", "osv", map[string]string{"todo-backend": "[CVE-2025-0001 CVE-2025-0002]", "api": "[OSV-2025-0004]"},
+			"- api: `1.0.0` → `1.1.0` (fixes OSV-2025-0004)\n", 2},
+		{"invalid", "nvd", map[string]string{}, "- worker: `1.0.0` → `1.1.0`\n", 0},
+	}
+	for _, tt := range tests {
+		t.Setenv("RELEASER_CVE_LOOKUP", tt.lookup)
+		queries = 0
+		changes := []Change{
+			{Service: "todo-backend", From: "v1.1.0", To: "v1.1.1"},
+			{Service: "api", From: "1.0.0", To: "1.1.0"},
+			{Service: "worker", From: "1.0.0", To: "1.1.0"},
+		}
+		annotateFixes(context.Background(), m, changes)
+		fixes := map[string]string{}
+		for _, c := range changes {
+			if len(c.Fixes) > 0 {
+				fixes[c.Service] = fmt.Sprint(c.Fixes)
+			}
+		}
+		if !maps.Equal(fixes, tt.fixes) {
+			t.Errorf("%s: fixes %v, want %v", tt.name, fixes, tt.fixes)
+		}
+		if queries != tt.queries {
+			t.Errorf("%s: %d OSV queries, want %d", tt.name, queries, tt.queries)
+		}
+		if entry := changelogEntry(m, "v202510.4.0", time.Time{}); !strings.Contains(entry, tt.changelog) {
+			t.Errorf("%s: changelog entry %q, missing %q", tt.name, entry, tt.changelog)
+		}
+		body := updatePRBody(updateBranches(m, changes)[0])
+		if strings.Contains(body, "fixes CVE-2025-0001, CVE-2025-0002") != (tt.fixes["todo-backend"] != "") {
+			t.Errorf("%s: pull request body %q", tt.name, body)
+		}
+	}
+}
+
+func TestReleaseLocks(t *testing.T) {
+	leader := []string{"v1.3.0", "v1.2.0", "v1.1.0", "v1.0.0"}
+	behind := []struct {
+		version string
+		want    []string
+		ok      bool
+	}{
+		{"v1.3.0", []string{}, true},
+		{"v1.2.0", []string{"v1.3.0"}, true},
+		{"v1.0.0", []string{"v1.3.0", "v1.2.0", "v1.1.0"}, true},
+		{"v1.2.5", []string{"v1.3.0"}, true},
+		{"v1.4.0", nil, true},
+		{"sha256:0123abcd", nil, false},
+	}
+	for _, tt := range behind {
+		got, ok := releasesBehind(leader, tt.version)
+		if !slices.Equal(got, tt.want) || ok != tt.ok {
+			t.Errorf("releasesBehind(%s) = %v, %v, want %v, %v", tt.version, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+
+	// The leader: staging, whose manifest moved the shared auth image on
+	// three times.
+	origin := filepath.Join(dir, "origin")
+	if err := os.MkdirAll(origin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(origin); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gitOutput("init", "-q", "-b", "staging"); err != nil {
+		t.Skip("git unavailable:", err)
+	}
+	for _, version := range []string{"v1.0.0", "v1.1.0", "v1.1.0", "v1.2.0"} {
+		data := `{"release_version": "v202540.0.0", "services": [{"name": "todo-auth", "image": "acme/auth", "version": "` + version + `"}]}`
+		if err := os.WriteFile(ManifestFile, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, args := range [][]string{
+			{"add", ManifestFile},
+			{"-c", "user.name=t", "-c", "user.email=t@example.com", "commit", "-q", "--allow-empty", "-m", "release"},
+		} {
+			if _, err := gitOutput(args...); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	work := filepath.Join(dir, "work")
+	if err := os.MkdirAll(work, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(work); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{{"init", "-q"}, {"remote", "add", "origin", "file://" + origin}} {
+		if _, err := gitOutput(args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	prod := func(version string) *manifest.Manifest {
+		return &manifest.Manifest{ReleaseVersion: "v202540.0.0", Services: []manifest.Service{{Name: "todo-auth", Image: "acme/auth", Version: version}}}
+	}
+	if err := checkLocks(prod("v0.1.0")); err != nil {
+		t.Errorf("checkLocks() without %s = %v", LocksFile, err)
+	}
+
+	tests := []struct {
+		name    string
+		locks   string
+		version string
+		wantErr string
+	}{
+		{"level", `{"locks": [{"service": "todo-auth", "leader": "staging", "max_behind": 1}]}`, "v1.2.0", ""},
+		{"one behind", `{"locks": [{"service": "todo-auth", "leader": "staging", "max_behind": 1}]}`, "v1.1.0", ""},
+		{"two behind", `{"locks": [{"service": "todo-auth", "leader": "staging", "max_behind": 1}]}`, "v1.0.0",
+			"todo-auth at v1.0.0 is 2 releases behind staging, which has run v1.2.0, v1.1.0 since; at most 1 allowed"},
+		{"lockstep", `{"locks": [{"service": "todo-auth", "leader": "staging"}]}`, "v1.1.0",
+			"todo-auth at v1.1.0 is 1 release behind staging, which has run v1.2.0 since; at most 0 allowed"},
+		{"never released there", `{"locks": [{"service": "todo-auth", "leader": "staging", "max_behind": 1}]}`, "v0.9.0",
+			"todo-auth at v0.9.0 is 3 releases behind staging"},
+		{"not in the leader", `{"locks": [{"service": "todo-mail", "leader": "staging"}]}`, "v1.2.0", "todo-mail is locked to staging but isn't in the manifest"},
+		{"no leader branch", `{"locks": [{"service": "todo-auth", "leader": "qa"}]}`, "v1.2.0", "error fetching qa"},
+		{"invalid", `{"locks": [{"service": "todo-auth"}]}`, "v1.2.0", "need a service, a leader branch"},
+	}
+	for _, tt := range tests {
+		if err := os.WriteFile(LocksFile, []byte(tt.locks), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := checkLocks(prod(tt.version))
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: checkLocks() = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestReleaseHistory(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if _, err := gitOutput("init", "-q"); err != nil {
+		t.Skip("git unavailable:", err)
+	}
+	releases := []struct {
+		tag, date, backend, frontend string
+	}{
+		{"v202501.0.0", "2025-01-06T10:00:00Z", "v1.0.0", "v1.0.0"},
+		{"v202501.1.0", "2025-01-20T10:00:00Z", "v1.1.0", "v1.0.0"},
+		{"v202502.0.0", "2025-02-03T10:00:00Z", "v1.1.0", "v1.1.0"},
+		{"v202502.1.0", "2025-02-17T10:00:00Z", "v1.2.0", "v1.1.0"},
+	}
+	for _, r := range releases {
+		data := `{"release_version": "` + r.tag + `", "services": [` +
+			`{"name": "todo-backend", "image": "acme/backend", "version": "` + r.backend + `"}, ` +
+			`{"name": "todo-frontend", "image": "acme/frontend", "version": "` + r.frontend + `"}]}`
+		if err := os.WriteFile(ManifestFile, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("GIT_COMMITTER_DATE", r.date)
+		for _, args := range [][]string{
+			{"add", ManifestFile},
+			{"-c", "user.name=t", "-c", "user.email=t@example.com", "commit", "-q", "-m", r.tag},
+			{"tag", r.tag},
+		} {
+			if _, err := gitOutput(args...); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := gitOutput("tag", "not-a-release"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query  string
+		status int
+		tags   []string
+		next   string
+	}{
+		{"", http.StatusOK, []string{"v202502.1.0", "v202502.0.0", "v202501.1.0", "v202501.0.0"}, ""},
+		{"?sort=oldest&limit=3", http.StatusOK, []string{"v202501.0.0", "v202501.1.0", "v202502.0.0"}, "v202502.0.0"},
+		{"?sort=oldest&limit=3&cursor=v202502.0.0", http.StatusOK, []string{"v202502.1.0"}, ""},
+		{"?limit=1&cursor=v202502.1.0", http.StatusOK, []string{"v202502.0.0"}, "v202502.0.0"},
+		{"?since=2025-01-20T10:00:00Z&until=2025-02-17T10:00:00Z", http.StatusOK, []string{"v202502.0.0", "v202501.1.0"}, ""},
+		{"?service=todo-frontend", http.StatusOK, []string{"v202502.0.0", "v202501.0.0"}, ""},
+		{"?service=todo-frontend,todo-backend&since=2025-01-07T00:00:00Z", http.StatusOK, []string{"v202502.1.0", "v202502.0.0", "v202501.1.0"}, ""},
+		{"?service=todo-backend&limit=1", http.StatusOK, []string{"v202502.1.0"}, "v202502.1.0"},
+		{"?service=todo-mail", http.StatusOK, []string{}, ""},
+		{"?sort=biggest", http.StatusBadRequest, nil, ""},
+		{"?limit=0", http.StatusBadRequest, nil, ""},
+		{"?since=yesterday", http.StatusBadRequest, nil, ""},
+		{"?cursor=v202412.0.0", http.StatusBadRequest, nil, ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handleReleases(rec, httptest.NewRequest(http.MethodGet, "/releases"+tt.query, nil))
+		if rec.Code != tt.status {
+			t.Errorf("GET /releases%s = %d %s, want %d", tt.query, rec.Code, rec.Body, tt.status)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		var page ReleasePage
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		var tags []string
+		for _, r := range page.Releases {
+			tags = append(tags, r.Tag)
+		}
+		if !slices.Equal(tags, tt.tags) || page.Next != tt.next {
+			t.Errorf("GET /releases%s = %v, next %q, want %v, next %q", tt.query, tags, page.Next, tt.tags, tt.next)
+		}
+		if link := rec.Header().Get("Link"); (link != "") != (tt.next != "") || tt.next != "" && !strings.Contains(link, "cursor="+tt.next) {
+			t.Errorf("GET /releases%s Link = %q", tt.query, link)
+		}
+	}
+
+	page, err := ReleaseHistory(HistoryQuery{Oldest: true, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Release{
+		{Tag: "v202501.0.0", Time: time.Date(2025, 1, 6, 10, 0, 0, 0, time.UTC), Services: map[string]string{"todo-backend": "v1.0.0", "todo-frontend": "v1.0.0"}, Changed: []string{"todo-backend", "todo-frontend"}},
+		{Tag: "v202501.1.0", Time: time.Date(2025, 1, 20, 10, 0, 0, 0, time.UTC), Services: map[string]string{"todo-backend": "v1.1.0", "todo-frontend": "v1.0.0"}, Changed: []string{"todo-backend"}},
+	}
+	if !reflect.DeepEqual(page.Releases, want) {
+		t.Errorf("ReleaseHistory() = %+v, want %+v", page.Releases, want)
+	}
+}
+
+func TestStateStore(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("RELEASER_STATE_DIR", dir)
+	t.Setenv("RELEASER_STATE_STORE", "")
+	t.Setenv("RELEASER_STATE_DSN", "")
+	t.Setenv("RELEASER_AUDIT_LOG", "")
+	defer closeStateStore()
+	now := time.Date(2025, 2, 10, 12, 0, 0, 0, time.UTC)
+
+	// State kept in files before is imported once, then only the store
+	// is read.
+	files := map[string]string{
+		"freeze.json": `{"reason": "launch", "since": "2025-02-10T09:00:00Z"}`,
+		"agents.json": `{"prod-1": {"version": "v202502.0.0", "state": "deployed", "deployed": "v202502.0.0"}}`,
+		"audit.jsonl": `{"time": "2025-02-09T09:00:00Z", "action": "secrets.rotated"}` + "\n",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := CurrentFreeze(now)
+	if err != nil || f == nil || f.Reason != "launch" {
+		t.Fatalf("CurrentFreeze() = %+v, %v, want the freeze from freeze.json", f, err)
+	}
+	reports, err := AgentReports()
+	if err != nil || reports["prod-1"].Deployed != "v202502.0.0" {
+		t.Errorf("AgentReports() = %+v, %v", reports, err)
+	}
+	audit(AuditEvent{Action: "freeze.bypassed"})
+	events, err := readAuditLog()
+	if err != nil || len(events) != 2 || events[0].Action != "secrets.rotated" || events[1].Action != "freeze.bypassed" {
+		t.Errorf("readAuditLog() = %+v, %v", events, err)
+	}
+	for name := range files {
+		if _, err := os.Stat(filepath.Join(dir, name)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s not imported: %v", name, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, name+".imported")); err != nil {
+			t.Errorf("%s not kept after importing: %v", name, err)
+		}
+	}
+
+	if err := SetFreeze(nil); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := CurrentFreeze(now); err != nil || f != nil {
+		t.Errorf("CurrentFreeze() after lifting = %+v, %v", f, err)
+	}
+	closeStateStore()
+	if reports, err := AgentReports(); err != nil || len(reports) != 1 {
+		t.Errorf("AgentReports() after reopening = %+v, %v", reports, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "state.db")); err != nil {
+		t.Errorf("no SQLite database in the state dir: %v", err)
+	}
+
+	tests := []struct {
+		store, dsn string
+		wantErr    string
+	}{
+		{"postgres", "", "RELEASER_STATE_STORE: postgres needs RELEASER_STATE_DSN"},
+		{"etcd", "", `RELEASER_STATE_STORE: "etcd" must be sqlite or postgres`},
+		{"sqlite", filepath.Join(t.TempDir(), "moved.db"), ""},
+	}
+	for _, tt := range tests {
+		t.Setenv("RELEASER_STATE_STORE", tt.store)
+		t.Setenv("RELEASER_STATE_DSN", tt.dsn)
+		_, err := AgentReports()
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+			t.Errorf("RELEASER_STATE_STORE=%s: AgentReports() = %v, want %q", tt.store, err, tt.wantErr)
+		}
+	}
+	if _, err := os.Stat(tests[2].dsn); err != nil {
+		t.Errorf("RELEASER_STATE_DSN didn't move the SQLite database: %v", err)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("RELEASER_STATE_DIR", dir)
+	t.Setenv("RELEASER_STATE_STORE", "")
+	t.Setenv("RELEASER_STATE_DSN", "")
+	t.Setenv("RELEASER_AUDIT_LOG", "")
+	defer closeStateStore()
+	now := time.Date(2025, 2, 10, 12, 0, 0, 0, time.UTC)
+
+	if err := SetFreeze(&Freeze{Reason: "launch", Since: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordAgentReport("prod-1", agent.Report{Version: "v202502.0.0", State: agent.StateDeployed}); err != nil {
+		t.Fatal(err)
+	}
+	audit(AuditEvent{Action: "secrets.rotated", Names: []string{"RELEASER_API_TOKEN"}})
+	for name, data := range map[string]string{"pki/ca.pem": "ca", "repo/release_manifest.json": "{}", "tags.json.imported": "{}"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0700)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backups, err := blobstore.Open(blobstore.Config{Driver: blobstore.Local, Path: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, err := backupTo(context.Background(), backups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := path.Base(url)
+	r, err := backups.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("backup %s not stored: %v", url, err)
+	}
+	defer r.Close()
+	var backup bytes.Buffer
+	if _, err := io.Copy(&backup, r); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := t.TempDir()
+	if err := extractState(bytes.NewReader(backup.Bytes()), entries); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	filepath.WalkDir(entries, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			rel, _ := filepath.Rel(entries, p)
+			names = append(names, filepath.ToSlash(rel))
+		}
+		return err
+	})
+	want := []string{"backup.json", "files/pki/ca.pem", "logs/audit.jsonl", "state/agents.json", "state/freeze.json"}
+	if !slices.Equal(names, want) {
+		t.Errorf("backup holds %v, want %v", names, want)
+	}
+
+	// Restore into a new state dir, as on a rebuilt controlplane.
+	restored := t.TempDir()
+	t.Setenv("RELEASER_STATE_DIR", restored)
+	if err := Restore(bytes.NewReader(backup.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := CurrentFreeze(now); err != nil || f == nil || f.Reason != "launch" {
+		t.Errorf("CurrentFreeze() after restoring = %+v, %v", f, err)
+	}
+	if reports, err := AgentReports(); err != nil || reports["prod-1"].Deployed != "v202502.0.0" {
+		t.Errorf("AgentReports() after restoring = %+v, %v", reports, err)
+	}
+	events, err := readAuditLog()
+	if err != nil || len(events) != 2 || events[0].Action != "secrets.rotated" || events[1].Action != "state.restored" {
+		t.Errorf("readAuditLog() after restoring = %+v, %v", events, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(restored, "pki", "ca.pem")); err != nil || string(data) != "ca" {
+		t.Errorf("pki/ca.pem restored as %q, %v", data, err)
+	}
+
+	var notBackup bytes.Buffer
+	if err := archiveState(&notBackup, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{"not gzip": []byte("state"), "no backup.json": notBackup.Bytes()} {
+		if err := Restore(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: Restore() succeeded", name)
+		}
+	}
+}
+
+func TestInterruptedRelease(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	t.Setenv("RELEASER_STATE_DIR", t.TempDir())
+	for _, name := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		t.Setenv(name, "t")
+	}
+	for _, name := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(name, "t@example.com")
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	const original = `{"release_version": "v202501.0.0", "services": [{"name": "todo-api", "image": "acme/api", "version": "v1.0.0"}]}`
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		env  map[string]string
+		// taken tags the release's version before it is made.
+		taken   bool
+		want    string
+		wantErr bool
+	}{
+		{"interrupted", cancelled, nil, false, "", true},
+		{"tag taken", context.Background(), nil, true, "", true},
+		{"released", context.Background(), nil, false, "v202501.0.1", false},
+		{"deploy times out", context.Background(), map[string]string{"RELEASER_DEPLOY_COMMAND": "sleep 5", "RELEASER_DEPLOY_TIMEOUT": "100ms"}, false, "v202501.0.1", true},
+	}
+	for _, tt := range tests {
+		for _, name := range []string{"RELEASER_DEPLOY_COMMAND", "RELEASER_DEPLOY_TIMEOUT"} {
+			t.Setenv(name, tt.env[name])
+		}
+		if err := os.Chdir(t.TempDir()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := gitOutput("init", "-q"); err != nil {
+			t.Skip("git unavailable:", err)
+		}
+		if err := os.WriteFile(ManifestFile, []byte(original), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, args := range [][]string{{"add", ManifestFile}, {"commit", "-q", "-m", "init"}} {
+			if _, err := gitOutput(args...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tt.taken {
+			if _, err := gitOutput("tag", "v202501.0.1"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		head, _ := gitOutput("rev-parse", "HEAD")
+
+		m, err := manifest.Parse([]byte(original))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.SetVersion(0, "v1.1.0", "test", time.Now())
+		start := time.Now()
+		version, err := releaseAs(tt.ctx, m, "v202501.0.1", "chore: update services to latest versions")
+		if version != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("%s: releaseAs() = %q, %v, want %q, wantErr %v", tt.name, version, err, tt.want, tt.wantErr)
+		}
+		if time.Since(start) > 4*time.Second {
+			t.Errorf("%s: releaseAs() took %v", tt.name, time.Since(start))
+		}
+		after, _ := gitOutput("rev-parse", "HEAD")
+		status, _ := gitOutput("status", "--porcelain")
+		tagged, _ := gitOutput("rev-parse", "--verify", "-q", "v202501.0.1^{commit}")
+		if tt.want != "" {
+			if after == head || tagged != after {
+				t.Errorf("%s: HEAD %s, tag at %q, want the release tagged", tt.name, after, tagged)
+			}
+			continue
+		}
+		if after != head || status != "" {
+			t.Errorf("%s: left HEAD at %s (was %s) with changes %q, want the checkout as it was", tt.name, after, head, status)
+		}
+		if data, _ := os.ReadFile(ManifestFile); string(data) != original {
+			t.Errorf("%s: left the manifest as %s", tt.name, data)
+		}
+		if tt.taken != (tagged == head) {
+			t.Errorf("%s: tag at %q, want it kept only when it was there before", tt.name, tagged)
+		}
+	}
+
+	for _, tt := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", DefaultGitTimeout},
+		{"90s", 90 * time.Second},
+		{"0s", DefaultGitTimeout},
+		{"soon", DefaultGitTimeout},
+	} {
+		t.Setenv("RELEASER_GIT_TIMEOUT", tt.value)
+		if got := phaseTimeout("RELEASER_GIT_TIMEOUT", DefaultGitTimeout); got != tt.want {
+			t.Errorf("phaseTimeout(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	t.Setenv("RELEASER_STATE_DIR", t.TempDir())
+	defer closeStateStore()
+	for _, name := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		t.Setenv(name, "t")
+	}
+	for _, name := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(name, "t@example.com")
+	}
+	for _, name := range []string{"RELEASER_REPO_URL", "RELEASER_TAG_NAMESPACE", "RELEASER_UPDATE_MODE", "RELEASER_DEPLOY_COMMAND", "GITHUB_TOKEN"} {
+		t.Setenv(name, "")
+	}
+	transport := registryHTTP.Transport
+	defer func() { registryHTTP.Transport = transport }()
+	defer func() { registryClients = map[string]*cachedRegistryClient{} }()
+	// Runs cut short leave what they saw unrecorded, for TestReplay to find.
+	defer recordRegistryHistory(time.Now())
+	ghcr := &testRegistry{manifests: map[string][2]string{}, blobs: map[string][]byte{}}
+	registryHTTP.Transport = sandboxTransport{ghcr}
+	for _, image := range []string{"acme/api:v1.0.0", "acme/api:v1.1.0", "acme/worker:v2.0.0"} {
+		repo, tag, _ := strings.Cut(image, ":")
+		ghcr.put(repo, tag, "application/vnd.oci.image.manifest.v1+json", []byte(`{"tag": "`+tag+`"}`))
+	}
+	defer func(c ClockSource) { Clock = c }(Clock)
+	Clock = fixedClock(time.Date(2026, time.March, 4, 12, 0, 0, 0, time.UTC))
+	const original = `{"release_version": "v202601.0.0", "services": [
+		{"name": "api", "image": "ghcr.io/acme/api", "version": "v1.0.0"},
+		{"name": "worker", "image": "ghcr.io/acme/worker", "version": "v2.0.0"}]}`
+
+	tests := []struct {
+		name     string
+		due      []string
+		renovate string
+		// want is the version the release is tagged with, "" for none.
+		want    string
+		wantAPI string
+	}{
+		{"update", nil, "", calverPrefix(Clock.Now()) + ".1.0", "v1.1.0"},
+		{"due", []string{"api"}, "", calverPrefix(Clock.Now()) + ".1.0", "v1.1.0"},
+		{"not due", []string{"worker"}, "", "", "v1.0.0"},
+		{"ignored", nil, `{"ignoreDeps": ["ghcr.io/acme/api"]}`, "", "v1.0.0"},
+	}
+	for _, tt := range tests {
+		registryClients = map[string]*cachedRegistryClient{}
+		if err := os.Chdir(t.TempDir()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := gitOutput("init", "-q"); err != nil {
+			t.Skip("git unavailable:", err)
+		}
+		if err := os.WriteFile(ManifestFile, []byte(original), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if tt.renovate != "" {
+			if err := os.WriteFile("renovate.json", []byte(tt.renovate), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, args := range [][]string{{"add", "."}, {"commit", "-q", "-m", "init"}} {
+			if _, err := gitOutput(args...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		head, _ := gitOutput("rev-parse", "HEAD")
+
+		result, err := reconcile(context.Background(), tt.due)
+		if err != nil {
+			t.Errorf("%s: reconcile() error: %v", tt.name, err)
+			continue
+		}
+		var version string
+		if result != nil {
+			version = result.Version
+		}
+		if version != tt.want {
+			t.Errorf("%s: released %q, want %q", tt.name, version, tt.want)
+		}
+		m, err := loadManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if api := m.Services[0].Version; api != tt.wantAPI {
+			t.Errorf("%s: api at %s, want %s", tt.name, api, tt.wantAPI)
+		}
+		after, _ := gitOutput("rev-parse", "HEAD")
+		tagged, _ := gitOutput("rev-parse", "--verify", "-q", tt.want+"^{commit}")
+		switch {
+		case tt.want == "" && after != head:
+			t.Errorf("%s: committed %s, want nothing released", tt.name, after)
+		case tt.want != "" && (after == head || tagged != after):
+			t.Errorf("%s: HEAD %s, tag at %q, want the release committed and tagged", tt.name, after, tagged)
+		}
+		if result != nil && (len(result.Changes) != 1 || result.Changes[0].Service != "api" || result.Changes[0].To != "v1.1.0") {
+			t.Errorf("%s: changes %+v, want api to v1.1.0", tt.name, result.Changes)
+		}
+	}
+}
+
+func TestCheckFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		ref      string
+		err      error
+		failure  string
+		registry string
+	}{
+		{"budget spent", "nginx", fmt.Errorf("hub: %w", ratelimit.ErrBudgetExhausted), FailureRateLimited, "docker.io"},
+		{"too many requests", "nginx", &statusError{"docker hub", http.StatusTooManyRequests}, FailureRateLimited, "docker.io"},
+		{"unauthorized", "ghcr.io/acme/api", &statusError{"ghcr", http.StatusUnauthorized}, FailureAuth, "ghcr.io"},
+		{"forbidden", "ghcr.io/acme/api", &statusError{"ghcr", http.StatusForbidden}, FailureAuth, "ghcr.io"},
+		{"no such repository", "acme/gone", &statusError{"docker hub", http.StatusNotFound}, FailureNotFound, "docker.io"},
+		{"no such tag", "acme/api", fmt.Errorf("acme/api:v9: %w", errTagNotFound), FailureNotFound, "docker.io"},
+		{"registry down", "acme/api", &statusError{"docker hub", http.StatusBadGateway}, FailureNetwork, "docker.io"},
+		{"connection refused", "registry.internal:5000/api", &url.Error{Op: "Get", URL: "https://registry.internal:5000/v2/", Err: errors.New("connection refused")}, FailureNetwork, "registry.internal:5000"},
+		{"timed out", "acme/api", fmt.Errorf("lookup: %w", context.DeadlineExceeded), FailureNetwork, "docker.io"},
+		{"outside the policy", "ghcr.io/acme/api", policyError{errors.New("plugin ghcr returned v2.0.0, which is not in ~1.2")}, FailurePolicy, "ghcr.io"},
+		{"other", "acme/api", errors.New("unexpected end of JSON input"), FailureOther, "docker.io"},
+	}
+	var checks []ServiceCheck
+	for _, tt := range tests {
+		c := ServiceCheck{Name: tt.name}
+		c.fail(tt.ref, tt.err)
+		if c.Failure != tt.failure || c.Registry != tt.registry || c.Error == "" {
+			t.Errorf("%s: check failed as %q at %q (%q), want %q at %q", tt.name, c.Failure, c.Registry, c.Error, tt.failure, tt.registry)
+		}
+		checks = append(checks, c)
+	}
+	checks = append(checks, ServiceCheck{Name: "up to date"})
+
+	var got []string
+	for _, g := range failureGroups(checks) {
+		got = append(got, g.String())
+	}
+	want := []string{
+		"2 services skipped: rate-limited by docker.io",
+		"2 services skipped: access denied by ghcr.io",
+		"2 services skipped: not found on docker.io",
+		"2 services skipped: could not reach docker.io",
+		"1 service skipped: could not reach registry.internal:5000",
+		"1 service skipped: nothing the release policy allows on ghcr.io",
+		"1 service skipped: failed on docker.io",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("failureGroups() = %q, want %q", got, want)
+	}
+}
+
+func TestImport(t *testing.T) {
+	transport := registryHTTP.Transport
+	defer func() { registryHTTP.Transport = transport }()
+	registryHTTP.Transport = sandboxTransport{newSandboxRegistry()}
+
+	backend := "singaravelan21/todo-backend"
+	built := "sha256:" + strings.Repeat("b", 64)
+	engine := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/containers/json":
+			json.NewEncoder(w).Encode([]map[string]any{
+				{"Names": []string{"/todo-backend-1"}, "Image": backend + ":v1.1.1", "ImageID": "sha256:b1", "Labels": map[string]string{agent.ComposeServiceLabel: "todo-backend"}},
+				{"Names": []string{"/todo-backend-2"}, "Image": backend + ":v1.1.1", "ImageID": "sha256:b1", "Labels": map[string]string{agent.ComposeServiceLabel: "todo-backend"}},
+				{"Names": []string{"/nginx-1"}, "Image": "nginx", "ImageID": "sha256:n1", "Labels": map[string]string{agent.ComposeServiceLabel: "nginx"}},
+				{"Names": []string{"/worker-1"}, "Image": built, "ImageID": built, "Labels": map[string]string{agent.ComposeServiceLabel: "worker"}},
+			})
+		case "/images/sha256:b1/json":
+			fmt.Fprintf(w, `{"RepoDigests": [%q]}`, backend+"@sha256:0b1")
+		case "/images/sha256:n1/json":
+			w.Write([]byte(`{"RepoDigests": ["nginx@sha256:0n1"]}`))
+		case "/images/" + built + "/json":
+			w.Write([]byte(`{"RepoDigests": []}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer engine.Close()
+	host := "tcp://" + strings.TrimPrefix(engine.URL, "http://")
+
+	dir := t.TempDir()
+	compose := filepath.Join(dir, "compose.yaml")
+	if err := os.WriteFile(compose, []byte(`services:
+  todo-backend:
+    image: ${BACKEND_IMAGE:-singaravelan21/todo-backend}:v1.1.1
+  nginx:
+    image: nginx:$NGINX_TAG
+  worker:
+    build: ./worker
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	unset := filepath.Join(dir, "unset.yaml")
+	if err := os.WriteFile(unset, []byte("services:\n  api:\n    image: acme/api:${API_TAG}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	existing := filepath.Join(dir, "existing.json")
+	if err := os.WriteFile(existing, []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("NGINX_TAG", "1.27.3")
+	nginx := sandboxDigest("library/nginx", "1.27.3")
+
+	tests := []struct {
+		name string
+		opts ImportOptions
+		want []manifest.Service
+	}{
+		{"host", ImportOptions{Host: host}, []manifest.Service{
+			{Name: "nginx", Image: "nginx@sha256:0n1"},
+			{Name: "todo-backend", Image: backend, Version: "v1.1.1"},
+		}},
+		{"host pinned", ImportOptions{Host: host, Pin: true}, []manifest.Service{
+			{Name: "nginx", Image: "nginx@sha256:0n1"},
+			{Name: "todo-backend", Image: backend + "@sha256:0b1", Version: "v1.1.1"},
+		}},
+		{"compose", ImportOptions{Compose: compose}, []manifest.Service{
+			{Name: "nginx", Image: "nginx", Version: "1.27.3"},
+			{Name: "todo-backend", Image: backend, Version: "v1.1.1"},
+		}},
+		{"compose pinned", ImportOptions{Compose: compose, Pin: true}, []manifest.Service{
+			{Name: "nginx", Image: "nginx@" + nginx, Version: "1.27.3"},
+			{Name: "todo-backend", Image: backend + "@" + sandboxDigest(backend, "v1.1.1"), Version: "v1.1.1"},
+		}},
+		{"unset variable", ImportOptions{Compose: unset}, nil},
+		{"neither", ImportOptions{}, nil},
+		{"both", ImportOptions{Host: host, Compose: compose}, nil},
+		{"existing manifest", ImportOptions{Compose: compose, Out: existing}, nil},
+		{"existing manifest forced", ImportOptions{Compose: compose, Out: existing, Force: true}, []manifest.Service{
+			{Name: "nginx", Image: "nginx", Version: "1.27.3"},
+			{Name: "todo-backend", Image: backend, Version: "v1.1.1"},
+		}},
+	}
+	for i, tt := range tests {
+		if tt.opts.Out == "" {
+			tt.opts.Out = filepath.Join(dir, fmt.Sprintf("manifest-%d.json", i))
+		}
+		m, err := Import(context.Background(), tt.opts)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: Import() succeeded", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		saved, err := manifest.Load(tt.opts.Out)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(m.Services, tt.want) || !reflect.DeepEqual(saved.Services, tt.want) || saved.ReleaseVersion != "" {
+			t.Errorf("%s: imported %+v, saved %+v, want %+v", tt.name, m.Services, saved.Services, tt.want)
+		}
+	}
+}
+
+func TestConfigBundles(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RELEASER_STATE_DIR", t.TempDir())
+	if _, err := gitOutput("init", "-q"); err != nil {
+		t.Skip("git unavailable:", err)
+	}
+	for _, name := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		t.Setenv(name, "t")
+	}
+	for _, name := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(name, "t@example.com")
+	}
+	if err := os.MkdirAll("config", 0755); err != nil {
+		t.Fatal(err)
+	}
+	m := &manifest.Manifest{ReleaseVersion: "v202501.0.0", Services: []manifest.Service{
+		{Name: "todo-backend", Image: "singaravelan21/todo-backend", Version: "v1.1.0", Config: []manifest.ConfigBundle{{Path: "config/todo-backend.env"}}},
+		{Name: "nginx", Image: "nginx", Version: "1.27.3"},
+	}}
+	info, debug := "LOG_LEVEL=info\n", "LOG_LEVEL=debug\n"
+
+	steps := []struct {
+		name string
+		env  string
+		want []Change
+	}{
+		{"first hash", info, []Change{{Service: "todo-backend", Config: "config/todo-backend.env", To: shortDigest(manifest.HashConfig([]byte(info)))}}},
+		{"unchanged", info, nil},
+		{"changed", debug, []Change{{Service: "todo-backend", Config: "config/todo-backend.env", From: shortDigest(manifest.HashConfig([]byte(info))), To: shortDigest(manifest.HashConfig([]byte(debug)))}}},
+	}
+	for _, tt := range steps {
+		if err := os.WriteFile("config/todo-backend.env", []byte(tt.env), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := configChanges(m)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: configChanges() = %+v, %v, want %+v", tt.name, got, err, tt.want)
+		}
+		if hash := m.Services[0].Config[0].Hash; hash != manifest.HashConfig([]byte(tt.env)) {
+			t.Errorf("%s: recorded hash %s", tt.name, hash)
+		}
+	}
+
+	// v202501.0.1 releases the debug config; then info is committed again.
+	m.ReleaseVersion = "v202501.0.1"
+	if err := manifest.Save(ManifestFile, m); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{{"add", "."}, {"commit", "-q", "-m", "release"}, {"tag", "v202501.0.1"}} {
+		if _, err := gitOutput(args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile("config/todo-backend.env", []byte(info), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gitOutput("commit", "-q", "-am", "back to info"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		code  int
+		body  string
+	}{
+		{"release=v202501.0.1&path=config/todo-backend.env", http.StatusOK, debug},
+		{"release=v202501.0.1&path=" + ManifestFile, http.StatusNotFound, ""},
+		{"release=v202501.0.2&path=config/todo-backend.env", http.StatusNotFound, ""},
+		{"release=../v202501.0.1&path=config/todo-backend.env", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handleConfig(rec, httptest.NewRequest(http.MethodGet, "/config?"+tt.query, nil))
+		if rec.Code != tt.code || tt.body != "" && rec.Body.String() != tt.body {
+			t.Errorf("GET /config?%s = %d %q, want %d %q", tt.query, rec.Code, rec.Body, tt.code, tt.body)
+		}
+	}
+
+	if err := restoreConfig(context.Background(), "v202501.0.1", m); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile("config/todo-backend.env"); err != nil || string(data) != debug {
+		t.Errorf("restored config = %q, %v, want %q", data, err, debug)
+	}
+	if staged, err := gitOutput("diff", "--cached", "--name-only"); err != nil || staged != "config/todo-backend.env" {
+		t.Errorf("staged %q, %v, want the restored config", staged, err)
+	}
+}
+
+// testRegistry is a content-addressed v2 registry. With user set it asks
+// for basic auth, else for a token from its /token service.
+type testRegistry struct {
+	mu        sync.Mutex
+	user      string
+	manifests map[string][2]string // repo:reference -> data, media type
+	blobs     map[string][]byte
+	uploads   int
+	// tokenUsers are the users tokens were asked for as, "" when anonymous.
+	tokenUsers []string
+}
+
+func (reg *testRegistry) put(repo, reference, mediaType string, data []byte) string {
+	sum := sha256.Sum256(data)
+	digest := fmt.Sprintf("sha256:%x", sum)
+	reg.manifests[repo+":"+reference] = [2]string{string(data), mediaType}
+	reg.manifests[repo+":"+digest] = [2]string{string(data), mediaType}
+	return digest
+}
+
+func (reg *testRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if r.URL.Path == "/token" {
+		user, _, _ := r.BasicAuth()
+		reg.tokenUsers = append(reg.tokenUsers, user)
+		json.NewEncoder(w).Encode(map[string]string{"token": "pull-" + r.URL.Query().Get("scope")})
+		return
+	}
+	if user, _, _ := r.BasicAuth(); reg.user != "" && user != reg.user {
+		w.Header().Set("WWW-Authenticate", `Basic realm="site"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if reg.user == "" && !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer pull-repository:") {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="test"`, r.Host))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	rest := strings.TrimPrefix(r.URL.Path, "/v2/")
+	if repo, ok := strings.CutSuffix(rest, "/tags/list"); ok {
+		// Two tags a page, to be paged through.
+		var tags []string
+		for key := range reg.manifests {
+			if name, tag, _ := strings.Cut(key, ":"); name == repo && !strings.HasPrefix(tag, "sha256") {
+				tags = append(tags, tag)
+			}
+		}
+		if len(tags) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		slices.Sort(tags)
+		last := r.URL.Query().Get("last")
+		i, _ := slices.BinarySearch(tags, last)
+		if i < len(tags) && tags[i] == last {
+			i++
+		}
+		page := tags[i:min(i+2, len(tags))]
+		if i+2 < len(tags) {
+			w.Header().Set("Link", fmt.Sprintf(`</v2/%s/tags/list?n=2&last=%s>; rel="next"`, repo, page[1]))
+		}
+		json.NewEncoder(w).Encode(map[string]any{"name": repo, "tags": page})
+		return
+	}
+	if repo, ref, ok := strings.Cut(rest, "/manifests/"); ok {
+		if r.Method == http.MethodPut {
+			data, _ := io.ReadAll(r.Body)
+			reg.put(repo, ref, r.Header.Get("Content-Type"), data)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		m, ok := reg.manifests[repo+":"+ref]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		sum := sha256.Sum256([]byte(m[0]))
+		w.Header().Set("Docker-Content-Digest", fmt.Sprintf("sha256:%x", sum))
+		w.Header().Set("Content-Type", m[1])
+		io.WriteString(w, m[0])
+		return
+	}
+	if _, digest, ok := strings.Cut(rest, "/blobs/"); ok && r.Method != http.MethodPost {
+		b, ok := reg.blobs[digest]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(b)
+		return
+	}
+	switch {
+	case rest == "":
+		return
+	case r.Method == http.MethodPost && strings.HasSuffix(rest, "/blobs/uploads/"):
+		reg.uploads++
+		w.Header().Set("Location", fmt.Sprintf("/upload/%d?state=x", reg.uploads))
+		w.WriteHeader(http.StatusAccepted)
+		return
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/upload/"):
+		data, _ := io.ReadAll(r.Body)
+		sum := sha256.Sum256(data)
+		if digest := r.URL.Query().Get("digest"); digest == fmt.Sprintf("sha256:%x", sum) && r.URL.Query().Get("state") == "x" {
+			reg.blobs[digest] = data
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		http.Error(w, "digest mismatch", http.StatusBadRequest)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func TestQuayRegistry(t *testing.T) {
+	transport := registryHTTP.Transport
+	defer func() { registryHTTP.Transport = transport }()
+	defer func() { registryClients = map[string]*cachedRegistryClient{} }()
+	quay := &testRegistry{manifests: map[string][2]string{}, blobs: map[string][]byte{}}
+	digests := map[string]string{}
+	for _, tag := range []string{"v4.1.0", "v4.2.0"} {
+		digests[tag] = quay.put("coreos/etcd", tag, "application/vnd.oci.image.manifest.v1+json", []byte(`{"tag": "`+tag+`"}`))
+	}
+	tags := map[string][]string{
+		"coreos/etcd":   {"v4.0.0", "v4.1.0", "latest", "v4.2.0", "v3.5.9"},
+		"acme/internal": {"1.0.0", "1.1.0"},
+	}
+	registryHTTP.Transport = sandboxTransport{http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repo, ok := strings.CutPrefix(r.URL.Path, "/api/v1/repository/")
+		if !ok {
+			quay.ServeHTTP(w, r)
+			return
+		}
+		repo = strings.TrimSuffix(repo, "/tag/")
+		names, ok := tags[repo]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if repo == "acme/internal" && r.Header.Get("Authorization") != "Bearer quay-token" {
+			http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+		var list []map[string]any
+		for _, name := range names {
+			list = append(list, map[string]any{"name": name})
+		}
+		if r.URL.Query().Get("onlyActiveTags") != "true" {
+			list = append(list, map[string]any{"name": "v9.0.0", "end_ts": 1})
+		}
+		// Two tags a page.
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		from := min(2*(page-1), len(list))
+		to := min(from+2, len(list))
+		json.NewEncoder(w).Encode(map[string]any{"tags": list[from:to], "page": page, "has_additional": to < len(list)})
+	})}
+
+	tests := []struct {
+		image      string
+		token      string
+		constraint string
+		want       string
+		wantErr    bool
+	}{
+		{"quay.io/coreos/etcd", "", "", "v4.2.0", false},
+		{"quay.io/coreos/etcd", "", "<4.2", "v4.1.0", false},
+		{"quay.io/acme/internal", "quay-token", "", "1.1.0", false},
+		{"quay.io/acme/internal", "", "", "", true},
+		{"quay.io/acme/gone", "", "", "", true},
+	}
+	for _, tt := range tests {
+		registryClients = map[string]*cachedRegistryClient{}
+		t.Setenv("RELEASER_QUAY_TOKEN", tt.token)
+		var c *semver.Constraints
+		if tt.constraint != "" {
+			c, _ = semver.NewConstraint(tt.constraint)
+		}
+		got, err := latestTag(context.Background(), tt.image, c)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("latestTag(%s, %q) = %q, %v, want %q", tt.image, tt.constraint, got, err, tt.want)
+		}
+	}
+	if _, err := latestTag(context.Background(), "quay.io/acme/internal", nil); failureCategory(err) != FailureAuth {
+		t.Errorf("tags of a private repository without a token: %v, want an auth failure", err)
+	}
+	if digest, err := tagDigest(context.Background(), "quay.io/coreos/etcd", "v4.2.0"); err != nil || digest != digests["v4.2.0"] {
+		t.Errorf("tagDigest(quay.io/coreos/etcd, v4.2.0) = %s, %v, want %s", digest, err, digests["v4.2.0"])
+	}
+}
+
+func TestProgress(t *testing.T) {
+	lookups := []struct {
+		name, current string
+		l             serviceLookup
+		update        bool
+	}{
+		{"api", "1.2.0", serviceLookup{tag: "1.3.0"}, true},
+		{"worker", "2.0.0", serviceLookup{tag: "2.0.0"}, false},
+		{"db", "16.1", serviceLookup{skipped: "ignored by the Renovate config"}, false},
+		{"web", "3.1.0", serviceLookup{err: &statusError{"docker hub", http.StatusTooManyRequests}}, false},
+	}
+	checks := []ServiceCheck{
+		{Name: "api", Current: "1.2.0", Latest: "1.3.0", Update: true},
+		{Name: "worker", Current: "2.0.0", Latest: "2.0.0"},
+		{Name: "db", Current: "16.1", Skipped: true, Reason: "ignored by the Renovate config"},
+		{Name: "web", Current: "3.1.0", Error: "docker hub api returned 429", Failure: FailureRateLimited},
+		{Name: "cache", Current: "7.0.0", Latest: "7.2.0", Reason: "cache:7.2.0 is not published for linux/arm64"},
+	}
+	tests := []struct {
+		name       string
+		tty, color bool
+		want       []string
+		notWant    []string
+	}{
+		{"plain", false, false, []string{"Checking service: api"}, []string{"Checking registries", "SERVICE", "✓"}},
+		{"terminal", true, true, []string{
+			"Checking registries 0/4", "Checking registries 4/4",
+			ansiGreen + "✓ api" + ansiReset + "  1.2.0 → 1.3.0",
+			"· worker  2.0.0 is the latest",
+			"- db  skipped: ignored by the Renovate config",
+			ansiRed + "✗ web" + ansiReset + "  rate-limited: docker hub api returned 429",
+			"SERVICE", ansiYellow + "held back: cache:7.2.0 is not published for linux/arm64",
+			ansiGreen + "1 update" + ansiReset + ", 1 up to date, " + ansiYellow + "1 held back" + ansiReset + ", 1 skipped, " + ansiRed + "1 failed",
+		}, []string{"Checking service:"}},
+		{"NO_COLOR", true, false, []string{"✓ api  1.2.0 → 1.3.0", "1 update, 1 up to date, 1 held back, 1 skipped, 1 failed"}, []string{ansiGreen, ansiRed}},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		p := &progress{out: &out, tty: tt.tty, color: tt.color}
+		p.start(len(lookups))
+		for _, l := range lookups {
+			p.done(l.name, l.current, l.l, l.update)
+		}
+		p.end()
+		p.printf("Checking service: %s (current: %s)\n", "api", "1.2.0")
+		p.summary(checks)
+		for _, want := range tt.want {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("%s: output lacks %q:\n%s", tt.name, want, out.String())
+			}
+		}
+		for _, notWant := range tt.notWant {
+			if strings.Contains(out.String(), notWant) {
+				t.Errorf("%s: output has %q:\n%s", tt.name, notWant, out.String())
+			}
+		}
+	}
+
+	f, err := os.CreateTemp(t.TempDir(), "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	if isTerminal(f) || isTerminal(null) {
+		t.Error("isTerminal of a file or the null device is true")
+	}
+	for _, tt := range []struct {
+		progress, ci string
+		want         bool
+	}{
+		{"", "", false},
+		{"tty", "true", true},
+		{"plain", "", false},
+	} {
+		t.Setenv("RELEASER_PROGRESS", tt.progress)
+		t.Setenv("CI", tt.ci)
+		if got := newProgress().tty; got != tt.want {
+			t.Errorf("RELEASER_PROGRESS=%q CI=%q: tty %v, want %v", tt.progress, tt.ci, got, tt.want)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RELEASER_STATE_DIR", t.TempDir())
+	defer closeStateStore()
+	if _, err := gitOutput("init", "-q"); err != nil {
+		t.Skip("git unavailable:", err)
+	}
+	for _, name := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		t.Setenv(name, "t")
+	}
+	for _, name := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(name, "t@example.com")
+	}
+	t.Setenv("RELEASER_TAG_NAMESPACE", "")
+	day := func(month time.Month, d, hour int) time.Time {
+		return time.Date(2026, month, d, hour, 0, 0, 0, time.UTC)
+	}
+	releaseAt := func(tag, api string, at time.Time) {
+		m := &manifest.Manifest{ReleaseVersion: tag, Services: []manifest.Service{
+			{Name: "api", Image: "acme/api", Version: api},
+			{Name: "worker", Image: "ghcr.io/acme/worker", Version: "v3.0.0"},
+		}}
+		if err := manifest.Save(ManifestFile, m); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("GIT_COMMITTER_DATE", at.Format(time.RFC3339))
+		for _, args := range [][]string{{"add", "."}, {"commit", "-q", "-m", "release " + tag}, {"tag", tag}} {
+			if _, err := gitOutput(args...); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	releaseAt("v202601.1.0", "1.0.0", day(time.January, 1, 12))
+	releaseAt("v202607.1.0", "1.1.0", day(time.February, 10, 12))
+
+	api, _ := image.Parse("acme/api")
+	if _, err := Replay(context.Background(), ReplayOptions{Since: 30 * 24 * time.Hour, Every: 24 * time.Hour}); err == nil {
+		t.Error("Replay without a registry history succeeded")
+	}
+	for _, seen := range []struct {
+		at   time.Time
+		tags []string
+	}{
+		{day(time.January, 1, 12), []string{"1.0.0", "1.1.0", "latest"}},
+		{day(time.February, 5, 12), []string{"1.0.0", "1.1.0", "latest", "2.0.0"}},
+		{day(time.February, 15, 12), []string{"1.0.0", "1.1.0", "latest", "2.0.0", "1.2.0"}},
+	} {
+		observeTags(api, seen.tags)
+		recordRegistryHistory(seen.at)
+	}
+
+	defer func(c ClockSource) { Clock = c }(Clock)
+	Clock = fixedClock(day(time.March, 1, 0))
+	tests := []struct {
+		name     string
+		renovate string
+		want     []string
+		wantAt   []time.Time
+		version  string
+	}{
+		{"no policy", "", []string{"1.1.0", "2.0.0"}, []time.Time{day(time.January, 31, 0), day(time.February, 6, 0)}, "2.0.0"},
+		{"allowed versions", `{"packageRules": [{"matchPackageNames": ["acme/api"], "allowedVersions": "<2"}]}`,
+			[]string{"1.1.0", "1.2.0"}, []time.Time{day(time.January, 31, 0), day(time.February, 16, 0)}, "1.2.0"},
+		{"majors disabled", `{"packageRules": [{"matchUpdateTypes": ["major"], "enabled": false}]}`,
+			[]string{"1.1.0"}, []time.Time{day(time.January, 31, 0)}, "1.1.0"},
+		{"ignored", `{"ignoreDeps": ["acme/api"]}`, nil, nil, "1.0.0"},
+	}
+	for _, tt := range tests {
+		os.Remove("renovate.json")
+		if tt.renovate != "" {
+			os.WriteFile("renovate.json", []byte(tt.renovate), 0644)
+		}
+		stdout := os.Stdout
+		report, err := Replay(context.Background(), ReplayOptions{Since: 30 * 24 * time.Hour, Every: 24 * time.Hour})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if os.Stdout != stdout || registryReplay != nil || !Clock.Now().Equal(day(time.March, 1, 0)) {
+			t.Errorf("%s: the replay left stdout, the registry or the clock replaced", tt.name)
+		}
+		var got []string
+		var gotAt []time.Time
+		for _, r := range report.Replayed {
+			for _, c := range r.Changes {
+				got, gotAt = append(got, c.To), append(gotAt, r.Time)
+			}
+		}
+		if !slices.Equal(got, tt.want) || !slices.EqualFunc(gotAt, tt.wantAt, time.Time.Equal) {
+			t.Errorf("%s: replayed %v at %v, want %v at %v", tt.name, got, gotAt, tt.want, tt.wantAt)
+		}
+		wantServices := []ReplayService{
+			{Service: "api", Replayed: len(tt.want), Released: 1, Version: tt.version, Current: "1.1.0"},
+			{Service: "worker", Version: "v3.0.0", Current: "v3.0.0"},
+		}
+		if report.Start != "v202601.1.0" || len(report.Released) != 1 || !slices.Equal(report.Services, wantServices) || !slices.Equal(report.Unrecorded, []string{"worker"}) {
+			t.Errorf("%s: report from %s with %d releases, services %+v, unrecorded %v", tt.name, report.Start, len(report.Released), report.Services, report.Unrecorded)
+		}
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestGARRegistry(t *testing.T) {
+	transport := registryHTTP.Transport
+	defer func() { registryHTTP.Transport = transport }()
+	defer func() { registryClients = map[string]*cachedRegistryClient{} }()
+	defer func() { googleCredentials.found, googleCredentials.tokens = false, nil }()
+
+	gar := &testRegistry{user: "oauth2accesstoken", manifests: map[string][2]string{}, blobs: map[string][]byte{}}
+	public := &testRegistry{manifests: map[string][2]string{}, blobs: map[string][]byte{}}
+	for _, tag := range []string{"1.0.0", "1.3.0", "1.2.9"} {
+		gar.put("acme/apps/api", tag, "application/vnd.oci.image.manifest.v1+json", []byte(`{"tag": "`+tag+`"}`))
+		public.put("distroless/static", tag, "application/vnd.oci.image.manifest.v1+json", []byte(`{"tag": "`+tag+`"}`))
+	}
+	var passwords, grants []string
+	server := sandboxTransport{http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Host {
+		case "oauth2.googleapis.com":
+			r.ParseForm()
+			grant := r.Form.Get("grant_type")
+			if grant == "urn:ietf:params:oauth:grant-type:jwt-bearer" && r.Form.Get("assertion") == "" ||
+				grant == "refresh_token" && r.Form.Get("refresh_token") != "refresh" {
+				http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
+			grants = append(grants, grant)
+			token := "ya29.user"
+			if r.Form.Get("assertion") != "" {
+				token = "ya29.service-account"
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{"access_token": token, "token_type": "Bearer", "expires_in": 3600})
+		case "metadata.test":
+			if r.Header.Get("Metadata-Flavor") != "Google" {
+				http.Error(w, "missing Metadata-Flavor", http.StatusForbidden)
+				return
+			}
+			grants = append(grants, "metadata")
+			json.NewEncoder(w).Encode(map[string]any{"access_token": "ya29.metadata", "token_type": "Bearer", "expires_in": 3600})
+		case "gcr.io":
+			public.ServeHTTP(w, r)
+		default:
+			if _, password, ok := r.BasicAuth(); ok {
+				passwords = append(passwords, password)
+			}
+			gar.ServeHTTP(w, r)
+		}
+	})}
+	registryHTTP.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host == "metadata.google.internal" {
+			return nil, errors.New("no such host")
+		}
+		return server.RoundTrip(req)
+	})
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	pemKey := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	dir := t.TempDir()
+	write := func(name string, v any) string {
+		data, _ := json.Marshal(v)
+		os.WriteFile(filepath.Join(dir, name), data, 0600)
+		return filepath.Join(dir, name)
+	}
+	serviceAccount := write("sa.json", map[string]string{"type": "service_account", "client_email": "releaser@acme.iam.gserviceaccount.com", "private_key": pemKey})
+	user := write("user.json", map[string]string{"type": "authorized_user", "client_id": "id", "client_secret": "secret", "refresh_token": "refresh"})
+	revoked := write("revoked.json", map[string]string{"type": "authorized_user", "client_id": "id", "client_secret": "secret", "refresh_token": "revoked"})
+	external := write("external.json", map[string]string{"type": "external_account"})
+	gcloud := t.TempDir()
+	os.WriteFile(filepath.Join(gcloud, "application_default_credentials.json"), []byte(`{"type": "authorized_user", "refresh_token": "refresh"}`), 0600)
+
+	tests := []struct {
+		name         string
+		image        string
+		credentials  string
+		gcloudConfig string
+		metadata     string
+		want         string
+		wantGrants   []string
+		wantPassword string
+		wantErr      bool
+	}{
+		{"service account key", "europe-west1-docker.pkg.dev/acme/apps/api", serviceAccount, "", "", "1.3.0", []string{"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "ya29.service-account", false},
+		{"user credentials", "us-docker.pkg.dev/acme/apps/api", user, "", "", "1.3.0", []string{"refresh_token"}, "ya29.user", false},
+		{"gcloud's credentials", "eu.gcr.io/acme/apps/api", "", gcloud, "", "1.3.0", []string{"refresh_token"}, "ya29.user", false},
+		{"metadata server", "europe-west1-docker.pkg.dev/acme/apps/api", "", dir, "metadata.test", "1.3.0", []string{"metadata"}, "ya29.metadata", false},
+		{"anonymous off Google Cloud", "gcr.io/distroless/static", "", dir, "", "1.3.0", nil, "", false},
+		{"revoked credentials", "europe-west1-docker.pkg.dev/acme/apps/api", revoked, "", "", "", nil, "", true},
+		{"unsupported credentials", "europe-west1-docker.pkg.dev/acme/apps/api", external, "", "", "", nil, "", true},
+	}
+	for _, tt := range tests {
+		registryClients = map[string]*cachedRegistryClient{}
+		googleCredentials.found, googleCredentials.tokens = false, nil
+		passwords, grants = nil, nil
+		t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", tt.credentials)
+		t.Setenv("CLOUDSDK_CONFIG", tt.gcloudConfig)
+		t.Setenv("GCE_METADATA_HOST", tt.metadata)
+		got, err := latestTag(context.Background(), tt.image, nil)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%s: latestTag(%s) = %q, %v, want %q", tt.name, tt.image, got, err, tt.want)
+		}
+		if !slices.Equal(grants, tt.wantGrants) {
+			t.Errorf("%s: tokens granted for %q, want %q", tt.name, grants, tt.wantGrants)
+		}
+		if tt.wantPassword != "" && (len(passwords) == 0 || passwords[0] != tt.wantPassword) {
+			t.Errorf("%s: registry logged in to with %q, want %q", tt.name, passwords, tt.wantPassword)
+		}
+	}
+
+	for _, host := range []string{"gcr.io", "asia.gcr.io", "us-central1-docker.pkg.dev", "us-central1-npm.pkg.dev", "gcr.io.evil.example", "docker.pkg.dev"} {
+		want := !strings.Contains(host, "npm") && !strings.Contains(host, "evil") && host != "docker.pkg.dev"
+		if got := garRegistry.handles(host); got != want {
+			t.Errorf("garRegistry.handles(%s) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestPublishManifest(t *testing.T) {
+	transport := registryHTTP.Transport
+	defer func() { registryHTTP.Transport = transport }()
+	registryHTTP.Transport = http.DefaultTransport
+	reg := &testRegistry{manifests: map[string][2]string{}, blobs: map[string][]byte{}}
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gitOutput("init", "-q"); err != nil {
+		t.Skip("git unavailable:", err)
+	}
+	for _, name := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		t.Setenv(name, "t")
+	}
+	for _, name := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(name, "t@example.com")
+	}
+	t.Setenv("GITHUB_REPOSITORY", "")
+	env := "LOG_LEVEL=info\n"
+	os.Mkdir("config", 0755)
+	os.WriteFile("config/api.env", []byte(env), 0644)
+	bundle := manifest.ConfigBundle{Path: "config/api.env", Hash: manifest.HashConfig([]byte(env))}
+	m := &manifest.Manifest{ReleaseVersion: "v202501.1.0", Services: []manifest.Service{
+		{Name: "api", Image: "acme/api", Version: "v1.2.0", Config: []manifest.ConfigBundle{bundle}},
+		{Name: "api-jobs", Image: "acme/api", Version: "v1.2.0", Config: []manifest.ConfigBundle{bundle}},
+	}}
+	if err := manifest.Save(ManifestFile, m); err != nil {
+		t.Fatal(err)
+	}
+	if err := SignManifest(base64.StdEncoding.EncodeToString(make([]byte, ed25519.SeedSize))); err != nil {
+		t.Fatal(err)
+	}
+	sigs, _ := os.ReadFile(provenance.SignaturePath(ManifestFile))
+	for _, args := range [][]string{{"add", "."}, {"commit", "-q", "-m", "release"}, {"tag", "v202501.1.0"}, {"tag", "todo/v202501.1.0"}} {
+		if _, err := gitOutput(args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	released, _ := os.ReadFile(ManifestFile)
+	// A working tree changed since doesn't change what is published.
+	os.WriteFile("config/api.env", []byte("LOG_LEVEL=debug\n"), 0644)
+
+	tests := []struct {
+		repository string
+		version    string
+		wantTag    string
+		wantLatest string
+		wantErr    bool
+	}{
+		{"", "v202501.1.0", "", "", false},
+		{host + "/acme/releases", "v202501.1.0", "v202501.1.0", "latest", false},
+		{host + "/acme/releases", "todo/v202501.1.0", "todo-v202501.1.0", "todo-latest", false},
+		{host + "/acme/releases:latest", "v202501.1.0", "", "", true},
+		{host + "/acme/releases", "v202501.9.9", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Setenv("RELEASER_MANIFEST_REPOSITORY", tt.repository)
+		before := len(reg.manifests)
+		err := publishManifest(context.Background(), tt.version)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("publishManifest(%s) to %q: %v, want error %v", tt.version, tt.repository, err, tt.wantErr)
+		}
+		if tt.wantTag == "" {
+			if len(reg.manifests) != before {
+				t.Errorf("publishManifest(%s) to %q pushed a manifest", tt.version, tt.repository)
+			}
+			continue
+		}
+		pushed, ok := reg.manifests["acme/releases:"+tt.wantTag]
+		if !ok {
+			t.Errorf("publishManifest(%s): no artifact tagged %s", tt.version, tt.wantTag)
+			continue
+		}
+		if latest := reg.manifests["acme/releases:"+tt.wantLatest]; latest != pushed {
+			t.Errorf("publishManifest(%s): %s isn't the release's artifact", tt.version, tt.wantLatest)
+		}
+		var artifact struct {
+			ArtifactType string          `json:"artifactType"`
+			Config       ociDescriptor   `json:"config"`
+			Layers       []ociDescriptor `json:"layers"`
+			Annotations  map[string]string
+		}
+		if err := json.Unmarshal([]byte(pushed[0]), &artifact); err != nil {
+			t.Fatal(err)
+		}
+		if artifact.ArtifactType != ManifestArtifactType || artifact.Annotations["org.opencontainers.image.version"] != tt.version {
+			t.Errorf("artifact of %s: type %q, annotations %v", tt.version, artifact.ArtifactType, artifact.Annotations)
+		}
+		if string(reg.blobs[artifact.Config.Digest]) != "{}" {
+			t.Errorf("artifact of %s: config %q, want the empty config", tt.version, reg.blobs[artifact.Config.Digest])
+		}
+		files := map[string]string{}
+		for _, l := range artifact.Layers {
+			files[l.Annotations[titleAnnotation]] = string(reg.blobs[l.Digest])
+		}
+		want := map[string]string{ManifestFile: string(released), provenance.SignaturePath(ManifestFile): string(sigs), "config/api.env": env}
+		if !maps.Equal(files, want) || len(artifact.Layers) != len(want) {
+			t.Errorf("artifact of %s has %v, want %v", tt.version, files, want)
+		}
+	}
+}
+
+func TestBundle(t *testing.T) {
+	transport := registryHTTP.Transport
+	defer func() { registryHTTP.Transport = transport }()
+	registryHTTP.Transport = http.DefaultTransport
+
+	source := &testRegistry{manifests: map[string][2]string{}, blobs: map[string][]byte{}}
+	blob := func(content string) map[string]any {
+		sum := sha256.Sum256([]byte(content))
+		digest := fmt.Sprintf("sha256:%x", sum)
+		source.blobs[digest] = []byte(content)
+		return map[string]any{"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": digest, "size": len(content)}
+	}
+	image := func(repo, arch string) []byte {
+		data, _ := json.Marshal(map[string]any{
+			"schemaVersion": 2,
+			"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+			"config":        blob(`{"architecture": "` + arch + `"}`),
+			"layers":        []any{blob("base layer"), blob(repo + " " + arch + " layer")},
+		})
+		return data
+	}
+	const manifestType = "application/vnd.oci.image.manifest.v1+json"
+	var children []any
+	for _, arch := range []string{"amd64", "arm64"} {
+		data := image("api", arch)
+		digest := source.put("acme/api", "unused-"+arch, manifestType, data)
+		children = append(children, map[string]any{"mediaType": manifestType, "digest": digest, "size": len(data), "platform": map[string]string{"os": "linux", "architecture": arch}})
+	}
+	index, _ := json.Marshal(map[string]any{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.index.v1+json", "manifests": children})
+	apiDigest := source.put("acme/api", "v1.2.0", "application/vnd.oci.image.index.v1+json", index)
+	workerDigest := source.put("acme/worker", "v2.0.0", manifestType, image("worker", "amd64"))
+	srcSrv := httptest.NewServer(source)
+	defer srcSrv.Close()
+	srcHost := strings.TrimPrefix(srcSrv.URL, "http://")
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RELEASER_STATE_DIR", t.TempDir())
+	if _, err := gitOutput("init", "-q"); err != nil {
+		t.Skip("git unavailable:", err)
+	}
+	for _, name := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		t.Setenv(name, "t")
+	}
+	for _, name := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(name, "t@example.com")
+	}
+	env := "LOG_LEVEL=info\n"
+	os.Mkdir("config", 0755)
+	os.WriteFile("config/api.env", []byte(env), 0644)
+	m := &manifest.Manifest{ReleaseVersion: "v202501.1.0", Services: []manifest.Service{
+		{Name: "api", Image: srcHost + "/acme/api@" + apiDigest, Version: "v1.2.0", Config: []manifest.ConfigBundle{{Path: "config/api.env", Hash: manifest.HashConfig([]byte(env))}}},
+		{Name: "worker", Image: srcHost + "/acme/worker@" + workerDigest, Version: "v2.0.0"},
+	}}
+	if err := manifest.Save(ManifestFile, m); err != nil {
+		t.Fatal(err)
+	}
+	signer := base64.StdEncoding.EncodeToString(make([]byte, ed25519.SeedSize))
+	if err := SignManifest(signer); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{{"add", "."}, {"commit", "-q", "-m", "release"}, {"tag", "v202501.1.0"}} {
+		if _, err := gitOutput(args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bundle := filepath.Join(t.TempDir(), "bundle.tar")
+	if err := Export(context.Background(), ExportOptions{Release: "v202501.1.0", Out: bundle}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A bundle altered on the way is refused.
+	data, _ := os.ReadFile(bundle)
+	tampered := filepath.Join(t.TempDir(), "tampered.tar")
+	os.WriteFile(tampered, bytes.Replace(data, []byte("LOG_LEVEL=info"), []byte("LOG_LEVEL=evil"), 1), 0644)
+	if err := extractBundle(tampered, t.TempDir()); err == nil || !strings.Contains(err.Error(), "config/api.env") {
+		t.Errorf("tampered bundle: %v, want a checksum error for config/api.env", err)
+	}
+
+	site := &testRegistry{user: "site", manifests: map[string][2]string{}, blobs: map[string][]byte{}}
+	siteSrv := httptest.NewServer(site)
+	defer siteSrv.Close()
+	siteHost := strings.TrimPrefix(siteSrv.URL, "http://")
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RELEASER_IMPORT_USERNAME", "site")
+	t.Setenv("RELEASER_IMPORT_PASSWORD", "secret")
+	t.Setenv("RELEASER_DEPLOY_COMMAND", `echo "$RELEASE_VERSION" > deployed`)
+
+	// The site verifies the manifest as it would its own.
+	key, _ := provenance.ParsePrivateKey(signer)
+	other, _ := provenance.ParsePrivateKey(base64.StdEncoding.EncodeToString([]byte("01234567890123456789012345678901")))
+	for _, verify := range []struct{ mode, key string }{
+		{ManifestVerifySignature, base64.StdEncoding.EncodeToString(other.Public().(ed25519.PublicKey))},
+		{ManifestVerifyCommit, ""},
+	} {
+		t.Setenv("RELEASER_MANIFEST_VERIFY", verify.mode)
+		t.Setenv("RELEASER_MANIFEST_KEYS", verify.key)
+		if _, err := Import(context.Background(), ImportOptions{Bundle: bundle, Registry: siteHost}); err == nil || !strings.Contains(err.Error(), "verif") {
+			t.Errorf("%s verification: imported a bundle it couldn't verify: %v", verify.mode, err)
+		}
+		if _, err := os.Stat("deployed"); err == nil {
+			t.Fatalf("%s verification: deployed a bundle it couldn't verify", verify.mode)
+		}
+	}
+	t.Setenv("RELEASER_MANIFEST_VERIFY", ManifestVerifySignature)
+	t.Setenv("RELEASER_MANIFEST_KEYS", base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)))
+
+	// SHA256SUMS isn't signed: a bundle altered with its checksums redone
+	// is refused by the signed manifest.
+	rebundle := func(edit func(dir string)) string {
+		dir := t.TempDir()
+		if err := extractBundle(bundle, dir); err != nil {
+			t.Fatal(err)
+		}
+		edit(dir)
+		out := filepath.Join(t.TempDir(), "rebundled.tar")
+		f, err := os.Create(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		tw := tar.NewWriter(f)
+		var sums strings.Builder
+		err = filepath.WalkDir(dir, func(path string, e fs.DirEntry, err error) error {
+			if err != nil || e.IsDir() {
+				return err
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			name, _ := filepath.Rel(dir, path)
+			name = filepath.ToSlash(name)
+			fmt.Fprintf(&sums, "%x  %s\n", sha256.Sum256(data), name)
+			if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}); err != nil {
+				return err
+			}
+			_, err = tw.Write(data)
+			return err
+		})
+		if err == nil {
+			err = tw.WriteHeader(&tar.Header{Name: bundleSums, Mode: 0644, Size: int64(sums.Len())})
+		}
+		if err == nil {
+			_, err = io.WriteString(tw, sums.String())
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	editIndex := func(edit func(index *ociManifest)) func(dir string) {
+		return func(dir string) {
+			var index ociManifest
+			data, _ := os.ReadFile(filepath.Join(dir, "index.json"))
+			if err := json.Unmarshal(data, &index); err != nil {
+				t.Fatal(err)
+			}
+			edit(&index)
+			data, _ = json.Marshal(index)
+			os.WriteFile(filepath.Join(dir, "index.json"), data, 0644)
+		}
+	}
+	workerRef := srcHost + "/acme/worker:v2.0.0@" + workerDigest
+	rebundled := []struct {
+		name string
+		edit func(dir string)
+		want string
+	}{
+		{"config", func(dir string) {
+			os.WriteFile(filepath.Join(dir, "config", "config", "api.env"), []byte("LOG_LEVEL=evil\n"), 0644)
+		}, "config/api.env"},
+		{"image", editIndex(func(index *ociManifest) {
+			for i, d := range index.Manifests {
+				if d.Annotations[refNameAnnotation] != workerRef {
+					index.Manifests[i].Digest, index.Manifests[i].MediaType = workerDigest, manifestType
+				}
+			}
+		}), "not the digest"},
+		{"extra image", editIndex(func(index *ociManifest) {
+			extra := index.Manifests[0]
+			extra.Annotations = map[string]string{refNameAnnotation: srcHost + "/acme/evil:latest"}
+			index.Manifests = append(index.Manifests, extra)
+		}), "acme/evil:latest"},
+		{"image manifest", func(dir string) {
+			os.WriteFile(filepath.Join(dir, filepath.FromSlash(blobPath(workerDigest))), []byte(`{"schemaVersion": 2}`), 0644)
+		}, "does not match its digest"},
+	}
+	for _, tt := range rebundled {
+		if _, err := Import(context.Background(), ImportOptions{Bundle: rebundle(tt.edit), Registry: siteHost}); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("bundle with a replaced %s: %v, want an error mentioning %q", tt.name, err, tt.want)
+		}
+	}
+	if _, err := os.Stat("deployed"); err == nil {
+		t.Fatal("deployed a tampered bundle")
+	}
+	if site.manifests["acme/worker:v2.0.0"] != [2]string{} {
+		t.Error("loaded the image of a tampered bundle")
+	}
+
+	// An image pinned by tag alone can't be tied to a verified manifest.
+	dir := t.TempDir()
+	tagOnly := &manifest.Manifest{Services: []manifest.Service{{Name: "api", Image: "registry.example.com/acme/api", Version: "v1.2.0"}}}
+	os.WriteFile(filepath.Join(dir, "index.json"), []byte(`{"manifests": [{"digest": "`+apiDigest+`", "annotations": {"`+refNameAnnotation+`": "registry.example.com/acme/api:v1.2.0"}}]}`), 0644)
+	if _, err := bundleImages(dir, tagOnly); err == nil || !strings.Contains(err.Error(), "pin it by digest") {
+		t.Errorf("tag-only image under verification: %v, want it refused", err)
+	}
+	t.Setenv("RELEASER_MANIFEST_VERIFY", "")
+	if images, err := bundleImages(dir, tagOnly); err != nil || len(images) != 1 || images[0].d.Digest != apiDigest {
+		t.Errorf("tag-only image unverified: %v, %v, want it loaded", images, err)
+	}
+	t.Setenv("RELEASER_MANIFEST_VERIFY", ManifestVerifySignature)
+
+	got, err := Import(context.Background(), ImportOptions{Bundle: bundle, Registry: siteHost})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !maps.EqualFunc(site.blobs, source.blobs, bytes.Equal) {
+		t.Errorf("site has %d blobs, want the source's %d", len(site.blobs), len(source.blobs))
+	}
+	for _, key := range []string{"acme/api:v1.2.0", "acme/worker:v2.0.0", "acme/worker:" + workerDigest} {
+		if site.manifests[key] != source.manifests[key] {
+			t.Errorf("site manifest %s = %v, want %v", key, site.manifests[key], source.manifests[key])
+		}
+	}
+	for i := range children {
+		digest := children[i].(map[string]any)["digest"].(string)
+		if _, ok := site.manifests["acme/api:"+digest]; !ok {
+			t.Errorf("site is missing the api image %s", digest)
+		}
+	}
+	wantImages := []string{siteHost + "/acme/api@" + apiDigest, siteHost + "/acme/worker@" + workerDigest}
+	saved, err := manifest.Load(ManifestFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range saved.Services {
+		if s.Image != wantImages[i] || got.Services[i].Image != wantImages[i] {
+			t.Errorf("%s imported as %s, want %s", s.Name, s.Image, wantImages[i])
+		}
+	}
+	if content, _ := os.ReadFile("config/api.env"); string(content) != env {
+		t.Errorf("config/api.env = %q, want %q", content, env)
+	}
+	if deployed, _ := os.ReadFile("deployed"); string(deployed) != "v202501.1.0\n" {
+		t.Errorf("deploy command wrote %q", deployed)
+	}
+}
+
+func TestRegistryBackends(t *testing.T) {
+	transport := registryHTTP.Transport
+	defer func() { registryHTTP.Transport = transport }()
+	defer func() { registryClients = map[string]*cachedRegistryClient{} }()
+	ghcr := &testRegistry{manifests: map[string][2]string{}, blobs: map[string][]byte{}}
+	registryHTTP.Transport = sandboxTransport{http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Host != "ghcr.io" {
+			http.NotFound(w, r)
+			return
+		}
+		ghcr.ServeHTTP(w, r)
+	})}
+	digests := map[string]string{}
+	for _, tag := range []string{"v1.0.0", "v1.2.0", "v1.10.0", "latest", "v1.9.3"} {
+		digests[tag] = ghcr.put("acme/api", tag, "application/vnd.oci.image.manifest.v1+json", []byte(`{"tag": "`+tag+`"}`))
+	}
+
+	tests := []struct {
+		image      string
+		constraint string
+		githubAuth bool
+		want       string
+		wantDigest string
+		wantErr    bool
+	}{
+		{"ghcr.io/acme/api", "", false, "v1.10.0", digests["v1.10.0"], false},
+		{"ghcr.io/acme/api", "~1.2", true, "v1.2.0", digests["v1.2.0"], false},
+		{"ghcr.io/acme/gone", "", false, "", "", true},
+	}
+	for _, tt := range tests {
+		registryClients = map[string]*cachedRegistryClient{}
+		ghcr.tokenUsers = nil
+		if tt.githubAuth {
+			t.Setenv("GITHUB_TOKEN", "gh-token")
+		} else {
+			t.Setenv("GITHUB_TOKEN", "")
+		}
+		var c *semver.Constraints
+		if tt.constraint != "" {
+			c, _ = semver.NewConstraint(tt.constraint)
+		}
+		got, err := latestTag(context.Background(), tt.image, c)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("latestTag(%s, %q) = %q, %v, want %q", tt.image, tt.constraint, got, err, tt.want)
+		}
+		if tt.wantErr {
+			continue
+		}
+		digest, err := tagDigest(context.Background(), tt.image, got)
+		if err != nil || digest != tt.wantDigest {
+			t.Errorf("tagDigest(%s, %s) = %s, %v, want %s", tt.image, got, digest, err, tt.wantDigest)
+		}
+		wantUsers := []string{""}
+		if tt.githubAuth {
+			wantUsers = []string{"releaser"}
+		}
+		if !slices.Equal(ghcr.tokenUsers, wantUsers) {
+			t.Errorf("%s: tokens asked for as %q, want %q", tt.image, ghcr.tokenUsers, wantUsers)
+		}
+	}
+	if _, err := tagDigest(context.Background(), "ghcr.io/acme/api", "v9.9.9"); !errors.Is(err, errTagNotFound) {
+		t.Errorf("digest of a missing tag: %v, want errTagNotFound", err)
+	}
+	if _, err := latestTag(context.Background(), "ghcr.io/acme/gone", nil); failureCategory(err) != FailureNotFound {
+		t.Errorf("tags of a missing repository: %v, want a not found failure", err)
+	}
+}
+
+func TestECRRegistry(t *testing.T) {
+	transport := registryHTTP.Transport
+	defer func() { registryHTTP.Transport = transport }()
+	defer func() { registryClients = map[string]*cachedRegistryClient{} }()
+	loginPassword := ecrLoginPassword
+	defer func() { ecrLoginPassword = loginPassword }()
+	defer func() { ecrPasswords = map[string]cachedPassword{} }()
+	ecr := &testRegistry{user: "AWS", manifests: map[string][2]string{}, blobs: map[string][]byte{}}
+	registryHTTP.Transport = sandboxTransport{ecr}
+	digests := map[string]string{}
+	for _, tag := range []string{"1.0.0", "1.4.1", "1.4.0"} {
+		digests[tag] = ecr.put("team/api", tag, "application/vnd.oci.image.manifest.v1+json", []byte(`{"tag": "`+tag+`"}`))
+	}
+
+	tests := []struct {
+		image      string
+		loginErr   error
+		wantRegion string
+		want       string
+		wantErr    bool
+	}{
+		{"123456789012.dkr.ecr.eu-west-1.amazonaws.com/team/api", nil, "eu-west-1", "1.4.1", false},
+		{"123456789012.dkr.ecr-fips.us-gov-west-1.amazonaws.com/team/api", nil, "us-gov-west-1", "1.4.1", false},
+		{"123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn/team/api", nil, "cn-north-1", "1.4.1", false},
+		{"123456789012.dkr.ecr.us-east-1.amazonaws.com/team/api", errors.New("Unable to locate credentials"), "us-east-1", "", true},
+	}
+	for _, tt := range tests {
+		registryClients = map[string]*cachedRegistryClient{}
+		ecrPasswords = map[string]cachedPassword{}
+		var regions []string
+		ecrLoginPassword = func(ctx context.Context, region string) (string, time.Time, error) {
+			regions = append(regions, region)
+			return "ecr-password", time.Now().Add(12 * time.Hour), tt.loginErr
+		}
+		got, err := latestTag(context.Background(), tt.image, nil)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("latestTag(%s) = %q, %v, want %q", tt.image, got, err, tt.want)
+		}
+		if !slices.Equal(regions, []string{tt.wantRegion}) {
+			t.Errorf("%s: logged in to %q, want %q", tt.image, regions, tt.wantRegion)
+		}
+		if tt.wantErr {
+			continue
+		}
+		digest, err := tagDigest(context.Background(), tt.image, got)
+		if err != nil || digest != digests[got] {
+			t.Errorf("tagDigest(%s, %s) = %s, %v, want %s", tt.image, got, digest, err, digests[got])
+		}
+	}
+
+	// Passwords are reused until an hour before they expire.
+	ecrPasswords = map[string]cachedPassword{}
+	logins := 0
+	expires := time.Now().Add(12 * time.Hour)
+	ecrLoginPassword = func(ctx context.Context, region string) (string, time.Time, error) {
+		logins++
+		return "ecr-password", expires, nil
+	}
+	for range 2 {
+		if _, err := ecrPassword(context.Background(), "eu-west-1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if logins != 1 {
+		t.Errorf("logged in %d times for a fresh password, want 1", logins)
+	}
+	expires = time.Now().Add(30 * time.Minute)
+	ecrPasswords = map[string]cachedPassword{"eu-west-1": {"old", expires}}
+	if password, err := ecrPassword(context.Background(), "eu-west-1"); err != nil || password != "ecr-password" || logins != 2 {
+		t.Errorf("password expiring in 30m: got %q, %v after %d logins, want a new one", password, err, logins)
+	}
+
+	for _, host := range []string{"123456789012.dkr.ecr.eu-west-1.amazonaws.com", "public.ecr.aws", "dkr.ecr.eu-west-1.amazonaws.com", "123456789012.dkr.ecr.eu-west-1.amazonaws.com.evil.example"} {
+		want := host == "123456789012.dkr.ecr.eu-west-1.amazonaws.com"
+		if got := ecrRegistry.handles(host); got != want {
+			t.Errorf("ecrRegistry.handles(%s) = %v, want %v", host, got, want)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package releaser
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/image"
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// Time to release is how long an upstream tag took to reach a release: from
+// when it was pushed to the registry, as Docker Hub or the image's
+// org.opencontainers.image.created label tells, to the release that moved
+// a service to it. RELEASER_RELEASE_SLO sets targets for it by update
+// type, e.g. patch=24h,minor=168h; the default, patch=24h, is the "security
+// patches within a day" promise, as security fixes ship as patches.
+// Releases are kept for sloRetention and reported over the last sloWindow
+// by /metrics, GET /slo and releaser slo.
+
+// LabelCreated is the OCI annotation key of an image's build time.
+const LabelCreated = "org.opencontainers.image.created"
+
+// DefaultReleaseSLO is the time to release target unless
+// RELEASER_RELEASE_SLO says otherwise.
+const DefaultReleaseSLO = "patch=24h"
+
+const (
+	// sloWindow is the period /metrics reports the SLO over.
+	sloWindow = 30 * 24 * time.Hour
+	// sloRetention is how long released tags are kept for reports.
+	sloRetention = 365 * 24 * time.Hour
+)
+
+// releaseSLOs parses RELEASER_RELEASE_SLO into targets by update type.
+func releaseSLOs() (map[string]time.Duration, error) {
+	s := os.Getenv("RELEASER_RELEASE_SLO")
+	if s == "" {
+		s = DefaultReleaseSLO
+	}
+	slos := map[string]time.Duration{}
+	for _, entry := range strings.Split(s, ",") {
+		typ, target, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		d, err := time.ParseDuration(target)
+		if !ok || err != nil || d <= 0 || !slices.Contains([]string{"major", "minor", "patch", "digest"}, typ) {
+			return nil, fmt.Errorf("RELEASER_RELEASE_SLO: %q is not <major|minor|patch|digest>=<duration>", entry)
+		}
+		slos[typ] = d
+	}
+	return slos, nil
+}
+
+// ReleasedTag is a tag a release moved a service to.
+type ReleasedTag struct {
+	Service string `json:"service"`
+	Tag     string `json:"tag"`
+	// Type is the update type: major, minor, patch or digest.
+	Type      string    `json:"type"`
+	Release   string    `json:"release"`
+	Published time.Time `json:"published"`
+	Released  time.Time `json:"released"`
+}
+
+// Delay is the tag's time to release.
+func (t ReleasedTag) Delay() time.Duration {
+	return t.Released.Sub(t.Published)
+}
+
+var releasedTagsMu sync.Mutex
+
+const releasedTagsState = "released_tags.json"
+
+func readReleasedTags() ([]ReleasedTag, error) {
+	var tags []ReleasedTag
+	if err := readStateJSON(releasedTagsState, &tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// recordTimeToRelease records when each tag result moved a service to was
+// published, for the time to release reports. Tags whose publish time the
+// registry doesn't tell are left out. Recording is best effort: errors are
+// logged.
+func recordTimeToRelease(ctx context.Context, m *manifest.Manifest, result *Result) {
+	now := Clock.Now().UTC()
+	var released []ReleasedTag
+	for _, c := range result.Changes {
+		s, ok := m.Service(c.Service)
+		if !ok || s.Version == "" || c.From == s.Version || c.Config != "" {
+			// A pin to a digest publishes nothing new.
+			continue
+		}
+		published, err := tagPublished(ctx, s.Image, s.Version)
+		if err != nil {
+			fmt.Printf("Error reading when %s:%s was published: %v\n", s.Image, s.Version, err)
+			continue
+		}
+		if published.IsZero() {
+			continue
+		}
+		t := ReleasedTag{Service: c.Service, Tag: s.Version, Type: updateType(s, c), Release: result.Version, Published: published.UTC(), Released: now}
+		fmt.Printf("%s:%s released %v after it was published\n", c.Service, s.Version, t.Delay().Round(time.Minute))
+		released = append(released, t)
+	}
+	if len(released) == 0 {
+		return
+	}
+	if err := appendReleasedTags(released, now); err != nil {
+		fmt.Printf("Error recording time to release: %v\n", err)
+	}
+}
+
+func appendReleasedTags(released []ReleasedTag, now time.Time) error {
+	releasedTagsMu.Lock()
+	defer releasedTagsMu.Unlock()
+	tags, err := readReleasedTags()
+	if err != nil {
+		return err
+	}
+	tags = slices.DeleteFunc(append(tags, released...), func(t ReleasedTag) bool {
+		return now.Sub(t.Released) > sloRetention
+	})
+	return writeStateJSON(releasedTagsState, tags)
+}
+
+// tagPublished returns when tag of the image ref was pushed: Docker Hub's
+// tag_last_pushed, or else the image's LabelCreated. It returns the zero
+// time when the registry doesn't tell.
+func tagPublished(ctx context.Context, ref, tag string) (time.Time, error) {
+	r, err := image.Parse(ref)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if r.IsDockerHub() {
+		if t, err := getTagPushedFromDockerHub(ctx, r, tag); err != nil || !t.IsZero() {
+			return t, err
+		}
+	}
+	labels, err := imageLabels(ctx, r.Name(), tag)
+	if err != nil || labels[LabelCreated] == "" {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339, labels[LabelCreated])
+}
+
+func getTagPushedFromDockerHub(ctx context.Context, ref image.Reference, tag string) (time.Time, error) {
+	if err := throttle(ctx, ref.Registry); err != nil {
+		return time.Time{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("https://hub.docker.com/v2/repositories/%s/tags/%s", ref.Repository, tag), nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	resp, err := registryHTTP.Do(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("docker hub api returned %d", resp.StatusCode)
+	}
+	var t struct {
+		TagLastPushed time.Time `json:"tag_last_pushed"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&t)
+	return t.TagLastPushed, err
+}
+
+// ServiceSLO is a service's time to release over a report's period.
+type ServiceSLO struct {
+	Service  string        `json:"service"`
+	Releases int           `json:"releases"`
+	Median   time.Duration `json:"median_seconds"`
+	Max      time.Duration `json:"max_seconds"`
+	// Breaches are the releases of tags of update types with a target that
+	// took longer than it.
+	Breaches []ReleasedTag `json:"breaches,omitempty"`
+}
+
+// TypeSLO is how an update type met its target over a report's period.
+type TypeSLO struct {
+	Type     string        `json:"type"`
+	Target   time.Duration `json:"target_seconds"`
+	Releases int           `json:"releases"`
+	Within   int           `json:"within"`
+}
+
+// Met is the share of releases within the target, 1 without releases.
+func (t TypeSLO) Met() float64 {
+	if t.Releases == 0 {
+		return 1
+	}
+	return float64(t.Within) / float64(t.Releases)
+}
+
+// SLOReport is the time to release of the tags released since Since.
+type SLOReport struct {
+	Since    time.Time    `json:"since"`
+	Services []ServiceSLO `json:"services"`
+	Types    []TypeSLO    `json:"types"`
+}
+
+// Breaches is the number of releases that missed their target.
+func (r *SLOReport) Breaches() int {
+	n := 0
+	for _, s := range r.Services {
+		n += len(s.Breaches)
+	}
+	return n
+}
+
+// ReleaseSLO reports the time to release of the tags released since since,
+// against the targets of RELEASER_RELEASE_SLO.
+func ReleaseSLO(since time.Time) (*SLOReport, error) {
+	slos, err := releaseSLOs()
+	if err != nil {
+		return nil, err
+	}
+	releasedTagsMu.Lock()
+	tags, err := readReleasedTags()
+	releasedTagsMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return sloReport(tags, slos, since), nil
+}
+
+func sloReport(tags []ReleasedTag, slos map[string]time.Duration, since time.Time) *SLOReport {
+	r := &SLOReport{Since: since, Services: []ServiceSLO{}, Types: []TypeSLO{}}
+	delays := map[string][]time.Duration{}
+	services := map[string]*ServiceSLO{}
+	types := map[string]*TypeSLO{}
+	for typ, target := range slos {
+		types[typ] = &TypeSLO{Type: typ, Target: target}
+	}
+	for _, t := range tags {
+		if t.Released.Before(since) {
+			continue
+		}
+		s := services[t.Service]
+		if s == nil {
+			s = &ServiceSLO{Service: t.Service}
+			services[t.Service] = s
+		}
+		s.Releases++
+		delays[t.Service] = append(delays[t.Service], t.Delay())
+		if typ := types[t.Type]; typ != nil {
+			typ.Releases++
+			if t.Delay() <= typ.Target {
+				typ.Within++
+			} else {
+				s.Breaches = append(s.Breaches, t)
+			}
+		}
+	}
+	for name, s := range services {
+		d := delays[name]
+		slices.Sort(d)
+		s.Median, s.Max = d[len(d)/2], d[len(d)-1]
+		r.Services = append(r.Services, *s)
+	}
+	for _, t := range types {
+		r.Types = append(r.Types, *t)
+	}
+	slices.SortFunc(r.Services, func(a, b ServiceSLO) int { return strings.Compare(a.Service, b.Service) })
+	slices.SortFunc(r.Types, func(a, b TypeSLO) int { return strings.Compare(a.Type, b.Type) })
+	return r
+}
+
+// writeReleaseSLOMetrics writes the time to release over sloWindow in the
+// Prometheus text format.
+func writeReleaseSLOMetrics(w io.Writer) {
+	r, err := ReleaseSLO(Clock.Now().Add(-sloWindow))
+	if err != nil {
+		fmt.Printf("Error reading time to release: %v\n", err)
+		return
+	}
+	fmt.Fprintf(w, "# HELP releaser_time_to_release_seconds Median time from a tag's publication to its release, over 30 days.\n")
+	fmt.Fprintf(w, "# TYPE releaser_time_to_release_seconds gauge\n")
+	for _, s := range r.Services {
+		fmt.Fprintf(w, "releaser_time_to_release_seconds{service=%q} %.0f\n", s.Service, s.Median.Seconds())
+	}
+	fmt.Fprintf(w, "# HELP releaser_time_to_release_max_seconds Longest time from a tag's publication to its release, over 30 days.\n")
+	fmt.Fprintf(w, "# TYPE releaser_time_to_release_max_seconds gauge\n")
+	for _, s := range r.Services {
+		fmt.Fprintf(w, "releaser_time_to_release_max_seconds{service=%q} %.0f\n", s.Service, s.Max.Seconds())
+	}
+	fmt.Fprintf(w, "# HELP releaser_time_to_release_slo_target_seconds Time to release target by update type.\n")
+	fmt.Fprintf(w, "# TYPE releaser_time_to_release_slo_target_seconds gauge\n")
+	for _, t := range r.Types {
+		fmt.Fprintf(w, "releaser_time_to_release_slo_target_seconds{type=%q} %.0f\n", t.Type, t.Target.Seconds())
+	}
+	fmt.Fprintf(w, "# HELP releaser_time_to_release_slo_met_ratio Share of releases within the target by update type, over 30 days.\n")
+	fmt.Fprintf(w, "# TYPE releaser_time_to_release_slo_met_ratio gauge\n")
+	for _, t := range r.Types {
+		fmt.Fprintf(w, "releaser_time_to_release_slo_met_ratio{type=%q} %g\n", t.Type, t.Met())
+	}
+}
+
+// handleSLO serves GET /slo, the time to release report over the last
+// 30 days, or since the RFC 3339 time in ?since.
+func handleSLO(w http.ResponseWriter, r *http.Request) {
+	since := Clock.Now().Add(-sloWindow)
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	report, err := ReleaseSLO(since)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// SLOOptions control PrintSLO.
+type SLOOptions struct {
+	// Since is how far back the report goes.
+	Since time.Duration
+	// JSON prints the report as JSON instead of tables.
+	JSON bool
+}
+
+// RegisterFlags binds o to flags in fs.
+func (o *SLOOptions) RegisterFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&o.Since, "since", sloWindow, "how far back to report")
+	fs.BoolVar(&o.JSON, "json", false, "print the report as JSON")
+}
+
+// PrintSLO prints the time to release report from this releaser's state.
+// It returns the number of releases that missed their target.
+func PrintSLO(opts SLOOptions) (int, error) {
+	report, err := ReleaseSLO(Clock.Now().Add(-opts.Since))
+	if err != nil {
+		return 0, err
+	}
+	if opts.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return report.Breaches(), enc.Encode(report)
+	}
+	if len(report.Services) == 0 {
+		fmt.Printf("Nothing released since %s.\n", report.Since.Format(time.DateOnly))
+		return 0, nil
+	}
+	round := func(d time.Duration) string { return d.Round(time.Minute).String() }
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVICE\tRELEASES\tMEDIAN\tMAX\tMISSED")
+	for _, s := range report.Services {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%d\n", s.Service, s.Releases, round(s.Median), round(s.Max), len(s.Breaches))
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "TYPE\tTARGET\tRELEASES\tWITHIN\tMET")
+	for _, t := range report.Types {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%.0f%%\n", t.Type, round(t.Target), t.Releases, t.Within, t.Met()*100)
+	}
+	if err := tw.Flush(); err != nil {
+		return 0, err
+	}
+	for _, s := range report.Services {
+		for _, b := range s.Breaches {
+			fmt.Printf("Missed: %s:%s (%s) took %s to reach %s\n", b.Service, b.Tag, b.Type, round(b.Delay()), b.Release)
+		}
+	}
+	return report.Breaches(), nil
+}
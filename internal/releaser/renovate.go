@@ -0,0 +1,660 @@
+package releaser
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/velann21/todo-releaser/internal/image"
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// Repositories moving over from Renovate keep their Renovate config, which
+// the releaser reads from the first of RenovateFiles it finds. Of it, the
+// releaser follows:
+//
+//	ignoreDeps       images never updated
+//	packageRules     matchPackageNames, matchDepNames and matchUpdateTypes
+//	                 select images and updates; enabled: false holds them
+//	                 back, allowedVersions (a semver range) caps them and
+//	                 labels label their pull requests
+//	branchPrefix     of update branches, "renovate/" unless set
+//	labels           for every update pull request
+//	semanticCommits  "enabled" titles updates chore(deps): update …, with
+//	                 semanticCommitType and semanticCommitScope
+//
+// Package names are the images as Renovate names them, e.g. nginx or
+// ghcr.io/velann21/todo-worker, and match exactly, as a glob, as a /regex/,
+// or not at all when prefixed with !.
+//
+// With RELEASER_UPDATE_MODE=pr updates are not released directly. Each gets
+// a branch and pull request named as Renovate would name them, e.g.
+// renovate/nginx-1.x and "Update nginx Docker tag to v1.27.3", so PR
+// automation and dashboards built around Renovate keep working. Branches
+// are rebuilt from the base branch on every run, and what has been merged
+// into the manifest since the last release is released on the next.
+var RenovateFiles = []string{"renovate.json", ".github/renovate.json", ".gitlab/renovate.json", ".renovaterc", ".renovaterc.json"}
+
+// Update modes.
+const (
+	UpdateModeRelease = "release"
+	UpdateModePR      = "pr"
+)
+
+func updateMode() (string, error) {
+	switch mode := os.Getenv("RELEASER_UPDATE_MODE"); mode {
+	case "", UpdateModeRelease:
+		return UpdateModeRelease, nil
+	case UpdateModePR:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("RELEASER_UPDATE_MODE: %q must be release or pr", mode)
+	}
+}
+
+// RenovateConfig is the part of a Renovate config the releaser follows.
+type RenovateConfig struct {
+	IgnoreDeps          []string              `json:"ignoreDeps"`
+	PackageRules        []RenovatePackageRule `json:"packageRules"`
+	BranchPrefix        string                `json:"branchPrefix"`
+	Labels              []string              `json:"labels"`
+	SemanticCommits     string                `json:"semanticCommits"`
+	SemanticCommitType  string                `json:"semanticCommitType"`
+	SemanticCommitScope string                `json:"semanticCommitScope"`
+}
+
+// RenovatePackageRule is a Renovate package rule.
+type RenovatePackageRule struct {
+	MatchPackageNames []string `json:"matchPackageNames"`
+	MatchDepNames     []string `json:"matchDepNames"`
+	// MatchUpdateTypes are major, minor, patch or digest.
+	MatchUpdateTypes []string `json:"matchUpdateTypes"`
+	Enabled          *bool    `json:"enabled"`
+	AllowedVersions  string   `json:"allowedVersions"`
+	Labels           []string `json:"labels"`
+
+	allowed *semver.Constraints
+}
+
+// renovate is the Renovate config of the current run, nil without one.
+var renovate *RenovateConfig
+
+// loadRenovateConfig loads the first of RenovateFiles there is, or returns
+// nil when there is none.
+func loadRenovateConfig() (*RenovateConfig, error) {
+	for _, file := range RenovateFiles {
+		data, err := os.ReadFile(file)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var c RenovateConfig
+		if err := json.Unmarshal(data, &c); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %w", file, err)
+		}
+		for i := range c.PackageRules {
+			r := &c.PackageRules[i]
+			if r.AllowedVersions == "" {
+				continue
+			}
+			if r.allowed, err = semver.NewConstraint(r.AllowedVersions); err != nil {
+				return nil, fmt.Errorf("%s: allowedVersions %q is not a semver range: %w", file, r.AllowedVersions, err)
+			}
+		}
+		return &c, nil
+	}
+	return nil, nil
+}
+
+// depName is the name Renovate knows s's image by.
+func depName(s manifest.Service) string {
+	r, err := image.Parse(s.Image)
+	if err != nil {
+		name, _, _ := strings.Cut(s.Image, "@")
+		return name
+	}
+	return r.Name()
+}
+
+// matchNames reports whether name matches Renovate match patterns: any of
+// the positive ones, if there are any, and none of those negated with !.
+func matchNames(patterns []string, name string) bool {
+	positive, matched := false, false
+	for _, p := range patterns {
+		negated := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+		var ok bool
+		if len(p) > 1 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/") {
+			re, err := regexp.Compile(p[1 : len(p)-1])
+			ok = err == nil && re.MatchString(name)
+		} else {
+			ok, _ = path.Match(p, name)
+		}
+		if negated {
+			if ok {
+				return false
+			}
+			continue
+		}
+		positive = true
+		matched = matched || ok
+	}
+	return matched || !positive
+}
+
+// matches reports whether r applies to updates of type updateType to dep,
+// or to dep at all when updateType is "".
+func (r RenovatePackageRule) matches(dep, updateType string) bool {
+	if len(r.MatchPackageNames) > 0 && !matchNames(r.MatchPackageNames, dep) {
+		return false
+	}
+	if len(r.MatchDepNames) > 0 && !matchNames(r.MatchDepNames, dep) {
+		return false
+	}
+	if len(r.MatchUpdateTypes) > 0 {
+		return updateType != "" && slices.Contains(r.MatchUpdateTypes, updateType)
+	}
+	return true
+}
+
+// ignored reports whether s is never updated.
+func (c *RenovateConfig) ignored(s manifest.Service) bool {
+	return c.disabled(s, "")
+}
+
+// disabled reports whether updates of type updateType to s are held back,
+// the last rule to say so winning, as in Renovate.
+func (c *RenovateConfig) disabled(s manifest.Service, updateType string) bool {
+	return c.depDisabled(depName(s), updateType)
+}
+
+// depDisabled reports whether updates of type updateType to the dependency
+// dep are held back.
+func (c *RenovateConfig) depDisabled(dep, updateType string) bool {
+	if c == nil {
+		return false
+	}
+	if slices.Contains(c.IgnoreDeps, dep) {
+		return true
+	}
+	disabled := false
+	for _, r := range c.PackageRules {
+		if r.Enabled != nil && r.matches(dep, updateType) {
+			disabled = !*r.Enabled
+		}
+	}
+	return disabled
+}
+
+// constraint is the allowedVersions of the last rule for s that has one.
+func (c *RenovateConfig) constraint(s manifest.Service) *semver.Constraints {
+	if c == nil {
+		return nil
+	}
+	var allowed *semver.Constraints
+	dep := depName(s)
+	for _, r := range c.PackageRules {
+		if r.allowed != nil && len(r.MatchUpdateTypes) == 0 && r.matches(dep, "") {
+			allowed = r.allowed
+		}
+	}
+	return allowed
+}
+
+// updateType is the Renovate update type of a change to s: digest when
+// only the image behind the tag changed, which planUpdates records as a
+// change from the old digest.
+func updateType(s manifest.Service, c Change) string {
+	if algorithm, _, ok := strings.Cut(s.Digest(), ":"); ok && strings.HasPrefix(c.From, algorithm+":") {
+		return "digest"
+	}
+	switch determineIncrementType(c.From, c.To) {
+	case IncrementMajor:
+		return "major"
+	case IncrementMinor:
+		return "minor"
+	default:
+		return "patch"
+	}
+}
+
+var depNameUnsafe = regexp.MustCompile(`[/:\s]+|-{2,}`)
+
+// updateBranch is the branch Renovate would put the change to s on, with s
+// already updated: <branchPrefix><depNameSanitized>-<major>.x, or -digest
+// for digest updates.
+func (c *RenovateConfig) updateBranch(s manifest.Service, ch Change) string {
+	if updateType(s, ch) == "digest" {
+		return c.branchPrefix() + branchTopic(depName(s)) + "-digest"
+	}
+	return c.versionBranch(depName(s), ch.To)
+}
+
+func (c *RenovateConfig) branchPrefix() string {
+	if c != nil && c.BranchPrefix != "" {
+		return c.BranchPrefix
+	}
+	return "renovate/"
+}
+
+// branchTopic is dep sanitized for a branch name, as Renovate does.
+func branchTopic(dep string) string {
+	return depNameUnsafe.ReplaceAllString(strings.ToLower(strings.TrimPrefix(dep, "@")), "-")
+}
+
+// versionBranch is the branch of an update of dep to version:
+// <branchPrefix><depNameSanitized>-<major>.x.
+func (c *RenovateConfig) versionBranch(dep, version string) string {
+	topic := c.branchPrefix() + branchTopic(dep)
+	if v, err := semver.NewVersion(version); err == nil {
+		return fmt.Sprintf("%s-%d.x", topic, v.Major())
+	}
+	return topic
+}
+
+// updateTitle is the title Renovate would give the change to s, with s
+// already updated, e.g. "Update nginx Docker tag to v1.27.3".
+func (c *RenovateConfig) updateTitle(s manifest.Service, ch Change) string {
+	var topic, to string
+	switch updateType(s, ch) {
+	case "digest":
+		_, hex, _ := strings.Cut(s.Digest(), ":")
+		topic, to = "Docker digest", hex[:min(len(hex), 7)]
+	case "major":
+		v, _ := semver.NewVersion(ch.To)
+		topic, to = "Docker tag", fmt.Sprintf("v%d", v.Major())
+	default:
+		topic, to = "Docker tag", ch.To
+		if !strings.HasPrefix(to, "v") {
+			to = "v" + to
+		}
+	}
+	return c.semanticTitle(fmt.Sprintf("Update %s %s to %s", depName(s), topic, to))
+}
+
+// semanticTitle turns an "Update …" title into a semantic commit title,
+// chore(deps): update …, when semanticCommits is enabled.
+func (c *RenovateConfig) semanticTitle(title string) string {
+	if c == nil || c.SemanticCommits != "enabled" {
+		return title
+	}
+	typ, scope := c.SemanticCommitType, c.SemanticCommitScope
+	if typ == "" {
+		typ = "chore"
+	}
+	if scope == "" {
+		scope = "deps"
+	}
+	return fmt.Sprintf("%s(%s): u%s", typ, scope, title[1:])
+}
+
+// updateLabels are the labels of the pull request for the change to s.
+func (c *RenovateConfig) updateLabels(s manifest.Service, ch Change) []string {
+	return c.depLabels(depName(s), updateType(s, ch))
+}
+
+// depLabels are the labels of the pull request for an update of type typ
+// to the dependency dep.
+func (c *RenovateConfig) depLabels(dep, typ string) []string {
+	if c == nil {
+		return nil
+	}
+	labels := slices.Clone(c.Labels)
+	for _, r := range c.PackageRules {
+		if r.matches(dep, typ) {
+			labels = append(labels, r.Labels...)
+		}
+	}
+	slices.Sort(labels)
+	return slices.Compact(labels)
+}
+
+// UpdateBranch is how RELEASER_UPDATE_MODE=pr names a change.
+type UpdateBranch struct {
+	Service string   `json:"service"`
+	From    string   `json:"from"`
+	To      string   `json:"to"`
+	Branch  string   `json:"branch"`
+	Title   string   `json:"title"`
+	Labels  []string `json:"labels,omitempty"`
+	// Fixes are the vulnerabilities the update fixes.
+	Fixes []string `json:"fixes,omitempty"`
+	// Owners are the owners of the service, one of whom must approve.
+	Owners []string `json:"owners,omitempty"`
+}
+
+// updateBranches names changes, made to m.
+func updateBranches(m *manifest.Manifest, changes []Change) []UpdateBranch {
+	branches := []UpdateBranch{}
+	for _, c := range changes {
+		i := slices.IndexFunc(m.Services, func(s manifest.Service) bool { return s.Name == c.Service })
+		if i < 0 {
+			continue
+		}
+		s := m.Services[i]
+		labels := renovate.updateLabels(s, c)
+		if len(c.Security) > 0 && !slices.Contains(labels, SecurityLabel) {
+			labels = append(labels, SecurityLabel)
+		}
+		branches = append(branches, UpdateBranch{c.Service, c.From, c.To, renovate.updateBranch(s, c), renovate.updateTitle(s, c), labels, c.Fixes, serviceOwners(s)})
+	}
+	return branches
+}
+
+// holdBack drops the changes Renovate rules disable, restoring their
+// services in m to before, and returns them separately.
+func holdBack(m *manifest.Manifest, before []manifest.Service, changes []Change) (kept, held []Change) {
+	for _, c := range changes {
+		i := slices.IndexFunc(m.Services, func(s manifest.Service) bool { return s.Name == c.Service })
+		if renovate.disabled(m.Services[i], updateType(m.Services[i], c)) {
+			fmt.Printf("Holding back %s %s -> %s: disabled by the Renovate config\n", c.Service, c.From, c.To)
+			m.Services[i] = before[i]
+			held = append(held, c)
+			continue
+		}
+		kept = append(kept, c)
+	}
+	return kept, held
+}
+
+// holdChecks records in checks that the updates held were held back, and
+// why.
+func holdChecks(checks []ServiceCheck, held []Change, reason func(Change) string) {
+	for _, c := range held {
+		for i := range checks {
+			if checks[i].Name == c.Service {
+				checks[i].Update, checks[i].Reason = false, reason(c)
+			}
+		}
+	}
+}
+
+// baseBranch is the branch releases are made on.
+func baseBranch() (string, error) {
+	if managed != nil {
+		return managed.branch, nil
+	}
+	branch, err := currentRepo().branch()
+	if err == nil && branch == "" {
+		// Detached, as in GitHub Actions.
+		branch = os.Getenv("GITHUB_REF_NAME")
+	}
+	if branch == "" {
+		return "", errors.New("cannot tell the base branch: HEAD is detached and GITHUB_REF_NAME is not set")
+	}
+	return branch, err
+}
+
+// openUpdatePRs puts each of changes, made to m from before, on its own
+// branch off the base branch and opens a pull request for it, leaving the
+// checkout as it was. Each pull request carries a comment with checks, what
+// the run found for every service, so reviewers see why others weren't
+// updated.
+func openUpdatePRs(m *manifest.Manifest, before []manifest.Service, changes []Change, checks []ServiceCheck) error {
+	base, err := baseBranch()
+	if err != nil {
+		return err
+	}
+	head, err := commitOf("HEAD")
+	if err != nil {
+		return err
+	}
+	updates := updateBranches(m, changes)
+	owned := ownersInUse(m)
+	var failed []string
+	for _, u := range updates {
+		if err := openUpdatePR(m, before, u, base, head, checksTable(checks, updates, u), owned); err != nil {
+			fmt.Printf("Error opening the pull request for %s: %v\n", u.Service, err)
+			failed = append(failed, u.Service)
+		}
+		if err := currentRepo().reset(context.Background(), head, resetKeep); err != nil {
+			return err
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("opening pull requests failed for %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// reportedChecks is the checks comment last posted to each update branch's
+// pull request, so unchanged pull requests cost no API calls.
+var reportedChecks = map[string]string{}
+
+// openUpdatePR pushes u's branch unless it is current and opens its pull
+// request, commenting table. With owned, the owners' approval of the pull
+// request is checked too, every run, since it can come at any time.
+func openUpdatePR(m *manifest.Manifest, before []manifest.Service, u UpdateBranch, base, head, table string, owned bool) error {
+	i := slices.IndexFunc(m.Services, func(s manifest.Service) bool { return s.Name == u.Service })
+	updated := m.Services[i]
+	if updateCurrent(u.Branch, head, updated) {
+		if reportedChecks[u.Branch] == table && !owned {
+			fmt.Printf("%s is up to date on %s\n", u.Service, u.Branch)
+			return nil
+		}
+	} else {
+		only := *m
+		only.Services = slices.Clone(before)
+		only.Services[i] = updated
+		if err := manifest.Save(ManifestFile, &only); err != nil {
+			return fmt.Errorf("error saving manifest: %w", err)
+		}
+		if err := stageManifest(); err != nil {
+			return err
+		}
+		if err := currentRepo().commit(context.Background(), u.Title); err != nil {
+			return err
+		}
+		// The branch is ours to rebuild, as Renovate's are.
+		if err := currentRepo().push(context.Background(), true, "HEAD:refs/heads/"+u.Branch); err != nil {
+			return err
+		}
+	}
+	number, err := pullRequest(u, base, updatePRBody(u))
+	if err != nil {
+		return err
+	}
+	if err := reportChecks(number, table); err != nil {
+		return fmt.Errorf("error commenting the checks: %w", err)
+	}
+	reportedChecks[u.Branch] = table
+	if owned {
+		if err := reportApproval(number, u.Owners); err != nil {
+			return fmt.Errorf("error checking the owners' approval: %w", err)
+		}
+	}
+	return nil
+}
+
+// updatePRBody is the description of u's pull request.
+func updatePRBody(u UpdateBranch) string {
+	body := fmt.Sprintf("This PR updates %s from `%s` to `%s`.\n\n", u.Service, u.From, u.To)
+	if len(u.Fixes) > 0 {
+		body += fmt.Sprintf("This bump fixes %s.\n\n", strings.Join(u.Fixes, ", "))
+	}
+	if len(u.Owners) > 0 {
+		body += fmt.Sprintf("It needs the approval of %s, who own %s.\n\n", strings.Join(u.Owners, " or "), u.Service)
+	}
+	return body + "Merging it releases the update on the releaser's next run."
+}
+
+// updateCurrent reports whether origin's branch already updates s as
+// wanted, on top of head, so it needn't be pushed again.
+func updateCurrent(branch, head string, s manifest.Service) bool {
+	theirs, err := currentRepo().fetch(context.Background(), branch)
+	if err != nil {
+		return false
+	}
+	if ok, err := currentRepo().isAncestor(head, theirs); err != nil || !ok {
+		return false
+	}
+	data, err := gitShow(theirs, ManifestFile)
+	if err != nil {
+		return false
+	}
+	m, err := manifest.Parse(data)
+	if err != nil {
+		return false
+	}
+	for _, got := range m.Services {
+		if got.Name == s.Name {
+			return got.Image == s.Image && got.Version == s.Version
+		}
+	}
+	return false
+}
+
+// pullRequest returns the number of the open pull request for u, opening
+// one into base when there is none.
+func pullRequest(u UpdateBranch, base, body string) (int, error) {
+	owner, _, _ := strings.Cut(githubRepository(), "/")
+	var open []struct {
+		Number int `json:"number"`
+	}
+	if _, err := githubAPI(http.MethodGet, "/pulls?state=open&head="+url.QueryEscape(owner+":"+u.Branch), nil, &open); err != nil {
+		return 0, err
+	}
+	if len(open) > 0 {
+		return open[0].Number, nil
+	}
+
+	var pr struct {
+		Number  int    `json:"number"`
+		HTMLURL string `json:"html_url"`
+	}
+	if _, err := githubAPI(http.MethodPost, "/pulls", map[string]string{"title": u.Title, "head": u.Branch, "base": base, "body": body}, &pr); err != nil {
+		return 0, err
+	}
+	fmt.Printf("Opened pull request %s: %s\n", pr.HTMLURL, u.Title)
+	if len(u.Labels) > 0 {
+		if _, err := githubAPI(http.MethodPost, fmt.Sprintf("/issues/%d/labels", pr.Number), map[string][]string{"labels": u.Labels}, nil); err != nil {
+			return pr.Number, err
+		}
+	}
+	if len(u.Owners) > 0 {
+		if err := requestOwnerReviews(pr.Number, u.Owners); err != nil {
+			fmt.Printf("Error asking %s to review %s: %v\n", strings.Join(u.Owners, ", "), pr.HTMLURL, err)
+		}
+	}
+	return pr.Number, nil
+}
+
+// checksMarker starts the checks comment, to find it again.
+const checksMarker = "<!-- releaser:checks -->"
+
+// checksTable renders checks as the checks comment of u's pull request,
+// naming the pull requests of the other updates. Failed checks are
+// summarised above the table by why they failed.
+func checksTable(checks []ServiceCheck, updates []UpdateBranch, u UpdateBranch) string {
+	cell := func(s string) string { return strings.ReplaceAll(strings.ReplaceAll(s, "|", "\\|"), "\n", " ") }
+	code := func(s string) string {
+		if s == "" {
+			return ""
+		}
+		return "`" + cell(s) + "`"
+	}
+	var b strings.Builder
+	b.WriteString(checksMarker + "\n")
+	b.WriteString("### Registry check\n\n")
+	if groups := failureGroups(checks); len(groups) > 0 {
+		for _, g := range groups {
+			fmt.Fprintf(&b, "- :warning: %s (%s)\n", g, strings.Join(g.Services, ", "))
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("| Service | Current | Latest | Result |\n")
+	b.WriteString("| --- | --- | --- | --- |\n")
+	for _, c := range checks {
+		var result string
+		switch {
+		case c.Error != "" && c.Failure != "":
+			result = c.Failure + ": " + c.Error
+		case c.Error != "":
+			result = "error: " + c.Error
+		case c.Skipped:
+			result = "skipped: " + c.Reason
+		case c.Reason != "":
+			result = "held back: " + c.Reason
+		case c.Name == u.Service:
+			result = "**updated here**"
+		case c.Update:
+			result = "updated in its own pull request"
+			for _, other := range updates {
+				if other.Service == c.Name {
+					result = "updated on " + code(other.Branch)
+				}
+			}
+		default:
+			result = "up to date"
+		}
+		fmt.Fprintf(&b, "| %s | %s | %s | %s |\n", cell(c.Name), code(c.Current), code(c.Latest), cell(result))
+	}
+	return b.String()
+}
+
+// reportChecks posts table as the checks comment of pull request number,
+// editing the one posted before, if any, in place.
+func reportChecks(number int, table string) error {
+	var comments []struct {
+		ID   int64  `json:"id"`
+		Body string `json:"body"`
+	}
+	if _, err := githubAPI(http.MethodGet, fmt.Sprintf("/issues/%d/comments?per_page=100", number), nil, &comments); err != nil {
+		return err
+	}
+	for _, c := range comments {
+		if !strings.HasPrefix(c.Body, checksMarker) {
+			continue
+		}
+		if c.Body == table {
+			return nil
+		}
+		_, err := githubAPI(http.MethodPatch, fmt.Sprintf("/issues/comments/%d", c.ID), map[string]string{"body": table}, nil)
+		return err
+	}
+	_, err := githubAPI(http.MethodPost, fmt.Sprintf("/issues/%d/comments", number), map[string]string{"body": table}, nil)
+	return err
+}
+
+// mergedChanges returns the changes to m's services since its release,
+// which under RELEASER_UPDATE_MODE=pr are the update pull requests merged
+// since.
+func mergedChanges(m *manifest.Manifest) ([]Change, error) {
+	if m.ReleaseVersion == "" {
+		return nil, nil
+	}
+	data, err := gitShow(m.ReleaseVersion, ManifestFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the manifest of %s: %w", m.ReleaseVersion, err)
+	}
+	released, err := manifest.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing the manifest of %s: %w", m.ReleaseVersion, err)
+	}
+	var changes []Change
+	for _, s := range m.Services {
+		i := slices.IndexFunc(released.Services, func(r manifest.Service) bool { return r.Name == s.Name })
+		switch {
+		case i < 0:
+			changes = append(changes, Change{Service: s.Name, To: s.Version})
+		case released.Services[i].Image != s.Image || released.Services[i].Version != s.Version:
+			from := released.Services[i].Version
+			if from == "" || from == s.Version {
+				from = currentVersion(released.Services[i])
+			}
+			changes = append(changes, Change{Service: s.Name, From: from, To: s.Version})
+		}
+	}
+	return changes, nil
+}
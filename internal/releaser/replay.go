@@ -0,0 +1,361 @@
+package releaser
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/velann21/todo-releaser/internal/image"
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// Each reconcile records what the registries offered, the tags and the
+// digests they pointed to, as the registry history: when each tag was
+// first seen, and each digest a tag was seen at. `releaser replay` runs
+// the update decisions again over it, with the Renovate config and
+// branch policy of the checkout, to show what a policy change would have
+// released had it been in force: it starts from the release in force
+// opts.Since ago and, every opts.Every, plans updates against the tags
+// seen by then. Registries are not asked, nor is anything committed,
+// tagged or deployed. Platform checks pass, as platforms aren't recorded,
+// and the license gate and freezes are left out.
+
+const registryHistoryState = "registry_history.json"
+
+// imageHistory is what a registry was seen to offer for an image.
+type imageHistory struct {
+	// Tags are when each tag was first seen.
+	Tags map[string]time.Time `json:"tags"`
+	// Digests are the digests each tag was seen at, oldest first.
+	Digests map[string][]digestSeen `json:"digests,omitempty"`
+}
+
+type digestSeen struct {
+	Digest string    `json:"digest"`
+	Seen   time.Time `json:"seen"`
+}
+
+// registryObservations are the tags and digests seen since the history was
+// last recorded, by image name.
+var registryObservations struct {
+	sync.Mutex
+	tags    map[string][]string
+	digests map[string]map[string]string
+}
+
+func observeTags(r image.Reference, tags []string) {
+	registryObservations.Lock()
+	defer registryObservations.Unlock()
+	if registryObservations.tags == nil {
+		registryObservations.tags = map[string][]string{}
+	}
+	registryObservations.tags[r.Name()] = append(registryObservations.tags[r.Name()], tags...)
+}
+
+func observeDigest(r image.Reference, tag, digest string) {
+	registryObservations.Lock()
+	defer registryObservations.Unlock()
+	if registryObservations.digests == nil {
+		registryObservations.digests = map[string]map[string]string{}
+	}
+	if registryObservations.digests[r.Name()] == nil {
+		registryObservations.digests[r.Name()] = map[string]string{}
+	}
+	registryObservations.digests[r.Name()][tag] = digest
+}
+
+var registryHistoryMu sync.Mutex
+
+func readRegistryHistory() (map[string]*imageHistory, error) {
+	history := map[string]*imageHistory{}
+	if err := readStateJSON(registryHistoryState, &history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// recordRegistryHistory adds what was seen since it was last called to the
+// registry history, as seen at now. Recording is best effort: errors are
+// logged.
+func recordRegistryHistory(now time.Time) {
+	registryObservations.Lock()
+	tags, digests := registryObservations.tags, registryObservations.digests
+	registryObservations.tags, registryObservations.digests = nil, nil
+	registryObservations.Unlock()
+	if len(tags) == 0 && len(digests) == 0 {
+		return
+	}
+	if err := appendRegistryHistory(tags, digests, now.UTC()); err != nil {
+		fmt.Printf("Error recording the registry history: %v\n", err)
+	}
+}
+
+func appendRegistryHistory(tags map[string][]string, digests map[string]map[string]string, now time.Time) error {
+	registryHistoryMu.Lock()
+	defer registryHistoryMu.Unlock()
+	history, err := readRegistryHistory()
+	if err != nil {
+		return err
+	}
+	changed := false
+	entry := func(name string) *imageHistory {
+		if history[name] == nil {
+			history[name] = &imageHistory{Tags: map[string]time.Time{}}
+		}
+		return history[name]
+	}
+	for name, seen := range tags {
+		h := entry(name)
+		for _, tag := range seen {
+			if _, ok := h.Tags[tag]; !ok {
+				h.Tags[tag] = now
+				changed = true
+			}
+		}
+	}
+	for name, seen := range digests {
+		h := entry(name)
+		for tag, digest := range seen {
+			if _, ok := h.Tags[tag]; !ok {
+				h.Tags[tag] = now
+			}
+			if h.Digests == nil {
+				h.Digests = map[string][]digestSeen{}
+			}
+			if d := h.Digests[tag]; len(d) == 0 || d[len(d)-1].Digest != digest {
+				h.Digests[tag] = append(d, digestSeen{digest, now})
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return writeStateJSON(registryHistoryState, history)
+}
+
+// registryReplay, while set, answers registry lookups from the history.
+var registryReplay *replaySource
+
+// errNoHistory is a lookup the registry history can't answer.
+var errNoHistory = errors.New("not in the registry history")
+
+// replaySource is the registry history as it stood at a time.
+type replaySource struct {
+	history map[string]*imageHistory
+	at      time.Time
+}
+
+func (s *replaySource) latestTag(r image.Reference, c *semver.Constraints) (string, error) {
+	h := s.history[r.Name()]
+	if h == nil {
+		return "", fmt.Errorf("%s: %w", r.Name(), errNoHistory)
+	}
+	var tags []string
+	for tag, seen := range h.Tags {
+		if !seen.After(s.at) {
+			tags = append(tags, tag)
+		}
+	}
+	return newestTag(tags, c), nil
+}
+
+func (s *replaySource) tagDigest(r image.Reference, tag string) (string, error) {
+	var digest string
+	if h := s.history[r.Name()]; h != nil {
+		for _, d := range h.Digests[tag] {
+			if !d.Seen.After(s.at) {
+				digest = d.Digest
+			}
+		}
+	}
+	if digest == "" {
+		return "", fmt.Errorf("digest of %s:%s: %w", r.Name(), tag, errNoHistory)
+	}
+	return digest, nil
+}
+
+// replayClock is the time of a replay step.
+type replayClock time.Time
+
+func (c replayClock) Now() time.Time { return time.Time(c) }
+
+// ReplayOptions control Replay.
+type ReplayOptions struct {
+	// Since is how far back the replay starts.
+	Since time.Duration
+	// Every is how often the replay plans updates, as the schedule would.
+	Every time.Duration
+	// JSON prints the report as JSON instead of tables.
+	JSON bool
+}
+
+// RegisterFlags binds o to flags in fs.
+func (o *ReplayOptions) RegisterFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&o.Since, "since", sloWindow, "how far back to start the replay")
+	fs.DurationVar(&o.Every, "every", 24*time.Hour, "how often to plan updates")
+	fs.BoolVar(&o.JSON, "json", false, "print the report as JSON")
+}
+
+// ReplayRelease is a release the replay made.
+type ReplayRelease struct {
+	Time    time.Time `json:"time"`
+	Changes []Change  `json:"changes"`
+}
+
+// ReplayService compares what the replay and the releases made of a
+// service.
+type ReplayService struct {
+	Service string `json:"service"`
+	// Replayed and Released count the releases that updated the service.
+	Replayed int `json:"replayed"`
+	Released int `json:"released"`
+	// Version and Current are where the replay and the releases left it.
+	Version string `json:"version"`
+	Current string `json:"current"`
+}
+
+// ReplayReport is the outcome of a replay.
+type ReplayReport struct {
+	Since time.Time `json:"since"`
+	// Start is the release the replay started from.
+	Start    string          `json:"start"`
+	Replayed []ReplayRelease `json:"replayed"`
+	Released []Release       `json:"released"`
+	Services []ReplayService `json:"services"`
+	// Unrecorded are the services the registry history doesn't cover,
+	// which the replay left as they were.
+	Unrecorded []string `json:"unrecorded,omitempty"`
+}
+
+// Replay replays the update decisions over the registry history, with
+// the Renovate config and branch policy of the checkout.
+func Replay(ctx context.Context, opts ReplayOptions) (*ReplayReport, error) {
+	if opts.Since <= 0 || opts.Every <= 0 {
+		return nil, errors.New("replay needs a positive -since and -every")
+	}
+	history, err := readRegistryHistory()
+	if err != nil {
+		return nil, err
+	}
+	if len(history) == 0 {
+		return nil, errors.New("no registry history is recorded yet; each run records it from now on")
+	}
+	if renovate, err = loadRenovateConfig(); err != nil {
+		return nil, err
+	}
+	policy, err := currentBranchPolicy()
+	if err != nil {
+		return nil, err
+	}
+	releases, err := releaseHistory()
+	if err != nil {
+		return nil, err
+	}
+	now := Clock.Now().UTC()
+	report := &ReplayReport{Since: now.Add(-opts.Since), Replayed: []ReplayRelease{}, Released: []Release{}}
+	var current map[string]string
+	for _, r := range releases {
+		if r.Time.After(report.Since) {
+			report.Released = append(report.Released, r)
+		} else {
+			report.Start = r.Tag
+		}
+		current = r.Services
+	}
+	if report.Start == "" {
+		return nil, fmt.Errorf("no release before %s to start the replay from", report.Since.Format(time.DateOnly))
+	}
+	data, err := gitShow("refs/tags/"+report.Start, ManifestFile)
+	if err != nil {
+		return nil, err
+	}
+	m, err := manifest.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the manifest of %s: %w", report.Start, err)
+	}
+	for _, s := range m.Services {
+		if r, err := image.Parse(s.Image); err != nil || history[r.Name()] == nil {
+			report.Unrecorded = append(report.Unrecorded, s.Name)
+		}
+	}
+
+	clock := Clock
+	defer func() { registryReplay, Clock, runID = nil, clock, "" }()
+	runID = "replay"
+	// The decisions' progress would bury the report.
+	stdout := os.Stdout
+	if devNull, err := os.Open(os.DevNull); err == nil {
+		os.Stdout = devNull
+		defer func() { os.Stdout = stdout; devNull.Close() }()
+	}
+	for t := report.Since.Add(opts.Every); !t.After(now); t = t.Add(opts.Every) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		registryReplay, Clock = &replaySource{history, t}, replayClock(t)
+		before := slices.Clone(m.Services)
+		planned, _ := planUpdates(ctx, m, policy, nil)
+		changes, _ := holdBack(m, before, planned)
+		if len(changes) > 0 {
+			report.Replayed = append(report.Replayed, ReplayRelease{Time: t, Changes: changes})
+		}
+	}
+
+	for _, s := range m.Services {
+		rs := ReplayService{Service: s.Name, Version: currentVersion(s), Current: current[s.Name]}
+		for _, r := range report.Replayed {
+			if slices.ContainsFunc(r.Changes, func(c Change) bool { return c.Service == s.Name }) {
+				rs.Replayed++
+			}
+		}
+		for _, r := range report.Released {
+			if slices.Contains(r.Changed, s.Name) {
+				rs.Released++
+			}
+		}
+		report.Services = append(report.Services, rs)
+	}
+	return report, nil
+}
+
+// PrintReplay prints the report of a Replay.
+func PrintReplay(ctx context.Context, opts ReplayOptions) error {
+	report, err := Replay(ctx, opts)
+	if err != nil {
+		return err
+	}
+	if opts.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	fmt.Printf("Replayed from %s, the release in force on %s; %d releases were made since.\n", report.Start, report.Since.Format(time.DateOnly), len(report.Released))
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tSERVICE\tFROM\tTO")
+	for _, r := range report.Replayed {
+		for _, c := range r.Changes {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Time.Format(time.DateTime), c.Service, c.From, c.To)
+		}
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "SERVICE\tREPLAYED\tRELEASED\tVERSION\tCURRENT")
+	for _, s := range report.Services {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\n", s.Service, s.Replayed, s.Released, s.Version, s.Current)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(report.Unrecorded) > 0 {
+		fmt.Printf("Not in the registry history, so left as they were: %v\n", report.Unrecorded)
+	}
+	return nil
+}
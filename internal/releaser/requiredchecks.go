@@ -0,0 +1,141 @@
+package releaser
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// RELEASER_REQUIRED_CHECKS lists, comma-separated, the GitHub checks that
+// must have passed on the commit a release is cut from: commit status
+// contexts, check run names or Actions workflow names, e.g.
+// ci/build,test,Deploy preview. A release waits while any of them is
+// still running and is refused when any failed or never ran, so none is
+// ever cut off a red build. It needs GITHUB_TOKEN or a GitHub App.
+func requiredChecks() []string {
+	var checks []string
+	for _, c := range strings.Split(os.Getenv("RELEASER_REQUIRED_CHECKS"), ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			checks = append(checks, c)
+		}
+	}
+	return checks
+}
+
+// errChecksPending is returned when a release waits for required checks.
+var errChecksPending = errors.New("required checks are still running")
+
+// Outcomes of a required check.
+const (
+	checkPassed  = "passed"
+	checkPending = "pending"
+	checkFailed  = "failed"
+)
+
+// githubChecks returns the outcome of each check GitHub has for commit,
+// by status context, check run name and workflow name.
+func githubChecks(commit string) (map[string]string, error) {
+	outcomes := map[string]string{}
+
+	var status struct {
+		Statuses []struct {
+			Context string `json:"context"`
+			State   string `json:"state"`
+		} `json:"statuses"`
+	}
+	if _, err := githubAPI(http.MethodGet, "/commits/"+commit+"/status?per_page=100", nil, &status); err != nil {
+		return nil, fmt.Errorf("error reading commit statuses: %w", err)
+	}
+	for _, s := range status.Statuses {
+		switch s.State {
+		case "success":
+			outcomes[s.Context] = checkPassed
+		case "pending":
+			outcomes[s.Context] = checkPending
+		default:
+			outcomes[s.Context] = checkFailed
+		}
+	}
+
+	// Check runs and workflow runs come newest first; reruns replace the
+	// outcome of earlier runs.
+	type run struct {
+		Name       string `json:"name"`
+		Status     string `json:"status"`
+		Conclusion string `json:"conclusion"`
+	}
+	outcome := func(r run) string {
+		switch {
+		case r.Status != "completed":
+			return checkPending
+		case slices.Contains([]string{"success", "neutral", "skipped"}, r.Conclusion):
+			return checkPassed
+		default:
+			return checkFailed
+		}
+	}
+	var checkRuns struct {
+		CheckRuns []run `json:"check_runs"`
+	}
+	if _, err := githubAPI(http.MethodGet, "/commits/"+commit+"/check-runs?per_page=100", nil, &checkRuns); err != nil {
+		return nil, fmt.Errorf("error reading check runs: %w", err)
+	}
+	var workflowRuns struct {
+		WorkflowRuns []run `json:"workflow_runs"`
+	}
+	if _, err := githubAPI(http.MethodGet, "/actions/runs?per_page=100&head_sha="+commit, nil, &workflowRuns); err != nil {
+		return nil, fmt.Errorf("error reading workflow runs: %w", err)
+	}
+	for _, r := range slices.Concat(checkRuns.CheckRuns, workflowRuns.WorkflowRuns) {
+		if _, ok := outcomes[r.Name]; !ok {
+			outcomes[r.Name] = outcome(r)
+		}
+	}
+	return outcomes, nil
+}
+
+// gateRequiredChecks checks that the required checks passed on HEAD, the
+// commit the next release is cut from. It returns errChecksPending when
+// some are still running.
+func gateRequiredChecks() error {
+	required := requiredChecks()
+	if len(required) == 0 {
+		return nil
+	}
+	commit, err := commitOf("HEAD")
+	if err != nil {
+		return err
+	}
+	return checkCommit(commit, required)
+}
+
+// checkCommit checks that the required checks passed on commit.
+func checkCommit(commit string, required []string) error {
+	outcomes, err := githubChecks(commit)
+	if err != nil {
+		return err
+	}
+	var failed, pending []string
+	for _, c := range required {
+		switch outcomes[c] {
+		case checkPassed:
+		case checkPending:
+			pending = append(pending, c)
+		case checkFailed:
+			failed = append(failed, c)
+		default:
+			failed = append(failed, c+" (not run)")
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("required checks failed on %s: %s", shortRevision(commit), strings.Join(failed, ", "))
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%w on %s: %s", errChecksPending, shortRevision(commit), strings.Join(pending, ", "))
+	}
+	fmt.Printf("Required checks passed on %s\n", shortRevision(commit))
+	return nil
+}
@@ -0,0 +1,267 @@
+package releaser
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// SandboxOptions control Sandbox.
+type SandboxOptions struct {
+	// Dir is where the sandbox's repositories and state are created; a
+	// new temporary directory when empty.
+	Dir string
+	// Serve keeps the releaser running as a daemon on the sandbox after
+	// the first release, instead of returning.
+	Serve bool
+}
+
+// RegisterFlags binds o to flags in fs.
+func (o *SandboxOptions) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Dir, "dir", "", "directory to create the sandbox in (default a new temporary directory)")
+	fs.BoolVar(&o.Serve, "serve", false, "keep running as a daemon on the sandbox after the first release")
+}
+
+// sandboxImage is an image the sandbox registry serves.
+type sandboxImage struct {
+	repo string
+	tags []string
+}
+
+// sandboxImages are the images of the sandbox registry. The seeded
+// manifest runs the second tag of each, so the first run releases a minor
+// and two patch updates.
+var sandboxImages = []sandboxImage{
+	{"singaravelan21/todo-frontend", []string{"v1.0.0", "v1.1.0", "v1.2.0"}},
+	{"singaravelan21/todo-backend", []string{"v1.0.0", "v1.1.0", "v1.1.1"}},
+	{"library/nginx", []string{"1.27.1", "1.27.2", "1.27.3"}},
+}
+
+// sandboxSource is the source repository the sandbox images are labelled
+// with.
+const sandboxSource = "https://github.com/velann21/todo-app"
+
+// sandboxCreated is the build time the sandbox images are labelled with.
+const sandboxCreated = "2025-10-01T00:00:00Z"
+
+// Sandbox runs the releaser end to end without any external service or
+// credentials, for trying it out and for demos. It creates, in opts.Dir:
+//
+//	origin.git  a bare repository seeded with a release manifest, the remote
+//	checkout/   the releaser's managed checkout of it
+//	state/      the releaser's state
+//	deployed/   the manifest of every release, copied there by the deploy command
+//
+// Docker Hub is replaced by a registry embedded in the process, serving
+// sandboxImages, and the environment is cleared of RELEASER_* and GitHub
+// settings so nothing reaches out. Sandbox then reconciles once: it checks
+// the registry, releases the updates, pushes the release to origin.git and
+// deploys it. With opts.Serve the releaser keeps running as a daemon.
+func Sandbox(ctx context.Context, opts SandboxOptions) (*Result, error) {
+	dir := opts.Dir
+	if dir == "" {
+		var err error
+		if dir, err = os.MkdirTemp("", "releaser-sandbox-"); err != nil {
+			return nil, err
+		}
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Creating a sandbox in %s\n", dir)
+
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(name, "RELEASER_") || strings.HasPrefix(name, "GITHUB_") {
+			os.Unsetenv(name)
+		}
+	}
+	// The fake registry needs no rate limit.
+	registryHTTP.Transport = sandboxTransport{newSandboxRegistry()}
+
+	origin := filepath.Join(dir, "origin.git")
+	if err := seedSandbox(origin, filepath.Join(dir, "seed")); err != nil {
+		return nil, fmt.Errorf("error seeding the sandbox: %w", err)
+	}
+	deployed := filepath.Join(dir, "deployed")
+	if err := os.MkdirAll(deployed, 0755); err != nil {
+		return nil, err
+	}
+	os.Setenv("RELEASER_REPO_URL", "file://"+origin)
+	os.Setenv("RELEASER_REPO_DIR", filepath.Join(dir, "checkout"))
+	os.Setenv("RELEASER_STATE_DIR", filepath.Join(dir, "state"))
+	os.Setenv("RELEASER_SANDBOX_DEPLOYED", deployed)
+	os.Setenv("RELEASER_DEPLOY_COMMAND", `cp "$RELEASE_MANIFEST" "$RELEASER_SANDBOX_DEPLOYED/$RELEASE_VERSION.json"`)
+
+	if opts.Serve {
+		Run(ctx)
+		return nil, nil
+	}
+	result, err := Reconcile(ctx)
+	if err != nil {
+		return result, err
+	}
+	if result != nil {
+		fmt.Printf("Released and deployed %s: see %s\n", result.Version, filepath.Join(deployed, result.Version+".json"))
+	}
+	return result, nil
+}
+
+// seedSandbox creates the bare repository origin with one release of a
+// manifest running the second tag of each sandbox image, committed from
+// the scratch worktree seed.
+func seedSandbox(origin, seed string) error {
+	if err := runGitCommand("init", "--quiet", "--bare", "--initial-branch", "main", origin); err != nil {
+		return err
+	}
+	if err := runGitCommand("clone", "--quiet", origin, seed); err != nil {
+		return err
+	}
+	version := calverPrefix(Clock.Now()) + ".0.0"
+	m := &manifest.Manifest{ReleaseVersion: version}
+	for _, img := range sandboxImages {
+		m.Services = append(m.Services, manifest.Service{
+			Name:    img.repo[strings.LastIndex(img.repo, "/")+1:],
+			Image:   strings.TrimPrefix(img.repo, "library/"),
+			Version: img.tags[1],
+		})
+	}
+	if err := manifest.Save(filepath.Join(seed, ManifestFile), m); err != nil {
+		return err
+	}
+	git := func(args ...string) error {
+		return runGitCommand(append([]string{"-C", seed, "-c", "user.name=sandbox", "-c", "user.email=sandbox@localhost"}, args...)...)
+	}
+	for _, args := range [][]string{
+		{"add", ManifestFile},
+		{"commit", "--quiet", "-m", "chore: release " + version},
+		{"tag", version},
+		{"push", "--quiet", "origin", "HEAD:refs/heads/main", "refs/tags/" + version},
+	} {
+		if err := git(args...); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(seed)
+}
+
+// sandboxTransport serves requests with an in-process handler.
+type sandboxTransport struct {
+	handler http.Handler
+}
+
+func (t sandboxTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	t.handler.ServeHTTP(rec, req)
+	resp := rec.Result()
+	resp.Request = req
+	return resp, nil
+}
+
+// sandboxDigest is the made-up digest of a sandbox image or its config.
+func sandboxDigest(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// newSandboxRegistry returns a fake of the Docker Hub APIs the releaser
+// uses (hub.docker.com, auth.docker.io and registry-1.docker.io) serving
+// sandboxImages. Every image is a single linux/amd64 image labelled with
+// its source, a revision and sandboxCreated.
+func newSandboxRegistry() http.Handler {
+	find := func(repo, tag string) bool {
+		i := slices.IndexFunc(sandboxImages, func(img sandboxImage) bool { return img.repo == repo })
+		return i >= 0 && (tag == "" || slices.Contains(sandboxImages[i].tags, tag))
+	}
+	writeJSON := func(w http.ResponseWriter, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Host {
+		case "auth.docker.io":
+			writeJSON(w, map[string]string{"token": "sandbox"})
+			return
+
+		case "hub.docker.com":
+			rest, ok := strings.CutPrefix(r.URL.Path, "/v2/repositories/")
+			repo, tag, _ := strings.Cut(rest, "/tags")
+			tag = strings.TrimPrefix(tag, "/")
+			if !ok || !find(repo, tag) {
+				break
+			}
+			if tag != "" {
+				writeJSON(w, map[string]string{"name": tag, "digest": sandboxDigest(repo, tag)})
+				return
+			}
+			var tags DockerHubTags
+			for _, img := range sandboxImages {
+				if img.repo == repo {
+					for _, t := range img.tags {
+						tags.Results = append(tags.Results, struct {
+							Name string `json:"name"`
+						}{t})
+					}
+				}
+			}
+			writeJSON(w, tags)
+			return
+
+		case "registry-1.docker.io":
+			rest, _ := strings.CutPrefix(r.URL.Path, "/v2/")
+			if repo, ref, ok := strings.Cut(rest, "/manifests/"); ok {
+				tag := ref
+				for _, img := range sandboxImages {
+					for _, t := range img.tags {
+						if img.repo == repo && sandboxDigest(repo, t) == ref {
+							tag = t
+						}
+					}
+				}
+				if !find(repo, tag) {
+					break
+				}
+				w.Header().Set("Docker-Content-Digest", sandboxDigest(repo, tag))
+				w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+				json.NewEncoder(w).Encode(map[string]any{
+					"schemaVersion": 2,
+					"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+					"config":        map[string]any{"digest": sandboxDigest(repo, tag, "config"), "size": 1024},
+					"layers":        []map[string]any{{"digest": sandboxDigest(repo, tag, "layer"), "size": 20 << 20}},
+				})
+				return
+			}
+			if repo, digest, ok := strings.Cut(rest, "/blobs/"); ok {
+				for _, img := range sandboxImages {
+					for _, t := range img.tags {
+						if img.repo == repo && sandboxDigest(repo, t, "config") == digest {
+							writeJSON(w, map[string]any{
+								"os":           "linux",
+								"architecture": "amd64",
+								"config": map[string]any{"Labels": map[string]string{
+									LabelSource:   sandboxSource,
+									LabelRevision: sandboxDigest(repo, t)[len("sha256:"):][:40],
+									LabelCreated:  sandboxCreated,
+								}},
+							})
+							return
+						}
+					}
+				}
+			}
+		}
+		http.Error(w, "not found in the sandbox registry", http.StatusNotFound)
+	})
+}
@@ -0,0 +1,135 @@
+package releaser
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/image"
+	"github.com/velann21/todo-releaser/internal/manifest"
+	"github.com/velann21/todo-releaser/internal/schedule"
+)
+
+// The daemon checks each service on its own schedule: every
+// PollingInterval, unless the service's check_interval in the manifest or
+// its registry's entry in RELEASER_REGISTRY_INTERVALS, e.g.
+// docker.io=24h,ghcr.io=5m, says otherwise. RELEASER_SCHEDULE_JITTER
+// spreads the checks by up to that fraction of their interval either way,
+// DefaultScheduleJitter unless set.
+const DefaultScheduleJitter = 0.1
+
+func scheduleJitter() float64 {
+	if v := os.Getenv("RELEASER_SCHEDULE_JITTER"); v != "" {
+		if j, err := strconv.ParseFloat(v, 64); err == nil && j >= 0 && j < 1 {
+			return j
+		}
+		fmt.Printf("Ignoring RELEASER_SCHEDULE_JITTER=%q: not a fraction below 1\n", v)
+	}
+	return DefaultScheduleJitter
+}
+
+// parseIntervals parses a comma-separated list of host=duration pairs.
+func parseIntervals(s string) (map[string]time.Duration, error) {
+	intervals := map[string]time.Duration{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		host, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not host=interval", pair)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%s: %q is not a positive duration", host, value)
+		}
+		intervals[strings.TrimSpace(host)] = d
+	}
+	return intervals, nil
+}
+
+// serviceIntervals works out how often each of m's services is checked.
+// Intervals that don't parse are reported and replaced by PollingInterval.
+func serviceIntervals(m *manifest.Manifest) map[string]time.Duration {
+	registries, err := parseIntervals(os.Getenv("RELEASER_REGISTRY_INTERVALS"))
+	if err != nil {
+		fmt.Printf("Ignoring RELEASER_REGISTRY_INTERVALS: %v\n", err)
+	}
+	intervals := make(map[string]time.Duration, len(m.Services))
+	for _, s := range m.Services {
+		interval := PollingInterval
+		if r, err := image.Parse(s.Image); err == nil {
+			if d, ok := registries[r.Registry]; ok {
+				interval = d
+			}
+		}
+		if s.CheckInterval != "" {
+			if d, err := time.ParseDuration(s.CheckInterval); err == nil && d > 0 {
+				interval = d
+			} else {
+				fmt.Printf("Ignoring check_interval %q of %s: not a positive duration\n", s.CheckInterval, s.Name)
+			}
+		}
+		intervals[s.Name] = interval
+	}
+	return intervals
+}
+
+// syncSchedule brings the schedule in line with the services in the
+// manifest, as the checkout now has it.
+func syncSchedule(sched *schedule.Scheduler, now time.Time) error {
+	if err := syncCheckout(); err != nil {
+		return fmt.Errorf("error updating the checkout: %w", err)
+	}
+	m, err := loadManifest()
+	if err != nil {
+		return fmt.Errorf("error loading manifest: %w", err)
+	}
+	sched.Set(serviceIntervals(m), now)
+	return nil
+}
+
+// dueServices returns the services due at now, along with those a
+// security advisory brings forward (see securityDue).
+func dueServices(sched *schedule.Scheduler, now time.Time, advised map[string]bool) []string {
+	due := sched.Due(now)
+	m, err := loadManifest()
+	if err != nil {
+		return due
+	}
+	return securityDue(m, due, advised)
+}
+
+// nextWake is how long Run sleeps: until the next service is due, but no
+// longer than PollingInterval, so services added to the manifest are
+// picked up.
+func nextWake(sched *schedule.Scheduler, now time.Time) time.Duration {
+	next := sched.Next()
+	if next.IsZero() {
+		return PollingInterval
+	}
+	return max(min(next.Sub(now), PollingInterval), 0)
+}
+
+// ScheduledCheck is a service's entry in GET /schedule.
+type ScheduledCheck struct {
+	Service   string    `json:"service"`
+	Interval  string    `json:"interval"`
+	LastCheck time.Time `json:"last_check,omitzero"`
+	NextCheck time.Time `json:"next_check"`
+}
+
+// handleSchedule lists when each service was last checked and is checked
+// next, soonest first.
+func (s *Status) handleSchedule(w http.ResponseWriter, r *http.Request) {
+	checks := []ScheduledCheck{}
+	for _, e := range s.schedule.Entries() {
+		checks = append(checks, ScheduledCheck{e.Key, e.Interval.String(), e.Last, e.Next})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(checks)
+}
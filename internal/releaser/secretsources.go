@@ -0,0 +1,288 @@
+package releaser
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/secrets"
+)
+
+// The daemon can take its credentials from secret stores as well as its
+// environment, and picks up rotated ones without a restart.
+// RELEASER_SECRET_SOURCES lists the stores, comma separated:
+//
+//	file:/etc/releaser/secrets.env  NAME=value lines, values plain or encrypted (ENC[age,…])
+//	ssm:/releaser/prod              the SSM parameters under a path, named after their last element
+//	secretsmanager:releaser/prod    a Secrets Manager secret holding a JSON object of names to values
+//
+// The sources are read into the environment when the daemon starts, later
+// ones taking precedence, and read again every RELEASER_SECRET_REFRESH
+// (default 5m). Credentials are read from the environment when they are
+// used, so registry, webhook and notification tokens and the GitHub App key
+// rotate from their next use; the GitHub App's installation token is
+// minted again, and the status server swaps in the new API token and Slack
+// secrets. Names that disappear from the sources are unset. Each rotation
+// is written to the audit log with the names that changed, never the
+// values. A source that can't be read keeps the values it last gave.
+//
+// Encrypted values in the environment itself are decrypted at start too.
+
+// defaultSecretRefresh is how often secret sources are read again unless
+// RELEASER_SECRET_REFRESH says otherwise.
+const defaultSecretRefresh = 5 * time.Minute
+
+// secretSource is an entry of RELEASER_SECRET_SOURCES.
+type secretSource struct {
+	kind, location string
+}
+
+func (s secretSource) String() string { return s.kind + ":" + s.location }
+
+var secretState struct {
+	sync.Mutex
+	// loaded is what each source last gave, nil before the first read.
+	loaded map[string]map[string]string
+	// hooks are called with the names that changed.
+	hooks []func(names []string)
+}
+
+// parseSecretSources parses RELEASER_SECRET_SOURCES.
+func parseSecretSources(s string) ([]secretSource, error) {
+	var sources []secretSource
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kind, location, ok := strings.Cut(entry, ":")
+		if !ok || location == "" || !slices.Contains([]string{"file", "ssm", "secretsmanager"}, kind) {
+			return nil, fmt.Errorf("RELEASER_SECRET_SOURCES: %q is not file:, ssm: or secretsmanager: followed by a location", entry)
+		}
+		sources = append(sources, secretSource{kind, location})
+	}
+	return sources, nil
+}
+
+// onSecretsRotated registers f to be called with the names of the
+// environment variables a rotation changed.
+func onSecretsRotated(f func(names []string)) {
+	secretState.Lock()
+	defer secretState.Unlock()
+	secretState.hooks = append(secretState.hooks, f)
+}
+
+// startSecretWatcher decrypts encrypted values in the environment, loads
+// the secret sources and keeps reloading them in the background.
+func startSecretWatcher() {
+	decryptEnvironment()
+	sources, err := parseSecretSources(os.Getenv("RELEASER_SECRET_SOURCES"))
+	if err != nil {
+		fmt.Printf("Not loading secrets: %v\n", err)
+		return
+	}
+	if len(sources) == 0 {
+		return
+	}
+	refresh := defaultSecretRefresh
+	if s := os.Getenv("RELEASER_SECRET_REFRESH"); s != "" {
+		if refresh, err = time.ParseDuration(s); err != nil || refresh <= 0 {
+			fmt.Printf("RELEASER_SECRET_REFRESH: %q is not a positive duration, using %v\n", s, defaultSecretRefresh)
+			refresh = defaultSecretRefresh
+		}
+	}
+	refreshSecrets(sources)
+	go func() {
+		for range time.Tick(refresh) {
+			refreshSecrets(sources)
+		}
+	}()
+}
+
+// decryptEnvironment replaces encrypted values in the environment with
+// their plaintext.
+func decryptEnvironment() {
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		if !secrets.IsEncrypted(value) {
+			continue
+		}
+		plaintext, err := secrets.Decrypt(value)
+		if err != nil {
+			fmt.Printf("Error decrypting %s: %v\n", name, err)
+			continue
+		}
+		os.Setenv(name, plaintext)
+	}
+}
+
+// refreshSecrets reads every source and applies what changed since the
+// last read to the environment.
+func refreshSecrets(sources []secretSource) {
+	secretState.Lock()
+	first := secretState.loaded == nil
+	if first {
+		secretState.loaded = map[string]map[string]string{}
+	}
+	previous := mergeSecrets(sources, secretState.loaded)
+	var rotated []string
+	for _, src := range sources {
+		values, err := src.load()
+		if err != nil {
+			fmt.Printf("Error reading secrets from %s: %v\n", src, err)
+			continue
+		}
+		if !maps.Equal(secretState.loaded[src.String()], values) {
+			rotated = append(rotated, src.String())
+		}
+		secretState.loaded[src.String()] = values
+	}
+	current := mergeSecrets(sources, secretState.loaded)
+	var changed []string
+	for name, value := range current {
+		if old, ok := previous[name]; !ok || old != value {
+			os.Setenv(name, value)
+			changed = append(changed, name)
+		}
+	}
+	for name := range previous {
+		if _, ok := current[name]; !ok {
+			os.Unsetenv(name)
+			changed = append(changed, name)
+		}
+	}
+	slices.Sort(changed)
+	hooks := slices.Clone(secretState.hooks)
+	secretState.Unlock()
+
+	if len(changed) == 0 {
+		return
+	}
+	if first {
+		fmt.Printf("Loaded %d secrets from %s\n", len(changed), strings.Join(rotated, ", "))
+		audit(AuditEvent{Action: "secrets.loaded", Names: changed, Source: strings.Join(rotated, ",")})
+		return
+	}
+	fmt.Printf("Secrets rotated: %s\n", strings.Join(changed, ", "))
+	audit(AuditEvent{Action: "secrets.rotated", Names: changed, Source: strings.Join(rotated, ",")})
+	if slices.ContainsFunc(changed, func(name string) bool { return strings.HasPrefix(name, "RELEASER_GITHUB_APP_") }) {
+		resetGitHubAppToken()
+	}
+	for _, hook := range hooks {
+		hook(changed)
+	}
+}
+
+// mergeSecrets merges what the sources gave, later sources taking
+// precedence.
+func mergeSecrets(sources []secretSource, loaded map[string]map[string]string) map[string]string {
+	merged := map[string]string{}
+	for _, src := range sources {
+		maps.Copy(merged, loaded[src.String()])
+	}
+	return merged
+}
+
+// load reads the names and values of the source, decrypted.
+func (s secretSource) load() (map[string]string, error) {
+	var values map[string]string
+	switch s.kind {
+	case "file":
+		data, err := os.ReadFile(s.location)
+		if err != nil {
+			return nil, err
+		}
+		if values, err = parseEnvFile(data); err != nil {
+			return nil, fmt.Errorf("%s: %w", s.location, err)
+		}
+	case "ssm", "secretsmanager":
+		args := secretSourceArgs(s)
+		out, err := exec.Command("aws", args...).Output()
+		if err != nil {
+			if exit, ok := err.(*exec.ExitError); ok {
+				err = fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exit.Stderr)))
+			}
+			return nil, fmt.Errorf("aws %s %s: %w", args[0], args[1], err)
+		}
+		if s.kind == "ssm" {
+			values, err = parseSSMParameters(out)
+		} else {
+			err = json.Unmarshal(out, &values)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", s, err)
+		}
+	}
+	for name, value := range values {
+		plaintext, err := secrets.Decrypt(value)
+		if err != nil {
+			return nil, fmt.Errorf("decrypting %s: %w", name, err)
+		}
+		values[name] = plaintext
+	}
+	return values, nil
+}
+
+// secretSourceArgs returns the aws CLI arguments that read an ssm or
+// secretsmanager source.
+func secretSourceArgs(s secretSource) []string {
+	if s.kind == "ssm" {
+		return []string{"ssm", "get-parameters-by-path", "--path", s.location,
+			"--recursive", "--with-decryption", "--output", "json"}
+	}
+	return []string{"secretsmanager", "get-secret-value", "--secret-id", s.location,
+		"--query", "SecretString", "--output", "text"}
+}
+
+// parseSSMParameters parses the output of aws ssm get-parameters-by-path,
+// naming each parameter after the last element of its path.
+func parseSSMParameters(data []byte) (map[string]string, error) {
+	var out struct {
+		Parameters []struct {
+			Name  string `json:"Name"`
+			Value string `json:"Value"`
+		} `json:"Parameters"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	for _, p := range out.Parameters {
+		values[path.Base(p.Name)] = p.Value
+	}
+	return values, nil
+}
+
+// parseEnvFile parses NAME=value lines, skipping blank lines and # comments.
+// Values may be quoted and lines may start with export.
+func parseEnvFile(data []byte) (map[string]string, error) {
+	values := map[string]string{}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("line %d is not NAME=value", n)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[name] = value
+	}
+	return values, sc.Err()
+}
@@ -0,0 +1,238 @@
+package releaser
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// Security updates take a fast lane. An update is a security update when
+// an advisory of RELEASER_CVE_FEED says it fixes the version it moves
+// from, or when its new image carries one of RELEASER_SECURITY_LABELS,
+// comma-separated key=value or bare keys matching any value, e.g.
+// security=critical. Security updates:
+//
+//   - are checked for as soon as the feed has a fix for a version the
+//     manifest runs, rather than at the service's next scheduled check;
+//   - go out during a release freeze, on their own, and the release
+//     notification and the audit log name the freeze they went through;
+//   - with RELEASER_UPDATE_MODE=pr, are released straight away rather than
+//     waiting for their pull request to be merged, unless
+//     RELEASER_SECURITY_APPROVAL=pr gives them pull requests, labelled
+//     SecurityLabel, as other updates get.
+//
+// RELEASER_CVE_FEED is the URL or path of a JSON list of advisories:
+//
+//	[{"id": "CVE-2025-1234", "package": "nginx", "fixed": "1.27.3"}]
+//
+// where package matches images as Renovate package names do and fixed is
+// the first version without the vulnerability. A feed that can't be read
+// is reported and the updates it would have marked go out as usual.
+
+// Security approval policies.
+const (
+	SecurityApprovalRelease = "release"
+	SecurityApprovalPR      = "pr"
+)
+
+// SecurityLabel labels the pull requests of security updates.
+const SecurityLabel = "security"
+
+func securityApproval() (string, error) {
+	switch approval := os.Getenv("RELEASER_SECURITY_APPROVAL"); approval {
+	case "", SecurityApprovalRelease:
+		return SecurityApprovalRelease, nil
+	case SecurityApprovalPR:
+		return approval, nil
+	default:
+		return "", fmt.Errorf("RELEASER_SECURITY_APPROVAL: %q must be release or pr", approval)
+	}
+}
+
+// Advisory is an entry of RELEASER_CVE_FEED.
+type Advisory struct {
+	ID      string `json:"id"`
+	Package string `json:"package"`
+	Fixed   string `json:"fixed"`
+
+	fixed *semver.Version
+}
+
+// affects reports whether version of the image dep has the vulnerability
+// a fixes.
+func (a Advisory) affects(dep, version string) bool {
+	if !matchNames([]string{a.Package}, dep) {
+		return false
+	}
+	v, err := semver.NewVersion(version)
+	return err == nil && v.LessThan(a.fixed)
+}
+
+// loadAdvisories reads RELEASER_CVE_FEED, nil when it isn't set.
+func loadAdvisories() ([]Advisory, error) {
+	feed := os.Getenv("RELEASER_CVE_FEED")
+	if feed == "" {
+		return nil, nil
+	}
+	var data []byte
+	var err error
+	if strings.HasPrefix(feed, "https://") || strings.HasPrefix(feed, "http://") {
+		data, err = fetchFeed(feed)
+	} else {
+		data, err = os.ReadFile(feed)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading RELEASER_CVE_FEED: %w", err)
+	}
+	var advisories []Advisory
+	if err := json.Unmarshal(data, &advisories); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", feed, err)
+	}
+	for i := range advisories {
+		a := &advisories[i]
+		if a.fixed, err = semver.NewVersion(a.Fixed); err != nil || a.Package == "" {
+			return nil, fmt.Errorf("%s: advisory %s needs a package and a semver fixed version", feed, a.ID)
+		}
+	}
+	return advisories, nil
+}
+
+func fetchFeed(url string) ([]byte, error) {
+	client := &http.Client{Timeout: deployTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// securityLabels parses RELEASER_SECURITY_LABELS into the values wanted by
+// label key, "" for any.
+func securityLabels() map[string]string {
+	labels := map[string]string{}
+	for _, entry := range strings.Split(os.Getenv("RELEASER_SECURITY_LABELS"), ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			key, value, _ := strings.Cut(entry, "=")
+			labels[key] = value
+		}
+	}
+	return labels
+}
+
+// securityReasons says why c, which moved s to where it is now, is a
+// security update: the advisories it fixes and the security labels of its
+// new image. It returns nil when it isn't one.
+func securityReasons(ctx context.Context, s manifest.Service, c Change, advisories []Advisory, labels map[string]string) []string {
+	var reasons []string
+	dep := depName(s)
+	for _, a := range advisories {
+		if a.affects(dep, c.From) && !a.affects(dep, s.Version) {
+			reasons = append(reasons, a.ID)
+		}
+	}
+	if len(labels) > 0 && s.Version != "" {
+		got, err := imageLabels(ctx, dep, s.Version)
+		if err != nil {
+			fmt.Printf("Error reading the labels of %s:%s: %v\n", dep, s.Version, err)
+		}
+		for key, want := range labels {
+			if value, ok := got[key]; ok && (want == "" || value == want) {
+				reasons = append(reasons, "label "+key+"="+value)
+			}
+		}
+	}
+	slices.Sort(reasons)
+	return reasons
+}
+
+// markSecurity sets the Security of each of changes, made to m, that is a
+// security update.
+func markSecurity(ctx context.Context, m *manifest.Manifest, changes []Change) {
+	if len(changes) == 0 {
+		return
+	}
+	advisories, err := loadAdvisories()
+	if err != nil {
+		fmt.Printf("Not checking updates against the CVE feed: %v\n", err)
+	}
+	labels := securityLabels()
+	for i, c := range changes {
+		if s, ok := m.Service(c.Service); ok {
+			changes[i].Security = securityReasons(ctx, s, c, advisories, labels)
+			if len(changes[i].Security) > 0 {
+				fmt.Printf("%s %s -> %s is a security update: %s\n", c.Service, c.From, c.To, strings.Join(changes[i].Security, ", "))
+			}
+		}
+	}
+}
+
+// splitSecurity splits changes into security updates and the others.
+func splitSecurity(changes []Change) (security, other []Change) {
+	for _, c := range changes {
+		if len(c.Security) > 0 {
+			security = append(security, c)
+		} else {
+			other = append(other, c)
+		}
+	}
+	return security, other
+}
+
+// restoreServices puts the services of changes back in m as they were in
+// before.
+func restoreServices(m *manifest.Manifest, before []manifest.Service, changes []Change) {
+	for _, c := range changes {
+		if i := serviceIndex(m, c.Service); i >= 0 {
+			m.Services[i] = before[i]
+		}
+	}
+}
+
+// securityDue adds to the services due those of m running a version an
+// advisory of RELEASER_CVE_FEED has a fix for, so they are checked now
+// rather than when their check interval next comes round. Each advisory
+// brings a service forward once; seen records which have, by service and
+// advisory.
+func securityDue(m *manifest.Manifest, due []string, seen map[string]bool) []string {
+	advisories, err := loadAdvisories()
+	if err != nil {
+		fmt.Printf("Not checking the CVE feed: %v\n", err)
+		return due
+	}
+	for _, s := range m.Services {
+		for _, a := range advisories {
+			key := s.Name + " " + a.ID
+			if seen[key] || !a.affects(depName(s), s.Version) {
+				continue
+			}
+			seen[key] = true
+			if !slices.Contains(due, s.Name) {
+				fmt.Printf("Checking %s now: %s is fixed in %s\n", s.Name, a.ID, a.Fixed)
+				due = append(due, s.Name)
+			}
+		}
+	}
+	return due
+}
+
+// auditFreezeBypass records in the audit log that result went out during
+// freeze.
+func auditFreezeBypass(result *Result, freeze *Freeze) {
+	var names []string
+	for _, c := range result.Changes {
+		names = append(names, c.Service)
+	}
+	audit(AuditEvent{Action: "freeze.bypassed", Names: names, Source: result.Version, Detail: freeze.Reason})
+}
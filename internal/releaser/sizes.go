@@ -0,0 +1,157 @@
+package releaser
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/velann21/todo-releaser/internal/image"
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// DefaultSizeGrowthWarn is the growth, in percent, past which a bump is
+// flagged for ballooning its image, unless RELEASER_SIZE_GROWTH_WARN
+// overrides it. 0 turns the warning off.
+const DefaultSizeGrowthWarn = 20
+
+// imageSize returns the compressed size in bytes of the image ref at tag,
+// from Docker Hub, the registry plugin that handles it or one of
+// registryBackends. It returns 0 when the registry has no way to tell.
+func imageSize(ctx context.Context, ref, tag string) (int64, error) {
+	r, err := image.Parse(ref)
+	if err != nil {
+		return 0, err
+	}
+	if r.IsDockerHub() {
+		c, err := dockerHubRegistry(ctx, r)
+		if err != nil {
+			return 0, err
+		}
+		return c.size(ctx, tag)
+	}
+	if rc, _, err := nativeRegistry(ctx, r); err != nil || rc != nil {
+		if err != nil {
+			return 0, err
+		}
+		return rc.size(ctx, tag)
+	}
+	p, err := registryPlugin(ctx, r.Registry)
+	if err != nil || p == nil || !p.Info.Sizes {
+		return 0, err
+	}
+	if err := throttle(ctx, r.Registry); err != nil {
+		return 0, err
+	}
+	var result struct {
+		Size int64 `json:"size"`
+	}
+	err = p.Call(ctx, "image_size", map[string]string{"image": r.Name(), "tag": tag}, &result)
+	return result.Size, err
+}
+
+// sizeGrowthWarn is RELEASER_SIZE_GROWTH_WARN, or DefaultSizeGrowthWarn.
+func sizeGrowthWarn() float64 {
+	if v := os.Getenv("RELEASER_SIZE_GROWTH_WARN"); v != "" {
+		if pct, err := strconv.ParseFloat(v, 64); err == nil && pct >= 0 {
+			return pct
+		}
+		fmt.Printf("Ignoring RELEASER_SIZE_GROWTH_WARN=%q: not a percentage\n", v)
+	}
+	return DefaultSizeGrowthWarn
+}
+
+// measureSizes fills in the image sizes before and after each change and
+// flags the changes that grow their image by more than the warning
+// threshold. Images whose size can't be read are left unmeasured.
+func measureSizes(ctx context.Context, m *manifest.Manifest, changes []Change) {
+	warn := sizeGrowthWarn()
+	for i, c := range changes {
+		s, ok := m.Service(c.Service)
+		if !ok || c.Config != "" {
+			continue
+		}
+		to, err := imageSize(ctx, s.Image, c.To)
+		if err != nil {
+			fmt.Printf("Error reading the size of %s:%s: %v\n", s.Image, c.To, err)
+			continue
+		}
+		changes[i].SizeTo = to
+		if from, err := imageSize(ctx, s.Image, c.From); err == nil {
+			changes[i].SizeFrom = from
+		}
+		if g, ok := changes[i].Growth(); ok && warn > 0 && g > warn {
+			changes[i].SizeWarning = true
+			fmt.Printf("Warning: %s grows %.0f%% (%s -> %s)\n", c.Service, g, formatSize(changes[i].SizeFrom), formatSize(to))
+		}
+	}
+}
+
+// Growth is how much the change grows its image, in percent, when both
+// sizes are known.
+func (c Change) Growth() (float64, bool) {
+	if c.SizeFrom <= 0 || c.SizeTo <= 0 {
+		return 0, false
+	}
+	return float64(c.SizeTo-c.SizeFrom) / float64(c.SizeFrom) * 100, true
+}
+
+// formatSize renders a byte count in MB, as registries show image sizes.
+func formatSize(n int64) string {
+	return fmt.Sprintf("%.1f MB", float64(n)/1e6)
+}
+
+// sizeDelta renders a change's size change, e.g. "45.3 MB → 50.7 MB, +12%",
+// or "" when it wasn't measured.
+func sizeDelta(c Change) string {
+	g, ok := c.Growth()
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%s → %s, %+.0f%%", formatSize(c.SizeFrom), formatSize(c.SizeTo), g)
+}
+
+var (
+	imageSizesMu sync.Mutex
+	// imageSizes are the measured changes of the latest release, by service.
+	imageSizes = map[string]Change{}
+)
+
+// recordSizes keeps the sizes measured for result for /metrics.
+func recordSizes(result *Result) {
+	imageSizesMu.Lock()
+	defer imageSizesMu.Unlock()
+	for _, c := range result.Changes {
+		if c.SizeTo > 0 {
+			imageSizes[c.Service] = c
+		}
+	}
+}
+
+// writeSizeMetrics writes the image sizes in the Prometheus text format.
+func writeSizeMetrics(w io.Writer) {
+	imageSizesMu.Lock()
+	defer imageSizesMu.Unlock()
+
+	services := make([]string, 0, len(imageSizes))
+	for s := range imageSizes {
+		services = append(services, s)
+	}
+	sort.Strings(services)
+
+	fmt.Fprintf(w, "# HELP releaser_image_size_bytes Compressed size of each service's image as last released.\n")
+	fmt.Fprintf(w, "# TYPE releaser_image_size_bytes gauge\n")
+	for _, s := range services {
+		fmt.Fprintf(w, "releaser_image_size_bytes{service=%q} %d\n", s, imageSizes[s].SizeTo)
+	}
+	fmt.Fprintf(w, "# HELP releaser_image_size_change_bytes Change in the image's size in its last release.\n")
+	fmt.Fprintf(w, "# TYPE releaser_image_size_change_bytes gauge\n")
+	for _, s := range services {
+		if c := imageSizes[s]; c.SizeFrom > 0 {
+			fmt.Fprintf(w, "releaser_image_size_change_bytes{service=%q} %d\n", s, c.SizeTo-c.SizeFrom)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package releaser
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/agent"
+	"github.com/velann21/todo-releaser/internal/image"
+	"github.com/velann21/todo-releaser/internal/manifest"
+	"github.com/velann21/todo-releaser/internal/pki"
+)
+
+const containersState = "containers.json"
+
+// Skew statuses of a service on a host.
+const (
+	// SkewCurrent runs the image of the manifest.
+	SkewCurrent = "current"
+	// SkewOutdated runs another tag of the service's image.
+	SkewOutdated = "outdated"
+	// SkewModified runs an image that isn't the registry's: another
+	// repository, an image built or retagged on the host, or one whose
+	// digest differs from the registry's for its tag.
+	SkewModified = "modified"
+	// SkewMissing has no container of the service.
+	SkewMissing = "missing"
+	// SkewUnmanaged is a compose service that isn't in the manifest.
+	SkewUnmanaged = "unmanaged"
+)
+
+// ServiceSkew is how a container on a host compares with the manifest.
+type ServiceSkew struct {
+	Service   string `json:"service"`
+	Container string `json:"container,omitempty"`
+	Status    string `json:"status"`
+	// Expected is the image the manifest runs, Running the one the
+	// container was created from and Digest its registry digest.
+	Expected string `json:"expected,omitempty"`
+	Running  string `json:"running,omitempty"`
+	Digest   string `json:"digest,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// HostSkew compares the containers a deploy agent last reported with the
+// manifest.
+type HostSkew struct {
+	Host        string `json:"host"`
+	Environment string `json:"environment,omitempty"`
+	// Release is the release the agent last applied.
+	Release  string        `json:"release,omitempty"`
+	Reported time.Time     `json:"reported"`
+	Services []ServiceSkew `json:"services"`
+}
+
+// Skewed reports whether any service on the host isn't current.
+func (h HostSkew) Skewed() bool {
+	return slices.ContainsFunc(h.Services, func(s ServiceSkew) bool { return s.Status != SkewCurrent })
+}
+
+// readInventories returns the containers last reported by each agent.
+func readInventories() (map[string]agent.Inventory, error) {
+	inventories := map[string]agent.Inventory{}
+	if err := readStateJSON(containersState, &inventories); err != nil {
+		return nil, err
+	}
+	return inventories, nil
+}
+
+// recordInventory stores inv as the containers running on the agent name.
+func recordInventory(name string, inv agent.Inventory) error {
+	agentsMu.Lock()
+	defer agentsMu.Unlock()
+
+	inventories, err := readInventories()
+	if err != nil {
+		return err
+	}
+	inventories[name] = inv
+	return writeStateJSON(containersState, inventories)
+}
+
+// handleAgentContainers serves PUT /agents/{name}/containers, where deploy
+// agents report the containers running on their host, authenticated like
+// their rollout reports.
+func handleAgentContainers(token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if pki.AgentName(r.TLS) != name && !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var inv agent.Inventory
+		if err := json.NewDecoder(r.Body).Decode(&inv); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := recordInventory(name, inv); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Skew compares the containers every deploy agent reported with m: for each
+// host, whether each service runs the manifest's image, an older or newer
+// tag of it, or something else, such as an image built on the host. A
+// service runs the manifest's image when the container's registry digest
+// is the one the manifest pins, or the one its tag points to in the
+// registry. When the registry can't be reached tags are compared instead.
+func Skew(ctx context.Context, m *manifest.Manifest) ([]HostSkew, error) {
+	agentsMu.Lock()
+	inventories, err := readInventories()
+	var reports map[string]AgentStatus
+	if err == nil {
+		reports, err = readAgentReports()
+	}
+	agentsMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// The registry's digests, looked up once for every host.
+	digests := map[string]string{}
+	expectedDigest := func(s manifest.Service) (string, error) {
+		if d := s.Digest(); d != "" {
+			return d, nil
+		}
+		if d, ok := digests[s.Name]; ok {
+			return d, nil
+		}
+		d, err := tagDigest(ctx, s.Image, s.Version)
+		if err != nil {
+			return "", err
+		}
+		digests[s.Name] = d
+		return d, nil
+	}
+
+	var hosts []HostSkew
+	for name, inv := range inventories {
+		h := HostSkew{Host: name, Environment: reports[name].Environment, Release: inv.Version, Reported: inv.Time}
+		for _, s := range m.Services {
+			found := false
+			for _, c := range inv.Containers {
+				if c.Service == s.Name {
+					found = true
+					h.Services = append(h.Services, compareContainer(s, c, expectedDigest))
+				}
+			}
+			if !found {
+				h.Services = append(h.Services, ServiceSkew{Service: s.Name, Status: SkewMissing, Expected: s.Ref()})
+			}
+		}
+		for _, c := range inv.Containers {
+			if _, ok := m.Service(c.Service); !ok {
+				h.Services = append(h.Services, ServiceSkew{Service: c.Service, Container: c.Name, Status: SkewUnmanaged, Running: c.Image})
+			}
+		}
+		hosts = append(hosts, h)
+	}
+	slices.SortFunc(hosts, func(a, b HostSkew) int { return strings.Compare(a.Host, b.Host) })
+	return hosts, nil
+}
+
+// compareContainer tells how the container c of s compares with the
+// manifest, with expectedDigest returning the digest s should run.
+func compareContainer(s manifest.Service, c agent.Container, expectedDigest func(manifest.Service) (string, error)) ServiceSkew {
+	sk := ServiceSkew{Service: s.Name, Container: c.Name, Expected: s.Ref(), Running: c.Image}
+	want, err := image.Parse(s.Image)
+	if err != nil {
+		sk.Status, sk.Detail = SkewModified, err.Error()
+		return sk
+	}
+	for _, rd := range c.RepoDigests {
+		if r, err := image.Parse(rd); err == nil && r.Registry == want.Registry && r.Repository == want.Repository {
+			sk.Digest = r.Digest
+		}
+	}
+	running, err := image.Parse(c.Image)
+	if err != nil || running.Registry != want.Registry || running.Repository != want.Repository {
+		sk.Status, sk.Detail = SkewModified, "runs an image of another repository than "+want.Name()
+		return sk
+	}
+	if sk.Digest == "" {
+		sk.Status, sk.Detail = SkewModified, "runs an image that wasn't pulled from the registry"
+		return sk
+	}
+
+	expected, err := expectedDigest(s)
+	switch {
+	case err != nil:
+		// Without the registry, trust the tag.
+		sk.Detail = fmt.Sprintf("compared by tag: %v", err)
+		sk.Status = SkewOutdated
+		if running.Tag == s.Version {
+			sk.Status = SkewCurrent
+		}
+	case sk.Digest == expected:
+		sk.Status = SkewCurrent
+	case running.Tag == s.Version:
+		sk.Status = SkewModified
+		sk.Detail = fmt.Sprintf("runs %s, not the registry's %s", shortDigest(sk.Digest), shortDigest(expected))
+	default:
+		sk.Status = SkewOutdated
+	}
+	return sk
+}
+
+// handleSkew serves GET /skew, the Skew of every host against the current
+// manifest.
+func handleSkew(w http.ResponseWriter, r *http.Request) {
+	m, err := loadManifest()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	hosts, err := Skew(r.Context(), m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hosts)
+}
+
+// SkewOptions control PrintSkew.
+type SkewOptions struct {
+	// JSON prints the report as JSON instead of a table.
+	JSON bool
+}
+
+// RegisterFlags binds o to flags in fs.
+func (o *SkewOptions) RegisterFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&o.JSON, "json", false, "print the report as JSON")
+}
+
+// PrintSkew prints the Skew of every host against the manifest of the
+// checkout, from the containers the agents reported to this releaser's
+// state. It returns the number of hosts that are skewed.
+func PrintSkew(ctx context.Context, opts SkewOptions) (int, error) {
+	if err := syncCheckout(); err != nil {
+		return 0, fmt.Errorf("error updating the checkout: %w", err)
+	}
+	m, err := loadManifest()
+	if err != nil {
+		return 0, fmt.Errorf("error loading manifest: %w", err)
+	}
+	hosts, err := Skew(ctx, m)
+	if err != nil {
+		return 0, err
+	}
+	skewed := 0
+	for _, h := range hosts {
+		if h.Skewed() {
+			skewed++
+		}
+	}
+	if opts.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return skewed, enc.Encode(hosts)
+	}
+	if len(hosts) == 0 {
+		fmt.Println("No agent has reported its containers.")
+		return 0, nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tSERVICE\tSTATUS\tEXPECTED\tRUNNING\tDETAIL")
+	for _, h := range hosts {
+		for _, s := range h.Services {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", h.Host, s.Service, s.Status, s.Expected, s.Running, s.Detail)
+		}
+	}
+	return skewed, tw.Flush()
+}
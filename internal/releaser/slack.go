@@ -0,0 +1,403 @@
+package releaser
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// Slack roles, each allowed what the one before it is and more.
+const (
+	RoleViewer   = "viewer"   // /release status
+	RoleOperator = "operator" // /release now and /release freeze
+	RoleAdmin    = "admin"    // /release rollback
+)
+
+var roleRank = map[string]int{RoleViewer: 1, RoleOperator: 2, RoleAdmin: 3}
+
+// slackCommands maps each /release subcommand to the role it needs.
+var slackCommands = map[string]string{
+	"status":   RoleViewer,
+	"now":      RoleOperator,
+	"freeze":   RoleOperator,
+	"rollback": RoleAdmin,
+}
+
+// slackMaxAge is how old a signed Slack request may be, against replays.
+const slackMaxAge = 5 * time.Minute
+
+// parseSlackRoles parses RELEASER_SLACK_ROLES: comma-separated
+// user=role pairs of Slack user IDs, e.g. U012AB3CD=admin,*=viewer, where
+// * is anyone not listed.
+func parseSlackRoles(s string) (map[string]string, error) {
+	roles := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		user, role, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not user=role", pair)
+		}
+		if _, ok := roleRank[role]; !ok {
+			return nil, fmt.Errorf("%s: unknown role %q (want viewer, operator or admin)", user, role)
+		}
+		roles[strings.TrimSpace(user)] = role
+	}
+	return roles, nil
+}
+
+// slackAllowed reports whether user may run the /release subcommand.
+func slackAllowed(roles map[string]string, user, command string) bool {
+	role, ok := roles[user]
+	if !ok {
+		role = roles["*"]
+	}
+	need, ok := slackCommands[command]
+	return ok && roleRank[role] >= roleRank[need]
+}
+
+// verifySlack checks a request's Slack signature, an HMAC of its timestamp
+// and body with the app's signing secret.
+func verifySlack(secret string, h http.Header, body []byte, now time.Time) error {
+	ts := h.Get("X-Slack-Request-Timestamp")
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errors.New("missing request timestamp")
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > slackMaxAge || age < -slackMaxAge {
+		return errors.New("request timestamp too far from now")
+	}
+	want := "v0=" + slackSignature(secret, ts, body)
+	if !hmac.Equal([]byte(h.Get("X-Slack-Signature")), []byte(want)) {
+		return errors.New("bad signature")
+	}
+	return nil
+}
+
+func slackSignature(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:", ts)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// slackMessage is a slash command response, immediate or sent later to
+// its response_url.
+type slackMessage struct {
+	ResponseType    string `json:"response_type,omitempty"`
+	ReplaceOriginal bool   `json:"replace_original,omitempty"`
+	Text            string `json:"text"`
+	Blocks          []any  `json:"blocks,omitempty"`
+}
+
+// slackBot serves the /release slash command and its buttons.
+type slackBot struct {
+	secret string
+	roles  map[string]string
+	status *Status
+}
+
+// readSlack reads and verifies a request, answering it when it fails.
+func (b *slackBot) readSlack(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if err := verifySlack(b.secret, r.Header, body, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+	return body, true
+}
+
+// handleCommand serves the /release slash command:
+//
+//	/release status                   current release, health, freeze and environments
+//	/release now                      reconcile now instead of at the next poll
+//	/release freeze [duration] reason freeze releases, for duration if given
+//	/release freeze off               lift the freeze
+//	/release rollback                 roll the current release back, after confirming
+func (b *slackBot) handleCommand(w http.ResponseWriter, r *http.Request) {
+	body, ok := b.readSlack(w, r)
+	if !ok {
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, name := form.Get("user_id"), form.Get("user_name")
+	command, args, _ := strings.Cut(strings.TrimSpace(form.Get("text")), " ")
+	args = strings.TrimSpace(args)
+	if command == "" {
+		command = "status"
+	}
+
+	reply := func(msg slackMessage) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(msg)
+	}
+	if _, ok := slackCommands[command]; !ok {
+		reply(slackMessage{Text: "Usage: `/release status`, `/release now`, `/release freeze [duration] reason`, `/release freeze off` or `/release rollback`"})
+		return
+	}
+	if !slackAllowed(b.roles, user, command) {
+		reply(slackMessage{Text: fmt.Sprintf("You need the %s role for `/release %s`.", slackCommands[command], command)})
+		return
+	}
+	fmt.Printf("Slack: %s (%s) ran /release %s %s\n", name, user, command, args)
+
+	switch command {
+	case "status":
+		reply(slackMessage{Text: b.statusText(time.Now())})
+	case "now":
+		b.enqueue(form.Get("response_url"), func(ctx context.Context, s *Status) string {
+			result, err := reconcileOnce(ctx, s, nil)
+			switch {
+			case err != nil:
+				return fmt.Sprintf("Release check requested by <@%s> failed: %v", user, err)
+			case result == nil:
+				return fmt.Sprintf("Release check requested by <@%s>: nothing to release.", user)
+			}
+			return fmt.Sprintf("Release check requested by <@%s> released %s.", user, result.Version)
+		})
+		reply(slackMessage{ResponseType: "in_channel", Text: fmt.Sprintf("<@%s> started a release check.", user)})
+	case "freeze":
+		text, err := slackFreeze(args, name, time.Now())
+		if err != nil {
+			reply(slackMessage{Text: err.Error()})
+			return
+		}
+		reply(slackMessage{ResponseType: "in_channel", Text: fmt.Sprintf("<@%s> %s", user, text)})
+	case "rollback":
+		m, err := loadManifest()
+		if err != nil {
+			reply(slackMessage{Text: fmt.Sprintf("Error loading the manifest: %v", err)})
+			return
+		}
+		reply(rollbackConfirmation(m.ReleaseVersion))
+	}
+}
+
+// slackFreeze freezes releases as "[duration] reason" asks, or lifts the
+// freeze for "off", and says what it did.
+func slackFreeze(args, by string, now time.Time) (string, error) {
+	if args == "off" {
+		if err := SetFreeze(nil); err != nil {
+			return "", err
+		}
+		fmt.Println("Release freeze lifted")
+		return "lifted the release freeze.", nil
+	}
+	f := &Freeze{Reason: args, By: by, Since: now}
+	if first, rest, _ := strings.Cut(args, " "); first != "" {
+		if d, err := time.ParseDuration(first); err == nil {
+			f.Reason, f.Until = strings.TrimSpace(rest), now.Add(d)
+		}
+	}
+	if f.Reason == "" {
+		return "", errors.New("usage: `/release freeze [duration] reason`, e.g. `/release freeze 2h incident 4711`")
+	}
+	if err := SetFreeze(f); err != nil {
+		return "", err
+	}
+	fmt.Printf("Releases frozen by %q: %s\n", f.By, f.Reason)
+	if f.Until.IsZero() {
+		return fmt.Sprintf("froze releases: %s", f.Reason), nil
+	}
+	return fmt.Sprintf("froze releases until %s: %s", f.Until.UTC().Format(time.RFC1123), f.Reason), nil
+}
+
+// rollbackConfirmation asks to confirm rolling version back, with the
+// version on the button so a release made meanwhile isn't rolled back by
+// mistake.
+func rollbackConfirmation(version string) slackMessage {
+	text := fmt.Sprintf("Roll back %s to the release before it? Releases stay frozen afterwards.", version)
+	return slackMessage{
+		Text: text,
+		Blocks: []any{
+			map[string]any{"type": "section", "text": map[string]string{"type": "mrkdwn", "text": text}},
+			map[string]any{"type": "actions", "elements": []any{
+				map[string]any{
+					"type":      "button",
+					"action_id": "rollback",
+					"style":     "danger",
+					"text":      map[string]string{"type": "plain_text", "text": "Roll back " + version},
+					"value":     version,
+				},
+			}},
+		},
+	}
+}
+
+// handleAction serves button clicks: the rollback confirmation.
+func (b *slackBot) handleAction(w http.ResponseWriter, r *http.Request) {
+	body, ok := b.readSlack(w, r)
+	if !ok {
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var payload struct {
+		User struct {
+			ID       string `json:"id"`
+			Username string `json:"username"`
+		} `json:"user"`
+		ResponseURL string `json:"response_url"`
+		Actions     []struct {
+			ActionID string `json:"action_id"`
+			Value    string `json:"value"`
+		} `json:"actions"`
+	}
+	if err := json.Unmarshal([]byte(form.Get("payload")), &payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	user := payload.User.ID
+	for _, action := range payload.Actions {
+		if action.ActionID != "rollback" {
+			continue
+		}
+		if !slackAllowed(b.roles, user, "rollback") {
+			go postSlack(payload.ResponseURL, slackMessage{Text: "You need the admin role to roll back."})
+			return
+		}
+		version, by := action.Value, payload.User.Username
+		fmt.Printf("Slack: %s (%s) rolled back %s\n", by, user, version)
+		go postSlack(payload.ResponseURL, slackMessage{ReplaceOriginal: true, Text: fmt.Sprintf("<@%s> is rolling back %s…", user, version)})
+		b.enqueue(payload.ResponseURL, func(ctx context.Context, _ *Status) string {
+			if err := startRun(); err != nil {
+				return fmt.Sprintf("Error rolling back %s: %v", version, err)
+			}
+			m, err := loadManifest()
+			if err != nil {
+				return fmt.Sprintf("Error loading the manifest: %v", err)
+			}
+			if m.ReleaseVersion != version {
+				return fmt.Sprintf("Not rolling back %s: the current release is now %s.", version, m.ReleaseVersion)
+			}
+			previous, tag, err := rollBack(ctx, m, version, fmt.Sprintf("rolled back %s from Slack", version), by)
+			if err != nil {
+				return fmt.Sprintf("Error rolling back %s: %v", version, err)
+			}
+			return fmt.Sprintf("<@%s> rolled %s back to %s as %s.", user, version, previous, tag)
+		})
+	}
+}
+
+// enqueue runs op between reconciles and posts the text it returns to
+// responseURL. Slack wants an answer within three seconds, so it returns
+// at once.
+func (b *slackBot) enqueue(responseURL string, op func(context.Context, *Status) string) {
+	go func() {
+		operations <- func(ctx context.Context, s *Status) {
+			text := op(ctx, s)
+			if err := postSlack(responseURL, slackMessage{ResponseType: "in_channel", Text: text}); err != nil {
+				fmt.Printf("Error answering Slack: %v\n", err)
+			}
+		}
+	}()
+}
+
+// postSlack sends a delayed response to a command's or action's
+// response_url.
+func postSlack(responseURL string, msg slackMessage) error {
+	if responseURL == "" {
+		return nil
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: deployTimeout}
+	resp, err := client.Post(responseURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("slack returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// statusText summarises the release, reconcile health, freeze and
+// environments in Slack mrkdwn.
+func (b *slackBot) statusText(now time.Time) string {
+	var sb strings.Builder
+	if m, err := manifest.Load(ManifestFile); err == nil {
+		fmt.Fprintf(&sb, "*Current release:* %s\n", m.ReleaseVersion)
+	}
+	b.status.mu.Lock()
+	lastRun, lastSuccess := b.status.lastRun, b.status.lastSuccess
+	b.status.mu.Unlock()
+	health := "healthy"
+	if !b.status.Healthy(now) {
+		health = "unhealthy"
+	}
+	if lastRun.IsZero() {
+		fmt.Fprintf(&sb, "*Reconcile:* %s, no run yet\n", health)
+	} else {
+		fmt.Fprintf(&sb, "*Reconcile:* %s, last run %s ago", health, now.Sub(lastRun).Round(time.Second))
+		if lastSuccess != lastRun {
+			fmt.Fprintf(&sb, " (failed; last success %s)", formatSince(now, lastSuccess))
+		}
+		sb.WriteString("\n")
+	}
+	if f, err := CurrentFreeze(now); err != nil {
+		fmt.Fprintf(&sb, "*Freeze:* unknown (%v)\n", err)
+	} else if f != nil {
+		fmt.Fprintf(&sb, "*Frozen* by %s: %s", f.By, f.Reason)
+		if !f.Until.IsZero() {
+			fmt.Fprintf(&sb, " (until %s)", f.Until.UTC().Format(time.RFC1123))
+		}
+		sb.WriteString("\n")
+	}
+	envs, warnings, err := Environments()
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf("environment status unavailable: %v", err))
+	}
+	for _, env := range envs {
+		fmt.Fprintf(&sb, "• %s: %d hosts, ", env.Name, len(env.Hosts))
+		switch env.Behind {
+		case -1:
+			sb.WriteString("no known release\n")
+		case 0:
+			sb.WriteString("up to date\n")
+		default:
+			fmt.Fprintf(&sb, "%d releases behind\n", env.Behind)
+		}
+	}
+	for _, w := range warnings {
+		fmt.Fprintf(&sb, ":warning: %s\n", w)
+	}
+	return sb.String()
+}
+
+func formatSince(now, t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return now.Sub(t).Round(time.Second).String() + " ago"
+}
@@ -0,0 +1,158 @@
+package releaser
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/velann21/todo-releaser/internal/statestore"
+)
+
+// RELEASER_STATE_STORE selects where the releaser keeps its state, the
+// freeze, agent reports, webhooks, enrollment tokens, release history and
+// audit log: sqlite, the default, in state.db in StateDir, or postgres at
+// the connection string RELEASER_STATE_DSN, so the controlplane's state
+// survives losing its instance. RELEASER_STATE_DSN may also move the SQLite
+// file. The agent CA and the managed checkout stay in StateDir.
+//
+// State the releaser kept in files in StateDir before is imported the
+// first time it is read, and the file renamed with a .imported suffix.
+func stateStoreConfig() (driver, dsn string, err error) {
+	driver = os.Getenv("RELEASER_STATE_STORE")
+	dsn = os.Getenv("RELEASER_STATE_DSN")
+	switch driver {
+	case "", statestore.SQLite:
+		if dsn == "" {
+			dsn = filepath.Join(StateDir(), "state.db")
+		}
+		return statestore.SQLite, dsn, nil
+	case statestore.Postgres:
+		if dsn == "" {
+			return "", "", errors.New("RELEASER_STATE_STORE: postgres needs RELEASER_STATE_DSN")
+		}
+		return driver, dsn, nil
+	default:
+		return "", "", fmt.Errorf("RELEASER_STATE_STORE: %q must be sqlite or postgres", driver)
+	}
+}
+
+// stateDB is the open state store, reopened when its configuration
+// changes.
+var stateDB struct {
+	sync.Mutex
+	driver, dsn string
+	store       statestore.Store
+}
+
+func stateStore() (statestore.Store, error) {
+	driver, dsn, err := stateStoreConfig()
+	if err != nil {
+		return nil, err
+	}
+	stateDB.Lock()
+	defer stateDB.Unlock()
+	if stateDB.store != nil && stateDB.driver == driver && stateDB.dsn == dsn {
+		return stateDB.store, nil
+	}
+	if stateDB.store != nil {
+		stateDB.store.Close()
+		stateDB.store = nil
+	}
+	store, err := statestore.Open(context.Background(), driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error opening the %s state store: %w", driver, err)
+	}
+	stateDB.driver, stateDB.dsn, stateDB.store = driver, dsn, store
+	return store, nil
+}
+
+// closeStateStore closes the state store, which is opened again when next
+// used, e.g. so the SQLite file can be archived or replaced.
+func closeStateStore() {
+	stateDB.Lock()
+	defer stateDB.Unlock()
+	if stateDB.store != nil {
+		stateDB.store.Close()
+		stateDB.store = nil
+	}
+}
+
+// readState returns the state stored as name, importing the file name in
+// StateDir if it was kept there before. It returns statestore.ErrNotFound
+// when there is none.
+func readState(name string) ([]byte, error) {
+	store, err := stateStore()
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	data, err := store.Get(ctx, name)
+	if !errors.Is(err, statestore.ErrNotFound) {
+		return data, err
+	}
+	legacy := filepath.Join(StateDir(), name)
+	data, err = os.ReadFile(legacy)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, statestore.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Put(ctx, name, data); err != nil {
+		return nil, fmt.Errorf("error importing %s: %w", legacy, err)
+	}
+	if err := os.Rename(legacy, legacy+".imported"); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readStateJSON decodes the state name into v, leaving v alone when there
+// is none.
+func readStateJSON(name string, v any) error {
+	data, err := readState(name)
+	if errors.Is(err, statestore.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("error parsing %s: %w", name, err)
+	}
+	return nil
+}
+
+// writeStateJSON stores v as the state name.
+func writeStateJSON(name string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	store, err := stateStore()
+	if err != nil {
+		return err
+	}
+	return store.Put(context.Background(), name, data)
+}
+
+// deleteState removes the state name, along with a file of it not yet
+// imported.
+func deleteState(name string) error {
+	store, err := stateStore()
+	if err != nil {
+		return err
+	}
+	if err := store.Delete(context.Background(), name); err != nil {
+		return err
+	}
+	err = os.Remove(filepath.Join(StateDir(), name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
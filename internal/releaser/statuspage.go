@@ -0,0 +1,241 @@
+package releaser
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// maintenance is a rollout announced on the status page.
+type maintenance struct {
+	version    string
+	components []string
+	// incident is the Statuspage.io maintenance, if one was opened.
+	incident string
+}
+
+// DefaultStatuspageAPI is the Statuspage.io API unless
+// RELEASER_STATUSPAGE_API_URL overrides it.
+const DefaultStatuspageAPI = "https://api.statuspage.io/v1"
+
+// maintenanceWindow is how long a maintenance is scheduled for. It is
+// completed as soon as the rollout ends.
+const maintenanceWindow = time.Hour
+
+// Status events.
+const (
+	StatusDeployStarted  = "deploy-started"
+	StatusDeployFinished = "deploy-finished"
+)
+
+// StatusEvent is what the status webhook receives.
+type StatusEvent struct {
+	Event      string   `json:"event"`
+	Version    string   `json:"version"`
+	Components []string `json:"components"`
+	// Succeeded and Error tell how a finished rollout went.
+	Succeeded bool   `json:"succeeded,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// affectedComponents are the status components of the services bumped by
+// this run, or of every service when none was, as in a rollback.
+func affectedComponents(m *manifest.Manifest) []string {
+	var components, all []string
+	for _, s := range m.Services {
+		all = append(all, s.StatusComponents...)
+		if s.LastBump != nil && s.LastBump.Run == runID {
+			components = append(components, s.StatusComponents...)
+		}
+	}
+	if components == nil {
+		components = all
+	}
+	slices.Sort(components)
+	return slices.Compact(components)
+}
+
+// beginMaintenance announces the rollout of m's release on the status
+// page, as a maintenance of the components of the services the release
+// changes (each service's status_components) while the deploy hooks run.
+// Both integrations are optional:
+//
+//   - Statuspage.io: RELEASER_STATUSPAGE_PAGE_ID names the page and
+//     RELEASER_STATUSPAGE_API_KEY, or the manifest's statuspage_api_key
+//     secret, authorises the API. The maintenance is opened in progress,
+//     with the components under maintenance, and completed when the rollout
+//     ends.
+//   - An internal status service: RELEASER_STATUS_WEBHOOK, or the
+//     manifest's status_webhook secret, is POSTed a StatusEvent when the
+//     rollout begins and when it ends.
+//
+// Failures are logged; they never hold up a rollout. It returns nil when
+// no status integration is configured or no component is affected.
+func beginMaintenance(m *manifest.Manifest) *maintenance {
+	page, key, hook := statuspageConfig(m)
+	if page == "" && hook == "" {
+		return nil
+	}
+	mt := &maintenance{version: m.ReleaseVersion, components: affectedComponents(m)}
+	if len(mt.components) == 0 {
+		return nil
+	}
+	if page != "" {
+		id, err := openStatuspageMaintenance(page, key, mt)
+		if err != nil {
+			fmt.Printf("Error opening the Statuspage maintenance for %s: %v\n", mt.version, err)
+		}
+		mt.incident = id
+	}
+	if hook != "" {
+		event := StatusEvent{Event: StatusDeployStarted, Version: mt.version, Components: mt.components}
+		if err := postStatusWebhook(hook, event); err != nil {
+			fmt.Printf("Error posting to the status webhook: %v\n", err)
+		}
+	}
+	return mt
+}
+
+// end announces that the rollout finished, failed if deployErr is set.
+func (mt *maintenance) end(m *manifest.Manifest, deployErr error) {
+	if mt == nil {
+		return
+	}
+	page, key, hook := statuspageConfig(m)
+	if page != "" && mt.incident != "" {
+		if err := completeStatuspageMaintenance(page, key, mt, deployErr); err != nil {
+			fmt.Printf("Error completing the Statuspage maintenance for %s: %v\n", mt.version, err)
+		}
+	}
+	if hook != "" {
+		event := StatusEvent{Event: StatusDeployFinished, Version: mt.version, Components: mt.components, Succeeded: deployErr == nil}
+		if deployErr != nil {
+			event.Error = deployErr.Error()
+		}
+		if err := postStatusWebhook(hook, event); err != nil {
+			fmt.Printf("Error posting to the status webhook: %v\n", err)
+		}
+	}
+}
+
+// statuspageConfig returns the Statuspage.io page and API key, and the
+// status webhook URL.
+func statuspageConfig(m *manifest.Manifest) (page, key, hook string) {
+	page = os.Getenv("RELEASER_STATUSPAGE_PAGE_ID")
+	if key = os.Getenv("RELEASER_STATUSPAGE_API_KEY"); key == "" {
+		key = m.Secret("statuspage_api_key")
+	}
+	if hook = os.Getenv("RELEASER_STATUS_WEBHOOK"); hook == "" {
+		hook = m.Secret("status_webhook")
+	}
+	return page, key, hook
+}
+
+// openStatuspageMaintenance opens an in-progress maintenance for mt and
+// returns its incident ID.
+func openStatuspageMaintenance(page, key string, mt *maintenance) (string, error) {
+	now := Clock.Now().UTC()
+	payload := map[string]any{"incident": map[string]any{
+		"name":                   "Deploying release " + mt.version,
+		"status":                 "in_progress",
+		"impact_override":        "maintenance",
+		"scheduled_for":          now.Format(time.RFC3339),
+		"scheduled_until":        now.Add(maintenanceWindow).Format(time.RFC3339),
+		"scheduled_remind_prior": false,
+		"body":                   fmt.Sprintf("Release %s is being rolled out.", mt.version),
+		"component_ids":          mt.components,
+		"components":             componentStatuses(mt.components, "under_maintenance"),
+	}}
+	var incident struct {
+		ID string `json:"id"`
+	}
+	if err := statuspageAPI(http.MethodPost, "/pages/"+page+"/incidents", key, payload, &incident); err != nil {
+		return "", err
+	}
+	return incident.ID, nil
+}
+
+// completeStatuspageMaintenance completes mt's maintenance, with the
+// components back in operation.
+func completeStatuspageMaintenance(page, key string, mt *maintenance, deployErr error) error {
+	body := fmt.Sprintf("Release %s has been rolled out.", mt.version)
+	if deployErr != nil {
+		body = fmt.Sprintf("The rollout of release %s failed and the services stay at their previous versions.", mt.version)
+	}
+	payload := map[string]any{"incident": map[string]any{
+		"status":     "completed",
+		"body":       body,
+		"components": componentStatuses(mt.components, "operational"),
+	}}
+	return statuspageAPI(http.MethodPatch, "/pages/"+page+"/incidents/"+mt.incident, key, payload, nil)
+}
+
+func componentStatuses(components []string, status string) map[string]string {
+	statuses := map[string]string{}
+	for _, c := range components {
+		statuses[c] = status
+	}
+	return statuses
+}
+
+// statuspageAPI calls the Statuspage.io API at path, sending payload as JSON
+// and decoding the response into out unless it is nil.
+func statuspageAPI(method, path, key string, payload, out any) error {
+	if key == "" {
+		return fmt.Errorf("RELEASER_STATUSPAGE_API_KEY is not set")
+	}
+	api := os.Getenv("RELEASER_STATUSPAGE_API_URL")
+	if api == "" {
+		api = DefaultStatuspageAPI
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, api+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "OAuth "+key)
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: deployTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var msg bytes.Buffer
+	msg.ReadFrom(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %d: %s", req.URL.Host, resp.StatusCode, strings.TrimSpace(msg.String()))
+	}
+	if out != nil {
+		return json.Unmarshal(msg.Bytes(), out)
+	}
+	return nil
+}
+
+func postStatusWebhook(url string, event StatusEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: deployTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("status webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
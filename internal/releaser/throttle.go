@@ -0,0 +1,200 @@
+package releaser
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/ratelimit"
+)
+
+// Registry request limits, unless overridden by:
+//
+//	RELEASER_REGISTRY_RATE         requests a second to any one host
+//	RELEASER_REGISTRY_RATES        per-host rates, e.g. hub.docker.com=1,ghcr.io=10
+//	RELEASER_REGISTRY_BUDGET       requests per run, 0 for no limit
+//	RELEASER_REGISTRY_CONCURRENCY  services checked at once
+//
+// Hosts are those requests go to (hub.docker.com, registry-1.docker.io,
+// auth.docker.io), or the registry a plugin handles.
+const (
+	DefaultRegistryRate        = 2
+	DefaultRegistryBudget      = 1000
+	DefaultRegistryConcurrency = 4
+)
+
+var (
+	throttleOnce sync.Once
+	throttleErr  error
+	hostLimits   *ratelimit.Hosts
+	runBudget    = &ratelimit.Budget{}
+	concurrency  = DefaultRegistryConcurrency
+
+	registryStatsMu sync.Mutex
+	registryStats   = map[string]*hostStats{}
+	budgetExhausted int
+)
+
+// hostStats count the requests to a registry host and the throttling they
+// saw.
+type hostStats struct {
+	requests  int
+	throttled int
+	waited    time.Duration
+}
+
+func loadThrottle() error {
+	throttleOnce.Do(func() {
+		hostLimits = &ratelimit.Hosts{Default: DefaultRegistryRate}
+		runBudget.Max = DefaultRegistryBudget
+		if v := os.Getenv("RELEASER_REGISTRY_RATE"); v != "" {
+			if hostLimits.Default, throttleErr = ratelimit.ParseRate(v); throttleErr != nil {
+				throttleErr = fmt.Errorf("RELEASER_REGISTRY_RATE: %w", throttleErr)
+				return
+			}
+		}
+		if hostLimits.Overrides, throttleErr = ratelimit.ParseRates(os.Getenv("RELEASER_REGISTRY_RATES")); throttleErr != nil {
+			throttleErr = fmt.Errorf("RELEASER_REGISTRY_RATES: %w", throttleErr)
+			return
+		}
+		for _, v := range []struct {
+			name string
+			dst  *int
+			min  int
+		}{
+			{"RELEASER_REGISTRY_BUDGET", &runBudget.Max, 0},
+			{"RELEASER_REGISTRY_CONCURRENCY", &concurrency, 1},
+		} {
+			s := os.Getenv(v.name)
+			if s == "" {
+				continue
+			}
+			n, err := strconv.Atoi(s)
+			if err != nil || n < v.min {
+				throttleErr = fmt.Errorf("%s: %q must be a number of at least %d", v.name, s, v.min)
+				return
+			}
+			*v.dst = n
+		}
+	})
+	return throttleErr
+}
+
+// startRegistryRun gives a reconcile run a fresh request budget.
+func startRegistryRun() error {
+	if err := loadThrottle(); err != nil {
+		return err
+	}
+	runBudget.Reset()
+	return nil
+}
+
+// throttle waits until a request to host is allowed, or fails when the
+// run's budget is spent.
+func throttle(ctx context.Context, host string) error {
+	if err := loadThrottle(); err != nil {
+		return err
+	}
+	if err := runBudget.Take(); err != nil {
+		registryStatsMu.Lock()
+		budgetExhausted++
+		registryStatsMu.Unlock()
+		return err
+	}
+	return pace(ctx, host)
+}
+
+// pace waits until a request to host is allowed by its rate.
+func pace(ctx context.Context, host string) error {
+	if err := loadThrottle(); err != nil {
+		return err
+	}
+	waited, err := hostLimits.Limiter(host).Wait(ctx)
+
+	registryStatsMu.Lock()
+	defer registryStatsMu.Unlock()
+	st := registryStats[host]
+	if st == nil {
+		st = &hostStats{}
+		registryStats[host] = st
+	}
+	st.requests++
+	if waited > 0 {
+		st.throttled++
+		st.waited += waited
+	}
+	return err
+}
+
+// throttledTransport paces every request through throttle, or, for bulk
+// transfers, only through pace.
+type throttledTransport struct {
+	base http.RoundTripper
+	bulk bool
+}
+
+func (t throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	limit := throttle
+	if t.bulk {
+		limit = pace
+	}
+	if err := limit(req.Context(), req.URL.Host); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
+
+// bulkTransport is t for copying images. Its requests are paced like any
+// other, but not counted against the run's budget, which is sized for
+// checks: copying the blobs of a release would spend it a few images in.
+func bulkTransport(t http.RoundTripper) http.RoundTripper {
+	if tt, ok := t.(throttledTransport); ok {
+		tt.bulk = true
+		return tt
+	}
+	return t
+}
+
+// registryHTTP is the client for all registry API requests.
+var registryHTTP = &http.Client{
+	Timeout:   30 * time.Second,
+	Transport: throttledTransport{base: http.DefaultTransport},
+}
+
+// writeRegistryMetrics writes the registry counters in the Prometheus text
+// format.
+func writeRegistryMetrics(w io.Writer) {
+	registryStatsMu.Lock()
+	defer registryStatsMu.Unlock()
+
+	hosts := make([]string, 0, len(registryStats))
+	for host := range registryStats {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	fmt.Fprintf(w, "# HELP releaser_registry_requests_total Registry requests by host.\n")
+	fmt.Fprintf(w, "# TYPE releaser_registry_requests_total counter\n")
+	for _, host := range hosts {
+		fmt.Fprintf(w, "releaser_registry_requests_total{host=%q} %d\n", host, registryStats[host].requests)
+	}
+	fmt.Fprintf(w, "# HELP releaser_registry_throttled_total Registry requests delayed by the rate limit.\n")
+	fmt.Fprintf(w, "# TYPE releaser_registry_throttled_total counter\n")
+	for _, host := range hosts {
+		fmt.Fprintf(w, "releaser_registry_throttled_total{host=%q} %d\n", host, registryStats[host].throttled)
+	}
+	fmt.Fprintf(w, "# HELP releaser_registry_throttle_seconds_total Time spent waiting for the rate limit.\n")
+	fmt.Fprintf(w, "# TYPE releaser_registry_throttle_seconds_total counter\n")
+	for _, host := range hosts {
+		fmt.Fprintf(w, "releaser_registry_throttle_seconds_total{host=%q} %g\n", host, registryStats[host].waited.Seconds())
+	}
+	fmt.Fprintf(w, "# HELP releaser_registry_budget_exhausted_total Registry requests refused because the run's budget was spent.\n")
+	fmt.Fprintf(w, "# TYPE releaser_registry_budget_exhausted_total counter\n")
+	fmt.Fprintf(w, "releaser_registry_budget_exhausted_total %d\n", budgetExhausted)
+}
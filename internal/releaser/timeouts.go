@@ -0,0 +1,67 @@
+package releaser
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Each phase of a run has a timeout, so a registry, remote or deploy target
+// that hangs fails the run instead of stalling the daemon:
+//
+//	RELEASER_REGISTRY_TIMEOUT  the registry checks of a run, default 5m
+//	RELEASER_GIT_TIMEOUT       each git command, default 10m
+//	RELEASER_DEPLOY_TIMEOUT    the deploy hooks of a release, default 30m
+const (
+	DefaultRegistryTimeout = 5 * time.Minute
+	DefaultGitTimeout      = 10 * time.Minute
+	DefaultDeployTimeout   = 30 * time.Minute
+)
+
+// stopDelay is how long an interrupted git or deploy command gets to clean
+// up, git its lock files, before it is killed.
+const stopDelay = 10 * time.Second
+
+// phaseTimeout reads the timeout in the environment variable name, def
+// when it is unset or invalid.
+func phaseTimeout(name string, def time.Duration) time.Duration {
+	s := os.Getenv(name)
+	if s == "" {
+		return def
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		fmt.Printf("%s: %q is not a positive duration, using %v\n", name, s, def)
+		return def
+	}
+	return d
+}
+
+// gitContext is ctx, done when RELEASER_GIT_TIMEOUT passes too.
+func gitContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, phaseTimeout("RELEASER_GIT_TIMEOUT", DefaultGitTimeout))
+}
+
+// runGitCommandContext is runGitCommand, stopped when ctx is done or
+// RELEASER_GIT_TIMEOUT passes. The command is interrupted rather than
+// killed, so git removes its lock files.
+func runGitCommandContext(ctx context.Context, args ...string) error {
+	ctx, cancel := gitContext(ctx)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = stopDelay
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	fmt.Printf("Running: git %s\n", strings.Join(args, " "))
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("git %s: %w", args[0], context.Cause(ctx))
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package releaser
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// Watchdog watches a release for its bake period after it is deployed and
+// reports a breach when the app turns unhealthy. It is configured from the
+// environment:
+//
+//	RELEASER_BAKE_PERIOD          how long to watch, e.g. 10m; unset disables it
+//	RELEASER_HEALTH_URL           app health endpoint polled during the bake
+//	RELEASER_HEALTH_MAX_FAILURES  consecutive failed polls that breach (default 3)
+//	RELEASER_ALB                  load balancer, as in its CloudWatch dimension
+//	                              (app/<name>/<id>), whose target 5xx are counted
+//	RELEASER_ALB_MAX_5XX          target 5xx per minute that breach (default 10)
+//
+// The 5xx count is read with the aws CLI, in AWS_REGION.
+type Watchdog struct {
+	Bake              time.Duration
+	Interval          time.Duration
+	HealthURL         string
+	MaxHealthFailures int
+	LoadBalancer      string
+	Max5xx            int
+	Region            string
+}
+
+// watchdogFromEnv returns the configured watchdog, or nil when it is off.
+func watchdogFromEnv() (*Watchdog, error) {
+	bake := os.Getenv("RELEASER_BAKE_PERIOD")
+	if bake == "" {
+		return nil, nil
+	}
+	w := &Watchdog{
+		Interval:          time.Minute,
+		HealthURL:         os.Getenv("RELEASER_HEALTH_URL"),
+		MaxHealthFailures: 3,
+		LoadBalancer:      os.Getenv("RELEASER_ALB"),
+		Max5xx:            10,
+		Region:            os.Getenv("AWS_REGION"),
+	}
+	var err error
+	if w.Bake, err = time.ParseDuration(bake); err != nil {
+		return nil, fmt.Errorf("RELEASER_BAKE_PERIOD: %w", err)
+	}
+	if v := os.Getenv("RELEASER_HEALTH_MAX_FAILURES"); v != "" {
+		if w.MaxHealthFailures, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("RELEASER_HEALTH_MAX_FAILURES: %w", err)
+		}
+	}
+	if v := os.Getenv("RELEASER_ALB_MAX_5XX"); v != "" {
+		if w.Max5xx, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("RELEASER_ALB_MAX_5XX: %w", err)
+		}
+	}
+	if w.HealthURL == "" && w.LoadBalancer == "" {
+		return nil, fmt.Errorf("RELEASER_BAKE_PERIOD needs RELEASER_HEALTH_URL or RELEASER_ALB to watch")
+	}
+	return w, nil
+}
+
+// Watch polls every Interval until the bake period is over. It returns nil
+// when the release stayed healthy, or an error describing the breach.
+func (w *Watchdog) Watch(ctx context.Context) error {
+	deadline := time.Now().Add(w.Bake)
+	healthFailures := 0
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(w.Interval):
+		}
+
+		if w.HealthURL != "" {
+			if err := checkHealthURL(ctx, w.HealthURL); err != nil {
+				healthFailures++
+				fmt.Printf("Health check failed (%d/%d): %v\n", healthFailures, w.MaxHealthFailures, err)
+				if healthFailures >= w.MaxHealthFailures {
+					return fmt.Errorf("%d consecutive health checks failed, last: %w", healthFailures, err)
+				}
+			} else {
+				healthFailures = 0
+			}
+		}
+
+		if w.LoadBalancer != "" {
+			count, err := targetErrorCount(ctx, w.Region, w.LoadBalancer)
+			if err != nil {
+				// A CloudWatch outage is not a reason to roll back.
+				fmt.Printf("Error reading 5xx count: %v\n", err)
+			} else if count > w.Max5xx {
+				return fmt.Errorf("%s returned %d target 5xx in the last minute (max %d)", w.LoadBalancer, count, w.Max5xx)
+			}
+		}
+	}
+	return nil
+}
+
+func checkHealthURL(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// targetErrorCount sums HTTPCode_Target_5XX_Count for the load balancer over
+// the last minute.
+func targetErrorCount(ctx context.Context, region, loadBalancer string) (int, error) {
+	end := time.Now().UTC()
+	args := []string{"cloudwatch", "get-metric-statistics",
+		"--namespace", "AWS/ApplicationELB",
+		"--metric-name", "HTTPCode_Target_5XX_Count",
+		"--dimensions", "Name=LoadBalancer,Value=" + loadBalancer,
+		"--start-time", end.Add(-time.Minute).Format(time.RFC3339),
+		"--end-time", end.Format(time.RFC3339),
+		"--period", "60",
+		"--statistics", "Sum",
+		"--output", "json"}
+	if region != "" {
+		args = append(args, "--region", region)
+	}
+	out, err := exec.CommandContext(ctx, "aws", args...).Output()
+	if err != nil {
+		return 0, fmt.Errorf("aws cloudwatch get-metric-statistics: %w", err)
+	}
+	var stats struct {
+		Datapoints []struct{ Sum float64 }
+	}
+	if err := json.Unmarshal(out, &stats); err != nil {
+		return 0, err
+	}
+	total := 0.0
+	for _, d := range stats.Datapoints {
+		total += d.Sum
+	}
+	return int(total), nil
+}
+
+// watchRelease bakes a freshly deployed release. On a breach it rolls back:
+// the previous release's service versions are released again as a new tag
+// and deployed, releases are frozen so the next reconcile does not bring the
+// bad versions back, the channel is notified and the on-call is paged.
+func watchRelease(ctx context.Context, m *manifest.Manifest, version string) error {
+	w, err := watchdogFromEnv()
+	if err != nil || w == nil {
+		return err
+	}
+
+	fmt.Printf("Watching %s for %v\n", version, w.Bake)
+	breach := w.Watch(ctx)
+	if ctx.Err() != nil {
+		return fmt.Errorf("stopped watching %s: %w", version, context.Cause(ctx))
+	}
+	if breach == nil {
+		fmt.Printf("%s baked without problems\n", version)
+		return nil
+	}
+	fmt.Printf("Rolling back %s: %v\n", version, breach)
+
+	previous, rollback, err := rollBack(ctx, m, version, fmt.Sprintf("automatic rollback of %s: %v", version, breach), "releaser watchdog")
+	switch {
+	case previous == "":
+		err = fmt.Errorf("%s breached (%v) but %w", version, breach, err)
+	case err != nil:
+		err = fmt.Errorf("error rolling back %s: %w", version, err)
+	default:
+		err = fmt.Errorf("%s rolled back to %s as %s: %v", version, previous, rollback, breach)
+	}
+	pageRelease(m, version, "rollback", pagerDutyCritical, err.Error(), map[string]string{
+		"breach":         breach.Error(),
+		"rolled_back_to": previous,
+		"rollback_tag":   rollback,
+	})
+	return err
+}
+
+// rollBack releases the service versions and config bundles of the release
+// before version again as a new tag and deploys it, freezing releases for
+// reason so the next reconcile does not bring the bad versions back, and
+// notifies the channel. It returns the release rolled back to, "" if there is none, and
+// the new tag, "" if it was not created.
+func rollBack(ctx context.Context, m *manifest.Manifest, version, reason, by string) (previous, tag string, err error) {
+	previous, err = previousRelease(version + "^")
+	if err != nil {
+		return "", "", errors.New("there is no earlier release to roll back to")
+	}
+	data, err := gitShow(previous, ManifestFile)
+	if err != nil {
+		return previous, "", err
+	}
+	prev, err := manifest.Parse(data)
+	if err != nil {
+		return previous, "", fmt.Errorf("error reading %s manifest: %w", previous, err)
+	}
+
+	if err := SetFreeze(&Freeze{Reason: reason, By: by, Since: time.Now()}); err != nil {
+		return previous, "", fmt.Errorf("error freezing releases: %w", err)
+	}
+	if err := restoreConfig(ctx, previous, prev); err != nil {
+		return previous, "", fmt.Errorf("error restoring the config of %s: %w", previous, err)
+	}
+	m.Services = prev.Services
+	tag, err = release(ctx, m, IncrementPatch, fmt.Sprintf("revert: roll back %s to %s", version, previous))
+	if tag != "" {
+		data := RollbackData{Version: version, Previous: previous, Tag: tag, Reason: reason}
+		if notifyErr := notify(ctx, m, NotifyRollback, data); notifyErr != nil {
+			fmt.Printf("Error sending rollback notification: %v\n", notifyErr)
+		}
+		publishEvent(LifecycleEvent{Type: EventRollback, Version: tag, Previous: previous, RolledBack: version, Reason: reason})
+	}
+	return previous, tag, err
+}
@@ -0,0 +1,432 @@
+package releaser
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// Release webhooks are outbound webhooks registered through the API that
+// receive every release as a ReleasePayload: the generic way to integrate
+// anything the releaser has no integration for. Each delivery is signed
+// with the webhook's secret:
+//
+//	X-Releaser-Event      release
+//	X-Releaser-Delivery   the delivery ID
+//	X-Releaser-Signature  sha256=<hex HMAC-SHA256 of the body with the secret>
+//
+// A delivery is attempted up to webhookAttempts times, backing off between
+// attempts, until the receiver answers 2xx. Client errors other than 408
+// and 429 are not retried. The last webhookDeliveryLog deliveries of each
+// webhook are kept for GET /webhooks/{id}/deliveries.
+type ReleaseWebhook struct {
+	ID          string    `json:"id"`
+	URL         string    `json:"url"`
+	Description string    `json:"description,omitempty"`
+	Created     time.Time `json:"created"`
+	// Secret signs the deliveries. It is only returned when the webhook is
+	// created.
+	Secret string `json:"secret,omitempty"`
+}
+
+// WebhookDelivery is the log of one delivery of a release to a webhook.
+type WebhookDelivery struct {
+	ID        string           `json:"id"`
+	Webhook   string           `json:"webhook"`
+	Event     string           `json:"event"`
+	Version   string           `json:"version"`
+	Succeeded bool             `json:"succeeded"`
+	Attempts  []WebhookAttempt `json:"attempts"`
+}
+
+// WebhookAttempt is one try at a delivery.
+type WebhookAttempt struct {
+	Time time.Time `json:"time"`
+	// Status is the receiver's HTTP status, 0 when it could not be reached.
+	Status   int           `json:"status,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// ReleasePayload is what release webhooks receive.
+type ReleasePayload struct {
+	Event      string          `json:"event"`
+	Version    string          `json:"version"`
+	Previous   string          `json:"previous,omitempty"`
+	Date       time.Time       `json:"date"`
+	Repository string          `json:"repository,omitempty"`
+	CompareURL string          `json:"compare_url,omitempty"`
+	Hotfix     bool            `json:"hotfix,omitempty"`
+	Changes    []PayloadChange `json:"changes"`
+	Blocked    []PayloadChange `json:"blocked,omitempty"`
+}
+
+// PayloadChange is a service version bump in a ReleasePayload.
+type PayloadChange struct {
+	Service string `json:"service"`
+	Image   string `json:"image,omitempty"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+	// Changelog links to the notes for the new version.
+	Changelog  string `json:"changelog,omitempty"`
+	Revision   string `json:"revision,omitempty"`
+	CommitURL  string `json:"commit_url,omitempty"`
+	CompareURL string `json:"compare_url,omitempty"`
+}
+
+const (
+	// webhookAttempts is how often a delivery is tried.
+	webhookAttempts = 4
+	// webhookDeliveryLog is how many deliveries are kept per webhook.
+	webhookDeliveryLog = 50
+)
+
+// webhookBackoff is the wait before the second attempt, doubling after.
+var webhookBackoff = 2 * time.Second
+
+var webhooksMu sync.Mutex
+
+// State names of the webhooks and their deliveries.
+const (
+	webhooksState          = "webhooks.json"
+	webhookDeliveriesState = "webhook_deliveries.json"
+)
+
+func readWebhooks() ([]ReleaseWebhook, error) {
+	var hooks []ReleaseWebhook
+	if err := readStateJSON(webhooksState, &hooks); err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+func readWebhookDeliveries() (map[string][]WebhookDelivery, error) {
+	deliveries := map[string][]WebhookDelivery{}
+	if err := readStateJSON(webhookDeliveriesState, &deliveries); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// AddWebhook registers a release webhook for rawURL. A secret is generated
+// when none is given. The returned webhook includes the secret.
+func AddWebhook(rawURL, secret, description string, now time.Time) (ReleaseWebhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return ReleaseWebhook{}, fmt.Errorf("%q is not an http(s) URL", rawURL)
+	}
+	if secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return ReleaseWebhook{}, err
+		}
+		secret = base64.RawURLEncoding.EncodeToString(b)
+	}
+	hook := ReleaseWebhook{ID: randomID(8), URL: rawURL, Description: description, Created: now.UTC(), Secret: secret}
+
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+	hooks, err := readWebhooks()
+	if err != nil {
+		return ReleaseWebhook{}, err
+	}
+	return hook, writeStateJSON(webhooksState, append(hooks, hook))
+}
+
+// RemoveWebhook unregisters the webhook id, and drops its deliveries. It
+// reports whether there was one.
+func RemoveWebhook(id string) (bool, error) {
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+	hooks, err := readWebhooks()
+	if err != nil {
+		return false, err
+	}
+	i := slices.IndexFunc(hooks, func(h ReleaseWebhook) bool { return h.ID == id })
+	if i < 0 {
+		return false, nil
+	}
+	if err := writeStateJSON(webhooksState, slices.Delete(hooks, i, i+1)); err != nil {
+		return false, err
+	}
+	deliveries, err := readWebhookDeliveries()
+	if err != nil {
+		return true, err
+	}
+	delete(deliveries, id)
+	return true, writeStateJSON(webhookDeliveriesState, deliveries)
+}
+
+// Webhooks returns the registered webhooks, without their secrets.
+func Webhooks() ([]ReleaseWebhook, error) {
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+	hooks, err := readWebhooks()
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	return hooks, err
+}
+
+// newReleasePayload builds the payload webhooks receive for result.
+func newReleasePayload(m *manifest.Manifest, result *Result, repo, previous string, now time.Time) ReleasePayload {
+	d := newNotesData(m, result, repo, previous, now)
+	p := ReleasePayload{Event: "release", Version: d.Version, Previous: d.Previous, Date: d.Date.UTC(),
+		Repository: d.RepoURL, CompareURL: d.CompareURL, Hotfix: d.Hotfix, Changes: []PayloadChange{}}
+	change := func(c NoteChange) PayloadChange {
+		return PayloadChange{Service: c.Service, Image: c.Image, From: c.From, To: c.To, Changelog: c.Changelog,
+			Revision: c.Revision, CommitURL: c.CommitURL, CompareURL: c.CompareURL}
+	}
+	for _, c := range d.Changes {
+		p.Changes = append(p.Changes, change(c))
+	}
+	for _, c := range d.Blocked {
+		p.Blocked = append(p.Blocked, change(c))
+	}
+	return p
+}
+
+// deliverReleaseWebhooks sends result to every registered webhook and logs
+// the deliveries. All webhooks are attempted; the error lists those that
+// failed.
+func deliverReleaseWebhooks(m *manifest.Manifest, result *Result) error {
+	webhooksMu.Lock()
+	hooks, err := readWebhooks()
+	webhooksMu.Unlock()
+	if err != nil || len(hooks) == 0 {
+		return err
+	}
+	previous, _ := previousRelease(result.Version + "^")
+	body, err := json.Marshal(newReleasePayload(m, result, repositoryURL(), previous, time.Now()))
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, h := range hooks {
+		d := deliverWebhook(h, "release", result.Version, body)
+		if err := logWebhookDelivery(d); err != nil {
+			fmt.Printf("Error logging the delivery to webhook %s: %v\n", h.ID, err)
+		}
+		if !d.Succeeded {
+			failed = append(failed, fmt.Sprintf("%s: %s", h.ID, d.Attempts[len(d.Attempts)-1].Error))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("webhook deliveries failed:\n  %s", strings.Join(failed, "\n  "))
+	}
+	return nil
+}
+
+// deliverWebhook posts body to h, signed, retrying as documented on
+// ReleaseWebhook.
+func deliverWebhook(h ReleaseWebhook, event, version string, body []byte) WebhookDelivery {
+	d := WebhookDelivery{ID: randomID(8), Webhook: h.ID, Event: event, Version: version}
+	client := &http.Client{Timeout: deployTimeout}
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		a, retry := attemptWebhook(client, h, d.ID, event, body)
+		d.Attempts = append(d.Attempts, a)
+		if a.Error == "" {
+			d.Succeeded = true
+			return d
+		}
+		if !retry || attempt == webhookAttempts {
+			return d
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// attemptWebhook makes one delivery attempt, and tells whether a failed
+// one is worth retrying.
+func attemptWebhook(client *http.Client, h ReleaseWebhook, delivery, event string, body []byte) (WebhookAttempt, bool) {
+	a := WebhookAttempt{Time: time.Now().UTC()}
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		a.Error = err.Error()
+		return a, false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "todo-releaser")
+	req.Header.Set("X-Releaser-Event", event)
+	req.Header.Set("X-Releaser-Delivery", delivery)
+	req.Header.Set("X-Releaser-Signature", webhookSignature(h.Secret, body))
+	resp, err := client.Do(req)
+	a.Duration = time.Since(a.Time)
+	if err != nil {
+		a.Error = err.Error()
+		return a, true
+	}
+	resp.Body.Close()
+	a.Status = resp.StatusCode
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return a, false
+	}
+	a.Error = fmt.Sprintf("webhook returned %d", resp.StatusCode)
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+	return a, retry
+}
+
+// webhookSignature signs body with secret, as X-Releaser-Signature.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// logWebhookDelivery records d, dropping the webhook's oldest deliveries
+// beyond webhookDeliveryLog.
+func logWebhookDelivery(d WebhookDelivery) error {
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+	deliveries, err := readWebhookDeliveries()
+	if err != nil {
+		return err
+	}
+	log := append(deliveries[d.Webhook], d)
+	if len(log) > webhookDeliveryLog {
+		log = log[len(log)-webhookDeliveryLog:]
+	}
+	deliveries[d.Webhook] = log
+	return writeStateJSON(webhookDeliveriesState, deliveries)
+}
+
+// WebhookDeliveries returns the logged deliveries to webhook id, newest
+// first, and whether the webhook exists.
+func WebhookDeliveries(id string) ([]WebhookDelivery, bool, error) {
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+	hooks, err := readWebhooks()
+	if err != nil {
+		return nil, false, err
+	}
+	if !slices.ContainsFunc(hooks, func(h ReleaseWebhook) bool { return h.ID == id }) {
+		return nil, false, nil
+	}
+	deliveries, err := readWebhookDeliveries()
+	if err != nil {
+		return nil, true, err
+	}
+	log := slices.Clone(deliveries[id])
+	slices.Reverse(log)
+	if log == nil {
+		log = []WebhookDelivery{}
+	}
+	return log, true, nil
+}
+
+// webhookRequest is the body of POST /webhooks.
+type webhookRequest struct {
+	URL         string `json:"url"`
+	Secret      string `json:"secret,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// handleWebhooks serves GET and POST /webhooks (API token): the registered
+// webhooks, and registering one. The response to POST is the new webhook
+// with its secret.
+func handleWebhooks(token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var out any
+		switch r.Method {
+		case http.MethodGet:
+			hooks, err := Webhooks()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if hooks == nil {
+				hooks = []ReleaseWebhook{}
+			}
+			out = hooks
+		case http.MethodPost:
+			var req webhookRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			hook, err := AddWebhook(req.URL, req.Secret, req.Description, time.Now())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			fmt.Printf("Webhook %s registered for %s\n", hook.ID, hook.URL)
+			out = hook
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
+
+// handleWebhook serves DELETE /webhooks/{id} (API token).
+func handleWebhook(token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id := r.PathValue("id")
+		ok, err := RemoveWebhook(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "no webhook "+id, http.StatusNotFound)
+			return
+		}
+		fmt.Printf("Webhook %s removed\n", id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleWebhookDeliveries serves GET /webhooks/{id}/deliveries (API
+// token), the webhook's delivery log, newest first.
+func handleWebhookDeliveries(token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id := r.PathValue("id")
+		log, ok, err := WebhookDeliveries(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "no webhook "+id, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(log)
+	}
+}
@@ -0,0 +1,164 @@
+package releaser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// errTagNotFound is returned when the registry doesn't have a tag.
+var errTagNotFound = errors.New("tag not found")
+
+// RELEASER_YANKED_TAGS is what is done when a tag the manifest runs
+// disappears from its registry, yanked or deleted upstream:
+//
+//	notify  notify and page about it (the default)
+//	pin     notify and page, and pin the service to the digest the tag last
+//	        pointed to, so deploys keep pulling the same image
+//
+// A service can only be pinned when a check saw its tag before it went.
+const (
+	YankedNotify = "notify"
+	YankedPin    = "pin"
+)
+
+func yankedMode() (string, error) {
+	switch mode := os.Getenv("RELEASER_YANKED_TAGS"); mode {
+	case "":
+		return YankedNotify, nil
+	case YankedNotify, YankedPin:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("RELEASER_YANKED_TAGS: %q must be notify or pin", mode)
+	}
+}
+
+const tagsState = "tags.json"
+
+// tagRecord is what checks last saw of a tag the manifest runs.
+type tagRecord struct {
+	// Digest is the digest the tag last pointed to.
+	Digest string `json:"digest,omitempty"`
+	// Yanked is when the tag was found gone from the registry.
+	Yanked *time.Time `json:"yanked,omitempty"`
+}
+
+// readTagRecords returns the records of the tags checked, by reference.
+func readTagRecords() (map[string]tagRecord, error) {
+	records := map[string]tagRecord{}
+	if err := readStateJSON(tagsState, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func writeTagRecords(records map[string]tagRecord) error {
+	return writeStateJSON(tagsState, records)
+}
+
+// YankedTag is a tag the manifest runs that is gone from its registry.
+type YankedTag struct {
+	Service string
+	Image   string
+	Tag     string
+	// Digest is the digest the tag last pointed to, if a check saw it.
+	Digest string
+	// Pinned is set when the service was pinned to Digest.
+	Pinned bool
+}
+
+// YankedData is what yanked-tag notifications are rendered from.
+type YankedData struct {
+	Version string
+	Tags    []YankedTag
+}
+
+// checkYankedTags checks that the tags m's services run, those the run
+// left at their tag (unchanged since before), are still in their
+// registries. Each tag found gone is notified and paged about once; with
+// RELEASER_YANKED_TAGS=pin its service is also pinned to the digest the
+// tag last pointed to, and the pins are returned as changes to release.
+// Digest-only services pull by digest and aren't checked. With only set,
+// only the services in it are checked.
+func checkYankedTags(ctx context.Context, m *manifest.Manifest, before []manifest.Service, only map[string]bool) ([]Change, error) {
+	mode, err := yankedMode()
+	if err != nil {
+		return nil, err
+	}
+	records, err := readTagRecords()
+	if err != nil {
+		return nil, err
+	}
+	var changes []Change
+	var yanked []YankedTag
+	for i, s := range m.Services {
+		if (only != nil && !only[s.Name]) || s.Digest() != "" || s.Version == "" ||
+			s.Image != before[i].Image || s.Version != before[i].Version {
+			continue
+		}
+		ref := s.Ref()
+		rec := records[ref]
+		digest, err := tagDigest(ctx, s.Image, s.Version)
+		if err == nil {
+			if rec.Yanked != nil {
+				fmt.Printf("%s is back in the registry\n", ref)
+			}
+			records[ref] = tagRecord{Digest: digest}
+			continue
+		}
+		if !errors.Is(err, errTagNotFound) {
+			// The registry can't tell; check again next run.
+			continue
+		}
+		fmt.Printf("%s is gone from the registry\n", ref)
+		y := YankedTag{Service: s.Name, Image: s.Image, Tag: s.Version, Digest: rec.Digest}
+		if mode == YankedPin && rec.Digest != "" {
+			fmt.Printf("Pinning %s to %s\n", s.Name, shortDigest(rec.Digest))
+			m.SetDigest(i, s.Version, rec.Digest, runID, Clock.Now())
+			changes = append(changes, Change{Service: s.Name, From: s.Version, To: shortDigest(rec.Digest)})
+			y.Pinned = true
+		}
+		if rec.Yanked == nil {
+			now := Clock.Now().UTC()
+			rec.Yanked = &now
+			yanked = append(yanked, y)
+		}
+		records[ref] = rec
+	}
+	if err := writeTagRecords(records); err != nil {
+		return nil, err
+	}
+	if len(yanked) > 0 {
+		alertYanked(ctx, m, yanked)
+	}
+	return changes, nil
+}
+
+// alertYanked notifies and pages about tags newly found gone from their
+// registries. Both are best effort.
+func alertYanked(ctx context.Context, m *manifest.Manifest, yanked []YankedTag) {
+	if err := notify(ctx, m, NotifyYanked, YankedData{Version: m.ReleaseVersion, Tags: yanked}); err != nil {
+		fmt.Printf("Error sending yanked tag notification: %v\n", err)
+	}
+	var refs []string
+	details := map[string]string{}
+	for _, y := range yanked {
+		ref := y.Image + ":" + y.Tag
+		refs = append(refs, ref)
+		switch {
+		case y.Pinned:
+			details[y.Service] = ref + " pinned to " + y.Digest
+		case y.Digest != "":
+			details[y.Service] = ref + " last pointed to " + y.Digest
+		default:
+			details[y.Service] = ref + " has no recorded digest"
+		}
+	}
+	summary := fmt.Sprintf("Released images gone from the registry: %s", strings.Join(refs, ", "))
+	pageRelease(m, m.ReleaseVersion, "yanked-tag", pagerDutyCritical, summary, details)
+}
@@ -0,0 +1,74 @@
+package render
+
+import (
+	"cmp"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// Nomad renders m as <Project>.nomad.hcl, a Nomad service job named
+// Project with a group per service, each
+// running its image with the docker driver. Of the runtime settings, the
+// memory and pids limits, the logging driver and the restart policies
+// that give up (no and on-failure:N) carry over. CPU limits, in CPUs
+// rather than Nomad's MHz, and healthchecks, which Nomad ties to service
+// registrations the manifest doesn't describe, are left to the job's
+// owners. Nomad has no ordering between groups, so depends_on is dropped
+// as well.
+func Nomad(m *manifest.Manifest) (map[string][]byte, error) {
+	var b strings.Builder
+	b.WriteString(header("#", m))
+	fmt.Fprintf(&b, "job %s {\n", hclString(Project))
+	b.WriteString("  type = \"service\"\n\n")
+	fmt.Fprintf(&b, "  meta {\n    release_version = %s\n  }\n", hclString(m.ReleaseVersion))
+	for _, s := range m.Services {
+		fmt.Fprintf(&b, "\n  group %s {\n", hclString(s.Name))
+		r := s.Runtime
+		if r == nil {
+			r = &manifest.Runtime{}
+		}
+		if policy, count, _ := strings.Cut(r.Restart, ":"); r.Restart == "no" || policy == "on-failure" && count != "" {
+			fmt.Fprintf(&b, "    restart {\n      attempts = %s\n      mode     = \"fail\"\n    }\n\n", cmp.Or(count, "0"))
+		}
+		fmt.Fprintf(&b, "    task %s {\n", hclString(s.Name))
+		b.WriteString("      driver = \"docker\"\n\n")
+		b.WriteString("      config {\n")
+		fmt.Fprintf(&b, "        image = %s\n", hclString(s.Ref()))
+		if l := r.Limits; l != nil && l.Pids > 0 {
+			fmt.Fprintf(&b, "        pids_limit = %d\n", l.Pids)
+		}
+		if lg := r.Logging; lg != nil {
+			fmt.Fprintf(&b, "\n        logging {\n          type = %s\n", hclString(lg.Driver))
+			if len(lg.Options) > 0 {
+				b.WriteString("          config {\n")
+				for _, k := range sortedKeys(lg.Options) {
+					fmt.Fprintf(&b, "            %s = %s\n", k, hclString(lg.Options[k]))
+				}
+				b.WriteString("          }\n")
+			}
+			b.WriteString("        }\n")
+		}
+		b.WriteString("      }\n")
+		if l := r.Limits; l != nil && l.Memory != "" {
+			mib, err := memoryMiB(l.Memory)
+			if err != nil {
+				return nil, fmt.Errorf("runtime of %s: %w", s.Name, err)
+			}
+			fmt.Fprintf(&b, "\n      resources {\n        memory = %d\n      }\n", mib)
+		}
+		b.WriteString("    }\n  }\n")
+	}
+	b.WriteString("}\n")
+	return map[string][]byte{Project + ".nomad.hcl": []byte(b.String())}, nil
+}
+
+// hclString quotes s as an HCL string, escaping the template sequences
+// HCL would otherwise interpolate.
+func hclString(s string) string {
+	s = strings.ReplaceAll(s, "${", "$${")
+	s = strings.ReplaceAll(s, "%{", "%%{")
+	return strconv.Quote(s)
+}
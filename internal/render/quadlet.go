@@ -0,0 +1,127 @@
+package render
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/velann21/todo-releaser/internal/image"
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// Quadlet renders m as podman quadlets, for systemd to run the services
+// with podman: a <service>.container unit for each service, and
+// <Project>.network, a network they all join so they reach each other by
+// service name as in compose. Dropped into /etc/containers/systemd, the
+// units start <service>.service after those of the services it depends
+// on. Images are written fully qualified, as podman won't guess a
+// registry. All runtime settings carry over, except the retry count of
+// on-failure:N, which systemd counts differently.
+func Quadlet(m *manifest.Manifest) (map[string][]byte, error) {
+	files := map[string][]byte{
+		Project + ".network": []byte(header("#", m) + "[Network]\nNetworkName=" + Project + "\n"),
+	}
+	for _, s := range m.Services {
+		ref, err := image.Parse(s.Ref())
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %w", s.Name, err)
+		}
+		var b strings.Builder
+		b.WriteString(header("#", m))
+		b.WriteString("[Unit]\n")
+		unitLine(&b, "Description", fmt.Sprintf("%s of release %s", s.Name, m.ReleaseVersion))
+		for _, dep := range s.DependsOn {
+			unitLine(&b, "Requires", dep+".service")
+			unitLine(&b, "After", dep+".service")
+		}
+
+		b.WriteString("\n[Container]\n")
+		unitLine(&b, "ContainerName", s.Name)
+		unitLine(&b, "Image", qualified(ref))
+		unitLine(&b, "Network", Project+".network")
+		r := s.Runtime
+		if r == nil {
+			r = &manifest.Runtime{}
+		}
+		if h := r.Healthcheck; h != nil {
+			cmd, err := healthCmd(h.Test)
+			if err != nil {
+				return nil, fmt.Errorf("service %s: %w", s.Name, err)
+			}
+			unitLine(&b, "HealthCmd", cmd)
+			unitLine(&b, "HealthInterval", h.Interval)
+			unitLine(&b, "HealthTimeout", h.Timeout)
+			unitLine(&b, "HealthStartPeriod", h.StartPeriod)
+			if h.Retries > 0 {
+				unitLine(&b, "HealthRetries", fmt.Sprint(h.Retries))
+			}
+		}
+		if l := r.Limits; l != nil {
+			if l.CPUs != "" {
+				unitLine(&b, "PodmanArgs", "--cpus="+l.CPUs)
+			}
+			if l.Memory != "" {
+				unitLine(&b, "PodmanArgs", "--memory="+l.Memory)
+			}
+			if l.Pids > 0 {
+				unitLine(&b, "PidsLimit", fmt.Sprint(l.Pids))
+			}
+		}
+		if lg := r.Logging; lg != nil {
+			unitLine(&b, "LogDriver", lg.Driver)
+			for _, k := range sortedKeys(lg.Options) {
+				unitLine(&b, "LogOpt", k+"="+lg.Options[k])
+			}
+		}
+
+		b.WriteString("\n[Service]\n")
+		switch policy, _, _ := strings.Cut(r.Restart, ":"); policy {
+		case "always", "unless-stopped":
+			unitLine(&b, "Restart", "always")
+		case "on-failure":
+			unitLine(&b, "Restart", "on-failure")
+		default:
+			unitLine(&b, "Restart", "no")
+		}
+
+		b.WriteString("\n[Install]\nWantedBy=default.target\n")
+		files[s.Name+".container"] = []byte(b.String())
+	}
+	return files, nil
+}
+
+// unitLine writes key=value to a unit file, escaping the % systemd would
+// take for a specifier. Empty values are left out.
+func unitLine(b *strings.Builder, key, value string) {
+	if value != "" {
+		fmt.Fprintf(b, "%s=%s\n", key, strings.ReplaceAll(value, "%", "%%"))
+	}
+}
+
+// healthCmd is a compose healthcheck test as podman's --health-cmd takes
+// it: a JSON list for an exec form, the command line for a shell one.
+func healthCmd(test []string) (string, error) {
+	switch test[0] {
+	case "CMD":
+		data, err := json.Marshal(test[1:])
+		return string(data), err
+	case "CMD-SHELL":
+		return strings.Join(test[1:], " "), nil
+	case "NONE":
+		return "none", nil
+	}
+	return "", fmt.Errorf("healthcheck test %q must start with CMD, CMD-SHELL or NONE", test[0])
+}
+
+// qualified is ref with its registry, which short Docker Hub references
+// leave out.
+func qualified(ref image.Reference) string {
+	s := ref.Registry + "/" + ref.Repository
+	if ref.Tag != "" {
+		s += ":" + ref.Tag
+	}
+	if ref.Digest != "" {
+		s += "@" + ref.Digest
+	}
+	return s
+}
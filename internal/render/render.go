@@ -0,0 +1,104 @@
+// Package render writes the release manifest out for hosts that run
+// neither compose nor Kubernetes: as a Nomad job, or as systemd units that
+// run the services with podman (quadlets). Each output carries the images
+// and runtime settings of the release, as the deploy agent's compose
+// override does.
+package render
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+// Project names what the outputs run the services as: the Nomad job, the
+// podman network.
+const Project = "todo"
+
+// Writer renders m as files, by path relative to the output directory.
+type Writer func(m *manifest.Manifest) (map[string][]byte, error)
+
+// Writers are the outputs by name.
+var Writers = map[string]Writer{
+	"nomad":   Nomad,
+	"quadlet": Quadlet,
+}
+
+// Names returns the names of the outputs, sorted.
+func Names() []string {
+	return sortedKeys(Writers)
+}
+
+// Write renders m with the output name into dir, returning the paths of
+// the files written.
+func Write(dir, name string, m *manifest.Manifest) ([]string, error) {
+	w, ok := Writers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown output %q, want one of %s", name, strings.Join(Names(), ", "))
+	}
+	for _, s := range m.Services {
+		if s.Runtime == nil {
+			continue
+		}
+		if err := s.Runtime.Validate(); err != nil {
+			return nil, fmt.Errorf("runtime of %s: %w", s.Name, err)
+		}
+	}
+	files, err := w(m)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, name := range sortedKeys(files) {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, files[name], 0644); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// header is the comment each file starts with, after comment, the
+// format's comment marker.
+func header(comment string, m *manifest.Manifest) string {
+	return fmt.Sprintf("%s Rendered from the manifest of %s; changes here are overwritten.\n", comment, m.ReleaseVersion)
+}
+
+var memoryParts = regexp.MustCompile(`^(?i)([0-9]+(?:\.[0-9]+)?)\s*([kmgt]?)i?b?$`)
+
+// memoryMiB converts a byte amount as compose writes it, e.g. 512M or 1.5g,
+// to mebibytes, rounding up. Compose's units are binary.
+func memoryMiB(amount string) (int, error) {
+	parts := memoryParts.FindStringSubmatch(amount)
+	if parts == nil {
+		return 0, fmt.Errorf("memory %q is not a byte amount like 512M", amount)
+	}
+	n, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	shift := strings.Index("bkmgt", strings.ToLower(cmp.Or(parts[2], "b")))
+	bytes := n * math.Pow(1024, float64(shift))
+	return int(math.Ceil(bytes / (1 << 20))), nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
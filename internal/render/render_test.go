@@ -0,0 +1,172 @@
+package render
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/velann21/todo-releaser/internal/manifest"
+)
+
+func testManifest() *manifest.Manifest {
+	return &manifest.Manifest{
+		ReleaseVersion: "v202502.1.0",
+		Services: []manifest.Service{
+			{Name: "todo-backend", Image: "singaravelan21/todo-backend", Version: "v1.1.0", DependsOn: []string{"redis"}, Runtime: &manifest.Runtime{
+				Healthcheck: &manifest.Healthcheck{Test: []string{"CMD", "curl", "-f", "http://localhost:8080/health"}, Interval: "30s", Retries: 3},
+				Restart:     "on-failure:3",
+				Limits:      &manifest.Limits{CPUs: "0.5", Memory: "512M", Pids: 100},
+				Logging:     &manifest.Logging{Driver: "json-file", Options: map[string]string{"max-size": "10m"}},
+			}},
+			{Name: "redis", Image: "redis@sha256:0123abcd", Runtime: &manifest.Runtime{Restart: "always"}},
+			{Name: "todo-frontend", Image: "registry.corp:5000/team/todo-frontend", Version: "v1.2.0"},
+		},
+	}
+}
+
+func TestNomad(t *testing.T) {
+	files, err := Nomad(testManifest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := string(files["todo.nomad.hcl"])
+	backend := `  group "todo-backend" {
+    restart {
+      attempts = 3
+      mode     = "fail"
+    }
+
+    task "todo-backend" {
+      driver = "docker"
+
+      config {
+        image = "singaravelan21/todo-backend:v1.1.0"
+        pids_limit = 100
+
+        logging {
+          type = "json-file"
+          config {
+            max-size = "10m"
+          }
+        }
+      }
+
+      resources {
+        memory = 512
+      }
+    }
+  }
+`
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"header", "# Rendered from the manifest of v202502.1.0; changes here are overwritten.\njob \"todo\" {\n"},
+		{"release", "release_version = \"v202502.1.0\""},
+		{"runtime settings", backend},
+		{"digest", `image = "redis@sha256:0123abcd"`},
+		{"other registry", `image = "registry.corp:5000/team/todo-frontend:v1.2.0"`},
+	}
+	for _, tt := range tests {
+		if !strings.Contains(job, tt.want) {
+			t.Errorf("%s: job\n%s\nwant it to contain\n%s", tt.name, job, tt.want)
+		}
+	}
+	if strings.Count(job, "restart {") != 1 {
+		t.Errorf("restart policies that don't give up rendered:\n%s", job)
+	}
+}
+
+func TestQuadlet(t *testing.T) {
+	files, err := Quadlet(testManifest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		file string
+		want string
+	}{
+		{"todo.network", "[Network]\nNetworkName=todo\n"},
+		{"todo-backend.container", "[Unit]\nDescription=todo-backend of release v202502.1.0\nRequires=redis.service\nAfter=redis.service\n"},
+		{"todo-backend.container", "Image=docker.io/singaravelan21/todo-backend:v1.1.0\nNetwork=todo.network\n"},
+		{"todo-backend.container", `HealthCmd=["curl","-f","http://localhost:8080/health"]` + "\nHealthInterval=30s\nHealthRetries=3\n"},
+		{"todo-backend.container", "PodmanArgs=--cpus=0.5\nPodmanArgs=--memory=512M\nPidsLimit=100\nLogDriver=json-file\nLogOpt=max-size=10m\n"},
+		{"todo-backend.container", "[Service]\nRestart=on-failure\n"},
+		{"redis.container", "Image=docker.io/library/redis@sha256:0123abcd\n"},
+		{"redis.container", "Restart=always\n"},
+		{"todo-frontend.container", "Image=registry.corp:5000/team/todo-frontend:v1.2.0\n"},
+		{"todo-frontend.container", "Restart=no\n\n[Install]\nWantedBy=default.target\n"},
+	}
+	for _, tt := range tests {
+		if got := string(files[tt.file]); !strings.Contains(got, tt.want) {
+			t.Errorf("%s =\n%s\nwant it to contain\n%s", tt.file, got, tt.want)
+		}
+	}
+
+	cmds := []struct {
+		test []string
+		want string
+	}{
+		{[]string{"CMD-SHELL", "curl -f http://localhost/ || exit 1"}, "curl -f http://localhost/ || exit 1"},
+		{[]string{"NONE"}, "none"},
+		{[]string{"curl"}, ""},
+	}
+	for _, tt := range cmds {
+		got, err := healthCmd(tt.test)
+		if got != tt.want || (err != nil) != (tt.want == "") {
+			t.Errorf("healthCmd(%q) = %q, %v, want %q", tt.test, got, err, tt.want)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	dir := t.TempDir()
+	paths, err := Write(dir, "quadlet", testManifest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 4 || paths[0] != filepath.Join(dir, "redis.container") {
+		t.Errorf("Write() = %v", paths)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "todo.network")); err != nil {
+		t.Error(err)
+	}
+
+	bad := testManifest()
+	bad.Services[0].Runtime.Restart = "sometimes"
+	tests := []struct {
+		name   string
+		output string
+		m      *manifest.Manifest
+	}{
+		{"unknown output", "kubernetes", testManifest()},
+		{"invalid runtime", "nomad", bad},
+	}
+	for _, tt := range tests {
+		if _, err := Write(t.TempDir(), tt.output, tt.m); err == nil {
+			t.Errorf("%s: Write() succeeded", tt.name)
+		}
+	}
+}
+
+func TestMemoryMiB(t *testing.T) {
+	tests := []struct {
+		amount string
+		want   int
+	}{
+		{"512M", 512},
+		{"512m", 512},
+		{"1g", 1024},
+		{"1.5GiB", 1536},
+		{"1048576", 1},
+		{"100k", 1},
+		{"lots", 0},
+	}
+	for _, tt := range tests {
+		got, err := memoryMiB(tt.amount)
+		if got != tt.want || (err != nil) != (tt.want == 0) {
+			t.Errorf("memoryMiB(%q) = %d, %v, want %d", tt.amount, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Package schedule keeps the next run time of a set of jobs that each
+// repeat at their own interval, such as checking each service's registry.
+// Runs are spread out with jitter so jobs with the same interval don't all
+// come due at once.
+package schedule
+
+import (
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Entry is a job's schedule.
+type Entry struct {
+	Key      string        `json:"key"`
+	Interval time.Duration `json:"interval"`
+	// Last is when the job last ran, zero if it hasn't yet.
+	Last time.Time `json:"last,omitzero"`
+	Next time.Time `json:"next"`
+}
+
+// Scheduler tracks when jobs are due. It is safe for concurrent use.
+type Scheduler struct {
+	// Jitter moves each run by up to this fraction of the interval either
+	// way, e.g. 0.1 runs a job every 9 to 11 minutes for an interval of 10.
+	Jitter float64
+	// Rand returns numbers in [0, 1) for the jitter; rand.Float64 when nil.
+	Rand func() float64
+
+	mu      sync.Mutex
+	entries map[string]*Entry
+}
+
+// New returns an empty scheduler with jitter.
+func New(jitter float64) *Scheduler {
+	return &Scheduler{Jitter: jitter, entries: map[string]*Entry{}}
+}
+
+// Set makes intervals the jobs. New jobs are due at now, jobs no longer
+// listed are dropped, and jobs whose interval changed are rescheduled from
+// their last run.
+func (s *Scheduler) Set(intervals map[string]time.Duration, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.entries == nil {
+		s.entries = map[string]*Entry{}
+	}
+	for key := range s.entries {
+		if _, ok := intervals[key]; !ok {
+			delete(s.entries, key)
+		}
+	}
+	for key, interval := range intervals {
+		e, ok := s.entries[key]
+		switch {
+		case !ok:
+			s.entries[key] = &Entry{Key: key, Interval: interval, Next: now}
+		case e.Interval != interval:
+			e.Interval = interval
+			if !e.Last.IsZero() {
+				e.Next = s.after(e.Last, interval)
+			}
+		}
+	}
+}
+
+// after is a jittered interval after t.
+func (s *Scheduler) after(t time.Time, interval time.Duration) time.Time {
+	r := s.Rand
+	if r == nil {
+		r = rand.Float64
+	}
+	jitter := (2*r() - 1) * s.Jitter * float64(interval)
+	return t.Add(interval + time.Duration(jitter))
+}
+
+// Due returns the keys of the jobs due at now, in order.
+func (s *Scheduler) Due(now time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []string
+	for key, e := range s.entries {
+		if !e.Next.After(now) {
+			due = append(due, key)
+		}
+	}
+	sort.Strings(due)
+	return due
+}
+
+// Done records that the jobs keys ran at now and schedules their next runs.
+func (s *Scheduler) Done(keys []string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		if e, ok := s.entries[key]; ok {
+			e.Last = now
+			e.Next = s.after(now, e.Interval)
+		}
+	}
+}
+
+// Next is when the next job is due, zero when there are none.
+func (s *Scheduler) Next() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var next time.Time
+	for _, e := range s.entries {
+		if next.IsZero() || e.Next.Before(next) {
+			next = e.Next
+		}
+	}
+	return next
+}
+
+// Entries returns the jobs in the order they are due.
+func (s *Scheduler) Entries() []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := make([]Entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].Next.Equal(entries[j].Next) {
+			return entries[i].Next.Before(entries[j].Next)
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
@@ -0,0 +1,100 @@
+package schedule
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScheduler(t *testing.T) {
+	start := time.Date(2025, 3, 3, 12, 0, 0, 0, time.UTC)
+	s := New(0)
+	s.Set(map[string]time.Duration{"nginx": 24 * time.Hour, "todo-backend": 5 * time.Minute}, start)
+
+	steps := []struct {
+		name string
+		at   time.Duration // offset from start
+		due  []string
+	}{
+		{"all due at first", 0, []string{"nginx", "todo-backend"}},
+		{"nothing due yet", 4 * time.Minute, nil},
+		{"fast service due", 5 * time.Minute, []string{"todo-backend"}},
+		{"slow service due a day later", 24 * time.Hour, []string{"nginx", "todo-backend"}},
+	}
+	for _, st := range steps {
+		now := start.Add(st.at)
+		due := s.Due(now)
+		if !slices.Equal(due, st.due) {
+			t.Errorf("%s: Due = %v, want %v", st.name, due, st.due)
+		}
+		s.Done(due, now)
+	}
+	if got, want := s.Next(), start.Add(24*time.Hour+5*time.Minute); !got.Equal(want) {
+		t.Errorf("Next = %v, want %v", got, want)
+	}
+	entries := s.Entries()
+	if len(entries) != 2 || entries[0].Key != "todo-backend" || entries[1].Key != "nginx" {
+		t.Errorf("Entries = %+v, want todo-backend then nginx", entries)
+	}
+}
+
+func TestSchedulerSet(t *testing.T) {
+	start := time.Date(2025, 3, 3, 12, 0, 0, 0, time.UTC)
+	s := New(0)
+	s.Set(map[string]time.Duration{"a": time.Hour, "b": time.Hour}, start)
+	s.Done([]string{"a", "b"}, start)
+
+	later := start.Add(10 * time.Minute)
+	s.Set(map[string]time.Duration{"a": 15 * time.Minute, "c": time.Hour}, later)
+	entries := s.Entries()
+	want := []Entry{
+		{Key: "c", Interval: time.Hour, Next: later},
+		{Key: "a", Interval: 15 * time.Minute, Last: start, Next: start.Add(15 * time.Minute)},
+	}
+	if !slices.Equal(entries, want) {
+		t.Errorf("after Set, Entries = %+v, want %+v", entries, want)
+	}
+}
+
+func TestSchedulerJitter(t *testing.T) {
+	start := time.Date(2025, 3, 3, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		rand float64
+		next time.Duration
+	}{
+		{0, 9 * time.Minute},
+		{0.5, 10 * time.Minute},
+		{0.75, 10*time.Minute + 30*time.Second},
+	}
+	for _, tt := range tests {
+		s := New(0.1)
+		s.Rand = func() float64 { return tt.rand }
+		s.Set(map[string]time.Duration{"a": 10 * time.Minute}, start)
+		s.Done([]string{"a"}, start)
+		if got := s.Next(); !got.Equal(start.Add(tt.next)) {
+			t.Errorf("rand %v: next run after %v, want %v", tt.rand, got.Sub(start), tt.next)
+		}
+	}
+}
+
+func TestSchedulerConcurrent(t *testing.T) {
+	s := New(0.1)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			now := start.Add(time.Duration(i) * time.Minute)
+			s.Set(map[string]time.Duration{"a": time.Minute, "b": time.Hour}, now)
+			s.Done(s.Due(now), now)
+			s.Entries()
+			s.Next()
+		}()
+	}
+	wg.Wait()
+	if len(s.Entries()) != 2 {
+		t.Errorf("Entries = %+v, want 2", s.Entries())
+	}
+}
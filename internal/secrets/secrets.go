@@ -0,0 +1,103 @@
+// Package secrets encrypts and decrypts single values with age, so secrets
+// can sit in files kept in a public repository. Encrypted values are written
+// as
+//
+//	ENC[age,<base64 age ciphertext>]
+//
+// and decrypted with the identities SOPS uses: SOPS_AGE_KEY (identities
+// inline), SOPS_AGE_KEY_FILE, or ~/.config/sops/age/keys.txt. Keys made
+// with age-keygen for SOPS therefore work unchanged.
+package secrets
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+)
+
+const (
+	prefix = "ENC[age,"
+	suffix = "]"
+)
+
+// IsEncrypted reports whether s is an encrypted value.
+func IsEncrypted(s string) bool {
+	return strings.HasPrefix(s, prefix) && strings.HasSuffix(s, suffix)
+}
+
+// Encrypt encrypts plaintext to the given age recipients ("age1...").
+func Encrypt(plaintext string, recipients ...string) (string, error) {
+	if len(recipients) == 0 {
+		return "", errors.New("no recipients")
+	}
+	var rs []age.Recipient
+	for _, r := range recipients {
+		rec, err := age.ParseX25519Recipient(strings.TrimSpace(r))
+		if err != nil {
+			return "", err
+		}
+		rs = append(rs, rec)
+	}
+
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, rs...)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.WriteString(w, plaintext); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return prefix + base64.StdEncoding.EncodeToString(buf.Bytes()) + suffix, nil
+}
+
+// Decrypt returns the plaintext of an encrypted value. Values that are not
+// encrypted are returned unchanged.
+func Decrypt(s string) (string, error) {
+	if !IsEncrypted(s) {
+		return s, nil
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(strings.TrimPrefix(s, prefix), suffix))
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted value: %w", err)
+	}
+	identities, err := loadIdentities()
+	if err != nil {
+		return "", err
+	}
+	r, err := age.Decrypt(bytes.NewReader(ciphertext), identities...)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := io.ReadAll(r)
+	return string(plaintext), err
+}
+
+func loadIdentities() ([]age.Identity, error) {
+	if keys := os.Getenv("SOPS_AGE_KEY"); keys != "" {
+		return age.ParseIdentities(strings.NewReader(keys))
+	}
+	path := os.Getenv("SOPS_AGE_KEY_FILE")
+	if path == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(dir, "sops", "age", "keys.txt")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("no age identity to decrypt with (set SOPS_AGE_KEY or SOPS_AGE_KEY_FILE): %w", err)
+	}
+	defer f.Close()
+	return age.ParseIdentities(f)
+}
@@ -0,0 +1,47 @@
+package secrets
+
+import (
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := Encrypt("https://hooks.example.com/deploy", id.Recipient().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		keys    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"encrypted", id.String(), enc, "https://hooks.example.com/deploy", false},
+		{"plain value passes through", "", "v1.1.0", "v1.1.0", false},
+		{"wrong identity", other.String(), enc, "", true},
+		{"malformed", id.String(), "ENC[age,not base64!]", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("SOPS_AGE_KEY", tt.keys)
+		got, err := Decrypt(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Decrypt() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: Decrypt() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+// Package statestore keeps the releaser daemon's state, such as the
+// freeze, agent reports, webhooks and the audit log, in a database: an
+// embedded SQLite file by default, or Postgres, so a controlplane can keep
+// its state in a managed cluster and outlive the instance it runs on.
+//
+// State is stored as documents by key, which the releaser reads and
+// replaces whole, and as logs by key, which it only appends to.
+package statestore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	// The drivers register themselves as "pgx" and "sqlite".
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+)
+
+// ErrNotFound is returned by Get for keys that aren't stored.
+var ErrNotFound = errors.New("state not found")
+
+// Store keeps state documents and logs by key.
+type Store interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Put stores value as key, replacing what was stored.
+	Put(ctx context.Context, key string, value []byte) error
+	// Delete removes key; removing a key that isn't stored is no error.
+	Delete(ctx context.Context, key string) error
+	// Append adds record to the log key.
+	Append(ctx context.Context, key string, record []byte) error
+	// Records returns the records of the log key, oldest first.
+	Records(ctx context.Context, key string) ([][]byte, error)
+	// Dump returns everything stored.
+	Dump(ctx context.Context) (*Snapshot, error)
+	// Load replaces everything stored with snap.
+	Load(ctx context.Context, snap *Snapshot) error
+	Close() error
+}
+
+// Snapshot is the content of a store, which Load takes into a store of any
+// driver.
+type Snapshot struct {
+	// State are the documents by key.
+	State map[string][]byte
+	// Logs are the records of each log, oldest first, by key.
+	Logs map[string][][]byte
+}
+
+// Drivers.
+const (
+	SQLite   = "sqlite"
+	Postgres = "postgres"
+)
+
+// dialect is the SQL that differs between the drivers.
+type dialect struct {
+	driver string
+	schema []string
+	get    string
+	put    string
+	delete string
+	append string
+	log    string
+	// dumpState and dumpLog select every document and every record,
+	// clear empties the tables.
+	dumpState string
+	dumpLog   string
+	clear     []string
+}
+
+var sqliteDialect = dialect{
+	driver: "sqlite",
+	schema: []string{
+		`CREATE TABLE IF NOT EXISTS state (key TEXT PRIMARY KEY, value BLOB NOT NULL, updated TIMESTAMP NOT NULL)`,
+		`CREATE TABLE IF NOT EXISTS log (id INTEGER PRIMARY KEY AUTOINCREMENT, key TEXT NOT NULL, record BLOB NOT NULL, time TIMESTAMP NOT NULL)`,
+		`CREATE INDEX IF NOT EXISTS log_key ON log (key, id)`,
+	},
+	get:    `SELECT value FROM state WHERE key = ?`,
+	put:    `INSERT INTO state (key, value, updated) VALUES (?, ?, ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value, updated = excluded.updated`,
+	delete: `DELETE FROM state WHERE key = ?`,
+	append: `INSERT INTO log (key, record, time) VALUES (?, ?, ?)`,
+	log:    `SELECT record FROM log WHERE key = ? ORDER BY id`,
+
+	dumpState: `SELECT key, value FROM state`,
+	dumpLog:   `SELECT key, record FROM log ORDER BY id`,
+	clear:     []string{`DELETE FROM state`, `DELETE FROM log`},
+}
+
+var postgresDialect = dialect{
+	driver: "pgx",
+	schema: []string{
+		`CREATE TABLE IF NOT EXISTS releaser_state (key TEXT PRIMARY KEY, value BYTEA NOT NULL, updated TIMESTAMPTZ NOT NULL)`,
+		`CREATE TABLE IF NOT EXISTS releaser_log (id BIGSERIAL PRIMARY KEY, key TEXT NOT NULL, record BYTEA NOT NULL, time TIMESTAMPTZ NOT NULL)`,
+		`CREATE INDEX IF NOT EXISTS releaser_log_key ON releaser_log (key, id)`,
+	},
+	get:    `SELECT value FROM releaser_state WHERE key = $1`,
+	put:    `INSERT INTO releaser_state (key, value, updated) VALUES ($1, $2, $3) ON CONFLICT (key) DO UPDATE SET value = excluded.value, updated = excluded.updated`,
+	delete: `DELETE FROM releaser_state WHERE key = $1`,
+	append: `INSERT INTO releaser_log (key, record, time) VALUES ($1, $2, $3)`,
+	log:    `SELECT record FROM releaser_log WHERE key = $1 ORDER BY id`,
+
+	dumpState: `SELECT key, value FROM releaser_state`,
+	dumpLog:   `SELECT key, record FROM releaser_log ORDER BY id`,
+	clear:     []string{`DELETE FROM releaser_state`, `DELETE FROM releaser_log`},
+}
+
+// Open returns the store of driver at dsn: for SQLite the path of the
+// database file, created if need be, for Postgres a connection string
+// such as postgres://releaser@db.internal/releaser. The tables are created
+// when they don't exist; Postgres's are prefixed releaser_ so the
+// database can be shared.
+func Open(ctx context.Context, driver, dsn string) (Store, error) {
+	if dsn == "" {
+		return nil, fmt.Errorf("the %s driver needs a data source", driver)
+	}
+	var d dialect
+	switch driver {
+	case SQLite:
+		d = sqliteDialect
+		if err := os.MkdirAll(filepath.Dir(dsn), 0755); err != nil {
+			return nil, err
+		}
+		// The releaser's state holds webhook secrets.
+		f, err := os.OpenFile(dsn, os.O_CREATE|os.O_RDONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+		dsn = "file:" + dsn + "?_pragma=busy_timeout(5000)"
+	case Postgres:
+		d = postgresDialect
+	default:
+		return nil, fmt.Errorf("unknown driver %q, expected %s or %s", driver, SQLite, Postgres)
+	}
+	db, err := sql.Open(d.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if driver == SQLite {
+		// SQLite takes one writer at a time; more connections only wait
+		// on its lock.
+		db.SetMaxOpenConns(1)
+	}
+	for _, stmt := range d.schema {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("error creating the %s tables: %w", driver, err)
+		}
+	}
+	return &sqlStore{db: db, dialect: d}, nil
+}
+
+type sqlStore struct {
+	db *sql.DB
+	dialect
+}
+
+func (s *sqlStore) Get(ctx context.Context, key string) ([]byte, error) {
+	var value []byte
+	err := s.db.QueryRowContext(ctx, s.get, key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (s *sqlStore) Put(ctx context.Context, key string, value []byte) error {
+	_, err := s.db.ExecContext(ctx, s.put, key, value, time.Now().UTC())
+	return err
+}
+
+func (s *sqlStore) Delete(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, s.delete, key)
+	return err
+}
+
+func (s *sqlStore) Append(ctx context.Context, key string, record []byte) error {
+	_, err := s.db.ExecContext(ctx, s.append, key, record, time.Now().UTC())
+	return err
+}
+
+func (s *sqlStore) Records(ctx context.Context, key string) ([][]byte, error) {
+	rows, err := s.db.QueryContext(ctx, s.log, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records [][]byte
+	for rows.Next() {
+		var record []byte
+		if err := rows.Scan(&record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+func (s *sqlStore) Dump(ctx context.Context) (*Snapshot, error) {
+	snap := &Snapshot{State: map[string][]byte{}, Logs: map[string][][]byte{}}
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	for _, q := range []struct {
+		query string
+		add   func(key string, value []byte)
+	}{
+		{s.dumpState, func(key string, value []byte) { snap.State[key] = value }},
+		{s.dumpLog, func(key string, record []byte) { snap.Logs[key] = append(snap.Logs[key], record) }},
+	} {
+		rows, err := tx.QueryContext(ctx, q.query)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var key string
+			var value []byte
+			if err := rows.Scan(&key, &value); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			q.add(key, value)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return snap, nil
+}
+
+func (s *sqlStore) Load(ctx context.Context, snap *Snapshot) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range s.clear {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	now := time.Now().UTC()
+	for key, value := range snap.State {
+		if _, err := tx.ExecContext(ctx, s.put, key, value, now); err != nil {
+			return err
+		}
+	}
+	for key, records := range snap.Logs {
+		for _, record := range records {
+			if _, err := tx.ExecContext(ctx, s.append, key, record, now); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
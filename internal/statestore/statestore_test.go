@@ -0,0 +1,147 @@
+package statestore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// testStore exercises s; the stores of every driver behave the same.
+func testStore(t *testing.T, s Store) {
+	ctx := context.Background()
+	if _, err := s.Get(ctx, "freeze.json"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of a missing key = %v, want ErrNotFound", err)
+	}
+	steps := []struct {
+		name  string
+		do    func() error
+		key   string
+		value string
+	}{
+		{"put", func() error { return s.Put(ctx, "freeze.json", []byte(`{"reason": "launch"}`)) }, "freeze.json", `{"reason": "launch"}`},
+		{"replace", func() error { return s.Put(ctx, "freeze.json", []byte(`{"reason": "incident"}`)) }, "freeze.json", `{"reason": "incident"}`},
+		{"other key", func() error { return s.Put(ctx, "agents.json", []byte(`{}`)) }, "freeze.json", `{"reason": "incident"}`},
+		{"delete", func() error { return s.Delete(ctx, "freeze.json") }, "freeze.json", ""},
+		{"delete again", func() error { return s.Delete(ctx, "freeze.json") }, "freeze.json", ""},
+	}
+	for _, tt := range steps {
+		if err := tt.do(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got, err := s.Get(ctx, tt.key)
+		if tt.value == "" && !errors.Is(err, ErrNotFound) || tt.value != "" && (err != nil || string(got) != tt.value) {
+			t.Errorf("%s: Get(%s) = %q, %v, want %q", tt.name, tt.key, got, err, tt.value)
+		}
+	}
+
+	for _, r := range []string{`{"action": "one"}`, `{"action": "two"}`} {
+		if err := s.Append(ctx, "audit", []byte(r)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Append(ctx, "other", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	records, err := s.Records(ctx, "audit")
+	var got []string
+	for _, r := range records {
+		got = append(got, string(r))
+	}
+	if err != nil || !slices.Equal(got, []string{`{"action": "one"}`, `{"action": "two"}`}) {
+		t.Errorf("Records(audit) = %q, %v", got, err)
+	}
+	if records, err := s.Records(ctx, "missing"); err != nil || len(records) != 0 {
+		t.Errorf("Records(missing) = %q, %v", records, err)
+	}
+
+	snap, err := s.Dump(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Snapshot{
+		State: map[string][]byte{"agents.json": []byte(`{}`)},
+		Logs:  map[string][][]byte{"audit": {[]byte(`{"action": "one"}`), []byte(`{"action": "two"}`)}, "other": {[]byte(`{}`)}},
+	}
+	if !reflect.DeepEqual(snap, want) {
+		t.Errorf("Dump() = %q, want %q", snap, want)
+	}
+	if err := s.Put(ctx, "freeze.json", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Load(ctx, &Snapshot{State: map[string][]byte{"tags.json": []byte(`{}`)}, Logs: map[string][][]byte{"audit": {[]byte(`{"action": "three"}`)}}}); err != nil {
+		t.Fatal(err)
+	}
+	if snap, err := s.Dump(ctx); err != nil || len(snap.State) != 1 || snap.State["tags.json"] == nil || len(snap.Logs) != 1 || len(snap.Logs["audit"]) != 1 {
+		t.Errorf("Dump() after Load() = %q, %v, want only what was loaded", snap, err)
+	}
+}
+
+func TestSQLite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "state.db")
+	s, err := Open(context.Background(), SQLite, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+	if err := s.Put(context.Background(), "kept.json", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("database file %v, %v, want mode 0600", fi, err)
+	}
+
+	s, err = Open(context.Background(), SQLite, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got, err := s.Get(context.Background(), "kept.json"); err != nil || string(got) != `{}` {
+		t.Errorf("Get after reopening = %q, %v", got, err)
+	}
+}
+
+// TestPostgres runs against the database STATESTORE_TEST_POSTGRES names,
+// e.g. postgres://postgres@localhost/releaser_test, and is skipped
+// without one.
+func TestPostgres(t *testing.T) {
+	dsn := os.Getenv("STATESTORE_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("STATESTORE_TEST_POSTGRES is not set")
+	}
+	s, err := Open(context.Background(), Postgres, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+	s.(*sqlStore).db.ExecContext(ctx, `TRUNCATE releaser_state, releaser_log`)
+	testStore(t, s)
+}
+
+func TestOpen(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, []byte("not a directory"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		driver string
+		dsn    string
+	}{
+		{"unknown driver", "mysql", "releaser@/releaser"},
+		{"no data source", Postgres, ""},
+		{"unreachable", Postgres, "postgres://releaser@127.0.0.1:1/releaser?connect_timeout=1"},
+		{"unwritable", SQLite, filepath.Join(file, "state.db")},
+	}
+	for _, tt := range tests {
+		if s, err := Open(context.Background(), tt.driver, tt.dsn); err == nil {
+			s.Close()
+			t.Errorf("%s: Open() succeeded", tt.name)
+		}
+	}
+}